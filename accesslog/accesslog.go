@@ -0,0 +1,268 @@
+// Access logging observer, writes a line for every request proxied to the endpoints
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Format defines the layout of the access log lines
+type Format int
+
+const (
+	// Apache combined log format followed by request id, attempt count and total duration in seconds, e.g.
+	// 127.0.0.1 - - [04/Mar/2012:05:06:07 +0000] "GET /hello HTTP/1.1" 200 5 "-" "curl/7.35.0" 12 1 0.013
+	CombinedFormat Format = iota
+	// One JSON object per line, see Entry for the field names
+	JsonFormat
+)
+
+// Entry is the access log record, it is serialized as is in JsonFormat
+type Entry struct {
+	Time      time.Time `json:"time"`
+	RequestId int64     `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Duration  float64   `json:"duration"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Options struct {
+	// Layout of the log lines, CombinedFormat by default
+	Format Format
+	// If set, lines are written to the writer in a separate goroutine, so a slow writer does not block
+	// the requests. Lines that do not fit into the queue are dropped. 0 means write synchronously.
+	QueueSize int
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+// AccessLogger is an observer that writes a line for every attempt to proxy the request to the endpoint.
+// Duration is counted from the start of the first attempt, so the line of the last attempt
+// has the total duration of the request.
+type AccessLogger struct {
+	writer  io.Writer
+	options Options
+	// Serializes writes in synchronous mode
+	mutex   *sync.Mutex
+	lines   chan []byte
+	closed  bool
+	dropped int64
+	done    chan struct{}
+}
+
+func New(w io.Writer) (*AccessLogger, error) {
+	return NewWithOptions(w, Options{})
+}
+
+func NewWithOptions(w io.Writer, o Options) (*AccessLogger, error) {
+	if w == nil {
+		return nil, fmt.Errorf("Provide writer")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	l := &AccessLogger{
+		writer:  w,
+		options: o,
+		mutex:   &sync.Mutex{},
+		done:    make(chan struct{}),
+	}
+	if o.QueueSize > 0 {
+		l.lines = make(chan []byte, o.QueueSize)
+		go l.run()
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+// Remembers the start of the first attempt
+func (l *AccessLogger) ObserveRequest(r request.Request) {
+	if _, ok := r.GetUserData(startKey); !ok {
+		r.SetUserData(startKey, l.options.TimeProvider.UtcNow())
+	}
+}
+
+func (l *AccessLogger) ObserveResponse(r request.Request, a request.Attempt) {
+	line, err := l.format(l.newEntry(r, a))
+	if err != nil {
+		log.Errorf("Failed to format access log entry for %s: %s", r, err)
+		return
+	}
+	l.write(line)
+}
+
+// GetDropped returns the amount of lines dropped because the queue was full
+func (l *AccessLogger) GetDropped() int64 {
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// Close stops accepting new lines and waits until the queued lines are written
+func (l *AccessLogger) Close() {
+	l.mutex.Lock()
+	if !l.closed {
+		l.closed = true
+		if l.lines != nil {
+			close(l.lines)
+		}
+	}
+	l.mutex.Unlock()
+	<-l.done
+}
+
+func (l *AccessLogger) newEntry(r request.Request, a request.Attempt) *Entry {
+	now := l.options.TimeProvider.UtcNow()
+	req := r.GetHttpRequest()
+
+	e := &Entry{
+		Time:      now,
+		RequestId: r.GetId(),
+		ClientIP:  clientIP(r),
+		Method:    req.Method,
+		Path:      req.RequestURI,
+		Proto:     req.Proto,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+		Attempts:  len(r.GetAttempts()),
+		Bytes:     -1,
+	}
+	if e.Path == "" {
+		e.Path = req.URL.RequestURI()
+	}
+	if user, _, ok := req.BasicAuth(); ok {
+		e.User = user
+	}
+	if start, ok := r.GetUserData(startKey); ok {
+		e.Duration = now.Sub(start.(time.Time)).Seconds()
+	}
+	if a == nil {
+		return e
+	}
+	if a.GetEndpoint() != nil {
+		e.Endpoint = a.GetEndpoint().GetId()
+	}
+	if re := a.GetResponse(); re != nil {
+		e.Status = re.StatusCode
+		e.Bytes = re.ContentLength
+	}
+	if err := a.GetError(); err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (l *AccessLogger) format(e *Entry) ([]byte, error) {
+	if l.options.Format == JsonFormat {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%s - %s [%s] \"%s %s %s\" %s %s \"%s\" \"%s\" %d %d %.3f\n",
+		dash(e.ClientIP),
+		dash(e.User),
+		e.Time.Format(combinedTimeFormat),
+		e.Method, e.Path, e.Proto,
+		dashInt(int64(e.Status)),
+		dashInt(e.Bytes),
+		dash(e.Referer),
+		dash(e.UserAgent),
+		e.RequestId,
+		e.Attempts,
+		e.Duration)
+	return b.Bytes(), nil
+}
+
+func (l *AccessLogger) write(line []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		atomic.AddInt64(&l.dropped, 1)
+		return
+	}
+	if l.lines == nil {
+		l.writeLine(line)
+		return
+	}
+	select {
+	case l.lines <- line:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+func (l *AccessLogger) run() {
+	defer close(l.done)
+	for line := range l.lines {
+		l.writeLine(line)
+	}
+}
+
+func (l *AccessLogger) writeLine(line []byte) {
+	if _, err := l.writer.Write(line); err != nil {
+		log.Errorf("Failed to write access log: %s", err)
+	}
+}
+
+// clientIP is the address of the client behind the trusted proxies, see Request.GetClientIP
+func clientIP(r request.Request) string {
+	if ip := r.GetClientIP(); ip != nil {
+		return ip.String()
+	}
+	return r.GetHttpRequest().RemoteAddr
+}
+
+func dash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+func dashInt(v int64) string {
+	if v <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", v)
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Format != CombinedFormat && o.Format != JsonFormat {
+		return o, fmt.Errorf("Unsupported format: %d", o.Format)
+	}
+	if o.QueueSize < 0 {
+		return o, fmt.Errorf("Queue size can not be negative")
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
+
+const (
+	startKey           = "__accesslog.start"
+	combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
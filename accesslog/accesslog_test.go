@@ -0,0 +1,140 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestAccessLog(t *testing.T) { TestingT(t) }
+
+type AccessLogSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&AccessLogSuite{})
+
+func (s *AccessLogSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *AccessLogSuite) TestCombined(c *C) {
+	out := &bytes.Buffer{}
+	l, err := NewWithOptions(out, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	req := makeRequest(12)
+	s.proxy(l, req, &request.BaseAttempt{Error: fmt.Errorf("connection refused")})
+	s.proxy(l, req, &request.BaseAttempt{Response: makeResponse(200, 5)})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(len(lines), Equals, 2)
+	c.Assert(lines[0], Equals, `127.0.0.1 - bob [04/Mar/2012:05:06:07 +0000] "GET /hello?a=b HTTP/1.1" - - "-" "curl/7.35.0" 12 1 0.010`)
+	c.Assert(lines[1], Equals, `127.0.0.1 - bob [04/Mar/2012:05:06:07 +0000] "GET /hello?a=b HTTP/1.1" 200 5 "-" "curl/7.35.0" 12 2 0.020`)
+}
+
+func (s *AccessLogSuite) TestJson(c *C) {
+	out := &bytes.Buffer{}
+	l, err := NewWithOptions(out, Options{Format: JsonFormat, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	s.proxy(l, makeRequest(3), &request.BaseAttempt{
+		Response: makeResponse(404, 9),
+		Endpoint: endpoint.MustParseUrl("http://localhost:5000"),
+	})
+
+	var e Entry
+	c.Assert(json.Unmarshal(out.Bytes(), &e), IsNil)
+	c.Assert(e.RequestId, Equals, int64(3))
+	c.Assert(e.ClientIP, Equals, "127.0.0.1")
+	c.Assert(e.Method, Equals, "GET")
+	c.Assert(e.Path, Equals, "/hello?a=b")
+	c.Assert(e.Status, Equals, 404)
+	c.Assert(e.Bytes, Equals, int64(9))
+	c.Assert(e.Endpoint, Equals, "http://localhost:5000")
+	c.Assert(e.Attempts, Equals, 1)
+	c.Assert(e.Duration, Equals, 0.01)
+}
+
+func (s *AccessLogSuite) TestAsync(c *C) {
+	out := &bytes.Buffer{}
+	l, err := NewWithOptions(out, Options{QueueSize: 10, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	s.proxy(l, makeRequest(1), &request.BaseAttempt{Response: makeResponse(200, 5)})
+	s.proxy(l, makeRequest(2), &request.BaseAttempt{Response: makeResponse(200, 5)})
+	l.Close()
+
+	c.Assert(len(strings.Split(strings.TrimSpace(out.String()), "\n")), Equals, 2)
+	c.Assert(l.GetDropped(), Equals, int64(0))
+
+	// Lines are dropped once the logger is closed
+	s.proxy(l, makeRequest(3), &request.BaseAttempt{Response: makeResponse(200, 5)})
+	c.Assert(l.GetDropped(), Equals, int64(1))
+}
+
+func (s *AccessLogSuite) TestBadParams(c *C) {
+	_, err := New(nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewWithOptions(&bytes.Buffer{}, Options{Format: Format(10)})
+	c.Assert(err, NotNil)
+
+	_, err = NewWithOptions(&bytes.Buffer{}, Options{QueueSize: -1})
+	c.Assert(err, NotNil)
+}
+
+// proxy emulates the attempt that takes 10 milliseconds
+func (s *AccessLogSuite) TestClientIP(c *C) {
+	out := &bytes.Buffer{}
+	l, err := NewWithOptions(out, Options{Format: JsonFormat, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	trusted, err := netutils.ParseCIDRs([]string{"127.0.0.0/8"})
+	c.Assert(err, IsNil)
+	req := makeRequest(3)
+	req.GetHttpRequest().Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.(*request.BaseRequest).TrustedProxies = trusted
+	s.proxy(l, req, &request.BaseAttempt{Response: makeResponse(200, 5)})
+
+	var e Entry
+	c.Assert(json.Unmarshal(out.Bytes(), &e), IsNil)
+	c.Assert(e.ClientIP, Equals, "1.2.3.4")
+}
+
+func (s *AccessLogSuite) proxy(l *AccessLogger, r request.Request, a request.Attempt) {
+	l.ObserveRequest(r)
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(10 * time.Millisecond)
+	r.AddAttempt(a)
+	l.ObserveResponse(r, a)
+}
+
+func makeRequest(id int64) request.Request {
+	r := &http.Request{
+		Method:     "GET",
+		URL:        netutils.MustParseUrl("http://localhost/hello?a=b"),
+		RequestURI: "/hello?a=b",
+		Proto:      "HTTP/1.1",
+		RemoteAddr: "127.0.0.1:5678",
+		Header:     http.Header{},
+	}
+	r.Header.Set("User-Agent", "curl/7.35.0")
+	r.SetBasicAuth("bob", "secret")
+	return request.NewBaseRequest(r, id, nil)
+}
+
+func makeResponse(status int, length int64) *http.Response {
+	return &http.Response{StatusCode: status, ContentLength: length}
+}
@@ -0,0 +1,146 @@
+// Middleware that allows or denies the requests by the client IP address
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// ACL rejects the requests from the denied networks with 403 Forbidden. If the allow list is not empty,
+// the clients outside of the allowed networks are rejected too, the deny list takes precedence over the allow list,
+// e.g. to allow the office network except for the guest wifi. Rules can be changed at runtime.
+type ACL struct {
+	mutex *sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func NewACL(allow, deny []string) (*ACL, error) {
+	allowed, err := netutils.ParseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := netutils.ParseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ACL{
+		mutex: &sync.RWMutex{},
+		allow: allowed,
+		deny:  denied,
+	}, nil
+}
+
+func (a *ACL) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	ip := r.GetClientIP()
+	if ip == nil {
+		return nil, fmt.Errorf("Failed to parse client address: %q", req.RemoteAddr)
+	}
+	if !a.IsAllowed(ip) {
+		log.Infof("%s client %s is not allowed", r, ip)
+		return netutils.NewTextResponse(req, http.StatusForbidden, "Forbidden"), nil
+	}
+	return nil, nil
+}
+
+func (a *ACL) ProcessResponse(r request.Request, at request.Attempt) {
+}
+
+// IsAllowed checks the address against the rules
+func (a *ACL) IsAllowed(ip net.IP) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if netutils.ContainsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || netutils.ContainsIP(a.allow, ip)
+}
+
+// AddAllow adds the address or the network to the allow list
+func (a *ACL) AddAllow(cidr string) error {
+	return a.add(&a.allow, cidr)
+}
+
+// RemoveAllow removes the address or the network from the allow list
+func (a *ACL) RemoveAllow(cidr string) error {
+	return a.remove(&a.allow, cidr)
+}
+
+// AddDeny adds the address or the network to the deny list
+func (a *ACL) AddDeny(cidr string) error {
+	return a.add(&a.deny, cidr)
+}
+
+// RemoveDeny removes the address or the network from the deny list
+func (a *ACL) RemoveDeny(cidr string) error {
+	return a.remove(&a.deny, cidr)
+}
+
+// GetAllowed returns the networks in the allow list
+func (a *ACL) GetAllowed() []string {
+	return a.list(&a.allow)
+}
+
+// GetDenied returns the networks in the deny list
+func (a *ACL) GetDenied() []string {
+	return a.list(&a.deny)
+}
+
+func (a *ACL) add(rules *[]*net.IPNet, cidr string) error {
+	n, err := netutils.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if indexOf(*rules, n) != -1 {
+		return nil
+	}
+	*rules = append(*rules, n)
+	return nil
+}
+
+func (a *ACL) remove(rules *[]*net.IPNet, cidr string) error {
+	n, err := netutils.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	i := indexOf(*rules, n)
+	if i == -1 {
+		return fmt.Errorf("Rule %s not found", n)
+	}
+	*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	return nil
+}
+
+func (a *ACL) list(rules *[]*net.IPNet) []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	out := make([]string, len(*rules))
+	for i, n := range *rules {
+		out[i] = n.String()
+	}
+	return out
+}
+
+func indexOf(rules []*net.IPNet, n *net.IPNet) int {
+	for i, r := range rules {
+		if r.String() == n.String() {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,128 @@
+package acl
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestACL(t *testing.T) { TestingT(t) }
+
+type ACLSuite struct{}
+
+var _ = Suite(&ACLSuite{})
+
+func (s *ACLSuite) TestAllowDeny(c *C) {
+	a, err := NewACL([]string{"10.0.0.0/8", "::1"}, []string{"10.1.0.0/16"})
+	c.Assert(err, IsNil)
+
+	tcs := []struct {
+		remoteAddr string
+		allowed    bool
+	}{
+		{"10.0.0.1:1234", true},
+		{"[::1]:1234", true},
+		{"10.1.0.1:1234", false},
+		{"1.2.3.4:1234", false},
+	}
+	for _, tc := range tcs {
+		re, err := a.ProcessRequest(makeRequest(tc.remoteAddr))
+		c.Assert(err, IsNil)
+		if tc.allowed {
+			c.Assert(re, IsNil, Commentf("%s", tc.remoteAddr))
+		} else {
+			c.Assert(re, NotNil, Commentf("%s", tc.remoteAddr))
+			c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+		}
+	}
+}
+
+// Empty allow list allows everyone except for the denied networks
+func (s *ACLSuite) TestDenyOnly(c *C) {
+	a, err := NewACL(nil, []string{"1.2.3.4"})
+	c.Assert(err, IsNil)
+
+	re, err := a.ProcessRequest(makeRequest("1.2.3.4:1234"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+
+	re, err = a.ProcessRequest(makeRequest("1.2.3.5:1234"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+// Client address is the one of the request, with the trusted networks of the proxy
+func (s *ACLSuite) TestRequestClientIP(c *C) {
+	a, err := NewACL(nil, []string{"1.2.3.4"})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("10.0.0.1:1234")
+	r.GetHttpRequest().Header.Set("X-Forwarded-For", "1.2.3.4")
+	re, err := a.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	r.(*request.BaseRequest).TrustedProxies, err = netutils.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+	re, err = a.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+
+	// Forwarded header of the untrusted client is ignored
+	trusted := r.(*request.BaseRequest).TrustedProxies
+	r = makeRequest("5.6.7.8:1234")
+	r.GetHttpRequest().Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.(*request.BaseRequest).TrustedProxies = trusted
+	re, err = a.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	_, err = a.ProcessRequest(makeRequest("bad"))
+	c.Assert(err, ErrorMatches, "Failed to parse client address.*")
+}
+
+func (s *ACLSuite) TestUpdateRules(c *C) {
+	a, err := NewACL(nil, nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(a.AddDeny("1.2.3.0/24"), IsNil)
+	c.Assert(a.AddDeny("1.2.3.0/24"), IsNil)
+	c.Assert(a.GetDenied(), DeepEquals, []string{"1.2.3.0/24"})
+	re, _ := a.ProcessRequest(makeRequest("1.2.3.4:1234"))
+	c.Assert(re, NotNil)
+
+	c.Assert(a.RemoveDeny("1.2.3.0/24"), IsNil)
+	c.Assert(a.RemoveDeny("1.2.3.0/24"), NotNil)
+	re, _ = a.ProcessRequest(makeRequest("1.2.3.4:1234"))
+	c.Assert(re, IsNil)
+
+	c.Assert(a.AddAllow("5.6.7.8"), IsNil)
+	c.Assert(a.GetAllowed(), DeepEquals, []string{"5.6.7.8/32"})
+	re, _ = a.ProcessRequest(makeRequest("1.2.3.4:1234"))
+	c.Assert(re, NotNil)
+	c.Assert(a.RemoveAllow("5.6.7.8/32"), IsNil)
+	c.Assert(a.GetAllowed(), DeepEquals, []string{})
+
+	c.Assert(a.AddAllow("garbage"), NotNil)
+}
+
+func (s *ACLSuite) TestBadParams(c *C) {
+	_, err := NewACL([]string{"10.0.0.0/33"}, nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewACL(nil, []string{"garbage"})
+	c.Assert(err, NotNil)
+
+}
+
+func makeRequest(remoteAddr string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     "GET",
+		RemoteAddr: remoteAddr,
+		URL:        netutils.MustParseUrl("http://localhost/a"),
+		Header:     http.Header{},
+	}, 1, nil)
+}
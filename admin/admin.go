@@ -0,0 +1,374 @@
+// Admin HTTP API that changes the locations, endpoints and middlewares of the running proxy
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mailgun/timetools"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/middleware"
+)
+
+// Admin manages the locations of the router and serves the API to change them at runtime:
+//
+//	router := exproute.NewExpRouter()
+//	a, _ := admin.NewAdminWithOptions(router, admin.Options{
+//		Token:       os.Getenv("VULCAN_ADMIN_TOKEN"),
+//		Middlewares: map[string]admin.MiddlewareFactory{"ratelimit": newRateLimiter},
+//	})
+//	a.AddLocation("PathRegexp(`/api/.*`)", apiLocation)
+//	go http.ListenAndServe("127.0.0.1:8182", a)
+//
+// Admin is the source of truth for the locations it manages, their endpoints and middlewares, so they
+// should be changed through it rather than on the router or the balancers directly to be listed correctly.
+type Admin struct {
+	options   Options
+	router    Router
+	mutex     *sync.Mutex
+	locations map[string]*managedLocation
+	handler   http.Handler
+}
+
+// Router is the router the locations are added to, e.g. exproute.ExpRouter
+type Router interface {
+	AddLocation(expr string, l location.Location) error
+	RemoveLocationById(id string) error
+}
+
+// Balancer is the load balancer with the endpoints that can be changed at runtime, e.g. roundrobin.RoundRobin
+type Balancer interface {
+	AddEndpoint(endpoint.Endpoint) error
+	RemoveEndpoint(endpoint.Endpoint) error
+}
+
+// MiddlewareFactory creates the middleware of its type from the parameters sent to the API
+type MiddlewareFactory func(params json.RawMessage) (middleware.Middleware, error)
+
+type Options struct {
+	// Bearer token the API requests should be authorized with
+	Token string
+	// Authenticates the API requests instead of the token, returns the name of the user for the audit log
+	Authenticate func(r *http.Request) (user string, ok bool)
+	// Middleware types that can be added through the API
+	Middlewares map[string]MiddlewareFactory
+	// Options of the locations created through the API
+	Location httploc.Options
+	// Called for every change made through the API, in addition to the log
+	Audit func(AuditRecord)
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+// LocationInfo describes the location managed by the admin
+type LocationInfo struct {
+	Id         string `json:"id"`
+	Expression string `json:"expression"`
+	// Endpoint URLs in the order they were added
+	Endpoints []string `json:"endpoints"`
+	// Middleware ids in the order of execution, the built in ones are not listed
+	Middlewares []string `json:"middlewares"`
+}
+
+type managedLocation struct {
+	expr      string
+	location  *httploc.HttpLocation
+	endpoints []endpoint.Endpoint
+}
+
+func NewAdmin(router Router, token string) (*Admin, error) {
+	return NewAdminWithOptions(router, Options{Token: token})
+}
+
+func NewAdminWithOptions(router Router, o Options) (*Admin, error) {
+	if router == nil {
+		return nil, fmt.Errorf("Provide router")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	a := &Admin{
+		options:   o,
+		router:    router,
+		mutex:     &sync.Mutex{},
+		locations: make(map[string]*managedLocation),
+	}
+	a.handler = a.newHandler()
+	return a, nil
+}
+
+func (a *Admin) GetOptions() Options {
+	return a.options
+}
+
+// AddLocation adds the location to the router and lets the API manage it.
+// Endpoints are added to the balancer of the location, it should implement Balancer to change them later
+func (a *Admin) AddLocation(expr string, l *httploc.HttpLocation, endpoints ...endpoint.Endpoint) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.locations[l.GetId()]; ok {
+		return fmt.Errorf("Location '%s' already exists", l.GetId())
+	}
+	if len(endpoints) != 0 {
+		if _, ok := l.GetLoadBalancer().(Balancer); !ok {
+			return fmt.Errorf("Load balancer of location '%s' does not support adding endpoints", l.GetId())
+		}
+	}
+	if err := a.router.AddLocation(expr, l); err != nil {
+		return err
+	}
+	m := &managedLocation{expr: expr, location: l}
+	for _, e := range endpoints {
+		if err := m.addEndpoint(e); err != nil {
+			a.router.RemoveLocationById(l.GetId())
+			return err
+		}
+	}
+	a.locations[l.GetId()] = m
+	return nil
+}
+
+// CreateLocation creates the round robin location with the endpoints and adds it, see AddLocation
+func (a *Admin) CreateLocation(id, expr string, urls []string) (*httploc.HttpLocation, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Provide location id")
+	}
+	endpoints := make([]endpoint.Endpoint, len(urls))
+	for i, u := range urls {
+		e, err := endpoint.ParseUrl(u)
+		if err != nil {
+			return nil, fmt.Errorf("Bad endpoint '%s': %s", u, err)
+		}
+		endpoints[i] = e
+	}
+	lb, err := roundrobin.NewRoundRobin()
+	if err != nil {
+		return nil, err
+	}
+	l, err := httploc.NewLocationWithOptions(id, lb, a.options.Location)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.AddLocation(expr, l, endpoints...); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (a *Admin) RemoveLocation(id string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.locations[id]; !ok {
+		return &notFoundError{fmt.Sprintf("Location '%s' not found", id)}
+	}
+	if err := a.router.RemoveLocationById(id); err != nil {
+		return err
+	}
+	delete(a.locations, id)
+	return nil
+}
+
+func (a *Admin) GetLocations() []LocationInfo {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	out := make([]LocationInfo, 0, len(a.locations))
+	for _, m := range a.locations {
+		out = append(out, m.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out
+}
+
+func (a *Admin) GetLocation(id string) (LocationInfo, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	m, ok := a.locations[id]
+	if !ok {
+		return LocationInfo{}, false
+	}
+	return m.info(), true
+}
+
+// GetEndpointSnapshot returns the state of the endpoints of the location as seen by its load balancer,
+// see loadbalance.Snapshotter
+func (a *Admin) GetEndpointSnapshot(locationId string) ([]loadbalance.EndpointSnapshot, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	m, err := a.getLocation(locationId)
+	if err != nil {
+		return nil, err
+	}
+	lb, ok := m.location.GetLoadBalancer().(loadbalance.Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("Load balancer of location '%s' does not support endpoint snapshots", locationId)
+	}
+	return lb.GetSnapshot(), nil
+}
+
+func (a *Admin) AddEndpoint(locationId, u string) error {
+	e, err := endpoint.ParseUrl(u)
+	if err != nil {
+		return fmt.Errorf("Bad endpoint '%s': %s", u, err)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	m, err := a.getLocation(locationId)
+	if err != nil {
+		return err
+	}
+	return m.addEndpoint(e)
+}
+
+// RemoveEndpoint removes the endpoint by its id, e.g. http://10.0.0.1:5000, see endpoint.Endpoint
+func (a *Admin) RemoveEndpoint(locationId, endpointId string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	m, err := a.getLocation(locationId)
+	if err != nil {
+		return err
+	}
+	return m.removeEndpoint(endpointId)
+}
+
+// AddMiddleware creates the middleware of the type registered in the options and adds it to the location
+func (a *Admin) AddMiddleware(locationId, id, middlewareType string, priority int, params json.RawMessage) error {
+	if id == "" || isBuiltIn(id) {
+		return fmt.Errorf("Bad middleware id '%s'", id)
+	}
+	factory, ok := a.options.Middlewares[middlewareType]
+	if !ok {
+		return fmt.Errorf("Unknown middleware type '%s'", middlewareType)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	m, err := a.getLocation(locationId)
+	if err != nil {
+		return err
+	}
+	mw, err := factory(params)
+	if err != nil {
+		return fmt.Errorf("Bad %s middleware params: %s", middlewareType, err)
+	}
+	return m.location.GetMiddlewareChain().Add(id, priority, mw)
+}
+
+func (a *Admin) RemoveMiddleware(locationId, id string) error {
+	if isBuiltIn(id) {
+		return fmt.Errorf("Built in middleware '%s' can not be removed", id)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	m, err := a.getLocation(locationId)
+	if err != nil {
+		return err
+	}
+	if m.location.GetMiddlewareChain().Get(id) == nil {
+		return &notFoundError{fmt.Sprintf("Middleware '%s' not found", id)}
+	}
+	return m.location.GetMiddlewareChain().Remove(id)
+}
+
+func (a *Admin) getLocation(id string) (*managedLocation, error) {
+	m, ok := a.locations[id]
+	if !ok {
+		return nil, &notFoundError{fmt.Sprintf("Location '%s' not found", id)}
+	}
+	return m, nil
+}
+
+func (m *managedLocation) addEndpoint(e endpoint.Endpoint) error {
+	lb, ok := m.location.GetLoadBalancer().(Balancer)
+	if !ok {
+		return fmt.Errorf("Load balancer of location '%s' does not support adding endpoints", m.location.GetId())
+	}
+	for _, existing := range m.endpoints {
+		if existing.GetId() == e.GetId() {
+			return fmt.Errorf("Endpoint '%s' already exists", e.GetId())
+		}
+	}
+	if err := lb.AddEndpoint(e); err != nil {
+		return err
+	}
+	m.endpoints = append(m.endpoints, e)
+	return nil
+}
+
+func (m *managedLocation) removeEndpoint(id string) error {
+	lb, ok := m.location.GetLoadBalancer().(Balancer)
+	if !ok {
+		return fmt.Errorf("Load balancer of location '%s' does not support removing endpoints", m.location.GetId())
+	}
+	for i, e := range m.endpoints {
+		if e.GetId() == id {
+			if err := lb.RemoveEndpoint(e); err != nil {
+				return err
+			}
+			m.endpoints = append(m.endpoints[:i], m.endpoints[i+1:]...)
+			return nil
+		}
+	}
+	return &notFoundError{fmt.Sprintf("Endpoint '%s' not found", id)}
+}
+
+func (m *managedLocation) info() LocationInfo {
+	i := LocationInfo{
+		Id:          m.location.GetId(),
+		Expression:  m.expr,
+		Endpoints:   make([]string, len(m.endpoints)),
+		Middlewares: []string{},
+	}
+	for j, e := range m.endpoints {
+		i.Endpoints[j] = e.GetUrl().String()
+	}
+	for _, id := range m.location.GetMiddlewareChain().List() {
+		if !isBuiltIn(id) {
+			i.Middlewares = append(i.Middlewares, id)
+		}
+	}
+	return i
+}
+
+// isBuiltIn tells whether the middleware is the one the location has added itself, e.g. httploc.BalancerId
+func isBuiltIn(id string) bool {
+	return strings.HasPrefix(id, "__")
+}
+
+type notFoundError struct {
+	message string
+}
+
+func (e *notFoundError) Error() string {
+	return e.message
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Token == "" && o.Authenticate == nil {
+		return o, fmt.Errorf("Provide token or authenticate function")
+	}
+	if o.Token != "" && o.Authenticate != nil {
+		return o, fmt.Errorf("Token and authenticate function are mutually exclusive")
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
@@ -0,0 +1,338 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route/exproute"
+	"github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func TestAdmin(t *testing.T) { TestingT(t) }
+
+type AdminSuite struct {
+	router  *exproute.ExpRouter
+	admin   *Admin
+	api     *httptest.Server
+	proxy   *httptest.Server
+	records []AuditRecord
+}
+
+var _ = Suite(&AdminSuite{})
+
+func (s *AdminSuite) SetUpTest(c *C) {
+	s.records = nil
+	s.router = exproute.NewExpRouter()
+	a, err := NewAdminWithOptions(s.router, Options{
+		Token:       "secret",
+		Middlewares: map[string]MiddlewareFactory{"reject": newRejecter},
+		Audit:       func(r AuditRecord) { s.records = append(s.records, r) },
+	})
+	c.Assert(err, IsNil)
+	s.admin = a
+	s.api = httptest.NewServer(a)
+
+	p, err := vulcan.NewProxy(s.router)
+	c.Assert(err, IsNil)
+	s.proxy = httptest.NewServer(p)
+}
+
+func (s *AdminSuite) TearDownTest(c *C) {
+	s.api.Close()
+	s.proxy.Close()
+}
+
+func (s *AdminSuite) TestCreateLocation(c *C) {
+	backend := testutils.NewTestResponder("hi")
+	defer backend.Close()
+
+	re, body := s.call(c, "POST", "/v1/locations", locationRequest{Id: "loc1", Expression: "TrieRoute(`/hello`)", Endpoints: []string{backend.URL}})
+	c.Assert(re.StatusCode, Equals, http.StatusCreated, Commentf("%s", body))
+	var info LocationInfo
+	c.Assert(json.Unmarshal(body, &info), IsNil)
+	c.Assert(info, DeepEquals, LocationInfo{Id: "loc1", Expression: "TrieRoute(`/hello`)", Endpoints: []string{backend.URL}, Middlewares: []string{}})
+
+	re, body, err := testutils.GET(s.proxy.URL+"/hello", testutils.Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hi")
+
+	re, body = s.call(c, "GET", "/v1/locations", nil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	var infos []LocationInfo
+	c.Assert(json.Unmarshal(body, &infos), IsNil)
+	c.Assert(infos, DeepEquals, []LocationInfo{info})
+
+	re, _ = s.call(c, "DELETE", "/v1/locations/loc1", nil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	re, _, err = testutils.GET(s.proxy.URL+"/hello", testutils.Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+
+	re, _ = s.call(c, "GET", "/v1/locations/loc1", nil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	re, _ = s.call(c, "DELETE", "/v1/locations/loc1", nil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestBadLocation(c *C) {
+	tcs := []locationRequest{
+		{Expression: "TrieRoute(`/hello`)"},
+		{Id: "loc1", Expression: "Bad("},
+		{Id: "loc1", Expression: "TrieRoute(`/hello`)", Endpoints: []string{"not a url"}},
+	}
+	for _, tc := range tcs {
+		re, body := s.call(c, "POST", "/v1/locations", tc)
+		c.Assert(re.StatusCode, Equals, http.StatusBadRequest, Commentf("%v: %s", tc, body))
+	}
+	c.Assert(s.admin.GetLocations(), DeepEquals, []LocationInfo{})
+
+	re, _ := s.callBody(c, "POST", "/v1/locations", "{")
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+
+	_, err := s.admin.CreateLocation("loc1", "TrieRoute(`/a`)", nil)
+	c.Assert(err, IsNil)
+	re, _ = s.call(c, "POST", "/v1/locations", locationRequest{Id: "loc1", Expression: "TrieRoute(`/b`)"})
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *AdminSuite) TestEndpoints(c *C) {
+	a, b := testutils.NewTestResponder("a"), testutils.NewTestResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	_, err := s.admin.CreateLocation("loc1", "TrieRoute(`/hello`)", []string{a.URL})
+	c.Assert(err, IsNil)
+
+	re, _ := s.call(c, "POST", "/v1/locations/loc1/endpoints", endpointRequest{Url: b.URL})
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	re, _ = s.call(c, "POST", "/v1/locations/loc1/endpoints", endpointRequest{Url: b.URL})
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	info, _ := s.admin.GetLocation("loc1")
+	c.Assert(info.Endpoints, DeepEquals, []string{a.URL, b.URL})
+
+	re, _ = s.call(c, "DELETE", "/v1/locations/loc1/endpoints/"+url.PathEscape(a.URL), nil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	info, _ = s.admin.GetLocation("loc1")
+	c.Assert(info.Endpoints, DeepEquals, []string{b.URL})
+
+	for i := 0; i < 3; i++ {
+		_, body, err := testutils.GET(s.proxy.URL+"/hello", testutils.Opts{})
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, "b")
+	}
+
+	re, _ = s.call(c, "DELETE", "/v1/locations/loc1/endpoints/"+url.PathEscape(a.URL), nil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	re, _ = s.call(c, "POST", "/v1/locations/loc2/endpoints", endpointRequest{Url: b.URL})
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	re, _ = s.call(c, "POST", "/v1/locations/loc1/endpoints", endpointRequest{Url: ""})
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *AdminSuite) TestEndpointSnapshot(c *C) {
+	backend := testutils.NewTestResponder("hi")
+	defer backend.Close()
+	_, err := s.admin.CreateLocation("loc1", "TrieRoute(`/hello`)", []string{backend.URL})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		re, _, err := testutils.GET(s.proxy.URL+"/hello", testutils.Opts{})
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	}
+
+	re, body := s.call(c, "GET", "/v1/locations/loc1/endpoints", nil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK, Commentf("%s", body))
+	var snapshot []loadbalance.EndpointSnapshot
+	c.Assert(json.Unmarshal(body, &snapshot), IsNil)
+	c.Assert(snapshot, HasLen, 1)
+	c.Assert(snapshot[0].Url, Equals, backend.URL)
+	c.Assert(snapshot[0].Successes, Equals, int64(3))
+	c.Assert(snapshot[0].Failures, Equals, int64(0))
+	c.Assert(snapshot[0].InFlight, Equals, int64(0))
+	c.Assert(snapshot[0].Healthy, Equals, true)
+
+	re, _ = s.call(c, "GET", "/v1/locations/loc2/endpoints", nil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestMiddlewares(c *C) {
+	backend := testutils.NewTestResponder("hi")
+	defer backend.Close()
+	_, err := s.admin.CreateLocation("loc1", "TrieRoute(`/hello`)", []string{backend.URL})
+	c.Assert(err, IsNil)
+
+	re, body := s.call(c, "POST", "/v1/locations/loc1/middlewares", middlewareRequest{Id: "deny", Type: "reject", Params: json.RawMessage(`{"status": 403}`)})
+	c.Assert(re.StatusCode, Equals, http.StatusOK, Commentf("%s", body))
+	info, _ := s.admin.GetLocation("loc1")
+	c.Assert(info.Middlewares, DeepEquals, []string{"deny"})
+
+	re, _, err = testutils.GET(s.proxy.URL+"/hello", testutils.Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+
+	re, _ = s.call(c, "DELETE", "/v1/locations/loc1/middlewares/deny", nil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	re, _, err = testutils.GET(s.proxy.URL+"/hello", testutils.Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	tcs := []middlewareRequest{
+		{Id: "deny", Type: "unknown"},
+		{Id: "deny", Type: "reject", Params: json.RawMessage(`{"status": "bad"}`)},
+		{Id: "", Type: "reject"},
+		{Id: httploc.BalancerId, Type: "reject"},
+	}
+	for _, tc := range tcs {
+		re, body := s.call(c, "POST", "/v1/locations/loc1/middlewares", tc)
+		c.Assert(re.StatusCode, Equals, http.StatusBadRequest, Commentf("%v: %s", tc, body))
+	}
+	re, _ = s.call(c, "DELETE", "/v1/locations/loc1/middlewares/"+httploc.BalancerId, nil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	re, _ = s.call(c, "DELETE", "/v1/locations/loc1/middlewares/deny", nil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestAddExistingLocation(c *C) {
+	backend := testutils.NewTestResponder("hi")
+	defer backend.Close()
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	l, err := httploc.NewLocation("loc1", rr)
+	c.Assert(err, IsNil)
+	c.Assert(s.admin.AddLocation("TrieRoute(`/hello`)", l), IsNil)
+	c.Assert(s.admin.AddLocation("TrieRoute(`/other`)", l), NotNil)
+
+	re, _ := s.call(c, "POST", "/v1/locations/loc1/endpoints", endpointRequest{Url: backend.URL})
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	_, body, err := testutils.GET(s.proxy.URL+"/hello", testutils.Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hi")
+}
+
+func (s *AdminSuite) TestUnauthorized(c *C) {
+	for _, token := range []string{"", "wrong"} {
+		req, err := http.NewRequest("GET", s.api.URL+"/v1/locations", nil)
+		c.Assert(err, IsNil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		re, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		c.Assert(re.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(re.Header.Get("WWW-Authenticate"), Not(Equals), "")
+	}
+}
+
+func (s *AdminSuite) TestAuthenticate(c *C) {
+	a, err := NewAdminWithOptions(exproute.NewExpRouter(), Options{
+		Authenticate: func(r *http.Request) (string, bool) {
+			user, password, ok := r.BasicAuth()
+			return user, ok && user == "ops" && password == "pass"
+		},
+	})
+	c.Assert(err, IsNil)
+	api := httptest.NewServer(a)
+	defer api.Close()
+
+	re, _, err := testutils.GET(api.URL+"/v1/locations", testutils.Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusUnauthorized)
+
+	re, body, err := testutils.GET(api.URL+"/v1/locations", testutils.Opts{
+		Headers: http.Header{"Authorization": []string{(&netutils.BasicAuth{Username: "ops", Password: "pass"}).String()}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "[]")
+}
+
+func (s *AdminSuite) TestAudit(c *C) {
+	s.call(c, "GET", "/v1/locations", nil)
+	s.call(c, "POST", "/v1/locations", locationRequest{Id: "loc1", Expression: "TrieRoute(`/hello`)"})
+	s.call(c, "DELETE", "/v1/locations/loc2", nil)
+
+	c.Assert(len(s.records), Equals, 2)
+	c.Assert(s.records[0].User, Equals, "token")
+	c.Assert(s.records[0].Action, Equals, "POST /v1/locations")
+	c.Assert(s.records[0].StatusCode, Equals, http.StatusCreated)
+	c.Assert(s.records[0].Error, IsNil)
+	c.Assert(s.records[1].Action, Equals, "DELETE /v1/locations/loc2")
+	c.Assert(s.records[1].StatusCode, Equals, http.StatusNotFound)
+	c.Assert(s.records[1].Error, NotNil)
+}
+
+func (s *AdminSuite) TestBadParams(c *C) {
+	_, err := NewAdmin(nil, "secret")
+	c.Assert(err, NotNil)
+	_, err = NewAdmin(exproute.NewExpRouter(), "")
+	c.Assert(err, NotNil)
+	_, err = NewAdminWithOptions(exproute.NewExpRouter(), Options{
+		Token:        "secret",
+		Authenticate: func(*http.Request) (string, bool) { return "", true },
+	})
+	c.Assert(err, NotNil)
+}
+
+func (s *AdminSuite) call(c *C, method, path string, v interface{}) (*http.Response, []byte) {
+	data := ""
+	if v != nil {
+		out, err := json.Marshal(v)
+		c.Assert(err, IsNil)
+		data = string(out)
+	}
+	return s.callBody(c, method, path, data)
+}
+
+func (s *AdminSuite) callBody(c *C, method, path, data string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, s.api.URL+path, bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", "Bearer secret")
+	re, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return re, body
+}
+
+// rejecter replies to all requests with the status from its params
+type rejecter struct {
+	Status int `json:"status"`
+}
+
+func newRejecter(params json.RawMessage) (middleware.Middleware, error) {
+	r := &rejecter{}
+	if err := json.Unmarshal(params, r); err != nil {
+		return nil, err
+	}
+	if r.Status < 400 {
+		return nil, fmt.Errorf("Bad status %d", r.Status)
+	}
+	return r, nil
+}
+
+func (r *rejecter) ProcessRequest(request.Request) (*http.Response, error) {
+	return nil, errors.FromStatus(r.Status)
+}
+
+func (r *rejecter) ProcessResponse(request.Request, request.Attempt) {
+}
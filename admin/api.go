@@ -0,0 +1,216 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/log"
+
+	"github.com/mailgun/vulcan/auth"
+)
+
+// AuditRecord describes the change made through the API
+type AuditRecord struct {
+	Time       time.Time
+	User       string
+	RemoteAddr string
+	// Method and path of the request, e.g. "DELETE /v1/locations/loc1"
+	Action     string
+	StatusCode int
+	// Error the change has failed with, nil if it has succeeded
+	Error error
+}
+
+// Maximum size of the request bodies, the API requests are small
+const maxBodyBytes = 1 << 20
+
+type locationRequest struct {
+	Id         string   `json:"id"`
+	Expression string   `json:"expression"`
+	Endpoints  []string `json:"endpoints"`
+}
+
+type endpointRequest struct {
+	Url string `json:"url"`
+}
+
+type middlewareRequest struct {
+	Id       string          `json:"id"`
+	Type     string          `json:"type"`
+	Priority int             `json:"priority"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// ServeHTTP serves the API, the requests and responses are JSON:
+//
+//	GET    /v1/locations
+//	POST   /v1/locations                                 {"id": "loc1", "expression": "...", "endpoints": ["http://10.0.0.1:5000"]}
+//	GET    /v1/locations/{id}
+//	DELETE /v1/locations/{id}
+//	GET    /v1/locations/{id}/endpoints                  state of the endpoints, see loadbalance.EndpointSnapshot
+//	POST   /v1/locations/{id}/endpoints                  {"url": "http://10.0.0.2:5000"}
+//	DELETE /v1/locations/{id}/endpoints/{endpoint}       endpoint id is URL encoded, e.g. http%3A%2F%2F10.0.0.2%3A5000
+//	POST   /v1/locations/{id}/middlewares                {"id": "limit", "type": "ratelimit", "priority": 0, "params": {...}}
+//	DELETE /v1/locations/{id}/middlewares/{middleware}
+//
+// Unauthorized requests are replied with 401, every change is logged along with the user who has made it
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.authenticate(r)
+	if !ok {
+		log.Infof("Unauthorized admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vulcan"`)
+		replyError(w, http.StatusUnauthorized, fmt.Errorf("Unauthorized"))
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w = &auditWriter{ResponseWriter: w, admin: a, user: user, req: r}
+	}
+	a.handler.ServeHTTP(w, r)
+}
+
+func (a *Admin) newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/locations", func(w http.ResponseWriter, r *http.Request) {
+		replyJSON(w, http.StatusOK, a.GetLocations())
+	})
+	mux.HandleFunc("POST /v1/locations", func(w http.ResponseWriter, r *http.Request) {
+		var req locationRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		l, err := a.CreateLocation(req.Id, req.Expression, req.Endpoints)
+		if err != nil {
+			replyError(w, statusCode(err), err)
+			return
+		}
+		info, _ := a.GetLocation(l.GetId())
+		replyJSON(w, http.StatusCreated, info)
+	})
+	mux.HandleFunc("GET /v1/locations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		info, ok := a.GetLocation(r.PathValue("id"))
+		if !ok {
+			replyError(w, http.StatusNotFound, fmt.Errorf("Location '%s' not found", r.PathValue("id")))
+			return
+		}
+		replyJSON(w, http.StatusOK, info)
+	})
+	mux.HandleFunc("DELETE /v1/locations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		replyResult(w, a.RemoveLocation(r.PathValue("id")))
+	})
+	mux.HandleFunc("GET /v1/locations/{id}/endpoints", func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := a.GetEndpointSnapshot(r.PathValue("id"))
+		if err != nil {
+			replyError(w, statusCode(err), err)
+			return
+		}
+		replyJSON(w, http.StatusOK, snapshot)
+	})
+	mux.HandleFunc("POST /v1/locations/{id}/endpoints", func(w http.ResponseWriter, r *http.Request) {
+		var req endpointRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		replyResult(w, a.AddEndpoint(r.PathValue("id"), req.Url))
+	})
+	mux.HandleFunc("DELETE /v1/locations/{id}/endpoints/{endpoint}", func(w http.ResponseWriter, r *http.Request) {
+		replyResult(w, a.RemoveEndpoint(r.PathValue("id"), r.PathValue("endpoint")))
+	})
+	mux.HandleFunc("POST /v1/locations/{id}/middlewares", func(w http.ResponseWriter, r *http.Request) {
+		var req middlewareRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		replyResult(w, a.AddMiddleware(r.PathValue("id"), req.Id, req.Type, req.Priority, req.Params))
+	})
+	mux.HandleFunc("DELETE /v1/locations/{id}/middlewares/{middleware}", func(w http.ResponseWriter, r *http.Request) {
+		replyResult(w, a.RemoveMiddleware(r.PathValue("id"), r.PathValue("middleware")))
+	})
+	return mux
+}
+
+func (a *Admin) authenticate(r *http.Request) (string, bool) {
+	if a.options.Authenticate != nil {
+		return a.options.Authenticate(r)
+	}
+	token, ok := auth.BearerToken(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.options.Token)) != 1 {
+		return "", false
+	}
+	return "token", true
+}
+
+func (a *Admin) audit(rec AuditRecord) {
+	if rec.Error != nil {
+		log.Infof("Admin %s from %s: %s failed with %d: %s", rec.User, rec.RemoteAddr, rec.Action, rec.StatusCode, rec.Error)
+	} else {
+		log.Infof("Admin %s from %s: %s, %d", rec.User, rec.RemoteAddr, rec.Action, rec.StatusCode)
+	}
+	if a.options.Audit != nil {
+		a.options.Audit(rec)
+	}
+}
+
+// auditWriter records the change once its result is known
+type auditWriter struct {
+	http.ResponseWriter
+	admin *Admin
+	user  string
+	req   *http.Request
+	err   error
+}
+
+func (w *auditWriter) WriteHeader(code int) {
+	w.admin.audit(AuditRecord{
+		Time:       w.admin.options.TimeProvider.UtcNow(),
+		User:       w.user,
+		RemoteAddr: w.req.RemoteAddr,
+		Action:     w.req.Method + " " + w.req.URL.Path,
+		StatusCode: code,
+		Error:      w.err,
+	})
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(v); err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("Bad request body: %s", err))
+		return false
+	}
+	return true
+}
+
+func replyResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		replyError(w, statusCode(err), err)
+		return
+	}
+	replyJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func replyError(w http.ResponseWriter, code int, err error) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.err = err
+	}
+	replyJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func replyJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Failed to serialize: %s", err)
+		code, data = http.StatusInternalServerError, []byte("{}")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func statusCode(err error) int {
+	if _, ok := err.(*notFoundError); ok {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,17 @@
+// Helpers shared by the authentication middlewares
+package auth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// BearerToken returns the token sent in the Authorization header with the Bearer scheme
+func BearerToken(req *http.Request) (string, bool) {
+	values := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(values) != 2 || !strings.EqualFold(values[0], "Bearer") {
+		return "", false
+	}
+	token := strings.TrimSpace(values[1])
+	return token, token != ""
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestAuth(t *testing.T) { TestingT(t) }
+
+type AuthSuite struct{}
+
+var _ = Suite(&AuthSuite{})
+
+func (s *AuthSuite) TestBearerToken(c *C) {
+	tcs := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer  abc ", "abc", true},
+		{"Bearer ", "", false},
+		{"Basic Ym9iOnNlY3JldA==", "", false},
+		{"", "", false},
+	}
+	for _, tc := range tcs {
+		req := &http.Request{Header: http.Header{}}
+		req.Header.Set("Authorization", tc.header)
+		token, ok := BearerToken(req)
+		c.Assert(token, Equals, tc.token, Commentf("%s", tc.header))
+		c.Assert(ok, Equals, tc.ok, Commentf("%s", tc.header))
+	}
+}
@@ -0,0 +1,112 @@
+// Middleware that authenticates the requests with HTTP basic authentication
+package basic
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// CredentialStore checks the username and the password sent by the client
+type CredentialStore interface {
+	// Authenticate returns false if the credentials are invalid and error if the store has failed to check them
+	Authenticate(username, password string) (bool, error)
+}
+
+// CredentialStoreFunc adapts the function to the CredentialStore interface,
+// e.g. to check the credentials against the database or the user service
+type CredentialStoreFunc func(username, password string) (bool, error)
+
+func (f CredentialStoreFunc) Authenticate(username, password string) (bool, error) {
+	return f(username, password)
+}
+
+// Authenticator rejects the requests without valid credentials with 401 Unauthorized,
+// asking the browsers to prompt for the username and the password
+type Authenticator struct {
+	store   CredentialStore
+	options Options
+}
+
+type Options struct {
+	// Realm sent to the clients in the challenge, DefaultRealm by default
+	Realm string
+	// Remove the Authorization header, so the endpoints do not see the passwords
+	RemoveCredentials bool
+}
+
+const DefaultRealm = "Restricted"
+
+func NewAuthenticator(store CredentialStore) (*Authenticator, error) {
+	return NewAuthenticatorWithOptions(store, Options{})
+}
+
+func NewAuthenticatorWithOptions(store CredentialStore, o Options) (*Authenticator, error) {
+	if store == nil {
+		return nil, fmt.Errorf("Provide credential store")
+	}
+	if o.Realm == "" {
+		o.Realm = DefaultRealm
+	}
+	return &Authenticator{store: store, options: o}, nil
+}
+
+func (au *Authenticator) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	if _, ok := GetUsername(r); !ok {
+		if err := au.authenticate(r); err != nil {
+			return nil, err
+		}
+	}
+	if au.options.RemoveCredentials {
+		req.Header.Del("Authorization")
+	}
+	return nil, nil
+}
+
+func (au *Authenticator) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+func (au *Authenticator) authenticate(r request.Request) error {
+	header := r.GetHttpRequest().Header.Get("Authorization")
+	if header == "" {
+		return au.unauthorized("Credentials required")
+	}
+	auth, err := netutils.ParseAuthHeader(header)
+	if err != nil {
+		log.Infof("%s has invalid authorization header: %s", r, err)
+		return au.unauthorized("Invalid credentials")
+	}
+	ok, err := au.store.Authenticate(auth.Username, auth.Password)
+	if err != nil {
+		log.Errorf("%s failed to check credentials of %q: %s", r, auth.Username, err)
+		return errors.FromStatus(http.StatusInternalServerError)
+	}
+	if !ok {
+		log.Infof("%s has invalid credentials of %q", r, auth.Username)
+		return au.unauthorized("Invalid credentials")
+	}
+	r.SetUserData(UsernameKey, auth.Username)
+	return nil
+}
+
+func (au *Authenticator) unauthorized(reason string) error {
+	return &errors.AuthError{Reason: reason, Challenge: fmt.Sprintf("Basic realm=%q", au.options.Realm)}
+}
+
+// GetUsername returns the name of the user authenticated by the middleware
+func GetUsername(r request.Request) (string, bool) {
+	v, ok := r.GetUserData(UsernameKey)
+	if !ok {
+		return "", false
+	}
+	username, ok := v.(string)
+	return username, ok
+}
+
+// Request user data key with the name of the authenticated user
+const UsernameKey = "basic.username"
@@ -0,0 +1,181 @@
+package basic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestBasic(t *testing.T) { TestingT(t) }
+
+type BasicSuite struct {
+	dir string
+}
+
+var _ = Suite(&BasicSuite{})
+
+func (s *BasicSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *BasicSuite) TestAuthenticate(c *C) {
+	a, err := NewAuthenticator(CredentialStoreFunc(func(username, password string) (bool, error) {
+		return username == "bob" && password == "secret", nil
+	}))
+	c.Assert(err, IsNil)
+
+	r := makeRequest(&netutils.BasicAuth{Username: "bob", Password: "secret"})
+	re, err := a.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	username, ok := GetUsername(r)
+	c.Assert(ok, Equals, true)
+	c.Assert(username, Equals, "bob")
+	c.Assert(r.GetHttpRequest().Header.Get("Authorization"), Not(Equals), "")
+}
+
+func (s *BasicSuite) TestRejected(c *C) {
+	a, err := NewAuthenticatorWithOptions(CredentialStoreFunc(func(username, password string) (bool, error) {
+		return username == "bob" && password == "secret", nil
+	}), Options{Realm: "api"})
+	c.Assert(err, IsNil)
+
+	requests := []request.Request{
+		makeRequest(nil),
+		makeRequest(&netutils.BasicAuth{Username: "bob", Password: "guess"}),
+		makeRequest(&netutils.BasicAuth{Username: "alice", Password: "secret"}),
+	}
+	for _, r := range requests {
+		re, err := a.ProcessRequest(r)
+		c.Assert(re, IsNil)
+		authErr, ok := err.(*errors.AuthError)
+		c.Assert(ok, Equals, true)
+		c.Assert(authErr.Headers().Get("WWW-Authenticate"), Equals, `Basic realm="api"`)
+		_, ok = GetUsername(r)
+		c.Assert(ok, Equals, false)
+	}
+}
+
+func (s *BasicSuite) TestStoreFailure(c *C) {
+	a, err := NewAuthenticator(CredentialStoreFunc(func(username, password string) (bool, error) {
+		return false, fmt.Errorf("database is down")
+	}))
+	c.Assert(err, IsNil)
+
+	_, err = a.ProcessRequest(makeRequest(&netutils.BasicAuth{Username: "bob", Password: "secret"}))
+	c.Assert(err, NotNil)
+	c.Assert(err.(errors.ProxyError).GetStatusCode(), Equals, http.StatusInternalServerError)
+}
+
+func (s *BasicSuite) TestRemoveCredentials(c *C) {
+	a, err := NewAuthenticatorWithOptions(CredentialStoreFunc(func(username, password string) (bool, error) {
+		return true, nil
+	}), Options{RemoveCredentials: true})
+	c.Assert(err, IsNil)
+
+	r := makeRequest(&netutils.BasicAuth{Username: "bob", Password: "secret"})
+	_, err = a.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetHttpRequest().Header.Get("Authorization"), Equals, "")
+}
+
+func (s *BasicSuite) TestHtpasswd(c *C) {
+	path := s.writeFile(c, `# users
+plain:secret
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+md5:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+`)
+	h, err := NewHtpasswd(path)
+	c.Assert(err, IsNil)
+
+	for _, username := range []string{"plain", "sha", "md5"} {
+		ok, err := h.Authenticate(username, "secret")
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true, Commentf("%s", username))
+
+		ok, err = h.Authenticate(username, "guess")
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, false, Commentf("%s", username))
+	}
+
+	ok, err := h.Authenticate("alice", "secret")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *BasicSuite) TestHtpasswdReload(c *C) {
+	path := s.writeFile(c, "bob:secret\n")
+	h, err := NewHtpasswd(path)
+	c.Assert(err, IsNil)
+
+	c.Assert(ioutil.WriteFile(path, []byte("alice:secret\n"), 0600), IsNil)
+	c.Assert(h.Reload(), IsNil)
+	ok, _ := h.Authenticate("bob", "secret")
+	c.Assert(ok, Equals, false)
+	ok, _ = h.Authenticate("alice", "secret")
+	c.Assert(ok, Equals, true)
+
+	// Users are kept if the file is broken
+	c.Assert(ioutil.WriteFile(path, []byte("broken\n"), 0600), IsNil)
+	c.Assert(h.Reload(), NotNil)
+	ok, _ = h.Authenticate("alice", "secret")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *BasicSuite) TestBadParams(c *C) {
+	_, err := NewAuthenticator(nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewHtpasswd(filepath.Join(s.dir, "missing"))
+	c.Assert(err, NotNil)
+
+	_, err = NewHtpasswd(s.writeFile(c, "bob:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC\n"))
+	c.Assert(err, NotNil)
+}
+
+// Hashes of the formats that are not supported are rejected instead of taken for the plain text passwords
+func (s *BasicSuite) TestHtpasswdUnsupportedFormats(c *C) {
+	tcs := []struct {
+		hash  string
+		error string
+	}{
+		{"$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC", "bcrypt hashes are not supported"},
+		{"rqXexS6ZhobKA", "crypt hashes are not supported"},
+		{"{SSHA}Y2Fi1yR3tjoEvVm5QbSmvXivHvL3Mo6F", "{SSHA} hashes are not supported"},
+		{"$1$saltsalt$2vnaRpHa6Jxjz5n83ok8Z0", "\\$1\\$ hashes are not supported"},
+		{"$6$rounds=5000$salt$hash", "\\$6\\$ hashes are not supported"},
+	}
+	for _, tc := range tcs {
+		_, err := NewHtpasswd(s.writeFile(c, "bob:"+tc.hash+"\n"))
+		c.Assert(err, ErrorMatches, "Failed to parse .*: Line 1: "+tc.error, Commentf("%s", tc.hash))
+	}
+}
+
+func (s *BasicSuite) writeFile(c *C, data string) string {
+	f, err := ioutil.TempFile(s.dir, "htpasswd")
+	c.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteString(data)
+	c.Assert(err, IsNil)
+	return f.Name()
+}
+
+func makeRequest(auth *netutils.BasicAuth) request.Request {
+	req := &http.Request{
+		Method: "GET",
+		URL:    netutils.MustParseUrl("http://localhost/a"),
+		Header: http.Header{},
+	}
+	if auth != nil {
+		req.Header.Set("Authorization", auth.String())
+	}
+	return request.NewBaseRequest(req, 1, nil)
+}
@@ -0,0 +1,204 @@
+package basic
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Htpasswd checks the credentials against the users from the file in Apache htpasswd format.
+// Supports the passwords hashed with SHA1 ({SHA}), Apache MD5 ($apr1$) and the plain text passwords.
+// The other formats, e.g. bcrypt, crypt or {SSHA}, are rejected rather than taken for the plain text,
+// use CredentialStoreFunc with their implementation instead. Plain text passwords that start with $ or {
+// or look like crypt hashes are rejected too.
+type Htpasswd struct {
+	path  string
+	mutex *sync.RWMutex
+	users map[string]string
+}
+
+// NewHtpasswd reads the users from the file, call Reload to pick up the changes
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path, mutex: &sync.RWMutex{}}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload rereads the file, the users loaded before are kept if the file can not be read
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users, err := parseHtpasswd(f)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %s", h.path, err)
+	}
+	h.mutex.Lock()
+	h.users = users
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *Htpasswd) Authenticate(username, password string) (bool, error) {
+	h.mutex.RLock()
+	hash, ok := h.users[username]
+	h.mutex.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return checkPassword(hash, password), nil
+}
+
+func parseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		values := strings.SplitN(text, ":", 2)
+		if len(values) != 2 || values[0] == "" {
+			return nil, fmt.Errorf("Line %d: expected user:hash", line)
+		}
+		if err := checkFormat(values[1]); err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err)
+		}
+		users[values[0]] = values[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// checkFormat rejects the hashes checkPassword does not support, as it would take them for the plain text passwords
+func checkFormat(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}") || strings.HasPrefix(hash, apr1Magic):
+		return nil
+	case strings.HasPrefix(hash, "$2"):
+		return fmt.Errorf("bcrypt hashes are not supported")
+	case strings.HasPrefix(hash, "$") || strings.HasPrefix(hash, "{"):
+		scheme := hash
+		if i := strings.IndexAny(hash[1:], "$}"); i != -1 {
+			scheme = hash[:i+2]
+		}
+		return fmt.Errorf("%s hashes are not supported", scheme)
+	case isCrypt(hash):
+		return fmt.Errorf("crypt hashes are not supported")
+	}
+	return nil
+}
+
+// isCrypt tells whether the hash looks like the one of the traditional DES-based crypt:
+// 2 characters of salt and 11 characters of the hash
+func isCrypt(hash string) bool {
+	if len(hash) != 13 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if strings.IndexByte(itoa64, hash[i]) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+func checkPassword(hash, password string) bool {
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.SplitN(strings.TrimPrefix(hash, apr1Magic), "$", 2)[0]
+		expected = apr1(password, salt)
+	default:
+		expected = password
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+}
+
+const apr1Magic = "$apr1$"
+
+// apr1 is the Apache variant of MD5-based crypt
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	final := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic))
+	ctx.Write(s)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(final[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final = ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write(s)
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return apr1Magic + salt + "$" + string(out)
+}
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
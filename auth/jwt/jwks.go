@@ -0,0 +1,204 @@
+package jwt
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+)
+
+// JWKS provides the RSA public keys published by the identity provider as JSON Web Key Set.
+// The keys are fetched on the first use and cached, the set is refetched once the cache expires
+// or the token is signed with the unknown key, e.g. after the provider has rotated the keys.
+// Fetches are at least MinRefreshInterval apart, even if no keys have been fetched yet, so the requests
+// fail fast while the provider is not available instead of waiting for the fetch each.
+// Only one fetch runs at a time and the lock is not held during it, the cached keys are served meanwhile.
+type JWKS struct {
+	url     string
+	options JWKSOptions
+	client  *http.Client
+
+	mutex     *sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// Error of the last fetch, nil if it has succeeded
+	fetchErr error
+	// Closed once the fetch in flight is done, nil if there is none
+	fetching chan struct{}
+}
+
+type JWKSOptions struct {
+	// How long the fetched keys are used before refetching them, DefaultCacheTTL by default
+	CacheTTL time.Duration
+	// Minimum time between the fetches caused by the unknown key ids, DefaultMinRefreshInterval by default
+	MinRefreshInterval time.Duration
+	// Timeout for fetching the keys, DefaultFetchTimeout by default
+	Timeout time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultCacheTTL           = time.Hour
+	DefaultMinRefreshInterval = time.Minute
+	DefaultFetchTimeout       = 10 * time.Second
+)
+
+func NewJWKS(url string) (*JWKS, error) {
+	return NewJWKSWithOptions(url, JWKSOptions{})
+}
+
+func NewJWKSWithOptions(url string, o JWKSOptions) (*JWKS, error) {
+	if url == "" {
+		return nil, fmt.Errorf("Provide JWKS url")
+	}
+	o, err := parseJWKSOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &JWKS{
+		url:     url,
+		options: o,
+		client:  &http.Client{Timeout: o.Timeout},
+		mutex:   &sync.Mutex{},
+	}, nil
+}
+
+func (j *JWKS) GetKey(alg, kid string) (interface{}, error) {
+	if alg != RS256 {
+		return nil, fmt.Errorf("Unexpected algorithm: %s", alg)
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	key, ok := j.keys[kid]
+	for j.fetching != nil && !ok {
+		// The key may come with the fetch in flight
+		fetching := j.fetching
+		j.mutex.Unlock()
+		<-fetching
+		j.mutex.Lock()
+		key, ok = j.keys[kid]
+	}
+
+	now := j.options.TimeProvider.UtcNow()
+	sinceFetch := now.Sub(j.fetchedAt)
+	canFetch := j.fetching == nil && (j.fetchedAt.IsZero() || sinceFetch >= j.options.MinRefreshInterval)
+	if canFetch && (j.keys == nil || !ok || sinceFetch >= j.options.CacheTTL) {
+		j.refresh(now)
+		key, ok = j.keys[kid]
+	}
+	if j.keys == nil {
+		return nil, fmt.Errorf("JWKS from %s is not available: %s", j.url, j.fetchErr)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unknown key id: %q", kid)
+	}
+	return key, nil
+}
+
+// refresh replaces the cached keys with the fetched ones, should be called under lock.
+// The lock is released while the keys are fetched
+func (j *JWKS) refresh(now time.Time) {
+	fetching := make(chan struct{})
+	j.fetching = fetching
+	// Failed fetches count too, so the unavailable provider is not hammered with requests
+	j.fetchedAt = now
+	j.mutex.Unlock()
+
+	keys, err := j.fetch()
+
+	j.mutex.Lock()
+	j.fetching = nil
+	close(fetching)
+	if j.fetchErr = err; err != nil {
+		if j.keys != nil {
+			// Keep using the cached keys while the provider is not available
+			log.Errorf("Failed to refresh JWKS from %s: %s", j.url, err)
+		}
+		return
+	}
+	j.keys = keys
+}
+
+// fetch gets the keys from the url
+func (j *JWKS) fetch() (map[string]*rsa.PublicKey, error) {
+	re, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected JWKS response status: %d", re.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(re.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("Malformed JWKS: %s", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != RS256) {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warningf("Skipping JWKS key %q: %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (k *jsonWebKey) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 2 || exponent.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("Invalid key parameters")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func parseJWKSOptions(o JWKSOptions) (JWKSOptions, error) {
+	if o.CacheTTL < 0 || o.MinRefreshInterval < 0 || o.Timeout < 0 {
+		return o, fmt.Errorf("JWKS options can not be negative")
+	}
+	if o.CacheTTL == 0 {
+		o.CacheTTL = DefaultCacheTTL
+	}
+	if o.MinRefreshInterval == 0 {
+		o.MinRefreshInterval = DefaultMinRefreshInterval
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultFetchTimeout
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
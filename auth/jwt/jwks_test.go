@@ -0,0 +1,207 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "gopkg.in/check.v1"
+)
+
+type JWKSSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&JWKSSuite{})
+
+func (s *JWKSSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *JWKSSuite) TestCachesKeys(c *C) {
+	server, fetches := newJWKSServer(c, &jwksReply{kids: []string{"k1"}})
+	defer server.Close()
+
+	j, err := NewJWKSWithOptions(server.URL, JWKSOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	a, err := NewAuthenticatorWithOptions(j, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		claims, err := a.Verify(signRS256(rsaKey, "k1", map[string]interface{}{"sub": "bob"}))
+		c.Assert(err, IsNil)
+		c.Assert(claims["sub"], Equals, "bob")
+	}
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(1))
+
+	// Cache has expired
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultCacheTTL)
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(2))
+
+	_, err = j.GetKey(HS256, "k1")
+	c.Assert(err, NotNil)
+}
+
+// Keys are refetched when the token is signed with the unknown key, but not too often
+func (s *JWKSSuite) TestRotation(c *C) {
+	reply := &jwksReply{kids: []string{"k1"}}
+	server, fetches := newJWKSServer(c, reply)
+	defer server.Close()
+
+	j, err := NewJWKSWithOptions(server.URL, JWKSOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, IsNil)
+
+	reply.kids = []string{"k1", "k2"}
+	_, err = j.GetKey(RS256, "k2")
+	c.Assert(err, NotNil)
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(1))
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultMinRefreshInterval)
+	_, err = j.GetKey(RS256, "k2")
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(2))
+}
+
+// Cached keys are used while the provider is failing
+func (s *JWKSSuite) TestProviderFailure(c *C) {
+	reply := &jwksReply{kids: []string{"k1"}}
+	server, _ := newJWKSServer(c, reply)
+	defer server.Close()
+
+	j, err := NewJWKSWithOptions(server.URL, JWKSOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, IsNil)
+
+	reply.status = http.StatusInternalServerError
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultCacheTTL)
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, IsNil)
+}
+
+// Slow provider does not hold up the requests signed with the cached keys
+func (s *JWKSSuite) TestSlowFetch(c *C) {
+	reply := &jwksReply{kids: []string{"k1"}}
+	server, fetches := newJWKSServer(c, reply)
+	defer server.Close()
+
+	j, err := NewJWKSWithOptions(server.URL, JWKSOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, IsNil)
+
+	reply.kids = []string{"k1", "k2"}
+	reply.block = make(chan struct{})
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultCacheTTL)
+	results := make(chan error, 2)
+	for _, kid := range []string{"k1", "k2"} {
+		go func(kid string) {
+			_, err := j.GetKey(RS256, kid)
+			results <- err
+		}(kid)
+		for atomic.LoadInt64(fetches) != 2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Cached key is served while the keys are being fetched, and no other fetch is started
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(2))
+
+	// Unknown key waits for the fetch in flight
+	close(reply.block)
+	c.Assert(<-results, IsNil)
+	c.Assert(<-results, IsNil)
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(2))
+}
+
+func (s *JWKSSuite) TestUnavailable(c *C) {
+	j, err := NewJWKSWithOptions("http://localhost:63999/keys", JWKSOptions{Timeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, NotNil)
+}
+
+// Provider that is down at the start is not asked for the keys on every request
+func (s *JWKSSuite) TestUnavailableAtStart(c *C) {
+	reply := &jwksReply{kids: []string{"k1"}, status: http.StatusServiceUnavailable}
+	server, fetches := newJWKSServer(c, reply)
+	defer server.Close()
+
+	j, err := NewJWKSWithOptions(server.URL, JWKSOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		_, err = j.GetKey(RS256, "k1")
+		c.Assert(err, NotNil)
+	}
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(1))
+
+	reply.status = 0
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultMinRefreshInterval / 2)
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, NotNil)
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(1))
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultMinRefreshInterval / 2)
+	_, err = j.GetKey(RS256, "k1")
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt64(fetches), Equals, int64(2))
+}
+
+func (s *JWKSSuite) TestBadParams(c *C) {
+	_, err := NewJWKS("")
+	c.Assert(err, NotNil)
+
+	_, err = NewJWKSWithOptions("http://localhost/keys", JWKSOptions{CacheTTL: -1})
+	c.Assert(err, NotNil)
+}
+
+type jwksReply struct {
+	status int
+	kids   []string
+	// If set, the replies wait until it is closed
+	block chan struct{}
+}
+
+// newJWKSServer publishes the test RSA key under the ids from the reply and counts the fetches
+func newJWKSServer(c *C, reply *jwksReply) (*httptest.Server, *int64) {
+	var fetches int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		if reply.block != nil {
+			<-reply.block
+		}
+		if reply.status != 0 {
+			w.WriteHeader(reply.status)
+			return
+		}
+		var keys []map[string]string
+		for _, kid := range reply.kids {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	return server, &fetches
+}
@@ -0,0 +1,262 @@
+// Middleware that authenticates the requests with JWT bearer tokens
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/auth"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Authenticator verifies the signature and the registered claims of the bearer token sent in the Authorization
+// header, rejects the requests without the valid token with 401 Unauthorized and stores the claims
+// of the valid token in the request user data, so the middlewares down the chain can use them.
+type Authenticator struct {
+	keys    KeyProvider
+	options Options
+}
+
+type Options struct {
+	// Expected issuer of the tokens, iss claim is not checked if empty
+	Issuer string
+	// Expected audience of the tokens, aud claim is not checked if empty
+	Audience string
+	// Allowed clock skew when checking exp and nbf claims
+	Leeway time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+// Claims of the verified token, numbers are decoded as float64
+type Claims map[string]interface{}
+
+// KeyProvider returns the key that verifies the signature of the token signed with the given algorithm and key id,
+// []byte secret for HS256 and *rsa.PublicKey for RS256. It should fail if the algorithm is not expected for the key,
+// so the tokens can not pick the algorithm the proxy verifies them with.
+type KeyProvider interface {
+	GetKey(alg, kid string) (interface{}, error)
+}
+
+// KeyProviderFunc adapts the function to the KeyProvider interface
+type KeyProviderFunc func(alg, kid string) (interface{}, error)
+
+func (f KeyProviderFunc) GetKey(alg, kid string) (interface{}, error) {
+	return f(alg, kid)
+}
+
+// HMACKey verifies HS256 tokens with the shared secret
+func HMACKey(secret []byte) KeyProvider {
+	return KeyProviderFunc(func(alg, kid string) (interface{}, error) {
+		if alg != HS256 {
+			return nil, fmt.Errorf("Unexpected algorithm: %s", alg)
+		}
+		return secret, nil
+	})
+}
+
+// RSAKeys verifies RS256 tokens with the public keys by key id,
+// the key with the empty id verifies the tokens without kid header
+func RSAKeys(keys map[string]*rsa.PublicKey) KeyProvider {
+	return KeyProviderFunc(func(alg, kid string) (interface{}, error) {
+		if alg != RS256 {
+			return nil, fmt.Errorf("Unexpected algorithm: %s", alg)
+		}
+		key, ok := keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("Unknown key id: %q", kid)
+		}
+		return key, nil
+	})
+}
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+)
+
+func NewAuthenticator(keys KeyProvider) (*Authenticator, error) {
+	return NewAuthenticatorWithOptions(keys, Options{})
+}
+
+func NewAuthenticatorWithOptions(keys KeyProvider, o Options) (*Authenticator, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("Provide keys")
+	}
+	if o.Leeway < 0 {
+		return nil, fmt.Errorf("Leeway can not be negative")
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &Authenticator{keys: keys, options: o}, nil
+}
+
+func (au *Authenticator) ProcessRequest(r request.Request) (*http.Response, error) {
+	if _, ok := GetClaims(r); ok {
+		// Verified on the previous attempt
+		return nil, nil
+	}
+	token, ok := auth.BearerToken(r.GetHttpRequest())
+	if !ok {
+		return nil, &errors.AuthError{Reason: "Bearer token required", Challenge: "Bearer"}
+	}
+	claims, err := au.Verify(token)
+	if err != nil {
+		log.Infof("%s has invalid token: %s", r, err)
+		return nil, &errors.AuthError{Reason: "Invalid token", Challenge: `Bearer error="invalid_token"`}
+	}
+	r.SetUserData(ClaimsKey, claims)
+	return nil, nil
+}
+
+func (au *Authenticator) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// Verify checks the signature and the registered claims of the token and returns its claims
+func (au *Authenticator) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	key, err := au.keys.GetKey(header.Alg, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed signature: %s", err)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := au.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (au *Authenticator) checkClaims(claims Claims) error {
+	now := au.options.TimeProvider.UtcNow()
+	if exp, ok := claims["exp"]; ok {
+		t, err := numericDate(exp)
+		if err != nil {
+			return err
+		}
+		if !now.Before(t.Add(au.options.Leeway)) {
+			return fmt.Errorf("Token has expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		t, err := numericDate(nbf)
+		if err != nil {
+			return err
+		}
+		if now.Add(au.options.Leeway).Before(t) {
+			return fmt.Errorf("Token is not valid yet")
+		}
+	}
+	if au.options.Issuer != "" && claims["iss"] != au.options.Issuer {
+		return fmt.Errorf("Unexpected issuer: %v", claims["iss"])
+	}
+	if au.options.Audience != "" && !hasAudience(claims["aud"], au.options.Audience) {
+		return fmt.Errorf("Unexpected audience: %v", claims["aud"])
+	}
+	return nil
+}
+
+// GetClaims returns the claims of the token verified by the authenticator
+func GetClaims(r request.Request) (Claims, bool) {
+	v, ok := r.GetUserData(ClaimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(Claims)
+	return claims, ok
+}
+
+func verifySignature(alg string, key interface{}, signed string, signature []byte) error {
+	switch alg {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("Expected secret for %s, got %T", alg, key)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("Invalid signature")
+		}
+		return nil
+	case RS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Expected RSA public key for %s, got %T", alg, key)
+		}
+		hashed := sha256.Sum256([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], signature); err != nil {
+			return fmt.Errorf("Invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported algorithm: %q", alg)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("Malformed token: %s", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Malformed token: %s", err)
+	}
+	return nil
+}
+
+func numericDate(v interface{}) (time.Time, error) {
+	seconds, ok := v.(float64)
+	if !ok {
+		return time.Time{}, fmt.Errorf("Expected numeric date, got %v", v)
+	}
+	return time.Unix(int64(seconds), 0).UTC(), nil
+}
+
+// hasAudience checks the aud claim, it can be either a single string or an array of strings
+func hasAudience(aud interface{}, expected string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == expected
+	case []interface{}:
+		for _, a := range v {
+			if a == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Request user data key with the Claims of the verified token
+const ClaimsKey = "jwt.claims"
@@ -0,0 +1,194 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestJWT(t *testing.T) { TestingT(t) }
+
+type JWTSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&JWTSuite{})
+
+var secret = []byte("secret")
+
+// Generated once, as generating RSA keys is slow
+var rsaKey = mustGenerateKey()
+
+func (s *JWTSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *JWTSuite) newAuthenticator(c *C, keys KeyProvider, o Options) *Authenticator {
+	o.TimeProvider = s.tm
+	a, err := NewAuthenticatorWithOptions(keys, o)
+	c.Assert(err, IsNil)
+	return a
+}
+
+func (s *JWTSuite) TestHS256(c *C) {
+	a := s.newAuthenticator(c, HMACKey(secret), Options{})
+
+	r := makeRequest("Bearer " + signHS256(secret, map[string]interface{}{"sub": "bob"}))
+	re, err := a.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	claims, ok := GetClaims(r)
+	c.Assert(ok, Equals, true)
+	c.Assert(claims["sub"], Equals, "bob")
+}
+
+func (s *JWTSuite) TestRS256(c *C) {
+	a := s.newAuthenticator(c, RSAKeys(map[string]*rsa.PublicKey{"k1": &rsaKey.PublicKey}), Options{})
+
+	claims, err := a.Verify(signRS256(rsaKey, "k1", map[string]interface{}{"sub": "bob"}))
+	c.Assert(err, IsNil)
+	c.Assert(claims["sub"], Equals, "bob")
+
+	_, err = a.Verify(signRS256(rsaKey, "k2", map[string]interface{}{"sub": "bob"}))
+	c.Assert(err, NotNil)
+}
+
+func (s *JWTSuite) TestRejected(c *C) {
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+
+	now := s.tm.UtcNow().Unix()
+	tcs := []struct {
+		name   string
+		keys   KeyProvider
+		header string
+	}{
+		{"no token", HMACKey(secret), ""},
+		{"basic", HMACKey(secret), "Basic Ym9iOnNlY3JldA=="},
+		{"malformed", HMACKey(secret), "Bearer abc"},
+		{"signature", HMACKey(secret), "Bearer " + signHS256([]byte("other"), map[string]interface{}{})},
+		{"expired", HMACKey(secret), "Bearer " + signHS256(secret, map[string]interface{}{"exp": now})},
+		{"not before", HMACKey(secret), "Bearer " + signHS256(secret, map[string]interface{}{"nbf": now + 10})},
+		{"issuer", HMACKey(secret), "Bearer " + signHS256(secret, map[string]interface{}{"iss": "other"})},
+		{"audience", HMACKey(secret), "Bearer " + signHS256(secret, map[string]interface{}{"aud": []string{"other"}})},
+		{"none", HMACKey(secret), "Bearer " + sign("none", "", nil, map[string]interface{}{})},
+		{"rsa key", RSAKeys(map[string]*rsa.PublicKey{"": &rsaKey.PublicKey}), "Bearer " + signRS256(other, "", map[string]interface{}{})},
+		// Token can not make the proxy verify it with HMAC using the public key as the secret
+		{"algorithm", RSAKeys(map[string]*rsa.PublicKey{"": &rsaKey.PublicKey}), "Bearer " + signHS256(secret, map[string]interface{}{})},
+	}
+	for _, tc := range tcs {
+		a := s.newAuthenticator(c, tc.keys, Options{Issuer: "vulcan", Audience: "api"})
+		r := makeRequest(tc.header)
+		re, err := a.ProcessRequest(r)
+		c.Assert(re, IsNil, Commentf("%s", tc.name))
+		authErr, ok := err.(*errors.AuthError)
+		c.Assert(ok, Equals, true, Commentf("%s", tc.name))
+		c.Assert(authErr.GetStatusCode(), Equals, http.StatusUnauthorized)
+		c.Assert(authErr.Headers().Get("WWW-Authenticate"), Matches, "Bearer.*")
+
+		_, ok = GetClaims(r)
+		c.Assert(ok, Equals, false, Commentf("%s", tc.name))
+	}
+}
+
+func (s *JWTSuite) TestRegisteredClaims(c *C) {
+	a := s.newAuthenticator(c, HMACKey(secret), Options{Issuer: "vulcan", Audience: "api", Leeway: time.Second})
+
+	now := s.tm.UtcNow().Unix()
+	claims, err := a.Verify(signHS256(secret, map[string]interface{}{
+		"iss": "vulcan",
+		"aud": []string{"web", "api"},
+		// Within the leeway
+		"exp": now,
+		"nbf": now + 1,
+	}))
+	c.Assert(err, IsNil)
+	c.Assert(claims["iss"], Equals, "vulcan")
+
+	_, err = a.Verify(signHS256(secret, map[string]interface{}{"iss": "vulcan", "aud": "api", "exp": "tomorrow"}))
+	c.Assert(err, NotNil)
+}
+
+func (s *JWTSuite) TestBadParams(c *C) {
+	_, err := NewAuthenticator(nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewAuthenticatorWithOptions(HMACKey(secret), Options{Leeway: -1})
+	c.Assert(err, NotNil)
+}
+
+func makeRequest(authorization string) request.Request {
+	req := &http.Request{
+		Method: "GET",
+		URL:    netutils.MustParseUrl("http://localhost/a"),
+		Header: http.Header{},
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return request.NewBaseRequest(req, 1, nil)
+}
+
+func signHS256(secret []byte, claims map[string]interface{}) string {
+	return sign(HS256, "", func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}, claims)
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	return sign(RS256, kid, func(signed []byte) []byte {
+		hashed := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		if err != nil {
+			panic(err)
+		}
+		return signature
+	}, claims)
+}
+
+func sign(alg, kid string, signFn func([]byte) []byte, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeSegment(header) + "." + encodeSegment(claims)
+	var signature []byte
+	if signFn != nil {
+		signature = signFn([]byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeSegment(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func mustGenerateKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
@@ -0,0 +1,247 @@
+// Middleware that validates opaque OAuth2 access tokens with the token introspection endpoint (RFC 7662)
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/mailgun/vulcan/auth"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Introspector asks the authorization server whether the bearer token is active, rejects the requests
+// with inactive tokens with 401 Unauthorized and forwards the subject and the scopes of the active tokens
+// to the endpoints in the headers. Introspection results are cached, so the authorization server is asked
+// once per token and cache period.
+type Introspector struct {
+	url     string
+	options Options
+	client  *http.Client
+	mutex   *sync.Mutex
+	cache   *ttlmap.TtlMap
+}
+
+type Options struct {
+	// Credentials of the proxy at the authorization server, sent with basic authentication if set
+	ClientId     string
+	ClientSecret string
+	// Scopes the token must have, requests with the tokens missing any of them are rejected with 403 Forbidden
+	RequiredScopes []string
+	// Request headers the subject and the space separated scopes are forwarded in,
+	// DefaultSubjectHeader and DefaultScopeHeader by default. Headers sent by the clients are removed.
+	SubjectHeader string
+	ScopeHeader   string
+	// How long the introspection results are cached, DefaultCacheTTL by default.
+	// Active tokens are not cached past their expiration time.
+	CacheTTL time.Duration
+	// Maximum amount of cached results, DefaultCacheCapacity by default
+	CacheCapacity int
+	// Timeout for the introspection requests, DefaultTimeout by default
+	Timeout time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultSubjectHeader = "X-Auth-Subject"
+	DefaultScopeHeader   = "X-Auth-Scope"
+	DefaultCacheTTL      = time.Minute
+	DefaultCacheCapacity = 65536
+	DefaultTimeout       = 5 * time.Second
+)
+
+// TokenInfo is the introspection response of the authorization server
+type TokenInfo struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope"`
+	ClientId  string `json:"client_id"`
+	Username  string `json:"username"`
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// HasScope tells whether the token has been granted the scope
+func (t *TokenInfo) HasScope(scope string) bool {
+	for _, s := range strings.Fields(t.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func NewIntrospector(url string) (*Introspector, error) {
+	return NewIntrospectorWithOptions(url, Options{})
+}
+
+func NewIntrospectorWithOptions(url string, o Options) (*Introspector, error) {
+	if url == "" {
+		return nil, fmt.Errorf("Provide introspection url")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := ttlmap.NewMapWithProvider(o.CacheCapacity, o.TimeProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &Introspector{
+		url:     url,
+		options: o,
+		client:  &http.Client{Timeout: o.Timeout},
+		mutex:   &sync.Mutex{},
+		cache:   cache,
+	}, nil
+}
+
+func (in *Introspector) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	req.Header.Del(in.options.SubjectHeader)
+	req.Header.Del(in.options.ScopeHeader)
+
+	info, ok := GetTokenInfo(r)
+	if !ok {
+		token, ok := auth.BearerToken(req)
+		if !ok {
+			return nil, &errors.AuthError{Reason: "Bearer token required", Challenge: "Bearer"}
+		}
+		var err error
+		if info, err = in.Introspect(token); err != nil {
+			log.Errorf("%s failed to introspect token: %s", r, err)
+			return nil, errors.FromStatus(http.StatusServiceUnavailable)
+		}
+		if !info.Active {
+			log.Infof("%s has inactive token", r)
+			return nil, &errors.AuthError{Reason: "Invalid token", Challenge: `Bearer error="invalid_token"`}
+		}
+		for _, scope := range in.options.RequiredScopes {
+			if !info.HasScope(scope) {
+				log.Infof("%s has token without scope %q", r, scope)
+				return nil, errors.FromStatus(http.StatusForbidden)
+			}
+		}
+		r.SetUserData(TokenInfoKey, info)
+	}
+
+	subject := info.Subject
+	if subject == "" {
+		subject = info.Username
+	}
+	if subject != "" {
+		req.Header.Set(in.options.SubjectHeader, subject)
+	}
+	if info.Scope != "" {
+		req.Header.Set(in.options.ScopeHeader, info.Scope)
+	}
+	return nil, nil
+}
+
+func (in *Introspector) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// Introspect returns the cached result or asks the authorization server about the token
+func (in *Introspector) Introspect(token string) (*TokenInfo, error) {
+	// Tokens are credentials, so only their hashes are kept in memory
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	in.mutex.Lock()
+	v, ok := in.cache.Get(key)
+	in.mutex.Unlock()
+	if ok {
+		return v.(*TokenInfo), nil
+	}
+
+	info, err := in.introspect(token)
+	if err != nil {
+		return nil, err
+	}
+	ttl := in.options.CacheTTL
+	if info.Active && info.ExpiresAt != 0 {
+		if untilExpiry := time.Unix(info.ExpiresAt, 0).Sub(in.options.TimeProvider.UtcNow()); untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+	}
+	if seconds := int(ttl / time.Second); seconds > 0 {
+		in.mutex.Lock()
+		in.cache.Set(key, info, seconds)
+		in.mutex.Unlock()
+	}
+	return info, nil
+}
+
+func (in *Introspector) introspect(token string) (*TokenInfo, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest("POST", in.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if in.options.ClientId != "" {
+		req.SetBasicAuth(in.options.ClientId, in.options.ClientSecret)
+	}
+	re, err := in.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected introspection response status: %d", re.StatusCode)
+	}
+	var info TokenInfo
+	if err := json.NewDecoder(re.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("Malformed introspection response: %s", err)
+	}
+	return &info, nil
+}
+
+// GetTokenInfo returns the introspection result of the active token sent with the request
+func GetTokenInfo(r request.Request) (*TokenInfo, bool) {
+	v, ok := r.GetUserData(TokenInfoKey)
+	if !ok {
+		return nil, false
+	}
+	info, ok := v.(*TokenInfo)
+	return info, ok
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.CacheTTL < 0 || o.CacheCapacity < 0 || o.Timeout < 0 {
+		return o, fmt.Errorf("Cache and timeout options can not be negative")
+	}
+	if o.SubjectHeader == "" {
+		o.SubjectHeader = DefaultSubjectHeader
+	}
+	if o.ScopeHeader == "" {
+		o.ScopeHeader = DefaultScopeHeader
+	}
+	if o.CacheTTL == 0 {
+		o.CacheTTL = DefaultCacheTTL
+	}
+	if o.CacheCapacity == 0 {
+		o.CacheCapacity = DefaultCacheCapacity
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
+
+// Request user data key with the TokenInfo of the active token
+const TokenInfoKey = "oauth2.token_info"
@@ -0,0 +1,150 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestOAuth2(t *testing.T) { TestingT(t) }
+
+type IntrospectSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&IntrospectSuite{})
+
+func (s *IntrospectSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *IntrospectSuite) TestActive(c *C) {
+	server, calls := s.newServer(c, map[string]TokenInfo{
+		"t1": {Active: true, Subject: "bob", Scope: "read write", ExpiresAt: s.tm.UtcNow().Add(time.Hour).Unix()},
+	})
+	defer server.Close()
+
+	in, err := NewIntrospectorWithOptions(server.URL, Options{ClientId: "proxy", ClientSecret: "secret", TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("Bearer t1")
+	r.GetHttpRequest().Header.Set("X-Auth-Subject", "admin")
+	re, err := in.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(r.GetHttpRequest().Header.Get("X-Auth-Subject"), Equals, "bob")
+	c.Assert(r.GetHttpRequest().Header.Get("X-Auth-Scope"), Equals, "read write")
+
+	info, ok := GetTokenInfo(r)
+	c.Assert(ok, Equals, true)
+	c.Assert(info.Subject, Equals, "bob")
+
+	// Result is cached
+	_, err = in.ProcessRequest(makeRequest("Bearer t1"))
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt64(calls), Equals, int64(1))
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultCacheTTL)
+	_, err = in.ProcessRequest(makeRequest("Bearer t1"))
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt64(calls), Equals, int64(2))
+}
+
+// Tokens are not cached past their expiration time
+func (s *IntrospectSuite) TestCacheExpiresWithToken(c *C) {
+	server, calls := s.newServer(c, map[string]TokenInfo{
+		"t1": {Active: true, Subject: "bob", ExpiresAt: s.tm.UtcNow().Add(10 * time.Second).Unix()},
+	})
+	defer server.Close()
+
+	in, err := NewIntrospectorWithOptions(server.URL, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	_, err = in.Introspect("t1")
+	c.Assert(err, IsNil)
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(10 * time.Second)
+	_, err = in.Introspect("t1")
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt64(calls), Equals, int64(2))
+}
+
+func (s *IntrospectSuite) TestRejected(c *C) {
+	server, _ := s.newServer(c, map[string]TokenInfo{
+		"t1": {Active: true, Subject: "bob", Scope: "read"},
+	})
+	defer server.Close()
+
+	in, err := NewIntrospectorWithOptions(server.URL, Options{RequiredScopes: []string{"read"}, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	for _, header := range []string{"", "Basic Ym9iOnNlY3JldA==", "Bearer unknown"} {
+		_, err := in.ProcessRequest(makeRequest(header))
+		c.Assert(err, FitsTypeOf, &errors.AuthError{}, Commentf("%s", header))
+	}
+
+	in, err = NewIntrospectorWithOptions(server.URL, Options{RequiredScopes: []string{"write"}, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	_, err = in.ProcessRequest(makeRequest("Bearer t1"))
+	c.Assert(err, NotNil)
+	c.Assert(err.(errors.ProxyError).GetStatusCode(), Equals, http.StatusForbidden)
+}
+
+func (s *IntrospectSuite) TestServerFailure(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	in, err := NewIntrospector(server.URL)
+	c.Assert(err, IsNil)
+
+	_, err = in.ProcessRequest(makeRequest("Bearer t1"))
+	c.Assert(err, NotNil)
+	c.Assert(err.(errors.ProxyError).GetStatusCode(), Equals, http.StatusServiceUnavailable)
+}
+
+func (s *IntrospectSuite) TestBadParams(c *C) {
+	_, err := NewIntrospector("")
+	c.Assert(err, NotNil)
+
+	_, err = NewIntrospectorWithOptions("http://localhost/introspect", Options{CacheTTL: -1})
+	c.Assert(err, NotNil)
+}
+
+// newServer replies with the token info for the known tokens and the inactive token otherwise
+func (s *IntrospectSuite) newServer(c *C, tokens map[string]TokenInfo) (*httptest.Server, *int64) {
+	var calls int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		c.Check(r.Method, Equals, "POST")
+		if user, password, ok := r.BasicAuth(); ok {
+			c.Check(user+":"+password, Equals, "proxy:secret")
+		}
+		info := tokens[r.FormValue("token")]
+		json.NewEncoder(w).Encode(&info)
+	}))
+	return server, &calls
+}
+
+func makeRequest(authorization string) request.Request {
+	req := &http.Request{
+		Method: "GET",
+		URL:    netutils.MustParseUrl("http://localhost/a"),
+		Header: http.Header{},
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return request.NewBaseRequest(req, 1, nil)
+}
@@ -0,0 +1,51 @@
+package signature
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+)
+
+// NonceCache remembers the nonces of the verified requests
+type NonceCache interface {
+	// Add remembers the nonce for the ttl, returns false if the nonce is already there
+	Add(nonce string, ttl time.Duration) (bool, error)
+}
+
+// MemoryNonceCache keeps the nonces in memory of this process, the nonces expiring soonest are evicted
+// once the capacity is reached, so the capacity should hold the nonces of all requests within the ttl
+type MemoryNonceCache struct {
+	mutex  *sync.Mutex
+	nonces *ttlmap.TtlMap
+}
+
+func NewMemoryNonceCache(capacity int, timeProvider timetools.TimeProvider) (*MemoryNonceCache, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("Capacity should be > 0")
+	}
+	if timeProvider == nil {
+		return nil, fmt.Errorf("Supply time provider")
+	}
+	nonces, err := ttlmap.NewMapWithProvider(capacity, timeProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryNonceCache{mutex: &sync.Mutex{}, nonces: nonces}, nil
+}
+
+func (m *MemoryNonceCache) Add(nonce string, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.nonces.Get(nonce); ok {
+		return false, nil
+	}
+	seconds := int((ttl + time.Second - 1) / time.Second)
+	if err := m.nonces.Set(nonce, true, seconds); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,178 @@
+// Middleware that verifies HMAC signatures of the requests
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Verifier rejects the requests that are not signed with the shared secret with 401 Unauthorized.
+// Clients sign the method, the URI, the SHA256 hash of the body, the timestamp and the random nonce
+// and send the signature in the headers, see Sign. Requests with the timestamps too far from
+// the proxy clock are rejected, and the nonces are remembered, so the captured requests can not be replayed.
+type Verifier struct {
+	secret  []byte
+	options Options
+}
+
+type Options struct {
+	// Maximum difference between the request timestamp and the proxy clock, DefaultMaxSkew by default
+	MaxSkew time.Duration
+	// Where to remember the nonces, in memory cache of DefaultNonceCapacity nonces by default.
+	// Use the shared cache if the clients can send the same request to multiple proxy instances.
+	NonceCache NonceCache
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultMaxSkew       = 5 * time.Minute
+	DefaultNonceCapacity = 65536
+)
+
+// Request headers with the signature
+const (
+	TimestampHeader = "X-Signature-Timestamp"
+	NonceHeader     = "X-Signature-Nonce"
+	SignatureHeader = "X-Signature"
+)
+
+func NewVerifier(secret []byte) (*Verifier, error) {
+	return NewVerifierWithOptions(secret, Options{})
+}
+
+func NewVerifierWithOptions(secret []byte, o Options) (*Verifier, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Provide secret")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{secret: secret, options: o}, nil
+}
+
+func (v *Verifier) ProcessRequest(r request.Request) (*http.Response, error) {
+	// Verified on the previous attempt, the nonce has been used by this very request
+	if _, ok := r.GetUserData(verifiedKey); ok {
+		return nil, nil
+	}
+	if err := v.verify(r); err != nil {
+		log.Infof("%s has invalid signature: %s", r, err)
+		return nil, &errors.AuthError{Reason: "Invalid signature"}
+	}
+	r.SetUserData(verifiedKey, true)
+	return nil, nil
+}
+
+func (v *Verifier) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+func (v *Verifier) verify(r request.Request) error {
+	req := r.GetHttpRequest()
+	timestamp, nonce := req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader)
+	signature, err := hex.DecodeString(req.Header.Get(SignatureHeader))
+	if timestamp == "" || nonce == "" || err != nil || len(signature) == 0 {
+		return fmt.Errorf("Missing or malformed signature headers")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Malformed timestamp: %q", timestamp)
+	}
+	skew := v.options.TimeProvider.UtcNow().Sub(time.Unix(seconds, 0))
+	if skew > v.options.MaxSkew || skew < -v.options.MaxSkew {
+		return fmt.Errorf("Timestamp is off by %s", skew)
+	}
+
+	bodyHash, err := hashBody(r)
+	if err != nil {
+		return err
+	}
+	expected := sign(v.secret, stringToSign(timestamp, nonce, req.Method, requestURI(req), bodyHash))
+	if !hmac.Equal(expected, signature) {
+		return fmt.Errorf("Signature mismatch")
+	}
+
+	// Nonces are checked once the signature is verified, so the cache can not be flooded with junk.
+	// The request is valid while its timestamp is within the skew on either side of the clock.
+	fresh, err := v.options.NonceCache.Add(nonce, 2*v.options.MaxSkew)
+	if err != nil {
+		return fmt.Errorf("Failed to check nonce: %s", err)
+	}
+	if !fresh {
+		return fmt.Errorf("Nonce %q has been used", nonce)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded signature of the request for the signature header
+func Sign(secret []byte, timestamp time.Time, nonce, method, uri string, body []byte) string {
+	h := sha256.Sum256(body)
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return hex.EncodeToString(sign(secret, stringToSign(ts, nonce, method, uri, hex.EncodeToString(h[:]))))
+}
+
+func stringToSign(timestamp, nonce, method, uri, bodyHash string) string {
+	return strings.Join([]string{timestamp, nonce, method, uri, bodyHash}, "\n")
+}
+
+func sign(secret []byte, s string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// hashBody reads the buffered body and rewinds it, so it can be proxied to the endpoint
+func hashBody(r request.Request) (string, error) {
+	h := sha256.New()
+	if body := r.GetBody(); body != nil {
+		if _, err := io.Copy(h, body); err != nil {
+			return "", err
+		}
+		if _, err := body.Seek(0, 0); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func requestURI(req *http.Request) string {
+	if req.RequestURI != "" {
+		return req.RequestURI
+	}
+	return req.URL.RequestURI()
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MaxSkew < 0 {
+		return o, fmt.Errorf("Max skew can not be negative")
+	}
+	if o.MaxSkew == 0 {
+		o.MaxSkew = DefaultMaxSkew
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	if o.NonceCache == nil {
+		c, err := NewMemoryNonceCache(DefaultNonceCapacity, o.TimeProvider)
+		if err != nil {
+			return o, err
+		}
+		o.NonceCache = c
+	}
+	return o, nil
+}
+
+const verifiedKey = "__signature.verified"
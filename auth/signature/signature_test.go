@@ -0,0 +1,150 @@
+package signature
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestSignature(t *testing.T) { TestingT(t) }
+
+type SignatureSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&SignatureSuite{})
+
+var secret = []byte("secret")
+
+func (s *SignatureSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *SignatureSuite) newVerifier(c *C) *Verifier {
+	v, err := NewVerifierWithOptions(secret, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	return v
+}
+
+func (s *SignatureSuite) TestValid(c *C) {
+	v := s.newVerifier(c)
+
+	r := s.makeSignedRequest(c, "POST", "/hooks?a=b", "hello", s.tm.UtcNow(), "n1")
+	re, err := v.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	// Body is rewound, so it can be proxied
+	body, err := ioutil.ReadAll(r.GetBody())
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+
+	// Retries of the same request are not treated as replays
+	re, err = v.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *SignatureSuite) TestReplay(c *C) {
+	v := s.newVerifier(c)
+
+	_, err := v.ProcessRequest(s.makeSignedRequest(c, "POST", "/hooks", "hello", s.tm.UtcNow(), "n1"))
+	c.Assert(err, IsNil)
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	_, err = v.ProcessRequest(s.makeSignedRequest(c, "POST", "/hooks", "hello", s.tm.UtcNow().Add(-time.Minute), "n1"))
+	c.Assert(err, FitsTypeOf, &errors.AuthError{})
+}
+
+func (s *SignatureSuite) TestRejected(c *C) {
+	v := s.newVerifier(c)
+	now := s.tm.UtcNow()
+
+	tampered := s.makeSignedRequest(c, "POST", "/hooks", "hello", now, "n1")
+	tampered.GetHttpRequest().Method = "DELETE"
+
+	otherBody := s.makeSignedRequest(c, "POST", "/hooks", "hello", now, "n2")
+	otherBody.SetBody(newBody(c, "hello!"))
+
+	tcs := []struct {
+		name string
+		r    request.Request
+	}{
+		{"unsigned", makeRequest(c, "POST", "/hooks", "hello")},
+		{"method", tampered},
+		{"body", otherBody},
+		{"old", s.makeSignedRequest(c, "POST", "/hooks", "hello", now.Add(-DefaultMaxSkew-time.Second), "n3")},
+		{"future", s.makeSignedRequest(c, "POST", "/hooks", "hello", now.Add(DefaultMaxSkew+time.Second), "n4")},
+	}
+	for _, tc := range tcs {
+		re, err := v.ProcessRequest(tc.r)
+		c.Assert(re, IsNil, Commentf("%s", tc.name))
+		c.Assert(err, FitsTypeOf, &errors.AuthError{}, Commentf("%s", tc.name))
+		c.Assert(err.(*errors.AuthError).GetStatusCode(), Equals, http.StatusUnauthorized)
+	}
+}
+
+func (s *SignatureSuite) TestNonceCacheExpires(c *C) {
+	cache, err := NewMemoryNonceCache(10, s.tm)
+	c.Assert(err, IsNil)
+
+	ok, err := cache.Add("n1", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	ok, err = cache.Add("n1", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	ok, err = cache.Add("n1", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *SignatureSuite) TestBadParams(c *C) {
+	_, err := NewVerifier(nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewVerifierWithOptions(secret, Options{MaxSkew: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewMemoryNonceCache(0, s.tm)
+	c.Assert(err, NotNil)
+}
+
+func (s *SignatureSuite) makeSignedRequest(c *C, method, uri, body string, timestamp time.Time, nonce string) request.Request {
+	r := makeRequest(c, method, uri, body)
+	h := r.GetHttpRequest().Header
+	h.Set(TimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	h.Set(NonceHeader, nonce)
+	h.Set(SignatureHeader, Sign(secret, timestamp, nonce, method, uri, []byte(body)))
+	return r
+}
+
+func makeRequest(c *C, method, uri, body string) request.Request {
+	req := &http.Request{
+		Method:     method,
+		URL:        netutils.MustParseUrl("http://localhost" + uri),
+		RequestURI: uri,
+		Header:     http.Header{},
+	}
+	return request.NewBaseRequest(req, 1, newBody(c, body))
+}
+
+func newBody(c *C, body string) netutils.MultiReader {
+	b, err := netutils.NewBodyBuffer(bytes.NewReader([]byte(body)))
+	c.Assert(err, IsNil)
+	return b
+}
@@ -0,0 +1,310 @@
+// HTTP response caching middleware
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Cache replies to GET requests with the stored responses while they are fresh according to
+// Cache-Control and Expires headers of the endpoint, and stores the cacheable responses.
+// Cache is shared by all the clients, so the requests with Authorization header are served from
+// and stored in the cache only if the response allows it explicitly, see RFC 9111 section 3.5.
+// Insert it before the load balancer, so the cache hits do not reach the balancer middleware:
+//
+//	c, _ := cache.NewCache()
+//	location.GetMiddlewareChain().InsertBefore(httploc.BalancerId, "cache", c)
+type Cache struct {
+	options Options
+	hits    int64
+	misses  int64
+}
+
+type Options struct {
+	// Where to keep the responses, in memory store of DefaultCapacity entries by default
+	Store Store
+	// Responses with larger bodies are not cached, DefaultMaxBodyBytes by default
+	MaxBodyBytes int64
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultCapacity     = 1024
+	DefaultMaxBodyBytes = 1024 * 1024
+)
+
+func NewCache() (*Cache, error) {
+	return NewCacheWithOptions(Options{})
+}
+
+func NewCacheWithOptions(o Options) (*Cache, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{options: o}, nil
+}
+
+// GetHits returns the amount of requests served from the cache
+func (c *Cache) GetHits() int64 {
+	return atomic.LoadInt64(&c.hits)
+}
+
+// GetMisses returns the amount of cacheable requests that were not found in the cache
+func (c *Cache) GetMisses() int64 {
+	return atomic.LoadInt64(&c.misses)
+}
+
+func (c *Cache) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	if req.Method != "GET" {
+		return nil, nil
+	}
+	cc := parseCacheControl(req.Header)
+	if cc.has("no-store") {
+		return nil, nil
+	}
+	key := cacheKey(req)
+	authorized := req.Header.Get("Authorization") != ""
+	if !cc.has("no-cache") && cc["max-age"] != "0" {
+		e, err := c.options.Store.Get(key)
+		if err != nil {
+			log.Errorf("%s failed to get cached response: %s", r, err)
+		} else if e != nil && varyMatches(e, req) && (!authorized || isShared(e.Header)) {
+			atomic.AddInt64(&c.hits, 1)
+			return c.newResponse(req, e), nil
+		}
+	}
+	atomic.AddInt64(&c.misses, 1)
+	r.SetUserData(cacheKeyKey, key)
+	if authorized {
+		// Other middlewares could remove the header before the request reaches the endpoint
+		r.SetUserData(authorizedKey, true)
+	}
+	return nil, nil
+}
+
+func (c *Cache) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// ModifyResponse stores the cacheable response of the endpoint
+func (c *Cache) ModifyResponse(r request.Request, re *http.Response) error {
+	v, ok := r.GetUserData(cacheKeyKey)
+	if !ok {
+		return nil
+	}
+	r.DeleteUserData(cacheKeyKey)
+	_, authorized := r.GetUserData(authorizedKey)
+	r.DeleteUserData(authorizedKey)
+	re.Header.Set(XCache, "MISS")
+
+	now := c.options.TimeProvider.UtcNow()
+	expires, ok := freshUntil(re, now)
+	if !ok || re.Body == nil || (authorized && !isShared(re.Header)) {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(re.Body, c.options.MaxBodyBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > c.options.MaxBodyBytes {
+		// Too large to cache, send what's been read followed by the rest of the body
+		re.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), re.Body), Closer: re.Body}
+		return nil
+	}
+	re.Body.Close()
+	re.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	e := &Entry{
+		StatusCode: re.StatusCode,
+		Header:     make(http.Header),
+		Body:       body,
+		Vary:       varyValues(re, r.GetHttpRequest()),
+		Stored:     now,
+		Expires:    expires,
+	}
+	netutils.CopyHeaders(e.Header, re.Header)
+	netutils.RemoveHopHeaders(e.Header)
+	e.Header.Del(XCache)
+	if err := c.options.Store.Set(v.(string), e); err != nil {
+		log.Errorf("%s failed to store response: %s", r, err)
+	}
+	return nil
+}
+
+func (c *Cache) newResponse(req *http.Request, e *Entry) *http.Response {
+	re := netutils.NewHttpResponse(req, e.StatusCode, e.Body, "")
+	re.Header = make(http.Header)
+	netutils.CopyHeaders(re.Header, e.Header)
+	age := c.options.TimeProvider.UtcNow().Sub(e.Stored)
+	re.Header.Set("Age", strconv.Itoa(int(age/time.Second)))
+	re.Header.Set(XCache, "HIT")
+	return re
+}
+
+// freshUntil returns the time the response becomes stale, false if the response can not be cached
+func freshUntil(re *http.Response, now time.Time) (time.Time, bool) {
+	if !cacheableStatus[re.StatusCode] {
+		return time.Time{}, false
+	}
+	if re.Header.Get("Set-Cookie") != "" || re.Header.Get("Vary") == "*" {
+		return time.Time{}, false
+	}
+	if strings.HasPrefix(re.Header.Get("Content-Type"), "text/event-stream") {
+		return time.Time{}, false
+	}
+	cc := parseCacheControl(re.Header)
+	if cc.has("no-store") || cc.has("no-cache") || cc.has("private") {
+		return time.Time{}, false
+	}
+	// Proxy is a shared cache, so s-maxage takes precedence
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds <= 0 {
+				return time.Time{}, false
+			}
+			return now.Add(time.Duration(seconds) * time.Second), true
+		}
+	}
+	if v := re.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return time.Time{}, false
+		}
+		// Expires is relative to the clock of the endpoint
+		if date, err := http.ParseTime(re.Header.Get("Date")); err == nil {
+			expires = now.Add(expires.Sub(date))
+		}
+		return expires, expires.After(now)
+	}
+	return time.Time{}, false
+}
+
+// isShared tells whether the response to the request with Authorization header can be served
+// to the other clients
+func isShared(h http.Header) bool {
+	cc := parseCacheControl(h)
+	return cc.has("public") || cc.has("s-maxage") || cc.has("must-revalidate")
+}
+
+func cacheKey(req *http.Request) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	return req.Method + " " + req.Host + uri
+}
+
+func varyValues(re *http.Response, req *http.Request) map[string]string {
+	var vary map[string]string
+	for _, v := range re.Header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if vary == nil {
+				vary = make(map[string]string)
+			}
+			vary[name] = req.Header.Get(name)
+		}
+	}
+	return vary
+}
+
+func varyMatches(e *Entry, req *http.Request) bool {
+	for name, value := range e.Vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			vals := strings.SplitN(directive, "=", 2)
+			name := strings.ToLower(vals[0])
+			if len(vals) == 2 {
+				cc[name] = strings.Trim(vals[1], `"`)
+			} else {
+				cc[name] = ""
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Response codes that can be cached when the freshness is set explicitly
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MaxBodyBytes < 0 {
+		return o, fmt.Errorf("Max body bytes can not be negative")
+	}
+	if o.MaxBodyBytes == 0 {
+		o.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	if o.Store == nil {
+		s, err := NewMemoryStore(DefaultCapacity, o.TimeProvider)
+		if err != nil {
+			return o, err
+		}
+		o.Store = s
+	}
+	return o, nil
+}
+
+const (
+	// Tells whether the response was served from the cache, HIT or MISS
+	XCache        = "X-Cache"
+	cacheKeyKey   = "__cache.key"
+	authorizedKey = "__cache.authorized"
+)
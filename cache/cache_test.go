@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestCache(t *testing.T) { TestingT(t) }
+
+type CacheSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&CacheSuite{})
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *CacheSuite) newCache(c *C) *Cache {
+	cache, err := NewCacheWithOptions(Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	return cache
+}
+
+func (s *CacheSuite) TestHit(c *C) {
+	cache := s.newCache(c)
+
+	re, body := s.roundTrip(c, cache, makeRequest("GET", "/a"), makeResponse(200, "hello", "Cache-Control", "max-age=60"))
+	c.Assert(re.Header.Get(XCache), Equals, "MISS")
+	c.Assert(body, Equals, "hello")
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(10 * time.Second)
+	re, err := cache.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, 200)
+	c.Assert(re.Header.Get(XCache), Equals, "HIT")
+	c.Assert(re.Header.Get("Age"), Equals, "10")
+	c.Assert(re.Header.Get("Cache-Control"), Equals, "max-age=60")
+	c.Assert(readBody(c, re), Equals, "hello")
+
+	c.Assert(cache.GetHits(), Equals, int64(1))
+	c.Assert(cache.GetMisses(), Equals, int64(1))
+
+	// Other urls are not affected
+	re, err = cache.ProcessRequest(makeRequest("GET", "/b"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *CacheSuite) TestExpires(c *C) {
+	cache := s.newCache(c)
+
+	s.roundTrip(c, cache, makeRequest("GET", "/a"), makeResponse(200, "hello",
+		"Date", "Sun, 04 Mar 2012 05:06:07 GMT",
+		"Expires", "Sun, 04 Mar 2012 05:07:07 GMT"))
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(59 * time.Second)
+	re, err := cache.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	re, err = cache.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *CacheSuite) TestVary(c *C) {
+	cache := s.newCache(c)
+
+	req := makeRequest("GET", "/a")
+	req.GetHttpRequest().Header.Set("Accept-Language", "en")
+	s.roundTrip(c, cache, req, makeResponse(200, "hello", "Cache-Control", "max-age=60", "Vary", "Accept-Language"))
+
+	req = makeRequest("GET", "/a")
+	req.GetHttpRequest().Header.Set("Accept-Language", "en")
+	re, err := cache.ProcessRequest(req)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+
+	req = makeRequest("GET", "/a")
+	req.GetHttpRequest().Header.Set("Accept-Language", "de")
+	re, err = cache.ProcessRequest(req)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *CacheSuite) TestAuthorization(c *C) {
+	authorized := func(token string) request.Request {
+		r := makeRequest("GET", "/a")
+		r.GetHttpRequest().Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	cache := s.newCache(c)
+
+	// Response to the authorized request is private unless it says otherwise
+	s.roundTrip(c, cache, authorized("alice"), makeResponse(200, "alice's", "Cache-Control", "max-age=60"))
+	c.Assert(cache.options.Store.(*MemoryStore).Len(), Equals, 0)
+	_, body := s.roundTrip(c, cache, authorized("bob"), makeResponse(200, "bob's", "Cache-Control", "max-age=60"))
+	c.Assert(body, Equals, "bob's")
+	re, err := cache.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	// Response of the anonymous request is not served to the authorized one either
+	s.roundTrip(c, cache, makeRequest("GET", "/a"), makeResponse(200, "anonymous", "Cache-Control", "max-age=60"))
+	re, err = cache.ProcessRequest(authorized("alice"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	// Public response is shared
+	for _, cc := range []string{"public, max-age=60", "s-maxage=60", "must-revalidate, max-age=60"} {
+		cache := s.newCache(c)
+		s.roundTrip(c, cache, authorized("alice"), makeResponse(200, "shared", "Cache-Control", cc))
+		re, err := cache.ProcessRequest(authorized("bob"))
+		c.Assert(err, IsNil)
+		c.Assert(re, NotNil, Commentf("%s", cc))
+		c.Assert(readBody(c, re), Equals, "shared")
+	}
+}
+
+func (s *CacheSuite) TestNotCacheable(c *C) {
+	tcs := []struct {
+		name     string
+		request  request.Request
+		response *http.Response
+	}{
+		{"post", makeRequest("POST", "/a"), makeResponse(200, "hello", "Cache-Control", "max-age=60")},
+		{"no freshness", makeRequest("GET", "/a"), makeResponse(200, "hello")},
+		{"no-store", makeRequest("GET", "/a"), makeResponse(200, "hello", "Cache-Control", "no-store, max-age=60")},
+		{"private", makeRequest("GET", "/a"), makeResponse(200, "hello", "Cache-Control", "private, max-age=60")},
+		{"cookie", makeRequest("GET", "/a"), makeResponse(200, "hello", "Cache-Control", "max-age=60", "Set-Cookie", "a=b")},
+		{"vary all", makeRequest("GET", "/a"), makeResponse(200, "hello", "Cache-Control", "max-age=60", "Vary", "*")},
+		{"status", makeRequest("GET", "/a"), makeResponse(500, "hello", "Cache-Control", "max-age=60")},
+		{"expired", makeRequest("GET", "/a"), makeResponse(200, "hello", "Expires", "Sun, 04 Mar 2012 05:06:07 GMT")},
+	}
+	for _, tc := range tcs {
+		cache := s.newCache(c)
+		s.roundTrip(c, cache, tc.request, tc.response)
+		c.Assert(cache.options.Store.(*MemoryStore).Len(), Equals, 0, Commentf("%s", tc.name))
+	}
+}
+
+// Client asks to revalidate, the response is fetched from the endpoint and the cache is refreshed
+func (s *CacheSuite) TestRequestNoCache(c *C) {
+	cache := s.newCache(c)
+	s.roundTrip(c, cache, makeRequest("GET", "/a"), makeResponse(200, "hello", "Cache-Control", "max-age=60"))
+
+	req := makeRequest("GET", "/a")
+	req.GetHttpRequest().Header.Set("Cache-Control", "no-cache")
+	_, body := s.roundTrip(c, cache, req, makeResponse(200, "hello again", "Cache-Control", "max-age=60"))
+	c.Assert(body, Equals, "hello again")
+
+	re, err := cache.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(readBody(c, re), Equals, "hello again")
+}
+
+func (s *CacheSuite) TestLargeBody(c *C) {
+	cache, err := NewCacheWithOptions(Options{TimeProvider: s.tm, MaxBodyBytes: 4})
+	c.Assert(err, IsNil)
+
+	_, body := s.roundTrip(c, cache, makeRequest("GET", "/a"), makeResponse(200, "hello", "Cache-Control", "max-age=60"))
+	c.Assert(body, Equals, "hello")
+	c.Assert(cache.options.Store.(*MemoryStore).Len(), Equals, 0)
+}
+
+func (s *CacheSuite) TestMemoryStoreEvicts(c *C) {
+	m, err := NewMemoryStore(2, s.tm)
+	c.Assert(err, IsNil)
+
+	e := &Entry{Expires: s.tm.CurrentTime.Add(time.Minute)}
+	c.Assert(m.Set("a", e), IsNil)
+	c.Assert(m.Set("b", e), IsNil)
+	// a is now the most recently used
+	out, err := m.Get("a")
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, e)
+
+	c.Assert(m.Set("c", e), IsNil)
+	out, err = m.Get("b")
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+	c.Assert(m.Len(), Equals, 2)
+
+	c.Assert(m.Delete("a"), IsNil)
+	out, err = m.Get("a")
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	out, err = m.Get("c")
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+	c.Assert(m.Len(), Equals, 0)
+}
+
+func (s *CacheSuite) TestBadParams(c *C) {
+	_, err := NewCacheWithOptions(Options{MaxBodyBytes: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewMemoryStore(0, s.tm)
+	c.Assert(err, NotNil)
+}
+
+// roundTrip emulates the request that has missed the cache and got the response from the endpoint
+func (s *CacheSuite) roundTrip(c *C, cache *Cache, r request.Request, re *http.Response) (*http.Response, string) {
+	out, err := cache.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+	c.Assert(cache.ModifyResponse(r, re), IsNil)
+	return re, readBody(c, re)
+}
+
+func makeRequest(method, path string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     method,
+		Host:       "localhost",
+		URL:        netutils.MustParseUrl("http://localhost" + path),
+		RequestURI: path,
+		Header:     http.Header{},
+	}, 1, nil)
+}
+
+func makeResponse(status int, body string, kv ...string) *http.Response {
+	re := &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	for i := 0; i < len(kv); i += 2 {
+		re.Header.Set(kv[i], kv[i+1])
+	}
+	return re
+}
+
+func readBody(c *C, re *http.Response) string {
+	defer re.Body.Close()
+	out, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(out)
+}
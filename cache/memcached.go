@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+
+	"github.com/mailgun/vulcan/internal/connpool"
+)
+
+// MemcachedStore keeps the responses in memcached, so multiple proxy instances share the cache.
+// Memcached limits the key length and characters, so the keys are hashed.
+type MemcachedStore struct {
+	options MemcachedOptions
+	pool    *connpool.Pool
+}
+
+type MemcachedOptions struct {
+	// Prefix for the cache keys, helps to share memcached with other applications
+	KeyPrefix string
+	// Maximum amount of idle connections kept open to memcached
+	MaxIdleConns int
+	// Timeout for connecting and for the individual commands
+	Timeout time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const DefaultMemcachedKeyPrefix = "vulcan:cache:"
+
+// Memcached treats expiration times larger than 30 days as unix timestamps
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+func NewMemcachedStore(address string) (*MemcachedStore, error) {
+	return NewMemcachedStoreWithOptions(address, MemcachedOptions{})
+}
+
+func NewMemcachedStoreWithOptions(address string, o MemcachedOptions) (*MemcachedStore, error) {
+	if address == "" {
+		return nil, fmt.Errorf("Provide memcached address")
+	}
+	if o.MaxIdleConns < 0 || o.Timeout < 0 {
+		return nil, fmt.Errorf("Memcached options can not be negative")
+	}
+	if o.KeyPrefix == "" {
+		o.KeyPrefix = DefaultMemcachedKeyPrefix
+	}
+	if o.MaxIdleConns == 0 {
+		o.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &MemcachedStore{
+		options: o,
+		pool:    connpool.New(address, o.MaxIdleConns, o.Timeout),
+	}, nil
+}
+
+func (m *MemcachedStore) Get(key string) (*Entry, error) {
+	var data []byte
+	err := m.pool.Do(func(c *connpool.Conn) error {
+		fmt.Fprintf(c.Writer, "get %s\r\n", m.key(key))
+		if err := c.Writer.Flush(); err != nil {
+			return err
+		}
+		line, err := c.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		// VALUE <key> <flags> <bytes>
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" {
+			return memcachedError(line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.Reader, buf); err != nil {
+			return err
+		}
+		data = buf[:size]
+		if line, err = c.ReadLine(); err != nil {
+			return err
+		}
+		if line != "END" {
+			return fmt.Errorf("Malformed memcached reply: %q", line)
+		}
+		return nil
+	})
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return decodeEntry(data, m.options.TimeProvider.UtcNow())
+}
+
+func (m *MemcachedStore) Set(key string, e *Entry) error {
+	now := m.options.TimeProvider.UtcNow()
+	ttl := e.Expires.Sub(now)
+	if ttl < time.Second {
+		return nil
+	}
+	exptime := int64(ttl / time.Second)
+	if ttl > maxRelativeExpiration {
+		exptime = e.Expires.Unix()
+	}
+	data, err := encodeEntry(e)
+	if err != nil {
+		return err
+	}
+	return m.pool.Do(func(c *connpool.Conn) error {
+		fmt.Fprintf(c.Writer, "set %s 0 %d %d\r\n", m.key(key), exptime, len(data))
+		c.Writer.Write(data)
+		c.Writer.WriteString("\r\n")
+		if err := c.Writer.Flush(); err != nil {
+			return err
+		}
+		line, err := c.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return memcachedError(line)
+		}
+		return nil
+	})
+}
+
+func (m *MemcachedStore) Delete(key string) error {
+	return m.pool.Do(func(c *connpool.Conn) error {
+		fmt.Fprintf(c.Writer, "delete %s\r\n", m.key(key))
+		if err := c.Writer.Flush(); err != nil {
+			return err
+		}
+		line, err := c.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return memcachedError(line)
+		}
+		return nil
+	})
+}
+
+// Close closes the idle connections to memcached
+func (m *MemcachedStore) Close() {
+	m.pool.Close()
+}
+
+func (m *MemcachedStore) key(key string) string {
+	h := sha1.Sum([]byte(key))
+	return m.options.KeyPrefix + hex.EncodeToString(h[:])
+}
+
+// memcachedError converts the unexpected reply to the error, the connection is still usable
+// after the error replies, but not after the replies we could not parse
+func memcachedError(line string) error {
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") || line == "NOT_STORED" {
+		return connpool.ReplyError("Memcached error: " + line)
+	}
+	return fmt.Errorf("Unexpected memcached reply: %q", line)
+}
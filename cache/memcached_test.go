@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/internal/connpool"
+	. "gopkg.in/check.v1"
+)
+
+type MemcachedSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&MemcachedSuite{})
+
+func (s *MemcachedSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *MemcachedSuite) TestSetGetDelete(c *C) {
+	var mutex sync.Mutex
+	var commands []string
+	values := map[string][]byte{}
+	server := newFakeMemcached(c, func(command []string, data []byte) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		commands = append(commands, strings.Join(command, " "))
+		switch command[0] {
+		case "set":
+			values[command[1]] = data
+			return "STORED\r\n"
+		case "get":
+			v, ok := values[command[1]]
+			if !ok {
+				return "END\r\n"
+			}
+			return fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\nEND\r\n", command[1], len(v), v)
+		case "delete":
+			if _, ok := values[command[1]]; !ok {
+				return "NOT_FOUND\r\n"
+			}
+			delete(values, command[1])
+			return "DELETED\r\n"
+		}
+		return "ERROR\r\n"
+	})
+	defer server.Close()
+
+	m, err := NewMemcachedStoreWithOptions(server.Addr().String(), MemcachedOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	defer m.Close()
+
+	e := &Entry{StatusCode: 200, Body: []byte("hello"), Stored: s.tm.UtcNow(), Expires: s.tm.UtcNow().Add(time.Minute)}
+	c.Assert(m.Set("GET localhost/a", e), IsNil)
+	// Keys are hashed to fit memcached limits
+	c.Assert(commands[0], Matches, "set vulcan:cache:[0-9a-f]{40} 0 60 [0-9]+")
+
+	out, err := m.Get("GET localhost/a")
+	c.Assert(err, IsNil)
+	c.Assert(out, NotNil)
+	c.Assert(string(out.Body), Equals, "hello")
+
+	c.Assert(m.Delete("GET localhost/a"), IsNil)
+	c.Assert(m.Delete("GET localhost/a"), IsNil)
+	out, err = m.Get("GET localhost/a")
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+}
+
+// Expiration times over 30 days are sent as unix timestamps
+func (s *MemcachedSuite) TestLongExpiration(c *C) {
+	var command []string
+	server := newFakeMemcached(c, func(cmd []string, data []byte) string {
+		command = cmd
+		return "STORED\r\n"
+	})
+	defer server.Close()
+
+	m, err := NewMemcachedStoreWithOptions(server.Addr().String(), MemcachedOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	defer m.Close()
+
+	expires := s.tm.UtcNow().Add(40 * 24 * time.Hour)
+	c.Assert(m.Set("a", &Entry{Expires: expires}), IsNil)
+	c.Assert(command[3], Equals, strconv.FormatInt(expires.Unix(), 10))
+}
+
+func (s *MemcachedSuite) TestErrorReply(c *C) {
+	server := newFakeMemcached(c, func(command []string, data []byte) string {
+		return "SERVER_ERROR out of memory\r\n"
+	})
+	defer server.Close()
+
+	m, err := NewMemcachedStoreWithOptions(server.Addr().String(), MemcachedOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	defer m.Close()
+
+	err = m.Set("a", &Entry{Expires: s.tm.UtcNow().Add(time.Minute)})
+	c.Assert(err, NotNil)
+	_, ok := err.(connpool.ReplyError)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *MemcachedSuite) TestConnectionFailure(c *C) {
+	m, err := NewMemcachedStoreWithOptions("localhost:63999", MemcachedOptions{Timeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	_, err = m.Get("a")
+	c.Assert(err, NotNil)
+}
+
+func (s *MemcachedSuite) TestBadParams(c *C) {
+	_, err := NewMemcachedStore("")
+	c.Assert(err, NotNil)
+
+	_, err = NewMemcachedStoreWithOptions("localhost:11211", MemcachedOptions{MaxIdleConns: -1})
+	c.Assert(err, NotNil)
+}
+
+// newFakeMemcached starts the server that reads the text protocol commands with the data block
+// of the storage commands and writes back the replies
+func newFakeMemcached(c *C, reply func(command []string, data []byte) string) net.Listener {
+	return newFakeServer(c, func(r *bufio.Reader, w io.Writer) error {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		command := strings.Fields(line)
+		if len(command) == 0 {
+			return fmt.Errorf("Empty command")
+		}
+		var data []byte
+		if command[0] == "set" {
+			size, err := strconv.Atoi(command[len(command)-1])
+			if err != nil {
+				return err
+			}
+			data = make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			data = data[:size]
+		}
+		_, err = io.WriteString(w, reply(command, data))
+		return err
+	})
+}
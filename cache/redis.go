@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/timetools"
+
+	"github.com/mailgun/vulcan/internal/redis"
+)
+
+// RedisStore keeps the responses in Redis, so multiple proxy instances share the cache.
+// Entries are stored with the expiration time, so Redis evicts them once they become stale.
+type RedisStore struct {
+	options RedisOptions
+	client  *redis.Client
+}
+
+type RedisOptions struct {
+	// Prefix for the cache keys, helps to share Redis with other applications
+	KeyPrefix string
+	// Maximum amount of idle connections kept open to Redis
+	MaxIdleConns int
+	// Timeout for connecting and for the individual commands
+	Timeout time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultRedisKeyPrefix = "vulcan:cache:"
+	DefaultMaxIdleConns   = 16
+	DefaultTimeout        = time.Second
+)
+
+func NewRedisStore(address string) (*RedisStore, error) {
+	return NewRedisStoreWithOptions(address, RedisOptions{})
+}
+
+func NewRedisStoreWithOptions(address string, o RedisOptions) (*RedisStore, error) {
+	if address == "" {
+		return nil, fmt.Errorf("Provide Redis address")
+	}
+	if o.MaxIdleConns < 0 || o.Timeout < 0 {
+		return nil, fmt.Errorf("Redis options can not be negative")
+	}
+	if o.KeyPrefix == "" {
+		o.KeyPrefix = DefaultRedisKeyPrefix
+	}
+	if o.MaxIdleConns == 0 {
+		o.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &RedisStore{
+		options: o,
+		client:  redis.NewClient(address, o.MaxIdleConns, o.Timeout),
+	}, nil
+}
+
+func (r *RedisStore) Get(key string) (*Entry, error) {
+	reply, err := r.client.Do("GET", r.options.KeyPrefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected Redis reply: %v", reply)
+	}
+	return decodeEntry([]byte(data), r.options.TimeProvider.UtcNow())
+}
+
+func (r *RedisStore) Set(key string, e *Entry) error {
+	ttl := e.Expires.Sub(r.options.TimeProvider.UtcNow())
+	if ttl < time.Millisecond {
+		return nil
+	}
+	data, err := encodeEntry(e)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Do("SET", r.options.KeyPrefix+key, string(data), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+func (r *RedisStore) Delete(key string) error {
+	_, err := r.client.Do("DEL", r.options.KeyPrefix+key)
+	return err
+}
+
+// Close closes the idle connections to Redis
+func (r *RedisStore) Close() {
+	r.client.Close()
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/internal/connpool"
+	. "gopkg.in/check.v1"
+)
+
+type RedisSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&RedisSuite{})
+
+func (s *RedisSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *RedisSuite) TestSetGetDelete(c *C) {
+	var mutex sync.Mutex
+	var commands [][]string
+	values := map[string]string{}
+	server := newFakeRedis(c, func(args []string) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		commands = append(commands, args)
+		switch args[0] {
+		case "SET":
+			values[args[1]] = args[2]
+			return "+OK\r\n"
+		case "GET":
+			v, ok := values[args[1]]
+			if !ok {
+				return "$-1\r\n"
+			}
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+		case "DEL":
+			delete(values, args[1])
+			return ":1\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	defer server.Close()
+
+	r, err := NewRedisStoreWithOptions(server.Addr().String(), RedisOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	e := &Entry{StatusCode: 200, Body: []byte("hello"), Stored: s.tm.UtcNow(), Expires: s.tm.UtcNow().Add(time.Minute)}
+	c.Assert(r.Set("GET localhost/a", e), IsNil)
+	c.Assert(commands[0][1], Equals, "vulcan:cache:GET localhost/a")
+	c.Assert(commands[0][3:], DeepEquals, []string{"PX", "60000"})
+
+	out, err := r.Get("GET localhost/a")
+	c.Assert(err, IsNil)
+	c.Assert(out, NotNil)
+	c.Assert(out.StatusCode, Equals, 200)
+	c.Assert(string(out.Body), Equals, "hello")
+
+	// Expired entries are not returned even if Redis has not evicted them yet
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	out, err = r.Get("GET localhost/a")
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+
+	c.Assert(r.Delete("GET localhost/a"), IsNil)
+	out, err = r.Get("GET localhost/a")
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+}
+
+func (s *RedisSuite) TestErrorReply(c *C) {
+	server := newFakeRedis(c, func(args []string) string {
+		return "-ERR unknown command\r\n"
+	})
+	defer server.Close()
+
+	r, err := NewRedisStore(server.Addr().String())
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	_, err = r.Get("a")
+	c.Assert(err, NotNil)
+	_, ok := err.(connpool.ReplyError)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RedisSuite) TestConnectionFailure(c *C) {
+	r, err := NewRedisStoreWithOptions("localhost:63999", RedisOptions{Timeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	_, err = r.Get("a")
+	c.Assert(err, NotNil)
+}
+
+func (s *RedisSuite) TestBadParams(c *C) {
+	_, err := NewRedisStore("")
+	c.Assert(err, NotNil)
+
+	_, err = NewRedisStoreWithOptions("localhost:6379", RedisOptions{Timeout: -1})
+	c.Assert(err, NotNil)
+}
+
+// newFakeRedis starts the server that reads the commands and writes back the replies
+func newFakeRedis(c *C, reply func(args []string) string) net.Listener {
+	return newFakeServer(c, func(r *bufio.Reader, w io.Writer) error {
+		args, err := readCommand(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, reply(args))
+		return err
+	})
+}
+
+// newFakeServer accepts the connections and serves them until the handler fails
+func newFakeServer(c *C, serve func(r *bufio.Reader, w io.Writer) error) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for serve(r, conn) == nil {
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var count int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &count); err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
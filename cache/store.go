@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// Entry is the cached response
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Values of the request headers listed in the Vary header of the response
+	Vary map[string]string
+	// When the response was stored and when it becomes stale
+	Stored  time.Time
+	Expires time.Time
+}
+
+// Store keeps the cached responses. Stores backed by external storage, e.g. Redis,
+// let multiple proxy instances share the cache.
+type Store interface {
+	// Get returns the entry stored under the key, nil if there's no entry or it has expired
+	Get(key string) (*Entry, error)
+	// Set stores the entry until it expires
+	Set(key string, e *Entry) error
+	// Delete removes the entry, it's not an error if the entry does not exist
+	Delete(key string) error
+}
+
+// MemoryStore keeps the entries in memory of this process, evicting the least recently used
+// entries once the capacity is reached.
+type MemoryStore struct {
+	mutex        *sync.Mutex
+	capacity     int
+	timeProvider timetools.TimeProvider
+	// Most recently used entries are in the front
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+func NewMemoryStore(capacity int, timeProvider timetools.TimeProvider) (*MemoryStore, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("Capacity should be > 0")
+	}
+	if timeProvider == nil {
+		return nil, fmt.Errorf("Supply time provider")
+	}
+	return &MemoryStore{
+		mutex:        &sync.Mutex{},
+		capacity:     capacity,
+		timeProvider: timeProvider,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+	}, nil
+}
+
+func (m *MemoryStore) Get(key string) (*Entry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	item := el.Value.(*memoryItem)
+	if !m.timeProvider.UtcNow().Before(item.entry.Expires) {
+		m.remove(el)
+		return nil, nil
+	}
+	m.lru.MoveToFront(el)
+	return item.entry, nil
+}
+
+func (m *MemoryStore) Set(key string, e *Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		el.Value.(*memoryItem).entry = e
+		m.lru.MoveToFront(el)
+		return nil
+	}
+	m.entries[key] = m.lru.PushFront(&memoryItem{key: key, entry: e})
+	for m.lru.Len() > m.capacity {
+		m.remove(m.lru.Back())
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+	return nil
+}
+
+// Len returns the amount of entries in the store, including the expired ones that were not evicted yet
+func (m *MemoryStore) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lru.Len()
+}
+
+func (m *MemoryStore) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*memoryItem).key)
+}
+
+// encodeEntry serializes the entry for the remote stores
+func encodeEntry(e *Entry) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// decodeEntry deserializes the entry, returns nil if the entry has expired
+// but has not been evicted by the remote store yet
+func decodeEntry(data []byte, now time.Time) (*Entry, error) {
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	if !now.Before(e.Expires) {
+		return nil, nil
+	}
+	return &e, nil
+}
@@ -0,0 +1,275 @@
+// Middleware that collapses concurrent identical requests into a single round trip to the endpoint
+package coalesce
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Coalescer lets the first GET or HEAD request go to the endpoint and holds the identical requests
+// that arrive while it is in flight. Once the response arrives, it is fanned out to all the waiters,
+// so the hot resources are fetched once no matter how many clients ask for them at the same time.
+//
+// Requests are identical if they have the same method, host, URI and the values of the key headers.
+// Waiters proceed to the endpoint on their own if the first request fails, its response is too large
+// to share or sets cookies. Insert the coalescer right before the load balancer, so the middlewares
+// that authorize or limit the requests process every request and not only the first one:
+//
+//	c, _ := coalesce.NewCoalescer()
+//	location.GetMiddlewareChain().InsertBefore(httploc.BalancerId, "coalesce", c)
+type Coalescer struct {
+	options   Options
+	mutex     *sync.Mutex
+	calls     map[string]*call
+	waiting   int64
+	coalesced int64
+}
+
+type Options struct {
+	// Request headers that make the requests different, DefaultKeyHeaders by default
+	KeyHeaders []string
+	// Responses with larger bodies are not shared, DefaultMaxBodyBytes by default
+	MaxBodyBytes int64
+	// How long the requests wait for the response before going to the endpoint on their own, DefaultMaxWait by default
+	MaxWait time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultMaxBodyBytes = 1024 * 1024
+	DefaultMaxWait      = 30 * time.Second
+)
+
+// Responses often depend on the credentials and the content negotiation headers of the client
+var DefaultKeyHeaders = []string{"Authorization", "Cookie", "Accept", "Accept-Encoding"}
+
+func NewCoalescer() (*Coalescer, error) {
+	return NewCoalescerWithOptions(Options{})
+}
+
+func NewCoalescerWithOptions(o Options) (*Coalescer, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Coalescer{
+		options: o,
+		mutex:   &sync.Mutex{},
+		calls:   make(map[string]*call),
+	}, nil
+}
+
+// GetWaiting returns the amount of requests currently waiting for the response of the identical request
+func (c *Coalescer) GetWaiting() int64 {
+	return atomic.LoadInt64(&c.waiting)
+}
+
+// GetCoalesced returns the amount of requests that were served with the response of the identical request
+func (c *Coalescer) GetCoalesced() int64 {
+	return atomic.LoadInt64(&c.coalesced)
+}
+
+func (c *Coalescer) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil, nil
+	}
+	// The request has already started the call and is retrying after the failed attempt
+	if _, ok := r.GetUserData(leaderKey); ok {
+		return nil, nil
+	}
+
+	key := c.key(req)
+	now := c.options.TimeProvider.UtcNow()
+
+	c.mutex.Lock()
+	cl, ok := c.calls[key]
+	if !ok || now.Sub(cl.started) >= c.options.MaxWait {
+		cl = &call{done: make(chan struct{}), started: now}
+		c.calls[key] = cl
+		c.mutex.Unlock()
+		l := &leader{key: key, call: cl}
+		r.SetUserData(leaderKey, l)
+		go c.release(r.GetContext(), l)
+		return nil, nil
+	}
+	c.mutex.Unlock()
+
+	res, err := c.wait(r, cl, c.options.MaxWait-now.Sub(cl.started))
+	if err != nil || res == nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.coalesced, 1)
+	return res.newResponse(req), nil
+}
+
+// ProcessResponse releases the waiters if the attempt has failed without response,
+// successful responses are shared once they have been modified by the rest of the chain.
+// The attempt with the response can still be retried, the leader keeps the call then.
+func (c *Coalescer) ProcessResponse(r request.Request, a request.Attempt) {
+	v, ok := r.GetUserData(leaderKey)
+	if !ok || (a != nil && a.GetResponse() != nil) {
+		return
+	}
+	r.DeleteUserData(leaderKey)
+	c.finish(v.(*leader), nil)
+}
+
+// ModifyResponse shares the response with the requests waiting for it
+func (c *Coalescer) ModifyResponse(r request.Request, re *http.Response) error {
+	v, ok := r.GetUserData(leaderKey)
+	if !ok {
+		return nil
+	}
+	r.DeleteUserData(leaderKey)
+	l := v.(*leader)
+
+	if re.Header.Get("Set-Cookie") != "" {
+		c.finish(l, nil)
+		return nil
+	}
+	var body []byte
+	if re.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(re.Body, c.options.MaxBodyBytes+1))
+		if err != nil {
+			c.finish(l, nil)
+			return err
+		}
+		if int64(len(body)) > c.options.MaxBodyBytes {
+			// Too large to share, send what's been read followed by the rest of the body
+			re.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), re.Body), Closer: re.Body}
+			c.finish(l, nil)
+			return nil
+		}
+		re.Body.Close()
+		re.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	res := &result{statusCode: re.StatusCode, header: make(http.Header), body: body}
+	netutils.CopyHeaders(res.header, re.Header)
+	netutils.RemoveHopHeaders(res.header)
+	c.finish(l, res)
+	return nil
+}
+
+func (c *Coalescer) wait(r request.Request, cl *call, timeout time.Duration) (*result, error) {
+	atomic.AddInt64(&c.waiting, 1)
+	defer atomic.AddInt64(&c.waiting, -1)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-cl.done:
+		return cl.result, nil
+	case <-timer.C:
+		log.Warningf("%s has not got the response of the identical request in %s, proceeding", r, timeout)
+		return nil, nil
+	case <-r.GetContext().Done():
+		return nil, r.GetContext().Err()
+	}
+}
+
+// release tells the waiters to proceed once the leader is over without reaching ModifyResponse,
+// e.g. the location has given up retrying the attempt that has got the response
+func (c *Coalescer) release(ctx context.Context, l *leader) {
+	select {
+	case <-ctx.Done():
+		c.finish(l, nil)
+	case <-l.call.done:
+	}
+}
+
+// finish publishes the result to the waiters, nil result tells them to proceed to the endpoint.
+// Only the first result of the call is published.
+func (c *Coalescer) finish(l *leader, res *result) {
+	l.call.once.Do(func() {
+		c.mutex.Lock()
+		// The call could have been replaced by the new one after MaxWait
+		if c.calls[l.key] == l.call {
+			delete(c.calls, l.key)
+		}
+		c.mutex.Unlock()
+
+		l.call.result = res
+		close(l.call.done)
+	})
+}
+
+func (c *Coalescer) key(req *http.Request) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	key := req.Method + " " + req.Host + uri
+	for _, name := range c.options.KeyHeaders {
+		key += "\n" + name + ": " + strings.Join(req.Header[http.CanonicalHeaderKey(name)], ",")
+	}
+	return key
+}
+
+// call is the round trip shared by the identical requests
+type call struct {
+	done    chan struct{}
+	once    sync.Once
+	started time.Time
+	// Set before done is closed, nil if the waiters should proceed on their own
+	result *result
+}
+
+type leader struct {
+	key  string
+	call *call
+}
+
+type result struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+func (res *result) newResponse(req *http.Request) *http.Response {
+	re := netutils.NewHttpResponse(req, res.statusCode, res.body, "")
+	re.Header = make(http.Header)
+	netutils.CopyHeaders(re.Header, res.header)
+	return re
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MaxBodyBytes < 0 || o.MaxWait < 0 {
+		return o, fmt.Errorf("Max body bytes and max wait can not be negative")
+	}
+	if o.KeyHeaders == nil {
+		o.KeyHeaders = DefaultKeyHeaders
+	}
+	if o.MaxBodyBytes == 0 {
+		o.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if o.MaxWait == 0 {
+		o.MaxWait = DefaultMaxWait
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
+
+const leaderKey = "__coalesce.leader"
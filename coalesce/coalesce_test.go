@@ -0,0 +1,224 @@
+package coalesce
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestCoalesce(t *testing.T) { TestingT(t) }
+
+type CoalesceSuite struct{}
+
+var _ = Suite(&CoalesceSuite{})
+
+func (s *CoalesceSuite) TestShare(c *C) {
+	co, err := NewCoalescer()
+	c.Assert(err, IsNil)
+
+	leader := makeRequest("GET", "/a")
+	re, err := co.ProcessRequest(leader)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	waiters := s.startWaiters(c, co, 2, "/a")
+
+	response := makeResponse(200, "hello", "Content-Type", "text/plain")
+	c.Assert(co.ModifyResponse(leader, response), IsNil)
+	c.Assert(readBody(c, response), Equals, "hello")
+
+	for i := 0; i < 2; i++ {
+		re := <-waiters
+		c.Assert(re, NotNil)
+		c.Assert(re.StatusCode, Equals, 200)
+		c.Assert(re.Header.Get("Content-Type"), Equals, "text/plain")
+		c.Assert(readBody(c, re), Equals, "hello")
+	}
+	c.Assert(co.GetCoalesced(), Equals, int64(2))
+
+	// Once the call is over, the next request goes to the endpoint
+	re, err = co.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+// Leader has failed, so the waiters go to the endpoint on their own
+func (s *CoalesceSuite) TestLeaderFailed(c *C) {
+	co, err := NewCoalescer()
+	c.Assert(err, IsNil)
+
+	leader := makeRequest("GET", "/a")
+	re, err := co.ProcessRequest(leader)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	waiters := s.startWaiters(c, co, 1, "/a")
+
+	co.ProcessResponse(leader, &request.BaseAttempt{Error: fmt.Errorf("connection refused")})
+	c.Assert(<-waiters, IsNil)
+	c.Assert(co.GetCoalesced(), Equals, int64(0))
+}
+
+// Leader retries after the failed attempt without waiting for itself
+func (s *CoalesceSuite) TestLeaderRetries(c *C) {
+	co, err := NewCoalescer()
+	c.Assert(err, IsNil)
+
+	leader := makeRequest("GET", "/a")
+	co.ProcessRequest(leader)
+	co.ProcessResponse(leader, &request.BaseAttempt{Response: makeResponse(502, "")})
+
+	re, err := co.ProcessRequest(leader)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+// Leader gives up retrying the attempt that has got the response, the request is over without ModifyResponse
+func (s *CoalesceSuite) TestLeaderRetryAborted(c *C) {
+	co, err := NewCoalescer()
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := makeRequest("GET", "/a")
+	leader.SetContext(ctx)
+	co.ProcessRequest(leader)
+	waiters := s.startWaiters(c, co, 1, "/a")
+
+	co.ProcessResponse(leader, &request.BaseAttempt{Response: makeResponse(503, "")})
+	co.ProcessRequest(leader)
+	co.ProcessResponse(leader, &request.BaseAttempt{Response: makeResponse(503, "")})
+	// E.g. the backoff before the next retry is interrupted by the deadline
+	cancel()
+
+	select {
+	case re := <-waiters:
+		c.Assert(re, IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("waiter has not been released")
+	}
+	// The call is over, so the next identical request goes to the endpoint right away
+	re, err := co.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(co.GetWaiting(), Equals, int64(0))
+}
+
+func (s *CoalesceSuite) TestDifferentRequests(c *C) {
+	co, err := NewCoalescer()
+	c.Assert(err, IsNil)
+
+	co.ProcessRequest(makeRequest("GET", "/a"))
+
+	requests := []request.Request{
+		makeRequest("POST", "/a"),
+		makeRequest("GET", "/b"),
+		makeRequest("GET", "/a", "Authorization", "Basic Ym9iOnNlY3JldA=="),
+		makeRequest("GET", "/a", "Accept-Encoding", "gzip"),
+	}
+	for _, r := range requests {
+		re, err := co.ProcessRequest(r)
+		c.Assert(err, IsNil)
+		c.Assert(re, IsNil)
+	}
+	c.Assert(co.GetWaiting(), Equals, int64(0))
+}
+
+func (s *CoalesceSuite) TestNotShared(c *C) {
+	tcs := []struct {
+		name     string
+		response *http.Response
+	}{
+		{"cookie", makeResponse(200, "hello", "Set-Cookie", "a=b")},
+		{"large", makeResponse(200, "hello, world")},
+	}
+	for _, tc := range tcs {
+		co, err := NewCoalescerWithOptions(Options{MaxBodyBytes: 5})
+		c.Assert(err, IsNil)
+
+		leader := makeRequest("GET", "/a")
+		co.ProcessRequest(leader)
+		waiters := s.startWaiters(c, co, 1, "/a")
+
+		c.Assert(co.ModifyResponse(leader, tc.response), IsNil)
+		c.Assert(<-waiters, IsNil, Commentf("%s", tc.name))
+		// The leader gets the whole body anyway
+		c.Assert(readBody(c, tc.response), Not(Equals), "", Commentf("%s", tc.name))
+	}
+}
+
+func (s *CoalesceSuite) TestMaxWait(c *C) {
+	co, err := NewCoalescerWithOptions(Options{MaxWait: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	co.ProcessRequest(makeRequest("GET", "/a"))
+
+	re, err := co.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *CoalesceSuite) TestBadParams(c *C) {
+	_, err := NewCoalescerWithOptions(Options{MaxBodyBytes: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewCoalescerWithOptions(Options{MaxWait: -1})
+	c.Assert(err, NotNil)
+}
+
+// startWaiters sends the identical requests and waits until they are all waiting for the leader
+func (s *CoalesceSuite) startWaiters(c *C, co *Coalescer, count int, path string) chan *http.Response {
+	out := make(chan *http.Response, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			re, err := co.ProcessRequest(makeRequest("GET", path))
+			c.Check(err, IsNil)
+			out <- re
+		}()
+	}
+	for co.GetWaiting() != int64(count) {
+		time.Sleep(time.Millisecond)
+	}
+	return out
+}
+
+func makeRequest(method, path string, kv ...string) request.Request {
+	req := &http.Request{
+		Method:     method,
+		Host:       "localhost",
+		URL:        netutils.MustParseUrl("http://localhost" + path),
+		RequestURI: path,
+		Header:     http.Header{},
+	}
+	for i := 0; i < len(kv); i += 2 {
+		req.Header.Set(kv[i], kv[i+1])
+	}
+	return request.NewBaseRequest(req, 1, nil)
+}
+
+func makeResponse(status int, body string, kv ...string) *http.Response {
+	re := &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	for i := 0; i < len(kv); i += 2 {
+		re.Header.Set(kv[i], kv[i+1])
+	}
+	return re
+}
+
+func readBody(c *C, re *http.Response) string {
+	defer re.Body.Close()
+	out, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(out)
+}
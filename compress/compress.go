@@ -0,0 +1,205 @@
+// Middleware that compresses the responses for the clients that accept gzip encoding
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+// Compressor gzips the responses on the fly as they are read from the endpoint, so the response
+// is not buffered and is flushed to the client chunk by chunk, the same way it arrives from the endpoint.
+// Responses that are already encoded, too small, partial or have content type that is not in the list are passed as is.
+// Strong ETag of the compressed response is weakened, as the compressed body is not the same bytes.
+type Compressor struct {
+	options Options
+}
+
+type Options struct {
+	// Responses with the known content length below this size are not compressed, DefaultMinSize by default
+	MinSize int64
+	// Media types to compress, e.g. "application/json", types ending with "/" match the whole group, e.g. "text/".
+	// DefaultContentTypes by default
+	ContentTypes []string
+	// Gzip compression level, e.g. gzip.NoCompression, gzip.DefaultCompression if nil
+	Level *int
+}
+
+const DefaultMinSize = 1024
+
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func NewCompressor() (*Compressor, error) {
+	return NewCompressorWithOptions(Options{})
+}
+
+func NewCompressorWithOptions(o Options) (*Compressor, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Compressor{options: o}, nil
+}
+
+func (c *Compressor) ProcessRequest(r request.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (c *Compressor) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// ModifyResponse replaces the body with the gzip stream if the client accepts it
+func (c *Compressor) ModifyResponse(r request.Request, re *http.Response) error {
+	if !c.shouldCompress(r.GetHttpRequest(), re) {
+		return nil
+	}
+	pr, pw := io.Pipe()
+	go compress(pw, re.Body, *c.options.Level)
+	re.Body = &gzipBody{PipeReader: pr, src: re.Body}
+
+	re.ContentLength = -1
+	re.Header.Del("Content-Length")
+	re.Header.Set("Content-Encoding", "gzip")
+	re.Header.Add("Vary", "Accept-Encoding")
+	if etag := re.Header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		re.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+func (c *Compressor) shouldCompress(req *http.Request, re *http.Response) bool {
+	if re.Body == nil || req.Method == "HEAD" {
+		return false
+	}
+	if re.StatusCode == http.StatusNoContent || re.StatusCode == http.StatusNotModified {
+		return false
+	}
+	// Ranges are the offsets in the original body
+	if re.StatusCode == http.StatusPartialContent || re.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if re.Header.Get("Content-Encoding") != "" || strings.Contains(re.Header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if re.ContentLength >= 0 && re.ContentLength < c.options.MinSize {
+		return false
+	}
+	return AcceptsGzip(req) && c.isCompressible(re.Header.Get("Content-Type"))
+}
+
+func (c *Compressor) isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.options.ContentTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsGzip tells whether the client has asked for gzip encoding in Accept-Encoding header
+func AcceptsGzip(req *http.Request) bool {
+	for _, v := range req.Header["Accept-Encoding"] {
+		for _, enc := range strings.Split(v, ",") {
+			params := strings.Split(enc, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			return !hasZeroQuality(params[1:])
+		}
+	}
+	return false
+}
+
+func hasZeroQuality(params []string) bool {
+	for _, p := range params {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "q=") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64)
+		return err == nil && q == 0
+	}
+	return false
+}
+
+// compress reads the body and writes compressed chunks to the pipe, flushing after every read,
+// so the client gets the data as soon as the endpoint sends it
+func compress(pw *io.PipeWriter, src io.Reader, level int) {
+	gz, err := gzip.NewWriterLevel(pw, level)
+	if err != nil {
+		pw.CloseWithError(err)
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := gz.Write(buf[:n]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if err := gz.Flush(); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+	}
+	pw.CloseWithError(gz.Close())
+}
+
+// gzipBody closes both the pipe and the original body, so the compressing goroutine exits
+// even if the client has not read the whole response
+type gzipBody struct {
+	*io.PipeReader
+	src io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MinSize < 0 {
+		return o, fmt.Errorf("Min size can not be negative")
+	}
+	if o.MinSize == 0 {
+		o.MinSize = DefaultMinSize
+	}
+	if o.ContentTypes == nil {
+		o.ContentTypes = DefaultContentTypes
+	}
+	level := gzip.DefaultCompression
+	if o.Level != nil {
+		level = *o.Level
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return o, fmt.Errorf("Unsupported compression level: %d", level)
+	}
+	o.Level = &level
+	return o, nil
+}
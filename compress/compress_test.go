@@ -0,0 +1,196 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestCompress(t *testing.T) { TestingT(t) }
+
+type CompressSuite struct {
+}
+
+var _ = Suite(&CompressSuite{})
+
+func (s *CompressSuite) TestCompress(c *C) {
+	cm, err := NewCompressor()
+	c.Assert(err, IsNil)
+
+	body := strings.Repeat("hello, world ", 200)
+	re := makeResponse("text/html; charset=utf-8", body, int64(len(body)))
+	c.Assert(cm.ModifyResponse(makeRequest("gzip, deflate"), re), IsNil)
+
+	c.Assert(re.Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(re.Header.Get("Content-Length"), Equals, "")
+	c.Assert(re.Header.Get("Vary"), Equals, "Accept-Encoding")
+	c.Assert(re.ContentLength, Equals, int64(-1))
+	c.Assert(decompress(c, re), Equals, body)
+}
+
+// Chunks are compressed and sent as soon as they arrive from the endpoint
+func (s *CompressSuite) TestStreaming(c *C) {
+	cm, err := NewCompressor()
+	c.Assert(err, IsNil)
+
+	pr, pw := io.Pipe()
+	re := makeResponse("text/event-stream", "", -1)
+	re.Body = pr
+	c.Assert(cm.ModifyResponse(makeRequest("gzip"), re), IsNil)
+
+	go pw.Write([]byte("data: first\n\n"))
+	gz, err := gzip.NewReader(re.Body)
+	c.Assert(err, IsNil)
+	buf := make([]byte, 1024)
+	n, err := gz.Read(buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf[:n]), Equals, "data: first\n\n")
+
+	pw.Close()
+	c.Assert(re.Body.Close(), IsNil)
+}
+
+func (s *CompressSuite) TestSkip(c *C) {
+	cm, err := NewCompressorWithOptions(Options{MinSize: 10, ContentTypes: []string{"application/json"}})
+	c.Assert(err, IsNil)
+
+	long := strings.Repeat("a", 100)
+	tcs := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		modify         func(*http.Response)
+	}{
+		{name: "client does not accept gzip", acceptEncoding: "", contentType: "application/json", body: long},
+		{name: "client refuses gzip", acceptEncoding: "gzip;q=0, deflate", contentType: "application/json", body: long},
+		{name: "too small", acceptEncoding: "gzip", contentType: "application/json", body: "{}"},
+		{name: "not in the list", acceptEncoding: "gzip", contentType: "image/png", body: long},
+		{
+			name: "already encoded", acceptEncoding: "gzip", contentType: "application/json", body: long,
+			modify: func(re *http.Response) { re.Header.Set("Content-Encoding", "br") },
+		},
+		{
+			name: "no transform", acceptEncoding: "gzip", contentType: "application/json", body: long,
+			modify: func(re *http.Response) { re.Header.Set("Cache-Control", "no-transform") },
+		},
+		{
+			name: "not modified", acceptEncoding: "gzip", contentType: "application/json", body: long,
+			modify: func(re *http.Response) { re.StatusCode = http.StatusNotModified },
+		},
+		{
+			name: "partial content", acceptEncoding: "gzip", contentType: "application/json", body: long,
+			modify: func(re *http.Response) {
+				re.StatusCode = http.StatusPartialContent
+				re.Header.Set("Content-Range", "bytes 0-99/1000")
+			},
+		},
+		{
+			name: "content range", acceptEncoding: "gzip", contentType: "application/json", body: long,
+			modify: func(re *http.Response) { re.Header.Set("Content-Range", "bytes */1000") },
+		},
+	}
+	for _, tc := range tcs {
+		re := makeResponse(tc.contentType, tc.body, int64(len(tc.body)))
+		if tc.modify != nil {
+			tc.modify(re)
+		}
+		c.Assert(cm.ModifyResponse(makeRequest(tc.acceptEncoding), re), IsNil)
+		c.Assert(re.Header.Get("Content-Encoding") != "gzip", Equals, true, Commentf("%s", tc.name))
+		out, err := ioutil.ReadAll(re.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(out), Equals, tc.body, Commentf("%s", tc.name))
+	}
+}
+
+// Compressed body is not byte for byte the same, so the strong ETag becomes weak
+func (s *CompressSuite) TestETag(c *C) {
+	cm, err := NewCompressor()
+	c.Assert(err, IsNil)
+
+	body := strings.Repeat("hello, world ", 200)
+	for _, etag := range [][]string{{`"v1"`, `W/"v1"`}, {`W/"v1"`, `W/"v1"`}} {
+		re := makeResponse("text/html", body, int64(len(body)))
+		re.Header.Set("ETag", etag[0])
+		c.Assert(cm.ModifyResponse(makeRequest("gzip"), re), IsNil)
+		c.Assert(re.Header.Get("ETag"), Equals, etag[1])
+	}
+}
+
+func (s *CompressSuite) TestLevel(c *C) {
+	level := gzip.NoCompression
+	cm, err := NewCompressorWithOptions(Options{Level: &level})
+	c.Assert(err, IsNil)
+	c.Assert(*cm.options.Level, Equals, gzip.NoCompression)
+
+	body := strings.Repeat("hello, world ", 200)
+	re := makeResponse("text/html", body, int64(len(body)))
+	c.Assert(cm.ModifyResponse(makeRequest("gzip"), re), IsNil)
+	c.Assert(decompress(c, re), Equals, body)
+
+	cm, err = NewCompressor()
+	c.Assert(err, IsNil)
+	c.Assert(*cm.options.Level, Equals, gzip.DefaultCompression)
+}
+
+func (s *CompressSuite) TestAcceptsGzip(c *C) {
+	tcs := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"identity", false},
+	}
+	for _, tc := range tcs {
+		c.Assert(AcceptsGzip(makeRequest(tc.header).GetHttpRequest()), Equals, tc.expected, Commentf("%s", tc.header))
+	}
+}
+
+func (s *CompressSuite) TestBadParams(c *C) {
+	_, err := NewCompressorWithOptions(Options{MinSize: -1})
+	c.Assert(err, NotNil)
+
+	level := 42
+	_, err = NewCompressorWithOptions(Options{Level: &level})
+	c.Assert(err, NotNil)
+}
+
+func makeRequest(acceptEncoding string) request.Request {
+	r := &http.Request{Method: "GET", Header: http.Header{}}
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	return request.NewBaseRequest(r, 1, nil)
+}
+
+func makeResponse(contentType, body string, contentLength int64) *http.Response {
+	re := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: contentLength,
+	}
+	re.Header.Set("Content-Type", contentType)
+	return re
+}
+
+func decompress(c *C, re *http.Response) string {
+	defer re.Body.Close()
+	gz, err := gzip.NewReader(re.Body)
+	c.Assert(err, IsNil)
+	out, err := ioutil.ReadAll(gz)
+	c.Assert(err, IsNil)
+	return string(out)
+}
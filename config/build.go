@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/admin"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/ewma"
+	"github.com/mailgun/vulcan/loadbalance/leastconn"
+	"github.com/mailgun/vulcan/loadbalance/p2c"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/route/exproute"
+	"github.com/mailgun/vulcan/threshold"
+)
+
+type Options struct {
+	// Middleware types in addition to the built in ones, see Middlewares
+	Middlewares map[string]admin.MiddlewareFactory
+	// Options of the proxy, the options of the locations are set in the config
+	Proxy vulcan.Options
+}
+
+// NewProxy builds the proxy that routes the requests to the locations of the config
+func (c *Config) NewProxy(o Options) (*vulcan.Proxy, error) {
+	router, err := c.NewRouter(o)
+	if err != nil {
+		return nil, err
+	}
+	return vulcan.NewProxyWithOptions(router, o.Proxy)
+}
+
+// NewRouter builds the locations of the config and adds them to the new router.
+// The router can be managed by admin.Admin afterwards to change the locations at runtime.
+func (c *Config) NewRouter(o Options) (*exproute.ExpRouter, error) {
+	router := exproute.NewExpRouter()
+	ids := make(map[string]bool, len(c.Locations))
+	for i, l := range c.Locations {
+		path := fmt.Sprintf("locations[%d]", i)
+		if l.Id == "" {
+			return nil, &Error{Path: path + ".id", Err: fmt.Errorf("Provide location id")}
+		}
+		if ids[l.Id] {
+			return nil, &Error{Path: path + ".id", Err: fmt.Errorf("Duplicate location id '%s'", l.Id)}
+		}
+		ids[l.Id] = true
+		loc, err := l.NewLocation(o)
+		if err != nil {
+			return nil, withPath(path, err)
+		}
+		if l.Expression == "" {
+			return nil, &Error{Path: path + ".expression", Err: fmt.Errorf("Provide expression")}
+		}
+		if err := router.AddLocation(l.Expression, loc); err != nil {
+			return nil, &Error{Path: path + ".expression", Err: err}
+		}
+	}
+	return router, nil
+}
+
+// NewLocation builds the location without adding it to a router, the errors point to the section of the location
+func (l *Location) NewLocation(o Options) (*httploc.HttpLocation, error) {
+	lb, err := l.Balancer.newBalancer()
+	if err != nil {
+		return nil, &Error{Path: "balancer", Err: err}
+	}
+	options, err := l.Options.locationOptions()
+	if err != nil {
+		return nil, &Error{Path: "options", Err: err}
+	}
+	loc, err := httploc.NewLocationWithOptions(l.Id, lb, options)
+	if err != nil {
+		return nil, &Error{Path: "options", Err: err}
+	}
+	for i, m := range l.Middlewares {
+		if err := m.addTo(loc, o); err != nil {
+			return nil, &Error{Path: fmt.Sprintf("middlewares[%d]", i), Err: err}
+		}
+	}
+	return loc, nil
+}
+
+func (b *Balancer) newBalancer() (loadbalance.LoadBalancer, error) {
+	if len(b.Endpoints) == 0 {
+		return nil, fmt.Errorf("Provide endpoints")
+	}
+	var lb interface {
+		loadbalance.LoadBalancer
+		admin.Balancer
+	}
+	var err error
+	switch b.Type {
+	case "", "roundrobin":
+		lb, err = roundrobin.NewRoundRobinWithOptions(roundrobin.Options{MaxInFlight: b.MaxInFlight, QueueTimeout: b.QueueTimeout.Duration()})
+	case "leastconn":
+		lb, err = leastconn.NewLeastConnWithOptions(leastconn.Options{MaxInFlight: b.MaxInFlight, QueueTimeout: b.QueueTimeout.Duration()})
+	case "p2c":
+		lb, err = p2c.NewP2CWithOptions(p2c.Options{MaxInFlight: b.MaxInFlight, QueueTimeout: b.QueueTimeout.Duration()})
+	case "ewma":
+		if b.MaxInFlight != 0 || b.QueueTimeout != 0 {
+			return nil, fmt.Errorf("ewma does not support max_in_flight and queue_timeout")
+		}
+		lb, err = ewma.NewEWMA()
+	default:
+		return nil, fmt.Errorf("Unknown balancer type '%s', supported types are roundrobin, leastconn, p2c and ewma", b.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range b.Endpoints {
+		e, err := endpoint.ParseUrl(u)
+		if err != nil {
+			return nil, fmt.Errorf("Bad endpoint '%s': %s", u, err)
+		}
+		if err := lb.AddEndpoint(e); err != nil {
+			return nil, err
+		}
+	}
+	return lb, nil
+}
+
+func (l *LocationOptions) locationOptions() (httploc.Options, error) {
+	o := httploc.Options{
+		Timeouts: httploc.Timeouts{
+			Read:         l.Timeouts.Read.Duration(),
+			Dial:         l.Timeouts.Dial.Duration(),
+			TlsHandshake: l.Timeouts.TlsHandshake.Duration(),
+			Attempt:      l.Timeouts.Attempt.Duration(),
+			Total:        l.Timeouts.Total.Duration(),
+		},
+		Limits: httploc.Limits{
+			MaxBodyBytes:    l.MaxBodyBytes,
+			MaxMemBodyBytes: l.MaxMemBodyBytes,
+		},
+		StripPrefix: l.StripPrefix,
+		Host:        l.Host,
+	}
+	if l.FailoverPredicate != "" {
+		p, err := threshold.ParseExpression(l.FailoverPredicate)
+		if err != nil {
+			return o, fmt.Errorf("Bad failover predicate '%s': %s", l.FailoverPredicate, err)
+		}
+		o.FailoverPredicate = p
+	}
+	switch l.HostHeader {
+	case "", "preserve":
+		o.HostHeader = httploc.PreserveHost
+	case "endpoint":
+		o.HostHeader = httploc.EndpointHost
+	case "fixed":
+		o.HostHeader = httploc.FixedHost
+	default:
+		return o, fmt.Errorf("Unknown host header '%s', supported values are preserve, endpoint and fixed", l.HostHeader)
+	}
+	return o, nil
+}
+
+func (m *Middleware) addTo(loc *httploc.HttpLocation, o Options) error {
+	if m.Id == "" {
+		return fmt.Errorf("Provide middleware id")
+	}
+	factory, ok := o.Middlewares[m.Type]
+	if !ok {
+		factory, ok = Middlewares[m.Type]
+	}
+	if !ok {
+		return fmt.Errorf("Unknown middleware type '%s'", m.Type)
+	}
+	mw, err := factory(m.Params)
+	if err != nil {
+		return fmt.Errorf("Bad %s middleware params: %s", m.Type, err)
+	}
+	return loc.GetMiddlewareChain().Add(m.Id, m.Priority, mw)
+}
+
+// withPath prefixes the path of the error with the path of the enclosing section
+func withPath(path string, err error) error {
+	if e, ok := err.(*Error); ok {
+		return &Error{Path: path + "." + e.Path, Err: e.Err}
+	}
+	return &Error{Path: path, Err: err}
+}
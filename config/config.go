@@ -0,0 +1,212 @@
+/*
+Declarative configuration of the proxy, in YAML or JSON:
+
+	locations:
+	  - id: api
+	    expression: TrieRoute(`/api/<version>`) && Host(`example.com`)
+	    balancer:
+	      type: leastconn
+	      endpoints: [http://10.0.0.1:5000, http://10.0.0.2:5000]
+	    options:
+	      timeouts: {read: 10s, dial: 3s, total: 30s}
+	      max_body_bytes: 1048576
+	      failover_predicate: IsNetworkError() && Attempts() <= 2
+	    middlewares:
+	      - id: limit
+	        type: ratelimit
+	        params: {variable: client.ip, period: 1s, average: 100, burst: 200}
+
+Locations are routed by the expressions, see exproute. The errors point to the section of the config
+that is not valid, e.g. "locations[0].middlewares[1]: Unknown middleware type 'ratelimiter'".
+*/
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Locations []Location
+}
+
+type Location struct {
+	Id string `json:"id"`
+	// Expression the requests are routed by, see exproute
+	Expression  string          `json:"expression"`
+	Balancer    Balancer        `json:"balancer"`
+	Options     LocationOptions `json:"options"`
+	Middlewares []Middleware    `json:"middlewares"`
+}
+
+type Balancer struct {
+	// One of roundrobin, leastconn, p2c, ewma, roundrobin by default
+	Type      string   `json:"type"`
+	Endpoints []string `json:"endpoints"`
+	// Maximum number of requests in flight per endpoint, 0 means no limit, not supported by ewma
+	MaxInFlight int64 `json:"max_in_flight"`
+	// How long the request waits for an endpoint when all of them are at the limit
+	QueueTimeout Duration `json:"queue_timeout"`
+}
+
+// LocationOptions are the options of httploc.HttpLocation, the ones not set are the location's defaults
+type LocationOptions struct {
+	Timeouts          Timeouts `json:"timeouts"`
+	MaxBodyBytes      int64    `json:"max_body_bytes"`
+	MaxMemBodyBytes   int64    `json:"max_mem_body_bytes"`
+	FailoverPredicate string   `json:"failover_predicate"`
+	StripPrefix       string   `json:"strip_prefix"`
+	// Host header sent to the endpoints: preserve (default), endpoint or fixed, see httploc.HostHeader
+	HostHeader string `json:"host_header"`
+	// Host sent to the endpoints with the fixed host header
+	Host string `json:"host"`
+}
+
+type Timeouts struct {
+	Read         Duration `json:"read"`
+	Dial         Duration `json:"dial"`
+	TlsHandshake Duration `json:"tls_handshake"`
+	Attempt      Duration `json:"attempt"`
+	Total        Duration `json:"total"`
+}
+
+type Middleware struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	// Middlewares with the lower priority are executed first
+	Priority int `json:"priority"`
+	// Parameters of the middleware type, passed to its factory as is
+	Params json.RawMessage `json:"params"`
+}
+
+// Duration is the time.Duration written as a string, e.g. "10s" or "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Duration should be a string like \"10s\", got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+type Format int
+
+const (
+	JSON Format = iota
+	YAML
+)
+
+// Error points to the section of the config that is not valid
+type Error struct {
+	// Path of the section, e.g. locations[1].balancer
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+// Load reads the config file, the files with .yaml and .yml extensions are YAML, the other ones are JSON
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := JSON
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = YAML
+	}
+	c, err := Parse(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return c, nil
+}
+
+func Parse(data []byte, format Format) (*Config, error) {
+	if format == YAML {
+		converted, err := yamlToJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		data = converted
+	}
+	var raw struct {
+		Locations []json.RawMessage `json:"locations"`
+	}
+	if err := decode(data, &raw); err != nil {
+		return nil, err
+	}
+	c := &Config{Locations: make([]Location, len(raw.Locations))}
+	for i, data := range raw.Locations {
+		path := fmt.Sprintf("locations[%d]", i)
+		if err := decodeLocation(path, data, &c.Locations[i]); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// decodeLocation decodes the location section by section, so the errors point to the section
+func decodeLocation(path string, data []byte, l *Location) error {
+	var raw struct {
+		Id          string            `json:"id"`
+		Expression  string            `json:"expression"`
+		Balancer    json.RawMessage   `json:"balancer"`
+		Options     json.RawMessage   `json:"options"`
+		Middlewares []json.RawMessage `json:"middlewares"`
+	}
+	if err := decode(data, &raw); err != nil {
+		return &Error{Path: path, Err: err}
+	}
+	l.Id, l.Expression = raw.Id, raw.Expression
+	if err := decodeSection(raw.Balancer, &l.Balancer); err != nil {
+		return &Error{Path: path + ".balancer", Err: err}
+	}
+	if err := decodeSection(raw.Options, &l.Options); err != nil {
+		return &Error{Path: path + ".options", Err: err}
+	}
+	l.Middlewares = make([]Middleware, len(raw.Middlewares))
+	for i, data := range raw.Middlewares {
+		if err := decode(data, &l.Middlewares[i]); err != nil {
+			return &Error{Path: fmt.Sprintf("%s.middlewares[%d]", path, i), Err: err}
+		}
+	}
+	return nil
+}
+
+// decodeSection decodes the optional section, it's left as is if missing
+func decodeSection(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	return decode(data, v)
+}
+
+// decode rejects the unknown fields, so the typos in the config are not silently ignored
+func decode(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/acl"
+	"github.com/mailgun/vulcan/admin"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/loadbalance/leastconn"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func TestConfig(t *testing.T) { TestingT(t) }
+
+type ConfigSuite struct{}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) TestParseYAML(c *C) {
+	cfg, err := Parse([]byte(`
+locations:
+  - id: api
+    expression: TrieRoute(`+"`/api`"+`)
+    balancer:
+      type: leastconn
+      endpoints: [http://localhost:5000, http://localhost:5001]
+    options:
+      timeouts: {read: 10s, dial: 3s}
+      max_body_bytes: 1024
+      failover_predicate: IsNetworkError()
+    middlewares:
+      - id: limit
+        type: ratelimit
+        priority: 1
+        params: {average: 10, burst: 20}
+`), YAML)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Locations, HasLen, 1)
+	l := cfg.Locations[0]
+	c.Assert(l.Id, Equals, "api")
+	c.Assert(l.Expression, Equals, "TrieRoute(`/api`)")
+	c.Assert(l.Balancer, DeepEquals, Balancer{Type: "leastconn", Endpoints: []string{"http://localhost:5000", "http://localhost:5001"}})
+	c.Assert(l.Options.Timeouts, DeepEquals, Timeouts{Read: Duration(10 * time.Second), Dial: Duration(3 * time.Second)})
+	c.Assert(l.Options.MaxBodyBytes, Equals, int64(1024))
+	c.Assert(l.Options.FailoverPredicate, Equals, "IsNetworkError()")
+	c.Assert(l.Middlewares, HasLen, 1)
+	c.Assert(l.Middlewares[0].Id, Equals, "limit")
+	c.Assert(l.Middlewares[0].Priority, Equals, 1)
+	c.Assert(string(l.Middlewares[0].Params), Equals, `{"average":10,"burst":20}`)
+
+	router, err := cfg.NewRouter(Options{})
+	c.Assert(err, IsNil)
+	loc := router.GetLocationById("api").(*httploc.HttpLocation)
+	c.Assert(loc.GetLoadBalancer(), FitsTypeOf, &leastconn.LeastConn{})
+	c.Assert(loc.GetOptions().Timeouts.Read, Equals, 10*time.Second)
+	c.Assert(loc.GetOptions().Limits.MaxBodyBytes, Equals, int64(1024))
+	limiter := loc.GetMiddlewareChain().Get("limit").(*tokenbucket.TokenLimiter)
+	c.Assert(limiter.GetRate(), Equals, tokenbucket.Rate{Units: 10, Period: time.Second})
+	c.Assert(limiter.GetBurst(), Equals, int64(20))
+}
+
+func (s *ConfigSuite) TestProxy(c *C) {
+	api := testutils.NewTestResponder("api")
+	defer api.Close()
+	web := testutils.NewTestResponder("web")
+	defer web.Close()
+
+	cfg, err := Parse([]byte(fmt.Sprintf(`{
+		"locations": [
+			{
+				"id": "api",
+				"expression": "TrieRoute(`+"`/api`"+`)",
+				"balancer": {"endpoints": [%q]},
+				"middlewares": [{"id": "acl", "type": "acl", "params": {"deny": ["127.0.0.1"]}}]
+			},
+			{
+				"id": "web",
+				"expression": "TrieRoute(`+"`/web`"+`)",
+				"balancer": {"type": "p2c", "endpoints": [%q], "max_in_flight": 10, "queue_timeout": "1s"}
+			}
+		]}`, api.URL, web.URL)), JSON)
+	c.Assert(err, IsNil)
+
+	p, err := cfg.NewProxy(Options{})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	re, body, err := testutils.GET(proxy.URL+"/web", testutils.Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "web")
+
+	re, _, err = testutils.GET(proxy.URL+"/api", testutils.Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *ConfigSuite) TestCustomMiddleware(c *C) {
+	cfg, err := Parse([]byte(`
+locations:
+- id: api
+  expression: TrieRoute(`+"`/api`"+`)
+  balancer:
+    endpoints:
+    - http://localhost:5000
+  middlewares:
+  - id: office
+    type: office
+`), YAML)
+	c.Assert(err, IsNil)
+
+	_, err = cfg.NewRouter(Options{})
+	c.Assert(err, ErrorMatches, `locations\[0\]\.middlewares\[0\]: Unknown middleware type 'office'`)
+
+	office, err := acl.NewACL([]string{"10.0.0.0/8"}, nil)
+	c.Assert(err, IsNil)
+	router, err := cfg.NewRouter(Options{Middlewares: map[string]admin.MiddlewareFactory{
+		"office": func(params json.RawMessage) (middleware.Middleware, error) { return office, nil },
+	}})
+	c.Assert(err, IsNil)
+	loc := router.GetLocationById("api").(*httploc.HttpLocation)
+	c.Assert(loc.GetMiddlewareChain().Get("office"), Equals, office)
+}
+
+func (s *ConfigSuite) TestErrors(c *C) {
+	location := func(fields string) string {
+		return "locations:\n  - id: api\n    expression: TrieRoute(`/api`)\n" + fields
+	}
+	endpoints := "    balancer: {endpoints: [http://localhost:5000]}\n"
+	tcs := []struct {
+		Config string
+		Error  string
+	}{
+		{
+			Config: "location: []",
+			Error:  `json: unknown field "location"`,
+		},
+		{
+			Config: location("    balancer:\n      endpoint: [http://localhost:5000]\n"),
+			Error:  `locations\[0\]\.balancer: json: unknown field "endpoint"`,
+		},
+		{
+			Config: location("    balancer: {endpoints: []}\n"),
+			Error:  `locations\[0\]\.balancer: Provide endpoints`,
+		},
+		{
+			Config: location("    balancer: {type: random, endpoints: [http://localhost:5000]}\n"),
+			Error:  `locations\[0\]\.balancer: Unknown balancer type 'random'.*`,
+		},
+		{
+			Config: location("    balancer: {type: ewma, endpoints: [http://localhost:5000], max_in_flight: 1}\n"),
+			Error:  `locations\[0\]\.balancer: ewma does not support max_in_flight and queue_timeout`,
+		},
+		{
+			Config: location("    balancer: {endpoints: [':bad']}\n"),
+			Error:  `locations\[0\]\.balancer: Bad endpoint ':bad'.*`,
+		},
+		{
+			Config: location(endpoints + "    options: {timeouts: {read: 10}}\n"),
+			Error:  `locations\[0\]\.options: Duration should be a string.*`,
+		},
+		{
+			Config: location(endpoints + "    options: {failover_predicate: Bad()}\n"),
+			Error:  `locations\[0\]\.options: Bad failover predicate 'Bad\(\)'.*`,
+		},
+		{
+			Config: location(endpoints + "    options: {host_header: fixed}\n"),
+			Error:  `locations\[0\]\.options: .*`,
+		},
+		{
+			Config: location(endpoints + "    middlewares:\n      - {id: limit, type: ratelimit, params: {rate: 10}}\n"),
+			Error:  `locations\[0\]\.middlewares\[0\]: Bad ratelimit middleware params: json: unknown field "rate"`,
+		},
+		{
+			Config: location(endpoints + "    middlewares:\n      - {type: ratelimit, params: {average: 10}}\n"),
+			Error:  `locations\[0\]\.middlewares\[0\]: Provide middleware id`,
+		},
+		{
+			Config: location(endpoints) + "  - id: api\n    expression: TrieRoute(`/web`)\n" + endpoints,
+			Error:  `locations\[1\]\.id: Duplicate location id 'api'`,
+		},
+		{
+			Config: "locations:\n  - id: api\n" + endpoints,
+			Error:  `locations\[0\]\.expression: Provide expression`,
+		},
+		{
+			Config: "locations:\n  - id: api\n    expression: Bad(\n" + endpoints,
+			Error:  `locations\[0\]\.expression: .*`,
+		},
+	}
+	for i, tc := range tcs {
+		comment := Commentf("test case #%d: %s", i, tc.Config)
+		cfg, err := Parse([]byte(tc.Config), YAML)
+		if err == nil {
+			_, err = cfg.NewRouter(Options{})
+		}
+		c.Assert(err, ErrorMatches, tc.Error, comment)
+	}
+}
+
+func (s *ConfigSuite) TestLoad(c *C) {
+	dir := c.MkDir()
+	yamlPath := filepath.Join(dir, "vulcan.yml")
+	c.Assert(ioutil.WriteFile(yamlPath, []byte("locations:\n  - id: api\n"), 0600), IsNil)
+	cfg, err := Load(yamlPath)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Locations[0].Id, Equals, "api")
+
+	jsonPath := filepath.Join(dir, "vulcan.json")
+	c.Assert(ioutil.WriteFile(jsonPath, []byte(`{"locations": [{"id": "api", "balancer": {"type": 1}}]}`), 0600), IsNil)
+	_, err = Load(jsonPath)
+	c.Assert(err, NotNil)
+	c.Assert(strings.HasPrefix(err.Error(), jsonPath+": locations[0].balancer: "), Equals, true, Commentf("%s", err))
+
+	_, err = Load(filepath.Join(dir, "missing.yaml"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
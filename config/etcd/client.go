@@ -0,0 +1,197 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// client talks to the JSON gateway of etcd v3 (https://etcd.io/docs/v3.5/dev-guide/api_grpc_gateway/)
+type client struct {
+	urls     []string
+	username string
+	password string
+	http     *http.Client
+
+	mutex *sync.Mutex
+	// Index of the etcd member the requests are sent to, moves to the next one on failures
+	current int
+	token   string
+}
+
+type keyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type responseHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type rangeResponse struct {
+	Header responseHeader `json:"header"`
+	Kvs    []keyValue     `json:"kvs"`
+}
+
+type event struct {
+	// PUT is the default and is omitted by the gateway
+	Type string   `json:"type"`
+	Kv   keyValue `json:"kv"`
+}
+
+type watchResponse struct {
+	Result struct {
+		Header          responseHeader `json:"header"`
+		Created         bool           `json:"created"`
+		Canceled        bool           `json:"canceled"`
+		CancelReason    string         `json:"cancel_reason"`
+		CompactRevision int64          `json:"compact_revision,string"`
+		Events          []event        `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// getPrefix returns the keys with the prefix and the revision of the store they were read at
+func (c *client) getPrefix(ctx context.Context, prefix string) (*rangeResponse, error) {
+	var re rangeResponse
+	err := c.call(ctx, "/v3/kv/range", map[string]interface{}{
+		"key":       []byte(prefix),
+		"range_end": prefixEnd(prefix),
+	}, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&re)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &re, nil
+}
+
+// watchPrefix calls fn with the changes of the keys with the prefix made since the revision,
+// until the context is canceled or the watch fails
+func (c *client) watchPrefix(ctx context.Context, prefix string, revision int64, fn func(*watchResponse) error) error {
+	return c.call(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(prefix),
+			"range_end":      prefixEnd(prefix),
+			"start_revision": revision,
+		},
+	}, func(body io.Reader) error {
+		d := json.NewDecoder(body)
+		for {
+			var re watchResponse
+			if err := d.Decode(&re); err != nil {
+				return err
+			}
+			if re.Error != nil {
+				return fmt.Errorf("Watch failed: %s", re.Error.Message)
+			}
+			if re.Result.Canceled {
+				if re.Result.CompactRevision != 0 {
+					return fmt.Errorf("Watch canceled, revision %d has been compacted", re.Result.CompactRevision)
+				}
+				return fmt.Errorf("Watch canceled: %s", re.Result.CancelReason)
+			}
+			if err := fn(&re); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func (c *client) call(ctx context.Context, path string, params interface{}, fn func(io.Reader) error) error {
+	err := c.do(ctx, path, params, fn)
+	if err != nil && ctx.Err() == nil {
+		// Next member is tried on the next call and the token is renewed in case it has expired
+		c.mutex.Lock()
+		c.current = (c.current + 1) % len(c.urls)
+		c.token = ""
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+func (c *client) do(ctx context.Context, path string, params interface{}, fn func(io.Reader) error) error {
+	url, token, err := c.getMember(ctx)
+	if err != nil {
+		return err
+	}
+	re, err := c.post(ctx, url+path, token, params)
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return responseError(re)
+	}
+	return fn(re.Body)
+}
+
+// getMember returns the URL of the member to send the requests to and the auth token, if auth is enabled
+func (c *client) getMember(ctx context.Context) (string, string, error) {
+	c.mutex.Lock()
+	url, token := c.urls[c.current], c.token
+	c.mutex.Unlock()
+	if c.username == "" || token != "" {
+		return url, token, nil
+	}
+	re, err := c.post(ctx, url+"/v3/auth/authenticate", "", map[string]string{"name": c.username, "password": c.password})
+	if err != nil {
+		return "", "", err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return "", "", responseError(re)
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(re.Body).Decode(&auth); err != nil {
+		return "", "", err
+	}
+	c.mutex.Lock()
+	c.token = auth.Token
+	c.mutex.Unlock()
+	return url, auth.Token, nil
+}
+
+func (c *client) post(ctx context.Context, url, token string, params interface{}) (*http.Response, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return c.http.Do(req.WithContext(ctx))
+}
+
+func responseError(re *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(re.Body, 4096))
+	return fmt.Errorf("%s %s: %s", re.Request.URL, re.Status, strings.TrimSpace(string(body)))
+}
+
+// prefixEnd returns the end of the range of the keys with the prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All keys after the prefix
+	return []byte{0}
+}
@@ -0,0 +1,431 @@
+/*
+Package etcd drives the proxy from etcd: the watcher keeps the locations in sync with the keys under the prefix
+and serves as the router of the proxy. The keys are (with /vulcan as the prefix):
+
+	/vulcan/locations/<id>                      {"expression": "Host(`example.com`) && TrieRoute(`/api`)", "balancer": {"type": "leastconn"}, "options": {...}}
+	/vulcan/locations/<id>/endpoints/<name>     http://10.0.0.1:5000
+	/vulcan/locations/<id>/middlewares/<id>     {"type": "ratelimit", "priority": 0, "params": {...}}
+
+Locations and middlewares are in the format of the config package, hosts are matched by the location expressions.
+The endpoints can be listed in the location too, the endpoint keys are added to them, e.g. by the service instances
+registering themselves with a lease. The endpoints and middlewares of the location that does not exist are ignored.
+
+Every change is applied atomically: the watcher builds the new router with all the locations and swaps it in,
+the requests in flight complete with the previous one. Locations that have not changed are carried over as is,
+so their balancers and connections are kept, the changes of their endpoints are synced into their balancers. If the new configuration is not valid, the error is logged
+and the previous configuration stays in effect.
+*/
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/log"
+
+	"github.com/mailgun/vulcan/admin"
+	"github.com/mailgun/vulcan/config"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route/exproute"
+)
+
+// Watcher watches the prefix and routes the requests to the locations defined there, see the package docs:
+//
+//	w, _ := etcd.NewWatcher([]string{"http://127.0.0.1:2379"}, "/vulcan")
+//	if err := w.Start(); err != nil {
+//		return err
+//	}
+//	defer w.Stop()
+//	proxy, _ := vulcan.NewProxy(w)
+type Watcher struct {
+	options Options
+	prefix  string
+	client  *client
+	router  atomic.Value
+
+	mutex *sync.Mutex
+	// Current keys with the values, relative to the prefix
+	keys      map[string][]byte
+	locations map[string]*builtLocation
+	revision  int64
+	cancel    context.CancelFunc
+	doneC     chan struct{}
+}
+
+type Options struct {
+	// Middleware types and proxy options, see config.Options
+	Config config.Options
+	// HTTP client for the requests to etcd, e.g. with the TLS config of the cluster, http.DefaultClient by default
+	Client *http.Client
+	// Credentials if the etcd auth is enabled
+	Username string
+	Password string
+	// How long to wait before reconnecting to etcd after failures, DefaultRetryPeriod by default
+	RetryPeriod time.Duration
+}
+
+const DefaultRetryPeriod = time.Second
+
+type builtLocation struct {
+	// Definition the location has been built from without the endpoints, to tell whether it has changed
+	definition []byte
+	location   *httploc.HttpLocation
+	// Endpoints of the balancer by their ids
+	endpoints map[string]endpoint.Endpoint
+}
+
+// NewWatcher creates the watcher of the prefix, the requests are sent to the etcd members in turn if they fail
+func NewWatcher(urls []string, prefix string) (*Watcher, error) {
+	return NewWatcherWithOptions(urls, prefix, Options{})
+}
+
+func NewWatcherWithOptions(urls []string, prefix string, o Options) (*Watcher, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("Provide etcd urls")
+	}
+	if prefix == "" || !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("Prefix should start with /")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, len(urls))
+	for i, u := range urls {
+		members[i] = strings.TrimRight(u, "/")
+	}
+	w := &Watcher{
+		options: o,
+		prefix:  strings.TrimRight(prefix, "/") + "/",
+		client: &client{
+			urls:     members,
+			username: o.Username,
+			password: o.Password,
+			http:     o.Client,
+			mutex:    &sync.Mutex{},
+		},
+		mutex:     &sync.Mutex{},
+		keys:      make(map[string][]byte),
+		locations: make(map[string]*builtLocation),
+	}
+	w.router.Store(exproute.NewExpRouter())
+	return w, nil
+}
+
+func (w *Watcher) GetOptions() Options {
+	return w.options
+}
+
+// Start reads the configuration and starts watching the changes.
+// Returns error if etcd is not available or the configuration is not valid, the watcher is not started then.
+func (w *Watcher) Start() error {
+	w.mutex.Lock()
+	started := w.cancel != nil
+	w.mutex.Unlock()
+	if started {
+		return fmt.Errorf("Watcher is already started")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	revision, err := w.load(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	doneC := make(chan struct{})
+	w.mutex.Lock()
+	w.cancel, w.doneC = cancel, doneC
+	w.mutex.Unlock()
+	go w.watch(ctx, revision, doneC)
+	return nil
+}
+
+// Stop stops watching the changes, the proxy keeps routing the requests with the last configuration
+func (w *Watcher) Stop() {
+	w.mutex.Lock()
+	cancel, doneC := w.cancel, w.doneC
+	w.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-doneC
+}
+
+// Route implements route.Router with the current configuration
+func (w *Watcher) Route(req request.Request) (location.Location, error) {
+	return w.GetRouter().Route(req)
+}
+
+// GetRouter returns the router with the current configuration, it is not changed by the watcher once replaced
+func (w *Watcher) GetRouter() *exproute.ExpRouter {
+	return w.router.Load().(*exproute.ExpRouter)
+}
+
+// GetRevision returns the etcd revision the current configuration has been read at
+func (w *Watcher) GetRevision() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.revision
+}
+
+// load reads all the keys and applies them, returns the revision they were read at
+func (w *Watcher) load(ctx context.Context) (int64, error) {
+	re, err := w.client.getPrefix(ctx, w.prefix)
+	if err != nil {
+		return 0, err
+	}
+	keys := make(map[string][]byte, len(re.Kvs))
+	for _, kv := range re.Kvs {
+		keys[strings.TrimPrefix(string(kv.Key), w.prefix)] = kv.Value
+	}
+	return re.Header.Revision, w.apply(keys, re.Header.Revision)
+}
+
+func (w *Watcher) watch(ctx context.Context, revision int64, doneC chan struct{}) {
+	defer close(doneC)
+	for {
+		err := w.client.watchPrefix(ctx, w.prefix, revision+1, func(re *watchResponse) error {
+			if len(re.Result.Events) == 0 {
+				return nil
+			}
+			revision = re.Result.Header.Revision
+			w.applyEvents(re.Result.Events, revision)
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Errorf("Failed to watch etcd prefix %s: %s, retrying in %s", w.prefix, err, w.options.RetryPeriod)
+		// Changes could be missed, e.g. if the revision has been compacted, so the keys are reloaded
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.options.RetryPeriod):
+			}
+			if revision, err = w.load(ctx); err == nil || ctx.Err() != nil {
+				break
+			}
+			if _, ok := err.(*config.Error); ok {
+				// The configuration is read, the changes fixing it will come through the watch
+				break
+			}
+			log.Errorf("Failed to read etcd prefix %s: %s, retrying in %s", w.prefix, err, w.options.RetryPeriod)
+		}
+	}
+}
+
+// applyEvents applies the changes made in one etcd transaction
+func (w *Watcher) applyEvents(events []event, revision int64) {
+	w.mutex.Lock()
+	keys := make(map[string][]byte, len(w.keys))
+	for k, v := range w.keys {
+		keys[k] = v
+	}
+	w.mutex.Unlock()
+
+	for _, e := range events {
+		key := strings.TrimPrefix(string(e.Kv.Key), w.prefix)
+		if e.Type == "DELETE" {
+			delete(keys, key)
+		} else {
+			keys[key] = e.Kv.Value
+		}
+	}
+	if err := w.apply(keys, revision); err != nil {
+		log.Errorf("Failed to apply etcd revision %d: %s", revision, err)
+	}
+}
+
+// apply builds the router with the locations defined by the keys and swaps it in.
+// The keys are remembered even if they are not valid, so the following changes can fix them
+func (w *Watcher) apply(keys map[string][]byte, revision int64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.keys = keys
+	defs, err := w.parseKeys(keys)
+	if err != nil {
+		return err
+	}
+	router := exproute.NewExpRouter()
+	locations := make(map[string]*builtLocation, len(defs))
+	// Endpoints to sync into the locations that are carried over, once the new configuration is known to be valid
+	synced := make(map[*builtLocation]map[string]endpoint.Endpoint)
+	for _, def := range defs {
+		key := w.prefix + "locations/" + def.Id
+		endpoints, err := parseEndpoints(def.Balancer.Endpoints)
+		if err != nil {
+			return &config.Error{Path: key, Err: &config.Error{Path: "balancer", Err: err}}
+		}
+		// Endpoints come and go, e.g. with the instances registering themselves with a lease,
+		// they are synced into the balancer rather than rebuilding the location
+		stripped := *def
+		stripped.Balancer.Endpoints = nil
+		data, err := json.Marshal(&stripped)
+		if err != nil {
+			return &config.Error{Path: key, Err: err}
+		}
+		b, ok := w.locations[def.Id]
+		if !ok || string(b.definition) != string(data) {
+			l, err := def.NewLocation(w.options.Config)
+			if err != nil {
+				return &config.Error{Path: key, Err: err}
+			}
+			b = &builtLocation{definition: data, location: l, endpoints: endpoints}
+		} else {
+			synced[b] = endpoints
+		}
+		if def.Expression == "" {
+			return &config.Error{Path: key, Err: fmt.Errorf("Provide expression")}
+		}
+		if err := router.AddLocation(def.Expression, b.location); err != nil {
+			return &config.Error{Path: key, Err: err}
+		}
+		locations[def.Id] = b
+	}
+	for b, endpoints := range synced {
+		b.syncEndpoints(endpoints)
+	}
+	previous := w.locations
+	w.locations = locations
+	w.revision = revision
+	w.router.Store(router)
+	log.Infof("Applied etcd revision %d with %d locations", revision, len(locations))
+
+	// Locations that have been replaced or removed do not get new requests, their idle connections would be
+	// kept until they time out. The requests in flight complete with them
+	for id, b := range previous {
+		if locations[id] != b {
+			_, transport := b.location.GetOptionsAndTransport()
+			transport.CloseIdleConnections()
+		}
+	}
+	return nil
+}
+
+// syncEndpoints removes the endpoints that are gone from the balancer of the location and adds the new ones,
+// the same way discovery.Syncer does
+func (b *builtLocation) syncEndpoints(endpoints map[string]endpoint.Endpoint) {
+	lb, ok := b.location.GetLoadBalancer().(admin.Balancer)
+	if !ok {
+		log.Errorf("Failed to sync the endpoints of location %s: balancer does not support changing them", b.location.GetId())
+		return
+	}
+	for id, e := range b.endpoints {
+		if _, ok := endpoints[id]; ok {
+			continue
+		}
+		if err := lb.RemoveEndpoint(e); err != nil {
+			log.Errorf("Failed to remove endpoint %s from location %s: %s", e, b.location.GetId(), err)
+			continue
+		}
+		delete(b.endpoints, id)
+		log.Infof("Removed endpoint %s from location %s", e, b.location.GetId())
+	}
+	for id, e := range endpoints {
+		if _, ok := b.endpoints[id]; ok {
+			continue
+		}
+		if err := lb.AddEndpoint(e); err != nil {
+			log.Errorf("Failed to add endpoint %s to location %s: %s", e, b.location.GetId(), err)
+			continue
+		}
+		b.endpoints[id] = e
+		log.Infof("Added endpoint %s to location %s", e, b.location.GetId())
+	}
+}
+
+// parseEndpoints returns the endpoints by their ids, the location needs at least one
+func parseEndpoints(urls []string) (map[string]endpoint.Endpoint, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("Provide endpoints")
+	}
+	endpoints := make(map[string]endpoint.Endpoint, len(urls))
+	for _, u := range urls {
+		e, err := endpoint.ParseUrl(u)
+		if err != nil {
+			return nil, fmt.Errorf("Bad endpoint '%s': %s", u, err)
+		}
+		endpoints[e.GetId()] = e
+	}
+	return endpoints, nil
+}
+
+// parseKeys returns the locations defined by the keys sorted by id
+func (w *Watcher) parseKeys(keys map[string][]byte) ([]*config.Location, error) {
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	// Locations go before their endpoints and middlewares, that are sorted by their names
+	sort.Strings(names)
+
+	defs := make(map[string]*config.Location)
+	var ids []string
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		if len(parts) < 2 || parts[0] != "locations" || parts[1] == "" {
+			continue
+		}
+		value := keys[name]
+		id := parts[1]
+		def := defs[id]
+		switch {
+		case len(parts) == 2:
+			def = &config.Location{}
+			if err := decode(value, def); err != nil {
+				return nil, &config.Error{Path: w.prefix + name, Err: err}
+			}
+			def.Id = id
+			defs[id] = def
+			ids = append(ids, id)
+		case def == nil:
+			log.Warningf("Ignoring etcd key %s of the location that does not exist", w.prefix+name)
+		case len(parts) == 4 && parts[2] == "endpoints":
+			def.Balancer.Endpoints = append(def.Balancer.Endpoints, strings.TrimSpace(string(value)))
+		case len(parts) == 4 && parts[2] == "middlewares":
+			m := config.Middleware{}
+			if err := decode(value, &m); err != nil {
+				return nil, &config.Error{Path: w.prefix + name, Err: err}
+			}
+			m.Id = parts[3]
+			def.Middlewares = append(def.Middlewares, m)
+		}
+	}
+	out := make([]*config.Location, len(ids))
+	for i, id := range ids {
+		out[i] = defs[id]
+	}
+	return out, nil
+}
+
+// decode rejects the unknown fields, so the typos are not silently ignored
+func decode(data []byte, v interface{}) error {
+	d := json.NewDecoder(strings.NewReader(string(data)))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	if o.RetryPeriod < 0 {
+		return o, fmt.Errorf("RetryPeriod can not be negative")
+	}
+	if o.RetryPeriod == 0 {
+		o.RetryPeriod = DefaultRetryPeriod
+	}
+	return o, nil
+}
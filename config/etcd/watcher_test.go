@@ -0,0 +1,396 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func TestEtcd(t *testing.T) { TestingT(t) }
+
+type WatcherSuite struct {
+	etcd *fakeEtcd
+}
+
+var _ = Suite(&WatcherSuite{})
+
+func (s *WatcherSuite) SetUpTest(c *C) {
+	s.etcd = newFakeEtcd()
+}
+
+func (s *WatcherSuite) TearDownTest(c *C) {
+	s.etcd.Close()
+}
+
+func (s *WatcherSuite) newWatcher(c *C, o Options) *Watcher {
+	o.RetryPeriod = 10 * time.Millisecond
+	w, err := NewWatcherWithOptions([]string{s.etcd.URL}, "/vulcan", o)
+	c.Assert(err, IsNil)
+	return w
+}
+
+func (s *WatcherSuite) TestWatch(c *C) {
+	a := testutils.NewTestResponder("a")
+	defer a.Close()
+	b := testutils.NewTestResponder("b")
+	defer b.Close()
+
+	s.etcd.put(
+		"/vulcan/locations/a", `{"expression": "TrieRoute(`+"`/a`"+`)", "balancer": {"type": "leastconn"}}`,
+		"/vulcan/locations/a/endpoints/1", a.URL,
+		"/other/locations/b", `{"expression": "TrieRoute(`+"`/b`"+`)"}`,
+	)
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+	c.Assert(w.GetRevision(), Equals, int64(1))
+
+	p, err := vulcan.NewProxy(w)
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	c.Assert(get(c, proxy.URL+"/a"), Equals, "a")
+	c.Assert(get(c, proxy.URL+"/b"), Equals, "502")
+	locationA := w.GetRouter().GetLocationById("a")
+
+	// Location is added with its endpoint at once
+	s.etcd.put(
+		"/vulcan/locations/b", `{"expression": "TrieRoute(`+"`/b`"+`)"}`,
+		"/vulcan/locations/b/endpoints/1", b.URL,
+	)
+	s.waitRevision(c, w, 2)
+	c.Assert(get(c, proxy.URL+"/b"), Equals, "b")
+	c.Assert(w.GetRouter().GetLocationById("a"), Equals, locationA)
+
+	s.etcd.put("/vulcan/locations/a/middlewares/deny", `{"type": "acl", "params": {"deny": ["127.0.0.1"]}}`)
+	s.waitRevision(c, w, 3)
+	c.Assert(get(c, proxy.URL+"/a"), Equals, "403")
+	c.Assert(w.GetRouter().GetLocationById("a"), Not(Equals), locationA)
+
+	s.etcd.delete("/vulcan/locations/a")
+	s.waitRevision(c, w, 4)
+	c.Assert(get(c, proxy.URL+"/a"), Equals, "502")
+	c.Assert(get(c, proxy.URL+"/b"), Equals, "b")
+}
+
+func (s *WatcherSuite) TestEndpoints(c *C) {
+	a := testutils.NewTestResponder("a")
+	defer a.Close()
+	b := testutils.NewTestResponder("b")
+	defer b.Close()
+
+	s.etcd.put(
+		"/vulcan/locations/a", `{"expression": "TrieRoute(`+"`/a`"+`)"}`,
+		"/vulcan/locations/a/endpoints/1", a.URL,
+	)
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+
+	p, err := vulcan.NewProxy(w)
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+	locationA := w.GetRouter().GetLocationById("a")
+
+	// Endpoints are synced into the balancer of the location, it is not rebuilt
+	s.etcd.put("/vulcan/locations/a/endpoints/2", b.URL)
+	s.waitRevision(c, w, 2)
+	c.Assert(w.GetRouter().GetLocationById("a"), Equals, locationA)
+	c.Assert(get(c, proxy.URL+"/a")+get(c, proxy.URL+"/a"), Matches, "ab|ba")
+
+	s.etcd.delete("/vulcan/locations/a/endpoints/1")
+	s.waitRevision(c, w, 3)
+	c.Assert(w.GetRouter().GetLocationById("a"), Equals, locationA)
+	c.Assert(get(c, proxy.URL+"/a"), Equals, "b")
+	c.Assert(get(c, proxy.URL+"/a"), Equals, "b")
+
+	// Location without endpoints is not valid, the previous configuration stays in effect
+	s.etcd.delete("/vulcan/locations/a/endpoints/2")
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(w.GetRevision(), Equals, int64(3))
+	c.Assert(get(c, proxy.URL+"/a"), Equals, "b")
+}
+
+func (s *WatcherSuite) TestInvalidChange(c *C) {
+	a := testutils.NewTestResponder("a")
+	defer a.Close()
+
+	s.etcd.put("/vulcan/locations/a", fmt.Sprintf(`{"expression": "TrieRoute(`+"`/a`"+`)", "balancer": {"endpoints": [%q]}}`, a.URL))
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+	router := w.GetRouter()
+
+	// Previous configuration stays in effect
+	s.etcd.put("/vulcan/locations/a/middlewares/limit", `{"type": "ratelimiter"}`)
+	s.etcd.put("/vulcan/locations/b", `{"expression": "TrieRoute(`+"`/b`"+`)", "balancer": {"endpoints": ["http://localhost:5000"]}}`)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(w.GetRevision(), Equals, int64(1))
+	c.Assert(w.GetRouter(), Equals, router)
+
+	s.etcd.delete("/vulcan/locations/a/middlewares/limit")
+	s.waitRevision(c, w, 4)
+	c.Assert(w.GetRouter().GetLocationById("b"), NotNil)
+}
+
+func (s *WatcherSuite) TestReconnect(c *C) {
+	a := testutils.NewTestResponder("a")
+	defer a.Close()
+
+	s.etcd.put("/vulcan/locations/a", fmt.Sprintf(`{"expression": "TrieRoute(`+"`/a`"+`)", "balancer": {"endpoints": [%q]}}`, a.URL))
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+
+	// Changes made while the watch is down are read once it reconnects
+	s.etcd.setDown(true)
+	s.etcd.delete("/vulcan/locations/a")
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(w.GetRouter().GetLocationById("a"), NotNil)
+
+	s.etcd.setDown(false)
+	s.waitRevision(c, w, 2)
+	c.Assert(w.GetRouter().GetLocationById("a"), IsNil)
+}
+
+func (s *WatcherSuite) TestAuth(c *C) {
+	s.etcd.username, s.etcd.password = "vulcan", "secret"
+	s.etcd.put("/vulcan/locations/a", `{"expression": "TrieRoute(`+"`/a`"+`)", "balancer": {"endpoints": ["http://localhost:5000"]}}`)
+
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), ErrorMatches, ".*401 Unauthorized.*")
+
+	w = s.newWatcher(c, Options{Username: "vulcan", Password: "secret"})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+	c.Assert(w.GetRouter().GetLocationById("a"), NotNil)
+}
+
+func (s *WatcherSuite) TestStartErrors(c *C) {
+	s.etcd.put("/vulcan/locations/a", `{"expression": "TrieRoute(`+"`/a`"+`)"}`)
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), ErrorMatches, "/vulcan/locations/a: balancer: Provide endpoints")
+
+	s.etcd.put("/vulcan/locations/a", `{"expresion": "TrieRoute(`+"`/a`"+`)"}`)
+	c.Assert(w.Start(), ErrorMatches, `/vulcan/locations/a: json: unknown field "expresion"`)
+
+	s.etcd.setDown(true)
+	c.Assert(w.Start(), NotNil)
+}
+
+func (s *WatcherSuite) TestBadParams(c *C) {
+	_, err := NewWatcher(nil, "/vulcan")
+	c.Assert(err, NotNil)
+	_, err = NewWatcher([]string{s.etcd.URL}, "vulcan")
+	c.Assert(err, NotNil)
+	_, err = NewWatcherWithOptions([]string{s.etcd.URL}, "/vulcan", Options{RetryPeriod: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *WatcherSuite) TestPrefixEnd(c *C) {
+	c.Assert(string(prefixEnd("/vulcan/")), Equals, "/vulcan0")
+	c.Assert(prefixEnd("a\xff"), DeepEquals, []byte("b"))
+	c.Assert(prefixEnd("\xff"), DeepEquals, []byte{0})
+}
+
+func (s *WatcherSuite) waitRevision(c *C, w *Watcher, revision int64) {
+	for i := 0; i < 200; i++ {
+		if w.GetRevision() >= revision {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("Revision %d has not been applied, current revision is %d", revision, w.GetRevision())
+}
+
+// get returns the body of the successful response or the status code
+func get(c *C, url string) string {
+	re, body, err := testutils.GET(url, testutils.Opts{})
+	c.Assert(err, IsNil)
+	if re.StatusCode != http.StatusOK {
+		return fmt.Sprint(re.StatusCode)
+	}
+	return string(body)
+}
+
+// fakeEtcd serves the range and watch requests of the etcd JSON gateway
+type fakeEtcd struct {
+	*httptest.Server
+	username string
+	password string
+
+	mutex    sync.Mutex
+	revision int64
+	kvs      map[string]string
+	events   []fakeEvent
+	down     bool
+	// Closed and replaced on every change to wake up the watches
+	changedC chan struct{}
+}
+
+type fakeEvent struct {
+	revision int64
+	typ      string
+	key      string
+	value    string
+}
+
+func newFakeEtcd() *fakeEtcd {
+	e := &fakeEtcd{kvs: make(map[string]string), changedC: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/auth/authenticate", e.authenticate)
+	mux.HandleFunc("/v3/kv/range", e.checkAuth(e.getRange))
+	mux.HandleFunc("/v3/watch", e.checkAuth(e.watch))
+	e.Server = httptest.NewServer(mux)
+	return e
+}
+
+// put sets the keys and values in one transaction
+func (e *fakeEtcd) put(kvs ...string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.revision++
+	for i := 0; i < len(kvs); i += 2 {
+		e.kvs[kvs[i]] = kvs[i+1]
+		e.events = append(e.events, fakeEvent{revision: e.revision, key: kvs[i], value: kvs[i+1]})
+	}
+	close(e.changedC)
+	e.changedC = make(chan struct{})
+}
+
+func (e *fakeEtcd) delete(key string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.revision++
+	delete(e.kvs, key)
+	e.events = append(e.events, fakeEvent{revision: e.revision, typ: "DELETE", key: key})
+	close(e.changedC)
+	e.changedC = make(chan struct{})
+}
+
+// setDown makes etcd fail the requests and drop the watches
+func (e *fakeEtcd) setDown(down bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.down = down
+	close(e.changedC)
+	e.changedC = make(chan struct{})
+}
+
+func (e *fakeEtcd) authenticate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Name != e.username || req.Password != e.password {
+		http.Error(w, `{"error": "authentication failed"}`, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": "token-" + e.username})
+}
+
+func (e *fakeEtcd) checkAuth(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e.mutex.Lock()
+		down := e.down
+		e.mutex.Unlock()
+		if down {
+			http.Error(w, `{"error": "etcdserver: no leader"}`, http.StatusServiceUnavailable)
+			return
+		}
+		if e.username != "" && r.Header.Get("Authorization") != "token-"+e.username {
+			http.Error(w, `{"error": "etcdserver: user name is empty"}`, http.StatusUnauthorized)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (e *fakeEtcd) getRange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key      []byte `json:"key"`
+		RangeEnd []byte `json:"range_end"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	re := map[string]interface{}{"header": map[string]string{"revision": fmt.Sprint(e.revision)}}
+	var kvs []keyValue
+	for k, v := range e.kvs {
+		if k >= string(req.Key) && k < string(req.RangeEnd) {
+			kvs = append(kvs, keyValue{Key: []byte(k), Value: []byte(v)})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+	re["kvs"] = kvs
+	json.NewEncoder(w).Encode(re)
+}
+
+func (e *fakeEtcd) watch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CreateRequest struct {
+			Key           []byte `json:"key"`
+			RangeEnd      []byte `json:"range_end"`
+			StartRevision int64  `json:"start_revision"`
+		} `json:"create_request"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	from, to := string(req.CreateRequest.Key), string(req.CreateRequest.RangeEnd)
+	next := req.CreateRequest.StartRevision
+
+	e.mutex.Lock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": map[string]interface{}{"header": map[string]string{"revision": fmt.Sprint(e.revision)}, "created": true},
+	})
+	e.mutex.Unlock()
+	w.(http.Flusher).Flush()
+
+	for {
+		e.mutex.Lock()
+		if e.down {
+			e.mutex.Unlock()
+			return
+		}
+		// Events of one revision are sent in one response, like the ones of one transaction
+		for next <= e.revision {
+			var events []map[string]interface{}
+			for _, ev := range e.events {
+				if ev.revision == next && ev.key >= from && ev.key < to {
+					event := map[string]interface{}{"kv": keyValue{Key: []byte(ev.key), Value: []byte(ev.value)}}
+					if ev.typ != "" {
+						event["type"] = ev.typ
+					}
+					events = append(events, event)
+				}
+			}
+			if len(events) != 0 {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"result": map[string]interface{}{"header": map[string]string{"revision": fmt.Sprint(next)}, "events": events},
+				})
+			}
+			next++
+		}
+		changedC := e.changedC
+		e.mutex.Unlock()
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-changedC:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mailgun/vulcan/acl"
+	"github.com/mailgun/vulcan/admin"
+	"github.com/mailgun/vulcan/cors"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/connlimit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/middleware"
+)
+
+// Middlewares are the built in middleware types, they can be registered in admin.Options too
+// to add the same middlewares through the admin API:
+//
+//	ratelimit  {"variable": "client.ip", "period": "1s", "average": 100, "burst": 200}
+//	connlimit  {"variable": "client.ip", "max_connections": 10}
+//	acl        {"allow": ["10.0.0.0/8"], "deny": ["10.0.5.0/24"]}
+//	cors       {"allowed_origins": ["https://*.example.com"], "allow_credentials": true, "max_age": "1h"}
+//
+// The variable is the one of limit.VariableToMapper, client.ip by default
+var Middlewares = map[string]admin.MiddlewareFactory{
+	"ratelimit": newRateLimiter,
+	"connlimit": newConnLimiter,
+	"acl":       newACL,
+	"cors":      newCors,
+}
+
+func newRateLimiter(params json.RawMessage) (middleware.Middleware, error) {
+	p := struct {
+		Variable string   `json:"variable"`
+		Period   Duration `json:"period"`
+		Average  int64    `json:"average"`
+		Burst    int64    `json:"burst"`
+	}{Period: Duration(time.Second)}
+	if err := decodeSection(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Average <= 0 {
+		return nil, fmt.Errorf("Provide average rate")
+	}
+	mapper, err := variableToMapper(p.Variable)
+	if err != nil {
+		return nil, err
+	}
+	rate := tokenbucket.Rate{Units: p.Average, Period: p.Period.Duration()}
+	return tokenbucket.NewTokenLimiterWithOptions(mapper, rate, tokenbucket.Options{Burst: p.Burst})
+}
+
+func newConnLimiter(params json.RawMessage) (middleware.Middleware, error) {
+	var p struct {
+		Variable       string `json:"variable"`
+		MaxConnections int64  `json:"max_connections"`
+	}
+	if err := decodeSection(params, &p); err != nil {
+		return nil, err
+	}
+	mapper, err := variableToMapper(p.Variable)
+	if err != nil {
+		return nil, err
+	}
+	return connlimit.NewConnectionLimiter(mapper, p.MaxConnections)
+}
+
+func newACL(params json.RawMessage) (middleware.Middleware, error) {
+	var p struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	if err := decodeSection(params, &p); err != nil {
+		return nil, err
+	}
+	return acl.NewACL(p.Allow, p.Deny)
+}
+
+func newCors(params json.RawMessage) (middleware.Middleware, error) {
+	var p struct {
+		AllowedOrigins   []string `json:"allowed_origins"`
+		AllowedMethods   []string `json:"allowed_methods"`
+		AllowedHeaders   []string `json:"allowed_headers"`
+		ExposedHeaders   []string `json:"exposed_headers"`
+		AllowCredentials bool     `json:"allow_credentials"`
+		MaxAge           Duration `json:"max_age"`
+	}
+	if err := decodeSection(params, &p); err != nil {
+		return nil, err
+	}
+	return cors.NewCorsWithOptions(cors.Options{
+		AllowedOrigins:   p.AllowedOrigins,
+		AllowedMethods:   p.AllowedMethods,
+		AllowedHeaders:   p.AllowedHeaders,
+		ExposedHeaders:   p.ExposedHeaders,
+		AllowCredentials: p.AllowCredentials,
+		MaxAge:           p.MaxAge.Duration(),
+	})
+}
+
+func variableToMapper(variable string) (limit.MapperFn, error) {
+	if variable == "" {
+		variable = "client.ip"
+	}
+	return limit.VariableToMapper(variable)
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlToJSON converts the YAML document to JSON, so both formats are decoded and validated the same way.
+// The keys of the mappings have to be strings, the empty document is the empty mapping
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return []byte("{}"), nil
+	}
+	v, err := toJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// toJSONValue converts the decoded YAML value to the one JSON can represent
+func toJSONValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			converted, err := toJSONValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+			v[key] = converted
+		}
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			s, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			converted, err := toJSONValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", s, err)
+			}
+			out[s] = converted
+		}
+		return out, nil
+	case []interface{}:
+		for i, value := range v {
+			converted, err := toJSONValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %s", i, err)
+			}
+			v[i] = converted
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v is not a valid number, quote it to make it a string", v)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type YAMLSuite struct{}
+
+var _ = Suite(&YAMLSuite{})
+
+func (s *YAMLSuite) TestConvert(c *C) {
+	tcs := []struct {
+		YAML string
+		JSON string
+	}{
+		{"", `{}`},
+		{"# comment only\n", `{}`},
+		{"---\na: 1", `{"a":1}`},
+		{"a: 1\nb: 1.5\nc: true\nd: null\ne: ~\nf: text", `{"a":1,"b":1.5,"c":true,"d":null,"e":null,"f":"text"}`},
+		{"a: \"quoted # not a comment\"  # comment", `{"a":"quoted # not a comment"}`},
+		{"a: 'it''s'", `{"a":"it's"}`},
+		{"a: \"10\"", `{"a":"10"}`},
+		{"a: 'value with spaces: and colon'", `{"a":"value with spaces: and colon"}`},
+		{"a: http://localhost:5000", `{"a":"http://localhost:5000"}`},
+		{"a: TrieRoute(`/a`) && Header(`X`, `b`)", `{"a":"TrieRoute(` + "`/a`" + `) \u0026\u0026 Header(` + "`X`, `b`" + `)"}`},
+		{"a:\n  b:\n    c: 1\n  d: 2", `{"a":{"b":{"c":1},"d":2}}`},
+		{"a:\n  - 1\n  - two", `{"a":[1,"two"]}`},
+		{"a:\n- 1\n- 2\nb: 3", `{"a":[1,2],"b":3}`},
+		{"- a: 1\n  b: 2\n- c: 3", `[{"a":1,"b":2},{"c":3}]`},
+		{"-\n  a: 1\n- - 2\n  - 3", `[{"a":1},[2,3]]`},
+		{"a: [1, 'b, c', \"d\"]", `{"a":[1,"b, c","d"]}`},
+		{"a: []\nb: {}", `{"a":[],"b":{}}`},
+		{"a: {b: 1, c: d}", `{"a":{"b":1,"c":"d"}}`},
+		{"a:", `{"a":null}`},
+		{"a: |\n  line\n  text\n", `{"a":"line\ntext\n"}`},
+		{"a: &a {b: 1}\nc: *a", `{"a":{"b":1},"c":{"b":1}}`},
+		{"id: nan\nb: Infinity\nc: inf", `{"b":"Infinity","c":"inf","id":"nan"}`},
+		{"msg: don't # note", `{"msg":"don't"}`},
+		{"a: 1 # note\n# comment\nb: 'c # d'", `{"a":1,"b":"c # d"}`},
+	}
+	for i, tc := range tcs {
+		out, err := yamlToJSON([]byte(tc.YAML))
+		c.Assert(err, IsNil, Commentf("test case #%d: %s", i, tc.YAML))
+		c.Assert(string(out), Equals, tc.JSON, Commentf("test case #%d: %s", i, tc.YAML))
+	}
+}
+
+func (s *YAMLSuite) TestErrors(c *C) {
+	tcs := []struct {
+		YAML  string
+		Error string
+	}{
+		{"a: 1\n\tb: 2", "yaml: line 2: found a tab character that violates indentation"},
+		{"a: value: b", "yaml: mapping values are not allowed in this context"},
+		{"a: 1\n  b: 2", "yaml: line 2: mapping values are not allowed in this context"},
+		{"a: 1\na: 2", "yaml: unmarshal errors:\n  line 2: mapping key \"a\" already defined at line 1"},
+		{"a: [1, 2", "yaml: line 1: did not find expected ',' or ']'"},
+		{"a: \"unterminated", "yaml: found unexpected end of stream"},
+		{"a: .nan", "a: NaN is not a valid number, quote it to make it a string"},
+		{"a: [-.inf]", "a: \\[0\\]: -Inf is not a valid number, quote it to make it a string"},
+		{"a: {1: b}", "a: key 1 is not a string"},
+	}
+	for i, tc := range tcs {
+		_, err := yamlToJSON([]byte(tc.YAML))
+		c.Assert(err, ErrorMatches, tc.Error, Commentf("test case #%d: %s", i, tc.YAML))
+	}
+}
@@ -0,0 +1,220 @@
+// Middleware implementing Cross-Origin Resource Sharing
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Cors answers the preflight OPTIONS requests of the browsers without proxying them to the endpoints
+// and adds the CORS headers to the responses of the actual requests from the allowed origins.
+// Requests from the origins that are not allowed are proxied as is, so the browsers block them.
+type Cors struct {
+	options        Options
+	allowedMethods map[string]bool
+	allowedHeaders map[string]bool
+	anyHeader      bool
+}
+
+type Options struct {
+	// Origins allowed to make the requests, e.g. "https://example.com". "*" allows any origin,
+	// the origin can contain one wildcard, e.g. "https://*.example.com". Any origin is allowed by default
+	AllowedOrigins []string
+	// Methods allowed in the actual requests, DefaultAllowedMethods by default
+	AllowedMethods []string
+	// Headers allowed in the actual requests, "*" allows any header, DefaultAllowedHeaders by default
+	AllowedHeaders []string
+	// Response headers the browsers let the scripts read in addition to the simple response headers
+	ExposedHeaders []string
+	// Whether the requests can include the cookies and the credentials, the origins have to be listed
+	// explicitly then, as "*" would let any website read the responses to the credentialed requests
+	AllowCredentials bool
+	// How long the browsers can cache the preflight response, the browser's default is used if 0
+	MaxAge time.Duration
+}
+
+var (
+	DefaultAllowedOrigins = []string{"*"}
+	DefaultAllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	DefaultAllowedHeaders = []string{"Accept", "Accept-Language", "Content-Language", "Content-Type", "Authorization", "X-Requested-With"}
+)
+
+func NewCors() (*Cors, error) {
+	return NewCorsWithOptions(Options{})
+}
+
+func NewCorsWithOptions(o Options) (*Cors, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cors{
+		options:        o,
+		allowedMethods: make(map[string]bool),
+		allowedHeaders: make(map[string]bool),
+	}
+	for _, m := range o.AllowedMethods {
+		c.allowedMethods[strings.ToUpper(m)] = true
+	}
+	for _, h := range o.AllowedHeaders {
+		if h == "*" {
+			c.anyHeader = true
+		}
+		c.allowedHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	return c, nil
+}
+
+func (c *Cors) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	if req.Method != "OPTIONS" || req.Header.Get(origin) == "" || req.Header.Get(requestMethod) == "" {
+		return nil, nil
+	}
+	return c.preflight(r), nil
+}
+
+func (c *Cors) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// ModifyResponse adds the CORS headers to the response of the actual request from the allowed origin
+func (c *Cors) ModifyResponse(r request.Request, re *http.Response) error {
+	req := r.GetHttpRequest()
+	o := req.Header.Get(origin)
+	if o == "" || re.Header.Get(allowOrigin) != "" {
+		return nil
+	}
+	re.Header.Add("Vary", origin)
+	if !c.isOriginAllowed(o) {
+		return nil
+	}
+	c.setAllowOrigin(re.Header, o)
+	if len(c.options.ExposedHeaders) != 0 {
+		re.Header.Set(exposeHeaders, strings.Join(c.options.ExposedHeaders, ", "))
+	}
+	return nil
+}
+
+func (c *Cors) preflight(r request.Request) *http.Response {
+	req := r.GetHttpRequest()
+	o := req.Header.Get(origin)
+	if !c.isOriginAllowed(o) {
+		log.Infof("%s preflight request from origin %q is not allowed", r, o)
+		return forbidden(req, "Origin is not allowed")
+	}
+	method := strings.ToUpper(req.Header.Get(requestMethod))
+	if !c.allowedMethods[method] {
+		log.Infof("%s preflight request for method %q is not allowed", r, method)
+		return forbidden(req, "Method is not allowed")
+	}
+	requested := parseHeaderList(req.Header[requestHeaders])
+	for _, h := range requested {
+		if !c.anyHeader && !c.allowedHeaders[h] {
+			log.Infof("%s preflight request for header %q is not allowed", r, h)
+			return forbidden(req, "Header is not allowed")
+		}
+	}
+
+	re := netutils.NewTextResponse(req, http.StatusNoContent, "")
+	re.Header.Del("Content-Type")
+	re.Header.Add("Vary", strings.Join([]string{origin, requestMethod, requestHeaders}, ", "))
+	c.setAllowOrigin(re.Header, o)
+	re.Header.Set(allowMethods, strings.Join(c.options.AllowedMethods, ", "))
+	if len(requested) != 0 {
+		re.Header.Set(allowHeaders, strings.Join(requested, ", "))
+	}
+	if c.options.MaxAge > 0 {
+		re.Header.Set(maxAge, strconv.Itoa(int(c.options.MaxAge/time.Second)))
+	}
+	return re
+}
+
+func (c *Cors) setAllowOrigin(h http.Header, o string) {
+	// Any origin is never combined with credentials, see parseOptions
+	if len(c.options.AllowedOrigins) == 1 && c.options.AllowedOrigins[0] == "*" {
+		h.Set(allowOrigin, "*")
+	} else {
+		h.Set(allowOrigin, o)
+	}
+	if c.options.AllowCredentials {
+		h.Set(allowCredentials, "true")
+	}
+}
+
+func (c *Cors) isOriginAllowed(o string) bool {
+	o = strings.ToLower(o)
+	for _, pattern := range c.options.AllowedOrigins {
+		if matchOrigin(strings.ToLower(pattern), o) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches the origin against the pattern with at most one wildcard
+func matchOrigin(pattern, o string) bool {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return pattern == o
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(o) >= len(prefix)+len(suffix) && strings.HasPrefix(o, prefix) && strings.HasSuffix(o, suffix)
+}
+
+func parseHeaderList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				out = append(out, http.CanonicalHeaderKey(h))
+			}
+		}
+	}
+	return out
+}
+
+func forbidden(req *http.Request, message string) *http.Response {
+	return netutils.NewTextResponse(req, http.StatusForbidden, message)
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MaxAge < 0 {
+		return o, fmt.Errorf("Max age can not be negative")
+	}
+	if o.AllowedOrigins == nil {
+		o.AllowedOrigins = DefaultAllowedOrigins
+	}
+	for _, pattern := range o.AllowedOrigins {
+		if strings.Count(pattern, "*") > 1 {
+			return o, fmt.Errorf("Origin %q can contain only one wildcard", pattern)
+		}
+		if pattern == "*" && o.AllowCredentials {
+			return o, fmt.Errorf("Credentials can not be allowed for any origin, list the allowed origins")
+		}
+	}
+	if o.AllowedMethods == nil {
+		o.AllowedMethods = DefaultAllowedMethods
+	}
+	if o.AllowedHeaders == nil {
+		o.AllowedHeaders = DefaultAllowedHeaders
+	}
+	return o, nil
+}
+
+const (
+	origin           = "Origin"
+	requestMethod    = "Access-Control-Request-Method"
+	requestHeaders   = "Access-Control-Request-Headers"
+	allowOrigin      = "Access-Control-Allow-Origin"
+	allowMethods     = "Access-Control-Allow-Methods"
+	allowHeaders     = "Access-Control-Allow-Headers"
+	allowCredentials = "Access-Control-Allow-Credentials"
+	exposeHeaders    = "Access-Control-Expose-Headers"
+	maxAge           = "Access-Control-Max-Age"
+)
@@ -0,0 +1,168 @@
+package cors
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestCors(t *testing.T) { TestingT(t) }
+
+type CorsSuite struct{}
+
+var _ = Suite(&CorsSuite{})
+
+func (s *CorsSuite) TestPreflight(c *C) {
+	cors, err := NewCorsWithOptions(Options{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedMethods:   []string{"GET", "PUT"},
+		AllowedHeaders:   []string{"Content-Type", "X-Token"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	c.Assert(err, IsNil)
+
+	re, err := cors.ProcessRequest(makeRequest("OPTIONS",
+		"Origin", "https://app.example.com",
+		"Access-Control-Request-Method", "PUT",
+		"Access-Control-Request-Headers", "content-type, x-token"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNoContent)
+	c.Assert(re.Header.Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Assert(re.Header.Get("Access-Control-Allow-Methods"), Equals, "GET, PUT")
+	c.Assert(re.Header.Get("Access-Control-Allow-Headers"), Equals, "Content-Type, X-Token")
+	c.Assert(re.Header.Get("Access-Control-Allow-Credentials"), Equals, "true")
+	c.Assert(re.Header.Get("Access-Control-Max-Age"), Equals, "600")
+}
+
+func (s *CorsSuite) TestPreflightRejected(c *C) {
+	cors, err := NewCorsWithOptions(Options{
+		AllowedOrigins: []string{"https://*.example.com"},
+		AllowedMethods: []string{"GET"},
+	})
+	c.Assert(err, IsNil)
+
+	requests := []request.Request{
+		makeRequest("OPTIONS", "Origin", "https://example.org", "Access-Control-Request-Method", "GET"),
+		makeRequest("OPTIONS", "Origin", "https://app.example.com", "Access-Control-Request-Method", "DELETE"),
+		makeRequest("OPTIONS", "Origin", "https://app.example.com", "Access-Control-Request-Method", "GET",
+			"Access-Control-Request-Headers", "X-Token"),
+	}
+	for _, r := range requests {
+		re, err := cors.ProcessRequest(r)
+		c.Assert(err, IsNil)
+		c.Assert(re, NotNil)
+		c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+		c.Assert(re.Header.Get("Access-Control-Allow-Origin"), Equals, "")
+	}
+}
+
+// Regular OPTIONS requests are proxied to the endpoints
+func (s *CorsSuite) TestNotPreflight(c *C) {
+	cors, err := NewCors()
+	c.Assert(err, IsNil)
+
+	for _, r := range []request.Request{makeRequest("OPTIONS"), makeRequest("GET", "Origin", "https://example.com")} {
+		re, err := cors.ProcessRequest(r)
+		c.Assert(err, IsNil)
+		c.Assert(re, IsNil)
+	}
+}
+
+func (s *CorsSuite) TestActualRequest(c *C) {
+	cors, err := NewCorsWithOptions(Options{ExposedHeaders: []string{"X-Total"}})
+	c.Assert(err, IsNil)
+
+	re := netutils.NewTextResponse(nil, http.StatusOK, "hello")
+	c.Assert(cors.ModifyResponse(makeRequest("GET", "Origin", "https://example.com"), re), IsNil)
+	c.Assert(re.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
+	c.Assert(re.Header.Get("Access-Control-Expose-Headers"), Equals, "X-Total")
+	c.Assert(re.Header.Get("Access-Control-Allow-Credentials"), Equals, "")
+	c.Assert(re.Header.Get("Vary"), Equals, "Origin")
+
+	// Not a CORS request
+	re = netutils.NewTextResponse(nil, http.StatusOK, "hello")
+	c.Assert(cors.ModifyResponse(makeRequest("GET"), re), IsNil)
+	c.Assert(re.Header.Get("Access-Control-Allow-Origin"), Equals, "")
+}
+
+func (s *CorsSuite) TestActualRequestNotAllowed(c *C) {
+	cors, err := NewCorsWithOptions(Options{AllowedOrigins: []string{"https://example.com"}})
+	c.Assert(err, IsNil)
+
+	re := netutils.NewTextResponse(nil, http.StatusOK, "hello")
+	c.Assert(cors.ModifyResponse(makeRequest("GET", "Origin", "https://example.org"), re), IsNil)
+	c.Assert(re.Header.Get("Access-Control-Allow-Origin"), Equals, "")
+	c.Assert(readBody(c, re), Equals, "hello")
+}
+
+// Wildcard is not allowed with credentials, so the origin is echoed back
+func (s *CorsSuite) TestCredentials(c *C) {
+	cors, err := NewCorsWithOptions(Options{AllowedOrigins: []string{"https://*.com"}, AllowCredentials: true})
+	c.Assert(err, IsNil)
+
+	re := netutils.NewTextResponse(nil, http.StatusOK, "hello")
+	c.Assert(cors.ModifyResponse(makeRequest("GET", "Origin", "https://example.com"), re), IsNil)
+	c.Assert(re.Header.Get("Access-Control-Allow-Origin"), Equals, "https://example.com")
+	c.Assert(re.Header.Get("Access-Control-Allow-Credentials"), Equals, "true")
+}
+
+// Any origin could read the credentialed responses, so the origins have to be listed
+func (s *CorsSuite) TestCredentialsAnyOrigin(c *C) {
+	_, err := NewCorsWithOptions(Options{AllowCredentials: true})
+	c.Assert(err, ErrorMatches, "Credentials can not be allowed for any origin.*")
+
+	_, err = NewCorsWithOptions(Options{AllowedOrigins: []string{"https://example.com", "*"}, AllowCredentials: true})
+	c.Assert(err, NotNil)
+}
+
+func (s *CorsSuite) TestMatchOrigin(c *C) {
+	tcs := []struct {
+		pattern string
+		origin  string
+		match   bool
+	}{
+		{"*", "https://example.com", true},
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "http://example.com", false},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"http://localhost:*", "http://localhost:8080", true},
+	}
+	for _, tc := range tcs {
+		c.Assert(matchOrigin(tc.pattern, tc.origin), Equals, tc.match, Commentf("%s %s", tc.pattern, tc.origin))
+	}
+}
+
+func (s *CorsSuite) TestBadParams(c *C) {
+	_, err := NewCorsWithOptions(Options{MaxAge: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewCorsWithOptions(Options{AllowedOrigins: []string{"https://*.*.com"}})
+	c.Assert(err, NotNil)
+}
+
+func makeRequest(method string, kv ...string) request.Request {
+	req := &http.Request{
+		Method: method,
+		URL:    netutils.MustParseUrl("http://localhost/a"),
+		Header: http.Header{},
+	}
+	for i := 0; i < len(kv); i += 2 {
+		req.Header.Set(kv[i], kv[i+1])
+	}
+	return request.NewBaseRequest(req, 1, nil)
+}
+
+func readBody(c *C, re *http.Response) string {
+	defer re.Body.Close()
+	out, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(out)
+}
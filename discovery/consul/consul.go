@@ -0,0 +1,294 @@
+// Consul service discovery: keeps the endpoints of the balancer in sync with the healthy instances of the service
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+
+	"github.com/mailgun/vulcan/discovery"
+)
+
+// Watcher subscribes to the instances of the service that pass their Consul health checks with the blocking
+// queries of the health API and syncs them to the balancer:
+//
+//	rr, _ := roundrobin.NewRoundRobin()
+//	w, _ := consul.NewWatcher(rr, "http://127.0.0.1:8500", "api")
+//	if err := w.Start(); err != nil {
+//		return err
+//	}
+//	defer w.Stop()
+//
+// The weight of the instance is taken from the service metadata, e.g. {"weight": "5"}, or from the passing
+// weight of the service if the metadata does not have it.
+type Watcher struct {
+	options Options
+	url     string
+	service string
+	syncer  *discovery.Syncer
+
+	mutex  *sync.Mutex
+	index  uint64
+	cancel context.CancelFunc
+	doneC  chan struct{}
+}
+
+type Options struct {
+	// Datacenter of the service, the datacenter of the agent by default
+	Datacenter string
+	// Only the instances with the tag are synced, e.g. "production"
+	Tag string
+	// ACL token
+	Token string
+	// Scheme of the endpoint URLs, DefaultScheme by default
+	Scheme string
+	// Metadata key with the weight of the instance, DefaultWeightKey by default
+	WeightKey string
+	// How long the blocking query waits for the changes, DefaultWaitTime by default
+	WaitTime time.Duration
+	// How long to wait before retrying after the query fails, DefaultRetryPeriod by default
+	RetryPeriod time.Duration
+	// HTTP client for the requests to Consul, http.DefaultClient by default
+	Client *http.Client
+}
+
+const (
+	DefaultScheme      = "http"
+	DefaultWeightKey   = "weight"
+	DefaultWaitTime    = 5 * time.Minute
+	DefaultRetryPeriod = time.Second
+)
+
+type serviceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func NewWatcher(b discovery.Balancer, consulUrl, service string) (*Watcher, error) {
+	return NewWatcherWithOptions(b, consulUrl, service, Options{})
+}
+
+func NewWatcherWithOptions(b discovery.Balancer, consulUrl, service string, o Options) (*Watcher, error) {
+	syncer, err := discovery.NewSyncer(b)
+	if err != nil {
+		return nil, err
+	}
+	if consulUrl == "" {
+		return nil, fmt.Errorf("Provide Consul url")
+	}
+	if service == "" {
+		return nil, fmt.Errorf("Provide service name")
+	}
+	o, err = parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{
+		options: o,
+		url:     strings.TrimRight(consulUrl, "/"),
+		service: service,
+		syncer:  syncer,
+		mutex:   &sync.Mutex{},
+	}, nil
+}
+
+func (w *Watcher) GetOptions() Options {
+	return w.options
+}
+
+// GetInstances returns the instances synced to the balancer
+func (w *Watcher) GetInstances() []discovery.Instance {
+	return w.syncer.GetInstances()
+}
+
+// Start syncs the instances and watches the changes until Stop is called.
+// Returns error if Consul is not available, the watcher is not started then.
+func (w *Watcher) Start() error {
+	w.mutex.Lock()
+	started := w.cancel != nil
+	w.mutex.Unlock()
+	if started {
+		return fmt.Errorf("Watcher is already started")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := w.update(ctx, 0); err != nil {
+		cancel()
+		return err
+	}
+	doneC := make(chan struct{})
+	w.mutex.Lock()
+	w.cancel, w.doneC = cancel, doneC
+	w.mutex.Unlock()
+	go w.watch(ctx, doneC)
+	return nil
+}
+
+// Stop stops watching the changes, the endpoints stay in the balancer
+func (w *Watcher) Stop() {
+	w.mutex.Lock()
+	cancel, doneC := w.cancel, w.doneC
+	w.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-doneC
+}
+
+func (w *Watcher) watch(ctx context.Context, doneC chan struct{}) {
+	defer close(doneC)
+	for {
+		w.mutex.Lock()
+		index := w.index
+		w.mutex.Unlock()
+		err := w.update(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+		log.Errorf("Failed to query Consul service %s: %s, retrying in %s", w.service, err, w.options.RetryPeriod)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.options.RetryPeriod):
+		}
+	}
+}
+
+// update waits for the instances to change since the index and syncs them
+func (w *Watcher) update(ctx context.Context, index uint64) error {
+	entries, next, err := w.query(ctx, index)
+	if err != nil {
+		return err
+	}
+	// Index can go backwards, e.g. when the Consul servers have been restored, the query is started over then
+	if next < index {
+		next = 0
+	}
+	w.mutex.Lock()
+	w.index = next
+	w.mutex.Unlock()
+	if next == index && index != 0 {
+		// The wait time has passed without changes
+		return nil
+	}
+	instances := make([]discovery.Instance, 0, len(entries))
+	for _, e := range entries {
+		i, err := w.instance(e)
+		if err != nil {
+			log.Errorf("Skipping instance %s of Consul service %s: %s", e.Service.ID, w.service, err)
+			continue
+		}
+		instances = append(instances, i)
+	}
+	if err := w.syncer.Sync(instances); err != nil {
+		log.Errorf("Failed to sync Consul service %s: %s", w.service, err)
+	}
+	return nil
+}
+
+func (w *Watcher) query(ctx context.Context, index uint64) ([]serviceEntry, uint64, error) {
+	params := url.Values{"passing": {"true"}}
+	if w.options.Datacenter != "" {
+		params.Set("dc", w.options.Datacenter)
+	}
+	if w.options.Tag != "" {
+		params.Set("tag", w.options.Tag)
+	}
+	if index != 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%dms", w.options.WaitTime/time.Millisecond))
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/health/service/%s?%s", w.url, url.PathEscape(w.service), params.Encode()), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if w.options.Token != "" {
+		req.Header.Set("X-Consul-Token", w.options.Token)
+	}
+	re, err := w.options.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(re.Body, 4096))
+		return nil, 0, fmt.Errorf("%s: %s", re.Status, strings.TrimSpace(string(body)))
+	}
+	next, err := strconv.ParseUint(re.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Bad X-Consul-Index header '%s'", re.Header.Get("X-Consul-Index"))
+	}
+	var entries []serviceEntry
+	if err := json.NewDecoder(re.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, next, nil
+}
+
+func (w *Watcher) instance(e serviceEntry) (discovery.Instance, error) {
+	host := e.Service.Address
+	if host == "" {
+		host = e.Node.Address
+	}
+	if host == "" || e.Service.Port == 0 {
+		return discovery.Instance{}, fmt.Errorf("Missing address")
+	}
+	i := discovery.Instance{
+		Url:    fmt.Sprintf("%s://%s", w.options.Scheme, net.JoinHostPort(host, strconv.Itoa(e.Service.Port))),
+		Weight: e.Service.Weights.Passing,
+	}
+	if v, ok := e.Service.Meta[w.options.WeightKey]; ok {
+		weight, err := strconv.Atoi(v)
+		if err != nil || weight <= 0 {
+			return i, fmt.Errorf("Bad weight '%s'", v)
+		}
+		i.Weight = weight
+	}
+	return i, nil
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.WaitTime < 0 || o.RetryPeriod < 0 {
+		return o, fmt.Errorf("WaitTime and RetryPeriod can not be negative")
+	}
+	if o.Scheme == "" {
+		o.Scheme = DefaultScheme
+	}
+	if o.WeightKey == "" {
+		o.WeightKey = DefaultWeightKey
+	}
+	if o.WaitTime == 0 {
+		o.WaitTime = DefaultWaitTime
+	}
+	if o.RetryPeriod == 0 {
+		o.RetryPeriod = DefaultRetryPeriod
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	return o, nil
+}
@@ -0,0 +1,218 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/discovery"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "gopkg.in/check.v1"
+)
+
+func TestConsul(t *testing.T) { TestingT(t) }
+
+type ConsulSuite struct {
+	consul *fakeConsul
+	rr     *roundrobin.RoundRobin
+}
+
+var _ = Suite(&ConsulSuite{})
+
+func (s *ConsulSuite) SetUpTest(c *C) {
+	s.consul = newFakeConsul()
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	s.rr = rr
+}
+
+func (s *ConsulSuite) TearDownTest(c *C) {
+	s.consul.Close()
+}
+
+func (s *ConsulSuite) newWatcher(c *C, o Options) *Watcher {
+	o.RetryPeriod = 10 * time.Millisecond
+	w, err := NewWatcherWithOptions(s.rr, s.consul.URL, "api", o)
+	c.Assert(err, IsNil)
+	return w
+}
+
+func (s *ConsulSuite) TestWatch(c *C) {
+	s.consul.set(
+		instance("10.0.0.1", 80, nil),
+		instance("", 80, map[string]string{"weight": "3"}),
+	)
+	w := s.newWatcher(c, Options{Datacenter: "dc2", Tag: "production", Token: "token"})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "http://10.0.0.1:80", Weight: 1}, {Url: "http://10.1.0.1:80", Weight: 3}})
+	c.Assert(s.rr.GetEndpoints(), HasLen, 2)
+	query, token := s.consul.getLastQuery()
+	c.Assert(query.Get("dc"), Equals, "dc2")
+	c.Assert(query.Get("tag"), Equals, "production")
+	c.Assert(query.Get("passing"), Equals, "true")
+	c.Assert(token, Equals, "token")
+
+	s.consul.set(instance("10.0.0.2", 8080, nil), instance("", 80, map[string]string{"weight": "5"}))
+	s.waitInstances(c, w, []discovery.Instance{{Url: "http://10.0.0.2:8080", Weight: 1}, {Url: "http://10.1.0.1:80", Weight: 5}})
+	c.Assert(s.rr.FindEndpointByUrl("http://10.1.0.1:80").GetOriginalWeight(), Equals, 5)
+	c.Assert(s.rr.FindEndpointByUrl("http://10.0.0.1:80"), IsNil)
+
+	// Service without the passing instances keeps the last ones
+	s.consul.set()
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(w.GetInstances(), HasLen, 2)
+	c.Assert(s.rr.GetEndpoints(), HasLen, 2)
+}
+
+func (s *ConsulSuite) TestWeights(c *C) {
+	passing := instance("10.0.0.1", 80, nil)
+	passing.Service.Weights.Passing = 4
+	s.consul.set(
+		passing,
+		instance("10.0.0.2", 80, map[string]string{"w": "2"}),
+		instance("10.0.0.3", 80, map[string]string{"w": "0"}),
+		instance("10.0.0.4", 0, nil),
+	)
+	w := s.newWatcher(c, Options{WeightKey: "w", Scheme: "https"})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "https://10.0.0.1:80", Weight: 4}, {Url: "https://10.0.0.2:80", Weight: 2}})
+}
+
+func (s *ConsulSuite) TestRetries(c *C) {
+	s.consul.set(instance("10.0.0.1", 80, nil))
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+
+	// Instances stay in the balancer while Consul is down
+	s.consul.setDown(true)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(w.GetInstances(), HasLen, 1)
+
+	s.consul.set(instance("10.0.0.2", 80, nil))
+	s.consul.setDown(false)
+	s.waitInstances(c, w, []discovery.Instance{{Url: "http://10.0.0.2:80", Weight: 1}})
+}
+
+func (s *ConsulSuite) TestStartFails(c *C) {
+	s.consul.setDown(true)
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), ErrorMatches, "500 Internal Server Error.*")
+	c.Assert(w.GetInstances(), HasLen, 0)
+}
+
+func (s *ConsulSuite) TestBadParams(c *C) {
+	_, err := NewWatcher(nil, s.consul.URL, "api")
+	c.Assert(err, NotNil)
+	_, err = NewWatcher(s.rr, "", "api")
+	c.Assert(err, NotNil)
+	_, err = NewWatcher(s.rr, s.consul.URL, "")
+	c.Assert(err, NotNil)
+	_, err = NewWatcherWithOptions(s.rr, s.consul.URL, "api", Options{WaitTime: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *ConsulSuite) waitInstances(c *C, w *Watcher, expected []discovery.Instance) {
+	for i := 0; i < 200; i++ {
+		if reflect.DeepEqual(w.GetInstances(), expected) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(w.GetInstances(), DeepEquals, expected)
+}
+
+func instance(address string, port int, meta map[string]string) serviceEntry {
+	var e serviceEntry
+	e.Node.Address = "10.1.0.1"
+	e.Service.ID = "api-" + address
+	e.Service.Address = address
+	e.Service.Port = port
+	e.Service.Meta = meta
+	return e
+}
+
+// fakeConsul serves the blocking queries of the health API
+type fakeConsul struct {
+	*httptest.Server
+
+	mutex     sync.Mutex
+	index     uint64
+	entries   []serviceEntry
+	down      bool
+	lastQuery url.Values
+	lastToken string
+	changedC  chan struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{index: 1, changedC: make(chan struct{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHealth))
+	return f
+}
+
+func (f *fakeConsul) set(entries ...serviceEntry) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.index++
+	f.entries = entries
+	close(f.changedC)
+	f.changedC = make(chan struct{})
+}
+
+func (f *fakeConsul) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down = down
+	close(f.changedC)
+	f.changedC = make(chan struct{})
+}
+
+func (f *fakeConsul) getLastQuery() (url.Values, string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.lastQuery, f.lastToken
+}
+
+func (f *fakeConsul) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/api" {
+		http.NotFound(w, r)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	timeout := time.After(wait)
+	for {
+		f.mutex.Lock()
+		f.lastQuery, f.lastToken = r.URL.Query(), r.Header.Get("X-Consul-Token")
+		if f.down {
+			f.mutex.Unlock()
+			http.Error(w, "No cluster leader", http.StatusInternalServerError)
+			return
+		}
+		if index < f.index || wait == 0 {
+			data, _ := json.Marshal(f.entries)
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+			f.mutex.Unlock()
+			w.Write(data)
+			return
+		}
+		changedC := f.changedC
+		f.mutex.Unlock()
+		select {
+		case <-changedC:
+		case <-timeout:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Service discovery keeps the endpoints of the load balancer in sync with the instances of the service
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mailgun/log"
+
+	"github.com/mailgun/vulcan/endpoint"
+)
+
+// Balancer is the load balancer the discovered endpoints are added to and removed from, e.g. roundrobin.RoundRobin
+type Balancer interface {
+	AddEndpoint(endpoint.Endpoint) error
+	RemoveEndpoint(endpoint.Endpoint) error
+}
+
+// WeightedBalancer is the balancer that the weights of the instances are applied to, e.g. roundrobin.RoundRobin.
+// Other balancers get the instances with any weight
+type WeightedBalancer interface {
+	Balancer
+	SetEndpointWeight(e endpoint.Endpoint, weight int) error
+}
+
+// Instance is the discovered instance of the service
+type Instance struct {
+	Url string
+	// Relative weight of the instance, DefaultWeight if 0
+	Weight int
+	// Labels of the endpoint, see endpoint.Labeled
+	Labels map[string]string
+}
+
+const DefaultWeight = 1
+
+// Syncer applies the discovered instances to the balancer: adds the new ones, removes the ones that are gone
+// and updates the weights that have changed. Instances are told apart by their endpoint ids.
+type Syncer struct {
+	balancer Balancer
+	mutex    *sync.Mutex
+	current  map[string]*syncedInstance
+}
+
+type syncedInstance struct {
+	instance Instance
+	endpoint endpoint.Endpoint
+}
+
+func NewSyncer(b Balancer) (*Syncer, error) {
+	if b == nil {
+		return nil, fmt.Errorf("Provide balancer")
+	}
+	return &Syncer{
+		balancer: b,
+		mutex:    &sync.Mutex{},
+		current:  make(map[string]*syncedInstance),
+	}, nil
+}
+
+func (s *Syncer) GetBalancer() Balancer {
+	return s.balancer
+}
+
+// Sync makes the instances the only endpoints the syncer has added to the balancer.
+// Labels of the endpoints don't change, so the instance with the new labels is removed and added again.
+// Bad instances are skipped, the rest of them are synced anyway and the first error is returned.
+// No instances at all is more likely the failure of the discovery than the service that is gone,
+// so the empty set is refused and the current instances are kept.
+func (s *Syncer) Sync(instances []Instance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var errs []error
+	next := make(map[string]*syncedInstance, len(instances))
+	for _, i := range instances {
+		if i.Weight == 0 {
+			i.Weight = DefaultWeight
+		}
+		e, err := endpoint.ParseUrlWithLabels(i.Url, i.Labels)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Bad instance url '%s': %s", i.Url, err))
+			continue
+		}
+		if i.Weight < 0 {
+			errs = append(errs, fmt.Errorf("Bad weight %d of instance '%s'", i.Weight, i.Url))
+			continue
+		}
+		next[e.GetId()] = &syncedInstance{instance: i, endpoint: e}
+	}
+	if len(next) == 0 {
+		if len(errs) != 0 {
+			return errs[0]
+		}
+		return fmt.Errorf("No instances found, keeping the current ones")
+	}
+
+	for id, c := range s.current {
+		if n, ok := next[id]; ok && sameLabels(n.instance.Labels, c.instance.Labels) {
+			continue
+		}
+		if err := s.balancer.RemoveEndpoint(c.endpoint); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Infof("Removed %s", c.endpoint)
+		delete(s.current, id)
+	}
+	for id, n := range next {
+		c, ok := s.current[id]
+		if !ok {
+			if err := s.balancer.AddEndpoint(n.endpoint); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			log.Infof("Added %s with weight %d", n.endpoint, n.instance.Weight)
+			c = &syncedInstance{instance: Instance{Url: n.instance.Url, Weight: DefaultWeight, Labels: n.instance.Labels}, endpoint: n.endpoint}
+			s.current[id] = c
+		}
+		if c.instance.Weight == n.instance.Weight {
+			continue
+		}
+		if wb, ok := s.balancer.(WeightedBalancer); ok {
+			if err := wb.SetEndpointWeight(c.endpoint, n.instance.Weight); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		c.instance.Weight = n.instance.Weight
+	}
+	if len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// GetInstances returns the instances added to the balancer, sorted by url
+func (s *Syncer) GetInstances() []Instance {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]Instance, 0, len(s.current))
+	for _, c := range s.current {
+		out = append(out, c.instance)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Url < out[j].Url })
+	return out
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/leastconn"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "gopkg.in/check.v1"
+)
+
+func TestDiscovery(t *testing.T) { TestingT(t) }
+
+type SyncerSuite struct{}
+
+var _ = Suite(&SyncerSuite{})
+
+func (s *SyncerSuite) TestSync(c *C) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	syncer, err := NewSyncer(rr)
+	c.Assert(err, IsNil)
+
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.1:80"}, {Url: "http://10.0.0.2:80", Weight: 3}}), IsNil)
+	c.Assert(weights(rr), DeepEquals, map[string]int{"http://10.0.0.1:80": 1, "http://10.0.0.2:80": 3})
+	c.Assert(syncer.GetInstances(), DeepEquals, []Instance{{Url: "http://10.0.0.1:80", Weight: 1}, {Url: "http://10.0.0.2:80", Weight: 3}})
+
+	// Weight is updated in place, the removed instance is removed
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.2:80", Weight: 5}, {Url: "http://10.0.0.3:80"}}), IsNil)
+	c.Assert(weights(rr), DeepEquals, map[string]int{"http://10.0.0.2:80": 5, "http://10.0.0.3:80": 1})
+
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.3:80"}}), IsNil)
+	c.Assert(weights(rr), DeepEquals, map[string]int{"http://10.0.0.3:80": 1})
+	c.Assert(syncer.GetInstances(), DeepEquals, []Instance{{Url: "http://10.0.0.3:80", Weight: 1}})
+}
+
+func (s *SyncerSuite) TestKeepsInstancesWhenEmpty(c *C) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	syncer, err := NewSyncer(rr)
+	c.Assert(err, IsNil)
+
+	c.Assert(syncer.Sync(nil), ErrorMatches, "No instances found, keeping the current ones")
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.1:80"}}), IsNil)
+
+	c.Assert(syncer.Sync(nil), ErrorMatches, "No instances found, keeping the current ones")
+	c.Assert(syncer.Sync([]Instance{}), NotNil)
+	c.Assert(weights(rr), DeepEquals, map[string]int{"http://10.0.0.1:80": 1})
+
+	// Instances that are all bad are not applied either
+	c.Assert(syncer.Sync([]Instance{{Url: ":bad"}}), ErrorMatches, "Bad instance url ':bad'.*")
+	c.Assert(syncer.GetInstances(), DeepEquals, []Instance{{Url: "http://10.0.0.1:80", Weight: 1}})
+}
+
+func (s *SyncerSuite) TestLabels(c *C) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	syncer, err := NewSyncer(rr)
+	c.Assert(err, IsNil)
+
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.1:80", Labels: map[string]string{"version": "1"}}}), IsNil)
+	e := rr.FindEndpointByUrl("http://10.0.0.1:80")
+	c.Assert(endpoint.GetLabel(e, "version"), Equals, "1")
+
+	// Same labels keep the endpoint, the new labels replace it
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.1:80", Labels: map[string]string{"version": "1"}}}), IsNil)
+	c.Assert(rr.FindEndpointByUrl("http://10.0.0.1:80"), Equals, e)
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.1:80", Labels: map[string]string{"version": "2"}}}), IsNil)
+	c.Assert(endpoint.GetLabel(rr.FindEndpointByUrl("http://10.0.0.1:80"), "version"), Equals, "2")
+	c.Assert(syncer.GetInstances(), DeepEquals, []Instance{{Url: "http://10.0.0.1:80", Weight: 1, Labels: map[string]string{"version": "2"}}})
+}
+
+func (s *SyncerSuite) TestKeepsOtherEndpoints(c *C) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	c.Assert(rr.AddEndpoint(endpoint.MustParseUrl("http://10.0.0.9:80")), IsNil)
+	syncer, err := NewSyncer(rr)
+	c.Assert(err, IsNil)
+
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.1:80"}}), IsNil)
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.2:80"}}), IsNil)
+	c.Assert(weights(rr), DeepEquals, map[string]int{"http://10.0.0.9:80": 1, "http://10.0.0.2:80": 1})
+}
+
+func (s *SyncerSuite) TestBadInstances(c *C) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	syncer, err := NewSyncer(rr)
+	c.Assert(err, IsNil)
+
+	err = syncer.Sync([]Instance{{Url: "http://10.0.0.1:80"}, {Url: ":bad"}, {Url: "http://10.0.0.2:80", Weight: -1}})
+	c.Assert(err, ErrorMatches, "Bad instance url ':bad'.*")
+	c.Assert(weights(rr), DeepEquals, map[string]int{"http://10.0.0.1:80": 1})
+
+	_, err = NewSyncer(nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *SyncerSuite) TestUnweightedBalancer(c *C) {
+	lc, err := leastconn.NewLeastConn()
+	c.Assert(err, IsNil)
+	syncer, err := NewSyncer(lc)
+	c.Assert(err, IsNil)
+
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.1:80", Weight: 2}}), IsNil)
+	c.Assert(syncer.Sync([]Instance{{Url: "http://10.0.0.1:80", Weight: 4}}), IsNil)
+	c.Assert(syncer.GetInstances(), DeepEquals, []Instance{{Url: "http://10.0.0.1:80", Weight: 4}})
+}
+
+func weights(rr *roundrobin.RoundRobin) map[string]int {
+	out := make(map[string]int)
+	for _, e := range rr.GetEndpoints() {
+		out[e.GetId()] = e.GetOriginalWeight()
+	}
+	return out
+}
@@ -0,0 +1,213 @@
+// DNS service discovery: keeps the endpoints of the balancer in sync with the DNS records of the service
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+
+	"github.com/mailgun/vulcan/discovery"
+)
+
+// Watcher resolves the records of the target on the interval and syncs them to the balancer when they change,
+// e.g. for the backends behind the cloud load balancers with the addresses that change over time. Targets are:
+//
+//	api.internal:8080          A and AAAA records with the port
+//	_http._tcp.api.internal    SRV records, with the ports and weights of the records
+//
+// Only the SRV records with the lowest priority are used. If the lookup fails or returns no records,
+// the error is logged and the endpoints from the last successful lookup are kept.
+type Watcher struct {
+	options Options
+	target  string
+	// Host and port of A and AAAA target, SRV targets have no port
+	host   string
+	port   string
+	syncer *discovery.Syncer
+
+	mutex *sync.Mutex
+	stopC chan struct{}
+	doneC chan struct{}
+}
+
+// Resolver looks up the records, implemented by net.Resolver
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+type Options struct {
+	// Scheme of the endpoint URLs, DefaultScheme by default
+	Scheme string
+	// How often the records are resolved, DefaultInterval by default. The resolver does not tell the TTL
+	// of the records, so the interval should be about the TTL the records are published with
+	Interval time.Duration
+	// How long the lookup can take, DefaultTimeout by default
+	Timeout time.Duration
+	// Resolver to look up the records with, net.DefaultResolver by default
+	Resolver Resolver
+}
+
+const (
+	DefaultScheme   = "http"
+	DefaultInterval = 30 * time.Second
+	DefaultTimeout  = 5 * time.Second
+)
+
+func NewWatcher(b discovery.Balancer, target string) (*Watcher, error) {
+	return NewWatcherWithOptions(b, target, Options{})
+}
+
+func NewWatcherWithOptions(b discovery.Balancer, target string, o Options) (*Watcher, error) {
+	syncer, err := discovery.NewSyncer(b)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{target: target, syncer: syncer, mutex: &sync.Mutex{}}
+	if !strings.HasPrefix(target, "_") {
+		if w.host, w.port, err = net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("Bad target '%s', expected host:port or SRV name: %s", target, err)
+		}
+		if _, err := strconv.ParseUint(w.port, 10, 16); err != nil || w.host == "" {
+			return nil, fmt.Errorf("Bad target '%s', expected host:port or SRV name", target)
+		}
+	}
+	if w.options, err = parseOptions(o); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Watcher) GetOptions() Options {
+	return w.options
+}
+
+// GetInstances returns the instances synced to the balancer
+func (w *Watcher) GetInstances() []discovery.Instance {
+	return w.syncer.GetInstances()
+}
+
+// Start resolves the records and keeps resolving them on the interval until Stop is called.
+// Returns error if the first lookup fails, the watcher is not started then.
+func (w *Watcher) Start() error {
+	w.mutex.Lock()
+	started := w.stopC != nil
+	w.mutex.Unlock()
+	if started {
+		return fmt.Errorf("Watcher is already started")
+	}
+	if err := w.Refresh(); err != nil {
+		return err
+	}
+	stopC, doneC := make(chan struct{}), make(chan struct{})
+	w.mutex.Lock()
+	w.stopC, w.doneC = stopC, doneC
+	w.mutex.Unlock()
+	go w.run(stopC, doneC)
+	return nil
+}
+
+// Stop stops resolving the records, the endpoints stay in the balancer
+func (w *Watcher) Stop() {
+	w.mutex.Lock()
+	stopC, doneC := w.stopC, w.doneC
+	w.stopC, w.doneC = nil, nil
+	w.mutex.Unlock()
+	if stopC == nil {
+		return
+	}
+	close(stopC)
+	<-doneC
+}
+
+// Refresh resolves the records and syncs them to the balancer right away
+func (w *Watcher) Refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.options.Timeout)
+	defer cancel()
+
+	instances, err := w.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	return w.syncer.Sync(instances)
+}
+
+func (w *Watcher) run(stopC, doneC chan struct{}) {
+	defer close(doneC)
+	ticker := time.NewTicker(w.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+			if err := w.Refresh(); err != nil {
+				log.Errorf("Failed to refresh %s, keeping the endpoints: %s", w.target, err)
+			}
+		}
+	}
+}
+
+func (w *Watcher) lookup(ctx context.Context) ([]discovery.Instance, error) {
+	if w.host != "" {
+		addrs, err := w.options.Resolver.LookupIPAddr(ctx, w.host)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]discovery.Instance, len(addrs))
+		for i, a := range addrs {
+			out[i] = discovery.Instance{Url: w.url(a.String(), w.port)}
+		}
+		return out, nil
+	}
+	_, records, err := w.options.Resolver.LookupSRV(ctx, "", "", w.target)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	var out []discovery.Instance
+	for _, r := range records {
+		if r.Priority != records[0].Priority {
+			break
+		}
+		// Weight 0 is the lowest SRV weight, the instance gets discovery.DefaultWeight then
+		out = append(out, discovery.Instance{
+			Url:    w.url(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))),
+			Weight: int(r.Weight),
+		})
+	}
+	return out, nil
+}
+
+func (w *Watcher) url(host, port string) string {
+	return fmt.Sprintf("%s://%s", w.options.Scheme, net.JoinHostPort(host, port))
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Interval < 0 || o.Timeout < 0 {
+		return o, fmt.Errorf("Interval and Timeout can not be negative")
+	}
+	if o.Scheme == "" {
+		o.Scheme = DefaultScheme
+	}
+	if o.Interval == 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Resolver == nil {
+		o.Resolver = net.DefaultResolver
+	}
+	return o, nil
+}
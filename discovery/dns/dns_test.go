@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/discovery"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "gopkg.in/check.v1"
+)
+
+func TestDNS(t *testing.T) { TestingT(t) }
+
+type DNSSuite struct {
+	resolver *fakeResolver
+	rr       *roundrobin.RoundRobin
+}
+
+var _ = Suite(&DNSSuite{})
+
+func (s *DNSSuite) SetUpTest(c *C) {
+	s.resolver = &fakeResolver{}
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	s.rr = rr
+}
+
+func (s *DNSSuite) TestAddresses(c *C) {
+	s.resolver.setAddrs("10.0.0.1", "::1")
+	w, err := NewWatcherWithOptions(s.rr, "api.internal:8080", Options{Resolver: s.resolver})
+	c.Assert(err, IsNil)
+	c.Assert(w.Refresh(), IsNil)
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "http://10.0.0.1:8080", Weight: 1}, {Url: "http://[::1]:8080", Weight: 1}})
+	c.Assert(s.rr.GetEndpoints(), HasLen, 2)
+	c.Assert(s.resolver.getHost(), Equals, "api.internal")
+
+	s.resolver.setAddrs("10.0.0.2")
+	c.Assert(w.Refresh(), IsNil)
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "http://10.0.0.2:8080", Weight: 1}})
+	c.Assert(s.rr.GetEndpoints(), HasLen, 1)
+}
+
+func (s *DNSSuite) TestSRV(c *C) {
+	s.resolver.setSRV(
+		&net.SRV{Target: "a.internal.", Port: 8080, Priority: 10, Weight: 5},
+		&net.SRV{Target: "b.internal.", Port: 8081, Priority: 10, Weight: 0},
+		&net.SRV{Target: "backup.internal.", Port: 8080, Priority: 20, Weight: 5},
+	)
+	w, err := NewWatcherWithOptions(s.rr, "_http._tcp.api.internal", Options{Resolver: s.resolver, Scheme: "https"})
+	c.Assert(err, IsNil)
+	c.Assert(w.Refresh(), IsNil)
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "https://a.internal:8080", Weight: 5}, {Url: "https://b.internal:8081", Weight: 1}})
+	c.Assert(s.resolver.getHost(), Equals, "_http._tcp.api.internal")
+}
+
+func (s *DNSSuite) TestKeepsEndpointsOnFailures(c *C) {
+	s.resolver.setAddrs("10.0.0.1")
+	w, err := NewWatcherWithOptions(s.rr, "api.internal:80", Options{Resolver: s.resolver})
+	c.Assert(err, IsNil)
+	c.Assert(w.Refresh(), IsNil)
+
+	s.resolver.setError(fmt.Errorf("server misbehaving"))
+	c.Assert(w.Refresh(), ErrorMatches, "server misbehaving")
+	c.Assert(w.GetInstances(), HasLen, 1)
+
+	s.resolver.setAddrs()
+	c.Assert(w.Refresh(), ErrorMatches, "No instances found, keeping the current ones")
+	c.Assert(w.GetInstances(), HasLen, 1)
+}
+
+func (s *DNSSuite) TestInterval(c *C) {
+	s.resolver.setAddrs("10.0.0.1")
+	w, err := NewWatcherWithOptions(s.rr, "api.internal:80", Options{Resolver: s.resolver, Interval: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "http://10.0.0.1:80", Weight: 1}})
+
+	s.resolver.setAddrs("10.0.0.2", "10.0.0.3")
+	expected := []discovery.Instance{{Url: "http://10.0.0.2:80", Weight: 1}, {Url: "http://10.0.0.3:80", Weight: 1}}
+	for i := 0; i < 200 && !reflect.DeepEqual(w.GetInstances(), expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(w.GetInstances(), DeepEquals, expected)
+}
+
+func (s *DNSSuite) TestStartFails(c *C) {
+	s.resolver.setError(fmt.Errorf("no such host"))
+	w, err := NewWatcherWithOptions(s.rr, "api.internal:80", Options{Resolver: s.resolver})
+	c.Assert(err, IsNil)
+	c.Assert(w.Start(), NotNil)
+	w.Stop()
+}
+
+func (s *DNSSuite) TestBadParams(c *C) {
+	for _, target := range []string{"api.internal", ":80", "api.internal:port", "api.internal:100000"} {
+		_, err := NewWatcher(s.rr, target)
+		c.Assert(err, NotNil, Commentf("%s", target))
+	}
+	_, err := NewWatcher(nil, "api.internal:80")
+	c.Assert(err, NotNil)
+	_, err = NewWatcherWithOptions(s.rr, "api.internal:80", Options{Interval: -1})
+	c.Assert(err, NotNil)
+}
+
+type fakeResolver struct {
+	mutex sync.Mutex
+	host  string
+	addrs []net.IPAddr
+	srv   []*net.SRV
+	err   error
+}
+
+func (r *fakeResolver) setAddrs(ips ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.addrs, r.err = nil, nil
+	for _, ip := range ips {
+		r.addrs = append(r.addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+}
+
+func (r *fakeResolver) setSRV(records ...*net.SRV) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.srv, r.err = records, nil
+}
+
+func (r *fakeResolver) setError(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.err = err
+}
+
+func (r *fakeResolver) getHost() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.host
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.host = host
+	return r.addrs, r.err
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.host = name
+	return name, r.srv, r.err
+}
@@ -0,0 +1,420 @@
+// Kubernetes service discovery: keeps the endpoints of the balancer in sync with the ready pods of the service
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+
+	"github.com/mailgun/vulcan/discovery"
+	"github.com/mailgun/vulcan/endpoint"
+)
+
+// Watcher watches the EndpointSlices of the service through the API server and syncs the ready endpoints
+// to the balancer, so vulcan can proxy to the pods directly from inside the cluster:
+//
+//	rr, _ := roundrobin.NewRoundRobin()
+//	w, _ := kubernetes.NewWatcherWithOptions(rr, "default", "api", kubernetes.Options{PortName: "http"})
+//	if err := w.Start(); err != nil {
+//		return err
+//	}
+//	defer w.Stop()
+//
+// By default the watcher uses the service account of the pod it runs in, the account should be allowed to list
+// and watch endpointslices in the namespace of the service.
+type Watcher struct {
+	options   Options
+	namespace string
+	service   string
+	syncer    *discovery.Syncer
+
+	mutex  *sync.Mutex
+	slices map[string]*endpointSlice
+	cancel context.CancelFunc
+	doneC  chan struct{}
+}
+
+type Options struct {
+	// URL of the API server, taken from KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT by default
+	ApiServer string
+	// File with the bearer token, re-read for every request as the tokens are rotated, DefaultTokenFile by default.
+	// The file is not required if the API server is set
+	TokenFile string
+	// HTTP client for the requests to the API server, the one trusting DefaultCAFile by default
+	Client *http.Client
+	// Name of the service port, required if the service has more than one port
+	PortName string
+	// Scheme of the endpoint URLs, DefaultScheme by default
+	Scheme string
+	// How long to wait before retrying after the API server fails, DefaultRetryPeriod by default
+	RetryPeriod time.Duration
+}
+
+const (
+	DefaultTokenFile   = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	DefaultCAFile      = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	DefaultScheme      = "http"
+	DefaultRetryPeriod = time.Second
+)
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			// Unknown readiness is considered ready
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		Zone string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+type sliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*endpointSlice `json:"items"`
+}
+
+type watchEvent struct {
+	// ADDED, MODIFIED, DELETED, BOOKMARK or ERROR
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// errExpired tells that the resource version is too old to watch from and the slices should be listed again
+type errExpired struct {
+	message string
+}
+
+func (e *errExpired) Error() string {
+	return e.message
+}
+
+func NewWatcher(b discovery.Balancer, namespace, service string) (*Watcher, error) {
+	return NewWatcherWithOptions(b, namespace, service, Options{})
+}
+
+func NewWatcherWithOptions(b discovery.Balancer, namespace, service string, o Options) (*Watcher, error) {
+	syncer, err := discovery.NewSyncer(b)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" || service == "" {
+		return nil, fmt.Errorf("Provide namespace and service")
+	}
+	o, err = parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{
+		options:   o,
+		namespace: namespace,
+		service:   service,
+		syncer:    syncer,
+		mutex:     &sync.Mutex{},
+		slices:    make(map[string]*endpointSlice),
+	}, nil
+}
+
+func (w *Watcher) GetOptions() Options {
+	return w.options
+}
+
+// GetInstances returns the instances synced to the balancer
+func (w *Watcher) GetInstances() []discovery.Instance {
+	return w.syncer.GetInstances()
+}
+
+// Start lists the endpoints and watches the changes until Stop is called.
+// Returns error if the API server is not available, the watcher is not started then.
+func (w *Watcher) Start() error {
+	w.mutex.Lock()
+	started := w.cancel != nil
+	w.mutex.Unlock()
+	if started {
+		return fmt.Errorf("Watcher is already started")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	version, err := w.list(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	doneC := make(chan struct{})
+	w.mutex.Lock()
+	w.cancel, w.doneC = cancel, doneC
+	w.mutex.Unlock()
+	go w.run(ctx, version, doneC)
+	return nil
+}
+
+// Stop stops watching the changes, the endpoints stay in the balancer
+func (w *Watcher) Stop() {
+	w.mutex.Lock()
+	cancel, doneC := w.cancel, w.doneC
+	w.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-doneC
+}
+
+func (w *Watcher) run(ctx context.Context, version string, doneC chan struct{}) {
+	defer close(doneC)
+	for {
+		err := w.watch(ctx, &version)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// API server ends the watches after a while, the watch is resumed from the last version
+			continue
+		}
+		if _, ok := err.(*errExpired); !ok {
+			log.Errorf("Failed to watch endpoints of service %s/%s: %s, retrying in %s", w.namespace, w.service, err, w.options.RetryPeriod)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.options.RetryPeriod):
+			}
+			continue
+		}
+		for {
+			if version, err = w.list(ctx); err == nil || ctx.Err() != nil {
+				break
+			}
+			log.Errorf("Failed to list endpoints of service %s/%s: %s, retrying in %s", w.namespace, w.service, err, w.options.RetryPeriod)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.options.RetryPeriod):
+			}
+		}
+	}
+}
+
+// list replaces the slices with the current ones and returns the version to watch the changes from
+func (w *Watcher) list(ctx context.Context) (string, error) {
+	re, err := w.get(ctx, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer re.Body.Close()
+	var list sliceList
+	if err := json.NewDecoder(re.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	slices := make(map[string]*endpointSlice, len(list.Items))
+	for _, s := range list.Items {
+		slices[s.Metadata.Name] = s
+	}
+	w.mutex.Lock()
+	w.slices = slices
+	w.mutex.Unlock()
+	w.sync()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies the changes since the version until the watch ends, the version is updated as they come
+func (w *Watcher) watch(ctx context.Context, version *string) error {
+	re, err := w.get(ctx, url.Values{"watch": {"1"}, "resourceVersion": {*version}, "allowWatchBookmarks": {"true"}})
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	d := json.NewDecoder(re.Body)
+	for {
+		var e watchEvent
+		if err := d.Decode(&e); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if e.Type == "ERROR" {
+			var status struct {
+				Message string `json:"message"`
+				Code    int    `json:"code"`
+			}
+			json.Unmarshal(e.Object, &status)
+			if status.Code == http.StatusGone {
+				return &errExpired{status.Message}
+			}
+			return fmt.Errorf("Watch failed: %d %s", status.Code, status.Message)
+		}
+		var s endpointSlice
+		if err := json.Unmarshal(e.Object, &s); err != nil {
+			return err
+		}
+		*version = s.Metadata.ResourceVersion
+		w.mutex.Lock()
+		switch e.Type {
+		case "ADDED", "MODIFIED":
+			w.slices[s.Metadata.Name] = &s
+		case "DELETED":
+			delete(w.slices, s.Metadata.Name)
+		}
+		w.mutex.Unlock()
+		if e.Type != "BOOKMARK" {
+			w.sync()
+		}
+	}
+}
+
+// sync applies the ready endpoints of all slices to the balancer
+func (w *Watcher) sync() {
+	w.mutex.Lock()
+	names := make([]string, 0, len(w.slices))
+	for name := range w.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var instances []discovery.Instance
+	for _, name := range names {
+		s := w.slices[name]
+		port, err := w.port(s)
+		if err != nil {
+			log.Errorf("Skipping EndpointSlice %s/%s: %s", w.namespace, name, err)
+			continue
+		}
+		for _, e := range s.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			// Zone of the endpoint lets the zone aware balancer keep the traffic within the zone
+			var labels map[string]string
+			if e.Zone != "" {
+				labels = map[string]string{endpoint.LabelZone: e.Zone}
+			}
+			for _, addr := range e.Addresses {
+				instances = append(instances, discovery.Instance{
+					Url:    fmt.Sprintf("%s://%s", w.options.Scheme, net.JoinHostPort(addr, strconv.Itoa(port))),
+					Labels: labels,
+				})
+			}
+		}
+	}
+	w.mutex.Unlock()
+	if err := w.syncer.Sync(instances); err != nil {
+		log.Errorf("Failed to sync endpoints of service %s/%s: %s", w.namespace, w.service, err)
+	}
+}
+
+func (w *Watcher) port(s *endpointSlice) (int, error) {
+	if w.options.PortName == "" {
+		if len(s.Ports) != 1 {
+			return 0, fmt.Errorf("Service has %d ports, set the port name", len(s.Ports))
+		}
+		return s.Ports[0].Port, nil
+	}
+	for _, p := range s.Ports {
+		if p.Name == w.options.PortName {
+			return p.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("Port '%s' not found", w.options.PortName)
+}
+
+func (w *Watcher) get(ctx context.Context, params url.Values) (*http.Response, error) {
+	params.Set("labelSelector", "kubernetes.io/service-name="+w.service)
+	u := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		w.options.ApiServer, url.PathEscape(w.namespace), params.Encode())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if w.options.TokenFile != "" {
+		token, err := ioutil.ReadFile(w.options.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+	re, err := w.options.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if re.StatusCode != http.StatusOK {
+		defer re.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(re.Body, 4096))
+		if re.StatusCode == http.StatusGone {
+			return nil, &errExpired{string(body)}
+		}
+		return nil, fmt.Errorf("%s: %s", re.Status, strings.TrimSpace(string(body)))
+	}
+	return re, nil
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.RetryPeriod < 0 {
+		return o, fmt.Errorf("RetryPeriod can not be negative")
+	}
+	if o.ApiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return o, fmt.Errorf("Provide API server, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+		}
+		o.ApiServer = "https://" + net.JoinHostPort(host, port)
+		if o.TokenFile == "" {
+			o.TokenFile = DefaultTokenFile
+		}
+		if o.Client == nil {
+			client, err := inClusterClient()
+			if err != nil {
+				return o, err
+			}
+			o.Client = client
+		}
+	}
+	o.ApiServer = strings.TrimRight(o.ApiServer, "/")
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	if o.Scheme == "" {
+		o.Scheme = DefaultScheme
+	}
+	if o.RetryPeriod == 0 {
+		o.RetryPeriod = DefaultRetryPeriod
+	}
+	return o, nil
+}
+
+// inClusterClient returns the client that trusts the CA of the cluster
+func inClusterClient() (*http.Client, error) {
+	ca, err := ioutil.ReadFile(DefaultCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates found in %s", DefaultCAFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
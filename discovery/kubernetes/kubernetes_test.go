@@ -0,0 +1,329 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/discovery"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "gopkg.in/check.v1"
+)
+
+func TestKubernetes(t *testing.T) { TestingT(t) }
+
+type KubernetesSuite struct {
+	api *fakeApiServer
+	rr  *roundrobin.RoundRobin
+}
+
+var _ = Suite(&KubernetesSuite{})
+
+func (s *KubernetesSuite) SetUpTest(c *C) {
+	s.api = newFakeApiServer()
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	s.rr = rr
+}
+
+func (s *KubernetesSuite) TearDownTest(c *C) {
+	s.api.Close()
+}
+
+func (s *KubernetesSuite) newWatcher(c *C, o Options) *Watcher {
+	o.ApiServer = s.api.URL
+	o.RetryPeriod = 10 * time.Millisecond
+	w, err := NewWatcherWithOptions(s.rr, "default", "api", o)
+	c.Assert(err, IsNil)
+	return w
+}
+
+func (s *KubernetesSuite) TestWatch(c *C) {
+	s.api.set(slice("api-1", []string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.3"}))
+	w := s.newWatcher(c, Options{PortName: "http"})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+	c.Assert(w.GetInstances(), DeepEquals, instances("10.0.0.1", "10.0.0.2"))
+	c.Assert(s.rr.GetEndpoints(), HasLen, 2)
+	c.Assert(s.api.getSelector(), Equals, "kubernetes.io/service-name=api")
+
+	// Pod becomes ready, another slice is added
+	s.api.set(slice("api-1", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, nil))
+	s.api.set(slice("api-2", []string{"fd00::1"}, nil))
+	s.waitInstances(c, w, append(instances("10.0.0.1", "10.0.0.2", "10.0.0.3"), discovery.Instance{Url: "http://[fd00::1]:8080", Weight: 1}))
+
+	s.api.delete("api-1")
+	s.waitInstances(c, w, []discovery.Instance{{Url: "http://[fd00::1]:8080", Weight: 1}})
+	c.Assert(s.rr.GetEndpoints(), HasLen, 1)
+
+	// Service without the ready endpoints keeps the last ones
+	s.api.delete("api-2")
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(w.GetInstances(), HasLen, 1)
+	c.Assert(s.rr.GetEndpoints(), HasLen, 1)
+}
+
+func (s *KubernetesSuite) TestZone(c *C) {
+	zonal := slice("api-1", []string{"10.0.0.1"}, nil)
+	zonal.Endpoints[0].Zone = "us-east-1a"
+	s.api.set(zonal)
+	w := s.newWatcher(c, Options{PortName: "http"})
+	c.Assert(w.Start(), IsNil)
+	w.Stop()
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "http://10.0.0.1:8080", Weight: 1, Labels: map[string]string{"zone": "us-east-1a"}}})
+	c.Assert(s.rr.FindEndpointByUrl("http://10.0.0.1:8080").GetOriginalEndpoint().(endpoint.Localized).GetLocality(), Equals, endpoint.Locality{Zone: "us-east-1a"})
+}
+
+func (s *KubernetesSuite) TestRelistsExpiredVersion(c *C) {
+	s.api.set(slice("api-1", []string{"10.0.0.1"}, nil))
+	w := s.newWatcher(c, Options{PortName: "http"})
+	c.Assert(w.Start(), IsNil)
+	defer w.Stop()
+
+	// Changes made while the watch has been down are not in the history anymore
+	s.api.setDown(true)
+	s.api.set(slice("api-1", []string{"10.0.0.2"}, nil))
+	s.api.expire()
+	time.Sleep(30 * time.Millisecond)
+	c.Assert(w.GetInstances(), DeepEquals, instances("10.0.0.1"))
+
+	s.api.setDown(false)
+	s.waitInstances(c, w, instances("10.0.0.2"))
+}
+
+func (s *KubernetesSuite) TestPorts(c *C) {
+	single := slice("api-1", []string{"10.0.0.1"}, nil)
+	multi := slice("api-2", []string{"10.0.0.2"}, nil)
+	multi.Ports = append(multi.Ports, multi.Ports[0])
+	multi.Ports[1].Name, multi.Ports[1].Port = "metrics", 9090
+	s.api.set(single)
+	s.api.set(multi)
+
+	// The slice with more than one port is skipped without the port name
+	w := s.newWatcher(c, Options{Scheme: "https"})
+	c.Assert(w.Start(), IsNil)
+	w.Stop()
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "https://10.0.0.1:8080", Weight: 1}})
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	w, err = NewWatcherWithOptions(rr, "default", "api", Options{ApiServer: s.api.URL, PortName: "metrics"})
+	c.Assert(err, IsNil)
+	c.Assert(w.Start(), IsNil)
+	w.Stop()
+	c.Assert(w.GetInstances(), DeepEquals, []discovery.Instance{{Url: "http://10.0.0.2:9090", Weight: 1}})
+}
+
+func (s *KubernetesSuite) TestToken(c *C) {
+	tokenFile := filepath.Join(c.MkDir(), "token")
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600), IsNil)
+	s.api.token = "secret"
+	s.api.set(slice("api-1", []string{"10.0.0.1"}, nil))
+
+	w := s.newWatcher(c, Options{})
+	c.Assert(w.Start(), ErrorMatches, "401 Unauthorized.*")
+
+	w = s.newWatcher(c, Options{TokenFile: tokenFile})
+	c.Assert(w.Start(), IsNil)
+	w.Stop()
+	c.Assert(w.GetInstances(), DeepEquals, instances("10.0.0.1"))
+}
+
+func (s *KubernetesSuite) TestBadParams(c *C) {
+	_, err := NewWatcherWithOptions(nil, "default", "api", Options{ApiServer: s.api.URL})
+	c.Assert(err, NotNil)
+	_, err = NewWatcherWithOptions(s.rr, "", "api", Options{ApiServer: s.api.URL})
+	c.Assert(err, NotNil)
+	_, err = NewWatcherWithOptions(s.rr, "default", "", Options{ApiServer: s.api.URL})
+	c.Assert(err, NotNil)
+	_, err = NewWatcherWithOptions(s.rr, "default", "api", Options{ApiServer: s.api.URL, RetryPeriod: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *KubernetesSuite) waitInstances(c *C, w *Watcher, expected []discovery.Instance) {
+	for i := 0; i < 200 && !reflect.DeepEqual(w.GetInstances(), expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(w.GetInstances(), DeepEquals, expected)
+}
+
+func instances(ips ...string) []discovery.Instance {
+	out := make([]discovery.Instance, len(ips))
+	for i, ip := range ips {
+		out[i] = discovery.Instance{Url: fmt.Sprintf("http://%s:8080", ip), Weight: 1}
+	}
+	return out
+}
+
+func slice(name string, ready, notReady []string) *endpointSlice {
+	var data struct {
+		Metadata  map[string]string        `json:"metadata"`
+		Endpoints []map[string]interface{} `json:"endpoints"`
+		Ports     []map[string]interface{} `json:"ports"`
+	}
+	data.Metadata = map[string]string{"name": name}
+	for _, ip := range ready {
+		data.Endpoints = append(data.Endpoints, map[string]interface{}{"addresses": []string{ip}, "conditions": map[string]bool{"ready": true}})
+	}
+	for _, ip := range notReady {
+		data.Endpoints = append(data.Endpoints, map[string]interface{}{"addresses": []string{ip}, "conditions": map[string]bool{"ready": false}})
+	}
+	data.Ports = []map[string]interface{}{{"name": "http", "port": 8080}}
+	bytes, _ := json.Marshal(data)
+	var s endpointSlice
+	json.Unmarshal(bytes, &s)
+	return &s
+}
+
+// fakeApiServer serves the list and watch requests of the EndpointSlices
+type fakeApiServer struct {
+	*httptest.Server
+	token string
+
+	mutex    sync.Mutex
+	version  int
+	slices   map[string]*endpointSlice
+	events   []fakeEvent
+	expired  int
+	down     bool
+	selector string
+	changedC chan struct{}
+}
+
+type fakeEvent struct {
+	version int
+	typ     string
+	slice   *endpointSlice
+}
+
+func newFakeApiServer() *fakeApiServer {
+	f := &fakeApiServer{slices: make(map[string]*endpointSlice), changedC: make(chan struct{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeApiServer) set(s *endpointSlice) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	typ := "MODIFIED"
+	if _, ok := f.slices[s.Metadata.Name]; !ok {
+		typ = "ADDED"
+	}
+	f.change(typ, s)
+}
+
+func (f *fakeApiServer) delete(name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.change("DELETED", f.slices[name])
+}
+
+func (f *fakeApiServer) change(typ string, s *endpointSlice) {
+	f.version++
+	copied := *s
+	copied.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	if typ == "DELETED" {
+		delete(f.slices, s.Metadata.Name)
+	} else {
+		f.slices[s.Metadata.Name] = &copied
+	}
+	f.events = append(f.events, fakeEvent{version: f.version, typ: typ, slice: &copied})
+	f.notify()
+}
+
+// expire drops the history, so the watches from the older versions fail
+func (f *fakeApiServer) expire() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.expired = f.version
+	f.events = nil
+}
+
+func (f *fakeApiServer) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down = down
+	f.notify()
+}
+
+func (f *fakeApiServer) notify() {
+	close(f.changedC)
+	f.changedC = make(chan struct{})
+}
+
+func (f *fakeApiServer) getSelector() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.selector
+}
+
+func (f *fakeApiServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" {
+		http.NotFound(w, r)
+		return
+	}
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		http.Error(w, `{"kind": "Status", "code": 401}`, http.StatusUnauthorized)
+		return
+	}
+	f.mutex.Lock()
+	f.selector = r.URL.Query().Get("labelSelector")
+	if f.down {
+		f.mutex.Unlock()
+		http.Error(w, `{"kind": "Status", "code": 503}`, http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Query().Get("watch") == "" {
+		list := sliceList{Items: []*endpointSlice{}}
+		list.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		for _, s := range f.slices {
+			list.Items = append(list.Items, s)
+		}
+		f.mutex.Unlock()
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	next, _ := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+	if next < f.expired {
+		f.mutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":   "ERROR",
+			"object": map[string]interface{}{"kind": "Status", "code": 410, "message": "too old resource version"},
+		})
+		return
+	}
+	f.mutex.Unlock()
+	w.(http.Flusher).Flush()
+
+	for {
+		f.mutex.Lock()
+		if f.down {
+			f.mutex.Unlock()
+			return
+		}
+		for _, e := range f.events {
+			if e.version > next {
+				json.NewEncoder(w).Encode(map[string]interface{}{"type": e.typ, "object": e.slice})
+				next = e.version
+			}
+		}
+		changedC := f.changedC
+		f.mutex.Unlock()
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-changedC:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -14,9 +14,51 @@ type Endpoint interface {
 	String() string
 }
 
+// Labeled is implemented by the endpoints that carry labels, e.g. version, zone or canary.
+// Labels are set when the endpoint is created and don't change, see GetLabel.
+type Labeled interface {
+	GetLabel(key string) (string, bool)
+	// Returns the copy of the labels
+	GetLabels() map[string]string
+}
+
+// Well known labels
+const (
+	LabelRegion = "region"
+	LabelZone   = "zone"
+)
+
+// Locality is where the endpoint runs, e.g. the region and the availability zone of the cloud provider,
+// it is kept in LabelRegion and LabelZone labels
+type Locality struct {
+	Region string
+	Zone   string
+}
+
+// Localized is implemented by the endpoints that know their locality
+type Localized interface {
+	GetLocality() Locality
+}
+
+// GetLabel returns the label of the endpoint, or of the original endpoint wrapped by the load balancer,
+// "" if the endpoint has no such label or does not support labels
+func GetLabel(e Endpoint, key string) string {
+	if w, ok := e.(interface {
+		GetOriginalEndpoint() Endpoint
+	}); ok {
+		e = w.GetOriginalEndpoint()
+	}
+	if l, ok := e.(Labeled); ok {
+		value, _ := l.GetLabel(key)
+		return value
+	}
+	return ""
+}
+
 type HttpEndpoint struct {
-	url *url.URL
-	id  string
+	url    *url.URL
+	id     string
+	labels map[string]string
 }
 
 func ParseUrl(in string) (*HttpEndpoint, error) {
@@ -24,7 +66,29 @@ func ParseUrl(in string) (*HttpEndpoint, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &HttpEndpoint{url: url, id: fmt.Sprintf("%s://%s", url.Scheme, url.Host)}, nil
+	return &HttpEndpoint{url: url, id: endpointId(url)}, nil
+}
+
+// ParseUrlWithLabels parses the endpoint with the labels, the labels are copied
+func ParseUrlWithLabels(in string, labels map[string]string) (*HttpEndpoint, error) {
+	e, err := ParseUrl(in)
+	if err != nil {
+		return nil, err
+	}
+	e.labels = copyLabels(labels)
+	return e, nil
+}
+
+// ParseUrlWithLocality parses the endpoint that runs in the given region and zone, see zoneaware balancer
+func ParseUrlWithLocality(in string, l Locality) (*HttpEndpoint, error) {
+	labels := map[string]string{}
+	if l.Region != "" {
+		labels[LabelRegion] = l.Region
+	}
+	if l.Zone != "" {
+		labels[LabelZone] = l.Zone
+	}
+	return ParseUrlWithLabels(in, labels)
 }
 
 func MustParseUrl(in string) *HttpEndpoint {
@@ -41,7 +105,15 @@ func NewHttpEndpoint(in *url.URL) (*HttpEndpoint, error) {
 	}
 	return &HttpEndpoint{
 		url: netutils.CopyUrl(in),
-		id:  fmt.Sprintf("%s://%s", in.Scheme, in.Host)}, nil
+		id:  endpointId(in)}, nil
+}
+
+// Endpoints listening on the unix sockets are told apart by the socket path
+func endpointId(u *url.URL) string {
+	if u.Scheme == "unix" {
+		return fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Path)
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
 }
 
 func (e *HttpEndpoint) String() string {
@@ -55,3 +127,24 @@ func (e *HttpEndpoint) GetId() string {
 func (e *HttpEndpoint) GetUrl() *url.URL {
 	return e.url
 }
+
+func (e *HttpEndpoint) GetLabel(key string) (string, bool) {
+	value, ok := e.labels[key]
+	return value, ok
+}
+
+func (e *HttpEndpoint) GetLabels() map[string]string {
+	return copyLabels(e.labels)
+}
+
+func (e *HttpEndpoint) GetLocality() Locality {
+	return Locality{Region: e.labels[LabelRegion], Zone: e.labels[LabelZone]}
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
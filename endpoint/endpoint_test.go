@@ -0,0 +1,61 @@
+package endpoint
+
+import (
+	"net/url"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestEndpoint(t *testing.T) { TestingT(t) }
+
+type EndpointSuite struct{}
+
+var _ = Suite(&EndpointSuite{})
+
+func (s *EndpointSuite) TestLabels(c *C) {
+	labels := map[string]string{"version": "1.2", LabelZone: "us-east-1a"}
+	e, err := ParseUrlWithLabels("http://localhost:5000", labels)
+	c.Assert(err, IsNil)
+
+	// Labels don't change with the map they were created from
+	labels["version"] = "2.0"
+	value, ok := e.GetLabel("version")
+	c.Assert(ok, Equals, true)
+	c.Assert(value, Equals, "1.2")
+	e.GetLabels()["version"] = "3.0"
+	c.Assert(GetLabel(e, "version"), Equals, "1.2")
+
+	c.Assert(e.GetLocality(), Equals, Locality{Zone: "us-east-1a"})
+	c.Assert(GetLabel(e, "canary"), Equals, "")
+	c.Assert(GetLabel(MustParseUrl("http://localhost:5000"), "version"), Equals, "")
+}
+
+func (s *EndpointSuite) TestLocality(c *C) {
+	e, err := ParseUrlWithLocality("http://localhost:5000", Locality{Region: "us-east-1", Zone: "us-east-1a"})
+	c.Assert(err, IsNil)
+	c.Assert(e.GetLocality(), Equals, Locality{Region: "us-east-1", Zone: "us-east-1a"})
+	c.Assert(e.GetLabels(), DeepEquals, map[string]string{LabelRegion: "us-east-1", LabelZone: "us-east-1a"})
+
+	_, err = ParseUrlWithLabels(":bad", nil)
+	c.Assert(err, NotNil)
+}
+
+// Balancers wrap the endpoints, the labels of the original endpoint are still there
+func (s *EndpointSuite) TestWrapped(c *C) {
+	e, err := ParseUrlWithLabels("http://localhost:5000", map[string]string{"canary": "true"})
+	c.Assert(err, IsNil)
+	c.Assert(GetLabel(&wrapped{e}, "canary"), Equals, "true")
+}
+
+// wrapped is the endpoint of the balancer, e.g. roundrobin.WeightedEndpoint
+type wrapped struct {
+	e *HttpEndpoint
+}
+
+func (w *wrapped) GetId() string    { return w.e.GetId() }
+func (w *wrapped) GetUrl() *url.URL { return w.e.GetUrl() }
+func (w *wrapped) String() string   { return w.e.String() }
+func (w *wrapped) GetOriginalEndpoint() Endpoint {
+	return w.e
+}
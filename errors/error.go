@@ -28,9 +28,13 @@ type JsonFormatter struct {
 }
 
 func (f *JsonFormatter) Format(err ProxyError) (int, []byte, string) {
-	encodedError, e := json.Marshal(map[string]interface{}{
+	out := map[string]interface{}{
 		"error": string(err.Error()),
-	})
+	}
+	if e, ok := err.(*RequestIdError); ok {
+		out["request_id"] = e.RequestId
+	}
+	encodedError, e := json.Marshal(out)
 	if e != nil {
 		log.Errorf("Failed to serialize: %s", e)
 		encodedError = []byte("{}")
@@ -59,6 +63,50 @@ func (r *HttpError) GetStatusCode() int {
 	return r.StatusCode
 }
 
+// RequestIdError attaches the id of the failed request to the error, so formatters can include it in the response
+type RequestIdError struct {
+	ProxyError
+	RequestId string
+}
+
+func WithRequestId(err ProxyError, requestId string) *RequestIdError {
+	return &RequestIdError{ProxyError: err, RequestId: requestId}
+}
+
+// AuthError rejects the request that has failed authentication with 401 Unauthorized,
+// the challenge, if set, is sent in WWW-Authenticate header
+type AuthError struct {
+	Reason    string
+	Challenge string
+}
+
+func (e *AuthError) Error() string {
+	return e.Reason
+}
+
+func (e *AuthError) GetStatusCode() int {
+	return http.StatusUnauthorized
+}
+
+func (e *AuthError) Headers() http.Header {
+	if e.Challenge == "" {
+		return nil
+	}
+	h := make(http.Header)
+	h.Set("WWW-Authenticate", e.Challenge)
+	return h
+}
+
+// AbortError makes the proxy drop the client connection without sending the response,
+// e.g. to emulate the connection reset by the endpoint
+type AbortError struct {
+	Reason string
+}
+
+func (e *AbortError) Error() string {
+	return e.Reason
+}
+
 type RedirectError struct {
 	URL *url.URL
 }
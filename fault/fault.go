@@ -0,0 +1,194 @@
+// Middleware that injects faults into the requests for chaos testing
+package fault
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/threshold"
+)
+
+// Injector delays, aborts or resets the share of the requests, so the resilience of the clients
+// and the retry policies can be tested, e.g. in staging:
+//
+//	f, _ := fault.NewInjectorWithOptions(fault.Options{
+//		Delay: fault.Delay{Percent: 10, Duration: 2 * time.Second},
+//		Abort: fault.Abort{Percent: 5, StatusCode: http.StatusServiceUnavailable},
+//	})
+//
+// The faults are chosen once per request, so the failover attempts of the request get the same fault.
+type Injector struct {
+	options Options
+	mutex   *sync.Mutex
+}
+
+type Options struct {
+	// Delays the requests before they are proxied to the endpoints
+	Delay Delay
+	// Replies to the requests with the error status without proxying them
+	Abort Abort
+	// Drops the client connections without the response
+	Reset Reset
+	// Injects the faults into the requests matching the predicate only, all requests by default
+	Predicate threshold.Predicate
+	// Random numbers source, useful in tests
+	Rand *rand.Rand
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+type Delay struct {
+	// Percent of the requests to delay, in range [0, 100]
+	Percent  float64
+	Duration time.Duration
+}
+
+type Abort struct {
+	// Percent of the requests to abort, in range [0, 100]
+	Percent float64
+	// Response status code, 503 Service Unavailable by default
+	StatusCode int
+}
+
+type Reset struct {
+	// Percent of the requests to reset, in range [0, 100]
+	Percent float64
+}
+
+func NewInjector() (*Injector, error) {
+	return NewInjectorWithOptions(Options{})
+}
+
+func NewInjectorWithOptions(o Options) (*Injector, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Injector{options: o, mutex: &sync.Mutex{}}, nil
+}
+
+func (f *Injector) ProcessRequest(r request.Request) (*http.Response, error) {
+	fl := f.getFault(r)
+	if fl == nil {
+		return nil, nil
+	}
+	if fl.delay > 0 {
+		// Only the first attempt is delayed
+		delay := fl.delay
+		fl.delay = 0
+		select {
+		case <-f.options.TimeProvider.After(delay):
+		case <-r.GetContext().Done():
+			return nil, r.GetContext().Err()
+		}
+	}
+	switch fl.kind {
+	case faultAbort:
+		return netutils.NewTextResponse(r.GetHttpRequest(), f.options.Abort.StatusCode, http.StatusText(f.options.Abort.StatusCode)), nil
+	case faultReset:
+		return nil, &errors.AbortError{Reason: "Injected connection reset"}
+	}
+	return nil, nil
+}
+
+func (f *Injector) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+type faultKind int
+
+const (
+	faultNone faultKind = iota
+	faultAbort
+	faultReset
+)
+
+func (k faultKind) String() string {
+	switch k {
+	case faultAbort:
+		return "abort"
+	case faultReset:
+		return "reset"
+	}
+	return "none"
+}
+
+// fault is chosen for the first attempt and is shared by all attempts of the request
+type fault struct {
+	delay time.Duration
+	kind  faultKind
+}
+
+// getFault returns the fault of the request, nil if the request is not affected
+func (f *Injector) getFault(r request.Request) *fault {
+	if v, ok := r.GetUserData(faultKey); ok {
+		return v.(*fault)
+	}
+	var fl *fault
+	if f.options.Predicate == nil || f.options.Predicate(r) {
+		fl = f.chooseFault()
+	}
+	r.SetUserData(faultKey, fl)
+	if fl != nil {
+		log.Infof("%s injecting fault: delay=%s, fault=%s", r, fl.delay, fl.kind)
+	}
+	return fl
+}
+
+func (f *Injector) chooseFault() *fault {
+	f.mutex.Lock()
+	delayRoll, faultRoll := f.options.Rand.Float64()*100, f.options.Rand.Float64()*100
+	f.mutex.Unlock()
+
+	fl := &fault{}
+	if delayRoll < f.options.Delay.Percent {
+		fl.delay = f.options.Delay.Duration
+	}
+	// Reset and abort are exclusive, so they share the roll
+	switch {
+	case faultRoll < f.options.Reset.Percent:
+		fl.kind = faultReset
+	case faultRoll < f.options.Reset.Percent+f.options.Abort.Percent:
+		fl.kind = faultAbort
+	}
+	if fl.delay == 0 && fl.kind == faultNone {
+		return nil
+	}
+	return fl
+}
+
+func parseOptions(o Options) (Options, error) {
+	for _, p := range []float64{o.Delay.Percent, o.Abort.Percent, o.Reset.Percent} {
+		if p < 0 || p > 100 {
+			return o, fmt.Errorf("Percent should be in range [0, 100], got %v", p)
+		}
+	}
+	if o.Abort.Percent+o.Reset.Percent > 100 {
+		return o, fmt.Errorf("Abort and reset percents together should not exceed 100")
+	}
+	if o.Delay.Duration < 0 {
+		return o, fmt.Errorf("Delay can not be negative")
+	}
+	if o.Abort.StatusCode == 0 {
+		o.Abort.StatusCode = http.StatusServiceUnavailable
+	}
+	if o.Abort.StatusCode < 100 || o.Abort.StatusCode > 599 {
+		return o, fmt.Errorf("Unsupported status code: %d", o.Abort.StatusCode)
+	}
+	if o.Rand == nil {
+		o.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
+
+const faultKey = "__fault.fault"
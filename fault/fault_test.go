@@ -0,0 +1,164 @@
+package fault
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestFault(t *testing.T) { TestingT(t) }
+
+type FaultSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&FaultSuite{})
+
+func (s *FaultSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *FaultSuite) newInjector(c *C, o Options) *Injector {
+	o.TimeProvider = s.tm
+	o.Rand = rand.New(rand.NewSource(1))
+	f, err := NewInjectorWithOptions(o)
+	c.Assert(err, IsNil)
+	return f
+}
+
+// Injector without faults passes the requests through
+func (s *FaultSuite) TestNoFaults(c *C) {
+	f, err := NewInjector()
+	c.Assert(err, IsNil)
+	re, err := f.ProcessRequest(makeRequest())
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *FaultSuite) TestDelay(c *C) {
+	f := s.newInjector(c, Options{Delay: Delay{Percent: 100, Duration: time.Second}})
+
+	r := makeRequest()
+	start := s.tm.UtcNow()
+	re, err := f.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, time.Second)
+
+	// Failover attempt is not delayed again
+	re, err = f.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, time.Second)
+}
+
+func (s *FaultSuite) TestDelayClientGone(c *C) {
+	f, err := NewInjectorWithOptions(Options{Delay: Delay{Percent: 100, Duration: time.Hour}})
+	c.Assert(err, IsNil)
+
+	r := makeRequest()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.SetContext(ctx)
+	_, err = f.ProcessRequest(r)
+	c.Assert(err, Equals, context.Canceled)
+}
+
+func (s *FaultSuite) TestAbort(c *C) {
+	f := s.newInjector(c, Options{Abort: Abort{Percent: 100, StatusCode: http.StatusTooManyRequests}})
+
+	re, err := f.ProcessRequest(makeRequest())
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusTooManyRequests)
+
+	f = s.newInjector(c, Options{Abort: Abort{Percent: 100}})
+	re, err = f.ProcessRequest(makeRequest())
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *FaultSuite) TestReset(c *C) {
+	f := s.newInjector(c, Options{Reset: Reset{Percent: 100}})
+
+	r := makeRequest()
+	re, err := f.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	_, ok := err.(*errors.AbortError)
+	c.Assert(ok, Equals, true)
+
+	// Failover attempts get the same fault
+	_, err = f.ProcessRequest(r)
+	_, ok = err.(*errors.AbortError)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *FaultSuite) TestPercent(c *C) {
+	f := s.newInjector(c, Options{Abort: Abort{Percent: 30}, Reset: Reset{Percent: 20}})
+
+	aborted, reset := 0, 0
+	for i := 0; i < 1000; i++ {
+		re, err := f.ProcessRequest(makeRequest())
+		if re != nil {
+			aborted++
+		}
+		if err != nil {
+			reset++
+		}
+	}
+	c.Assert(aborted > 250 && aborted < 350, Equals, true, Commentf("aborted %d", aborted))
+	c.Assert(reset > 150 && reset < 250, Equals, true, Commentf("reset %d", reset))
+}
+
+func (s *FaultSuite) TestPredicate(c *C) {
+	f := s.newInjector(c, Options{
+		Abort: Abort{Percent: 100},
+		Predicate: func(r request.Request) bool {
+			return r.GetHttpRequest().Header.Get("X-Chaos") != ""
+		},
+	})
+
+	re, err := f.ProcessRequest(makeRequest())
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	r := makeRequest()
+	r.GetHttpRequest().Header.Set("X-Chaos", "1")
+	re, err = f.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+}
+
+func (s *FaultSuite) TestBadParams(c *C) {
+	bad := []Options{
+		{Delay: Delay{Percent: -1}},
+		{Abort: Abort{Percent: 101}},
+		{Abort: Abort{Percent: 60}, Reset: Reset{Percent: 60}},
+		{Delay: Delay{Percent: 10, Duration: -1}},
+		{Abort: Abort{Percent: 10, StatusCode: 1000}},
+	}
+	for _, o := range bad {
+		_, err := NewInjectorWithOptions(o)
+		c.Assert(err, NotNil)
+	}
+}
+
+func makeRequest() request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     "GET",
+		Host:       "localhost",
+		URL:        netutils.MustParseUrl("http://localhost/a"),
+		RequestURI: "/a",
+		Header:     http.Header{},
+	}, 1, nil)
+}
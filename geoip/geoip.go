@@ -0,0 +1,220 @@
+// GeoIP lookups of the client addresses for filtering, limiting and routing the requests
+package geoip
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route"
+)
+
+// Record is the location of the client address
+type Record struct {
+	// ISO 3166-1 country code, e.g. "US", empty if unknown
+	Country string
+	// Continent code, e.g. "EU", empty if unknown
+	Continent string
+	// Autonomous system number, 0 if unknown
+	ASN uint
+	// Organization of the autonomous system
+	Organization string
+}
+
+// GeoIP looks up the client addresses in MaxMind databases. The record is looked up once per request
+// and is shared by the router matchers, the limiter mappers and the middleware:
+//
+//	g, _ := geoip.NewGeoIPWithOptions(countryDB, geoip.Options{DeniedCountries: []string{"XX"}})
+//	router.AddRoute("eu", g.Continent("EU"), euLocation)
+//	limiter, _ := tokenbucket.NewTokenLimiter(g.MapCountry, rate)
+//	location.GetMiddlewareChain().Add("geoip", 0, g)
+//
+// As a middleware, it rejects the requests from the denied countries and networks with 403 Forbidden
+// and stores the country and the ASN in the request user data under CountryKey and ASNKey,
+// so the limiters can use "request.user_data.geoip.country" variable.
+type GeoIP struct {
+	db      *Database
+	options Options
+
+	allowedCountries map[string]bool
+	deniedCountries  map[string]bool
+	deniedASNs       map[uint]bool
+}
+
+type Options struct {
+	// Database with the autonomous systems, e.g. GeoLite2-ASN, if they are not in the main database
+	ASNDatabase *Database
+	// If set, the requests from the other countries, including the unknown ones, are rejected
+	AllowedCountries []string
+	// Requests from these countries are rejected
+	DeniedCountries []string
+	// Requests from these autonomous systems are rejected
+	DeniedASNs []uint
+}
+
+func NewGeoIP(db *Database) (*GeoIP, error) {
+	return NewGeoIPWithOptions(db, Options{})
+}
+
+func NewGeoIPWithOptions(db *Database, o Options) (*GeoIP, error) {
+	if db == nil {
+		return nil, fmt.Errorf("Provide database")
+	}
+	g := &GeoIP{
+		db:               db,
+		options:          o,
+		allowedCountries: countrySet(o.AllowedCountries),
+		deniedCountries:  countrySet(o.DeniedCountries),
+		deniedASNs:       make(map[uint]bool),
+	}
+	for _, asn := range o.DeniedASNs {
+		g.deniedASNs[asn] = true
+	}
+	return g, nil
+}
+
+func (g *GeoIP) ProcessRequest(r request.Request) (*http.Response, error) {
+	rec := g.Locate(r)
+	r.SetUserData(CountryKey, rec.Country)
+	r.SetUserData(ASNKey, strconv.FormatUint(uint64(rec.ASN), 10))
+
+	if !g.isAllowed(rec) {
+		log.Infof("%s client from country %q, ASN %d is not allowed", r, rec.Country, rec.ASN)
+		return netutils.NewTextResponse(r.GetHttpRequest(), http.StatusForbidden, "Forbidden"), nil
+	}
+	return nil, nil
+}
+
+func (g *GeoIP) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// Locate returns the location of the client, the record is empty if the address is unknown
+func (g *GeoIP) Locate(r request.Request) *Record {
+	if v, ok := r.GetUserData(recordKey); ok {
+		return v.(*Record)
+	}
+	rec, err := g.lookup(r)
+	if err != nil {
+		log.Warningf("%s failed to locate client: %s", r, err)
+		rec = &Record{}
+	}
+	r.SetUserData(recordKey, rec)
+	return rec
+}
+
+// Country matches the requests from any of the countries
+func (g *GeoIP) Country(codes ...string) route.Matcher {
+	set := countrySet(codes)
+	return func(r request.Request) bool {
+		return set[g.Locate(r).Country]
+	}
+}
+
+// Continent matches the requests from any of the continents
+func (g *GeoIP) Continent(codes ...string) route.Matcher {
+	set := countrySet(codes)
+	return func(r request.Request) bool {
+		return set[g.Locate(r).Continent]
+	}
+}
+
+// ASN matches the requests from any of the autonomous systems
+func (g *GeoIP) ASN(numbers ...uint) route.Matcher {
+	return func(r request.Request) bool {
+		asn := g.Locate(r).ASN
+		for _, n := range numbers {
+			if asn == n {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MapCountry maps the request to the country of the client for the limiters, requests from unknown countries
+// share the empty token
+func (g *GeoIP) MapCountry(r request.Request) (string, int64, error) {
+	return g.Locate(r).Country, 1, nil
+}
+
+// MapASN maps the request to the autonomous system of the client for the limiters
+func (g *GeoIP) MapASN(r request.Request) (string, int64, error) {
+	return strconv.FormatUint(uint64(g.Locate(r).ASN), 10), 1, nil
+}
+
+func (g *GeoIP) isAllowed(rec *Record) bool {
+	if g.deniedCountries[rec.Country] || g.deniedASNs[rec.ASN] {
+		return false
+	}
+	return len(g.allowedCountries) == 0 || g.allowedCountries[rec.Country]
+}
+
+func (g *GeoIP) lookup(r request.Request) (*Record, error) {
+	ip := r.GetClientIP()
+	if ip == nil {
+		return nil, fmt.Errorf("Failed to parse client address: %q", r.GetHttpRequest().RemoteAddr)
+	}
+	rec := &Record{}
+	fields, err := g.db.Lookup(ip)
+	if err != nil {
+		return nil, err
+	}
+	rec.fill(fields)
+	if g.options.ASNDatabase != nil {
+		fields, err := g.options.ASNDatabase.Lookup(ip)
+		if err != nil {
+			return nil, err
+		}
+		rec.fill(fields)
+	}
+	return rec, nil
+}
+
+// fill sets the fields found in the record of GeoIP2/GeoLite2 Country, City or ASN database
+func (rec *Record) fill(fields map[string]interface{}) {
+	if fields == nil {
+		return
+	}
+	if code := nestedString(fields, "country", "iso_code"); code != "" {
+		rec.Country = code
+	} else if code := nestedString(fields, "registered_country", "iso_code"); code != "" && rec.Country == "" {
+		rec.Country = code
+	}
+	if code := nestedString(fields, "continent", "code"); code != "" {
+		rec.Continent = code
+	}
+	if asn, ok := fields["autonomous_system_number"].(uint64); ok {
+		rec.ASN = uint(asn)
+	}
+	if org, ok := fields["autonomous_system_organization"].(string); ok {
+		rec.Organization = org
+	}
+}
+
+func nestedString(fields map[string]interface{}, key, field string) string {
+	m, ok := fields[key].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	v, _ := m[field].(string)
+	return v
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		set[strings.ToUpper(c)] = true
+	}
+	return set
+}
+
+const (
+	// Request user data keys with the country code and the ASN of the client set by the middleware
+	CountryKey = "geoip.country"
+	ASNKey     = "geoip.asn"
+	recordKey  = "__geoip.record"
+)
@@ -0,0 +1,141 @@
+package geoip
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type GeoIPSuite struct {
+	db  *Database
+	asn *Database
+}
+
+var _ = Suite(&GeoIPSuite{})
+
+func (s *GeoIPSuite) SetUpSuite(c *C) {
+	var err error
+	s.db, err = FromBytes(buildDatabase(6, 28, testNetworks))
+	c.Assert(err, IsNil)
+	s.asn, err = FromBytes(buildDatabase(4, 24, []testNetwork{
+		{"1.2.0.0/16", map[string]interface{}{
+			"autonomous_system_number":       uint32(64500),
+			"autonomous_system_organization": "Example",
+		}},
+	}))
+	c.Assert(err, IsNil)
+}
+
+func (s *GeoIPSuite) TestLocate(c *C) {
+	g, err := NewGeoIPWithOptions(s.db, Options{ASNDatabase: s.asn})
+	c.Assert(err, IsNil)
+
+	rec := g.Locate(makeRequest("1.2.3.4:1234"))
+	c.Assert(rec, DeepEquals, &Record{Country: "US", Continent: "NA", ASN: 64500, Organization: "Example"})
+
+	rec = g.Locate(makeRequest("127.0.0.1:1234"))
+	c.Assert(rec, DeepEquals, &Record{})
+}
+
+func (s *GeoIPSuite) TestMiddleware(c *C) {
+	g, err := NewGeoIPWithOptions(s.db, Options{DeniedCountries: []string{"de"}, ASNDatabase: s.asn})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4:1234")
+	re, err := g.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	country, _ := r.GetUserData(CountryKey)
+	c.Assert(country, Equals, "US")
+	asn, _ := r.GetUserData(ASNKey)
+	c.Assert(asn, Equals, "64500")
+
+	re, err = g.ProcessRequest(makeRequest("5.6.7.8:1234"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+}
+
+// Unknown countries are rejected if the allowed countries are set
+func (s *GeoIPSuite) TestAllowedCountries(c *C) {
+	g, err := NewGeoIPWithOptions(s.db, Options{AllowedCountries: []string{"US"}})
+	c.Assert(err, IsNil)
+
+	tcs := []struct {
+		remoteAddr string
+		allowed    bool
+	}{
+		{"1.2.3.4:1234", true},
+		{"5.6.7.8:1234", false},
+		{"127.0.0.1:1234", false},
+	}
+	for _, tc := range tcs {
+		re, err := g.ProcessRequest(makeRequest(tc.remoteAddr))
+		c.Assert(err, IsNil)
+		c.Assert(re == nil, Equals, tc.allowed, Commentf("%s", tc.remoteAddr))
+	}
+}
+
+func (s *GeoIPSuite) TestDeniedASNs(c *C) {
+	g, err := NewGeoIPWithOptions(s.db, Options{ASNDatabase: s.asn, DeniedASNs: []uint{64500}})
+	c.Assert(err, IsNil)
+
+	re, err := g.ProcessRequest(makeRequest("1.2.3.4:1234"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+}
+
+func (s *GeoIPSuite) TestMatchers(c *C) {
+	g, err := NewGeoIPWithOptions(s.db, Options{ASNDatabase: s.asn})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4:1234")
+	c.Assert(g.Country("CA", "US")(r), Equals, true)
+	c.Assert(g.Country("DE")(r), Equals, false)
+	c.Assert(g.Continent("NA")(r), Equals, true)
+	c.Assert(g.ASN(64500)(r), Equals, true)
+
+	token, amount, err := g.MapCountry(r)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "US")
+	c.Assert(amount, Equals, int64(1))
+
+	token, _, err = g.MapASN(r)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "64500")
+}
+
+// Address of the client is the one of the request, with the trusted networks of the proxy
+func (s *GeoIPSuite) TestRequestClientIP(c *C) {
+	g, err := NewGeoIP(s.db)
+	c.Assert(err, IsNil)
+
+	trusted, err := netutils.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+	for _, tc := range []struct {
+		trusted []*net.IPNet
+		us      bool
+	}{{nil, false}, {trusted, true}} {
+		r := makeRequest("10.0.0.1:1234")
+		r.GetHttpRequest().Header.Set("X-Forwarded-For", "1.2.3.4")
+		r.(*request.BaseRequest).TrustedProxies = tc.trusted
+		c.Assert(g.Country("US")(r), Equals, tc.us)
+	}
+}
+
+func (s *GeoIPSuite) TestBadParams(c *C) {
+	_, err := NewGeoIP(nil)
+	c.Assert(err, NotNil)
+}
+
+func makeRequest(remoteAddr string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     "GET",
+		RemoteAddr: remoteAddr,
+		URL:        netutils.MustParseUrl("http://localhost/a"),
+		Header:     http.Header{},
+	}, 1, nil)
+}
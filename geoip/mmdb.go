@@ -0,0 +1,347 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// Database reads MaxMind DB files, e.g. GeoLite2-Country or GeoLite2-ASN.
+// The whole file is loaded in memory, lookups are safe for concurrent use.
+type Database struct {
+	buffer     []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// Node the IPv4 addresses start from in the IPv6 trees
+	ipv4Start uint
+	// Type of the database, e.g. GeoLite2-Country
+	Type string
+}
+
+// Open loads the database from the file
+func Open(path string) (*Database, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buffer)
+}
+
+// FromBytes parses the database contents
+func FromBytes(buffer []byte) (*Database, error) {
+	i := bytes.LastIndex(buffer, metadataMarker)
+	if i == -1 {
+		return nil, fmt.Errorf("Not a MaxMind DB: metadata not found")
+	}
+	metaStart := i + len(metadataMarker)
+	d := &decoder{buffer: buffer[metaStart:]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed metadata: %s", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Malformed metadata: expected map, got %T", v)
+	}
+
+	db := &Database{buffer: buffer}
+	db.nodeCount = uint(toUint64(meta["node_count"]))
+	db.recordSize = uint(toUint64(meta["record_size"]))
+	db.ipVersion = uint(toUint64(meta["ip_version"]))
+	db.Type, _ = meta["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("Unsupported record size: %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("Unsupported IP version: %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+dataSeparatorSize > uint(i) {
+		return nil, fmt.Errorf("Malformed database: search tree is larger than the file")
+	}
+	db.data = buffer[treeSize+dataSeparatorSize : i]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			if node, err = db.readRecord(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// Lookup returns the record of the network that contains the address, nil if the address is not in the database
+func (db *Database) Lookup(ip net.IP) (map[string]interface{}, error) {
+	node, address := uint(0), ip.To4()
+	if address != nil {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else {
+		if address = ip.To16(); address == nil {
+			return nil, fmt.Errorf("Invalid address: %v", ip)
+		}
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+	}
+
+	bits := uint(len(address) * 8)
+	for i := uint(0); i < bits && node < db.nodeCount; i++ {
+		bit := uint(address[i>>3]>>(7-(i&7))) & 1
+		var err error
+		if node, err = db.readRecord(node, bit); err != nil {
+			return nil, err
+		}
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, fmt.Errorf("Malformed database: search tree is deeper than the address")
+	}
+	offset := node - db.nodeCount - dataSeparatorSize
+	d := &decoder{buffer: db.data}
+	v, _, err := d.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	record, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Malformed record: expected map, got %T", v)
+	}
+	return record, nil
+}
+
+// readRecord returns the left (bit 0) or the right (bit 1) record of the node
+func (db *Database) readRecord(node, bit uint) (uint, error) {
+	nodeSize := db.recordSize / 4
+	offset := node * nodeSize
+	if offset+nodeSize > uint(len(db.buffer)) {
+		return 0, fmt.Errorf("Malformed database: node %d is out of range", node)
+	}
+	b := db.buffer[offset : offset+nodeSize]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const dataSeparatorSize = 16
+
+// Data section field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decoder decodes the fields of the data section into maps, slices, strings, numbers and booleans.
+// Unsigned integers are decoded as uint64, except for uint128 that is decoded as *big.Int.
+type decoder struct {
+	buffer []byte
+}
+
+// decode returns the value at the offset and the offset of the next field
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	typeNum, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typeNum == typePointer {
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(pointer)
+		return v, next, err
+	}
+	return d.decodeValue(typeNum, size, offset)
+}
+
+func (d *decoder) decodeControl(offset uint) (uint, uint, uint, error) {
+	b, err := d.read(offset, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	offset++
+	ctrl := uint(b[0])
+	typeNum := ctrl >> 5
+	if typeNum == typeExtended {
+		b, err := d.read(offset, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		offset++
+		typeNum = 7 + uint(b[0])
+	}
+	size := ctrl & 0x1f
+	if typeNum == typePointer || size < 29 {
+		return typeNum, size, offset, nil
+	}
+	extra := size - 28
+	b, err = d.read(offset, extra)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	n := uint(0)
+	for _, v := range b {
+		n = n<<8 | uint(v)
+	}
+	switch extra {
+	case 1:
+		size = 29 + n
+	case 2:
+		size = 285 + n
+	default:
+		size = 65821 + n
+	}
+	return typeNum, size, offset + extra, nil
+}
+
+func (d *decoder) decodePointer(size, offset uint) (uint, uint, error) {
+	pointerSize := (size >> 3) & 0x3
+	b, err := d.read(offset, pointerSize+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	var prefix uint
+	if pointerSize != 3 {
+		prefix = size & 0x7
+	}
+	n := prefix
+	for _, v := range b {
+		n = n<<8 | uint(v)
+	}
+	switch pointerSize {
+	case 1:
+		n += 2048
+	case 2:
+		n += 526336
+	}
+	return n, offset + pointerSize + 1, nil
+}
+
+func (d *decoder) decodeValue(typeNum, size, offset uint) (interface{}, uint, error) {
+	switch typeNum {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("Expected string map key, got %T", k)
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.read(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	next := offset + size
+	switch typeNum {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("Invalid double size: %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("Invalid float size: %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("Invalid integer size: %d", size)
+		}
+		n := uint64(0)
+		for _, v := range b {
+			n = n<<8 | uint64(v)
+		}
+		return n, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("Invalid integer size: %d", size)
+		}
+		n := uint32(0)
+		for _, v := range b {
+			n = n<<8 | uint32(v)
+		}
+		return int64(int32(n)), next, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return nil, 0, fmt.Errorf("Unsupported field type: %d", typeNum)
+}
+
+func (d *decoder) read(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buffer)) || offset+size < offset {
+		return nil, fmt.Errorf("Unexpected end of data at offset %d", offset)
+	}
+	return d.buffer[offset : offset+size], nil
+}
+
+func toUint64(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
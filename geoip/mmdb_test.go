@@ -0,0 +1,266 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestGeoIP(t *testing.T) { TestingT(t) }
+
+type MMDBSuite struct{}
+
+var _ = Suite(&MMDBSuite{})
+
+var testNetworks = []testNetwork{
+	{"1.2.3.0/24", map[string]interface{}{
+		"country":   map[string]interface{}{"iso_code": "US"},
+		"continent": map[string]interface{}{"code": "NA"},
+	}},
+	{"5.6.0.0/16", map[string]interface{}{
+		"country":   map[string]interface{}{"iso_code": "DE"},
+		"continent": map[string]interface{}{"code": "EU"},
+	}},
+}
+
+func (s *MMDBSuite) TestLookup(c *C) {
+	for _, ipVersion := range []int{4, 6} {
+		networks := testNetworks
+		if ipVersion == 6 {
+			networks = append(networks, testNetwork{"2001:db8::/32", map[string]interface{}{
+				"country": map[string]interface{}{"iso_code": "FR"},
+			}})
+		}
+		for _, recordSize := range []int{24, 28, 32} {
+			comment := Commentf("ip version %d, record size %d", ipVersion, recordSize)
+			db, err := FromBytes(buildDatabase(ipVersion, recordSize, networks))
+			c.Assert(err, IsNil, comment)
+			c.Assert(db.Type, Equals, "Test")
+
+			tcs := []struct {
+				ip      string
+				country string
+			}{
+				{"1.2.3.4", "US"},
+				{"1.2.3.255", "US"},
+				{"5.6.7.8", "DE"},
+				{"1.2.4.1", ""},
+				{"127.0.0.1", ""},
+			}
+			if ipVersion == 6 {
+				tcs = append(tcs, struct {
+					ip      string
+					country string
+				}{"2001:db8::1", "FR"})
+			}
+			for _, tc := range tcs {
+				record, err := db.Lookup(net.ParseIP(tc.ip))
+				c.Assert(err, IsNil, comment)
+				if tc.country == "" {
+					c.Assert(record, IsNil, comment)
+					continue
+				}
+				c.Assert(nestedString(record, "country", "iso_code"), Equals, tc.country, comment)
+			}
+		}
+	}
+}
+
+// IPv6 addresses are not in IPv4 databases
+func (s *MMDBSuite) TestIPv6InIPv4Database(c *C) {
+	db, err := FromBytes(buildDatabase(4, 24, testNetworks))
+	c.Assert(err, IsNil)
+
+	record, err := db.Lookup(net.ParseIP("2001:db8::1"))
+	c.Assert(err, IsNil)
+	c.Assert(record, IsNil)
+}
+
+func (s *MMDBSuite) TestDecodePointer(c *C) {
+	// "hello" at offset 0, followed by the pointer to it
+	d := &decoder{buffer: []byte{0x45, 'h', 'e', 'l', 'l', 'o', 0x20, 0x00}}
+	v, next, err := d.decode(6)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "hello")
+	c.Assert(next, Equals, uint(8))
+}
+
+func (s *MMDBSuite) TestDecodeTypes(c *C) {
+	tcs := []struct {
+		data     []byte
+		expected interface{}
+	}{
+		{[]byte{0xa2, 0x01, 0x00}, uint64(256)},
+		// Extended types: int32, uint64, boolean
+		{[]byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe}, int64(-2)},
+		{[]byte{0x01, 0x02, 0x05}, uint64(5)},
+		{[]byte{0x01, 0x07}, true},
+		{[]byte{0x02, 0x04, 0x43, 'a', 'b', 'c', 0x41, 'd'}, []interface{}{"abc", "d"}},
+	}
+	for _, tc := range tcs {
+		d := &decoder{buffer: tc.data}
+		v, next, err := d.decode(0)
+		c.Assert(err, IsNil)
+		c.Assert(v, DeepEquals, tc.expected)
+		c.Assert(next, Equals, uint(len(tc.data)))
+	}
+}
+
+func (s *MMDBSuite) TestMalformed(c *C) {
+	_, err := FromBytes([]byte("garbage"))
+	c.Assert(err, NotNil)
+
+	data := buildDatabase(4, 24, testNetworks)
+	// Truncated search tree
+	_, err = FromBytes(data[len(data)-60:])
+	c.Assert(err, NotNil)
+
+	d := &decoder{buffer: []byte{0x45, 'h', 'e'}}
+	_, _, err = d.decode(0)
+	c.Assert(err, NotNil)
+}
+
+type testNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	id       int
+	leaf     bool
+	offset   int
+}
+
+// buildDatabase writes MaxMind DB with the networks
+func buildDatabase(ipVersion, recordSize int, networks []testNetwork) []byte {
+	root := &trieNode{}
+	var data []byte
+	for _, n := range networks {
+		_, network, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			panic(err)
+		}
+		ones, _ := network.Mask.Size()
+		address := []byte(network.IP)
+		if ipVersion == 6 && len(address) == 4 {
+			address = append(make([]byte, 12), address...)
+			ones += 96
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := address[i/8] >> uint(7-i%8) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &trieNode{}
+			}
+			node = node.children[bit]
+		}
+		node.leaf = true
+		node.offset = len(data)
+		data = append(data, encodeValue(n.record)...)
+	}
+
+	// Number the nodes breadth first, root is the node 0
+	var nodes []*trieNode
+	for queue := []*trieNode{root}; len(queue) != 0; queue = queue[1:] {
+		node := queue[0]
+		if node.leaf {
+			continue
+		}
+		node.id = len(nodes)
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	var tree []byte
+	for _, node := range nodes {
+		var records [2]uint32
+		for i, child := range node.children {
+			switch {
+			case child == nil:
+				records[i] = uint32(len(nodes))
+			case child.leaf:
+				records[i] = uint32(len(nodes) + dataSeparatorSize + child.offset)
+			default:
+				records[i] = uint32(child.id)
+			}
+		}
+		tree = append(tree, encodeNode(recordSize, records)...)
+	}
+
+	out := append(tree, make([]byte, dataSeparatorSize)...)
+	out = append(out, data...)
+	out = append(out, metadataMarker...)
+	return append(out, encodeValue(map[string]interface{}{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test",
+	})...)
+}
+
+func encodeNode(recordSize int, r [2]uint32) []byte {
+	switch recordSize {
+	case 24:
+		return []byte{byte(r[0] >> 16), byte(r[0] >> 8), byte(r[0]), byte(r[1] >> 16), byte(r[1] >> 8), byte(r[1])}
+	case 28:
+		return []byte{byte(r[0] >> 16), byte(r[0] >> 8), byte(r[0]), byte(r[0]>>20&0xF0 | r[1]>>24&0x0F), byte(r[1] >> 16), byte(r[1] >> 8), byte(r[1])}
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, r[0])
+	binary.BigEndian.PutUint32(b[4:], r[1])
+	return b
+}
+
+// encodeValue supports the small values used in tests
+func encodeValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(control(typeString, len(v)), v...)
+	case uint16:
+		return append(control(typeUint16, 2), byte(v>>8), byte(v))
+	case uint32:
+		return append(control(typeUint32, 4), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	case uint64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return append(control(typeUint64, 8), b...)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := control(typeMap, len(v))
+		for _, k := range keys {
+			out = append(out, encodeValue(k)...)
+			out = append(out, encodeValue(v[k])...)
+		}
+		return out
+	}
+	panic("unsupported value")
+}
+
+func control(typeNum, size int) []byte {
+	var extra []byte
+	if size >= 29 {
+		if size >= 285 {
+			panic("size is too large")
+		}
+		size, extra = 29, []byte{byte(size - 29)}
+	}
+	var out []byte
+	if typeNum < 8 {
+		out = []byte{byte(typeNum<<5 | size)}
+	} else {
+		out = []byte{byte(size), byte(typeNum - 7)}
+	}
+	return append(out, extra...)
+}
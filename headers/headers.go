@@ -6,26 +6,37 @@ const (
 	XForwardedFor      = "X-Forwarded-For"
 	XForwardedHost     = "X-Forwarded-Host"
 	XForwardedServer   = "X-Forwarded-Server"
+	Forwarded          = "Forwarded"
+	Via                = "Via"
 	Connection         = "Connection"
 	KeepAlive          = "Keep-Alive"
 	ProxyAuthenticate  = "Proxy-Authenticate"
 	ProxyAuthorization = "Proxy-Authorization"
-	Te                 = "Te" // canonicalized version of "TE"
+	ProxyConnection    = "Proxy-Connection" // non-standard, but sent by the older clients
+	Te                 = "Te"               // canonicalized version of "TE"
+	Trailer            = "Trailer"
 	Trailers           = "Trailers"
 	TransferEncoding   = "Transfer-Encoding"
 	Upgrade            = "Upgrade"
 	ContentLength      = "Content-Length"
+	XRequestId         = "X-Request-Id"
+	XB3TraceId         = "X-B3-TraceId"
+	XB3SpanId          = "X-B3-SpanId"
+	XB3ParentSpanId    = "X-B3-ParentSpanId"
+	XB3Sampled         = "X-B3-Sampled"
 )
 
-// Hop-by-hop headers. These are removed when sent to the backend.
-// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+// Hop-by-hop headers. These are removed when sent to the backend and when sent back to the client.
+// https://tools.ietf.org/html/rfc7230#section-6.1
 // Copied from reverseproxy.go, too bad
 var HopHeaders = []string{
 	Connection,
+	ProxyConnection,
 	KeepAlive,
 	ProxyAuthenticate,
 	ProxyAuthorization,
 	Te, // canonicalized version of "TE"
+	Trailer,
 	Trailers,
 	TransferEncoding,
 	Upgrade,
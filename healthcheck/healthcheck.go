@@ -0,0 +1,263 @@
+// Active health checking of the endpoints
+package healthcheck
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/endpoint"
+)
+
+// Balancer is the load balancer that the health checker adds healthy endpoints to
+// and removes unhealthy endpoints from, e.g. round robin.
+type Balancer interface {
+	AddEndpoint(endpoint.Endpoint) error
+	RemoveEndpoint(endpoint.Endpoint) error
+}
+
+// HealthChecker periodically probes endpoints with HTTP GET requests, removes endpoints
+// from the balancer once they fail UnhealthyThreshold probes in a row and adds them back
+// once they pass HealthyThreshold probes in a row.
+type HealthChecker struct {
+	balancer Balancer
+	options  Options
+	client   *http.Client
+	mutex    *sync.Mutex
+	targets  map[string]*target
+	stopC    chan struct{}
+	wg       *sync.WaitGroup
+}
+
+type Options struct {
+	// Path to probe, e.g. /status
+	Path string
+	// How often to probe endpoints
+	Interval time.Duration
+	// Probe fails if the endpoint does not reply within the timeout
+	Timeout time.Duration
+	// Consecutive successful probes after which unhealthy endpoint is added back
+	HealthyThreshold int
+	// Consecutive failed probes after which endpoint is removed
+	UnhealthyThreshold int
+	// Transport to send probes with, useful in tests
+	Transport http.RoundTripper
+}
+
+const (
+	DefaultPath               = "/"
+	DefaultInterval           = 10 * time.Second
+	DefaultTimeout            = 5 * time.Second
+	DefaultHealthyThreshold   = 2
+	DefaultUnhealthyThreshold = 3
+)
+
+type target struct {
+	endpoint  endpoint.Endpoint
+	healthy   bool
+	successes int
+	failures  int
+}
+
+func NewHealthChecker(b Balancer) (*HealthChecker, error) {
+	return NewHealthCheckerWithOptions(b, Options{})
+}
+
+func NewHealthCheckerWithOptions(b Balancer, o Options) (*HealthChecker, error) {
+	if b == nil {
+		return nil, fmt.Errorf("Provide balancer")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &HealthChecker{
+		balancer: b,
+		options:  o,
+		client:   &http.Client{Transport: o.Transport, Timeout: o.Timeout},
+		mutex:    &sync.Mutex{},
+		targets:  make(map[string]*target),
+		wg:       &sync.WaitGroup{},
+	}, nil
+}
+
+// AddEndpoint adds the endpoint to the balancer and starts probing it,
+// endpoint is considered healthy until it fails the probes.
+func (h *HealthChecker) AddEndpoint(e endpoint.Endpoint) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	if _, exists := h.targets[e.GetId()]; exists {
+		return fmt.Errorf("Endpoint %s already exists", e.GetId())
+	}
+	if err := h.balancer.AddEndpoint(e); err != nil {
+		return err
+	}
+	h.targets[e.GetId()] = &target{endpoint: e, healthy: true}
+	return nil
+}
+
+// RemoveEndpoint stops probing the endpoint and removes it from the balancer if it's there
+func (h *HealthChecker) RemoveEndpoint(e endpoint.Endpoint) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	t, exists := h.targets[e.GetId()]
+	if !exists {
+		return fmt.Errorf("Endpoint %s not found", e.GetId())
+	}
+	delete(h.targets, e.GetId())
+	if t.healthy {
+		return h.balancer.RemoveEndpoint(t.endpoint)
+	}
+	return nil
+}
+
+func (h *HealthChecker) IsHealthy(e endpoint.Endpoint) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	t, exists := h.targets[e.GetId()]
+	return exists && t.healthy
+}
+
+// Start probes endpoints every interval until Stop is called
+func (h *HealthChecker) Start() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.stopC != nil {
+		return
+	}
+	h.stopC = make(chan struct{})
+	h.wg.Add(1)
+	go h.run(h.stopC)
+}
+
+func (h *HealthChecker) Stop() {
+	h.mutex.Lock()
+	stopC := h.stopC
+	h.stopC = nil
+	h.mutex.Unlock()
+
+	if stopC != nil {
+		close(stopC)
+		h.wg.Wait()
+	}
+}
+
+// Check probes all the endpoints once and updates the balancer
+func (h *HealthChecker) Check() {
+	h.mutex.Lock()
+	targets := make([]*target, 0, len(h.targets))
+	for _, t := range h.targets {
+		targets = append(targets, t)
+	}
+	h.mutex.Unlock()
+
+	results := make([]error, len(targets))
+	wg := &sync.WaitGroup{}
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, e endpoint.Endpoint) {
+			defer wg.Done()
+			results[i] = h.probe(e)
+		}(i, t.endpoint)
+	}
+	wg.Wait()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, t := range targets {
+		// Endpoint could have been removed while we were probing it
+		if h.targets[t.endpoint.GetId()] != t {
+			continue
+		}
+		h.update(t, results[i])
+	}
+}
+
+func (h *HealthChecker) run(stopC chan struct{}) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Check()
+		case <-stopC:
+			return
+		}
+	}
+}
+
+func (h *HealthChecker) probe(e endpoint.Endpoint) error {
+	u := *e.GetUrl()
+	u.Path = h.options.Path
+	u.RawQuery = ""
+	re, err := h.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	re.Body.Close()
+	if re.StatusCode < 200 || re.StatusCode >= 400 {
+		return fmt.Errorf("Unexpected status code: %d", re.StatusCode)
+	}
+	return nil
+}
+
+func (h *HealthChecker) update(t *target, err error) {
+	if err == nil {
+		t.successes += 1
+		t.failures = 0
+	} else {
+		t.failures += 1
+		t.successes = 0
+	}
+
+	if t.healthy && t.failures >= h.options.UnhealthyThreshold {
+		log.Infof("%s is unhealthy: %s, removing from balancer", t.endpoint, err)
+		if err := h.balancer.RemoveEndpoint(t.endpoint); err != nil {
+			log.Errorf("Failed to remove %s: %s", t.endpoint, err)
+			return
+		}
+		t.healthy = false
+	} else if !t.healthy && t.successes >= h.options.HealthyThreshold {
+		log.Infof("%s is healthy again, adding back to balancer", t.endpoint)
+		if err := h.balancer.AddEndpoint(t.endpoint); err != nil {
+			log.Errorf("Failed to add %s: %s", t.endpoint, err)
+			return
+		}
+		t.healthy = true
+	}
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Interval < 0 || o.Timeout < 0 || o.HealthyThreshold < 0 || o.UnhealthyThreshold < 0 {
+		return o, fmt.Errorf("Interval, timeout and thresholds can not be negative")
+	}
+	if o.Path == "" {
+		o.Path = DefaultPath
+	}
+	if o.Interval == 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.HealthyThreshold == 0 {
+		o.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if o.UnhealthyThreshold == 0 {
+		o.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	if o.Transport == nil {
+		o.Transport = http.DefaultTransport
+	}
+	return o, nil
+}
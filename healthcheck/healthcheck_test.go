@@ -0,0 +1,117 @@
+package healthcheck
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func TestHealthCheck(t *testing.T) { TestingT(t) }
+
+type HealthSuite struct {
+}
+
+var _ = Suite(&HealthSuite{})
+
+func (s *HealthSuite) TestBadParams(c *C) {
+	_, err := NewHealthChecker(nil)
+	c.Assert(err, NotNil)
+
+	rr, _ := roundrobin.NewRoundRobin()
+	_, err = NewHealthCheckerWithOptions(rr, Options{Interval: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *HealthSuite) TestAddRemove(c *C) {
+	rr, _ := roundrobin.NewRoundRobin()
+	h, err := NewHealthChecker(rr)
+	c.Assert(err, IsNil)
+
+	e := MustParseUrl("http://localhost:5000")
+	c.Assert(h.AddEndpoint(e), IsNil)
+	c.Assert(h.AddEndpoint(e), NotNil)
+	c.Assert(h.IsHealthy(e), Equals, true)
+	c.Assert(len(rr.GetEndpoints()), Equals, 1)
+
+	c.Assert(h.RemoveEndpoint(e), IsNil)
+	c.Assert(h.RemoveEndpoint(e), NotNil)
+	c.Assert(h.IsHealthy(e), Equals, false)
+	c.Assert(len(rr.GetEndpoints()), Equals, 0)
+}
+
+func (s *HealthSuite) TestRemovesAndAddsBack(c *C) {
+	var status int64 = http.StatusOK
+	var path atomic.Value
+	srv := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		path.Store(r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt64(&status)))
+	})
+	defer srv.Close()
+
+	rr, _ := roundrobin.NewRoundRobin()
+	h, err := NewHealthCheckerWithOptions(rr, Options{Path: "/status", HealthyThreshold: 2, UnhealthyThreshold: 2})
+	c.Assert(err, IsNil)
+
+	e := MustParseUrl(srv.URL)
+	c.Assert(h.AddEndpoint(e), IsNil)
+
+	h.Check()
+	c.Assert(path.Load(), Equals, "/status")
+	c.Assert(h.IsHealthy(e), Equals, true)
+
+	// One failure is not enough
+	atomic.StoreInt64(&status, http.StatusInternalServerError)
+	h.Check()
+	c.Assert(h.IsHealthy(e), Equals, true)
+
+	h.Check()
+	c.Assert(h.IsHealthy(e), Equals, false)
+	c.Assert(len(rr.GetEndpoints()), Equals, 0)
+
+	atomic.StoreInt64(&status, http.StatusOK)
+	h.Check()
+	c.Assert(h.IsHealthy(e), Equals, false)
+
+	h.Check()
+	c.Assert(h.IsHealthy(e), Equals, true)
+	c.Assert(len(rr.GetEndpoints()), Equals, 1)
+}
+
+func (s *HealthSuite) TestTimeout(c *C) {
+	srv := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	defer srv.Close()
+
+	rr, _ := roundrobin.NewRoundRobin()
+	h, err := NewHealthCheckerWithOptions(rr, Options{Timeout: 10 * time.Millisecond, UnhealthyThreshold: 1})
+	c.Assert(err, IsNil)
+
+	e := MustParseUrl(srv.URL)
+	c.Assert(h.AddEndpoint(e), IsNil)
+	h.Check()
+	c.Assert(h.IsHealthy(e), Equals, false)
+}
+
+func (s *HealthSuite) TestPeriodicChecks(c *C) {
+	// Nothing listens on this port, so probes fail right away
+	rr, _ := roundrobin.NewRoundRobin()
+	h, err := NewHealthCheckerWithOptions(rr, Options{Interval: time.Millisecond, UnhealthyThreshold: 1})
+	c.Assert(err, IsNil)
+
+	e := MustParseUrl("http://localhost:63450")
+	c.Assert(h.AddEndpoint(e), IsNil)
+
+	h.Start()
+	defer h.Stop()
+	for i := 0; i < 100 && h.IsHealthy(e); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(h.IsHealthy(e), Equals, false)
+}
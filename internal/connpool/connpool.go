@@ -0,0 +1,103 @@
+// Package connpool keeps the idle connections to the remote stores, e.g. Redis and memcached,
+// that the middlewares share their state through
+package connpool
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type Pool struct {
+	address string
+	timeout time.Duration
+	conns   chan *Conn
+}
+
+type Conn struct {
+	net.Conn
+	Reader *bufio.Reader
+	Writer *bufio.Writer
+}
+
+// ReplyError is the error replied by the store, the connection is still usable after it
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// New creates the pool, the timeout applies to connecting and to every call of Do
+func New(address string, maxIdleConns int, timeout time.Duration) *Pool {
+	return &Pool{
+		address: address,
+		timeout: timeout,
+		conns:   make(chan *Conn, maxIdleConns),
+	}
+}
+
+// Do runs the function on the pooled connection. Connections that failed with errors other than
+// ReplyError are closed, as they may have unread data.
+func (p *Pool) Do(fn func(c *Conn) error) error {
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+	c.SetDeadline(time.Now().Add(p.timeout))
+	err = fn(c)
+	if err != nil {
+		if _, ok := err.(ReplyError); !ok {
+			c.Close()
+			return err
+		}
+	}
+	p.put(c)
+	return err
+}
+
+// Close closes the idle connections
+func (p *Pool) Close() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (p *Pool) get() (*Conn, error) {
+	select {
+	case c := <-p.conns:
+		return c, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", p.address, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: nc, Reader: bufio.NewReader(nc), Writer: bufio.NewWriter(nc)}, nil
+}
+
+func (p *Pool) put(c *Conn) {
+	select {
+	case p.conns <- c:
+	default:
+		c.Close()
+	}
+}
+
+// ReadLine reads the line terminated by CRLF, both Redis and memcached protocols are line based
+func (c *Conn) ReadLine() (string, error) {
+	line, err := c.Reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("Malformed reply: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
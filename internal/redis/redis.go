@@ -0,0 +1,77 @@
+// Package redis is the Redis client shared by the middlewares that keep their state in Redis,
+// e.g. the token buckets of the rate limiter and the cache. It speaks the subset of the protocol
+// they need: status, error, integer and bulk string replies.
+package redis
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/vulcan/internal/connpool"
+)
+
+type Client struct {
+	pool *connpool.Pool
+}
+
+func NewClient(address string, maxIdleConns int, timeout time.Duration) *Client {
+	return &Client{pool: connpool.New(address, maxIdleConns, timeout)}
+}
+
+// Do sends the command and returns the reply: string, int64 or nil for the missing values.
+// Errors replied by Redis are connpool.ReplyError
+func (c *Client) Do(args ...string) (interface{}, error) {
+	var reply interface{}
+	err := c.pool.Do(func(conn *connpool.Conn) (err error) {
+		reply, err = do(conn, args...)
+		return err
+	})
+	return reply, err
+}
+
+// Close closes the idle connections to Redis
+func (c *Client) Close() {
+	c.pool.Close()
+}
+
+func do(c *connpool.Conn, args ...string) (interface{}, error) {
+	fmt.Fprintf(c.Writer, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.Writer, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := c.Writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	line, err := c.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("Empty Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, connpool.ReplyError("Redis error: " + line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.Reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	}
+	return nil, fmt.Errorf("Unsupported Redis reply: %s", line)
+}
@@ -0,0 +1,214 @@
+// Adaptive concurrency limiter that discovers the sustainable concurrency of the backends
+package adaptive
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// AdaptiveLimiter caps the concurrent requests to the backends and adjusts the cap using the latency gradient:
+// while the latency stays close to the no-load latency the limit grows, once the requests start queueing
+// on the backends and the latency increases, the limit shrinks. Failed requests decrease the limit
+// multiplicatively, the way AIMD does. Requests over the limit are rejected with 503 Service Unavailable.
+type AdaptiveLimiter struct {
+	mutex    *sync.Mutex
+	options  Options
+	limit    float64
+	inFlight int
+	// Minimum latency observed within the current window, estimates the no-load latency
+	minLatency time.Duration
+	windowEnd  time.Time
+	// Key of the request user data that marks requests admitted by this limiter
+	key string
+}
+
+type Options struct {
+	// Limit to start with
+	InitialLimit int
+	// Limit will never go below or above these values
+	MinLimit int
+	MaxLimit int
+	// How fast the limit follows the new estimates, in range (0, 1]
+	Smoothing float64
+	// Latency can grow by this factor over the no-load latency before the limit starts to shrink
+	Tolerance float64
+	// Extra requests allowed on top of the estimated limit, lets the limit grow while the latency is stable
+	QueueSize int
+	// Limit is multiplied by this ratio after the failed request, in range (0, 1)
+	BackoffRatio float64
+	// How often is the no-load latency estimate reset, so the limiter adapts to the backends getting slower
+	LatencyWindow time.Duration
+	// Tells whether the attempt has failed, by default network errors and 503 responses
+	IsFailure func(request.Attempt) bool
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultInitialLimit  = 20
+	DefaultMinLimit      = 1
+	DefaultMaxLimit      = 1000
+	DefaultSmoothing     = 0.2
+	DefaultTolerance     = 1.5
+	DefaultQueueSize     = 4
+	DefaultBackoffRatio  = 0.9
+	DefaultLatencyWindow = time.Minute
+)
+
+func NewAdaptiveLimiter() (*AdaptiveLimiter, error) {
+	return NewAdaptiveLimiterWithOptions(Options{})
+}
+
+func NewAdaptiveLimiterWithOptions(o Options) (*AdaptiveLimiter, error) {
+	options, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	l := &AdaptiveLimiter{
+		mutex:   &sync.Mutex{},
+		options: options,
+		limit:   float64(options.InitialLimit),
+	}
+	l.key = fmt.Sprintf("adaptive.admitted.%p", l)
+	return l, nil
+}
+
+// GetLimit returns the current concurrency limit
+func (l *AdaptiveLimiter) GetLimit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int(l.limit)
+}
+
+func (l *AdaptiveLimiter) GetInFlight() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.inFlight
+}
+
+func (l *AdaptiveLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.inFlight >= int(l.limit) {
+		return netutils.NewTextResponse(
+			r.GetHttpRequest(),
+			http.StatusServiceUnavailable,
+			fmt.Sprintf("Concurrency limit reached: %d", int(l.limit))), nil
+	}
+	l.inFlight++
+	r.SetUserData(l.key, true)
+	return nil, nil
+}
+
+func (l *AdaptiveLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	// Rejected requests are unwound as well, they should not affect the limit
+	if _, ok := r.GetUserData(l.key); !ok {
+		return
+	}
+	r.DeleteUserData(l.key)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	inFlight := l.inFlight
+	l.inFlight--
+
+	if a == nil {
+		return
+	}
+	if l.options.IsFailure(a) {
+		l.setLimit(l.limit * l.options.BackoffRatio)
+		return
+	}
+	l.observeLatency(a.GetDuration(), inFlight)
+}
+
+func (l *AdaptiveLimiter) observeLatency(latency time.Duration, inFlight int) {
+	if latency <= 0 {
+		return
+	}
+	now := l.options.TimeProvider.UtcNow()
+	if l.minLatency == 0 || latency < l.minLatency || !now.Before(l.windowEnd) {
+		if !now.Before(l.windowEnd) {
+			l.windowEnd = now.Add(l.options.LatencyWindow)
+		}
+		l.minLatency = latency
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.options.Tolerance*float64(l.minLatency)/float64(latency)))
+	// Don't grow the limit when the traffic does not use it, we learn nothing about the backend in this case
+	if gradient == 1 && inFlight < int(l.limit)/2 {
+		return
+	}
+	estimate := l.limit*gradient + float64(l.options.QueueSize)
+	l.setLimit(l.limit*(1-l.options.Smoothing) + estimate*l.options.Smoothing)
+}
+
+func (l *AdaptiveLimiter) setLimit(limit float64) {
+	l.limit = math.Max(float64(l.options.MinLimit), math.Min(float64(l.options.MaxLimit), limit))
+}
+
+// IsFailure is the default failure predicate, network errors and 503 responses tell that the backend is overloaded
+func IsFailure(a request.Attempt) bool {
+	if a.GetError() != nil {
+		return true
+	}
+	return a.GetResponse() != nil && a.GetResponse().StatusCode == http.StatusServiceUnavailable
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.InitialLimit < 0 || o.MinLimit < 0 || o.MaxLimit < 0 || o.QueueSize < 0 || o.LatencyWindow < 0 {
+		return o, fmt.Errorf("Limiter settings can not be negative")
+	}
+	if o.Smoothing < 0 || o.Smoothing > 1 {
+		return o, fmt.Errorf("Smoothing should be in range (0, 1]")
+	}
+	if o.BackoffRatio < 0 || o.BackoffRatio >= 1 {
+		return o, fmt.Errorf("Backoff ratio should be in range (0, 1)")
+	}
+	if o.Tolerance != 0 && o.Tolerance < 1 {
+		return o, fmt.Errorf("Tolerance should be >= 1")
+	}
+	if o.MinLimit == 0 {
+		o.MinLimit = DefaultMinLimit
+	}
+	if o.MaxLimit == 0 {
+		o.MaxLimit = DefaultMaxLimit
+	}
+	if o.InitialLimit == 0 {
+		o.InitialLimit = int(math.Max(float64(o.MinLimit), math.Min(float64(o.MaxLimit), DefaultInitialLimit)))
+	}
+	if o.MinLimit > o.MaxLimit || o.InitialLimit < o.MinLimit || o.InitialLimit > o.MaxLimit {
+		return o, fmt.Errorf("Initial limit should be within [%d, %d]", o.MinLimit, o.MaxLimit)
+	}
+	if o.Smoothing == 0 {
+		o.Smoothing = DefaultSmoothing
+	}
+	if o.Tolerance == 0 {
+		o.Tolerance = DefaultTolerance
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = DefaultQueueSize
+	}
+	if o.BackoffRatio == 0 {
+		o.BackoffRatio = DefaultBackoffRatio
+	}
+	if o.LatencyWindow == 0 {
+		o.LatencyWindow = DefaultLatencyWindow
+	}
+	if o.IsFailure == nil {
+		o.IsFailure = IsFailure
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
@@ -0,0 +1,177 @@
+package adaptive
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestAdaptive(t *testing.T) { TestingT(t) }
+
+type AdaptiveSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&AdaptiveSuite{})
+
+func (s *AdaptiveSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *AdaptiveSuite) newLimiter(c *C, o Options) *AdaptiveLimiter {
+	o.TimeProvider = s.tm
+	l, err := NewAdaptiveLimiterWithOptions(o)
+	c.Assert(err, IsNil)
+	return l
+}
+
+func (s *AdaptiveSuite) TestRejectOverLimit(c *C) {
+	l := s.newLimiter(c, Options{InitialLimit: 2})
+
+	r1, r2, r3 := makeReq(1), makeReq(2), makeReq(3)
+	re, err := l.ProcessRequest(r1)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	re, err = l.ProcessRequest(r2)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	re, err = l.ProcessRequest(r3)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	// Rejected request is unwound without affecting the counters
+	l.ProcessResponse(r3, &request.BaseAttempt{Response: re})
+	c.Assert(l.GetInFlight(), Equals, 2)
+
+	l.ProcessResponse(r1, ok(10*time.Millisecond))
+	c.Assert(l.GetInFlight(), Equals, 1)
+	re, err = l.ProcessRequest(r3)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+// Limit grows while the latency stays at the no-load level and the traffic uses the limit
+func (s *AdaptiveSuite) TestGrowsWithStableLatency(c *C) {
+	l := s.newLimiter(c, Options{InitialLimit: 10})
+
+	for i := 0; i < 50; i++ {
+		s.saturate(c, l, 10*time.Millisecond)
+	}
+	c.Assert(l.GetLimit() > 10, Equals, true)
+}
+
+// Limit is not changed when the traffic does not use it
+func (s *AdaptiveSuite) TestAppLimited(c *C) {
+	l := s.newLimiter(c, Options{InitialLimit: 10})
+
+	for i := 0; i < 50; i++ {
+		r := makeReq(int64(i))
+		l.ProcessRequest(r)
+		l.ProcessResponse(r, ok(10*time.Millisecond))
+	}
+	c.Assert(l.GetLimit(), Equals, 10)
+}
+
+// Limit shrinks once the latency grows over the tolerance
+func (s *AdaptiveSuite) TestShrinksWithGrowingLatency(c *C) {
+	l := s.newLimiter(c, Options{InitialLimit: 100})
+
+	s.saturate(c, l, 10*time.Millisecond)
+	for i := 0; i < 50; i++ {
+		s.saturate(c, l, 100*time.Millisecond)
+	}
+	c.Assert(l.GetLimit() < 50, Equals, true)
+}
+
+func (s *AdaptiveSuite) TestFailuresBackOff(c *C) {
+	l := s.newLimiter(c, Options{InitialLimit: 100, BackoffRatio: 0.5})
+
+	r := makeReq(1)
+	l.ProcessRequest(r)
+	l.ProcessResponse(r, &request.BaseAttempt{Error: fmt.Errorf("connection refused")})
+	c.Assert(l.GetLimit(), Equals, 50)
+
+	r = makeReq(2)
+	l.ProcessRequest(r)
+	l.ProcessResponse(r, &request.BaseAttempt{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}})
+	c.Assert(l.GetLimit(), Equals, 25)
+}
+
+func (s *AdaptiveSuite) TestRespectsBounds(c *C) {
+	l := s.newLimiter(c, Options{InitialLimit: 4, MinLimit: 3, MaxLimit: 5, BackoffRatio: 0.1})
+
+	for i := 0; i < 50; i++ {
+		s.saturate(c, l, 10*time.Millisecond)
+	}
+	c.Assert(l.GetLimit(), Equals, 5)
+
+	r := makeReq(1)
+	l.ProcessRequest(r)
+	l.ProcessResponse(r, &request.BaseAttempt{Error: fmt.Errorf("connection refused")})
+	c.Assert(l.GetLimit(), Equals, 3)
+}
+
+// No-load latency estimate is reset after the window, so the limiter adapts to slower backends
+func (s *AdaptiveSuite) TestLatencyWindow(c *C) {
+	l := s.newLimiter(c, Options{InitialLimit: 10, LatencyWindow: time.Minute})
+
+	s.saturate(c, l, 10*time.Millisecond)
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	for i := 0; i < 50; i++ {
+		s.saturate(c, l, 100*time.Millisecond)
+	}
+	c.Assert(l.GetLimit() > 10, Equals, true)
+}
+
+func (s *AdaptiveSuite) TestBadOptions(c *C) {
+	testCases := []Options{
+		{InitialLimit: -1},
+		{Smoothing: 2},
+		{BackoffRatio: 1},
+		{Tolerance: 0.5},
+		{MinLimit: 10, MaxLimit: 5},
+		{InitialLimit: 10, MaxLimit: 5},
+	}
+	for _, o := range testCases {
+		_, err := NewAdaptiveLimiterWithOptions(o)
+		c.Assert(err, NotNil)
+	}
+
+	l, err := NewAdaptiveLimiterWithOptions(Options{MaxLimit: 5})
+	c.Assert(err, IsNil)
+	c.Assert(l.GetLimit(), Equals, 5)
+}
+
+// saturate sends as many concurrent requests as the limit allows and completes them with the given latency
+func (s *AdaptiveSuite) saturate(c *C, l *AdaptiveLimiter, latency time.Duration) {
+	var reqs []request.Request
+	for i := 0; ; i++ {
+		r := makeReq(int64(i))
+		re, err := l.ProcessRequest(r)
+		c.Assert(err, IsNil)
+		if re != nil {
+			break
+		}
+		reqs = append(reqs, r)
+	}
+	for _, r := range reqs {
+		l.ProcessResponse(r, ok(latency))
+	}
+}
+
+func ok(latency time.Duration) request.Attempt {
+	return &request.BaseAttempt{Response: &http.Response{StatusCode: http.StatusOK}, Duration: latency}
+}
+
+func makeReq(id int64) request.Request {
+	return request.NewBaseRequest(&http.Request{Header: http.Header{}}, id, nil)
+}
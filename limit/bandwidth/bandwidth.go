@@ -0,0 +1,183 @@
+// Bandwidth limiter that throttles the request and response bodies
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Rate is the allowed transfer rate
+type Rate struct {
+	// Average rate, 0 means no limit
+	BytesPerSecond int64
+	// Bytes that can be transferred at once, BytesPerSecond by default
+	Burst int64
+}
+
+// Rates limit the request uploads and the response downloads separately
+type Rates struct {
+	Upload   Rate
+	Download Rate
+}
+
+// BandwidthLimiter throttles the bodies by the key, e.g. per connection with limit.RequestToConnection
+// or per tenant with limit.MakeRequestToHeader, so the large transfers of one client do not starve the others.
+// Concurrent requests with the same key share the rate.
+//
+// Request bodies are buffered by the location before the middlewares are called, so the upload
+// limit applies to the transfer from the proxy to the endpoint.
+type BandwidthLimiter struct {
+	mapper  limit.TokenMapperFn
+	rates   Rates
+	options Options
+}
+
+type Options struct {
+	// Overall capacity (maximum simultaneously active keys) of the default memory backend
+	Capacity int
+	// Storage for the token buckets, in memory by default
+	Backend tokenbucket.Backend
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const DefaultCapacity = 65536
+
+func NewBandwidthLimiter(mapper limit.TokenMapperFn, rates Rates) (*BandwidthLimiter, error) {
+	return NewBandwidthLimiterWithOptions(mapper, rates, Options{})
+}
+
+func NewBandwidthLimiterWithOptions(mapper limit.TokenMapperFn, rates Rates, o Options) (*BandwidthLimiter, error) {
+	if mapper == nil {
+		return nil, fmt.Errorf("Provide mapper function")
+	}
+	var err error
+	if rates.Upload, err = parseRate(rates.Upload); err != nil {
+		return nil, err
+	}
+	if rates.Download, err = parseRate(rates.Download); err != nil {
+		return nil, err
+	}
+	if rates.Upload.BytesPerSecond == 0 && rates.Download.BytesPerSecond == 0 {
+		return nil, fmt.Errorf("Provide upload or download rate")
+	}
+	if o, err = parseOptions(o); err != nil {
+		return nil, err
+	}
+	return &BandwidthLimiter{mapper: mapper, rates: rates, options: o}, nil
+}
+
+func (bl *BandwidthLimiter) GetRates() Rates {
+	return bl.rates
+}
+
+func (bl *BandwidthLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	key, err := bl.mapper(r)
+	if err != nil {
+		return nil, err
+	}
+	r.SetUserData(keyKey, key)
+	req := r.GetHttpRequest()
+	if bl.rates.Upload.BytesPerSecond != 0 && req.Body != nil {
+		req.Body = bl.throttle(r.GetContext(), req.Body, "upload:"+key, bl.rates.Upload)
+	}
+	return nil, nil
+}
+
+func (bl *BandwidthLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// ModifyResponse throttles the response body
+func (bl *BandwidthLimiter) ModifyResponse(r request.Request, re *http.Response) error {
+	v, ok := r.GetUserData(keyKey)
+	if !ok || bl.rates.Download.BytesPerSecond == 0 || re.Body == nil {
+		return nil
+	}
+	re.Body = bl.throttle(r.GetContext(), re.Body, "download:"+v.(string), bl.rates.Download)
+	return nil
+}
+
+func (bl *BandwidthLimiter) throttle(ctx context.Context, body io.ReadCloser, key string, rate Rate) io.ReadCloser {
+	return &throttledBody{ReadCloser: body, limiter: bl, ctx: ctx, key: key, rate: rate}
+}
+
+// throttledBody reads at most Burst bytes at a time and waits until the bucket has the tokens for the bytes read
+type throttledBody struct {
+	io.ReadCloser
+	limiter *BandwidthLimiter
+	ctx     context.Context
+	key     string
+	rate    Rate
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.rate.Burst {
+		p = p[:b.rate.Burst]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.wait(int64(n)); werr != nil {
+			return 0, werr
+		}
+	}
+	return n, err
+}
+
+func (b *throttledBody) wait(amount int64) error {
+	rate := tokenbucket.Rate{Units: b.rate.BytesPerSecond, Period: time.Second}
+	for {
+		delay, err := b.limiter.options.Backend.Consume(b.key, amount, rate, b.rate.Burst)
+		if err != nil {
+			return err
+		}
+		if delay <= 0 {
+			return nil
+		}
+		select {
+		case <-b.limiter.options.TimeProvider.After(delay):
+		case <-b.ctx.Done():
+			return b.ctx.Err()
+		}
+	}
+}
+
+func parseRate(r Rate) (Rate, error) {
+	if r.BytesPerSecond < 0 || r.Burst < 0 {
+		return r, fmt.Errorf("Rate can not be negative")
+	}
+	// Token bucket refills one token at a time, so the rate is limited by the clock resolution
+	if r.BytesPerSecond > int64(time.Second) {
+		return r, fmt.Errorf("Rate can not exceed %d bytes per second", int64(time.Second))
+	}
+	if r.Burst == 0 {
+		r.Burst = r.BytesPerSecond
+	}
+	return r, nil
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Capacity <= 0 {
+		o.Capacity = DefaultCapacity
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	if o.Backend == nil {
+		backend, err := tokenbucket.NewMemoryBackend(o.Capacity, o.TimeProvider)
+		if err != nil {
+			return o, err
+		}
+		o.Backend = backend
+	}
+	return o, nil
+}
+
+const keyKey = "__bandwidth.key"
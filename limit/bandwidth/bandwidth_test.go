@@ -0,0 +1,143 @@
+package bandwidth
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestBandwidth(t *testing.T) { TestingT(t) }
+
+type BandwidthSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&BandwidthSuite{})
+
+func (s *BandwidthSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *BandwidthSuite) newLimiter(c *C, rates Rates) *BandwidthLimiter {
+	bl, err := NewBandwidthLimiterWithOptions(limit.RequestToConnection, rates, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	return bl
+}
+
+func (s *BandwidthSuite) TestDownload(c *C) {
+	bl := s.newLimiter(c, Rates{Download: Rate{BytesPerSecond: 10}})
+
+	r := makeRequest("1.2.3.4:5678", "")
+	re, err := bl.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	body := strings.Repeat("a", 35)
+	re = netutils.NewTextResponse(r.GetHttpRequest(), http.StatusOK, body)
+	c.Assert(bl.ModifyResponse(r, re), IsNil)
+
+	start := s.tm.UtcNow()
+	out, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, body)
+	// First 10 bytes are the burst, the rest is sent at 10 bytes per second
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, 2500*time.Millisecond)
+}
+
+func (s *BandwidthSuite) TestUpload(c *C) {
+	bl := s.newLimiter(c, Rates{Upload: Rate{BytesPerSecond: 10, Burst: 20}})
+
+	body := strings.Repeat("a", 40)
+	r := makeRequest("1.2.3.4:5678", body)
+	_, err := bl.ProcessRequest(r)
+	c.Assert(err, IsNil)
+
+	start := s.tm.UtcNow()
+	out, err := ioutil.ReadAll(r.GetHttpRequest().Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, body)
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, 2*time.Second)
+}
+
+func (s *BandwidthSuite) TestKeysShareRate(c *C) {
+	bl := s.newLimiter(c, Rates{Download: Rate{BytesPerSecond: 10}})
+
+	read := func(remoteAddr string) time.Duration {
+		r := makeRequest(remoteAddr, "")
+		_, err := bl.ProcessRequest(r)
+		c.Assert(err, IsNil)
+		re := netutils.NewTextResponse(r.GetHttpRequest(), http.StatusOK, strings.Repeat("a", 10))
+		c.Assert(bl.ModifyResponse(r, re), IsNil)
+		start := s.tm.UtcNow()
+		_, err = ioutil.ReadAll(re.Body)
+		c.Assert(err, IsNil)
+		return s.tm.UtcNow().Sub(start)
+	}
+	c.Assert(read("1.2.3.4:5678"), Equals, time.Duration(0))
+	// Same connection has used up the burst
+	c.Assert(read("1.2.3.4:5678"), Equals, time.Second)
+	// Other connections have their own rate
+	c.Assert(read("1.2.3.4:9999"), Equals, time.Duration(0))
+}
+
+func (s *BandwidthSuite) TestClientGone(c *C) {
+	bl, err := NewBandwidthLimiter(limit.RequestToConnection, Rates{Download: Rate{BytesPerSecond: 1}})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4:5678", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	r.SetContext(ctx)
+	_, err = bl.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	re := netutils.NewTextResponse(r.GetHttpRequest(), http.StatusOK, "hello")
+	c.Assert(bl.ModifyResponse(r, re), IsNil)
+
+	cancel()
+	_, err = ioutil.ReadAll(re.Body)
+	c.Assert(err, Equals, context.Canceled)
+}
+
+func (s *BandwidthSuite) TestMapperError(c *C) {
+	bl := s.newLimiter(c, Rates{Download: Rate{BytesPerSecond: 10}})
+	_, err := bl.ProcessRequest(makeRequest("", ""))
+	c.Assert(err, NotNil)
+}
+
+func (s *BandwidthSuite) TestBadParams(c *C) {
+	_, err := NewBandwidthLimiter(nil, Rates{Download: Rate{BytesPerSecond: 10}})
+	c.Assert(err, NotNil)
+
+	bad := []Rates{
+		{},
+		{Download: Rate{BytesPerSecond: -1}},
+		{Upload: Rate{BytesPerSecond: 10, Burst: -1}},
+		{Upload: Rate{BytesPerSecond: 2 * int64(time.Second)}},
+	}
+	for _, rates := range bad {
+		_, err := NewBandwidthLimiter(limit.RequestToConnection, rates)
+		c.Assert(err, NotNil)
+	}
+}
+
+func makeRequest(remoteAddr, body string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     "POST",
+		Host:       "localhost",
+		RemoteAddr: remoteAddr,
+		URL:        netutils.MustParseUrl("http://localhost/a"),
+		RequestURI: "/a",
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, 1, nil)
+}
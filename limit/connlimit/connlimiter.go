@@ -3,12 +3,14 @@ package connlimit
 
 import (
 	"fmt"
+	"github.com/mailgun/timetools"
 	"github.com/mailgun/vulcan/errors"
 	"github.com/mailgun/vulcan/limit"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // This limiter tracks concurrent connection per token
@@ -19,24 +21,52 @@ type ConnectionLimiter struct {
 	connections      map[string]int64
 	maxConnections   int64
 	totalConnections int64
+	options          Options
+	// Requests waiting for the connection per token
+	queued map[string]int64
+	// Closed and replaced each time the connection is released to wake up the queued requests
+	released chan struct{}
 }
 
+type Options struct {
+	// How many requests per token can wait for the connection to be released
+	// instead of being rejected right away, 0 means no queueing
+	MaxQueued int64
+	// How long the queued request waits before it's rejected
+	QueueTimeout time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const DefaultQueueTimeout = 10 * time.Second
+
 func NewClientIpLimiter(maxConnections int64) (*ConnectionLimiter, error) {
 	return NewConnectionLimiter(limit.MapClientIp, maxConnections)
 }
 
 func NewConnectionLimiter(mapper limit.MapperFn, maxConnections int64) (*ConnectionLimiter, error) {
+	return NewConnectionLimiterWithOptions(mapper, maxConnections, Options{})
+}
+
+func NewConnectionLimiterWithOptions(mapper limit.MapperFn, maxConnections int64, o Options) (*ConnectionLimiter, error) {
 	if mapper == nil {
 		return nil, fmt.Errorf("Mapper function can not be nil")
 	}
 	if maxConnections <= 0 {
 		return nil, fmt.Errorf("Max connections should be >= 0")
 	}
+	options, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
 	return &ConnectionLimiter{
 		mutex:          &sync.Mutex{},
 		mapper:         mapper,
 		maxConnections: maxConnections,
 		connections:    make(map[string]int64),
+		options:        options,
+		queued:         make(map[string]int64),
+		released:       make(chan struct{}),
 	}, nil
 }
 
@@ -50,11 +80,11 @@ func (cl *ConnectionLimiter) ProcessRequest(r request.Request) (*http.Response,
 	}
 
 	connections := cl.connections[token]
-	if connections >= cl.maxConnections {
+	if connections >= cl.maxConnections && !cl.wait(r, token) {
 		return netutils.NewTextResponse(
 			r.GetHttpRequest(),
 			errors.StatusTooManyRequests,
-			fmt.Sprintf("Connection limit reached. Max is: %d, yours: %d", cl.maxConnections, connections)), nil
+			fmt.Sprintf("Connection limit reached. Max is: %d, yours: %d", cl.maxConnections, cl.connections[token])), nil
 	}
 
 	cl.connections[token] += amount
@@ -62,6 +92,38 @@ func (cl *ConnectionLimiter) ProcessRequest(r request.Request) (*http.Response,
 	return nil, nil
 }
 
+// wait queues the request until the connection for the token is released, returns false if the
+// queue is full, the request has waited too long or the client has gone away. Should be called under lock.
+func (cl *ConnectionLimiter) wait(r request.Request, token string) bool {
+	if cl.queued[token] >= cl.options.MaxQueued {
+		return false
+	}
+	cl.queued[token] += 1
+	defer func() {
+		cl.queued[token] -= 1
+		if cl.queued[token] == 0 {
+			delete(cl.queued, token)
+		}
+	}()
+
+	timeout := cl.options.TimeProvider.After(cl.options.QueueTimeout)
+	for cl.connections[token] >= cl.maxConnections {
+		released := cl.released
+		cl.mutex.Unlock()
+		select {
+		case <-released:
+			cl.mutex.Lock()
+		case <-timeout:
+			cl.mutex.Lock()
+			return false
+		case <-r.GetContext().Done():
+			cl.mutex.Lock()
+			return false
+		}
+	}
+	return true
+}
+
 func (cl *ConnectionLimiter) ProcessResponse(r request.Request, a request.Attempt) {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
@@ -73,6 +135,11 @@ func (cl *ConnectionLimiter) ProcessResponse(r request.Request, a request.Attemp
 	cl.connections[token] -= amount
 	cl.totalConnections -= int64(amount)
 
+	if cl.queued[token] > 0 {
+		close(cl.released)
+		cl.released = make(chan struct{})
+	}
+
 	// Otherwise it would grow forever
 	if cl.connections[token] == 0 {
 		delete(cl.connections, token)
@@ -92,3 +159,28 @@ func (cl *ConnectionLimiter) GetMaxConnections() int64 {
 func (cl *ConnectionLimiter) SetMaxConnections(max int64) {
 	cl.maxConnections = max
 }
+
+// GetQueuedCount returns the amount of requests waiting for the connection
+func (cl *ConnectionLimiter) GetQueuedCount() int64 {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	queued := int64(0)
+	for _, q := range cl.queued {
+		queued += q
+	}
+	return queued
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MaxQueued < 0 || o.QueueTimeout < 0 {
+		return o, fmt.Errorf("Queue settings can not be negative")
+	}
+	if o.QueueTimeout == 0 {
+		o.QueueTimeout = DefaultQueueTimeout
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
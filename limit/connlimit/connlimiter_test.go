@@ -1,9 +1,12 @@
 package connlimit
 
 import (
+	"context"
 	"net/http"
 	"testing"
+	"time"
 
+	. "github.com/mailgun/vulcan/limit"
 	"github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
 )
@@ -113,6 +116,95 @@ func (s *ConnLimiterSuite) TestWrongParams(c *C) {
 	c.Assert(err, NotNil)
 }
 
+// Queued request proceeds once the connection is released
+func (s *ConnLimiterSuite) TestQueueRelease(c *C) {
+	l, err := NewConnectionLimiterWithOptions(MapClientIp, 1, Options{MaxQueued: 1, QueueTimeout: 10 * time.Second})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4")
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	done := make(chan *http.Response)
+	go func() {
+		re, _ := l.ProcessRequest(r)
+		done <- re
+	}()
+
+	for l.GetQueuedCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	l.ProcessResponse(r, nil)
+	c.Assert(<-done, IsNil)
+	c.Assert(l.GetQueuedCount(), Equals, int64(0))
+	c.Assert(l.GetConnectionCount(), Equals, int64(1))
+}
+
+// Queued request is rejected after the timeout
+func (s *ConnLimiterSuite) TestQueueTimeout(c *C) {
+	l, err := NewConnectionLimiterWithOptions(MapClientIp, 1, Options{MaxQueued: 1, QueueTimeout: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4")
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+
+	re, err = l.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(l.GetQueuedCount(), Equals, int64(0))
+}
+
+// Requests over the queue size are rejected right away
+func (s *ConnLimiterSuite) TestQueueFull(c *C) {
+	l, err := NewConnectionLimiterWithOptions(MapClientIp, 1, Options{MaxQueued: 1, QueueTimeout: 10 * time.Second})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4")
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+
+	done := make(chan *http.Response)
+	go func() {
+		re, _ := l.ProcessRequest(r)
+		done <- re
+	}()
+	for l.GetQueuedCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	re, err = l.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+
+	l.ProcessResponse(r, nil)
+	c.Assert(<-done, IsNil)
+}
+
+// Queued request gives up once the client goes away
+func (s *ConnLimiterSuite) TestQueueCanceled(c *C) {
+	l, err := NewConnectionLimiterWithOptions(MapClientIp, 1, Options{MaxQueued: 1, QueueTimeout: 10 * time.Second})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := makeRequest("1.2.3.4")
+	r.SetContext(ctx)
+	cancel()
+
+	re, err = l.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+}
+
+func (s *ConnLimiterSuite) TestWrongOptions(c *C) {
+	_, err := NewConnectionLimiterWithOptions(MapClientIp, 1, Options{MaxQueued: -1})
+	c.Assert(err, NotNil)
+}
+
 func makeRequest(ip string) request.Request {
 	return &request.BaseRequest{
 		HttpRequest: &http.Request{
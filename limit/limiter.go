@@ -42,6 +42,11 @@ func MapRequestHost(req request.Request) (string, int64, error) {
 	return t, 1, err
 }
 
+func MapRequestPath(req request.Request) (string, int64, error) {
+	t, err := RequestToPath(req)
+	return t, 1, err
+}
+
 func MakeMapRequestHeader(header string) MapperFn {
 	return MakeMapper(MakeRequestToHeader(header), RequestToCount)
 }
@@ -69,13 +74,23 @@ func MakeMapper(t TokenMapperFn, a AmountMapperFn) MapperFn {
 	}
 }
 
-// RequestToClientIp is a TokenMapper that maps the request to the client IP.
+// RequestToClientIp is a TokenMapper that maps the request to the client IP, see Request.GetClientIP,
+// so the clients behind the trusted proxies get the limits of their own.
 func RequestToClientIp(req request.Request) (string, error) {
-	vals := strings.SplitN(req.GetHttpRequest().RemoteAddr, ":", 2)
-	if len(vals[0]) == 0 {
+	ip := req.GetClientIP()
+	if ip == nil {
 		return "", fmt.Errorf("Failed to parse client IP")
 	}
-	return vals[0], nil
+	return ip.String(), nil
+}
+
+// RequestToConnection maps request to the client connection (ip:port), so the limits apply per connection
+func RequestToConnection(req request.Request) (string, error) {
+	addr := req.GetHttpRequest().RemoteAddr
+	if addr == "" {
+		return "", fmt.Errorf("Missing client address")
+	}
+	return addr, nil
 }
 
 // RequestToHost maps request to the host value
@@ -83,6 +98,11 @@ func RequestToHost(req request.Request) (string, error) {
 	return req.GetHttpRequest().Host, nil
 }
 
+// RequestToPath maps request to the URL path
+func RequestToPath(req request.Request) (string, error) {
+	return req.GetHttpRequest().URL.Path, nil
+}
+
 // RequestToCount maps request to the amount of requests (essentially one)
 func RequestToCount(req request.Request) (int64, error) {
 	return 1, nil
@@ -100,14 +120,32 @@ func MakeRequestToHeader(header string) TokenMapperFn {
 	}
 }
 
+// MakeRequestToUserData creates a TokenMapper that maps the request to the user data value set by previous
+// middlewares, e.g. the identity attached by the auth middleware. Requests without the value are rejected.
+func MakeRequestToUserData(key string) TokenMapperFn {
+	return func(req request.Request) (string, error) {
+		v, ok := req.GetUserData(key)
+		if !ok {
+			return "", fmt.Errorf("Missing user data: %s", key)
+		}
+		return fmt.Sprint(v), nil
+	}
+}
+
 // Converts varaiable string to a mapper function used in limiters
 func MakeTokenMapperFromVariable(variable string) (TokenMapperFn, error) {
 	if variable == "client.ip" {
 		return RequestToClientIp, nil
 	}
+	if variable == "client.connection" {
+		return RequestToConnection, nil
+	}
 	if variable == "request.host" {
 		return RequestToHost, nil
 	}
+	if variable == "request.path" {
+		return RequestToPath, nil
+	}
 	if strings.HasPrefix(variable, "request.header.") {
 		header := strings.TrimPrefix(variable, "request.header.")
 		if len(header) == 0 {
@@ -115,5 +153,12 @@ func MakeTokenMapperFromVariable(variable string) (TokenMapperFn, error) {
 		}
 		return MakeRequestToHeader(header), nil
 	}
+	if strings.HasPrefix(variable, "request.user_data.") {
+		key := strings.TrimPrefix(variable, "request.user_data.")
+		if len(key) == 0 {
+			return nil, fmt.Errorf("Wrong user data key: %s", key)
+		}
+		return MakeRequestToUserData(key), nil
+	}
 	return nil, fmt.Errorf("Unsupported limiting variable: '%s'", variable)
 }
@@ -1,8 +1,12 @@
 package limit
 
 import (
-	. "gopkg.in/check.v1"
+	"net/http"
 	"testing"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
 )
 
 func TestLimit(t *testing.T) { TestingT(t) }
@@ -17,15 +21,80 @@ func (s *LimitSuite) TestVariableToMapper(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(m, NotNil)
 
+	m, err = VariableToMapper("client.connection")
+	c.Assert(err, IsNil)
+	c.Assert(m, NotNil)
+
 	m, err = VariableToMapper("request.host")
 	c.Assert(err, IsNil)
 	c.Assert(m, NotNil)
 
+	m, err = VariableToMapper("request.path")
+	c.Assert(err, IsNil)
+	c.Assert(m, NotNil)
+
 	m, err = VariableToMapper("request.header.X-Header-Name")
 	c.Assert(err, IsNil)
 	c.Assert(m, NotNil)
 
+	m, err = VariableToMapper("request.user_data.identity")
+	c.Assert(err, IsNil)
+	c.Assert(m, NotNil)
+
+	m, err = VariableToMapper("request.user_data.")
+	c.Assert(err, NotNil)
+	c.Assert(m, IsNil)
+
 	m, err = VariableToMapper("rsom")
 	c.Assert(err, NotNil)
 	c.Assert(m, IsNil)
 }
+
+func (s *LimitSuite) TestRequestToUserData(c *C) {
+	mapper := MakeRequestToUserData("identity")
+
+	r := request.NewBaseRequest(&http.Request{}, 1, nil)
+	_, err := mapper(r)
+	c.Assert(err, NotNil)
+
+	r.SetUserData("identity", "alice")
+	token, err := mapper(r)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "alice")
+}
+
+func (s *LimitSuite) TestRequestToConnection(c *C) {
+	r := request.NewBaseRequest(&http.Request{}, 1, nil)
+	_, err := RequestToConnection(r)
+	c.Assert(err, NotNil)
+
+	r = request.NewBaseRequest(&http.Request{RemoteAddr: "1.2.3.4:5678"}, 1, nil)
+	token, err := RequestToConnection(r)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "1.2.3.4:5678")
+}
+
+func (s *LimitSuite) TestRequestToClientIp(c *C) {
+	r := request.NewBaseRequest(&http.Request{}, 1, nil)
+	_, err := RequestToClientIp(r)
+	c.Assert(err, NotNil)
+
+	r = request.NewBaseRequest(&http.Request{RemoteAddr: "1.2.3.4:5678"}, 1, nil)
+	token, err := RequestToClientIp(r)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "1.2.3.4")
+
+	r = request.NewBaseRequest(&http.Request{RemoteAddr: "[2001:db8::1]:5678"}, 1, nil)
+	token, err = RequestToClientIp(r)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "2001:db8::1")
+
+	// Clients behind the trusted proxy are told apart by X-Forwarded-For
+	trusted, err := netutils.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+	r = request.NewBaseRequest(&http.Request{RemoteAddr: "10.0.0.1:5678", Header: http.Header{"X-Forwarded-For": {"1.2.3.4"}}}, 1, nil)
+	r.TrustedProxies = trusted
+	token, err = RequestToClientIp(r)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "1.2.3.4")
+}
@@ -0,0 +1,162 @@
+// Sliding window log request rate limiter
+package slidingwindow
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// WindowLimiter allows at most Limit tokens per key consumed in any window of the given size,
+// e.g. 100 requests in the last 60 seconds. Unlike the token bucket it does not allow bursts,
+// at the cost of keeping the log of the recent requests for each key.
+type WindowLimiter struct {
+	mutex   *sync.Mutex
+	windows *ttlmap.TtlMap
+	mapper  limit.MapperFn
+	limit   int64
+	window  time.Duration
+	options Options
+}
+
+type Options struct {
+	Capacity     int // Overall capacity (maximum sumultaneuously active tokens)
+	TimeProvider timetools.TimeProvider
+}
+
+const DefaultCapacity = 65536
+
+func NewWindowLimiter(mapper limit.MapperFn, limit int64, window time.Duration) (*WindowLimiter, error) {
+	return NewWindowLimiterWithOptions(mapper, limit, window, Options{})
+}
+
+func NewWindowLimiterWithOptions(mapper limit.MapperFn, limit int64, window time.Duration, o Options) (*WindowLimiter, error) {
+	if mapper == nil {
+		return nil, fmt.Errorf("Provide mapper function")
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("Limit should be > 0")
+	}
+	if window < time.Second {
+		return nil, fmt.Errorf("Window should be at least a second")
+	}
+	options, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	windows, err := ttlmap.NewMapWithProvider(options.Capacity, options.TimeProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &WindowLimiter{
+		mutex:   &sync.Mutex{},
+		windows: windows,
+		mapper:  mapper,
+		limit:   limit,
+		window:  window,
+		options: options,
+	}, nil
+}
+
+func (wl *WindowLimiter) GetLimit() int64 {
+	return wl.limit
+}
+
+func (wl *WindowLimiter) GetWindow() time.Duration {
+	return wl.window
+}
+
+func (wl *WindowLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	wl.mutex.Lock()
+	defer wl.mutex.Unlock()
+
+	token, amount, err := wl.mapper(r)
+	if err != nil {
+		return nil, err
+	}
+
+	windowI, exists := wl.windows.Get(token)
+	if !exists {
+		windowI = &window{}
+	}
+	w := windowI.(*window)
+	delay, err := w.consume(wl.options.TimeProvider.UtcNow(), wl.window, wl.limit, amount)
+	if err != nil {
+		return nil, err
+	}
+	// Log expires once the last entry leaves the window
+	wl.windows.Set(token, w, int(wl.window/time.Second)+1)
+
+	if delay > 0 {
+		re := netutils.NewTextResponse(r.GetHttpRequest(), errors.StatusTooManyRequests, "Too many requests")
+		re.Header.Set("Retry-After", strconv.FormatInt(int64((delay+time.Second-1)/time.Second), 10))
+		return re, nil
+	}
+	return nil, nil
+}
+
+func (wl *WindowLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// window is the log of the amounts consumed within the window, ordered by time
+type window struct {
+	entries []entry
+	total   int64
+}
+
+type entry struct {
+	at     time.Time
+	amount int64
+}
+
+// consume records the amount and returns 0 if it fits the limit,
+// otherwise returns the time to wait until enough entries leave the window.
+func (w *window) consume(now time.Time, size time.Duration, limit, amount int64) (time.Duration, error) {
+	if amount > limit {
+		return -1, fmt.Errorf("Requested amount larger than the limit")
+	}
+	w.expire(now.Add(-size))
+
+	if w.total+amount <= limit {
+		w.entries = append(w.entries, entry{at: now, amount: amount})
+		w.total += amount
+		return 0, nil
+	}
+
+	missing := w.total + amount - limit
+	for _, e := range w.entries {
+		missing -= e.amount
+		if missing <= 0 {
+			return e.at.Add(size).Sub(now), nil
+		}
+	}
+	return size, nil
+}
+
+// expire drops the entries that were recorded before the start of the window
+func (w *window) expire(start time.Time) {
+	i := 0
+	for ; i < len(w.entries) && !w.entries[i].at.After(start); i++ {
+		w.total -= w.entries[i].amount
+	}
+	w.entries = w.entries[i:]
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Capacity <= 0 {
+		o.Capacity = DefaultCapacity
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
@@ -0,0 +1,142 @@
+package slidingwindow
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestWindow(t *testing.T) { TestingT(t) }
+
+type WindowSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&WindowSuite{})
+
+func (s *WindowSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *WindowSuite) TestHitLimit(c *C) {
+	l, err := NewWindowLimiterWithOptions(MapClientIp, 2, time.Minute, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(10 * time.Second)
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	// Third request within a minute is rejected until the first one leaves the window
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, 429)
+	c.Assert(re.Header.Get("Retry-After"), Equals, "50")
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(49 * time.Second)
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+// Unlike token bucket, the rejected requests do not count towards the limit
+func (s *WindowSuite) TestRejectedNotCounted(c *C) {
+	l, err := NewWindowLimiterWithOptions(MapClientIp, 1, time.Second, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	for i := 0; i < 3; i++ {
+		re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(err, IsNil)
+		c.Assert(re, NotNil)
+	}
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *WindowSuite) TestIsolation(c *C) {
+	l, err := NewWindowLimiterWithOptions(MapClientIp, 1, time.Second, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+
+	re, err = l.ProcessRequest(makeRequest("1.2.3.5"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *WindowSuite) TestAmounts(c *C) {
+	w := &window{}
+	now := s.tm.UtcNow()
+
+	delay, err := w.consume(now, 10*time.Second, 10, 6)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, time.Duration(0))
+
+	now = now.Add(2 * time.Second)
+	delay, err = w.consume(now, 10*time.Second, 10, 3)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, time.Duration(0))
+
+	// Needs the first entry to expire
+	delay, err = w.consume(now, 10*time.Second, 10, 2)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, 8*time.Second)
+
+	_, err = w.consume(now, 10*time.Second, 10, 11)
+	c.Assert(err, NotNil)
+}
+
+func (s *WindowSuite) TestFailure(c *C) {
+	l, err := NewWindowLimiterWithOptions(MapClientIp, 1, time.Second, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	_, err = l.ProcessRequest(makeRequest(""))
+	c.Assert(err, NotNil)
+}
+
+func (s *WindowSuite) TestInvalidParams(c *C) {
+	_, err := NewWindowLimiter(nil, 1, time.Second)
+	c.Assert(err, NotNil)
+
+	_, err = NewWindowLimiter(MapClientIp, 0, time.Second)
+	c.Assert(err, NotNil)
+
+	_, err = NewWindowLimiter(MapClientIp, 1, time.Millisecond)
+	c.Assert(err, NotNil)
+}
+
+func makeRequest(ip string) request.Request {
+	return &request.BaseRequest{
+		HttpRequest: &http.Request{
+			RemoteAddr: ip,
+		},
+	}
+}
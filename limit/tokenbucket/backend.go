@@ -0,0 +1,62 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+)
+
+// Backend stores the token buckets of the limiters. Limiters sharing the backend with
+// external storage, e.g. Redis, share the quotas across multiple proxy instances.
+type Backend interface {
+	// Consume takes the amount of tokens from the bucket identified by the key and returns 0 if there
+	// were enough tokens, otherwise returns the time to wait until the bucket is refilled.
+	Consume(key string, amount int64, rate Rate, maxTokens int64) (time.Duration, error)
+}
+
+// MemoryBackend keeps the token buckets in memory of this process
+type MemoryBackend struct {
+	mutex        *sync.Mutex
+	buckets      *ttlmap.TtlMap
+	timeProvider timetools.TimeProvider
+}
+
+func NewMemoryBackend(capacity int, timeProvider timetools.TimeProvider) (*MemoryBackend, error) {
+	if timeProvider == nil {
+		return nil, fmt.Errorf("Supply time provider")
+	}
+	buckets, err := ttlmap.NewMapWithProvider(capacity, timeProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryBackend{
+		mutex:        &sync.Mutex{},
+		buckets:      buckets,
+		timeProvider: timeProvider,
+	}, nil
+}
+
+func (m *MemoryBackend) Consume(key string, amount int64, rate Rate, maxTokens int64) (time.Duration, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	bucketI, exists := m.buckets.Get(key)
+	if !exists {
+		b, err := NewTokenBucket(rate, maxTokens, m.timeProvider)
+		if err != nil {
+			return -1, err
+		}
+		bucketI = b
+		m.buckets.Set(key, bucketI, bucketTtlSeconds(rate))
+	}
+	return bucketI.(*TokenBucket).Consume(amount)
+}
+
+// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
+// the counters for this ip will expire after 10 seconds of inactivity
+func bucketTtlSeconds(rate Rate) int {
+	return int(rate.Period/time.Second)*10 + 1
+}
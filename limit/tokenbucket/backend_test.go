@@ -0,0 +1,70 @@
+package tokenbucket
+
+import (
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "github.com/mailgun/vulcan/limit"
+	. "gopkg.in/check.v1"
+)
+
+type BackendSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&BackendSuite{})
+
+func (s *BackendSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *BackendSuite) TestMemoryConsume(c *C) {
+	b, err := NewMemoryBackend(DefaultCapacity, s.tm)
+	c.Assert(err, IsNil)
+
+	rate := Rate{Units: 1, Period: time.Second}
+	delay, err := b.Consume("a", 1, rate, 1)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, time.Duration(0))
+
+	delay, err = b.Consume("a", 1, rate, 1)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, time.Second)
+
+	// Other keys have their own buckets
+	delay, err = b.Consume("b", 1, rate, 1)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, time.Duration(0))
+}
+
+func (s *BackendSuite) TestMemoryBadParams(c *C) {
+	_, err := NewMemoryBackend(DefaultCapacity, nil)
+	c.Assert(err, NotNil)
+
+	b, err := NewMemoryBackend(DefaultCapacity, s.tm)
+	c.Assert(err, IsNil)
+	_, err = b.Consume("a", 1, Rate{}, 1)
+	c.Assert(err, NotNil)
+}
+
+// Limiters sharing the backend share the quota
+func (s *BackendSuite) TestSharedBackend(c *C) {
+	b, err := NewMemoryBackend(DefaultCapacity, s.tm)
+	c.Assert(err, IsNil)
+
+	rate := Rate{Units: 1, Period: time.Second}
+	l1, err := NewTokenLimiterWithOptions(MapClientIp, rate, Options{TimeProvider: s.tm, Backend: b})
+	c.Assert(err, IsNil)
+	l2, err := NewTokenLimiterWithOptions(MapClientIp, rate, Options{TimeProvider: s.tm, Backend: b})
+	c.Assert(err, IsNil)
+
+	re, err := l1.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	re, err = l2.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+}
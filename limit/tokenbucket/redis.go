@@ -0,0 +1,141 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/timetools"
+
+	"github.com/mailgun/vulcan/internal/redis"
+)
+
+// RedisBackend keeps the token buckets in Redis, so multiple proxy instances share
+// the quotas for the same tokens. Buckets are refilled atomically by a Lua script,
+// using the time of the proxy instances, so their clocks should be in sync.
+type RedisBackend struct {
+	options RedisOptions
+	client  *redis.Client
+}
+
+type RedisOptions struct {
+	// Prefix for the bucket keys, helps to share Redis with other applications
+	KeyPrefix string
+	// Maximum amount of idle connections kept open to Redis
+	MaxIdleConns int
+	// Timeout for connecting and for the individual commands
+	Timeout time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultRedisKeyPrefix    = "vulcan:tb:"
+	DefaultRedisMaxIdleConns = 16
+	DefaultRedisTimeout      = time.Second
+)
+
+func NewRedisBackend(address string) (*RedisBackend, error) {
+	return NewRedisBackendWithOptions(address, RedisOptions{})
+}
+
+func NewRedisBackendWithOptions(address string, o RedisOptions) (*RedisBackend, error) {
+	if address == "" {
+		return nil, fmt.Errorf("Provide Redis address")
+	}
+	o, err := parseRedisOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisBackend{
+		options: o,
+		client:  redis.NewClient(address, o.MaxIdleConns, o.Timeout),
+	}, nil
+}
+
+// Refills the bucket and consumes the tokens, returns the time to wait in microseconds,
+// or -1 if requested tokens exceed the bucket size.
+const consumeScript = `
+local refill = tonumber(ARGV[1])
+local max = tonumber(ARGV[2])
+local amount = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local ttl = tonumber(ARGV[5])
+if amount > max then
+  return -1
+end
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1])
+local ts = tonumber(b[2])
+if tokens == nil or ts == nil then
+  tokens = max
+  ts = now
+end
+local added = math.floor((now - ts) / refill)
+if added > 0 then
+  tokens = math.min(max, tokens + added)
+  ts = now
+end
+local delay = 0
+if tokens < amount then
+  delay = (amount - tokens) * refill
+else
+  tokens = tokens - amount
+end
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", ts)
+redis.call("EXPIRE", KEYS[1], ttl)
+return delay
+`
+
+func (r *RedisBackend) Consume(key string, amount int64, rate Rate, maxTokens int64) (time.Duration, error) {
+	if rate.Period == 0 || rate.Units == 0 {
+		return -1, fmt.Errorf("Invalid rate: %v", rate)
+	}
+	refill := int64(rate.Period/time.Microsecond) / rate.Units
+	if refill <= 0 {
+		return -1, fmt.Errorf("Rate is too high: %v", rate)
+	}
+	now := r.options.TimeProvider.UtcNow().UnixNano() / int64(time.Microsecond)
+
+	reply, err := r.client.Do("EVAL", consumeScript, "1", r.options.KeyPrefix+key,
+		strconv.FormatInt(refill, 10),
+		strconv.FormatInt(maxTokens, 10),
+		strconv.FormatInt(amount, 10),
+		strconv.FormatInt(now, 10),
+		strconv.Itoa(bucketTtlSeconds(rate)))
+	if err != nil {
+		return -1, err
+	}
+	delay, ok := reply.(int64)
+	if !ok {
+		return -1, fmt.Errorf("Unexpected Redis reply: %v", reply)
+	}
+	if delay < 0 {
+		return -1, fmt.Errorf("Requested tokens larger than max tokens")
+	}
+	return time.Duration(delay) * time.Microsecond, nil
+}
+
+// Close closes the idle connections to Redis
+func (r *RedisBackend) Close() {
+	r.client.Close()
+}
+
+func parseRedisOptions(o RedisOptions) (RedisOptions, error) {
+	if o.MaxIdleConns < 0 || o.Timeout < 0 {
+		return o, fmt.Errorf("Redis options can not be negative")
+	}
+	if o.KeyPrefix == "" {
+		o.KeyPrefix = DefaultRedisKeyPrefix
+	}
+	if o.MaxIdleConns == 0 {
+		o.MaxIdleConns = DefaultRedisMaxIdleConns
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultRedisTimeout
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
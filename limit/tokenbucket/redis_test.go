@@ -0,0 +1,169 @@
+package tokenbucket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/internal/connpool"
+	. "gopkg.in/check.v1"
+)
+
+type RedisSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&RedisSuite{})
+
+func (s *RedisSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *RedisSuite) TestConsume(c *C) {
+	var commands [][]string
+	server := newFakeRedis(c, func(args []string) string {
+		commands = append(commands, args)
+		return ":0\r\n"
+	})
+	defer server.Close()
+
+	b, err := NewRedisBackendWithOptions(server.Addr().String(), RedisOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	delay, err := b.Consume("1.2.3.4", 1, Rate{Units: 2, Period: time.Second}, 3)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, time.Duration(0))
+
+	c.Assert(len(commands), Equals, 1)
+	args := commands[0]
+	c.Assert(args[0], Equals, "EVAL")
+	c.Assert(args[2], Equals, "1")
+	c.Assert(args[3], Equals, "vulcan:tb:1.2.3.4")
+	c.Assert(args[4], Equals, "500000")
+	c.Assert(args[5], Equals, "3")
+	c.Assert(args[6], Equals, "1")
+	c.Assert(args[7], Equals, strconv.FormatInt(s.tm.UtcNow().UnixNano()/1000, 10))
+	c.Assert(args[8], Equals, "11")
+}
+
+func (s *RedisSuite) TestDelay(c *C) {
+	server := newFakeRedis(c, func(args []string) string {
+		return ":1500000\r\n"
+	})
+	defer server.Close()
+
+	b, err := NewRedisBackendWithOptions(server.Addr().String(), RedisOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	// Connection is reused for the subsequent commands
+	for i := 0; i < 3; i++ {
+		delay, err := b.Consume("a", 1, Rate{Units: 1, Period: time.Second}, 1)
+		c.Assert(err, IsNil)
+		c.Assert(delay, Equals, 1500*time.Millisecond)
+	}
+}
+
+func (s *RedisSuite) TestTooManyTokens(c *C) {
+	server := newFakeRedis(c, func(args []string) string {
+		return ":-1\r\n"
+	})
+	defer server.Close()
+
+	b, err := NewRedisBackend(server.Addr().String())
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	_, err = b.Consume("a", 10, Rate{Units: 1, Period: time.Second}, 1)
+	c.Assert(err, NotNil)
+}
+
+func (s *RedisSuite) TestErrorReply(c *C) {
+	server := newFakeRedis(c, func(args []string) string {
+		return "-ERR unknown command\r\n"
+	})
+	defer server.Close()
+
+	b, err := NewRedisBackend(server.Addr().String())
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	_, err = b.Consume("a", 1, Rate{Units: 1, Period: time.Second}, 1)
+	c.Assert(err, NotNil)
+	_, ok := err.(connpool.ReplyError)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RedisSuite) TestConnectionFailure(c *C) {
+	b, err := NewRedisBackendWithOptions("localhost:63999", RedisOptions{Timeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	_, err = b.Consume("a", 1, Rate{Units: 1, Period: time.Second}, 1)
+	c.Assert(err, NotNil)
+}
+
+func (s *RedisSuite) TestBadParams(c *C) {
+	_, err := NewRedisBackend("")
+	c.Assert(err, NotNil)
+
+	_, err = NewRedisBackendWithOptions("localhost:6379", RedisOptions{Timeout: -1})
+	c.Assert(err, NotNil)
+
+	b, err := NewRedisBackend("localhost:6379")
+	c.Assert(err, IsNil)
+	_, err = b.Consume("a", 1, Rate{}, 1)
+	c.Assert(err, NotNil)
+}
+
+// newFakeRedis starts the server that reads the commands and writes back the replies
+func newFakeRedis(c *C, reply func(args []string) string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, reply(args))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var count int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &count); err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
@@ -4,19 +4,16 @@ package tokenbucket
 import (
 	"fmt"
 	"github.com/mailgun/timetools"
-	"github.com/mailgun/ttlmap"
 	"github.com/mailgun/vulcan/errors"
 	"github.com/mailgun/vulcan/limit"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 )
 
 type TokenLimiter struct {
-	buckets *ttlmap.TtlMap
-	mutex   *sync.Mutex
 	options Options
 	mapper  limit.MapperFn
 	rate    Rate
@@ -25,8 +22,9 @@ type TokenLimiter struct {
 type Options struct {
 	Rate         Rate  // Average allowed rate
 	Burst        int64 // Burst size
-	Capacity     int   // Overall capacity (maximum sumultaneuously active tokens)
+	Capacity     int   // Overall capacity (maximum sumultaneuously active tokens) of the default memory backend
 	Mapper       limit.MapperFn
+	Backend      Backend // Storage for the token buckets, in memory by default
 	TimeProvider timetools.TimeProvider
 }
 
@@ -42,17 +40,11 @@ func NewTokenLimiterWithOptions(mapper limit.MapperFn, rate Rate, o Options) (*T
 	if err != nil {
 		return nil, err
 	}
-	buckets, err := ttlmap.NewMapWithProvider(options.Capacity, options.TimeProvider)
-	if err != nil {
-		return nil, err
-	}
 
 	return &TokenLimiter{
 		rate:    rate,
 		mapper:  mapper,
 		options: options,
-		mutex:   &sync.Mutex{},
-		buckets: buckets,
 	}, nil
 }
 
@@ -69,31 +61,19 @@ func (tl *TokenLimiter) GetCapacity() int {
 }
 
 func (tl *TokenLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
-
 	token, amount, err := tl.mapper(r)
 	if err != nil {
 		return nil, err
 	}
 
-	bucketI, exists := tl.buckets.Get(token)
-	if !exists {
-		bucketI, err = NewTokenBucket(tl.rate, tl.options.Burst+1, tl.options.TimeProvider)
-		if err != nil {
-			return nil, err
-		}
-		// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
-		// the counters for this ip will expire after 10 seconds of inactivity
-		tl.buckets.Set(token, bucketI, int(tl.rate.Period/time.Second)*10+1)
-	}
-	bucket := bucketI.(*TokenBucket)
-	delay, err := bucket.Consume(amount)
+	delay, err := tl.options.Backend.Consume(token, amount, tl.rate, tl.options.Burst+1)
 	if err != nil {
 		return nil, err
 	}
 	if delay > 0 {
-		return netutils.NewTextResponse(r.GetHttpRequest(), errors.StatusTooManyRequests, "Too many requests"), nil
+		re := netutils.NewTextResponse(r.GetHttpRequest(), errors.StatusTooManyRequests, "Too many requests")
+		re.Header.Set("Retry-After", strconv.FormatInt(retryAfter(delay), 10))
+		return re, nil
 	}
 	return nil, nil
 }
@@ -101,6 +81,15 @@ func (tl *TokenLimiter) ProcessRequest(r request.Request) (*http.Response, error
 func (tl *TokenLimiter) ProcessResponse(r request.Request, a request.Attempt) {
 }
 
+// retryAfter converts the delay to the seconds for Retry-After header, rounding up
+func retryAfter(delay time.Duration) int64 {
+	seconds := int64(delay / time.Second)
+	if delay%time.Second != 0 {
+		seconds++
+	}
+	return seconds
+}
+
 // Check arguments and initialize defaults
 func parseOptions(o Options) (Options, error) {
 	if o.Capacity <= 0 {
@@ -109,6 +98,13 @@ func parseOptions(o Options) (Options, error) {
 	if o.TimeProvider == nil {
 		o.TimeProvider = &timetools.RealTime{}
 	}
+	if o.Backend == nil {
+		backend, err := NewMemoryBackend(o.Capacity, o.TimeProvider)
+		if err != nil {
+			return o, err
+		}
+		o.Backend = backend
+	}
 	return o, nil
 }
 
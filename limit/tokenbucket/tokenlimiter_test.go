@@ -43,6 +43,29 @@ func (s *LimiterSuite) TestHitLimit(c *C) {
 	c.Assert(err, IsNil)
 }
 
+// Rejected response tells the client when to retry
+func (s *LimiterSuite) TestRetryAfter(c *C) {
+	l, err := NewTokenLimiterWithOptions(
+		MapClientIp, Rate{Units: 1, Period: 3 * time.Second}, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.9"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	re, err = l.ProcessRequest(makeRequest("1.2.3.9"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, 429)
+	c.Assert(re.Header.Get("Retry-After"), Equals, "3")
+}
+
+func (s *LimiterSuite) TestRetryAfterRoundsUp(c *C) {
+	c.Assert(retryAfter(time.Second), Equals, int64(1))
+	c.Assert(retryAfter(1500*time.Millisecond), Equals, int64(2))
+	c.Assert(retryAfter(time.Millisecond), Equals, int64(1))
+}
+
 // We've failed to extract client ip
 func (s *LimiterSuite) TestFailure(c *C) {
 	l, err := NewTokenLimiterWithOptions(
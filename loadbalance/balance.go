@@ -2,6 +2,8 @@
 package loadbalance
 
 import (
+	"net/url"
+
 	. "github.com/mailgun/vulcan/endpoint"
 	. "github.com/mailgun/vulcan/middleware"
 	. "github.com/mailgun/vulcan/request"
@@ -15,3 +17,31 @@ type LoadBalancer interface {
 	// Load balancer may observe the request stats to get some runtime metrics
 	Observer
 }
+
+// Drainer is implemented by load balancers that can take the endpoint out of rotation gracefully
+type Drainer interface {
+	// Stops sending new requests to the endpoint, returned channel is closed once the requests in flight are done
+	Drain(Endpoint) (<-chan struct{}, error)
+}
+
+// HasAttempted tells whether the endpoint has already been tried for the request, balancers use it
+// to pick another endpoint on failover
+func HasAttempted(req Request, e Endpoint) bool {
+	for _, a := range req.GetAttempts() {
+		if a.GetEndpoint().GetId() == e.GetId() {
+			return true
+		}
+	}
+	return false
+}
+
+// FindEndpointByUrl returns the index of the endpoint with the same scheme, host and path as u
+// among the n endpoints of the balancer, urlAt returns the url of the i-th one. Returns -1 if there is none.
+func FindEndpointByUrl(n int, urlAt func(i int) *url.URL, u *url.URL) int {
+	for i := 0; i < n; i++ {
+		if eu := urlAt(i); eu.Path == u.Path && eu.Host == u.Host && eu.Scheme == u.Scheme {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,216 @@
+// Consistent hash load balancer
+package consistenthash
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/request"
+)
+
+// ConsistentHash maps the key extracted from the request to the endpoint using the hash ring,
+// so the same key ends up on the same endpoint, and adding or removing the endpoint
+// only moves the keys that belonged to it.
+type ConsistentHash struct {
+	mutex     *sync.RWMutex
+	endpoints []endpoint.Endpoint
+	// Points of the hash ring sorted by hash
+	ring    []point
+	options Options
+}
+
+// KeyFunc extracts the key used to select the endpoint from the request
+type KeyFunc func(req request.Request) string
+
+// Hash maps the key to the position on the ring
+type Hash func(data []byte) uint32
+
+type Options struct {
+	// Extracts the key from the request, requests are hashed by path by default
+	KeyFunc KeyFunc
+	// Number of points each endpoint takes on the ring, more points spread keys more evenly
+	Replicas int
+	// Hash function, crc32 by default
+	Hash Hash
+}
+
+const DefaultReplicas = 100
+
+type point struct {
+	hash     uint32
+	endpoint endpoint.Endpoint
+}
+
+// PathKey hashes requests by the request path
+func PathKey(req request.Request) string {
+	return req.GetHttpRequest().URL.Path
+}
+
+// HeaderKey hashes requests by the value of the header
+func HeaderKey(name string) KeyFunc {
+	return func(req request.Request) string {
+		return req.GetHttpRequest().Header.Get(name)
+	}
+}
+
+// CookieKey hashes requests by the value of the cookie, requests without the cookie share the same empty key
+func CookieKey(name string) KeyFunc {
+	return func(req request.Request) string {
+		c, err := req.GetHttpRequest().Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// ClientIPKey hashes requests by the client IP address, see Request.GetClientIP. The address is taken from
+// X-Forwarded-For only behind the trusted proxies, so the clients can't pick the endpoint by forging the header
+func ClientIPKey(req request.Request) string {
+	if ip := req.GetClientIP(); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func NewConsistentHash() (*ConsistentHash, error) {
+	return NewConsistentHashWithOptions(Options{})
+}
+
+// NewIPHash returns load balancer that consistently maps client IP addresses to endpoints,
+// e.g. for backends that keep per client state in memory.
+func NewIPHash() (*ConsistentHash, error) {
+	return NewConsistentHashWithOptions(Options{KeyFunc: ClientIPKey})
+}
+
+func NewConsistentHashWithOptions(o Options) (*ConsistentHash, error) {
+	o, err := validateOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsistentHash{
+		mutex:   &sync.RWMutex{},
+		options: o,
+	}, nil
+}
+
+func (c *ConsistentHash) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if len(c.ring) == 0 {
+		return nil, fmt.Errorf("No endpoints")
+	}
+
+	h := c.options.Hash([]byte(c.options.KeyFunc(req)))
+	start := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+
+	// On failover walk the ring clockwise to the next endpoint we have not tried yet,
+	// so the retries for the same key are spread consistently as well.
+	for i := 0; i < len(c.ring); i++ {
+		e := c.ring[(start+i)%len(c.ring)].endpoint
+		if !loadbalance.HasAttempted(req, e) {
+			return e, nil
+		}
+	}
+	return c.ring[start%len(c.ring)].endpoint, nil
+}
+
+func (c *ConsistentHash) GetEndpoints() []endpoint.Endpoint {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return append([]endpoint.Endpoint{}, c.endpoints...)
+}
+
+// In case if endpoint is already present in the load balancer, returns error
+func (c *ConsistentHash) AddEndpoint(e endpoint.Endpoint) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	if c.findEndpointByUrl(e.GetUrl()) != -1 {
+		return fmt.Errorf("Endpoint already exists")
+	}
+	c.endpoints = append(c.endpoints, e)
+	c.buildRing()
+	return nil
+}
+
+func (c *ConsistentHash) RemoveEndpoint(e endpoint.Endpoint) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	index := c.findEndpointByUrl(e.GetUrl())
+	if index == -1 {
+		return fmt.Errorf("Endpoint not found")
+	}
+	c.endpoints = append(c.endpoints[:index], c.endpoints[index+1:]...)
+	c.buildRing()
+	return nil
+}
+
+func (c *ConsistentHash) ProcessRequest(request.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (c *ConsistentHash) ProcessResponse(req request.Request, a request.Attempt) {
+}
+
+func (c *ConsistentHash) ObserveRequest(request.Request) {
+}
+
+func (c *ConsistentHash) ObserveResponse(req request.Request, a request.Attempt) {
+}
+
+func (c *ConsistentHash) buildRing() {
+	ring := make([]point, 0, len(c.endpoints)*c.options.Replicas)
+	for _, e := range c.endpoints {
+		for i := 0; i < c.options.Replicas; i++ {
+			// Points depend on the endpoint id only, so the rest of the ring stays the same on changes
+			ring = append(ring, point{hash: c.options.Hash([]byte(strconv.Itoa(i) + e.GetId())), endpoint: e})
+		}
+	}
+	sort.Sort(byHash(ring))
+	c.ring = ring
+}
+
+func (c *ConsistentHash) findEndpointByUrl(iu *url.URL) int {
+	return loadbalance.FindEndpointByUrl(len(c.endpoints), func(i int) *url.URL { return c.endpoints[i].GetUrl() }, iu)
+}
+
+type byHash []point
+
+func (a byHash) Len() int      { return len(a) }
+func (a byHash) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byHash) Less(i, j int) bool {
+	if a[i].hash != a[j].hash {
+		return a[i].hash < a[j].hash
+	}
+	// Collisions are resolved by id, so the ring does not depend on the order endpoints were added
+	return a[i].endpoint.GetId() < a[j].endpoint.GetId()
+}
+
+func validateOptions(o Options) (Options, error) {
+	if o.Replicas < 0 {
+		return o, fmt.Errorf("Replicas should be >= 0")
+	}
+	if o.Replicas == 0 {
+		o.Replicas = DefaultReplicas
+	}
+	if o.KeyFunc == nil {
+		o.KeyFunc = PathKey
+	}
+	if o.Hash == nil {
+		o.Hash = crc32.ChecksumIEEE
+	}
+	return o, nil
+}
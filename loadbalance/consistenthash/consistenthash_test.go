@@ -0,0 +1,177 @@
+package consistenthash
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type HashSuite struct {
+}
+
+var _ = Suite(&HashSuite{})
+
+func (s *HashSuite) TestNoEndpoints(c *C) {
+	h, err := NewConsistentHash()
+	c.Assert(err, IsNil)
+	_, err = h.NextEndpoint(makeReq("/a"))
+	c.Assert(err, NotNil)
+}
+
+func (s *HashSuite) TestBadOptions(c *C) {
+	_, err := NewConsistentHashWithOptions(Options{Replicas: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *HashSuite) TestAddRemove(c *C) {
+	h, _ := NewConsistentHash()
+	a := MustParseUrl("http://localhost:5000")
+
+	c.Assert(h.AddEndpoint(a), IsNil)
+	c.Assert(h.AddEndpoint(a), NotNil)
+	c.Assert(h.RemoveEndpoint(a), IsNil)
+	c.Assert(h.RemoveEndpoint(a), NotNil)
+	c.Assert(len(h.GetEndpoints()), Equals, 0)
+}
+
+func (s *HashSuite) TestSameKeySameEndpoint(c *C) {
+	h := newHash(c, Options{}, 3)
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprintf("/%d", i)
+		e1, err := h.NextEndpoint(makeReq(path))
+		c.Assert(err, IsNil)
+		e2, err := h.NextEndpoint(makeReq(path))
+		c.Assert(err, IsNil)
+		c.Assert(e1, Equals, e2)
+	}
+}
+
+// Removing the endpoint only moves the keys that were mapped to it
+func (s *HashSuite) TestRemoveMovesOnlyOwnKeys(c *C) {
+	h := newHash(c, Options{}, 3)
+	before := mapKeys(c, h)
+
+	removed := h.GetEndpoints()[1]
+	c.Assert(h.RemoveEndpoint(removed), IsNil)
+	after := mapKeys(c, h)
+
+	moved := 0
+	for key, e := range before {
+		if e == removed {
+			c.Assert(after[key], Not(Equals), removed)
+			moved += 1
+			continue
+		}
+		c.Assert(after[key], Equals, e)
+	}
+	c.Assert(moved > 0, Equals, true)
+}
+
+func (s *HashSuite) TestHeaderKey(c *C) {
+	h := newHash(c, Options{KeyFunc: HeaderKey("X-User")}, 3)
+
+	req := makeReq("/a")
+	req.GetHttpRequest().Header.Set("X-User", "bob")
+	e1, _ := h.NextEndpoint(req)
+
+	// Path does not matter, header does
+	req = makeReq("/b")
+	req.GetHttpRequest().Header.Set("X-User", "bob")
+	e2, _ := h.NextEndpoint(req)
+	c.Assert(e1, Equals, e2)
+}
+
+func (s *HashSuite) TestCookieKey(c *C) {
+	h := newHash(c, Options{KeyFunc: CookieKey("session")}, 3)
+
+	req := makeReq("/a")
+	req.GetHttpRequest().AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	e1, _ := h.NextEndpoint(req)
+
+	req = makeReq("/b")
+	req.GetHttpRequest().AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	e2, _ := h.NextEndpoint(req)
+	c.Assert(e1, Equals, e2)
+}
+
+func (s *HashSuite) TestClientIPKey(c *C) {
+	req := makeReq("/a")
+	req.GetHttpRequest().RemoteAddr = "10.0.0.1:4321"
+	req.GetHttpRequest().Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.2")
+
+	// Forwarded addresses are ignored unless the request came from the trusted proxy
+	c.Assert(ClientIPKey(req), Equals, "10.0.0.1")
+
+	// Client can't choose the endpoint with the leftmost address, only the one appended by the proxies counts
+	trusted, err := netutils.ParseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	c.Assert(err, IsNil)
+	req.(*BaseRequest).TrustedProxies = trusted
+	c.Assert(ClientIPKey(req), Equals, "1.2.3.4")
+	req.GetHttpRequest().Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4")
+	c.Assert(ClientIPKey(req), Equals, "1.2.3.4")
+
+	req.GetHttpRequest().Header.Del("X-Forwarded-For")
+	req.GetHttpRequest().RemoteAddr = "[2001:db8::1]:4321"
+	c.Assert(ClientIPKey(req), Equals, "2001:db8::1")
+}
+
+func (s *HashSuite) TestIPHash(c *C) {
+	h, err := NewIPHash()
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(h.AddEndpoint(MustParseUrl(fmt.Sprintf("http://localhost:%d", 5000+i))), IsNil)
+	}
+
+	// Same client ends up on the same endpoint regardless of the port and path
+	req := makeReq("/a")
+	req.GetHttpRequest().RemoteAddr = "10.0.0.1:4321"
+	e1, _ := h.NextEndpoint(req)
+
+	req = makeReq("/b")
+	req.GetHttpRequest().RemoteAddr = "10.0.0.1:1234"
+	e2, _ := h.NextEndpoint(req)
+	c.Assert(e1, Equals, e2)
+}
+
+func (s *HashSuite) TestFailoverAvoidsAttempted(c *C) {
+	h := newHash(c, Options{}, 3)
+
+	req := makeReq("/a")
+	e1, _ := h.NextEndpoint(req)
+	req.AddAttempt(&BaseAttempt{Endpoint: e1})
+	e2, err := h.NextEndpoint(req)
+	c.Assert(err, IsNil)
+	c.Assert(e2, Not(Equals), e1)
+}
+
+func newHash(c *C, o Options, count int) *ConsistentHash {
+	h, err := NewConsistentHashWithOptions(o)
+	c.Assert(err, IsNil)
+	for i := 0; i < count; i++ {
+		c.Assert(h.AddEndpoint(MustParseUrl(fmt.Sprintf("http://localhost:%d", 5000+i))), IsNil)
+	}
+	return h
+}
+
+func mapKeys(c *C, h *ConsistentHash) map[string]Endpoint {
+	out := make(map[string]Endpoint)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("/%d", i)
+		e, err := h.NextEndpoint(makeReq(key))
+		c.Assert(err, IsNil)
+		out[key] = e
+	}
+	return out
+}
+
+func makeReq(path string) Request {
+	hr := &http.Request{URL: netutils.MustParseUrl("http://google.com" + path), Header: make(http.Header)}
+	return &BaseRequest{HttpRequest: hr}
+}
@@ -0,0 +1,280 @@
+// Latency aware load balancer
+package ewma
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/outlier"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/request"
+)
+
+// EWMA keeps exponentially weighted moving average of the response latency of each endpoint
+// and selects endpoints randomly with probability inversely proportional to their latency,
+// so slow endpoints automatically get less traffic, but still get some to detect the recovery.
+// Failed attempts count as at least FailurePenalty, otherwise the endpoint that fails fast,
+// e.g. refuses the connections, would look like the fastest one and get most of the traffic.
+type EWMA struct {
+	mutex     *sync.Mutex
+	endpoints []*LatencyEndpoint
+	options   Options
+	stats     *metrics.EndpointMetrics
+}
+
+type Options struct {
+	// Smoothing factor of the latency moving average
+	Alpha float64
+	// Random numbers source, useful in tests
+	Rand *rand.Rand
+	// Failed attempts are observed with at least this latency, DefaultFailurePenalty by default
+	FailurePenalty time.Duration
+	// Tells whether the attempt has failed, network errors and 5xx responses by default
+	IsFailure metrics.FailPredicate
+}
+
+const (
+	DefaultAlpha          = 0.3
+	DefaultFailurePenalty = time.Second
+)
+
+// LatencyEndpoint wraps the endpoint and tracks its average latency.
+type LatencyEndpoint struct {
+	endpoint endpoint.Endpoint
+	latency  *metrics.EWMA
+}
+
+func (le *LatencyEndpoint) String() string {
+	return fmt.Sprintf("LatencyEndpoint(id=%s, url=%s, latency=%s)", le.GetId(), le.GetUrl(), le.GetLatency())
+}
+
+func (le *LatencyEndpoint) GetId() string {
+	return le.endpoint.GetId()
+}
+
+func (le *LatencyEndpoint) GetUrl() *url.URL {
+	return le.endpoint.GetUrl()
+}
+
+func (le *LatencyEndpoint) GetOriginalEndpoint() endpoint.Endpoint {
+	return le.endpoint
+}
+
+// GetLatency returns the average latency, 0 if the endpoint has not served any requests yet
+func (le *LatencyEndpoint) GetLatency() time.Duration {
+	return time.Duration(le.latency.Value())
+}
+
+func NewEWMA() (*EWMA, error) {
+	return NewEWMAWithOptions(Options{})
+}
+
+func NewEWMAWithOptions(o Options) (*EWMA, error) {
+	o, err := validateOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := metrics.NewEndpointMetrics(metrics.RoundTripOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &EWMA{
+		mutex:     &sync.Mutex{},
+		endpoints: []*LatencyEndpoint{},
+		options:   o,
+		stats:     stats,
+	}, nil
+}
+
+func (l *EWMA) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.endpoints) == 0 {
+		return nil, fmt.Errorf("No endpoints")
+	}
+
+	// On failover, prefer endpoints we have not tried yet
+	candidates := make([]*LatencyEndpoint, 0, len(l.endpoints))
+	for _, e := range l.endpoints {
+		if !loadbalance.HasAttempted(req, e.endpoint) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = l.endpoints
+	}
+
+	weights := l.weights(candidates)
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	v := l.options.Rand.Float64() * total
+	for i, w := range weights {
+		if v < w {
+			return candidates[i].endpoint, nil
+		}
+		v -= w
+	}
+	return candidates[len(candidates)-1].endpoint, nil
+}
+
+// Weights are inversely proportional to the latency. Endpoints that have no latency
+// stats yet are treated as the fastest ones, so they get the traffic and the stats.
+func (l *EWMA) weights(endpoints []*LatencyEndpoint) []float64 {
+	min := 0.0
+	for _, e := range endpoints {
+		if !e.latency.IsSet() {
+			continue
+		}
+		if min == 0 || e.latency.Value() < min {
+			min = e.latency.Value()
+		}
+	}
+	weights := make([]float64, len(endpoints))
+	for i, e := range endpoints {
+		latency := e.latency.Value()
+		if !e.latency.IsSet() || latency <= 0 {
+			latency = min
+		}
+		if latency <= 0 {
+			weights[i] = 1
+		} else {
+			weights[i] = 1 / latency
+		}
+	}
+	return weights
+}
+
+func (l *EWMA) GetEndpoints() []*LatencyEndpoint {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]*LatencyEndpoint{}, l.endpoints...)
+}
+
+// GetLatency returns the average latency of the endpoint with the given id
+func (l *EWMA) GetLatency(id string) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, e := range l.endpoints {
+		if e.GetId() == id {
+			return e.GetLatency(), nil
+		}
+	}
+	return 0, fmt.Errorf("Endpoint not found")
+}
+
+// GetSnapshot returns the state of the endpoints. EWMA does not track the requests in flight
+// and does not exclude any endpoints, so all of them are healthy.
+func (l *EWMA) GetSnapshot() []loadbalance.EndpointSnapshot {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	out := make([]loadbalance.EndpointSnapshot, 0, len(l.endpoints))
+	for _, e := range l.endpoints {
+		out = append(out, loadbalance.NewEndpointSnapshot(e.endpoint, l.stats))
+	}
+	loadbalance.SortSnapshot(out)
+	return out
+}
+
+// In case if endpoint is already present in the load balancer, returns error
+func (l *EWMA) AddEndpoint(e endpoint.Endpoint) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	if found, _ := l.findEndpointByUrl(e.GetUrl()); found != nil {
+		return fmt.Errorf("Endpoint already exists")
+	}
+	latency, err := metrics.NewEWMA(l.options.Alpha)
+	if err != nil {
+		return err
+	}
+	l.endpoints = append(l.endpoints, &LatencyEndpoint{endpoint: e, latency: latency})
+	return nil
+}
+
+func (l *EWMA) RemoveEndpoint(e endpoint.Endpoint) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	found, index := l.findEndpointByUrl(e.GetUrl())
+	if found == nil {
+		return fmt.Errorf("Endpoint not found")
+	}
+	l.endpoints = append(l.endpoints[:index], l.endpoints[index+1:]...)
+	l.stats.Remove(found.GetId())
+	return nil
+}
+
+func (l *EWMA) ProcessRequest(request.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (l *EWMA) ProcessResponse(req request.Request, a request.Attempt) {
+}
+
+func (l *EWMA) ObserveRequest(request.Request) {
+}
+
+func (l *EWMA) ObserveResponse(req request.Request, a request.Attempt) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if a == nil || a.GetEndpoint() == nil {
+		return
+	}
+	e, _ := l.findEndpointByUrl(a.GetEndpoint().GetUrl())
+	if e == nil {
+		return
+	}
+	l.stats.ObserveResponse(req, a)
+	latency := a.GetDuration()
+	if l.options.IsFailure(a) && latency < l.options.FailurePenalty {
+		latency = l.options.FailurePenalty
+	}
+	if latency <= 0 {
+		return
+	}
+	e.latency.Observe(float64(latency))
+}
+
+func (l *EWMA) findEndpointByUrl(iu *url.URL) (*LatencyEndpoint, int) {
+	i := loadbalance.FindEndpointByUrl(len(l.endpoints), func(i int) *url.URL { return l.endpoints[i].GetUrl() }, iu)
+	if i == -1 {
+		return nil, -1
+	}
+	return l.endpoints[i], i
+}
+
+func validateOptions(o Options) (Options, error) {
+	if o.Alpha == 0 {
+		o.Alpha = DefaultAlpha
+	}
+	if o.Alpha < 0 || o.Alpha > 1 {
+		return o, fmt.Errorf("Alpha should be in range (0, 1]")
+	}
+	if o.FailurePenalty < 0 {
+		return o, fmt.Errorf("FailurePenalty can not be negative")
+	}
+	if o.FailurePenalty == 0 {
+		o.FailurePenalty = DefaultFailurePenalty
+	}
+	if o.IsFailure == nil {
+		o.IsFailure = outlier.IsServerError
+	}
+	if o.Rand == nil {
+		o.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return o, nil
+}
@@ -0,0 +1,128 @@
+package ewma
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type EWMASuite struct {
+	req Request
+}
+
+var _ = Suite(&EWMASuite{})
+
+func (s *EWMASuite) SetUpTest(c *C) {
+	s.req = &BaseRequest{}
+}
+
+func (s *EWMASuite) newEWMA(c *C) *EWMA {
+	l, err := NewEWMAWithOptions(Options{Rand: rand.New(rand.NewSource(1))})
+	c.Assert(err, IsNil)
+	return l
+}
+
+func (s *EWMASuite) TestNoEndpoints(c *C) {
+	l := s.newEWMA(c)
+	_, err := l.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+}
+
+func (s *EWMASuite) TestBadOptions(c *C) {
+	_, err := NewEWMAWithOptions(Options{Alpha: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *EWMASuite) TestAddRemove(c *C) {
+	l := s.newEWMA(c)
+	a := MustParseUrl("http://localhost:5000")
+	c.Assert(l.AddEndpoint(a), IsNil)
+	c.Assert(l.AddEndpoint(a), NotNil)
+	c.Assert(l.RemoveEndpoint(a), IsNil)
+	c.Assert(l.RemoveEndpoint(a), NotNil)
+	c.Assert(len(l.GetEndpoints()), Equals, 0)
+}
+
+func (s *EWMASuite) TestObserveLatency(c *C) {
+	l := s.newEWMA(c)
+	a := MustParseUrl("http://localhost:5000")
+	l.AddEndpoint(a)
+
+	l.ObserveResponse(s.req, &BaseAttempt{Endpoint: a, Duration: 10 * time.Millisecond})
+	latency, err := l.GetLatency(a.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(latency, Equals, 10*time.Millisecond)
+}
+
+// Endpoint that is 9 times slower gets roughly 10% of the traffic
+func (s *EWMASuite) TestSlowEndpointGetsLessTraffic(c *C) {
+	l := s.newEWMA(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	l.AddEndpoint(a)
+	l.AddEndpoint(b)
+
+	l.ObserveResponse(s.req, &BaseAttempt{Endpoint: a, Duration: 10 * time.Millisecond})
+	l.ObserveResponse(s.req, &BaseAttempt{Endpoint: b, Duration: 90 * time.Millisecond})
+
+	hits := map[Endpoint]int{}
+	for i := 0; i < 1000; i++ {
+		e, err := l.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		hits[e] += 1
+	}
+	c.Assert(hits[b] > 50 && hits[b] < 150, Equals, true, Commentf("slow endpoint hits: %d", hits[b]))
+}
+
+func (s *EWMASuite) TestFailoverAvoidsAttempted(c *C) {
+	l := s.newEWMA(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	l.AddEndpoint(a)
+	l.AddEndpoint(b)
+
+	req := &BaseRequest{}
+	req.AddAttempt(&BaseAttempt{Endpoint: a})
+	for i := 0; i < 5; i++ {
+		e, err := l.NextEndpoint(req)
+		c.Assert(err, IsNil)
+		c.Assert(e, Equals, b)
+	}
+}
+
+// Endpoint that refuses the connections right away does not look like the fastest one
+func (s *EWMASuite) TestFailingFastEndpointGetsLessTraffic(c *C) {
+	l := s.newEWMA(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	l.AddEndpoint(a)
+	l.AddEndpoint(b)
+
+	for i := 0; i < 10; i++ {
+		l.ObserveResponse(s.req, &BaseAttempt{Endpoint: a, Duration: time.Millisecond, Error: fmt.Errorf("connection refused")})
+		l.ObserveResponse(s.req, &BaseAttempt{Endpoint: b, Duration: 50 * time.Millisecond})
+	}
+	latency, err := l.GetLatency(a.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(latency > 900*time.Millisecond, Equals, true, Commentf("failing endpoint latency: %s", latency))
+
+	hits := map[Endpoint]int{}
+	for i := 0; i < 1000; i++ {
+		e, err := l.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		hits[e] += 1
+	}
+	c.Assert(hits[a] < 100, Equals, true, Commentf("failing endpoint hits: %d", hits[a]))
+}
+
+func (s *EWMASuite) TestBadFailurePenalty(c *C) {
+	_, err := NewEWMAWithOptions(Options{FailurePenalty: -1})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,295 @@
+// Least connections load balancer
+package leastconn
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// LeastConn sends the request to the endpoint with the fewest requests in flight.
+// Endpoints with equal number of requests in flight are picked in round robin order.
+type LeastConn struct {
+	mutex *sync.Mutex
+	// Index of the last selected endpoint (starts from -1)
+	index     int
+	endpoints []*ConnEndpoint
+	options   Options
+	queue     *loadbalance.Queue
+	stats     *metrics.EndpointMetrics
+}
+
+type Options struct {
+	// Endpoint with this many requests in flight is skipped, 0 means no limit
+	MaxInFlight int64
+	// How long the request waits for an endpoint when all of them are at their limit,
+	// 0 means it fails with loadbalance.ErrSaturated right away
+	QueueTimeout time.Duration
+}
+
+// ConnEndpoint wraps the endpoint and tracks the number of requests in flight to it.
+type ConnEndpoint struct {
+	endpoint endpoint.Endpoint
+	inFlight int64
+	// Draining endpoint gets no new requests, drainedC is closed once it has no requests in flight
+	draining bool
+	drainedC chan struct{}
+}
+
+func (ce *ConnEndpoint) String() string {
+	return fmt.Sprintf("ConnEndpoint(id=%s, url=%s, inFlight=%d)", ce.GetId(), ce.GetUrl(), ce.inFlight)
+}
+
+func (ce *ConnEndpoint) GetId() string {
+	return ce.endpoint.GetId()
+}
+
+func (ce *ConnEndpoint) GetUrl() *url.URL {
+	return ce.endpoint.GetUrl()
+}
+
+func (ce *ConnEndpoint) GetOriginalEndpoint() endpoint.Endpoint {
+	return ce.endpoint
+}
+
+func (ce *ConnEndpoint) IsDraining() bool {
+	return ce.draining
+}
+
+func (ce *ConnEndpoint) closeDrained() {
+	if ce.drainedC == nil {
+		return
+	}
+	select {
+	case <-ce.drainedC:
+	default:
+		close(ce.drainedC)
+	}
+}
+
+func NewLeastConn() (*LeastConn, error) {
+	return NewLeastConnWithOptions(Options{})
+}
+
+func NewLeastConnWithOptions(o Options) (*LeastConn, error) {
+	if o.MaxInFlight < 0 || o.QueueTimeout < 0 {
+		return nil, fmt.Errorf("MaxInFlight and QueueTimeout can not be negative")
+	}
+	stats, err := metrics.NewEndpointMetrics(metrics.RoundTripOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &LeastConn{
+		mutex:     &sync.Mutex{},
+		index:     -1,
+		endpoints: []*ConnEndpoint{},
+		options:   o,
+		queue:     loadbalance.NewQueue(o.QueueTimeout),
+		stats:     stats,
+	}, nil
+}
+
+func (l *LeastConn) GetOptions() Options {
+	return l.options
+}
+
+// NextEndpoint selects the endpoint and counts the request as in flight to it,
+// the request is done once the location reports the attempt with ObserveResponse.
+// If all the endpoints are at their limit of requests in flight, the request waits in the queue for up to QueueTimeout.
+func (l *LeastConn) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	return l.queue.Next(req, func() (endpoint.Endpoint, error) {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return l.nextEndpoint(req)
+	})
+}
+
+func (l *LeastConn) nextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	if len(l.endpoints) == 0 {
+		return nil, fmt.Errorf("No endpoints")
+	}
+
+	// On failover, prefer endpoints we have not tried yet
+	best := l.pick(req, true)
+	if best == -1 {
+		best = l.pick(req, false)
+	}
+	if best == -1 {
+		for _, e := range l.endpoints {
+			if !e.draining && l.isSaturated(e) {
+				return nil, loadbalance.ErrSaturated
+			}
+		}
+		return nil, fmt.Errorf("No available endpoints")
+	}
+	l.index = best
+	e := l.endpoints[best]
+	e.inFlight += 1
+	return e.endpoint, nil
+}
+
+func (l *LeastConn) isSaturated(e *ConnEndpoint) bool {
+	return l.options.MaxInFlight > 0 && e.inFlight >= l.options.MaxInFlight
+}
+
+// pick returns the index of the endpoint with the fewest requests in flight, starting
+// the scan right after the last selected endpoint, so ties are broken in round robin order.
+func (l *LeastConn) pick(req request.Request, skipAttempted bool) int {
+	best := -1
+	for i := 1; i <= len(l.endpoints); i++ {
+		index := (l.index + i) % len(l.endpoints)
+		e := l.endpoints[index]
+		if e.draining || l.isSaturated(e) || (skipAttempted && loadbalance.HasAttempted(req, e.endpoint)) {
+			continue
+		}
+		if best == -1 || e.inFlight < l.endpoints[best].inFlight {
+			best = index
+		}
+	}
+	return best
+}
+
+func (l *LeastConn) GetEndpoints() []*ConnEndpoint {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]*ConnEndpoint{}, l.endpoints...)
+}
+
+// GetInFlight returns the number of requests in flight to the endpoint with the given id
+func (l *LeastConn) GetInFlight(id string) (int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, e := range l.endpoints {
+		if e.GetId() == id {
+			return e.inFlight, nil
+		}
+	}
+	return 0, fmt.Errorf("Endpoint not found")
+}
+
+// GetSnapshot returns the state of the endpoints, the endpoint is unhealthy while it is draining
+func (l *LeastConn) GetSnapshot() []loadbalance.EndpointSnapshot {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	out := make([]loadbalance.EndpointSnapshot, 0, len(l.endpoints))
+	for _, e := range l.endpoints {
+		s := loadbalance.NewEndpointSnapshot(e.endpoint, l.stats)
+		s.InFlight = e.inFlight
+		s.Healthy = !e.draining
+		out = append(out, s)
+	}
+	loadbalance.SortSnapshot(out)
+	return out
+}
+
+func (l *LeastConn) FindEndpointByUrl(in string) *ConnEndpoint {
+	u, err := netutils.ParseUrl(in)
+	if err != nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	e, _ := l.findEndpointByUrl(u)
+	return e
+}
+
+// In case if endpoint is already present in the load balancer, returns error
+func (l *LeastConn) AddEndpoint(e endpoint.Endpoint) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	if found, _ := l.findEndpointByUrl(e.GetUrl()); found != nil {
+		return fmt.Errorf("Endpoint already exists")
+	}
+	l.endpoints = append(l.endpoints, &ConnEndpoint{endpoint: e})
+	// Queued requests can go to the new endpoint
+	l.queue.Release()
+	return nil
+}
+
+// Drain stops sending new requests to the endpoint and lets the requests in flight finish.
+// Returned channel is closed once the endpoint has no requests in flight, so it can be removed.
+func (l *LeastConn) Drain(e endpoint.Endpoint) (<-chan struct{}, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	found, _ := l.findEndpointByUrl(e.GetUrl())
+	if found == nil {
+		return nil, fmt.Errorf("Endpoint not found")
+	}
+	if !found.draining {
+		found.draining = true
+		found.drainedC = make(chan struct{})
+		if found.inFlight == 0 {
+			found.closeDrained()
+		}
+	}
+	return found.drainedC, nil
+}
+
+func (l *LeastConn) RemoveEndpoint(e endpoint.Endpoint) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	found, index := l.findEndpointByUrl(e.GetUrl())
+	if found == nil {
+		return fmt.Errorf("Endpoint not found")
+	}
+	// Responses from the removed endpoint are not tracked anymore, so don't keep anyone waiting
+	found.closeDrained()
+	l.endpoints = append(l.endpoints[:index], l.endpoints[index+1:]...)
+	l.stats.Remove(found.GetId())
+	l.index = -1
+	return nil
+}
+
+func (l *LeastConn) ProcessRequest(request.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (l *LeastConn) ProcessResponse(req request.Request, a request.Attempt) {
+}
+
+func (l *LeastConn) ObserveRequest(request.Request) {
+}
+
+func (l *LeastConn) ObserveResponse(req request.Request, a request.Attempt) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if a == nil || a.GetEndpoint() == nil {
+		return
+	}
+	e, _ := l.findEndpointByUrl(a.GetEndpoint().GetUrl())
+	if e == nil {
+		return
+	}
+	l.stats.ObserveResponse(req, a)
+	if e.inFlight > 0 {
+		e.inFlight -= 1
+	}
+	if e.draining && e.inFlight == 0 {
+		e.closeDrained()
+	}
+	l.queue.Release()
+}
+
+func (l *LeastConn) findEndpointByUrl(iu *url.URL) (*ConnEndpoint, int) {
+	i := loadbalance.FindEndpointByUrl(len(l.endpoints), func(i int) *url.URL { return l.endpoints[i].GetUrl() }, iu)
+	if i == -1 {
+		return nil, -1
+	}
+	return l.endpoints[i], i
+}
@@ -0,0 +1,186 @@
+package leastconn
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type LeastConnSuite struct {
+	req Request
+}
+
+var _ = Suite(&LeastConnSuite{})
+
+func (s *LeastConnSuite) SetUpTest(c *C) {
+	s.req = &BaseRequest{}
+}
+
+func (s *LeastConnSuite) TestNoEndpoints(c *C) {
+	l, err := NewLeastConn()
+	c.Assert(err, IsNil)
+	_, err = l.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+}
+
+func (s *LeastConnSuite) TestAddRemove(c *C) {
+	l, _ := NewLeastConn()
+	a := MustParseUrl("http://localhost:5000")
+
+	c.Assert(l.AddEndpoint(a), IsNil)
+	c.Assert(l.AddEndpoint(a), NotNil)
+	c.Assert(l.FindEndpointByUrl("http://localhost:5000").GetOriginalEndpoint(), Equals, a)
+
+	c.Assert(l.RemoveEndpoint(a), IsNil)
+	c.Assert(l.RemoveEndpoint(a), NotNil)
+	c.Assert(len(l.GetEndpoints()), Equals, 0)
+}
+
+// Endpoints with the same number of requests in flight are selected in round robin order
+func (s *LeastConnSuite) TestTieBreakRoundRobin(c *C) {
+	l, _ := NewLeastConn()
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	l.AddEndpoint(a)
+	l.AddEndpoint(b)
+
+	for _, expected := range []Endpoint{a, b, a, b} {
+		e, err := l.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(e, Equals, expected)
+		l.ObserveResponse(s.req, &BaseAttempt{Endpoint: e})
+	}
+}
+
+func (s *LeastConnSuite) TestPicksLeastLoaded(c *C) {
+	l, _ := NewLeastConn()
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	l.AddEndpoint(a)
+	l.AddEndpoint(b)
+
+	// Both requests are in flight
+	e1, _ := l.NextEndpoint(s.req)
+	e2, _ := l.NextEndpoint(s.req)
+	c.Assert(e1, Equals, a)
+	c.Assert(e2, Equals, b)
+
+	// Request to a is done, so a has less requests in flight
+	l.ObserveResponse(s.req, &BaseAttempt{Endpoint: a})
+	inFlight, err := l.GetInFlight(a.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(inFlight, Equals, int64(0))
+
+	for i := 0; i < 3; i++ {
+		e, _ := l.NextEndpoint(s.req)
+		c.Assert(e, Equals, a)
+		l.ObserveResponse(s.req, &BaseAttempt{Endpoint: e})
+	}
+
+	inFlight, _ = l.GetInFlight(b.GetId())
+	c.Assert(inFlight, Equals, int64(1))
+}
+
+// On failover the load balancer avoids the endpoints that have been tried already
+func (s *LeastConnSuite) TestFailoverAvoidsAttempted(c *C) {
+	l, _ := NewLeastConn()
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	l.AddEndpoint(a)
+	l.AddEndpoint(b)
+
+	// b is busy
+	e, _ := l.NextEndpoint(s.req)
+	c.Assert(e, Equals, a)
+	l.ObserveResponse(s.req, &BaseAttempt{Endpoint: a})
+	e, _ = l.NextEndpoint(s.req)
+	c.Assert(e, Equals, b)
+
+	req := &BaseRequest{}
+	req.AddAttempt(&BaseAttempt{Endpoint: a})
+	e, err := l.NextEndpoint(req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, b)
+}
+
+func (s *LeastConnSuite) TestDrain(c *C) {
+	l, _ := NewLeastConn()
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	l.AddEndpoint(a)
+	l.AddEndpoint(b)
+
+	e, _ := l.NextEndpoint(s.req)
+	c.Assert(e, Equals, a)
+
+	_, err := l.Drain(MustParseUrl("http://localhost:5003"))
+	c.Assert(err, NotNil)
+
+	drained, err := l.Drain(a)
+	c.Assert(err, IsNil)
+
+	// a is less loaded, but it's draining
+	l.NextEndpoint(s.req)
+	e, _ = l.NextEndpoint(s.req)
+	c.Assert(e, Equals, b)
+
+	select {
+	case <-drained:
+		c.Fatalf("endpoint has requests in flight")
+	default:
+	}
+
+	l.ObserveResponse(s.req, &BaseAttempt{Endpoint: a})
+	select {
+	case <-drained:
+	default:
+		c.Fatalf("endpoint should be drained")
+	}
+
+	// All endpoints are draining
+	l.Drain(b)
+	_, err = l.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+}
+
+func (s *LeastConnSuite) TestMaxInFlight(c *C) {
+	l, err := NewLeastConnWithOptions(Options{MaxInFlight: 1})
+	c.Assert(err, IsNil)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	l.AddEndpoint(a)
+	l.AddEndpoint(b)
+
+	e1, _ := l.NextEndpoint(s.req)
+	e2, _ := l.NextEndpoint(s.req)
+	c.Assert(e1, Not(Equals), e2)
+	_, err = l.NextEndpoint(s.req)
+	c.Assert(err, Equals, loadbalance.ErrSaturated)
+
+	l.ObserveResponse(s.req, &BaseAttempt{Endpoint: e2})
+	e, err := l.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, e2)
+}
+
+func (s *LeastConnSuite) TestQueueTimeout(c *C) {
+	l, err := NewLeastConnWithOptions(Options{MaxInFlight: 1, QueueTimeout: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+	l.AddEndpoint(MustParseUrl("http://localhost:5000"))
+	_, err = l.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	_, err = l.NextEndpoint(s.req)
+	c.Assert(err, Equals, loadbalance.ErrSaturated)
+	c.Assert(time.Since(start) >= 10*time.Millisecond, Equals, true)
+
+	_, err = NewLeastConnWithOptions(Options{QueueTimeout: -1})
+	c.Assert(err, NotNil)
+}
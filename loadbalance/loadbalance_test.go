@@ -1 +1,125 @@
 package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/metrics"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type QueueSuite struct{}
+
+var _ = Suite(&QueueSuite{})
+
+func (s *QueueSuite) TestNoTimeout(c *C) {
+	q := NewQueue(0)
+	calls := 0
+	_, err := q.Next(&BaseRequest{}, func() (Endpoint, error) {
+		calls += 1
+		return nil, ErrSaturated
+	})
+	c.Assert(err, Equals, ErrSaturated)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *QueueSuite) TestRelease(c *C) {
+	q := NewQueue(10 * time.Second)
+	a := MustParseUrl("http://localhost:5000")
+	readyC := make(chan struct{})
+	resultC := make(chan Endpoint, 1)
+	go func() {
+		calls := 0
+		e, _ := q.Next(&BaseRequest{}, func() (Endpoint, error) {
+			calls += 1
+			if calls == 1 {
+				close(readyC)
+				return nil, ErrSaturated
+			}
+			return a, nil
+		})
+		resultC <- e
+	}()
+	<-readyC
+	q.Release()
+	c.Assert(<-resultC, Equals, a)
+}
+
+func (s *QueueSuite) TestCanceled(c *C) {
+	q := NewQueue(10 * time.Second)
+	req := &BaseRequest{}
+	ctx, cancel := context.WithCancel(context.Background())
+	req.SetContext(ctx)
+	cancel()
+	_, err := q.Next(req, func() (Endpoint, error) {
+		return nil, ErrSaturated
+	})
+	c.Assert(err, Equals, ErrSaturated)
+}
+
+type SnapshotSuite struct{}
+
+var _ = Suite(&SnapshotSuite{})
+
+func (s *SnapshotSuite) TestSnapshot(c *C) {
+	m, err := metrics.NewEndpointMetrics(metrics.RoundTripOptions{})
+	c.Assert(err, IsNil)
+	e, err := ParseUrlWithLocality("http://localhost:5000", Locality{Zone: "us-east-1a"})
+	c.Assert(err, IsNil)
+
+	observe := func(a *BaseAttempt) {
+		a.Endpoint = e
+		a.Duration = 10 * time.Millisecond
+		m.ObserveResponse(&BaseRequest{}, a)
+	}
+	observe(&BaseAttempt{Response: &http.Response{StatusCode: http.StatusOK}})
+	observe(&BaseAttempt{Response: &http.Response{StatusCode: http.StatusNotFound}})
+	observe(&BaseAttempt{Response: &http.Response{StatusCode: http.StatusBadGateway}})
+	observe(&BaseAttempt{Error: fmt.Errorf("connection refused")})
+
+	snapshot := NewEndpointSnapshot(e, m)
+	c.Assert(snapshot.Id, Equals, e.GetId())
+	c.Assert(snapshot.Url, Equals, "http://localhost:5000")
+	c.Assert(snapshot.Labels, DeepEquals, map[string]string{LabelZone: "us-east-1a"})
+	c.Assert(snapshot.Successes, Equals, int64(2))
+	c.Assert(snapshot.Failures, Equals, int64(2))
+	c.Assert(snapshot.LatencyP50 > 0, Equals, true)
+	c.Assert(snapshot.Healthy, Equals, true)
+
+	// Endpoint without requests has no stats yet
+	snapshot = NewEndpointSnapshot(MustParseUrl("http://localhost:5001"), m)
+	c.Assert(snapshot.Labels, IsNil)
+	c.Assert(snapshot.Successes, Equals, int64(0))
+	c.Assert(snapshot.LatencyP99, Equals, time.Duration(0))
+}
+
+type HelpersSuite struct{}
+
+var _ = Suite(&HelpersSuite{})
+
+func (s *HelpersSuite) TestHasAttempted(c *C) {
+	a, b := MustParseUrl("http://localhost:5000"), MustParseUrl("http://localhost:5001")
+	req := &BaseRequest{}
+	c.Assert(HasAttempted(req, a), Equals, false)
+
+	req.AddAttempt(&BaseAttempt{Endpoint: a})
+	c.Assert(HasAttempted(req, a), Equals, true)
+	c.Assert(HasAttempted(req, b), Equals, false)
+}
+
+func (s *HelpersSuite) TestFindEndpointByUrl(c *C) {
+	endpoints := []Endpoint{MustParseUrl("http://localhost:5000"), MustParseUrl("http://localhost:5001/path")}
+	urlAt := func(i int) *url.URL { return endpoints[i].GetUrl() }
+
+	c.Assert(FindEndpointByUrl(len(endpoints), urlAt, endpoints[1].GetUrl()), Equals, 1)
+	c.Assert(FindEndpointByUrl(len(endpoints), urlAt, MustParseUrl("https://localhost:5000").GetUrl()), Equals, -1)
+	c.Assert(FindEndpointByUrl(0, urlAt, endpoints[0].GetUrl()), Equals, -1)
+}
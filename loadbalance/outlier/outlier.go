@@ -0,0 +1,269 @@
+// Passive outlier detection and ejection of the failing endpoints
+package outlier
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Balancer is the load balancer that the detector ejects outliers from, e.g. round robin.
+type Balancer interface {
+	AddEndpoint(endpoint.Endpoint) error
+	RemoveEndpoint(endpoint.Endpoint) error
+}
+
+// Detector watches the results of the requests to the endpoints and temporarily removes
+// endpoints from the balancer if they fail too many requests in a row or their failure rate
+// is too high. Each subsequent ejection of the same endpoint lasts twice as long, up to MaxEjectionTime.
+// Detector should be added to the location's observer chain to see the requests.
+type Detector struct {
+	balancer Balancer
+	options  Options
+	mutex    *sync.Mutex
+	targets  map[string]*target
+}
+
+type Options struct {
+	// Endpoint is ejected after this many failed requests in a row
+	ConsecutiveFailures int
+	// Endpoint is ejected if its failure rate within the rolling window exceeds this value, 0 disables the check
+	FailureRate float64
+	// Minimum number of requests in the window to calculate the failure rate
+	MinRequests int64
+	// Rolling window to calculate the failure rate
+	Window time.Duration
+	// Duration of the first ejection
+	BaseEjectionTime time.Duration
+	// Maximum duration of the ejection
+	MaxEjectionTime time.Duration
+	// Maximum percentage of the endpoints that can be ejected at the same time
+	MaxEjectionPercent int
+	// Tells whether the attempt has failed, network errors and 5xx responses by default
+	IsFailure metrics.FailPredicate
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultConsecutiveFailures = 5
+	DefaultMinRequests         = 10
+	DefaultWindow              = 10 * time.Second
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 300 * time.Second
+	DefaultMaxEjectionPercent  = 50
+)
+
+type target struct {
+	endpoint    endpoint.Endpoint
+	meter       *metrics.RollingMeter
+	consecutive int
+	ejected     bool
+	ejections   int
+	ejectedTill time.Time
+}
+
+// IsServerError treats network errors and 5xx responses as failures
+func IsServerError(a request.Attempt) bool {
+	if metrics.IsNetworkError(a) {
+		return true
+	}
+	return a != nil && a.GetResponse() != nil && a.GetResponse().StatusCode >= http.StatusInternalServerError
+}
+
+func NewDetector(b Balancer) (*Detector, error) {
+	return NewDetectorWithOptions(b, Options{})
+}
+
+func NewDetectorWithOptions(b Balancer, o Options) (*Detector, error) {
+	if b == nil {
+		return nil, fmt.Errorf("Provide balancer")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Detector{
+		balancer: b,
+		options:  o,
+		mutex:    &sync.Mutex{},
+		targets:  make(map[string]*target),
+	}, nil
+}
+
+// AddEndpoint adds the endpoint to the balancer and starts watching it
+func (d *Detector) AddEndpoint(e endpoint.Endpoint) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	if _, exists := d.targets[e.GetId()]; exists {
+		return fmt.Errorf("Endpoint %s already exists", e.GetId())
+	}
+	meter, err := metrics.NewRollingMeter(e, int(d.options.Window/time.Second), time.Second, d.options.TimeProvider, d.options.IsFailure)
+	if err != nil {
+		return err
+	}
+	if err := d.balancer.AddEndpoint(e); err != nil {
+		return err
+	}
+	d.targets[e.GetId()] = &target{endpoint: e, meter: meter}
+	return nil
+}
+
+// RemoveEndpoint stops watching the endpoint and removes it from the balancer unless it's ejected
+func (d *Detector) RemoveEndpoint(e endpoint.Endpoint) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	t, exists := d.targets[e.GetId()]
+	if !exists {
+		return fmt.Errorf("Endpoint %s not found", e.GetId())
+	}
+	delete(d.targets, e.GetId())
+	if !t.ejected {
+		return d.balancer.RemoveEndpoint(t.endpoint)
+	}
+	return nil
+}
+
+func (d *Detector) IsEjected(e endpoint.Endpoint) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	t, exists := d.targets[e.GetId()]
+	return exists && t.ejected
+}
+
+// ObserveRequest puts back the endpoints whose ejection time is over
+func (d *Detector) ObserveRequest(request.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.reinstate()
+}
+
+func (d *Detector) ObserveResponse(req request.Request, a request.Attempt) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.reinstate()
+
+	if a == nil || a.GetEndpoint() == nil {
+		return
+	}
+	t, exists := d.targets[a.GetEndpoint().GetId()]
+	// Ignore late responses from the ejected endpoints
+	if !exists || t.ejected {
+		return
+	}
+
+	t.meter.ObserveResponse(req, a)
+	if d.options.IsFailure(a) {
+		t.consecutive += 1
+	} else {
+		t.consecutive = 0
+	}
+
+	if t.consecutive >= d.options.ConsecutiveFailures {
+		d.eject(t, fmt.Sprintf("%d consecutive failures", t.consecutive))
+		return
+	}
+	if d.options.FailureRate > 0 && t.meter.ProcessedCount() >= d.options.MinRequests && t.meter.GetRate() > d.options.FailureRate {
+		d.eject(t, fmt.Sprintf("failure rate %f", t.meter.GetRate()))
+	}
+}
+
+func (d *Detector) eject(t *target, reason string) {
+	ejected := 0
+	for _, o := range d.targets {
+		if o.ejected {
+			ejected += 1
+		}
+	}
+	if (ejected+1)*100 > len(d.targets)*d.options.MaxEjectionPercent {
+		log.Infof("%s is an outlier (%s), but too many endpoints are ejected already", t.endpoint, reason)
+		return
+	}
+
+	now := d.options.TimeProvider.UtcNow()
+	// Endpoint that has behaved well for a while starts over with the base ejection time
+	if now.Sub(t.ejectedTill) > d.options.MaxEjectionTime {
+		t.ejections = 0
+	}
+	duration := d.options.BaseEjectionTime << uint(t.ejections)
+	if duration > d.options.MaxEjectionTime || duration <= 0 {
+		duration = d.options.MaxEjectionTime
+	}
+
+	if err := d.balancer.RemoveEndpoint(t.endpoint); err != nil {
+		log.Errorf("Failed to eject %s: %s", t.endpoint, err)
+		return
+	}
+	log.Infof("%s is an outlier (%s), ejecting for %s", t.endpoint, reason, duration)
+	t.ejected = true
+	t.ejections += 1
+	t.ejectedTill = now.Add(duration)
+}
+
+func (d *Detector) reinstate() {
+	now := d.options.TimeProvider.UtcNow()
+	for _, t := range d.targets {
+		if !t.ejected || now.Before(t.ejectedTill) {
+			continue
+		}
+		if err := d.balancer.AddEndpoint(t.endpoint); err != nil {
+			log.Errorf("Failed to reinstate %s: %s", t.endpoint, err)
+			continue
+		}
+		log.Infof("%s ejection is over, reinstating", t.endpoint)
+		t.ejected = false
+		t.consecutive = 0
+		t.meter.Reset()
+	}
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.ConsecutiveFailures < 0 || o.FailureRate < 0 || o.FailureRate > 1 || o.MinRequests < 0 {
+		return o, fmt.Errorf("Invalid failure thresholds")
+	}
+	if o.BaseEjectionTime < 0 || o.MaxEjectionTime < 0 || o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return o, fmt.Errorf("Invalid ejection settings")
+	}
+	if o.Window != 0 && o.Window < time.Second {
+		return o, fmt.Errorf("Window should be at least a second")
+	}
+	if o.ConsecutiveFailures == 0 {
+		o.ConsecutiveFailures = DefaultConsecutiveFailures
+	}
+	if o.MinRequests == 0 {
+		o.MinRequests = DefaultMinRequests
+	}
+	if o.Window == 0 {
+		o.Window = DefaultWindow
+	}
+	if o.BaseEjectionTime == 0 {
+		o.BaseEjectionTime = DefaultBaseEjectionTime
+	}
+	if o.MaxEjectionTime == 0 {
+		o.MaxEjectionTime = DefaultMaxEjectionTime
+	}
+	if o.MaxEjectionPercent == 0 {
+		o.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+	if o.IsFailure == nil {
+		o.IsFailure = IsServerError
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
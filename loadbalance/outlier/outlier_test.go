@@ -0,0 +1,169 @@
+package outlier
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type OutlierSuite struct {
+	tm  *timetools.FreezedTime
+	rr  *roundrobin.RoundRobin
+	req Request
+	a   Endpoint
+	b   Endpoint
+}
+
+var _ = Suite(&OutlierSuite{})
+
+func (s *OutlierSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	rr, err := roundrobin.NewRoundRobinWithOptions(roundrobin.Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	s.rr = rr
+	s.req = &BaseRequest{}
+	s.a = MustParseUrl("http://localhost:5000")
+	s.b = MustParseUrl("http://localhost:5001")
+}
+
+func (s *OutlierSuite) newDetector(c *C, o Options) *Detector {
+	o.TimeProvider = s.tm
+	d, err := NewDetectorWithOptions(s.rr, o)
+	c.Assert(err, IsNil)
+	c.Assert(d.AddEndpoint(s.a), IsNil)
+	c.Assert(d.AddEndpoint(s.b), IsNil)
+	return d
+}
+
+func (s *OutlierSuite) TestBadParams(c *C) {
+	_, err := NewDetector(nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewDetectorWithOptions(s.rr, Options{FailureRate: 2})
+	c.Assert(err, NotNil)
+
+	_, err = NewDetectorWithOptions(s.rr, Options{MaxEjectionPercent: 101})
+	c.Assert(err, NotNil)
+}
+
+func (s *OutlierSuite) TestConsecutiveFailures(c *C) {
+	d := s.newDetector(c, Options{ConsecutiveFailures: 3})
+
+	s.fail(d, s.a, 2)
+	// Success resets the counter
+	s.succeed(d, s.a, 1)
+	s.fail(d, s.a, 2)
+	c.Assert(d.IsEjected(s.a), Equals, false)
+
+	s.fail(d, s.a, 1)
+	c.Assert(d.IsEjected(s.a), Equals, true)
+	c.Assert(s.rr.FindEndpointById(s.a.GetId()), IsNil)
+}
+
+func (s *OutlierSuite) TestServerErrors(c *C) {
+	d := s.newDetector(c, Options{ConsecutiveFailures: 2})
+
+	for i := 0; i < 2; i++ {
+		d.ObserveResponse(s.req, &BaseAttempt{Endpoint: s.a, Response: &http.Response{StatusCode: 503}})
+	}
+	c.Assert(d.IsEjected(s.a), Equals, true)
+}
+
+func (s *OutlierSuite) TestFailureRate(c *C) {
+	d := s.newDetector(c, Options{ConsecutiveFailures: 100, FailureRate: 0.4, MinRequests: 10})
+
+	for i := 0; i < 4; i++ {
+		s.succeed(d, s.a, 1)
+		s.fail(d, s.a, 1)
+	}
+	// Not enough requests yet
+	c.Assert(d.IsEjected(s.a), Equals, false)
+
+	s.succeed(d, s.a, 1)
+	s.fail(d, s.a, 1)
+	c.Assert(d.IsEjected(s.a), Equals, true)
+}
+
+func (s *OutlierSuite) TestExponentialEjection(c *C) {
+	d := s.newDetector(c, Options{ConsecutiveFailures: 1, BaseEjectionTime: 10 * time.Second, MaxEjectionTime: 30 * time.Second})
+
+	s.fail(d, s.a, 1)
+	c.Assert(d.IsEjected(s.a), Equals, true)
+
+	s.advance(d, 9*time.Second)
+	c.Assert(d.IsEjected(s.a), Equals, true)
+	s.advance(d, time.Second)
+	c.Assert(d.IsEjected(s.a), Equals, false)
+	c.Assert(s.rr.FindEndpointById(s.a.GetId()), NotNil)
+
+	// Second ejection lasts twice as long
+	s.fail(d, s.a, 1)
+	s.advance(d, 19*time.Second)
+	c.Assert(d.IsEjected(s.a), Equals, true)
+	s.advance(d, time.Second)
+	c.Assert(d.IsEjected(s.a), Equals, false)
+
+	// Third ejection is capped by the max ejection time
+	s.fail(d, s.a, 1)
+	s.advance(d, 30*time.Second)
+	c.Assert(d.IsEjected(s.a), Equals, false)
+
+	// Endpoint has been fine for a while, so it starts over
+	s.advance(d, time.Minute)
+	s.fail(d, s.a, 1)
+	s.advance(d, 10*time.Second)
+	c.Assert(d.IsEjected(s.a), Equals, false)
+}
+
+func (s *OutlierSuite) TestMaxEjectionPercent(c *C) {
+	d := s.newDetector(c, Options{ConsecutiveFailures: 1})
+
+	s.fail(d, s.a, 1)
+	c.Assert(d.IsEjected(s.a), Equals, true)
+
+	// Ejecting b would eject 100% of endpoints
+	s.fail(d, s.b, 1)
+	c.Assert(d.IsEjected(s.b), Equals, false)
+}
+
+func (s *OutlierSuite) TestRemoveEndpoint(c *C) {
+	d := s.newDetector(c, Options{ConsecutiveFailures: 1})
+
+	s.fail(d, s.a, 1)
+	c.Assert(d.RemoveEndpoint(s.a), IsNil)
+	c.Assert(d.RemoveEndpoint(s.a), NotNil)
+
+	// Removed endpoint is not reinstated
+	s.advance(d, time.Hour)
+	c.Assert(s.rr.FindEndpointById(s.a.GetId()), IsNil)
+	c.Assert(d.RemoveEndpoint(s.b), IsNil)
+	c.Assert(len(s.rr.GetEndpoints()), Equals, 0)
+}
+
+func (s *OutlierSuite) fail(d *Detector, e Endpoint, count int) {
+	for i := 0; i < count; i++ {
+		d.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Error: fmt.Errorf("failed")})
+	}
+}
+
+func (s *OutlierSuite) succeed(d *Detector, e Endpoint, count int) {
+	for i := 0; i < count; i++ {
+		d.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Response: &http.Response{StatusCode: 200}})
+	}
+}
+
+func (s *OutlierSuite) advance(d *Detector, duration time.Duration) {
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(duration)
+	d.ObserveRequest(s.req)
+}
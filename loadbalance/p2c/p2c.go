@@ -0,0 +1,298 @@
+// Power of two choices load balancer
+package p2c
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/outlier"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/request"
+)
+
+// P2C picks two random endpoints and sends the request to the less loaded one.
+// The load is the number of requests in flight weighted by the moving average of the endpoint latency.
+// Unlike least connections, it does not scan all the endpoints and avoids herding
+// on the single least loaded endpoint. Failed attempts count as at least FailurePenalty, otherwise
+// the endpoint that fails fast would look like the least loaded one and win most of the choices.
+type P2C struct {
+	mutex     *sync.Mutex
+	endpoints []*LoadEndpoint
+	options   Options
+	queue     *loadbalance.Queue
+	stats     *metrics.EndpointMetrics
+}
+
+type Options struct {
+	// Smoothing factor of the latency moving average
+	Alpha float64
+	// Random numbers source, useful in tests
+	Rand *rand.Rand
+	// Endpoint with this many requests in flight is skipped, 0 means no limit
+	MaxInFlight int64
+	// How long the request waits for an endpoint when all of them are at their limit,
+	// 0 means it fails with loadbalance.ErrSaturated right away
+	QueueTimeout time.Duration
+	// Failed attempts are observed with at least this latency, DefaultFailurePenalty by default
+	FailurePenalty time.Duration
+	// Tells whether the attempt has failed, network errors and 5xx responses by default
+	IsFailure metrics.FailPredicate
+}
+
+const (
+	DefaultAlpha          = 0.3
+	DefaultFailurePenalty = time.Second
+)
+
+// LoadEndpoint wraps the endpoint and tracks its load.
+type LoadEndpoint struct {
+	endpoint endpoint.Endpoint
+	inFlight int64
+	latency  *metrics.EWMA
+}
+
+func (le *LoadEndpoint) String() string {
+	return fmt.Sprintf("LoadEndpoint(id=%s, url=%s, inFlight=%d, latency=%s)",
+		le.GetId(), le.GetUrl(), le.inFlight, time.Duration(le.latency.Value()))
+}
+
+func (le *LoadEndpoint) GetId() string {
+	return le.endpoint.GetId()
+}
+
+func (le *LoadEndpoint) GetUrl() *url.URL {
+	return le.endpoint.GetUrl()
+}
+
+func (le *LoadEndpoint) GetOriginalEndpoint() endpoint.Endpoint {
+	return le.endpoint
+}
+
+// Requests with unknown latency are compared by the number of requests in flight only
+func (le *LoadEndpoint) lessLoaded(o *LoadEndpoint) bool {
+	if !le.latency.IsSet() || !o.latency.IsSet() {
+		return le.inFlight < o.inFlight
+	}
+	return float64(le.inFlight+1)*le.latency.Value() < float64(o.inFlight+1)*o.latency.Value()
+}
+
+func NewP2C() (*P2C, error) {
+	return NewP2CWithOptions(Options{})
+}
+
+func NewP2CWithOptions(o Options) (*P2C, error) {
+	o, err := validateOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := metrics.NewEndpointMetrics(metrics.RoundTripOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &P2C{
+		mutex:     &sync.Mutex{},
+		endpoints: []*LoadEndpoint{},
+		options:   o,
+		queue:     loadbalance.NewQueue(o.QueueTimeout),
+		stats:     stats,
+	}, nil
+}
+
+// NextEndpoint selects the endpoint and counts the request as in flight to it,
+// the request is done once the location reports the attempt with ObserveResponse.
+// If all the endpoints are at their limit of requests in flight, the request waits in the queue for up to QueueTimeout.
+func (p *P2C) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	return p.queue.Next(req, func() (endpoint.Endpoint, error) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return p.nextEndpoint(req)
+	})
+}
+
+func (p *P2C) nextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	if len(p.endpoints) == 0 {
+		return nil, fmt.Errorf("No endpoints")
+	}
+
+	available := make([]*LoadEndpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if !p.isSaturated(e) {
+			available = append(available, e)
+		}
+	}
+	if len(available) == 0 {
+		return nil, loadbalance.ErrSaturated
+	}
+
+	// On failover, prefer endpoints we have not tried yet
+	candidates := make([]*LoadEndpoint, 0, len(available))
+	for _, e := range available {
+		if !loadbalance.HasAttempted(req, e.endpoint) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = available
+	}
+
+	e := candidates[0]
+	if len(candidates) > 1 {
+		i := p.options.Rand.Intn(len(candidates))
+		// Second choice is different from the first one
+		j := p.options.Rand.Intn(len(candidates) - 1)
+		if j >= i {
+			j += 1
+		}
+		e = candidates[i]
+		if candidates[j].lessLoaded(e) {
+			e = candidates[j]
+		}
+	}
+	e.inFlight += 1
+	return e.endpoint, nil
+}
+
+func (p *P2C) isSaturated(e *LoadEndpoint) bool {
+	return p.options.MaxInFlight > 0 && e.inFlight >= p.options.MaxInFlight
+}
+
+func (p *P2C) GetEndpoints() []*LoadEndpoint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]*LoadEndpoint{}, p.endpoints...)
+}
+
+// GetLoad returns the number of requests in flight and the average latency of the endpoint with the given id
+func (p *P2C) GetLoad(id string) (int64, time.Duration, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, e := range p.endpoints {
+		if e.GetId() == id {
+			return e.inFlight, time.Duration(e.latency.Value()), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Endpoint not found")
+}
+
+// GetSnapshot returns the state of the endpoints, P2C does not exclude any endpoints, so all of them are healthy
+func (p *P2C) GetSnapshot() []loadbalance.EndpointSnapshot {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	out := make([]loadbalance.EndpointSnapshot, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		s := loadbalance.NewEndpointSnapshot(e.endpoint, p.stats)
+		s.InFlight = e.inFlight
+		out = append(out, s)
+	}
+	loadbalance.SortSnapshot(out)
+	return out
+}
+
+// In case if endpoint is already present in the load balancer, returns error
+func (p *P2C) AddEndpoint(e endpoint.Endpoint) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	if found, _ := p.findEndpointByUrl(e.GetUrl()); found != nil {
+		return fmt.Errorf("Endpoint already exists")
+	}
+	latency, err := metrics.NewEWMA(p.options.Alpha)
+	if err != nil {
+		return err
+	}
+	p.endpoints = append(p.endpoints, &LoadEndpoint{endpoint: e, latency: latency})
+	// Queued requests can go to the new endpoint
+	p.queue.Release()
+	return nil
+}
+
+func (p *P2C) RemoveEndpoint(e endpoint.Endpoint) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	found, index := p.findEndpointByUrl(e.GetUrl())
+	if found == nil {
+		return fmt.Errorf("Endpoint not found")
+	}
+	p.endpoints = append(p.endpoints[:index], p.endpoints[index+1:]...)
+	p.stats.Remove(found.GetId())
+	return nil
+}
+
+func (p *P2C) ProcessRequest(request.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (p *P2C) ProcessResponse(req request.Request, a request.Attempt) {
+}
+
+func (p *P2C) ObserveRequest(request.Request) {
+}
+
+func (p *P2C) ObserveResponse(req request.Request, a request.Attempt) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if a == nil || a.GetEndpoint() == nil {
+		return
+	}
+	e, _ := p.findEndpointByUrl(a.GetEndpoint().GetUrl())
+	if e == nil {
+		return
+	}
+	p.stats.ObserveResponse(req, a)
+	if e.inFlight > 0 {
+		e.inFlight -= 1
+	}
+	latency := a.GetDuration()
+	if p.options.IsFailure(a) && latency < p.options.FailurePenalty {
+		latency = p.options.FailurePenalty
+	}
+	if latency > 0 {
+		e.latency.Observe(float64(latency))
+	}
+	p.queue.Release()
+}
+
+func (p *P2C) findEndpointByUrl(iu *url.URL) (*LoadEndpoint, int) {
+	i := loadbalance.FindEndpointByUrl(len(p.endpoints), func(i int) *url.URL { return p.endpoints[i].GetUrl() }, iu)
+	if i == -1 {
+		return nil, -1
+	}
+	return p.endpoints[i], i
+}
+
+func validateOptions(o Options) (Options, error) {
+	if o.Alpha == 0 {
+		o.Alpha = DefaultAlpha
+	}
+	if o.Alpha < 0 || o.Alpha > 1 {
+		return o, fmt.Errorf("Alpha should be in range (0, 1]")
+	}
+	if o.MaxInFlight < 0 || o.QueueTimeout < 0 {
+		return o, fmt.Errorf("MaxInFlight and QueueTimeout can not be negative")
+	}
+	if o.FailurePenalty < 0 {
+		return o, fmt.Errorf("FailurePenalty can not be negative")
+	}
+	if o.FailurePenalty == 0 {
+		o.FailurePenalty = DefaultFailurePenalty
+	}
+	if o.IsFailure == nil {
+		o.IsFailure = outlier.IsServerError
+	}
+	if o.Rand == nil {
+		o.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return o, nil
+}
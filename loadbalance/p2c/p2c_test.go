@@ -0,0 +1,169 @@
+package p2c
+
+import (
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type P2CSuite struct {
+	req Request
+}
+
+var _ = Suite(&P2CSuite{})
+
+func (s *P2CSuite) SetUpTest(c *C) {
+	s.req = &BaseRequest{}
+}
+
+func (s *P2CSuite) newP2C(c *C) *P2C {
+	p, err := NewP2CWithOptions(Options{Rand: rand.New(rand.NewSource(1))})
+	c.Assert(err, IsNil)
+	return p
+}
+
+func (s *P2CSuite) TestNoEndpoints(c *C) {
+	p := s.newP2C(c)
+	_, err := p.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+}
+
+func (s *P2CSuite) TestBadOptions(c *C) {
+	_, err := NewP2CWithOptions(Options{Alpha: 2})
+	c.Assert(err, NotNil)
+}
+
+func (s *P2CSuite) TestAddRemove(c *C) {
+	p := s.newP2C(c)
+	a := MustParseUrl("http://localhost:5000")
+	c.Assert(p.AddEndpoint(a), IsNil)
+	c.Assert(p.AddEndpoint(a), NotNil)
+	c.Assert(p.RemoveEndpoint(a), IsNil)
+	c.Assert(p.RemoveEndpoint(a), NotNil)
+	c.Assert(len(p.GetEndpoints()), Equals, 0)
+}
+
+func (s *P2CSuite) TestSingleEndpoint(c *C) {
+	p := s.newP2C(c)
+	a := MustParseUrl("http://localhost:5000")
+	p.AddEndpoint(a)
+	for i := 0; i < 3; i++ {
+		e, err := p.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(e, Equals, a)
+	}
+	inFlight, _, err := p.GetLoad(a.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(inFlight, Equals, int64(3))
+}
+
+// With two endpoints both are always sampled, so the less loaded one wins
+func (s *P2CSuite) TestPicksLessInFlight(c *C) {
+	p := s.newP2C(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	p.AddEndpoint(a)
+	p.AddEndpoint(b)
+
+	e1, _ := p.NextEndpoint(s.req)
+	e2, _ := p.NextEndpoint(s.req)
+	c.Assert(e1, Not(Equals), e2)
+
+	p.ObserveResponse(s.req, &BaseAttempt{Endpoint: e1})
+	for i := 0; i < 5; i++ {
+		e, _ := p.NextEndpoint(s.req)
+		c.Assert(e, Equals, e1)
+		p.ObserveResponse(s.req, &BaseAttempt{Endpoint: e})
+	}
+}
+
+func (s *P2CSuite) TestPicksLowerLatency(c *C) {
+	p := s.newP2C(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	p.AddEndpoint(a)
+	p.AddEndpoint(b)
+
+	p.ObserveResponse(s.req, &BaseAttempt{Endpoint: a, Duration: 100 * time.Millisecond})
+	p.ObserveResponse(s.req, &BaseAttempt{Endpoint: b, Duration: 10 * time.Millisecond})
+
+	_, latency, _ := p.GetLoad(a.GetId())
+	c.Assert(latency, Equals, 100*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		e, _ := p.NextEndpoint(s.req)
+		c.Assert(e, Equals, b)
+		p.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Duration: 10 * time.Millisecond})
+	}
+}
+
+func (s *P2CSuite) TestFailoverAvoidsAttempted(c *C) {
+	p := s.newP2C(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	p.AddEndpoint(a)
+	p.AddEndpoint(b)
+
+	req := &BaseRequest{}
+	req.AddAttempt(&BaseAttempt{Endpoint: a})
+	for i := 0; i < 5; i++ {
+		e, err := p.NextEndpoint(req)
+		c.Assert(err, IsNil)
+		c.Assert(e, Equals, b)
+	}
+}
+
+func (s *P2CSuite) TestMaxInFlight(c *C) {
+	p, err := NewP2CWithOptions(Options{Rand: rand.New(rand.NewSource(1)), MaxInFlight: 2})
+	c.Assert(err, IsNil)
+	a := MustParseUrl("http://localhost:5000")
+	p.AddEndpoint(a)
+
+	for i := 0; i < 2; i++ {
+		_, err := p.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+	}
+	_, err = p.NextEndpoint(s.req)
+	c.Assert(err, Equals, loadbalance.ErrSaturated)
+
+	// New endpoint takes the requests the saturated one can't
+	b := MustParseUrl("http://localhost:5001")
+	p.AddEndpoint(b)
+	e, err := p.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, b)
+}
+
+// Endpoint that replies with 503 right away loses the choices to the healthy one
+func (s *P2CSuite) TestPenalizesFastFailures(c *C) {
+	p := s.newP2C(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	p.AddEndpoint(a)
+	p.AddEndpoint(b)
+
+	p.ObserveResponse(s.req, &BaseAttempt{Endpoint: a, Duration: time.Millisecond, Response: &http.Response{StatusCode: http.StatusServiceUnavailable}})
+	p.ObserveResponse(s.req, &BaseAttempt{Endpoint: b, Duration: 50 * time.Millisecond})
+
+	_, latency, _ := p.GetLoad(a.GetId())
+	c.Assert(latency, Equals, DefaultFailurePenalty)
+
+	for i := 0; i < 5; i++ {
+		e, _ := p.NextEndpoint(s.req)
+		c.Assert(e, Equals, b)
+		p.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Duration: 50 * time.Millisecond})
+	}
+}
+
+func (s *P2CSuite) TestBadFailurePenalty(c *C) {
+	_, err := NewP2CWithOptions(Options{FailurePenalty: -1})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,392 @@
+// Priority load balancer that sends the requests to the failover pools when the primary pool degrades
+package priority
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/outlier"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Balancer distributes the requests among the endpoints of the same tier, e.g. round robin
+type Balancer interface {
+	loadbalance.LoadBalancer
+	AddEndpoint(endpoint.Endpoint) error
+	RemoveEndpoint(endpoint.Endpoint) error
+}
+
+// Priority groups the endpoints into tiers by their priority, 0 is the highest one, e.g. the endpoints
+// in the primary datacenter have priority 0 and the endpoints in the backup one have priority 1.
+// Requests go to the tier with the highest priority while it is healthy and has capacity,
+// and spill over to the next tier when:
+//
+//   - the share of the healthy endpoints in the tier drops below MinHealthyRatio, the tier keeps
+//     the healthy share / MinHealthyRatio part of the requests then
+//   - the requests in flight per healthy endpoint of the tier reach MaxInFlight
+//
+// Endpoint is unhealthy while its failure rate within the rolling window exceeds MaxFailureRate.
+// If no tier can take the request, it goes to the tier with the highest priority.
+type Priority struct {
+	options   Options
+	mutex     *sync.Mutex
+	tiers     []*tier
+	endpoints map[string]*priorityEndpoint
+	stats     *metrics.EndpointMetrics
+}
+
+type Options struct {
+	// Tier keeps all the requests while this share of its endpoints is healthy
+	MinHealthyRatio float64
+	// Endpoint is unhealthy if its failure rate within the rolling window exceeds this value
+	MaxFailureRate float64
+	// Minimum number of requests in the window to calculate the failure rate
+	MinRequests int64
+	// Rolling window to calculate the failure rate
+	Window time.Duration
+	// Maximum average number of requests in flight per healthy endpoint of the tier, 0 means no limit
+	MaxInFlight int64
+	// Creates the balancer of each tier, round robin by default
+	NewBalancer func() (Balancer, error)
+	// Tells whether the attempt has failed, network errors and 5xx responses by default
+	IsFailure metrics.FailPredicate
+	// Random numbers source, useful in tests
+	Rand *rand.Rand
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultMinHealthyRatio = 0.7
+	DefaultMaxFailureRate  = 0.5
+	DefaultMinRequests     = 10
+	DefaultWindow          = 10 * time.Second
+)
+
+type tier struct {
+	priority  int
+	balancer  Balancer
+	endpoints map[string]*priorityEndpoint
+}
+
+type priorityEndpoint struct {
+	endpoint endpoint.Endpoint
+	tier     *tier
+	meter    *metrics.RollingMeter
+	inFlight int64
+}
+
+func NewPriority() (*Priority, error) {
+	return NewPriorityWithOptions(Options{})
+}
+
+func NewPriorityWithOptions(o Options) (*Priority, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := metrics.NewEndpointMetrics(metrics.RoundTripOptions{TimeProvider: o.TimeProvider})
+	if err != nil {
+		return nil, err
+	}
+	return &Priority{
+		options:   o,
+		mutex:     &sync.Mutex{},
+		endpoints: make(map[string]*priorityEndpoint),
+		stats:     stats,
+	}, nil
+}
+
+func (p *Priority) GetOptions() Options {
+	return p.options
+}
+
+// GetPriority returns the priority the endpoint was added with
+func (p *Priority) GetPriority(e endpoint.Endpoint) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pe, exists := p.endpoints[e.GetId()]
+	if !exists {
+		return -1, fmt.Errorf("Endpoint %s not found", e.GetId())
+	}
+	return pe.tier.priority, nil
+}
+
+// GetPriorities returns the priorities of the tiers that have endpoints, from the highest to the lowest
+func (p *Priority) GetPriorities() []int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	out := make([]int, len(p.tiers))
+	for i, t := range p.tiers {
+		out[i] = t.priority
+	}
+	return out
+}
+
+func (p *Priority) IsHealthy(e endpoint.Endpoint) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pe, exists := p.endpoints[e.GetId()]
+	return exists && p.isHealthy(pe)
+}
+
+// GetSnapshot returns the state of the endpoints of all the tiers, the endpoint is unhealthy
+// while its failure rate exceeds MaxFailureRate
+func (p *Priority) GetSnapshot() []loadbalance.EndpointSnapshot {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	out := make([]loadbalance.EndpointSnapshot, 0, len(p.endpoints))
+	for _, pe := range p.endpoints {
+		s := loadbalance.NewEndpointSnapshot(pe.endpoint, p.stats)
+		s.InFlight = pe.inFlight
+		s.Healthy = p.isHealthy(pe)
+		out = append(out, s)
+	}
+	loadbalance.SortSnapshot(out)
+	return out
+}
+
+// AddEndpoint adds the endpoint with the highest priority 0
+func (p *Priority) AddEndpoint(e endpoint.Endpoint) error {
+	return p.AddEndpointWithPriority(e, 0)
+}
+
+func (p *Priority) AddEndpointWithPriority(e endpoint.Endpoint, priority int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	if priority < 0 {
+		return fmt.Errorf("Priority can not be negative")
+	}
+	if _, exists := p.endpoints[e.GetId()]; exists {
+		return fmt.Errorf("Endpoint %s already exists", e.GetId())
+	}
+	meter, err := metrics.NewRollingMeter(e, int(p.options.Window/time.Second), time.Second, p.options.TimeProvider, p.options.IsFailure)
+	if err != nil {
+		return err
+	}
+	t, err := p.getTier(priority)
+	if err != nil {
+		return err
+	}
+	if err := t.balancer.AddEndpoint(e); err != nil {
+		return err
+	}
+	pe := &priorityEndpoint{endpoint: e, tier: t, meter: meter}
+	t.endpoints[e.GetId()] = pe
+	p.endpoints[e.GetId()] = pe
+	return nil
+}
+
+func (p *Priority) RemoveEndpoint(e endpoint.Endpoint) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pe, exists := p.endpoints[e.GetId()]
+	if !exists {
+		return fmt.Errorf("Endpoint %s not found", e.GetId())
+	}
+	t := pe.tier
+	if err := t.balancer.RemoveEndpoint(pe.endpoint); err != nil {
+		return err
+	}
+	delete(t.endpoints, e.GetId())
+	delete(p.endpoints, e.GetId())
+	p.stats.Remove(e.GetId())
+	if len(t.endpoints) == 0 {
+		for i := range p.tiers {
+			if p.tiers[i] == t {
+				p.tiers = append(p.tiers[:i], p.tiers[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// getTier returns the tier with the given priority, creating it if necessary
+func (p *Priority) getTier(priority int) (*tier, error) {
+	i := sort.Search(len(p.tiers), func(i int) bool { return p.tiers[i].priority >= priority })
+	if i < len(p.tiers) && p.tiers[i].priority == priority {
+		return p.tiers[i], nil
+	}
+	b, err := p.options.NewBalancer()
+	if err != nil {
+		return nil, err
+	}
+	t := &tier{priority: priority, balancer: b, endpoints: make(map[string]*priorityEndpoint)}
+	p.tiers = append(p.tiers, nil)
+	copy(p.tiers[i+1:], p.tiers[i:])
+	p.tiers[i] = t
+	return t, nil
+}
+
+// NextEndpoint selects the tier and lets its balancer choose the endpoint
+func (p *Priority) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	p.mutex.Lock()
+	t := p.selectTier()
+	p.mutex.Unlock()
+	if t == nil {
+		return nil, fmt.Errorf("No endpoints")
+	}
+
+	e, err := t.balancer.NextEndpoint(req)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if pe, exists := p.endpoints[e.GetId()]; exists {
+		pe.inFlight += 1
+	}
+	return e, nil
+}
+
+func (p *Priority) selectTier() *tier {
+	for _, t := range p.tiers {
+		share := p.share(t)
+		if share >= 1 || (share > 0 && p.options.Rand.Float64() < share) {
+			return t
+		}
+	}
+	if len(p.tiers) == 0 {
+		return nil
+	}
+	return p.tiers[0]
+}
+
+// share returns the part of the requests the tier keeps, the rest goes to the next tiers
+func (p *Priority) share(t *tier) float64 {
+	healthy, inFlight := int64(0), int64(0)
+	for _, pe := range t.endpoints {
+		if p.isHealthy(pe) {
+			healthy += 1
+		}
+		inFlight += pe.inFlight
+	}
+	if healthy == 0 {
+		return 0
+	}
+	if p.options.MaxInFlight > 0 && inFlight >= healthy*p.options.MaxInFlight {
+		return 0
+	}
+	ratio := float64(healthy) / float64(len(t.endpoints))
+	if ratio >= p.options.MinHealthyRatio {
+		return 1
+	}
+	return ratio / p.options.MinHealthyRatio
+}
+
+func (p *Priority) isHealthy(pe *priorityEndpoint) bool {
+	return pe.meter.ProcessedCount() < p.options.MinRequests || pe.meter.GetRate() <= p.options.MaxFailureRate
+}
+
+func (p *Priority) balancers() []Balancer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	out := make([]Balancer, len(p.tiers))
+	for i, t := range p.tiers {
+		out[i] = t.balancer
+	}
+	return out
+}
+
+// ProcessRequest lets the balancers of the tiers intercept the request, the first response wins
+func (p *Priority) ProcessRequest(req request.Request) (*http.Response, error) {
+	for _, b := range p.balancers() {
+		if re, err := b.ProcessRequest(req); re != nil || err != nil {
+			return re, err
+		}
+	}
+	return nil, nil
+}
+
+func (p *Priority) ProcessResponse(req request.Request, a request.Attempt) {
+	for _, b := range p.balancers() {
+		b.ProcessResponse(req, a)
+	}
+}
+
+func (p *Priority) ObserveRequest(req request.Request) {
+	for _, b := range p.balancers() {
+		b.ObserveRequest(req)
+	}
+}
+
+func (p *Priority) ObserveResponse(req request.Request, a request.Attempt) {
+	if a == nil || a.GetEndpoint() == nil {
+		return
+	}
+	p.mutex.Lock()
+	pe, exists := p.endpoints[a.GetEndpoint().GetId()]
+	if !exists {
+		p.mutex.Unlock()
+		return
+	}
+	pe.meter.ObserveResponse(req, a)
+	p.stats.ObserveResponse(req, a)
+	if pe.inFlight > 0 {
+		pe.inFlight -= 1
+	}
+	b := pe.tier.balancer
+	p.mutex.Unlock()
+
+	b.ObserveResponse(req, a)
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MinHealthyRatio < 0 || o.MinHealthyRatio > 1 || o.MaxFailureRate < 0 || o.MaxFailureRate > 1 {
+		return o, fmt.Errorf("Ratios should be in range [0, 1]")
+	}
+	if o.MinRequests < 0 || o.MaxInFlight < 0 {
+		return o, fmt.Errorf("MinRequests and MaxInFlight can not be negative")
+	}
+	if o.Window != 0 && o.Window < time.Second {
+		return o, fmt.Errorf("Window should be at least a second")
+	}
+	if o.MinHealthyRatio == 0 {
+		o.MinHealthyRatio = DefaultMinHealthyRatio
+	}
+	if o.MaxFailureRate == 0 {
+		o.MaxFailureRate = DefaultMaxFailureRate
+	}
+	if o.MinRequests == 0 {
+		o.MinRequests = DefaultMinRequests
+	}
+	if o.Window == 0 {
+		o.Window = DefaultWindow
+	}
+	if o.NewBalancer == nil {
+		o.NewBalancer = func() (Balancer, error) {
+			return roundrobin.NewRoundRobin()
+		}
+	}
+	if o.IsFailure == nil {
+		o.IsFailure = outlier.IsServerError
+	}
+	if o.Rand == nil {
+		o.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
@@ -0,0 +1,173 @@
+package priority
+
+import (
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PrioritySuite struct {
+	tm  *timetools.FreezedTime
+	req Request
+	a   Endpoint
+	b   Endpoint
+	c   Endpoint
+}
+
+var _ = Suite(&PrioritySuite{})
+
+func (s *PrioritySuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	s.req = &BaseRequest{}
+	s.a = MustParseUrl("http://localhost:5000")
+	s.b = MustParseUrl("http://localhost:5001")
+	s.c = MustParseUrl("http://localhost:5002")
+}
+
+func (s *PrioritySuite) newPriority(c *C, o Options) *Priority {
+	o.TimeProvider = s.tm
+	o.Rand = rand.New(rand.NewSource(1))
+	o.NewBalancer = func() (Balancer, error) {
+		return roundrobin.NewRoundRobinWithOptions(roundrobin.Options{TimeProvider: s.tm})
+	}
+	p, err := NewPriorityWithOptions(o)
+	c.Assert(err, IsNil)
+	return p
+}
+
+func (s *PrioritySuite) TestBadParams(c *C) {
+	_, err := NewPriorityWithOptions(Options{MaxFailureRate: 2})
+	c.Assert(err, NotNil)
+
+	_, err = NewPriorityWithOptions(Options{MaxInFlight: -1})
+	c.Assert(err, NotNil)
+
+	p := s.newPriority(c, Options{})
+	c.Assert(p.AddEndpointWithPriority(s.a, -1), NotNil)
+	c.Assert(p.AddEndpoint(nil), NotNil)
+}
+
+func (s *PrioritySuite) TestNoEndpoints(c *C) {
+	p := s.newPriority(c, Options{})
+	_, err := p.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+}
+
+func (s *PrioritySuite) TestTiers(c *C) {
+	p := s.newPriority(c, Options{})
+	c.Assert(p.AddEndpointWithPriority(s.c, 5), IsNil)
+	c.Assert(p.AddEndpointWithPriority(s.b, 1), IsNil)
+	c.Assert(p.AddEndpoint(s.a), IsNil)
+	c.Assert(p.AddEndpointWithPriority(s.a, 1), NotNil)
+	c.Assert(p.GetPriorities(), DeepEquals, []int{0, 1, 5})
+
+	priority, err := p.GetPriority(s.b)
+	c.Assert(err, IsNil)
+	c.Assert(priority, Equals, 1)
+
+	// Empty tiers are dropped
+	c.Assert(p.RemoveEndpoint(s.b), IsNil)
+	c.Assert(p.RemoveEndpoint(s.b), NotNil)
+	c.Assert(p.GetPriorities(), DeepEquals, []int{0, 5})
+	_, err = p.GetPriority(s.b)
+	c.Assert(err, NotNil)
+}
+
+func (s *PrioritySuite) TestFailover(c *C) {
+	p := s.newPriority(c, Options{MinRequests: 2})
+	p.AddEndpoint(s.a)
+	p.AddEndpointWithPriority(s.b, 1)
+	p.AddEndpointWithPriority(s.c, 2)
+	c.Assert(s.hits(c, p, 10), DeepEquals, map[Endpoint]int{s.a: 10})
+
+	s.fail(p, s.a, 20)
+	c.Assert(p.IsHealthy(s.a), Equals, false)
+	c.Assert(s.hits(c, p, 10), DeepEquals, map[Endpoint]int{s.b: 10})
+
+	s.fail(p, s.b, 20)
+	c.Assert(s.hits(c, p, 10), DeepEquals, map[Endpoint]int{s.c: 10})
+
+	// Primary pool recovers and takes the traffic back
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(p.GetOptions().Window + time.Second)
+	c.Assert(s.hits(c, p, 10), DeepEquals, map[Endpoint]int{s.a: 10})
+}
+
+func (s *PrioritySuite) TestFallsBackToPrimary(c *C) {
+	p := s.newPriority(c, Options{MinRequests: 1})
+	p.AddEndpoint(s.a)
+	p.AddEndpointWithPriority(s.b, 1)
+	s.fail(p, s.a, 1)
+	s.fail(p, s.b, 1)
+	e, err := p.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, s.a)
+}
+
+// Primary pool with a third of the endpoints down keeps the traffic while the threshold allows it
+func (s *PrioritySuite) TestHealthyRatio(c *C) {
+	p := s.newPriority(c, Options{MinRequests: 1, MinHealthyRatio: 0.6})
+	p.AddEndpoint(s.a)
+	p.AddEndpoint(s.b)
+	p.AddEndpoint(s.c)
+	backup := MustParseUrl("http://localhost:6000")
+	p.AddEndpointWithPriority(backup, 1)
+
+	hits := s.hits(c, p, 10, s.c)
+	c.Assert(hits[backup], Equals, 0)
+
+	// Healthy share 1/3 is below the threshold, so the primary pool keeps (1/3) / 0.6 of the requests
+	hits = s.hits(c, p, 1000, s.b, s.c)
+	c.Assert(hits[backup] > 350, Equals, true)
+	c.Assert(hits[s.a]+hits[s.b]+hits[s.c] > 450, Equals, true)
+}
+
+func (s *PrioritySuite) TestMaxInFlight(c *C) {
+	p := s.newPriority(c, Options{MaxInFlight: 1})
+	p.AddEndpoint(s.a)
+	p.AddEndpointWithPriority(s.b, 1)
+
+	for _, expected := range []Endpoint{s.a, s.b} {
+		e, err := p.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(e, Equals, expected)
+	}
+	p.ObserveResponse(s.req, &BaseAttempt{Endpoint: s.a})
+	e, err := p.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, s.a)
+}
+
+func (s *PrioritySuite) fail(p *Priority, e Endpoint, count int) {
+	for i := 0; i < count; i++ {
+		p.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Response: &http.Response{StatusCode: http.StatusServiceUnavailable}})
+	}
+}
+
+// hits sends the requests that complete right away and counts them per endpoint, failing endpoints return 503
+func (s *PrioritySuite) hits(c *C, p *Priority, count int, failing ...Endpoint) map[Endpoint]int {
+	out := make(map[Endpoint]int)
+	for i := 0; i < count; i++ {
+		e, err := p.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		out[e] += 1
+		code := http.StatusOK
+		for _, f := range failing {
+			if f == e {
+				code = http.StatusServiceUnavailable
+			}
+		}
+		p.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Response: &http.Response{StatusCode: code}})
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+package loadbalance
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/errors"
+	. "github.com/mailgun/vulcan/request"
+)
+
+// ErrSaturated is returned by the balancers when all the endpoints have reached their limit of requests in flight,
+// the proxy replies with 503 Service Unavailable
+var ErrSaturated = errors.FromStatus(http.StatusServiceUnavailable)
+
+// Queue holds the requests while all the endpoints of the balancer are saturated. The balancer calls Release
+// whenever a request to the endpoint completes, so the waiting requests can try again.
+type Queue struct {
+	timeout   time.Duration
+	mutex     *sync.Mutex
+	waiting   int
+	releasedC chan struct{}
+}
+
+// NewQueue creates the queue that holds the requests for up to the timeout, 0 means the requests don't wait
+func NewQueue(timeout time.Duration) *Queue {
+	return &Queue{timeout: timeout, mutex: &sync.Mutex{}, releasedC: make(chan struct{})}
+}
+
+// Next calls next until it returns anything but ErrSaturated. Saturated request waits for the release
+// and returns ErrSaturated once the timeout passes or the request is canceled.
+func (q *Queue) Next(req Request, next func() (Endpoint, error)) (Endpoint, error) {
+	var timeoutC <-chan time.Time
+	for {
+		releasedC := q.wait()
+		e, err := next()
+		if err != ErrSaturated || q.timeout == 0 {
+			q.done()
+			return e, err
+		}
+		if timeoutC == nil {
+			timer := time.NewTimer(q.timeout)
+			defer timer.Stop()
+			timeoutC = timer.C
+		}
+		select {
+		case <-releasedC:
+		case <-timeoutC:
+			q.done()
+			return nil, err
+		case <-req.GetContext().Done():
+			q.done()
+			return nil, err
+		}
+		q.done()
+	}
+}
+
+// Release wakes up the waiting requests
+func (q *Queue) Release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.waiting == 0 {
+		return
+	}
+	close(q.releasedC)
+	q.releasedC = make(chan struct{})
+}
+
+// wait registers the request before it checks the endpoints, so the release that happens in between is not missed
+func (q *Queue) wait() <-chan struct{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.waiting += 1
+	return q.releasedC
+}
+
+func (q *Queue) done() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.waiting -= 1
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/mailgun/log"
 	"github.com/mailgun/timetools"
 	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
 	"github.com/mailgun/vulcan/metrics"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
@@ -17,19 +18,29 @@ import (
 
 // Dynamic weighted round robin load balancer.
 type RoundRobin struct {
-	mutex *sync.Mutex
-	// Current index (starts from -1)
-	index         int
-	endpoints     []*WeightedEndpoint
-	currentWeight int
-	options       Options
+	mutex     *sync.Mutex
+	endpoints []*WeightedEndpoint
+	options   Options
+	queue     *loadbalance.Queue
+	stats     *metrics.EndpointMetrics
 }
 
+// Endpoint with the failure rate above this value is reported unhealthy, see GetSnapshot
+const UnhealthyFailRate = 0.5
+
 type Options struct {
 	// Control time in tests
 	TimeProvider timetools.TimeProvider
 	// Algorithm that reacts on the failures and can adjust weights
 	FailureHandler FailureHandler
+	// Newly added endpoints ramp up their share of traffic from a small value to the full weight
+	// during this period instead of getting the full share right away, 0 disables the slow start
+	SlowStart time.Duration
+	// Endpoint with this many requests in flight is skipped, 0 means no limit. Can be overridden per endpoint
+	MaxInFlight int64
+	// How long the request waits for an endpoint when all of them are at their limit,
+	// 0 means it fails with loadbalance.ErrSaturated right away
+	QueueTimeout time.Duration
 }
 
 // Set additional parameters for the endpoint can be supplied when adding endpoint
@@ -39,6 +50,9 @@ type EndpointOptions struct {
 
 	// Meter tracks the failure count and is used to do failover
 	Meter metrics.FailRateMeter
+
+	// Maximum number of requests in flight to the endpoint, Options.MaxInFlight by default
+	MaxInFlight int64
 }
 
 func NewRoundRobin() (*RoundRobin, error) {
@@ -50,19 +64,37 @@ func NewRoundRobinWithOptions(o Options) (*RoundRobin, error) {
 	if err != nil {
 		return nil, err
 	}
+	stats, err := metrics.NewEndpointMetrics(metrics.RoundTripOptions{TimeProvider: o.TimeProvider})
+	if err != nil {
+		return nil, err
+	}
 	rr := &RoundRobin{
 		options:   o,
-		index:     -1,
 		mutex:     &sync.Mutex{},
 		endpoints: []*WeightedEndpoint{},
+		queue:     loadbalance.NewQueue(o.QueueTimeout),
+		stats:     stats,
 	}
 	return rr, nil
 }
 
+// NextEndpoint selects the endpoint, if all the endpoints are at their limit of requests in flight,
+// the request waits in the queue for up to QueueTimeout.
 func (r *RoundRobin) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	return r.queue.Next(req, func() (endpoint.Endpoint, error) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		e, err := r.selectEndpoint(req)
+		if err != nil {
+			return nil, err
+		}
+		e.inFlight += 1
+		return e.endpoint, nil
+	})
+}
 
+func (r *RoundRobin) selectEndpoint(req request.Request) (*WeightedEndpoint, error) {
 	e, err := r.nextEndpoint(req)
 	if err != nil {
 		return nil, err
@@ -75,20 +107,19 @@ func (r *RoundRobin) NextEndpoint(req request.Request) (endpoint.Endpoint, error
 	// Try to prevent failover to the same endpoint that we've seen before,
 	// that reduces the probability of the scenario when failover hits same endpoint
 	// on the next attempt and fails, so users will see a failed request.
-	var endpoint endpoint.Endpoint
 	for _ = range r.endpoints {
-		endpoint, err = r.nextEndpoint(req)
+		e, err = r.nextEndpoint(req)
 		if err != nil {
 			return nil, err
 		}
-		if !hasAttempted(req, endpoint) {
-			return endpoint, nil
+		if !hasAttempted(req, e.endpoint) {
+			return e, nil
 		}
 	}
-	return endpoint, nil
+	return e, nil
 }
 
-func (r *RoundRobin) nextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+func (r *RoundRobin) nextEndpoint(req request.Request) (*WeightedEndpoint, error) {
 	if len(r.endpoints) == 0 {
 		return nil, fmt.Errorf("No endpoints")
 	}
@@ -96,34 +127,60 @@ func (r *RoundRobin) nextEndpoint(req request.Request) (endpoint.Endpoint, error
 	// Adjust weights based on endpoints failure rates
 	r.adjustWeights()
 
-	// The algo below may look messy, but is actually very simple
-	// it calculates the GCD  and subtracts it on every iteration, what interleaves endpoints
-	// and allows us not to build an iterator every time we readjust weights
-
-	// GCD across all enabled endpoints
-	gcd := r.weightGcd()
-	// Maximum weight across all enabled endpoints
-	max := r.maxWeight()
-
-	for {
-		r.index = (r.index + 1) % len(r.endpoints)
-		if r.index == 0 {
-			r.currentWeight = r.currentWeight - gcd
-			if r.currentWeight <= 0 {
-				r.currentWeight = max
-				if r.currentWeight == 0 {
-					return nil, fmt.Errorf("All endpoints have 0 weight")
-				}
-			}
+	// Smooth weighted round robin: on every pick each endpoint accumulates its weight,
+	// the endpoint with the largest accumulated weight wins and gives back the total weight.
+	// This interleaves endpoints evenly, e.g. weights 5, 1, 1 give a a b a c a a,
+	// and lets the traffic shift gradually when the weights change.
+	var best *WeightedEndpoint
+	total, saturated := 0, false
+	now := r.options.TimeProvider.UtcNow()
+	for _, e := range r.endpoints {
+		// Draining endpoints finish the requests in flight, but get no new ones
+		if e.draining {
+			continue
+		}
+		if e.isSaturated() {
+			saturated = true
+			continue
 		}
-		e := r.endpoints[r.index]
-		if e.effectiveWeight >= r.currentWeight {
-			return e.endpoint, nil
+		weight := r.schedulingWeight(e, now)
+		if weight <= 0 {
+			continue
 		}
+		e.currentWeight += weight
+		total += weight
+		if best == nil || e.currentWeight > best.currentWeight {
+			best = e
+		}
+	}
+	if best == nil && saturated {
+		return nil, loadbalance.ErrSaturated
 	}
+	if best == nil {
+		return nil, fmt.Errorf("No available endpoints")
+	}
+	best.currentWeight -= total
+	return best, nil
+}
 
-	// We did full circle and found no available endpoints
-	return nil, fmt.Errorf("No available endpoints!")
+// Weights are scaled, so the endpoints warming up can get the fraction of the weight 1,
+// scaling all weights by the same factor does not change the smooth round robin selection.
+const slowStartScale = 100
+
+func (r *RoundRobin) schedulingWeight(e *WeightedEndpoint, now time.Time) int {
+	weight := e.effectiveWeight * slowStartScale
+	if weight <= 0 || r.options.SlowStart <= 0 {
+		return weight
+	}
+	elapsed := now.Sub(e.addedAt)
+	if elapsed >= r.options.SlowStart {
+		return weight
+	}
+	warm := int(int64(weight) * int64(elapsed) / int64(r.options.SlowStart))
+	if warm < 1 {
+		return 1
+	}
+	return warm
 }
 
 func (r *RoundRobin) adjustWeights() {
@@ -151,6 +208,23 @@ func (r *RoundRobin) GetEndpoints() []*WeightedEndpoint {
 	return r.endpoints
 }
 
+// GetSnapshot returns the state of the endpoints, the endpoint is unhealthy while it is draining
+// or its failure rate is above UnhealthyFailRate
+func (r *RoundRobin) GetSnapshot() []loadbalance.EndpointSnapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	out := make([]loadbalance.EndpointSnapshot, 0, len(r.endpoints))
+	for _, e := range r.endpoints {
+		s := loadbalance.NewEndpointSnapshot(e.endpoint, r.stats)
+		s.InFlight = e.inFlight
+		s.Healthy = !e.draining && !(e.meter.IsReady() && e.failRate() > UnhealthyFailRate)
+		out = append(out, s)
+	}
+	loadbalance.SortSnapshot(out)
+	return out
+}
+
 func (rr *RoundRobin) AddEndpoint(endpoint endpoint.Endpoint) error {
 	return rr.AddEndpointWithOptions(endpoint, EndpointOptions{})
 }
@@ -175,12 +249,15 @@ func (r *RoundRobin) AddEndpointWithOptions(endpoint endpoint.Endpoint, options
 
 	r.endpoints = append(r.endpoints, we)
 	r.resetState()
+	// Queued requests can go to the new endpoint
+	r.queue.Release()
 	return nil
 }
 
 func (r *RoundRobin) resetIterator() {
-	r.index = -1
-	r.currentWeight = 0
+	for _, e := range r.endpoints {
+		e.currentWeight = 0
+	}
 }
 
 func (r *RoundRobin) resetState() {
@@ -242,15 +319,56 @@ func (rr *RoundRobin) newWeightedEndpoint(endpoint endpoint.Endpoint, options En
 		options.Meter = meter
 	}
 
+	if options.MaxInFlight < 0 {
+		return nil, fmt.Errorf("MaxInFlight can not be negative")
+	}
+	if options.MaxInFlight == 0 {
+		options.MaxInFlight = rr.options.MaxInFlight
+	}
+
 	return &WeightedEndpoint{
 		meter:           options.Meter,
 		endpoint:        endpoint,
 		weight:          options.Weight,
 		effectiveWeight: options.Weight,
+		maxInFlight:     options.MaxInFlight,
+		addedAt:         rr.options.TimeProvider.UtcNow(),
 		rr:              rr,
 	}, nil
 }
 
+// Drain stops sending new requests to the endpoint and lets the requests in flight finish.
+// Returned channel is closed once the endpoint has no requests in flight, so it can be removed.
+func (r *RoundRobin) Drain(endpoint endpoint.Endpoint) (<-chan struct{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, _ := r.findEndpointByUrl(endpoint.GetUrl())
+	if e == nil {
+		return nil, fmt.Errorf("Endpoint not found")
+	}
+	return e.drain(), nil
+}
+
+// SetEndpointWeight changes the weight of the endpoint at runtime, e.g. to shift the traffic
+// gradually during deploys. Weight 0 stops sending new requests to the endpoint.
+func (r *RoundRobin) SetEndpointWeight(endpoint endpoint.Endpoint, weight int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if weight < 0 {
+		return fmt.Errorf("Weight should be >=0")
+	}
+	e, _ := r.findEndpointByUrl(endpoint.GetUrl())
+	if e == nil {
+		return fmt.Errorf("Endpoint not found")
+	}
+	e.weight = weight
+	e.effectiveWeight = weight
+	r.resetState()
+	return nil
+}
+
 func (r *RoundRobin) RemoveEndpoint(endpoint endpoint.Endpoint) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -260,6 +378,9 @@ func (r *RoundRobin) RemoveEndpoint(endpoint endpoint.Endpoint) error {
 		return fmt.Errorf("Endpoint not found")
 	}
 	r.endpoints = append(r.endpoints[:index], r.endpoints[index+1:]...)
+	r.stats.Remove(e.GetId())
+	// Responses from the removed endpoint are not tracked anymore, so don't keep anyone waiting
+	e.closeDrained()
 	r.resetState()
 	return nil
 }
@@ -288,28 +409,9 @@ func (rr *RoundRobin) ObserveResponse(req request.Request, a request.Attempt) {
 
 	// Update endpoint stats: failure count and request roundtrip
 	we.meter.ObserveResponse(req, a)
-}
-
-func (rr *RoundRobin) maxWeight() int {
-	max := -1
-	for _, e := range rr.endpoints {
-		if e.effectiveWeight > max {
-			max = e.effectiveWeight
-		}
-	}
-	return max
-}
-
-func (rr *RoundRobin) weightGcd() int {
-	divisor := -1
-	for _, e := range rr.endpoints {
-		if divisor == -1 {
-			divisor = e.effectiveWeight
-		} else {
-			divisor = gcd(divisor, e.effectiveWeight)
-		}
-	}
-	return divisor
+	rr.stats.ObserveResponse(req, a)
+	we.finishRequest()
+	rr.queue.Release()
 }
 
 func gcd(a, b int) int {
@@ -324,6 +426,14 @@ func validateOptions(o Options) (Options, error) {
 		o.TimeProvider = &timetools.RealTime{}
 	}
 
+	if o.SlowStart < 0 {
+		return o, fmt.Errorf("SlowStart can not be negative")
+	}
+
+	if o.MaxInFlight < 0 || o.QueueTimeout < 0 {
+		return o, fmt.Errorf("MaxInFlight and QueueTimeout can not be negative")
+	}
+
 	if o.FailureHandler == nil {
 		failureHandler, err := NewFSMHandler()
 		if err != nil {
@@ -2,8 +2,11 @@ package roundrobin
 
 import (
 	"fmt"
+	"net/http"
+
 	"github.com/mailgun/timetools"
 	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
 	. "github.com/mailgun/vulcan/metrics"
 	. "github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
@@ -294,3 +297,250 @@ func (s *RoundRobinSuite) TestRemoveMultipleEndpoints(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(u, Equals, uC)
 }
+
+// Weighted endpoints are interleaved evenly instead of being selected in bursts
+func (s *RoundRobinSuite) TestSmoothWeights(c *C) {
+	r := s.newRR()
+
+	uA := MustParseUrl("http://localhost:5000")
+	uB := MustParseUrl("http://localhost:5001")
+	uC := MustParseUrl("http://localhost:5002")
+	r.AddEndpointWithOptions(uA, EndpointOptions{Weight: 5})
+	r.AddEndpoint(uB)
+	r.AddEndpoint(uC)
+
+	for _, expected := range []Endpoint{uA, uA, uB, uA, uC, uA, uA, uA, uA, uB} {
+		u, err := r.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(u, Equals, expected)
+	}
+}
+
+func (s *RoundRobinSuite) TestSetEndpointWeight(c *C) {
+	r := s.newRR()
+
+	uA := MustParseUrl("http://localhost:5000")
+	uB := MustParseUrl("http://localhost:5001")
+	r.AddEndpoint(uA)
+	r.AddEndpoint(uB)
+
+	c.Assert(r.SetEndpointWeight(uA, -1), NotNil)
+	c.Assert(r.SetEndpointWeight(MustParseUrl("http://localhost:5003"), 1), NotNil)
+
+	c.Assert(r.SetEndpointWeight(uB, 3), IsNil)
+	c.Assert(r.FindEndpointById(uB.GetId()).GetOriginalWeight(), Equals, 3)
+
+	counts := map[string]int{}
+	for i := 0; i < 40; i++ {
+		u, err := r.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		counts[u.GetId()] += 1
+	}
+	c.Assert(counts[uA.GetId()], Equals, 10)
+	c.Assert(counts[uB.GetId()], Equals, 30)
+
+	// Zero weight stops the traffic to the endpoint
+	c.Assert(r.SetEndpointWeight(uA, 0), IsNil)
+	for i := 0; i < 5; i++ {
+		u, err := r.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(u, Equals, uB)
+	}
+
+	c.Assert(r.SetEndpointWeight(uB, 0), IsNil)
+	_, err := r.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+}
+
+func (s *RoundRobinSuite) TestSlowStart(c *C) {
+	tm := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	handler, err := NewFSMHandlerWithOptions(tm)
+	c.Assert(err, IsNil)
+	r, err := NewRoundRobinWithOptions(Options{TimeProvider: tm, FailureHandler: handler, SlowStart: 10 * time.Second})
+	c.Assert(err, IsNil)
+
+	uA := MustParseUrl("http://localhost:5000")
+	uB := MustParseUrl("http://localhost:5001")
+	r.AddEndpoint(uA)
+	tm.CurrentTime = tm.CurrentTime.Add(time.Minute)
+
+	countB := func() int {
+		count := 0
+		for i := 0; i < 100; i++ {
+			u, err := r.NextEndpoint(s.req)
+			c.Assert(err, IsNil)
+			if u == uB {
+				count += 1
+			}
+		}
+		return count
+	}
+
+	// B has just been added and barely gets any traffic
+	r.AddEndpoint(uB)
+	c.Assert(countB(), Equals, 1)
+
+	// Half way through the warmup B gets half of its weight
+	tm.CurrentTime = tm.CurrentTime.Add(5 * time.Second)
+	c.Assert(countB(), Equals, 33)
+
+	// Warmup is over, B gets the full share
+	tm.CurrentTime = tm.CurrentTime.Add(5 * time.Second)
+	c.Assert(countB(), Equals, 50)
+}
+
+func (s *RoundRobinSuite) TestSlowStartBadOptions(c *C) {
+	_, err := NewRoundRobinWithOptions(Options{SlowStart: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *RoundRobinSuite) TestDrain(c *C) {
+	r := s.newRR()
+
+	uA := MustParseUrl("http://localhost:5000")
+	uB := MustParseUrl("http://localhost:5001")
+	r.AddEndpoint(uA)
+	r.AddEndpoint(uB)
+
+	u, err := r.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, uA)
+
+	_, err = r.Drain(MustParseUrl("http://localhost:5003"))
+	c.Assert(err, NotNil)
+
+	drained, err := r.Drain(uA)
+	c.Assert(err, IsNil)
+	c.Assert(r.FindEndpointById(uA.GetId()).IsDraining(), Equals, true)
+
+	// New requests go to the other endpoint
+	for i := 0; i < 3; i++ {
+		u, err = r.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(u, Equals, uB)
+	}
+
+	select {
+	case <-drained:
+		c.Fatalf("endpoint has requests in flight")
+	default:
+	}
+
+	// In flight request completes
+	r.ObserveResponse(s.req, &BaseAttempt{Endpoint: uA})
+	select {
+	case <-drained:
+	default:
+		c.Fatalf("endpoint should be drained")
+	}
+
+	// Draining idle endpoint completes right away
+	drained, err = r.Drain(uB)
+	c.Assert(err, IsNil)
+	r.ObserveResponse(s.req, &BaseAttempt{Endpoint: uB})
+	r.ObserveResponse(s.req, &BaseAttempt{Endpoint: uB})
+	r.ObserveResponse(s.req, &BaseAttempt{Endpoint: uB})
+	<-drained
+
+	_, err = r.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+}
+
+func (s *RoundRobinSuite) TestRemoveDrainingEndpoint(c *C) {
+	r := s.newRR()
+
+	uA := MustParseUrl("http://localhost:5000")
+	r.AddEndpoint(uA)
+	r.NextEndpoint(s.req)
+
+	drained, err := r.Drain(uA)
+	c.Assert(err, IsNil)
+	c.Assert(r.RemoveEndpoint(uA), IsNil)
+	<-drained
+}
+
+func (s *RoundRobinSuite) TestMaxInFlight(c *C) {
+	r, err := NewRoundRobinWithOptions(Options{TimeProvider: s.tm, MaxInFlight: 1})
+	c.Assert(err, IsNil)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	c.Assert(r.AddEndpoint(a), IsNil)
+	c.Assert(r.AddEndpointWithOptions(b, EndpointOptions{MaxInFlight: 2}), IsNil)
+	c.Assert(r.FindEndpointByUrl("http://localhost:5001").GetMaxInFlight(), Equals, int64(2))
+
+	// Saturated endpoint is skipped
+	for _, expected := range []Endpoint{a, b, b} {
+		e, err := r.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(e, Equals, expected)
+	}
+	_, err = r.NextEndpoint(s.req)
+	c.Assert(err, Equals, loadbalance.ErrSaturated)
+
+	r.ObserveResponse(s.req, &BaseAttempt{Endpoint: a})
+	e, err := r.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, a)
+}
+
+func (s *RoundRobinSuite) TestQueue(c *C) {
+	r, err := NewRoundRobinWithOptions(Options{TimeProvider: s.tm, MaxInFlight: 1, QueueTimeout: 10 * time.Second})
+	c.Assert(err, IsNil)
+	a := MustParseUrl("http://localhost:5000")
+	c.Assert(r.AddEndpoint(a), IsNil)
+	_, err = r.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+
+	// Queued request gets the endpoint once the request in flight completes
+	resultC := make(chan error, 1)
+	go func() {
+		_, err := r.NextEndpoint(s.req)
+		resultC <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.ObserveResponse(s.req, &BaseAttempt{Endpoint: a})
+	c.Assert(<-resultC, IsNil)
+	c.Assert(r.FindEndpointByUrl("http://localhost:5000").GetInFlight(), Equals, int64(1))
+}
+
+func (s *RoundRobinSuite) TestBadMaxInFlight(c *C) {
+	_, err := NewRoundRobinWithOptions(Options{MaxInFlight: -1})
+	c.Assert(err, NotNil)
+	r := s.newRR()
+	c.Assert(r.AddEndpointWithOptions(MustParseUrl("http://localhost:5000"), EndpointOptions{MaxInFlight: -1}), NotNil)
+}
+
+func (s *RoundRobinSuite) TestSnapshot(c *C) {
+	r := s.newRR()
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	c.Assert(r.AddEndpointWithOptions(b, EndpointOptions{Meter: &TestMeter{Rate: 0.8}}), IsNil)
+	c.Assert(r.AddEndpointWithOptions(a, EndpointOptions{Meter: &TestMeter{}}), IsNil)
+
+	for _, code := range []int{200, 200, 500} {
+		e, err := r.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		r.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Duration: time.Millisecond, Response: &http.Response{StatusCode: code}})
+	}
+	_, err := r.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+
+	snapshot := r.GetSnapshot()
+	c.Assert(snapshot, HasLen, 2)
+	c.Assert(snapshot[0].Id, Equals, a.GetId())
+	c.Assert(snapshot[0].Healthy, Equals, true)
+	c.Assert(snapshot[1].Id, Equals, b.GetId())
+	c.Assert(snapshot[1].Healthy, Equals, false)
+	c.Assert(snapshot[0].Successes+snapshot[1].Successes, Equals, int64(2))
+	c.Assert(snapshot[0].Failures+snapshot[1].Failures, Equals, int64(1))
+	c.Assert(snapshot[0].InFlight+snapshot[1].InFlight, Equals, int64(1))
+
+	_, err = r.Drain(a)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetSnapshot()[0].Healthy, Equals, false)
+
+	c.Assert(r.RemoveEndpoint(b), IsNil)
+	c.Assert(r.GetSnapshot(), HasLen, 1)
+}
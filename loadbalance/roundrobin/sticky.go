@@ -0,0 +1,105 @@
+package roundrobin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/request"
+)
+
+// StickySession wraps the round robin load balancer and pins clients to endpoints
+// using the affinity cookie. Clients without the cookie, or pinned to the endpoint
+// that has been removed, is draining, failing or at its limit of requests in flight, are balanced by the round robin and get the new cookie.
+type StickySession struct {
+	rr         *RoundRobin
+	cookieName string
+}
+
+// Pinned endpoint with the failure rate above this value is considered failing
+const StickyMaxFailRate = 0.5
+
+func NewStickySession(rr *RoundRobin, cookieName string) (*StickySession, error) {
+	if rr == nil {
+		return nil, fmt.Errorf("Provide round robin load balancer")
+	}
+	if cookieName == "" {
+		return nil, fmt.Errorf("Provide cookie name")
+	}
+	return &StickySession{rr: rr, cookieName: cookieName}, nil
+}
+
+func (s *StickySession) GetRoundRobin() *RoundRobin {
+	return s.rr
+}
+
+func (s *StickySession) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	if e := s.pinnedEndpoint(req); e != nil {
+		return e, nil
+	}
+	return s.rr.NextEndpoint(req)
+}
+
+func (s *StickySession) pinnedEndpoint(req request.Request) endpoint.Endpoint {
+	c, err := req.GetHttpRequest().Cookie(s.cookieName)
+	if err != nil {
+		return nil
+	}
+
+	s.rr.mutex.Lock()
+	defer s.rr.mutex.Unlock()
+
+	for _, we := range s.rr.endpoints {
+		if cookieValue(we.endpoint) != c.Value {
+			continue
+		}
+		// Fall back to the load balancer if the request has failed on this endpoint already
+		if hasAttempted(req, we.endpoint) || we.draining || we.isSaturated() {
+			return nil
+		}
+		if we.meter.IsReady() && we.meter.GetRate() > StickyMaxFailRate {
+			return nil
+		}
+		we.inFlight += 1
+		return we.endpoint
+	}
+	return nil
+}
+
+func (s *StickySession) ProcessRequest(req request.Request) (*http.Response, error) {
+	return s.rr.ProcessRequest(req)
+}
+
+// ProcessResponse pins the client to the endpoint that served the request
+func (s *StickySession) ProcessResponse(req request.Request, a request.Attempt) {
+	s.rr.ProcessResponse(req, a)
+
+	if a == nil || a.GetResponse() == nil || a.GetEndpoint() == nil {
+		return
+	}
+	value := cookieValue(a.GetEndpoint())
+	if c, err := req.GetHttpRequest().Cookie(s.cookieName); err == nil && c.Value == value {
+		return
+	}
+	if a.GetResponse().Header == nil {
+		a.GetResponse().Header = make(http.Header)
+	}
+	cookie := &http.Cookie{Name: s.cookieName, Value: value, Path: "/", HttpOnly: true}
+	a.GetResponse().Header.Add("Set-Cookie", cookie.String())
+}
+
+func (s *StickySession) ObserveRequest(req request.Request) {
+	s.rr.ObserveRequest(req)
+}
+
+func (s *StickySession) ObserveResponse(req request.Request, a request.Attempt) {
+	s.rr.ObserveResponse(req, a)
+}
+
+// Cookie contains the hash of the endpoint id, so the internal addresses are not exposed to clients
+func cookieValue(e endpoint.Endpoint) string {
+	h := fnv.New64a()
+	h.Write([]byte(e.GetId()))
+	return fmt.Sprintf("%x", h.Sum64())
+}
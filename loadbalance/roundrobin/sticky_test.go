@@ -0,0 +1,133 @@
+package roundrobin
+
+import (
+	"net/http"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	. "github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type StickySuite struct {
+}
+
+var _ = Suite(&StickySuite{})
+
+func (s *StickySuite) newSticky(c *C) (*StickySession, *RoundRobin) {
+	rr, err := NewRoundRobin()
+	c.Assert(err, IsNil)
+	sticky, err := NewStickySession(rr, "backend")
+	c.Assert(err, IsNil)
+	return sticky, rr
+}
+
+func (s *StickySuite) TestBadParams(c *C) {
+	_, err := NewStickySession(nil, "backend")
+	c.Assert(err, NotNil)
+
+	rr, _ := NewRoundRobin()
+	_, err = NewStickySession(rr, "")
+	c.Assert(err, NotNil)
+}
+
+func (s *StickySuite) TestPinsClient(c *C) {
+	sticky, rr := s.newSticky(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	rr.AddEndpoint(a)
+	rr.AddEndpoint(b)
+
+	// First request has no cookie, so it gets the first endpoint and the cookie
+	req := makeRequest("")
+	e, err := sticky.NextEndpoint(req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, a)
+	cookie := s.roundTrip(sticky, req, e)
+	c.Assert(cookie, NotNil)
+
+	// Requests with the cookie stick to the same endpoint
+	for i := 0; i < 3; i++ {
+		req = makeRequest(cookie.Value)
+		e, err = sticky.NextEndpoint(req)
+		c.Assert(err, IsNil)
+		c.Assert(e, Equals, a)
+		// Cookie is already set, no need to set it again
+		c.Assert(s.roundTrip(sticky, req, e), IsNil)
+	}
+}
+
+func (s *StickySuite) TestRemovedEndpoint(c *C) {
+	sticky, rr := s.newSticky(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	rr.AddEndpoint(a)
+	rr.AddEndpoint(b)
+
+	req := makeRequest("")
+	e, _ := sticky.NextEndpoint(req)
+	cookie := s.roundTrip(sticky, req, e)
+
+	rr.RemoveEndpoint(a)
+
+	req = makeRequest(cookie.Value)
+	e, err := sticky.NextEndpoint(req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, b)
+
+	// Client is pinned to the new endpoint
+	cookie = s.roundTrip(sticky, req, e)
+	c.Assert(cookie, NotNil)
+	c.Assert(cookie.Value, Equals, cookieValue(b))
+}
+
+func (s *StickySuite) TestFailingEndpoint(c *C) {
+	sticky, rr := s.newSticky(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	rr.AddEndpoint(b)
+	rr.AddEndpointWithOptions(a, EndpointOptions{Meter: &TestMeter{Rate: 0.9}})
+
+	// Client is pinned to a, but a is failing, so round robin selects b
+	e, err := sticky.NextEndpoint(makeRequest(cookieValue(a)))
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, b)
+}
+
+func (s *StickySuite) TestFailoverFromPinnedEndpoint(c *C) {
+	sticky, rr := s.newSticky(c)
+	a := MustParseUrl("http://localhost:5000")
+	b := MustParseUrl("http://localhost:5001")
+	rr.AddEndpoint(a)
+	rr.AddEndpoint(b)
+
+	req := makeRequest(cookieValue(b))
+	e, _ := sticky.NextEndpoint(req)
+	c.Assert(e, Equals, b)
+
+	req.AddAttempt(&BaseAttempt{Endpoint: b})
+	e, err := sticky.NextEndpoint(req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, a)
+}
+
+// Returns the cookie set by the load balancer, if any
+func (s *StickySuite) roundTrip(sticky *StickySession, req Request, e Endpoint) *http.Cookie {
+	a := &BaseAttempt{Endpoint: e, Response: &http.Response{Header: make(http.Header)}}
+	sticky.ProcessResponse(req, a)
+	for _, c := range a.Response.Cookies() {
+		if c.Name == "backend" {
+			return c
+		}
+	}
+	return nil
+}
+
+func makeRequest(cookie string) Request {
+	hr := &http.Request{URL: netutils.MustParseUrl("http://google.com"), Header: make(http.Header)}
+	if cookie != "" {
+		hr.AddCookie(&http.Cookie{Name: "backend", Value: cookie})
+	}
+	return &BaseRequest{HttpRequest: hr}
+}
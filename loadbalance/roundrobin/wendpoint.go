@@ -6,6 +6,7 @@ import (
 	"github.com/mailgun/vulcan/endpoint"
 	"github.com/mailgun/vulcan/metrics"
 	"net/url"
+	"time"
 )
 
 // WeightedEndpoint wraps the endpoint and adds support for weights and failure detection.
@@ -22,6 +23,22 @@ type WeightedEndpoint struct {
 	// effectiveWeight is the weights assigned by the load balancer based on failure
 	effectiveWeight int
 
+	// currentWeight is the weight accumulated by the smooth weighted round robin
+	currentWeight int
+
+	// addedAt is the time the endpoint was added, used by the slow start
+	addedAt time.Time
+
+	// inFlight is the number of requests sent to the endpoint that have not completed yet
+	inFlight int64
+
+	// maxInFlight is the limit of the requests in flight, 0 means no limit
+	maxInFlight int64
+
+	// draining endpoint gets no new requests, drainedC is closed once it has no requests in flight
+	draining bool
+	drainedC chan struct{}
+
 	// rr is a reference to the parent load balancer
 	rr *RoundRobin
 }
@@ -56,6 +73,54 @@ func (we *WeightedEndpoint) GetEffectiveWeight() int {
 	return we.effectiveWeight
 }
 
+func (we *WeightedEndpoint) IsDraining() bool {
+	return we.draining
+}
+
+func (we *WeightedEndpoint) GetInFlight() int64 {
+	return we.inFlight
+}
+
+func (we *WeightedEndpoint) GetMaxInFlight() int64 {
+	return we.maxInFlight
+}
+
+func (we *WeightedEndpoint) isSaturated() bool {
+	return we.maxInFlight > 0 && we.inFlight >= we.maxInFlight
+}
+
+func (we *WeightedEndpoint) drain() <-chan struct{} {
+	if !we.draining {
+		log.Infof("%s draining, requests in flight: %d", we, we.inFlight)
+		we.draining = true
+		we.drainedC = make(chan struct{})
+		if we.inFlight == 0 {
+			we.closeDrained()
+		}
+	}
+	return we.drainedC
+}
+
+func (we *WeightedEndpoint) finishRequest() {
+	if we.inFlight > 0 {
+		we.inFlight -= 1
+	}
+	if we.draining && we.inFlight == 0 {
+		we.closeDrained()
+	}
+}
+
+func (we *WeightedEndpoint) closeDrained() {
+	if we.drainedC == nil {
+		return
+	}
+	select {
+	case <-we.drainedC:
+	default:
+		close(we.drainedC)
+	}
+}
+
 func (we *WeightedEndpoint) GetMeter() metrics.FailRateMeter {
 	return we.meter
 }
@@ -0,0 +1,65 @@
+package loadbalance
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/metrics"
+)
+
+// Snapshotter is implemented by the load balancers that report the state of their endpoints,
+// e.g. for the health dashboards and the admin API
+type Snapshotter interface {
+	// Returns the snapshots of the endpoints sorted by id
+	GetSnapshot() []EndpointSnapshot
+}
+
+// EndpointSnapshot is the state of the endpoint in the load balancer. Counters and latencies
+// are calculated over the rolling window of the metrics, see metrics.RoundTripOptions
+type EndpointSnapshot struct {
+	Id     string            `json:"id"`
+	Url    string            `json:"url"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Attempts that have got the response below 500
+	Successes int64 `json:"successes"`
+	// Attempts that have failed with the network error or 5xx response
+	Failures   int64         `json:"failures"`
+	LatencyP50 time.Duration `json:"latency_p50"`
+	LatencyP90 time.Duration `json:"latency_p90"`
+	LatencyP99 time.Duration `json:"latency_p99"`
+	// Requests sent to the endpoint that have not completed yet
+	InFlight int64 `json:"in_flight"`
+	// Unhealthy endpoint gets no requests or less than its share, e.g. while it is failing or draining
+	Healthy bool `json:"healthy"`
+}
+
+// NewEndpointSnapshot fills in the snapshot of the healthy endpoint from its round trip metrics,
+// the balancer sets the rest of the state
+func NewEndpointSnapshot(e Endpoint, m *metrics.EndpointMetrics) EndpointSnapshot {
+	s := EndpointSnapshot{Id: e.GetId(), Url: e.GetUrl().String(), Healthy: true}
+	if l, ok := e.(Labeled); ok && len(l.GetLabels()) != 0 {
+		s.Labels = l.GetLabels()
+	}
+	stats, ok := m.GetStats(e.GetId())
+	if !ok {
+		return s
+	}
+	s.Failures = stats.NetworkErrors
+	for code, count := range stats.StatusCodes {
+		if code >= http.StatusInternalServerError {
+			s.Failures += count
+		}
+	}
+	s.Successes = stats.Total - s.Failures
+	s.LatencyP50 = stats.Latency.LatencyAtQuantile(50)
+	s.LatencyP90 = stats.Latency.LatencyAtQuantile(90)
+	s.LatencyP99 = stats.Latency.LatencyAtQuantile(99)
+	return s
+}
+
+// SortSnapshot sorts the snapshots by the endpoint id
+func SortSnapshot(s []EndpointSnapshot) {
+	sort.Slice(s, func(i, j int) bool { return s[i].Id < s[j].Id })
+}
@@ -0,0 +1,234 @@
+// Deterministic subsetting that limits the number of endpoints each proxy talks to
+package subset
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/endpoint"
+)
+
+// Balancer is the load balancer that gets the endpoints of the subset, e.g. round robin
+type Balancer interface {
+	AddEndpoint(endpoint.Endpoint) error
+	RemoveEndpoint(endpoint.Endpoint) error
+}
+
+// weightedBalancer is the balancer that the weights of the endpoints are applied to
+type weightedBalancer interface {
+	Balancer
+	SetEndpointWeight(e endpoint.Endpoint, weight int) error
+}
+
+// Subsetter keeps all the endpoints of the pool, but adds only a subset of them to the balancer,
+// so each proxy keeps connections to Size endpoints instead of all of them. Proxies are numbered
+// from 0 to N-1 and the subsets are chosen the same way on every proxy: endpoints are sorted by id and
+// shuffled with the seed shared by each group of pool size / Size proxies, and every proxy of the group
+// takes its own slice of the shuffled list. With the consecutive proxy ids every endpoint gets
+// about the same number of proxies, as long as the number of proxies is a multiple of the number of groups.
+//
+// Subsetter can be used instead of the balancer with the service discovery, e.g. discovery.NewSyncer.
+type Subsetter struct {
+	balancer Balancer
+	proxyId  int
+	options  Options
+	mutex    *sync.Mutex
+	// All the endpoints of the pool with their weights, 0 if not set
+	endpoints map[string]*subsetEndpoint
+	// Endpoints added to the balancer
+	subset map[string]*subsetEndpoint
+}
+
+type Options struct {
+	// Number of endpoints in the subset, DefaultSize by default
+	Size int
+}
+
+const DefaultSize = 20
+
+type subsetEndpoint struct {
+	endpoint endpoint.Endpoint
+	weight   int
+}
+
+func NewSubsetter(b Balancer, proxyId int) (*Subsetter, error) {
+	return NewSubsetterWithOptions(b, proxyId, Options{})
+}
+
+func NewSubsetterWithOptions(b Balancer, proxyId int, o Options) (*Subsetter, error) {
+	if b == nil {
+		return nil, fmt.Errorf("Provide balancer")
+	}
+	if proxyId < 0 {
+		return nil, fmt.Errorf("Proxy id can not be negative")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Subsetter{
+		balancer:  b,
+		proxyId:   proxyId,
+		options:   o,
+		mutex:     &sync.Mutex{},
+		endpoints: make(map[string]*subsetEndpoint),
+		subset:    make(map[string]*subsetEndpoint),
+	}, nil
+}
+
+func (s *Subsetter) GetOptions() Options {
+	return s.options
+}
+
+func (s *Subsetter) GetBalancer() Balancer {
+	return s.balancer
+}
+
+// GetEndpoints returns all the endpoints of the pool sorted by id
+func (s *Subsetter) GetEndpoints() []endpoint.Endpoint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sorted(s.endpoints)
+}
+
+// GetSubset returns the endpoints added to the balancer sorted by id
+func (s *Subsetter) GetSubset() []endpoint.Endpoint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sorted(s.subset)
+}
+
+// AddEndpoint adds the endpoint to the pool, the balancer gets it if it is in the subset
+func (s *Subsetter) AddEndpoint(e endpoint.Endpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	if _, exists := s.endpoints[e.GetId()]; exists {
+		return fmt.Errorf("Endpoint %s already exists", e.GetId())
+	}
+	s.endpoints[e.GetId()] = &subsetEndpoint{endpoint: e}
+	return s.sync()
+}
+
+func (s *Subsetter) RemoveEndpoint(e endpoint.Endpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.endpoints[e.GetId()]; !exists {
+		return fmt.Errorf("Endpoint %s not found", e.GetId())
+	}
+	delete(s.endpoints, e.GetId())
+	return s.sync()
+}
+
+// SetEndpointWeight remembers the weight of the endpoint and applies it if the endpoint is in the subset
+// and the balancer supports weights
+func (s *Subsetter) SetEndpointWeight(e endpoint.Endpoint, weight int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	se, exists := s.endpoints[e.GetId()]
+	if !exists {
+		return fmt.Errorf("Endpoint %s not found", e.GetId())
+	}
+	if weight <= 0 {
+		return fmt.Errorf("Weight should be > 0")
+	}
+	se.weight = weight
+	if wb, ok := s.balancer.(weightedBalancer); ok && s.subset[e.GetId()] != nil {
+		return wb.SetEndpointWeight(se.endpoint, weight)
+	}
+	return nil
+}
+
+// sync moves the balancer to the current subset. The endpoints that could not be added or removed
+// are logged and retried on the next change, the first error is returned.
+func (s *Subsetter) sync() error {
+	next := s.choose()
+
+	var errs []error
+	for id, se := range s.subset {
+		if next[id] != nil {
+			continue
+		}
+		if err := s.balancer.RemoveEndpoint(se.endpoint); err != nil {
+			log.Errorf("Failed to remove %s: %s", se.endpoint, err)
+			errs = append(errs, err)
+			continue
+		}
+		delete(s.subset, id)
+	}
+	for id, se := range next {
+		if s.subset[id] != nil {
+			continue
+		}
+		if err := s.balancer.AddEndpoint(se.endpoint); err != nil {
+			log.Errorf("Failed to add %s: %s", se.endpoint, err)
+			errs = append(errs, err)
+			continue
+		}
+		s.subset[id] = se
+		if wb, ok := s.balancer.(weightedBalancer); ok && se.weight > 0 {
+			if err := wb.SetEndpointWeight(se.endpoint, se.weight); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// choose returns the subset of the proxy for the current endpoints
+func (s *Subsetter) choose() map[string]*subsetEndpoint {
+	if len(s.endpoints) <= s.options.Size {
+		return s.endpoints
+	}
+	ids := make([]string, 0, len(s.endpoints))
+	for id := range s.endpoints {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Proxies of the same group share the shuffled list and take the different slices of it
+	subsets := len(ids) / s.options.Size
+	group := s.proxyId / subsets
+	r := rand.New(rand.NewSource(int64(group)))
+	for i := len(ids) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	start := (s.proxyId % subsets) * s.options.Size
+
+	out := make(map[string]*subsetEndpoint, s.options.Size)
+	for _, id := range ids[start : start+s.options.Size] {
+		out[id] = s.endpoints[id]
+	}
+	return out
+}
+
+func sorted(endpoints map[string]*subsetEndpoint) []endpoint.Endpoint {
+	out := make([]endpoint.Endpoint, 0, len(endpoints))
+	for _, se := range endpoints {
+		out = append(out, se.endpoint)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetId() < out[j].GetId() })
+	return out
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Size < 0 {
+		return o, fmt.Errorf("Size can not be negative")
+	}
+	if o.Size == 0 {
+		o.Size = DefaultSize
+	}
+	return o, nil
+}
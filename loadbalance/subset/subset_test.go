@@ -0,0 +1,133 @@
+package subset
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type SubsetSuite struct {
+	endpoints []Endpoint
+}
+
+var _ = Suite(&SubsetSuite{})
+
+func (s *SubsetSuite) SetUpTest(c *C) {
+	s.endpoints = nil
+	for i := 0; i < 100; i++ {
+		s.endpoints = append(s.endpoints, MustParseUrl(fmt.Sprintf("http://10.0.0.%d:80", i)))
+	}
+}
+
+func (s *SubsetSuite) newSubsetter(c *C, proxyId, size int) (*Subsetter, *roundrobin.RoundRobin) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	ss, err := NewSubsetterWithOptions(rr, proxyId, Options{Size: size})
+	c.Assert(err, IsNil)
+	for _, e := range s.endpoints {
+		c.Assert(ss.AddEndpoint(e), IsNil)
+	}
+	return ss, rr
+}
+
+func (s *SubsetSuite) TestBadParams(c *C) {
+	_, err := NewSubsetter(nil, 0)
+	c.Assert(err, NotNil)
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	_, err = NewSubsetter(rr, -1)
+	c.Assert(err, NotNil)
+	_, err = NewSubsetterWithOptions(rr, 0, Options{Size: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *SubsetSuite) TestSmallPool(c *C) {
+	s.endpoints = s.endpoints[:5]
+	ss, rr := s.newSubsetter(c, 3, 10)
+	c.Assert(ss.GetSubset(), HasLen, 5)
+	c.Assert(rr.GetEndpoints(), HasLen, 5)
+	c.Assert(ss.AddEndpoint(s.endpoints[0]), NotNil)
+
+	c.Assert(ss.RemoveEndpoint(s.endpoints[0]), IsNil)
+	c.Assert(ss.RemoveEndpoint(s.endpoints[0]), NotNil)
+	c.Assert(rr.GetEndpoints(), HasLen, 4)
+}
+
+func (s *SubsetSuite) TestDeterministic(c *C) {
+	a, rr := s.newSubsetter(c, 7, 10)
+	c.Assert(a.GetSubset(), HasLen, 10)
+	c.Assert(rr.GetEndpoints(), HasLen, 10)
+	c.Assert(a.GetEndpoints(), HasLen, 100)
+
+	// The order the endpoints are added in does not matter
+	for i, j := 0, len(s.endpoints)-1; i < j; i, j = i+1, j-1 {
+		s.endpoints[i], s.endpoints[j] = s.endpoints[j], s.endpoints[i]
+	}
+	b, _ := s.newSubsetter(c, 7, 10)
+	c.Assert(ids(b.GetSubset()), DeepEquals, ids(a.GetSubset()))
+}
+
+// With 100 endpoints in subsets of 10 every group of 10 proxies covers all the endpoints once
+func (s *SubsetSuite) TestBalance(c *C) {
+	proxies := make(map[string]int)
+	for proxyId := 0; proxyId < 50; proxyId++ {
+		ss, _ := s.newSubsetter(c, proxyId, 10)
+		for _, e := range ss.GetSubset() {
+			proxies[e.GetId()] += 1
+		}
+	}
+	c.Assert(proxies, HasLen, 100)
+	for id, count := range proxies {
+		c.Assert(count, Equals, 5, Commentf("%s", id))
+	}
+}
+
+func (s *SubsetSuite) TestSyncsBalancer(c *C) {
+	ss, rr := s.newSubsetter(c, 0, 10)
+	removed := ss.GetSubset()[0]
+	c.Assert(ss.RemoveEndpoint(removed), IsNil)
+	c.Assert(rr.FindEndpointById(removed.GetId()), IsNil)
+	c.Assert(rr.GetEndpoints(), HasLen, 10)
+	c.Assert(ids(ss.GetSubset()), DeepEquals, rrIds(rr))
+
+	// Weights are kept for the endpoints outside of the subset and applied once they get in
+	var outside Endpoint
+	for _, e := range ss.GetEndpoints() {
+		if rr.FindEndpointById(e.GetId()) == nil {
+			outside = e
+			break
+		}
+	}
+	c.Assert(ss.SetEndpointWeight(outside, 3), IsNil)
+	for _, e := range ss.GetSubset() {
+		c.Assert(ss.RemoveEndpoint(e), IsNil)
+		if rr.FindEndpointById(outside.GetId()) != nil {
+			break
+		}
+	}
+	c.Assert(rr.FindEndpointById(outside.GetId()).GetOriginalWeight(), Equals, 3)
+}
+
+func ids(endpoints []Endpoint) []string {
+	out := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		out[i] = e.GetId()
+	}
+	return out
+}
+
+func rrIds(rr *roundrobin.RoundRobin) []string {
+	out := []string{}
+	for _, e := range rr.GetEndpoints() {
+		out = append(out, e.GetId())
+	}
+	sort.Strings(out)
+	return out
+}
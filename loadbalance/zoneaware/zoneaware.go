@@ -0,0 +1,115 @@
+// Zone aware load balancer that keeps the traffic within the zone of the proxy
+package zoneaware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/priority"
+	"github.com/mailgun/vulcan/request"
+)
+
+// ZoneAware groups the endpoints into tiers by their locality: the endpoints in the zone of the proxy,
+// the endpoints in the other zones of the same region and the rest. Endpoints that don't implement
+// endpoint.Localized are in the last tier. Requests go to the first tier while it is healthy
+// and has capacity and spill over to the next tiers otherwise, see priority.Priority for details.
+type ZoneAware struct {
+	locality endpoint.Locality
+	priority *priority.Priority
+}
+
+// Options control when the requests spill over to the next tier, see priority.Options
+type Options priority.Options
+
+// Tiers of the endpoints, from the most preferred to the least one
+const (
+	SameZone = iota
+	SameRegion
+	Remote
+)
+
+// NewZoneAware creates the balancer for the proxy running in the given locality, the zone is required
+func NewZoneAware(l endpoint.Locality) (*ZoneAware, error) {
+	return NewZoneAwareWithOptions(l, Options{})
+}
+
+func NewZoneAwareWithOptions(l endpoint.Locality, o Options) (*ZoneAware, error) {
+	if l.Zone == "" {
+		return nil, fmt.Errorf("Provide the zone of the proxy")
+	}
+	p, err := priority.NewPriorityWithOptions(priority.Options(o))
+	if err != nil {
+		return nil, err
+	}
+	return &ZoneAware{locality: l, priority: p}, nil
+}
+
+func (z *ZoneAware) GetOptions() Options {
+	return Options(z.priority.GetOptions())
+}
+
+func (z *ZoneAware) GetLocality() endpoint.Locality {
+	return z.locality
+}
+
+// GetTier returns the tier of the endpoint: SameZone, SameRegion or Remote
+func (z *ZoneAware) GetTier(e endpoint.Endpoint) (int, error) {
+	return z.priority.GetPriority(e)
+}
+
+func (z *ZoneAware) IsHealthy(e endpoint.Endpoint) bool {
+	return z.priority.IsHealthy(e)
+}
+
+func (z *ZoneAware) GetSnapshot() []loadbalance.EndpointSnapshot {
+	return z.priority.GetSnapshot()
+}
+
+func (z *ZoneAware) AddEndpoint(e endpoint.Endpoint) error {
+	if e == nil {
+		return fmt.Errorf("Endpoint can't be nil")
+	}
+	return z.priority.AddEndpointWithPriority(e, z.tierOf(e))
+}
+
+func (z *ZoneAware) RemoveEndpoint(e endpoint.Endpoint) error {
+	return z.priority.RemoveEndpoint(e)
+}
+
+func (z *ZoneAware) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	return z.priority.NextEndpoint(req)
+}
+
+func (z *ZoneAware) tierOf(e endpoint.Endpoint) int {
+	le, ok := e.(endpoint.Localized)
+	if !ok {
+		return Remote
+	}
+	l := le.GetLocality()
+	switch {
+	// Zone names are unique across the regions, e.g. Kubernetes tells only the zone of the endpoint
+	case l.Zone != "" && l.Zone == z.locality.Zone && (l.Region == "" || l.Region == z.locality.Region):
+		return SameZone
+	case l.Region == z.locality.Region && l.Region != "":
+		return SameRegion
+	}
+	return Remote
+}
+
+func (z *ZoneAware) ProcessRequest(req request.Request) (*http.Response, error) {
+	return z.priority.ProcessRequest(req)
+}
+
+func (z *ZoneAware) ProcessResponse(req request.Request, a request.Attempt) {
+	z.priority.ProcessResponse(req, a)
+}
+
+func (z *ZoneAware) ObserveRequest(req request.Request) {
+	z.priority.ObserveRequest(req)
+}
+
+func (z *ZoneAware) ObserveResponse(req request.Request, a request.Attempt) {
+	z.priority.ObserveResponse(req, a)
+}
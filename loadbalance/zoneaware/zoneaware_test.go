@@ -0,0 +1,183 @@
+package zoneaware
+
+import (
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/priority"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ZoneSuite struct {
+	tm     *timetools.FreezedTime
+	req    Request
+	local  Endpoint
+	region Endpoint
+	remote Endpoint
+}
+
+var _ = Suite(&ZoneSuite{})
+
+func (s *ZoneSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	s.req = &BaseRequest{}
+	s.local = mustParse(c, "http://localhost:5000", "us-east-1", "us-east-1a")
+	s.region = mustParse(c, "http://localhost:5001", "us-east-1", "us-east-1b")
+	s.remote = mustParse(c, "http://localhost:5002", "eu-west-1", "eu-west-1a")
+}
+
+func (s *ZoneSuite) newZoneAware(c *C, o Options) *ZoneAware {
+	o.TimeProvider = s.tm
+	o.Rand = rand.New(rand.NewSource(1))
+	o.NewBalancer = func() (priority.Balancer, error) {
+		return roundrobin.NewRoundRobinWithOptions(roundrobin.Options{TimeProvider: s.tm})
+	}
+	z, err := NewZoneAwareWithOptions(Locality{Region: "us-east-1", Zone: "us-east-1a"}, o)
+	c.Assert(err, IsNil)
+	return z
+}
+
+func (s *ZoneSuite) TestBadParams(c *C) {
+	_, err := NewZoneAware(Locality{Region: "us-east-1"})
+	c.Assert(err, NotNil)
+
+	_, err = NewZoneAwareWithOptions(Locality{Zone: "a"}, Options{MinHealthyRatio: 2})
+	c.Assert(err, NotNil)
+
+	_, err = NewZoneAwareWithOptions(Locality{Zone: "a"}, Options{Window: time.Millisecond})
+	c.Assert(err, NotNil)
+}
+
+func (s *ZoneSuite) TestTiers(c *C) {
+	z := s.newZoneAware(c, Options{})
+	plain := MustParseUrl("http://localhost:5003")
+	// Endpoint that tells only its zone
+	zonal := mustParse(c, "http://localhost:5004", "", "us-east-1a")
+	for _, e := range []Endpoint{s.local, s.region, s.remote, plain, zonal} {
+		c.Assert(z.AddEndpoint(e), IsNil)
+	}
+	c.Assert(z.AddEndpoint(s.local), NotNil)
+
+	for e, expected := range map[Endpoint]int{s.local: SameZone, s.region: SameRegion, s.remote: Remote, plain: Remote, zonal: SameZone} {
+		tier, err := z.GetTier(e)
+		c.Assert(err, IsNil)
+		c.Assert(tier, Equals, expected)
+	}
+
+	c.Assert(z.RemoveEndpoint(plain), IsNil)
+	c.Assert(z.RemoveEndpoint(plain), NotNil)
+	_, err := z.GetTier(plain)
+	c.Assert(err, NotNil)
+}
+
+func (s *ZoneSuite) TestNoEndpoints(c *C) {
+	z := s.newZoneAware(c, Options{})
+	_, err := z.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+}
+
+func (s *ZoneSuite) TestPrefersLocalZone(c *C) {
+	z := s.newZoneAware(c, Options{})
+	z.AddEndpoint(s.remote)
+	z.AddEndpoint(s.region)
+	c.Assert(s.hits(c, z, 10), DeepEquals, map[Endpoint]int{s.region: 10})
+
+	z.AddEndpoint(s.local)
+	c.Assert(s.hits(c, z, 10), DeepEquals, map[Endpoint]int{s.local: 10})
+}
+
+func (s *ZoneSuite) TestSpillsOverWhenUnhealthy(c *C) {
+	z := s.newZoneAware(c, Options{MinRequests: 4})
+	z.AddEndpoint(s.local)
+	z.AddEndpoint(s.region)
+
+	for i := 0; i < 4; i++ {
+		z.ObserveResponse(s.req, &BaseAttempt{Endpoint: s.local, Response: &http.Response{StatusCode: http.StatusBadGateway}})
+	}
+	c.Assert(z.IsHealthy(s.local), Equals, false)
+	c.Assert(s.hits(c, z, 10), DeepEquals, map[Endpoint]int{s.region: 10})
+
+	// Errors leave the rolling window and the local zone is back
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(z.GetOptions().Window + time.Second)
+	c.Assert(z.IsHealthy(s.local), Equals, true)
+	c.Assert(s.hits(c, z, 10), DeepEquals, map[Endpoint]int{s.local: 10})
+}
+
+// Tier with some unhealthy endpoints keeps the part of the requests proportional to its healthy share
+func (s *ZoneSuite) TestPartialSpillOver(c *C) {
+	z := s.newZoneAware(c, Options{MinRequests: 1, MinHealthyRatio: 1})
+	other := mustParse(c, "http://localhost:5004", "us-east-1", "us-east-1a")
+	z.AddEndpoint(s.local)
+	z.AddEndpoint(other)
+	z.AddEndpoint(s.remote)
+
+	// Local tier is half healthy, so it keeps half of the requests
+	hits := make(map[Endpoint]int)
+	for i := 0; i < 1000; i++ {
+		e, err := z.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		hits[e] += 1
+		code := http.StatusOK
+		if e == other {
+			code = http.StatusInternalServerError
+		}
+		z.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Response: &http.Response{StatusCode: code}})
+	}
+	c.Assert(hits[s.local]+hits[other] > 400, Equals, true)
+	c.Assert(hits[s.remote] > 400, Equals, true)
+}
+
+func (s *ZoneSuite) TestFallsBackWhenAllUnhealthy(c *C) {
+	z := s.newZoneAware(c, Options{MinRequests: 1})
+	z.AddEndpoint(s.local)
+	z.AddEndpoint(s.remote)
+	for _, e := range []Endpoint{s.local, s.remote} {
+		z.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Response: &http.Response{StatusCode: http.StatusInternalServerError}})
+	}
+	c.Assert(s.hits(c, z, 10), DeepEquals, map[Endpoint]int{s.local: 10})
+}
+
+func (s *ZoneSuite) TestSpillsOverWhenBusy(c *C) {
+	z := s.newZoneAware(c, Options{MaxInFlight: 2})
+	z.AddEndpoint(s.local)
+	z.AddEndpoint(s.region)
+
+	for _, expected := range []Endpoint{s.local, s.local, s.region} {
+		e, err := z.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(e, Equals, expected)
+	}
+
+	z.ObserveResponse(s.req, &BaseAttempt{Endpoint: s.local})
+	e, err := z.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(e, Equals, s.local)
+}
+
+// hits sends the requests that complete right away and counts them per endpoint
+func (s *ZoneSuite) hits(c *C, z *ZoneAware, count int) map[Endpoint]int {
+	out := make(map[Endpoint]int)
+	for i := 0; i < count; i++ {
+		e, err := z.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		out[e] += 1
+		z.ObserveResponse(s.req, &BaseAttempt{Endpoint: e, Response: &http.Response{StatusCode: http.StatusOK}})
+	}
+	return out
+}
+
+func mustParse(c *C, in, region, zone string) Endpoint {
+	e, err := ParseUrlWithLocality(in, Locality{Region: region, Zone: zone})
+	c.Assert(err, IsNil)
+	return e
+}
@@ -0,0 +1,377 @@
+// Forward proxy location that lets vulcan act as the egress proxy
+package forwardloc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// ForwardLocation proxies the requests with absolute URIs, e.g. GET http://example.com/ HTTP/1.1, to the hosts
+// in the URIs and opens the tunnels for CONNECT requests. The clients configured to use vulcan as their HTTP proxy
+// go through the same middlewares as the reverse proxied requests, e.g. auth and rate limits:
+//
+//	l, _ := forwardloc.NewLocation("egress")
+//	l.GetMiddlewareChain().Add("auth", 0, authMiddleware)
+//	proxy, _ := vulcan.NewProxy(&route.ConstRouter{Location: l})
+//
+// CONNECT response body is the connection to the target, the proxy hijacks the client connection and copies
+// the data both ways. Tunnels are supported for HTTP/1.x clients only.
+//
+// Targets are checked against the destination policy: the host names, the ports and the networks of the addresses
+// the host names resolve to. By default the targets in the loopback, link-local and private networks are denied,
+// so the clients can not reach the internal services, e.g. the admin API or the cloud metadata endpoint.
+type ForwardLocation struct {
+	id              string
+	options         Options
+	transport       *http.Transport
+	dialer          *net.Dialer
+	middlewareChain *middleware.MiddlewareChain
+	observerChain   *middleware.ObserverChain
+	connectPorts    map[string]bool
+	forwardPorts    map[string]bool
+	allowNetworks   []*net.IPNet
+	denyNetworks    []*net.IPNet
+}
+
+type Timeouts struct {
+	// Socket read timeout (before we receive the first reply header)
+	Read time.Duration
+	// Socket connect timeout, for the tunnels as well
+	Dial time.Duration
+	// TLS handshake timeout
+	TlsHandshake time.Duration
+}
+
+type Options struct {
+	Timeouts Timeouts
+	// Ports the CONNECT tunnels can be opened to, DefaultConnectPorts by default
+	ConnectPorts []int
+	// Ports the requests with absolute URIs can be forwarded to, DefaultForwardPorts by default
+	ForwardPorts []int
+	// Hosts the requests can go to, e.g. "example.com", or ".example.com" for its subdomains. Empty list allows any host
+	AllowHosts []string
+	// Hosts the requests can not go to, in the same format as AllowHosts
+	DenyHosts []string
+	// Networks the targets are allowed in even if they are in DenyNetworks, e.g. "10.1.0.0/16" or "10.1.0.1"
+	AllowNetworks []string
+	// Networks the targets can not be in, DefaultDenyNetworks by default
+	DenyNetworks []string
+	// Maximum size of the request body in bytes, 0 means no limit
+	MaxBodyBytes int64
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultReadTimeout         = 10 * time.Second
+	DefaultDialTimeout         = 10 * time.Second
+	DefaultTlsHandshakeTimeout = 10 * time.Second
+)
+
+// Tunnels to the other ports could be used to reach arbitrary services, e.g. SMTP
+var DefaultConnectPorts = []int{443}
+
+var DefaultForwardPorts = []int{80, 443}
+
+// Loopback, link-local, private and other special purpose networks
+var DefaultDenyNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+func NewLocation(id string) (*ForwardLocation, error) {
+	return NewLocationWithOptions(id, Options{})
+}
+
+func NewLocationWithOptions(id string, o Options) (*ForwardLocation, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	allowNetworks, err := netutils.ParseCIDRs(o.AllowNetworks)
+	if err != nil {
+		return nil, err
+	}
+	denyNetworks, err := netutils.ParseCIDRs(o.DenyNetworks)
+	if err != nil {
+		return nil, err
+	}
+	l := &ForwardLocation{
+		id:              id,
+		options:         o,
+		dialer:          &net.Dialer{Timeout: o.Timeouts.Dial},
+		middlewareChain: middleware.NewMiddlewareChain(),
+		observerChain:   middleware.NewObserverChain(),
+		connectPorts:    portSet(o.ConnectPorts),
+		forwardPorts:    portSet(o.ForwardPorts),
+		allowNetworks:   allowNetworks,
+		denyNetworks:    denyNetworks,
+	}
+	l.transport = &http.Transport{
+		DialContext:           l.dial,
+		ResponseHeaderTimeout: o.Timeouts.Read,
+		TLSHandshakeTimeout:   o.Timeouts.TlsHandshake,
+	}
+	return l, nil
+}
+
+func (l *ForwardLocation) GetId() string {
+	return l.id
+}
+
+func (l *ForwardLocation) GetOptions() Options {
+	return l.options
+}
+
+func (l *ForwardLocation) GetMiddlewareChain() *middleware.MiddlewareChain {
+	return l.middlewareChain
+}
+
+func (l *ForwardLocation) GetObserverChain() *middleware.ObserverChain {
+	return l.observerChain
+}
+
+// RoundTrip forwards the request to the host in its URI, or connects to the host of the CONNECT request
+func (l *ForwardLocation) RoundTrip(req request.Request) (*http.Response, error) {
+	httpReq := req.GetHttpRequest()
+	if httpReq.Method != "CONNECT" && !httpReq.URL.IsAbs() {
+		log.Infof("%s has no absolute URI, rejecting", req)
+		return nil, errors.FromStatus(http.StatusBadRequest)
+	}
+	if l.options.MaxBodyBytes > 0 && httpReq.ContentLength > l.options.MaxBodyBytes {
+		return nil, errors.FromStatus(http.StatusRequestEntityTooLarge)
+	}
+	// Forward proxy does not fail over, so the body is streamed to the target as is
+	body := netutils.NewStreamingBody(httpReq.Body, httpReq.ContentLength, l.options.MaxBodyBytes)
+	req.SetBody(body)
+	defer body.Close()
+
+	response, err := l.roundTrip(req)
+	// Tunnel body is the connection to the target, it is not for the middlewares to modify
+	if response != nil && !(httpReq.Method == "CONNECT" && response.StatusCode == http.StatusOK) {
+		if err := l.middlewareChain.ModifyResponse(req, response); err != nil {
+			if response.Body != nil {
+				response.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	return response, err
+}
+
+// roundTrip executes the observers and middlewares chains around the round trip to the target
+func (l *ForwardLocation) roundTrip(req request.Request) (*http.Response, error) {
+	a := &request.BaseAttempt{}
+
+	l.observerChain.ObserveRequest(req)
+	defer l.observerChain.ObserveResponse(req, a)
+	defer req.AddAttempt(a)
+
+	it := l.middlewareChain.GetIter()
+	defer l.unwindIter(it, req, a)
+
+	for v := it.Next(); v != nil; v = it.Next() {
+		a.Response, a.Error = v.ProcessRequest(req)
+		if a.Response != nil || a.Error != nil {
+			// Move the iterator forward to count it again once we unwind the chain
+			it.Next()
+			return a.Response, a.Error
+		}
+	}
+
+	start := l.options.TimeProvider.UtcNow()
+	httpReq := req.GetHttpRequest()
+	if httpReq.Method == "CONNECT" {
+		a.Endpoint, a.Response, a.Error = l.connect(httpReq)
+	} else {
+		a.Endpoint, a.Response, a.Error = l.forward(httpReq, req.GetBody())
+	}
+	a.Duration = l.options.TimeProvider.UtcNow().Sub(start)
+	return a.Response, a.Error
+}
+
+// Unwind middlewares iterator in reverse order
+func (l *ForwardLocation) unwindIter(it *middleware.MiddlewareIter, req request.Request, a request.Attempt) {
+	for v := it.Prev(); v != nil; v = it.Prev() {
+		v.ProcessResponse(req, a)
+	}
+}
+
+// connect dials the target of the CONNECT request, the response body is the connection to the target
+func (l *ForwardLocation) connect(req *http.Request) (endpoint.Endpoint, *http.Response, error) {
+	target := req.URL.Host
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, errors.FromStatus(http.StatusBadRequest)
+	}
+	if err := l.checkTarget(host, port, l.connectPorts); err != nil {
+		return nil, nil, err
+	}
+	e, err := endpoint.NewHttpEndpoint(&url.URL{Scheme: "tcp", Host: target})
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := l.dial(req.Context(), "tcp", target)
+	if err != nil {
+		return e, nil, err
+	}
+	return e, &http.Response{
+		Status:        "200 Connection established",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          conn,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// forward sends the request to the host in its URI
+func (l *ForwardLocation) forward(req *http.Request, body netutils.MultiReader) (endpoint.Endpoint, *http.Response, error) {
+	port := req.URL.Port()
+	if port == "" {
+		port = defaultPorts[req.URL.Scheme]
+	}
+	if err := l.checkTarget(req.URL.Hostname(), port, l.forwardPorts); err != nil {
+		return nil, nil, err
+	}
+	e, err := endpoint.NewHttpEndpoint(&url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host})
+	if err != nil {
+		return nil, nil, err
+	}
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.URL = netutils.CopyUrl(req.URL)
+	// Client requests can not have RequestURI set
+	outReq.RequestURI = ""
+	outReq.Body = body
+	outReq.Close = false
+	outReq.Header = make(http.Header)
+	netutils.CopyHeaders(outReq.Header, req.Header)
+	// Proxy-Authorization and Proxy-Connection are meant for vulcan, not for the target
+	netutils.RemoveHopHeaders(outReq.Header)
+
+	re, err := l.transport.RoundTrip(outReq)
+	return e, re, err
+}
+
+// checkTarget applies the host and port policy, the networks are checked once the host is resolved, see dial
+func (l *ForwardLocation) checkTarget(host, port string, ports map[string]bool) error {
+	if !ports[port] {
+		log.Infof("Port %s of %s is not allowed", port, host)
+		return errors.FromStatus(http.StatusForbidden)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if (len(l.options.AllowHosts) != 0 && !matchHost(l.options.AllowHosts, host)) || matchHost(l.options.DenyHosts, host) {
+		log.Infof("Host %s is not allowed", host)
+		return errors.FromStatus(http.StatusForbidden)
+	}
+	return nil
+}
+
+// dial connects to the allowed address of the host. Addresses are checked after the host is resolved,
+// so the host names that point to the denied networks are denied as well.
+func (l *ForwardLocation) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.FromStatus(http.StatusForbidden)
+	for _, a := range addrs {
+		if !l.isAllowedIP(a.IP) {
+			log.Infof("Address %s of %s is not allowed", a.IP, host)
+			continue
+		}
+		var conn net.Conn
+		if conn, err = l.dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (l *ForwardLocation) isAllowedIP(ip net.IP) bool {
+	return netutils.ContainsIP(l.allowNetworks, ip) || !netutils.ContainsIP(l.denyNetworks, ip)
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if host == p || (strings.HasPrefix(p, ".") && strings.HasSuffix(host, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func portSet(ports []int) map[string]bool {
+	out := make(map[string]bool, len(ports))
+	for _, p := range ports {
+		out[strconv.Itoa(p)] = true
+	}
+	return out
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Timeouts.Read <= 0 {
+		o.Timeouts.Read = DefaultReadTimeout
+	}
+	if o.Timeouts.Dial <= 0 {
+		o.Timeouts.Dial = DefaultDialTimeout
+	}
+	if o.Timeouts.TlsHandshake <= 0 {
+		o.Timeouts.TlsHandshake = DefaultTlsHandshakeTimeout
+	}
+	if o.ConnectPorts == nil {
+		o.ConnectPorts = DefaultConnectPorts
+	}
+	if o.ForwardPorts == nil {
+		o.ForwardPorts = DefaultForwardPorts
+	}
+	for _, p := range append(append([]int{}, o.ConnectPorts...), o.ForwardPorts...) {
+		if p <= 0 || p > 65535 {
+			return o, fmt.Errorf("Invalid port: %d", p)
+		}
+	}
+	if o.DenyNetworks == nil {
+		o.DenyNetworks = DefaultDenyNetworks
+	}
+	if o.MaxBodyBytes < 0 {
+		return o, fmt.Errorf("Max body bytes can not be negative")
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
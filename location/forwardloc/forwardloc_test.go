@@ -0,0 +1,319 @@
+package forwardloc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/mailgun/vulcan"
+	. "github.com/mailgun/vulcan/middleware"
+	. "github.com/mailgun/vulcan/request"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func TestForwardLoc(t *testing.T) { TestingT(t) }
+
+type ForwardSuite struct{}
+
+var _ = Suite(&ForwardSuite{})
+
+func (s *ForwardSuite) newProxy(c *C, l *ForwardLocation) *httptest.Server {
+	p, err := vulcan.NewProxy(&ConstRouter{Location: l})
+	c.Assert(err, IsNil)
+	return httptest.NewServer(p)
+}
+
+func (s *ForwardSuite) TestForward(c *C) {
+	var upstreamHeader http.Header
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+
+	l, err := NewLocationWithOptions("egress", Options{
+		ForwardPorts:  []int{portOf(c, server.Listener.Addr())},
+		AllowNetworks: []string{"127.0.0.1"},
+	})
+	c.Assert(err, IsNil)
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("X-Other", "o")
+
+	re, err := s.client(c, proxy).Do(req)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(upstreamHeader.Get("Proxy-Authorization"), Equals, "")
+	c.Assert(upstreamHeader.Get("X-Other"), Equals, "o")
+}
+
+// Requests that are not meant for the forward proxy are rejected
+func (s *ForwardSuite) TestRelativeURI(c *C) {
+	l, err := NewLocation("egress")
+	c.Assert(err, IsNil)
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	re, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *ForwardSuite) TestConnect(c *C) {
+	target := newEchoServer(c)
+	defer target.Close()
+
+	l, err := NewLocationWithOptions("egress", Options{ConnectPorts: []int{portOf(c, target.Addr())}, AllowNetworks: []string{"127.0.0.1"}})
+	c.Assert(err, IsNil)
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	conn, reader, status := s.connect(c, proxy, target.Addr().String())
+	defer conn.Close()
+	c.Assert(status, Equals, "HTTP/1.1 200 Connection established\r\n")
+
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		_, err = io.WriteString(conn, msg)
+		c.Assert(err, IsNil)
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, msg)
+	}
+}
+
+func (s *ForwardSuite) TestConnectPortNotAllowed(c *C) {
+	target := newEchoServer(c)
+	defer target.Close()
+
+	l, err := NewLocation("egress")
+	c.Assert(err, IsNil)
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	conn, _, status := s.connect(c, proxy, target.Addr().String())
+	defer conn.Close()
+	c.Assert(status, Equals, "HTTP/1.1 403 Forbidden\r\n")
+}
+
+// Middlewares apply to the tunnels as well, e.g. to require proxy authentication
+func (s *ForwardSuite) TestConnectMiddleware(c *C) {
+	target := newEchoServer(c)
+	defer target.Close()
+
+	l, err := NewLocationWithOptions("egress", Options{ConnectPorts: []int{portOf(c, target.Addr())}, AllowNetworks: []string{"127.0.0.1"}})
+	c.Assert(err, IsNil)
+	var attempt Attempt
+	l.GetMiddlewareChain().Add("auth", 0, &MiddlewareWrapper{
+		OnRequest: func(r Request) (*http.Response, error) {
+			if r.GetHttpRequest().Header.Get("Proxy-Authorization") == "" {
+				re := &http.Response{StatusCode: http.StatusProxyAuthRequired, Header: http.Header{}, Body: http.NoBody}
+				return re, nil
+			}
+			return nil, nil
+		},
+		OnResponse: func(r Request, a Attempt) {
+			attempt = a
+		},
+	})
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	conn, _, status := s.connect(c, proxy, target.Addr().String())
+	conn.Close()
+	c.Assert(status, Equals, "HTTP/1.1 407 Proxy Authentication Required\r\n")
+
+	conn, _, status = s.connect(c, proxy, target.Addr().String(), "Proxy-Authorization: Basic secret")
+	conn.Close()
+	c.Assert(status, Equals, "HTTP/1.1 200 Connection established\r\n")
+	c.Assert(attempt.GetEndpoint().GetId(), Equals, "tcp://"+target.Addr().String())
+}
+
+// Middlewares can't modify the tunnel, e.g. wrap it to limit the bandwidth
+func (s *ForwardSuite) TestConnectModifyResponse(c *C) {
+	target := newEchoServer(c)
+	defer target.Close()
+
+	l, err := NewLocationWithOptions("egress", Options{ConnectPorts: []int{portOf(c, target.Addr())}, AllowNetworks: []string{"127.0.0.1"}})
+	c.Assert(err, IsNil)
+	l.GetMiddlewareChain().Add("wrap", 0, &MiddlewareWrapper{
+		OnModifyResponse: func(r Request, re *http.Response) error {
+			re.Body = ioutil.NopCloser(re.Body)
+			return nil
+		},
+	})
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	conn, reader, status := s.connect(c, proxy, target.Addr().String())
+	defer conn.Close()
+	c.Assert(status, Equals, "HTTP/1.1 200 Connection established\r\n")
+	_, err = io.WriteString(conn, "ping\n")
+	c.Assert(err, IsNil)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "ping\n")
+}
+
+// Internal networks are denied by default, for the tunnels and the forwarded requests
+func (s *ForwardSuite) TestDeniedNetworks(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	})
+	defer server.Close()
+	port := portOf(c, server.Listener.Addr())
+
+	l, err := NewLocationWithOptions("egress", Options{ConnectPorts: []int{port}, ForwardPorts: []int{port}})
+	c.Assert(err, IsNil)
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	for _, u := range []string{server.URL, fmt.Sprintf("http://localhost:%d", port)} {
+		re, err := s.client(c, proxy).Get(u)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		c.Assert(re.StatusCode, Equals, http.StatusForbidden, Commentf("%s", u))
+	}
+
+	conn, _, status := s.connect(c, proxy, server.Listener.Addr().String())
+	defer conn.Close()
+	c.Assert(status, Equals, "HTTP/1.1 403 Forbidden\r\n")
+}
+
+func (s *ForwardSuite) TestForwardPortNotAllowed(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+
+	l, err := NewLocationWithOptions("egress", Options{AllowNetworks: []string{"127.0.0.1"}})
+	c.Assert(err, IsNil)
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	re, err := s.client(c, proxy).Get(server.URL)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *ForwardSuite) TestHosts(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+	port := portOf(c, server.Listener.Addr())
+
+	tcs := []struct {
+		allow    []string
+		deny     []string
+		expected int
+	}{
+		{nil, nil, http.StatusOK},
+		{[]string{"127.0.0.1"}, nil, http.StatusOK},
+		{[]string{"example.com", ".example.com"}, nil, http.StatusForbidden},
+		{nil, []string{"127.0.0.1"}, http.StatusForbidden},
+	}
+	for _, tc := range tcs {
+		l, err := NewLocationWithOptions("egress", Options{
+			ForwardPorts:  []int{port},
+			AllowHosts:    tc.allow,
+			DenyHosts:     tc.deny,
+			AllowNetworks: []string{"127.0.0.0/8"},
+		})
+		c.Assert(err, IsNil)
+		proxy := s.newProxy(c, l)
+		re, err := s.client(c, proxy).Get(server.URL)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		proxy.Close()
+		c.Assert(re.StatusCode, Equals, tc.expected, Commentf("%v %v", tc.allow, tc.deny))
+	}
+	c.Assert(matchHost([]string{".example.com"}, "api.example.com"), Equals, true)
+	c.Assert(matchHost([]string{".example.com"}, "example.com"), Equals, false)
+	c.Assert(matchHost([]string{"Example.com"}, "example.com"), Equals, true)
+}
+
+func (s *ForwardSuite) TestBadParams(c *C) {
+	_, err := NewLocationWithOptions("egress", Options{ConnectPorts: []int{0}})
+	c.Assert(err, NotNil)
+
+	_, err = NewLocationWithOptions("egress", Options{ForwardPorts: []int{70000}})
+	c.Assert(err, NotNil)
+
+	_, err = NewLocationWithOptions("egress", Options{DenyNetworks: []string{"bad"}})
+	c.Assert(err, NotNil)
+
+	_, err = NewLocationWithOptions("egress", Options{MaxBodyBytes: -1})
+	c.Assert(err, NotNil)
+}
+
+// client returns the HTTP client that uses the proxy
+func (s *ForwardSuite) client(c *C, proxy *httptest.Server) *http.Client {
+	proxyURL, err := url.Parse(proxy.URL)
+	c.Assert(err, IsNil)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+// connect sends CONNECT request to the proxy and returns the connection and the status line of the response
+func (s *ForwardSuite) connect(c *C, proxy *httptest.Server, target string, headers ...string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	for _, h := range headers {
+		fmt.Fprintf(conn, "%s\r\n", h)
+	}
+	io.WriteString(conn, "\r\n")
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	if status == "HTTP/1.1 200 Connection established\r\n" {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, "\r\n")
+	}
+	return conn, reader, status
+}
+
+// newEchoServer returns the TCP server that sends back everything it reads
+func newEchoServer(c *C) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func portOf(c *C, addr net.Addr) int {
+	_, port, err := net.SplitHostPort(addr.String())
+	c.Assert(err, IsNil)
+	p, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+	return p
+}
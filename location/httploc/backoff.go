@@ -0,0 +1,77 @@
+package httploc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// Backoff controls the delay between failover attempts, so a flapping endpoint
+// is not hammered by instant retries.
+type Backoff struct {
+	// Delay before the first retry, 0 disables the backoff
+	Initial time.Duration
+	// Delay is multiplied by this value after each retry, at least 1, DefaultBackoffMultiplier by default
+	Multiplier float64
+	// Random fraction of the delay that is added or subtracted, e.g. 0.2 means +-20%
+	Jitter float64
+	// Maximum delay between retries, jitter included
+	Max time.Duration
+}
+
+const (
+	DefaultBackoffMultiplier = 2
+	DefaultBackoffMax        = 10 * time.Second
+)
+
+// Delay returns the delay before the retry that follows the given number of attempts
+func (b *Backoff) Delay(attempts int) time.Duration {
+	if b.Initial <= 0 || attempts <= 0 {
+		return 0
+	}
+	delay := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempts-1))
+	if b.Jitter > 0 {
+		delay = delay * (1 + b.Jitter*(2*rand.Float64()-1))
+	}
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	return time.Duration(delay)
+}
+
+// wait sleeps before the next attempt, returns error if the request context is done while waiting
+func (b *Backoff) wait(ctx context.Context, tp timetools.TimeProvider, attempts int) error {
+	delay := b.Delay(attempts)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-tp.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func parseBackoff(b Backoff) (Backoff, error) {
+	if b.Initial < 0 || b.Max < 0 || b.Multiplier < 0 {
+		return b, fmt.Errorf("Backoff settings can not be negative")
+	}
+	if b.Jitter < 0 || b.Jitter > 1 {
+		return b, fmt.Errorf("Backoff jitter should be in range [0, 1]")
+	}
+	if b.Multiplier == 0 {
+		b.Multiplier = DefaultBackoffMultiplier
+	}
+	if b.Multiplier < 1 {
+		return b, fmt.Errorf("Backoff multiplier should be at least 1")
+	}
+	if b.Max == 0 {
+		b.Max = DefaultBackoffMax
+	}
+	return b, nil
+}
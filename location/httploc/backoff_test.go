@@ -0,0 +1,91 @@
+package httploc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+type BackoffSuite struct {
+}
+
+var _ = Suite(&BackoffSuite{})
+
+func (s *BackoffSuite) TestDelay(c *C) {
+	b, err := parseBackoff(Backoff{Initial: time.Second, Max: 5 * time.Second})
+	c.Assert(err, IsNil)
+
+	c.Assert(b.Delay(0), Equals, time.Duration(0))
+	c.Assert(b.Delay(1), Equals, time.Second)
+	c.Assert(b.Delay(2), Equals, 2*time.Second)
+	c.Assert(b.Delay(3), Equals, 4*time.Second)
+	c.Assert(b.Delay(4), Equals, 5*time.Second)
+}
+
+func (s *BackoffSuite) TestDisabled(c *C) {
+	b, err := parseBackoff(Backoff{})
+	c.Assert(err, IsNil)
+	c.Assert(b.Delay(3), Equals, time.Duration(0))
+}
+
+func (s *BackoffSuite) TestJitter(c *C) {
+	b, err := parseBackoff(Backoff{Initial: time.Second, Jitter: 0.5})
+	c.Assert(err, IsNil)
+	for i := 0; i < 100; i++ {
+		d := b.Delay(1)
+		c.Assert(d >= 500*time.Millisecond && d <= 1500*time.Millisecond, Equals, true)
+	}
+}
+
+// Jitter does not push the delay over the maximum
+func (s *BackoffSuite) TestJitterMax(c *C) {
+	b, err := parseBackoff(Backoff{Initial: time.Second, Jitter: 0.5, Max: time.Second})
+	c.Assert(err, IsNil)
+	for i := 0; i < 100; i++ {
+		d := b.Delay(3)
+		c.Assert(d >= 500*time.Millisecond && d <= time.Second, Equals, true, Commentf("%s", d))
+	}
+}
+
+func (s *BackoffSuite) TestBadParams(c *C) {
+	_, err := parseBackoff(Backoff{Initial: -1})
+	c.Assert(err, NotNil)
+
+	_, err = parseBackoff(Backoff{Jitter: 2})
+	c.Assert(err, NotNil)
+
+	_, err = parseBackoff(Backoff{Initial: time.Second, Multiplier: 0.5})
+	c.Assert(err, NotNil)
+}
+
+func (s *BackoffSuite) TestBackoffBetweenAttempts(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	tm := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	start := tm.UtcNow()
+
+	ls := &LocSuite{tm: tm}
+	location, err := NewLocationWithOptions("dummy", ls.newRoundRobin("http://localhost:63999", server.URL), Options{
+		TimeProvider: tm,
+		Backoff:      Backoff{Initial: 3 * time.Second},
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	response, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(tm.UtcNow().Sub(start), Equals, 3*time.Second)
+}
@@ -0,0 +1,108 @@
+package httploc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/metrics"
+)
+
+// RetryBudget limits the retries to a share of the request volume over a rolling window,
+// so retries during a backend outage don't amplify the load. It can be shared by several
+// locations to enforce the global budget.
+type RetryBudget struct {
+	mutex    *sync.Mutex
+	options  RetryBudgetOptions
+	requests *metrics.RollingCounter
+	retries  *metrics.RollingCounter
+}
+
+type RetryBudgetOptions struct {
+	// Maximum ratio of retries to requests, e.g. 0.2 means retries may not exceed 20% of the requests
+	Ratio float64
+	// Retries allowed within the window regardless of the ratio, helps locations with low traffic
+	MinRetries int
+	// Rolling window size, rounded to seconds
+	Window time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultRetryBudgetRatio  = 0.2
+	DefaultRetryBudgetWindow = 10 * time.Second
+)
+
+func NewRetryBudget(ratio float64) (*RetryBudget, error) {
+	return NewRetryBudgetWithOptions(RetryBudgetOptions{Ratio: ratio})
+}
+
+func NewRetryBudgetWithOptions(o RetryBudgetOptions) (*RetryBudget, error) {
+	o, err := parseRetryBudgetOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	buckets := int(o.Window / time.Second)
+	requests, err := metrics.NewRollingCounter(buckets, time.Second, o.TimeProvider)
+	if err != nil {
+		return nil, err
+	}
+	retries, err := metrics.NewRollingCounter(buckets, time.Second, o.TimeProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &RetryBudget{
+		mutex:    &sync.Mutex{},
+		options:  o,
+		requests: requests,
+		retries:  retries,
+	}, nil
+}
+
+// RecordRequest counts the request towards the volume that the budget is computed from
+func (b *RetryBudget) RecordRequest() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.requests.Inc()
+}
+
+// AllowRetry tells whether there's a budget left for one more retry and withdraws it if so
+func (b *RetryBudget) AllowRetry() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	retries := b.retries.Count()
+	if retries >= int64(b.options.MinRetries) && float64(retries+1) > b.options.Ratio*float64(b.requests.Count()) {
+		return false
+	}
+	b.retries.Inc()
+	return true
+}
+
+// GetCounts returns the requests and retries counted in the current window
+func (b *RetryBudget) GetCounts() (requests int64, retries int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.requests.Count(), b.retries.Count()
+}
+
+func parseRetryBudgetOptions(o RetryBudgetOptions) (RetryBudgetOptions, error) {
+	if o.Ratio < 0 || o.MinRetries < 0 || o.Window < 0 {
+		return o, fmt.Errorf("Retry budget settings can not be negative")
+	}
+	if o.Ratio == 0 {
+		o.Ratio = DefaultRetryBudgetRatio
+	}
+	if o.Window == 0 {
+		o.Window = DefaultRetryBudgetWindow
+	}
+	if o.Window < time.Second {
+		return o, fmt.Errorf("Retry budget window should be at least a second")
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
@@ -0,0 +1,120 @@
+package httploc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+type BudgetSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&BudgetSuite{})
+
+func (s *BudgetSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *BudgetSuite) TestRatio(c *C) {
+	b, err := NewRetryBudgetWithOptions(RetryBudgetOptions{Ratio: 0.2, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	c.Assert(b.AllowRetry(), Equals, false)
+
+	for i := 0; i < 10; i++ {
+		b.RecordRequest()
+	}
+	c.Assert(b.AllowRetry(), Equals, true)
+	c.Assert(b.AllowRetry(), Equals, true)
+	c.Assert(b.AllowRetry(), Equals, false)
+
+	requests, retries := b.GetCounts()
+	c.Assert(requests, Equals, int64(10))
+	c.Assert(retries, Equals, int64(2))
+}
+
+func (s *BudgetSuite) TestMinRetries(c *C) {
+	b, err := NewRetryBudgetWithOptions(RetryBudgetOptions{MinRetries: 2, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	c.Assert(b.AllowRetry(), Equals, true)
+	c.Assert(b.AllowRetry(), Equals, true)
+	c.Assert(b.AllowRetry(), Equals, false)
+}
+
+func (s *BudgetSuite) TestWindowRolls(c *C) {
+	b, err := NewRetryBudgetWithOptions(RetryBudgetOptions{Ratio: 0.5, Window: 3 * time.Second, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	b.RecordRequest()
+	b.RecordRequest()
+	c.Assert(b.AllowRetry(), Equals, true)
+	c.Assert(b.AllowRetry(), Equals, false)
+
+	// Old requests and retries are out of the window
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(4 * time.Second)
+	c.Assert(b.AllowRetry(), Equals, false)
+	b.RecordRequest()
+	b.RecordRequest()
+	c.Assert(b.AllowRetry(), Equals, true)
+}
+
+func (s *BudgetSuite) TestBadOptions(c *C) {
+	_, err := NewRetryBudget(-1)
+	c.Assert(err, NotNil)
+
+	_, err = NewRetryBudgetWithOptions(RetryBudgetOptions{Window: time.Millisecond})
+	c.Assert(err, NotNil)
+
+	_, err = NewRetryBudgetWithOptions(RetryBudgetOptions{MinRetries: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *BudgetSuite) TestBudgetExhaustedFailsFast(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	budget, err := NewRetryBudgetWithOptions(RetryBudgetOptions{Ratio: 0.5, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	ls := &LocSuite{tm: s.tm}
+	location, err := NewLocationWithOptions("dummy", ls.newRoundRobin("http://localhost:63999", server.URL), Options{
+		TimeProvider: s.tm,
+		RetryBudget:  budget,
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	// One request is not enough to retry at 0.5 ratio, so the request fails fast
+	response, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+
+	// The second request gets to the good endpoint without the retry
+	response, _, err = MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+	// Now the budget allows the retry
+	response, _, err = MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+	requests, retries := budget.GetCounts()
+	c.Assert(requests, Equals, int64(3))
+	c.Assert(retries, Equals, int64(1))
+}
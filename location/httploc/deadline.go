@@ -0,0 +1,74 @@
+package httploc
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// totalTimer cancels the round trips once the total timeout of the location has passed,
+// or the deadline of the request, if the middlewares have set one
+type totalTimer struct {
+	tm       timetools.TimeProvider
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	deadline time.Time
+}
+
+func newTotalTimer(o *Options, cancel context.CancelFunc) *totalTimer {
+	t := &totalTimer{tm: o.TimeProvider, cancel: cancel}
+	if o.Timeouts.Total > 0 {
+		t.setDeadline(o.TimeProvider.UtcNow().Add(o.Timeouts.Total))
+	}
+	return t
+}
+
+// setDeadline re-arms the timer, the deadline replaces the total timeout
+func (t *totalTimer) setDeadline(deadline time.Time) {
+	if deadline.Equal(t.deadline) {
+		return
+	}
+	t.stop()
+	t.deadline = deadline
+	t.timer = time.AfterFunc(deadline.Sub(t.tm.UtcNow()), t.cancel)
+}
+
+// getDeadline returns the time the round trips are canceled at, false if there is no deadline
+func (t *totalTimer) getDeadline() (time.Time, bool) {
+	return t.deadline, !t.deadline.IsZero()
+}
+
+// remaining returns the time left until the deadline, false if there is no deadline
+func (t *totalTimer) remaining() (time.Duration, bool) {
+	if t.deadline.IsZero() {
+		return 0, false
+	}
+	return t.deadline.Sub(t.tm.UtcNow()), true
+}
+
+func (t *totalTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// setBudgetHeader tells the endpoint how many milliseconds are left before the proxy gives up on the request,
+// so it can shed the work that is doomed anyway. The budget is the time left until the deadline,
+// capped by the attempt timeout. The header sent by the client is removed, as the endpoints trust it.
+func setBudgetHeader(req *http.Request, o *Options, total *totalTimer) {
+	req.Header.Del(o.DeadlineHeader)
+	budget, ok := total.remaining()
+	if o.Timeouts.Attempt > 0 && (!ok || o.Timeouts.Attempt < budget) {
+		budget, ok = o.Timeouts.Attempt, true
+	}
+	if !ok {
+		return
+	}
+	if budget < 0 {
+		budget = 0
+	}
+	req.Header.Set(o.DeadlineHeader, strconv.FormatInt(int64(budget/time.Millisecond), 10))
+}
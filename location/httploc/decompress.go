@@ -0,0 +1,43 @@
+package httploc
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/vulcan/compress"
+)
+
+// decompressResponse decodes gzip encoded response of the endpoint if the client has not asked for gzip
+func decompressResponse(req *http.Request, re *http.Response) {
+	if re.Body == nil || !strings.EqualFold(re.Header.Get("Content-Encoding"), "gzip") || compress.AcceptsGzip(req) {
+		return
+	}
+	re.Body = &gunzipBody{src: re.Body}
+	re.ContentLength = -1
+	re.Uncompressed = true
+	re.Header.Del("Content-Encoding")
+	re.Header.Del("Content-Length")
+}
+
+// gunzipBody creates gzip reader on the first read, so the headers are not blocked by reading the gzip header
+type gunzipBody struct {
+	src io.ReadCloser
+	gz  *gzip.Reader
+	err error
+}
+
+func (b *gunzipBody) Read(p []byte) (int, error) {
+	if b.gz == nil && b.err == nil {
+		b.gz, b.err = gzip.NewReader(b.src)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.gz.Read(p)
+}
+
+func (b *gunzipBody) Close() error {
+	return b.src.Close()
+}
@@ -0,0 +1,35 @@
+package httploc
+
+import (
+	"net/url"
+)
+
+// HostHeader controls the Host header of the requests to the endpoints
+type HostHeader int
+
+const (
+	// Host requested by the client is passed to the endpoints, default
+	PreserveHost HostHeader = iota
+	// Host of the endpoint URL, e.g. for the virtual hosted endpoints that know their own names only
+	EndpointHost
+	// Host set in the options, e.g. the name of the service behind the endpoints
+	FixedHost
+)
+
+// upstreamHost returns the Host header for the request to the endpoint.
+// The host is set after the middlewares, so the forwarding headers carry the host requested by the client
+func upstreamHost(o *Options, u *url.URL, host string) string {
+	switch o.HostHeader {
+	case FixedHost:
+		return o.Host
+	case EndpointHost:
+		if u.Scheme == unixScheme {
+			return unixHostHeader(u, "")
+		}
+		return u.Host
+	}
+	if u.Scheme == unixScheme {
+		return unixHostHeader(u, host)
+	}
+	return host
+}
@@ -2,10 +2,17 @@
 package httploc
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,6 +24,7 @@ import (
 	"github.com/mailgun/vulcan/loadbalance"
 	"github.com/mailgun/vulcan/middleware"
 	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/proxyproto"
 	"github.com/mailgun/vulcan/request"
 	"github.com/mailgun/vulcan/threshold"
 )
@@ -40,12 +48,19 @@ type HttpLocation struct {
 }
 
 type Timeouts struct {
-	// Socket read timeout (before we receive the first reply header)
+	// Socket read timeout (before we receive the first reply header), the response header timeout of the transport
 	Read time.Duration
 	// Socket connect timeout
 	Dial time.Duration
 	// TLS handshake timeout
 	TlsHandshake time.Duration
+	// Maximum time to wait for the response headers on each failover attempt, 0 means no limit.
+	// Attempts that time out are treated as network errors and can fail over to the next endpoint.
+	Attempt time.Duration
+	// Maximum time to spend on all failover attempts together, 0 means no limit.
+	// Requests that exceed it are replied with 504 Gateway Timeout.
+	// Deadline set on the request by the middlewares, see request.SetDeadline, replaces it.
+	Total time.Duration
 }
 
 type KeepAlive struct {
@@ -53,12 +68,51 @@ type KeepAlive struct {
 	Period time.Duration
 	// How many idle connections will be kept per host
 	MaxIdleConnsPerHost int
+	// How long the idle connection is kept before it's closed
+	IdleConnTimeout time.Duration
 }
 
-// Limits contains various limits one can supply for a location.
+// Limits contains various limits one can supply for a location. Requests with the bodies over
+// MaxBodyBytes are rejected with 413 Request Entity Too Large, both the ones with Content-Length
+// and the chunked ones, so the limits can be set per location with SetOptions.
 type Limits struct {
-	MaxMemBodyBytes int64 // Maximum size to keep in memory before buffering to disk
-	MaxBodyBytes    int64 // Maximum size of a request body in bytes
+	MaxMemBodyBytes int64 // Maximum size to keep in memory before buffering to disk, netutils.DefaultMemBufferBytes by default
+	MaxBodyBytes    int64 // Maximum size of a request body in bytes, 0 means no limit
+	// Directory for the request bodies over MaxMemBodyBytes, os.TempDir() by default
+	BodyTempDir string
+}
+
+// Streaming controls how the response is written back to the client.
+type Streaming struct {
+	// Flush the response to the client as it arrives from the backend, e.g. for server sent events or long polling.
+	Enabled bool
+	// How often to flush the response, 0 means flush after every chunk read from the backend.
+	FlushInterval time.Duration
+	// Let the endpoint stream the response while the client is still sending the request body,
+	// e.g. for gRPC bidirectional streams. Requires PassThroughBody, the response is streamed even if Enabled is not set.
+	FullDuplex bool
+}
+
+// TLS controls the connections to the https endpoints, Go defaults are used if not set.
+type TLS struct {
+	// Certificate authorities the endpoint certificates are verified against, system roots by default
+	RootCAs *x509.CertPool
+	// Certificate presented to the endpoints that require mutual TLS, e.g. from tls.LoadX509KeyPair
+	ClientCertificate *tls.Certificate
+	// Name sent in SNI and checked against the endpoint certificates, the host of the endpoint URL by default
+	ServerName string
+	// Accept any certificate of the endpoints. This makes the connections open to man in the middle attacks,
+	// prefer RootCAs with the certificate of the endpoints
+	InsecureSkipVerify bool
+}
+
+// HTTP2 controls the protocol spoken to the endpoints, HTTP/1.1 is used by default.
+type HTTP2 struct {
+	// Negotiate HTTP/2 with the https endpoints using TLS ALPN, falls back to HTTP/1.1 if the endpoint does not support it.
+	Enabled bool
+	// Speak HTTP/2 with prior knowledge (h2c) to the plain http endpoints. All endpoints of the location,
+	// including the https ones, should support HTTP/2, as there is no way to negotiate the protocol.
+	Cleartext bool
 }
 
 // Additional options to control this location, such as timeouts
@@ -68,12 +122,53 @@ type Options struct {
 	KeepAlive KeepAlive
 	// Limits contains various limits one can supply for a location.
 	Limits Limits
+	// Controls streaming of the responses to the client
+	Streaming Streaming
+	// Controls TLS to the https endpoints, e.g. mutual TLS
+	TLS TLS
+	// Controls HTTP/2 to the endpoints, e.g. for gRPC and multiplexing the requests over fewer connections
+	HTTP2 HTTP2
 	// Predicate that defines when requests are allowed to failover
 	FailoverPredicate threshold.Predicate
+	// Delay between failover attempts
+	Backoff Backoff
+	// Limits the share of retries in the request volume, nil means no limit
+	RetryBudget *RetryBudget
+	// Decode gzip encoded responses of the endpoints for the clients that have not asked for gzip
+	Decompress bool
+	// Don't ask the endpoints for gzip on behalf of the clients that have not asked for it. By default the transport
+	// does so and decodes the responses transparently, trading the proxy CPU for the bandwidth to the endpoints
+	DisableCompression bool
+	// Stream the request bodies to the endpoints without buffering them. Requests fail over only
+	// if the body has not been sent yet, and the middlewares that read the body, e.g. signature verifier,
+	// can not be used.
+	PassThroughBody bool
+	// Path prefix removed from the request URI before proxying, e.g. location mounted at /api/v1
+	// forwards /api/v1/users as /users. Relative redirects of the endpoints get the prefix back.
+	StripPrefix string
+	// Send the PROXY protocol header of this version, 1 or 2, to the endpoints, so they see the address
+	// of the client. Header describes the whole connection, so the connections to the endpoints are not reused
+	ProxyProtocolVersion int
+	// Host header sent to the endpoints, PreserveHost by default. Endpoints listening on the unix sockets
+	// get the host of their URLs, if set, unless FixedHost is used
+	HostHeader HostHeader
+	// Host header value for FixedHost
+	Host string
 	// Used in forwarding headers
 	Hostname string
-	// In this case appends new forward info to the existing header
+	// In this case appends new forward info to the existing header of all clients, otherwise
+	// only the headers of the requests from the proxies in vulcan.Options.TrustedCIDRs are appended to
 	TrustForwardHeader bool
+	// Forwarding headers sent to the endpoints, e.g. XForwardedHeaders | ForwardedHeader sends both.
+	// XForwardedHeaders by default
+	ForwardingHeaders ForwardingHeaders
+	// Pseudonym of the proxy added to the Via header of the requests and responses, e.g. "vulcan".
+	// Via is not modified if empty
+	Via string
+	// Header that tells the endpoints the time left to process the request in milliseconds,
+	// e.g. X-Request-Deadline-Ms, so they can shed the work the proxy won't wait for. The budget is
+	// what's left of the total timeout after the retries, capped by the attempt timeout. Not sent if empty
+	DeadlineHeader string
 	// Time provider (useful for testing purposes)
 	TimeProvider timetools.TimeProvider
 }
@@ -95,7 +190,7 @@ func NewLocationWithOptions(id string, loadBalancer loadbalance.LoadBalancer, o
 	observerChain.Add(BalancerId, loadBalancer)
 
 	middlewareChain := middleware.NewMiddlewareChain()
-	middlewareChain.Add(RewriterId, -2, &Rewriter{TrustForwardHeader: o.TrustForwardHeader, Hostname: o.Hostname})
+	middlewareChain.Add(RewriterId, -2, newRewriter(o))
 	middlewareChain.Add(BalancerId, -1, loadBalancer)
 
 	return &HttpLocation{
@@ -117,7 +212,7 @@ func (l *HttpLocation) SetOptions(o Options) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	if err := l.middlewareChain.Update(RewriterId, -2, &Rewriter{TrustForwardHeader: o.TrustForwardHeader, Hostname: o.Hostname}); err != nil {
+	if err := l.middlewareChain.Update(RewriterId, -2, newRewriter(options)); err != nil {
 		return err
 	}
 	l.options = options
@@ -131,6 +226,17 @@ func (l *HttpLocation) GetOptions() Options {
 	return l.options
 }
 
+// GetFlushInterval tells the proxy whether to stream the response back to the client.
+func (l *HttpLocation) GetFlushInterval() (time.Duration, bool) {
+	o := l.GetOptions()
+	return o.Streaming.FlushInterval, o.Streaming.Enabled || o.Streaming.FullDuplex
+}
+
+// IsFullDuplex tells the proxy whether the request body is read while the response is streamed.
+func (l *HttpLocation) IsFullDuplex() bool {
+	return l.GetOptions().Streaming.FullDuplex
+}
+
 func (l *HttpLocation) GetOptionsAndTransport() (Options, *http.Transport) {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
@@ -160,18 +266,11 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 	originalRequest := req.GetHttpRequest()
 
 	//  Check request size first, if that exceeds the limit, we don't bother reading the request.
-	if l.isRequestOverLimit(req) {
+	if isRequestOverLimit(&o, req) {
 		return nil, errors.FromStatus(http.StatusRequestEntityTooLarge)
 	}
 
-	// Read the body while keeping this location's limits in mind. This reader controls the maximum bytes
-	// to read into memory and disk. This reader returns anerror if the total request size exceeds the
-	// prefefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
-	// and the reader would be unbounded bufio in the http.Server
-	body, err := netutils.NewBodyBufferWithOptions(originalRequest.Body, netutils.BodyBufferOptions{
-		MemBufferBytes: o.Limits.MaxMemBodyBytes,
-		MaxSizeBytes:   o.Limits.MaxBodyBytes,
-	})
+	body, err := newBody(&o, originalRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -179,17 +278,52 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 		return nil, fmt.Errorf("Empty body")
 	}
 
-	// Set request body to buffered reader that can replay the read and execute Seek
+	// Set request body to the reader that can replay the read and execute Seek
 	req.SetBody(body)
 	// Note that we don't change the original request Body as it's handled by the http server
 	defer body.Close()
 
+	// Pin the request context, so the contexts of the individual attempts below don't replace it.
+	// All attempts share this context, so it bounds them with the total timeout.
+	parent := req.GetContext()
+	total, cancelTotal := context.WithCancel(parent)
+	req.SetContext(total)
+
+	timer := newTotalTimer(&o, cancelTotal)
+	response, err := l.roundTrip(tr, &o, req, originalRequest, timer)
+	timer.stop()
+	if response != nil && response.Body != nil {
+		response.Body = &cancelBody{ReadCloser: response.Body, cancel: cancelTotal}
+		return response, err
+	}
+	// Total ctx is canceled while the client is still there, so it's our deadline that has passed
+	expired := total.Err() != nil && parent.Err() == nil
+	cancelTotal()
+	if expired {
+		deadline, _ := timer.getDeadline()
+		log.Errorf("%s exceeded deadline %s", req, deadline)
+		return nil, errors.FromStatus(http.StatusGatewayTimeout)
+	}
+	return response, err
+}
+
+// roundTrip proxies the request to the endpoints until it succeeds or failover predicate gives up
+func (l *HttpLocation) roundTrip(tr *http.Transport, o *Options, req request.Request, originalRequest *http.Request, total *totalTimer) (*http.Response, error) {
+	if o.RetryBudget != nil {
+		o.RetryBudget.RecordRequest()
+	}
+
 	for {
 		_, err := req.GetBody().Seek(0, 0)
 		if err != nil {
 			return nil, err
 		}
 
+		// Client has gone away or the deadline has passed, no point in trying again
+		if err := req.GetContext().Err(); err != nil {
+			return nil, err
+		}
+
 		endpoint, err := l.loadBalancer.NextEndpoint(req)
 		if err != nil {
 			log.Errorf("Load Balancer failure: %s", err)
@@ -198,21 +332,105 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 
 		// Adds headers, changes urls. Note that we rewrite request each time we proxy it to the
 		// endpoint, so that each try gets a fresh start
-		req.SetHttpRequest(l.copyRequest(originalRequest, req.GetBody(), endpoint))
+		// The request carries the context, so the round trip is canceled once the client disconnects.
+		outReq := l.copyRequest(originalRequest, req.GetBody(), endpoint, o)
+		ctx, cancel := context.WithCancel(req.GetContext())
+		req.SetHttpRequest(outReq.WithContext(ctx))
+
+		var timer *time.Timer
+		if o.Timeouts.Attempt > 0 {
+			timer = time.AfterFunc(o.Timeouts.Attempt, cancel)
+		}
 
 		// In case if error is not nil, we allow load balancer to choose the next endpoint
 		// e.g. to do request failover. Nil error means that we got proxied the request successfully.
-		response, err := l.proxyToEndpoint(tr, &o, endpoint, req)
-		if o.FailoverPredicate(req) {
+		response, err := l.proxyToEndpoint(tr, o, endpoint, req, total)
+		if timer != nil {
+			timer.Stop()
+		}
+		if o.FailoverPredicate(req) && canReplay(req) && l.allowRetry(o, req) {
+			// The response is discarded, so release the connection to the endpoint
+			if response != nil && response.Body != nil {
+				response.Body.Close()
+			}
+			cancel()
+			if err := o.Backoff.wait(req.GetContext(), o.TimeProvider, len(req.GetAttempts())); err != nil {
+				return nil, err
+			}
 			continue
+		}
+		if response != nil && o.Decompress {
+			decompressResponse(originalRequest, response)
+		}
+		if response != nil {
+			restorePrefix(originalRequest, response, o.StripPrefix)
+		}
+		if response != nil {
+			if err := l.middlewareChain.ModifyResponse(req, response); err != nil {
+				if response.Body != nil {
+					response.Body.Close()
+				}
+				cancel()
+				return nil, err
+			}
+		}
+		if response != nil && response.Body != nil {
+			response.Body = &cancelBody{ReadCloser: response.Body, cancel: cancel}
 		} else {
-			return response, err
+			cancel()
 		}
+		return response, err
 	}
 	log.Errorf("All endpoints failed!")
 	return nil, fmt.Errorf("All endpoints failed")
 }
 
+// newBody returns the reader of the request body, buffered unless the location passes the body through
+func newBody(o *Options, req *http.Request) (netutils.MultiReader, error) {
+	if o.PassThroughBody {
+		return netutils.NewStreamingBody(req.Body, req.ContentLength, o.Limits.MaxBodyBytes), nil
+	}
+	// Read the body while keeping this location's limits in mind. This reader controls the maximum bytes
+	// to read into memory and disk. This reader returns anerror if the total request size exceeds the
+	// prefefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
+	// and the reader would be unbounded bufio in the http.Server
+	return netutils.NewBodyBufferWithOptions(req.Body, netutils.BodyBufferOptions{
+		MemBufferBytes: o.Limits.MaxMemBodyBytes,
+		MaxSizeBytes:   o.Limits.MaxBodyBytes,
+		TempDir:        o.Limits.BodyTempDir,
+	})
+}
+
+// canReplay tells whether the body can be sent again, pass-through bodies can not once they have been read
+func canReplay(req request.Request) bool {
+	if _, err := req.GetBody().Seek(0, 0); err != nil {
+		log.Warningf("%s can not fail over: %s", req, err)
+		return false
+	}
+	return true
+}
+
+// allowRetry fails fast instead of retrying when the retry budget is exhausted
+func (l *HttpLocation) allowRetry(o *Options, req request.Request) bool {
+	if o.RetryBudget == nil || o.RetryBudget.AllowRetry() {
+		return true
+	}
+	log.Warningf("%s retry budget is exhausted, failing fast", req)
+	return false
+}
+
+// cancelBody releases the attempt context once the proxy is done reading the response
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 func (l *HttpLocation) GetLoadBalancer() loadbalance.LoadBalancer {
 	return l.loadBalancer
 }
@@ -228,15 +446,16 @@ func (l *HttpLocation) unwindIter(it *middleware.MiddlewareIter, req request.Req
 	}
 }
 
-func (l *HttpLocation) isRequestOverLimit(req request.Request) bool {
-	if l.options.Limits.MaxBodyBytes <= 0 {
+// isRequestOverLimit checks the options of the round trip, as SetOptions can change the limits concurrently
+func isRequestOverLimit(o *Options, req request.Request) bool {
+	if o.Limits.MaxBodyBytes <= 0 {
 		return false
 	}
-	return req.GetHttpRequest().ContentLength > l.options.Limits.MaxBodyBytes
+	return req.GetHttpRequest().ContentLength > o.Limits.MaxBodyBytes
 }
 
 // Proxy the request to the given endpoint, execute observers and middlewares chains
-func (l *HttpLocation) proxyToEndpoint(tr *http.Transport, o *Options, endpoint endpoint.Endpoint, req request.Request) (*http.Response, error) {
+func (l *HttpLocation) proxyToEndpoint(tr *http.Transport, o *Options, endpoint endpoint.Endpoint, req request.Request, total *totalTimer) (*http.Response, error) {
 
 	a := &request.BaseAttempt{Endpoint: endpoint}
 
@@ -257,24 +476,56 @@ func (l *HttpLocation) proxyToEndpoint(tr *http.Transport, o *Options, endpoint
 		}
 	}
 
+	// Middlewares may have set the deadline of the request, e.g. from the per-plan limits
+	if deadline, ok := req.GetDeadline(); ok {
+		total.setDeadline(deadline)
+	}
+	if o.DeadlineHeader != "" {
+		setBudgetHeader(req.GetHttpRequest(), o, total)
+	}
+
 	// Forward the request and mirror the response
 	start := o.TimeProvider.UtcNow()
-	a.Response, a.Error = tr.RoundTrip(req.GetHttpRequest())
+	timings := newTimingsRecorder(o.TimeProvider, start)
+	outReq := req.GetHttpRequest()
+	ctx := httptrace.WithClientTrace(outReq.Context(), timings.clientTrace())
+	if o.ProxyProtocolVersion != 0 {
+		ctx = proxyproto.ContextWithHeader(ctx, proxyproto.HeaderFromRequest(outReq))
+	}
+	outReq = outReq.WithContext(ctx)
+	outReq.Host = upstreamHost(o, endpoint.GetUrl(), outReq.Host)
+	a.Response, a.Error = tr.RoundTrip(outReq)
 	a.Duration = o.TimeProvider.UtcNow().Sub(start)
+	a.Timings = timings.getTimings()
 	return a.Response, a.Error
 }
 
-func (l *HttpLocation) copyRequest(req *http.Request, body netutils.MultiReader, endpoint endpoint.Endpoint) *http.Request {
+func (l *HttpLocation) copyRequest(req *http.Request, body netutils.MultiReader, endpoint endpoint.Endpoint, o *Options) *http.Request {
 	outReq := new(http.Request)
 	*outReq = *req // includes shallow copies of maps, but we handle this below
 
 	// Set the body to the enhanced body that can be re-read multiple times and buffered to disk
 	outReq.Body = body
 
+	// URL is copied as well, so the changes of the middlewares do not leak to the next attempt
+	u := *req.URL
+	outReq.URL = &u
+	outReq.RequestURI = stripPrefix(req.RequestURI, o.StripPrefix)
+	if outReq.RequestURI != req.RequestURI {
+		if parsed, err := url.ParseRequestURI(outReq.RequestURI); err == nil {
+			outReq.URL.Path, outReq.URL.RawPath = parsed.Path, parsed.RawPath
+		}
+	}
+
 	endpointURL := endpoint.GetUrl()
-	outReq.URL.Scheme = endpointURL.Scheme
-	outReq.URL.Host = endpointURL.Host
-	outReq.URL.Opaque = req.RequestURI
+	if endpointURL.Scheme == unixScheme {
+		outReq.URL.Scheme = "http"
+		outReq.URL.Host = unixSocketHost(endpointURL.Path)
+	} else {
+		outReq.URL.Scheme = endpointURL.Scheme
+		outReq.URL.Host = endpointURL.Host
+	}
+	outReq.URL.Opaque = outReq.RequestURI
 	// raw query is already included in RequestURI, so ignore it to avoid dupes
 	outReq.URL.RawQuery = ""
 
@@ -297,6 +548,7 @@ const (
 	DefaultTlsHandshakeTimeout = time.Duration(10) * time.Second
 	DefaultKeepAlivePeriod     = time.Duration(30) * time.Second
 	DefaultMaxIdleConnsPerHost = 2
+	DefaultIdleConnTimeout     = time.Duration(90) * time.Second
 )
 
 func parseOptions(o Options) (Options, error) {
@@ -315,9 +567,62 @@ func parseOptions(o Options) (Options, error) {
 	if o.KeepAlive.Period <= time.Duration(0) {
 		o.KeepAlive.Period = DefaultKeepAlivePeriod
 	}
+	backoff, err := parseBackoff(o.Backoff)
+	if err != nil {
+		return o, err
+	}
+	o.Backoff = backoff
+	if o.Timeouts.Attempt < 0 {
+		return o, fmt.Errorf("Attempt timeout can not be negative")
+	}
+	if o.Timeouts.Total < 0 {
+		return o, fmt.Errorf("Total timeout can not be negative")
+	}
+	if o.Streaming.FlushInterval < 0 {
+		return o, fmt.Errorf("FlushInterval can not be negative")
+	}
+	if o.Streaming.FullDuplex && !o.PassThroughBody {
+		return o, fmt.Errorf("FullDuplex streaming requires PassThroughBody")
+	}
+	if o.StripPrefix != "" {
+		if !strings.HasPrefix(o.StripPrefix, "/") {
+			return o, fmt.Errorf("StripPrefix should start with /")
+		}
+		o.StripPrefix = strings.TrimRight(o.StripPrefix, "/")
+	}
+	if o.ProxyProtocolVersion != 0 && o.ProxyProtocolVersion != 1 && o.ProxyProtocolVersion != 2 {
+		return o, fmt.Errorf("Unsupported PROXY protocol version: %d", o.ProxyProtocolVersion)
+	}
+	if o.ForwardingHeaders == 0 {
+		o.ForwardingHeaders = XForwardedHeaders
+	}
+	if o.ForwardingHeaders&^(XForwardedHeaders|ForwardedHeader) != 0 {
+		return o, fmt.Errorf("Unsupported forwarding headers: %d", o.ForwardingHeaders)
+	}
+	if strings.ContainsAny(o.Via, " \t,;\"") {
+		return o, fmt.Errorf("Via should be a single token, e.g. vulcan, got %q", o.Via)
+	}
+	if o.DeadlineHeader != "" && !isToken(o.DeadlineHeader) {
+		return o, fmt.Errorf("Invalid deadline header name: %q", o.DeadlineHeader)
+	}
+	switch o.HostHeader {
+	case PreserveHost, EndpointHost:
+		if o.Host != "" {
+			return o, fmt.Errorf("Host is used with FixedHost only")
+		}
+	case FixedHost:
+		if o.Host == "" {
+			return o, fmt.Errorf("FixedHost requires Host")
+		}
+	default:
+		return o, fmt.Errorf("Unsupported Host header mode: %d", o.HostHeader)
+	}
 	if o.KeepAlive.MaxIdleConnsPerHost <= 0 {
 		o.KeepAlive.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
 	}
+	if o.KeepAlive.IdleConnTimeout <= 0 {
+		o.KeepAlive.IdleConnTimeout = DefaultIdleConnTimeout
+	}
 
 	if o.Hostname == "" {
 		h, err := os.Hostname()
@@ -340,14 +645,53 @@ func parseOptions(o Options) (Options, error) {
 }
 
 func newTransport(o Options) *http.Transport {
-	return &http.Transport{
-		Dial: (&net.Dialer{
+	tr := &http.Transport{
+		// Dialer gets the context of the request, so the DNS and connect phases are reported to the trace
+		DialContext: dialUnixSockets((&net.Dialer{
 			Timeout:   o.Timeouts.Dial,
 			KeepAlive: o.KeepAlive.Period,
-		}).Dial,
+		}).DialContext),
 		ResponseHeaderTimeout: o.Timeouts.Read,
 		TLSHandshakeTimeout:   o.Timeouts.TlsHandshake,
+		TLSClientConfig:       newTLSConfig(o.TLS),
+		MaxIdleConnsPerHost:   o.KeepAlive.MaxIdleConnsPerHost,
+		IdleConnTimeout:       o.KeepAlive.IdleConnTimeout,
+		DisableCompression:    o.DisableCompression,
+	}
+	if o.HTTP2.Enabled || o.HTTP2.Cleartext {
+		// Transport with the custom dialer does not try HTTP/2 unless asked to
+		tr.ForceAttemptHTTP2 = true
+		tr.Protocols = &http.Protocols{}
+		tr.Protocols.SetHTTP2(true)
+		if o.HTTP2.Cleartext {
+			tr.Protocols.SetUnencryptedHTTP2(true)
+		} else {
+			tr.Protocols.SetHTTP1(true)
+		}
+	}
+	if o.ProxyProtocolVersion != 0 {
+		// Version is validated by parseOptions
+		dial, _ := proxyproto.NewDialFunc(tr.DialContext, o.ProxyProtocolVersion)
+		tr.DialContext = dial
+		tr.DisableKeepAlives = true
+	}
+	return tr
+}
+
+// newTLSConfig returns nil if there are no settings, so the transport uses the defaults
+func newTLSConfig(t TLS) *tls.Config {
+	if t.RootCAs == nil && t.ClientCertificate == nil && t.ServerName == "" && !t.InsecureSkipVerify {
+		return nil
+	}
+	c := &tls.Config{
+		RootCAs:            t.RootCAs,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.ClientCertificate != nil {
+		c.Certificates = []tls.Certificate{*t.ClientCertificate}
 	}
+	return c
 }
 
 const (
@@ -2,11 +2,24 @@ package httploc
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,11 +32,13 @@ import (
 	"github.com/mailgun/vulcan/loadbalance/roundrobin"
 	. "github.com/mailgun/vulcan/middleware"
 	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/proxyproto"
 	. "github.com/mailgun/vulcan/request"
 	. "github.com/mailgun/vulcan/route"
 	"github.com/mailgun/vulcan/route/exproute"
 	"github.com/mailgun/vulcan/route/hostroute"
 	. "github.com/mailgun/vulcan/testutils"
+	"github.com/mailgun/vulcan/threshold"
 	. "gopkg.in/check.v1"
 )
 
@@ -378,6 +393,519 @@ func (s *LocSuite) TestForwardedHeaders(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *LocSuite) TestForwardedHeader(c *C) {
+	var upstreamHeader http.Header
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		TrustForwardHeader: true,
+		ForwardingHeaders:  XForwardedHeaders | ForwardedHeader,
+		Hostname:           "proxy1",
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	hdr := http.Header{}
+	hdr.Set(headers.Forwarded, `for="[2001:db8::1]";proto=https`)
+	hdr.Set(headers.XForwardedFor, "192.168.1.1")
+	_, _, err = MakeRequest(proxy.URL, Opts{Headers: hdr, Host: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(upstreamHeader.Get(headers.Forwarded), Equals,
+		`for="[2001:db8::1]";proto=https, for=127.0.0.1;proto=http;host=example.com;by=proxy1`)
+	c.Assert(upstreamHeader.Get(headers.XForwardedFor), Equals, "192.168.1.1, 127.0.0.1")
+}
+
+// Legacy headers of the untrusted clients are removed when only the Forwarded header is sent
+func (s *LocSuite) TestForwardedHeaderOnly(c *C) {
+	var upstreamHeader http.Header
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		ForwardingHeaders: ForwardedHeader,
+		Hostname:          "proxy1",
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	hdr := http.Header{}
+	hdr.Set(headers.Forwarded, "for=10.0.0.1")
+	hdr.Set(headers.XForwardedFor, "10.0.0.1")
+	_, _, err = MakeRequest(proxy.URL, Opts{Headers: hdr, Host: "example.com:8080"})
+	c.Assert(err, IsNil)
+	c.Assert(upstreamHeader.Get(headers.Forwarded), Equals, `for=127.0.0.1;proto=http;host="example.com:8080";by=proxy1`)
+	c.Assert(upstreamHeader.Get(headers.XForwardedFor), Equals, "")
+}
+
+func (s *LocSuite) TestVia(c *C) {
+	var upstreamHeader http.Header
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+		w.Header().Set(headers.Via, "1.1 backend")
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{Via: "vulcan"})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	hdr := http.Header{}
+	hdr.Set(headers.Via, "1.0 fred")
+	re, body, err := MakeRequest(proxy.URL, Opts{Headers: hdr})
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(upstreamHeader.Get(headers.Via), Equals, "1.0 fred, 1.1 vulcan")
+	c.Assert(re.Header.Get(headers.Via), Equals, "1.1 backend, 1.1 vulcan")
+}
+
+// Forward headers are appended to only for the requests from the trusted proxies
+func (s *LocSuite) TestTrustedCIDRs(c *C) {
+	var forwardedFor string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get(headers.XForwardedFor)
+	})
+	defer server.Close()
+
+	tcs := []struct {
+		cidrs    []string
+		expected string
+	}{
+		{[]string{"10.0.0.0/8", "127.0.0.1"}, "192.168.1.1, 127.0.0.1"},
+		{[]string{"10.0.0.0/8"}, "127.0.0.1"},
+	}
+	for _, tc := range tcs {
+		location, err := NewLocation("dummy", s.newRoundRobin(server.URL))
+		c.Assert(err, IsNil)
+		p, err := vulcan.NewProxyWithOptions(&ConstRouter{Location: location}, vulcan.Options{TrustedCIDRs: tc.cidrs})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(p)
+
+		_, _, err = MakeRequest(proxy.URL, Opts{Headers: http.Header{headers.XForwardedFor: []string{"192.168.1.1"}}})
+		proxy.Close()
+		c.Assert(err, IsNil)
+		c.Assert(forwardedFor, Equals, tc.expected, Commentf("%v", tc.cidrs))
+	}
+}
+
+func (s *LocSuite) TestTransportOptions(c *C) {
+	location, err := NewLocation("dummy", s.newRoundRobin())
+	c.Assert(err, IsNil)
+	_, tr := location.GetOptionsAndTransport()
+	c.Assert(tr.ResponseHeaderTimeout, Equals, DefaultHttpReadTimeout)
+	c.Assert(tr.MaxIdleConnsPerHost, Equals, DefaultMaxIdleConnsPerHost)
+	c.Assert(tr.IdleConnTimeout, Equals, DefaultIdleConnTimeout)
+	c.Assert(tr.DisableCompression, Equals, false)
+
+	err = location.SetOptions(Options{
+		Timeouts:           Timeouts{Read: time.Second},
+		KeepAlive:          KeepAlive{MaxIdleConnsPerHost: 16, IdleConnTimeout: time.Minute},
+		DisableCompression: true,
+	})
+	c.Assert(err, IsNil)
+	_, tr = location.GetOptionsAndTransport()
+	c.Assert(tr.ResponseHeaderTimeout, Equals, time.Second)
+	c.Assert(tr.MaxIdleConnsPerHost, Equals, 16)
+	c.Assert(tr.IdleConnTimeout, Equals, time.Minute)
+	c.Assert(tr.DisableCompression, Equals, true)
+}
+
+// Transport does not ask the endpoint for gzip on behalf of the client
+func (s *LocSuite) TestDisableCompression(c *C) {
+	var acceptEncoding string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+	})
+	defer server.Close()
+
+	for _, disabled := range []bool{false, true} {
+		location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{DisableCompression: disabled})
+		c.Assert(err, IsNil)
+		p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(p)
+
+		// Client that does not ask for gzip
+		request, err := http.NewRequest("GET", proxy.URL, nil)
+		c.Assert(err, IsNil)
+		re, err := (&http.Transport{DisableCompression: true}).RoundTrip(request)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		proxy.Close()
+		if disabled {
+			c.Assert(acceptEncoding, Equals, "")
+		} else {
+			c.Assert(acceptEncoding, Equals, "gzip")
+		}
+	}
+}
+
+func (s *LocSuite) TestTLS(c *C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tcs := []struct {
+		name   string
+		tls    TLS
+		status int
+	}{
+		{"unknown authority", TLS{}, http.StatusBadGateway},
+		{"root CAs", TLS{RootCAs: roots}, http.StatusOK},
+		// Test certificate is issued for example.com as well
+		{"server name", TLS{RootCAs: roots, ServerName: "example.com"}, http.StatusOK},
+		{"wrong server name", TLS{RootCAs: roots, ServerName: "example.org"}, http.StatusBadGateway},
+		{"insecure", TLS{InsecureSkipVerify: true}, http.StatusOK},
+	}
+	for _, tc := range tcs {
+		location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{TLS: tc.tls})
+		c.Assert(err, IsNil)
+		p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(p)
+
+		re, _, err := MakeRequest(proxy.URL, Opts{})
+		proxy.Close()
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, tc.status, Commentf("%s", tc.name))
+	}
+}
+
+func (s *LocSuite) TestMutualTLS(c *C) {
+	cert := newClientCertificate(c)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert.Leaf)
+
+	var peerCerts int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCerts = len(r.TLS.PeerCertificates)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	for _, clientCert := range []*tls.Certificate{nil, cert} {
+		location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+			TLS: TLS{RootCAs: roots, ClientCertificate: clientCert},
+		})
+		c.Assert(err, IsNil)
+		p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(p)
+
+		re, _, err := MakeRequest(proxy.URL, Opts{})
+		proxy.Close()
+		c.Assert(err, IsNil)
+		if clientCert == nil {
+			c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+		} else {
+			c.Assert(re.StatusCode, Equals, http.StatusOK)
+			c.Assert(peerCerts, Equals, 1)
+		}
+	}
+}
+
+// HTTP/2 is negotiated with the TLS endpoints
+func (s *LocSuite) TestHTTP2(c *C) {
+	var proto string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	for _, enabled := range []bool{false, true} {
+		location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+			HTTP2: HTTP2{Enabled: enabled},
+			TLS:   TLS{RootCAs: roots},
+		})
+		c.Assert(err, IsNil)
+		p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(p)
+
+		re, _, err := MakeRequest(proxy.URL, Opts{})
+		proxy.Close()
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+		if enabled {
+			c.Assert(proto, Equals, "HTTP/2.0")
+		} else {
+			c.Assert(proto, Equals, "HTTP/1.1")
+		}
+	}
+}
+
+// HTTP/2 with prior knowledge is spoken to the plain http endpoints
+func (s *LocSuite) TestHTTP2Cleartext(c *C) {
+	var proto string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	}))
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		HTTP2: HTTP2{Cleartext: true},
+		Via:   "vulcan",
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	re, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(proto, Equals, "HTTP/2.0")
+	c.Assert(re.Header.Get(headers.Via), Equals, "2 vulcan")
+}
+
+// TE is hop-by-hop, but the endpoints should know that the trailers reach the client
+func (s *LocSuite) TestTeTrailers(c *C) {
+	var te string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		te = r.Header.Get(headers.Te)
+	})
+	defer server.Close()
+
+	_, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	_, _, err := MakeRequest(proxy.URL, Opts{Headers: http.Header{headers.Te: []string{"gzip, trailers"}}})
+	c.Assert(err, IsNil)
+	c.Assert(te, Equals, "trailers")
+
+	_, _, err = MakeRequest(proxy.URL, Opts{Headers: http.Header{headers.Te: []string{"gzip"}}})
+	c.Assert(err, IsNil)
+	c.Assert(te, Equals, "")
+}
+
+// Endpoint replies to every line of the request body while the client is still sending it
+func (s *LocSuite) TestFullDuplex(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		c.Assert(rc.EnableFullDuplex(), IsNil)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			fmt.Fprintf(w, "echo %s\n", scanner.Text())
+			rc.Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		PassThroughBody: true,
+		Streaming:       Streaming{FullDuplex: true},
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest("POST", proxy.URL, pr)
+		c.Assert(err, IsNil)
+		re, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer re.Body.Close()
+
+		reader := bufio.NewReader(re.Body)
+		for _, msg := range []string{"ping", "pong"} {
+			_, err = io.WriteString(pw, msg+"\n")
+			c.Assert(err, IsNil)
+			line, err := reader.ReadString('\n')
+			c.Assert(err, IsNil)
+			c.Assert(line, Equals, "echo "+msg+"\n")
+		}
+		pw.Close()
+		rest, err := ioutil.ReadAll(reader)
+		c.Assert(err, IsNil)
+		c.Assert(string(rest), Equals, "")
+		c.Assert(re.Trailer.Get("Grpc-Status"), Equals, "0")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Timeout waiting for the full duplex exchange")
+	}
+
+	_, err = NewLocationWithOptions("dummy", s.newRoundRobin(), Options{Streaming: Streaming{FullDuplex: true}})
+	c.Assert(err, NotNil)
+}
+
+func (s *LocSuite) TestUnixSocket(c *C) {
+	var host, forwardedHost string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, forwardedHost = r.Host, r.Header.Get(headers.XForwardedHost)
+		w.Write([]byte("hi, unix"))
+	}))
+	path := filepath.Join(c.MkDir(), "app.sock")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	_, proxy := s.newProxy(s.newRoundRobin("unix://" + path))
+	defer proxy.Close()
+
+	re, body, err := MakeRequest(proxy.URL, Opts{Host: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hi, unix")
+	c.Assert(host, Equals, "example.com")
+
+	// Host of the endpoint URL is sent as the Host header, forwarding headers still carry the original host
+	_, hostProxy := s.newProxy(s.newRoundRobin("unix://app.local" + path))
+	defer hostProxy.Close()
+	re, _, err = MakeRequest(hostProxy.URL, Opts{Host: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(host, Equals, "app.local")
+	c.Assert(forwardedHost, Equals, "example.com")
+}
+
+func (s *LocSuite) TestHostHeader(c *C) {
+	var host, forwardedHost string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		host, forwardedHost = r.Host, r.Header.Get(headers.XForwardedHost)
+	})
+	defer server.Close()
+
+	tcs := []struct {
+		options  Options
+		expected string
+	}{
+		{Options{}, "example.com"},
+		{Options{HostHeader: EndpointHost}, server.Listener.Addr().String()},
+		{Options{HostHeader: FixedHost, Host: "api.internal"}, "api.internal"},
+	}
+	for _, tc := range tcs {
+		location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), tc.options)
+		c.Assert(err, IsNil)
+		p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(p)
+
+		re, _, err := MakeRequest(proxy.URL, Opts{Host: "example.com"})
+		proxy.Close()
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+		c.Assert(host, Equals, tc.expected)
+		c.Assert(forwardedHost, Equals, "example.com")
+	}
+}
+
+func (s *LocSuite) TestHostHeaderBadParams(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{HostHeader: FixedHost})
+	c.Assert(err, NotNil)
+
+	_, err = NewLocationWithOptions("dummy", s.newRoundRobin(), Options{Host: "api.internal"})
+	c.Assert(err, NotNil)
+
+	_, err = NewLocationWithOptions("dummy", s.newRoundRobin(), Options{HostHeader: 3})
+	c.Assert(err, NotNil)
+}
+
+// Endpoint gets the address of the client in the PROXY protocol header
+func (s *LocSuite) TestProxyProtocol(c *C) {
+	var header *proxyproto.Header
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = proxyproto.GetHeader(r)
+	}))
+	l, err := proxyproto.NewListener(server.Listener)
+	c.Assert(err, IsNil)
+	server.Listener = l
+	server.Config.ConnContext = proxyproto.ConnContext
+	server.Start()
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{ProxyProtocolVersion: 2})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	_, _, err = MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(header, NotNil)
+	c.Assert(header.Version, Equals, 2)
+	c.Assert(header.Source.IP.String(), Equals, "127.0.0.1")
+	c.Assert(header.Destination.String(), Equals, proxy.Listener.Addr().String())
+
+	_, err = NewLocationWithOptions("dummy", s.newRoundRobin(), Options{ProxyProtocolVersion: 3})
+	c.Assert(err, NotNil)
+}
+
+func (s *LocSuite) TestForwardingBadParams(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{ForwardingHeaders: 8})
+	c.Assert(err, NotNil)
+
+	_, err = NewLocationWithOptions("dummy", s.newRoundRobin(), Options{Via: "vulcan, other"})
+	c.Assert(err, NotNil)
+}
+
+// Headers listed in Connection are hop-by-hop, so they are not passed to the endpoint
+func (s *LocSuite) TestRemovesHopHeaders(c *C) {
+	var upstreamHeader http.Header
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+	})
+	defer server.Close()
+
+	_, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	_, _, err := MakeRequest(proxy.URL, Opts{Headers: http.Header{
+		"Connection":       []string{"X-Client-Secret"},
+		"X-Client-Secret":  []string{"s"},
+		"Proxy-Connection": []string{"keep-alive"},
+		"X-Other":          []string{"o"},
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(upstreamHeader.Get("X-Client-Secret"), Equals, "")
+	c.Assert(upstreamHeader.Get("Proxy-Connection"), Equals, "")
+	c.Assert(upstreamHeader.Get("X-Other"), Equals, "o")
+}
+
 // Test that X-Forwarded-For and X-Forwarded-Proto are passed through
 func (s *LocSuite) TestForwardedProtoHTTPS(c *C) {
 	called := false
@@ -666,3 +1194,643 @@ func (s *LocSuite) TestMiddlewareRedirectsOnlyOnce(c *C) {
 	c.Assert(response.StatusCode, Equals, http.StatusFound)
 	c.Assert(response.Header.Get("Location"), Equals, "http://localhost1/loc1")
 }
+
+// Make sure the streamed response reaches the client before the endpoint finishes writing it
+func (s *LocSuite) TestStreaming(c *C) {
+	done := make(chan bool)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("event: 1\n"))
+		w.(http.Flusher).Flush()
+		<-done
+		w.Write([]byte("event: 2\n"))
+	})
+	defer server.Close()
+	defer close(done)
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		Streaming: Streaming{Enabled: true},
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	response, err := http.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+
+	line, err := bufio.NewReader(response.Body).ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "event: 1\n")
+}
+
+func (s *LocSuite) TestStreamingNegativeInterval(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{
+		Streaming: Streaming{Enabled: true, FlushInterval: -1},
+	})
+	c.Assert(err, NotNil)
+}
+
+// Round trip to the endpoint is canceled when the client disconnects
+func (s *LocSuite) TestClientDisconnectCancelsRoundTrip(c *C) {
+	canceled := make(chan bool, 1)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+		}
+	})
+	defer server.Close()
+
+	_, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", proxy.URL, nil)
+	c.Assert(err, IsNil)
+	_, err = http.DefaultClient.Do(req.WithContext(ctx))
+	c.Assert(err, NotNil)
+
+	c.Assert(<-canceled, Equals, true)
+}
+
+// Middleware can set a deadline for the round trip to the endpoint
+func (s *LocSuite) TestMiddlewareSetsDeadline(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	var cancel context.CancelFunc
+	location.GetMiddlewareChain().Add("deadline", 0, &MiddlewareWrapper{
+		OnRequest: func(r Request) (*http.Response, error) {
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(r.GetContext(), 10*time.Millisecond)
+			r.SetContext(ctx)
+			return nil, nil
+		},
+		OnResponse: func(r Request, a Attempt) {
+			cancel()
+		},
+	})
+
+	response, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Not(Equals), http.StatusOK)
+}
+
+func (s *LocSuite) TestFailoverOnResponseCode(c *C) {
+	unavailable := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer unavailable.Close()
+
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	predicate, err := threshold.DefaultFailoverPolicy.Predicate()
+	c.Assert(err, IsNil)
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(unavailable.URL, server.URL), Options{
+		FailoverPredicate: predicate,
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	response, bodyBytes, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
+
+	// POST is not idempotent, so it's not retried
+	response, _, err = MakeRequest(proxy.URL, Opts{Method: "POST"})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *LocSuite) TestAttemptTimeout(c *C) {
+	done := make(chan bool)
+	slow := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	})
+	defer slow.Close()
+	defer close(done)
+
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(slow.URL, server.URL), Options{
+		Timeouts: Timeouts{Attempt: 50 * time.Millisecond},
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	response, bodyBytes, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
+}
+
+func (s *LocSuite) TestAttemptTimeoutNegative(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{
+		Timeouts: Timeouts{Attempt: -1},
+	})
+	c.Assert(err, NotNil)
+}
+
+func (s *LocSuite) TestTotalTimeout(c *C) {
+	done := make(chan bool)
+	slow := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	})
+	defer slow.Close()
+	defer close(done)
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(slow.URL, slow.URL), Options{
+		Timeouts:          Timeouts{Total: 50 * time.Millisecond},
+		FailoverPredicate: threshold.IsNetworkError(),
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	response, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusGatewayTimeout)
+}
+
+func (s *LocSuite) TestTotalTimeoutAcrossAttempts(c *C) {
+	done := make(chan bool)
+	slow := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	})
+	defer slow.Close()
+	defer close(done)
+
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	// First attempt times out, but there's still time left for the second one
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(slow.URL, server.URL), Options{
+		Timeouts: Timeouts{Attempt: 50 * time.Millisecond, Total: time.Second},
+	})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	response, bodyBytes, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
+}
+
+// Middleware sets the deadline of the request that overrides the total timeout of the location
+func (s *LocSuite) TestRequestDeadline(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		delay, _ := time.ParseDuration(r.Header.Get("X-Delay"))
+		select {
+		case <-r.Context().Done():
+		case <-time.After(delay):
+		}
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		Timeouts:     Timeouts{Total: 100 * time.Millisecond},
+		TimeProvider: s.tm,
+	})
+	c.Assert(err, IsNil)
+	location.GetMiddlewareChain().Add("timeout", 0, &MiddlewareWrapper{
+		OnRequest: func(r Request) (*http.Response, error) {
+			if timeout, err := time.ParseDuration(r.GetHttpRequest().Header.Get("X-Timeout")); err == nil {
+				r.SetDeadline(s.tm.UtcNow().Add(timeout))
+			}
+			return nil, nil
+		},
+	})
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	// Shorter than the total timeout
+	re, _, err := MakeRequest(proxy.URL, Opts{Headers: http.Header{"X-Timeout": []string{"20ms"}, "X-Delay": []string{"1s"}}})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+
+	// Longer than the total timeout
+	re, body, err := MakeRequest(proxy.URL, Opts{Headers: http.Header{"X-Timeout": []string{"2s"}, "X-Delay": []string{"200ms"}}})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "Hi, I'm endpoint")
+
+	// Location timeout applies to the requests without the deadline
+	re, _, err = MakeRequest(proxy.URL, Opts{Headers: http.Header{"X-Delay": []string{"1s"}}})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+}
+
+func (s *LocSuite) TestDeadlineHeader(c *C) {
+	var budget string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		budget = r.Header.Get("X-Request-Deadline-Ms")
+	})
+	defer server.Close()
+
+	tcs := []struct {
+		timeouts Timeouts
+		expected string
+	}{
+		{Timeouts{}, ""},
+		{Timeouts{Total: 2 * time.Second}, "2000"},
+		{Timeouts{Total: 2 * time.Second, Attempt: 500 * time.Millisecond}, "500"},
+		{Timeouts{Attempt: 500 * time.Millisecond}, "500"},
+	}
+	for _, tc := range tcs {
+		location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+			Timeouts:       tc.timeouts,
+			DeadlineHeader: "X-Request-Deadline-Ms",
+			TimeProvider:   s.tm,
+		})
+		c.Assert(err, IsNil)
+		p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(p)
+
+		// Header forged by the client is not passed
+		_, _, err = MakeRequest(proxy.URL, Opts{Headers: http.Header{"X-Request-Deadline-Ms": []string{"100000"}}})
+		proxy.Close()
+		c.Assert(err, IsNil)
+		c.Assert(budget, Equals, tc.expected)
+	}
+
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{DeadlineHeader: "X-Deadline: 1"})
+	c.Assert(err, NotNil)
+}
+
+// Time spent on the failed attempts is taken out of the budget
+func (s *LocSuite) TestDeadlineHeaderAfterRetry(c *C) {
+	var budget string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		budget = r.Header.Get("X-Request-Deadline-Ms")
+	})
+	defer server.Close()
+
+	tm := &timetools.FreezedTime{CurrentTime: s.tm.UtcNow()}
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin("http://localhost:63999", server.URL), Options{
+		Timeouts:       Timeouts{Total: 2 * time.Second},
+		DeadlineHeader: "X-Request-Deadline-Ms",
+		TimeProvider:   tm,
+	})
+	c.Assert(err, IsNil)
+	location.GetMiddlewareChain().Add("clock", 0, &MiddlewareWrapper{
+		OnResponse: func(r Request, a Attempt) {
+			tm.CurrentTime = tm.CurrentTime.Add(300 * time.Millisecond)
+		},
+	})
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	re, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(budget, Equals, "1700")
+}
+
+func (s *LocSuite) TestTotalTimeoutNegative(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{
+		Timeouts: Timeouts{Total: -1},
+	})
+	c.Assert(err, NotNil)
+}
+
+// Middleware rewrites the upstream response before it's written to the client
+func (s *LocSuite) TestMiddlewareModifiesResponse(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	location.GetMiddlewareChain().Add("rewrite", 0, &MiddlewareWrapper{
+		OnModifyResponse: func(r Request, re *http.Response) error {
+			body, err := ioutil.ReadAll(re.Body)
+			if err != nil {
+				return err
+			}
+			re.StatusCode = http.StatusCreated
+			re.Header.Set("X-Rewritten", "yes")
+			netutils.SetResponseBody(re, []byte(strings.ToUpper(string(body))))
+			return nil
+		},
+	})
+
+	response, bodyBytes, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusCreated)
+	c.Assert(response.Header.Get("X-Rewritten"), Equals, "yes")
+	c.Assert(string(bodyBytes), Equals, "HI, I'M ENDPOINT")
+}
+
+// Error returned by the response modifier is replied to the client
+func (s *LocSuite) TestMiddlewareModifyResponseError(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	location.GetMiddlewareChain().Add("rewrite", 0, &MiddlewareWrapper{
+		OnModifyResponse: func(r Request, re *http.Response) error {
+			return errors.FromStatus(http.StatusForbidden)
+		},
+	})
+
+	response, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *LocSuite) TestAttemptTimings(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	var timings []*Timings
+	location.GetObserverChain().Add("ob", &ObserverWrapper{
+		OnResponse: func(r Request, a Attempt) {
+			timings = append(timings, a.GetTimings())
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		response, _, err := MakeRequest(proxy.URL, Opts{})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+	}
+
+	c.Assert(len(timings), Equals, 2)
+	first, second := timings[0], timings[1]
+	c.Assert(first.ConnReused, Equals, false)
+	c.Assert(first.Connect > 0, Equals, true)
+	c.Assert(first.GotConn >= first.Connect, Equals, true)
+	c.Assert(first.WroteRequest >= first.GotConn, Equals, true)
+	c.Assert(first.FirstByte >= 10*time.Millisecond, Equals, true)
+
+	// Second attempt reuses the connection to the endpoint
+	c.Assert(second.ConnReused, Equals, true)
+	c.Assert(second.Connect, Equals, time.Duration(0))
+	c.Assert(second.FirstByte >= 10*time.Millisecond, Equals, true)
+}
+
+func (s *LocSuite) TestDecompress(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("Hi, I'm endpoint"))
+		gz.Close()
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{Decompress: true})
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	// Client has not asked for gzip, so the response is decoded
+	response, bodyBytes, err := MakeRequest(proxyServer.URL, Opts{Headers: http.Header{"Accept-Encoding": []string{"identity"}}})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(response.Header.Get("Content-Encoding"), Equals, "")
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
+
+	// Client accepts gzip, the response is passed as is
+	response, bodyBytes, err = MakeRequest(proxyServer.URL, Opts{Headers: http.Header{"Accept-Encoding": []string{"gzip"}}})
+	c.Assert(err, IsNil)
+	c.Assert(response.Header.Get("Content-Encoding"), Equals, "gzip")
+	gz, err := gzip.NewReader(bytes.NewReader(bodyBytes))
+	c.Assert(err, IsNil)
+	decoded, err := ioutil.ReadAll(gz)
+	c.Assert(err, IsNil)
+	c.Assert(string(decoded), Equals, "Hi, I'm endpoint")
+}
+
+func (s *LocSuite) TestStripPrefix(c *C) {
+	var uri string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		uri = r.RequestURI
+		if r.URL.Path == "/login" {
+			http.Redirect(w, r, "/users/1?welcome=1", http.StatusFound)
+			return
+		}
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{StripPrefix: "/api/v1/"})
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	tcs := []struct {
+		in       string
+		expected string
+	}{
+		{"/api/v1/users?limit=1", "/users?limit=1"},
+		{"/api/v1", "/"},
+		{"/api/v1?a=b", "/?a=b"},
+		{"/api/v10/users", "/api/v10/users"},
+		{"/other", "/other"},
+	}
+	for _, tc := range tcs {
+		response, _, err := MakeRequest(proxyServer.URL+tc.in, Opts{})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(uri, Equals, tc.expected, Commentf("%s", tc.in))
+	}
+
+	// Redirects of the endpoint point back to the prefixed URIs
+	req, err := http.NewRequest("GET", proxyServer.URL+"/api/v1/login", nil)
+	c.Assert(err, IsNil)
+	response, err := http.DefaultTransport.RoundTrip(req)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusFound)
+	c.Assert(response.Header.Get("Location"), Equals, "/api/v1/users/1?welcome=1")
+}
+
+func (s *LocSuite) TestRestorePrefix(c *C) {
+	req := &http.Request{Host: "example.com"}
+	tcs := []struct {
+		location string
+		expected string
+	}{
+		{"/users", "/api/users"},
+		{"http://example.com/users", "http://example.com/api/users"},
+		{"http://other.com/users", "http://other.com/users"},
+		{"users", "users"},
+	}
+	for _, tc := range tcs {
+		re := &http.Response{Header: http.Header{"Location": []string{tc.location}}}
+		restorePrefix(req, re, "/api")
+		c.Assert(re.Header.Get("Location"), Equals, tc.expected, Commentf("%s", tc.location))
+	}
+}
+
+func (s *LocSuite) TestStripPrefixBadParams(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{StripPrefix: "api"})
+	c.Assert(err, NotNil)
+}
+
+func (s *LocSuite) TestPassThroughBody(c *C) {
+	var requestBody string
+	var contentLength int64
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		requestBody = string(body)
+		contentLength = r.ContentLength
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	// First endpoint is down, the body has not been sent yet, so the request fails over
+	p, err := threshold.ParseExpression(`IsNetworkError() && Attempts() < 2`)
+	c.Assert(err, IsNil)
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin("http://localhost:63999", server.URL), Options{
+		PassThroughBody:   true,
+		FailoverPredicate: p,
+	})
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	body := strings.Repeat("a", 4096)
+	response, _, err := MakeRequest(proxyServer.URL, Opts{Method: "PUT", Body: body})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(requestBody, Equals, body)
+	c.Assert(contentLength, Equals, int64(len(body)))
+
+	// Body of unknown length is streamed as is
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hello, "))
+		pw.Write([]byte("chunked"))
+		pw.Close()
+	}()
+	request, err := http.NewRequest("PUT", proxyServer.URL, pr)
+	c.Assert(err, IsNil)
+	response, err = http.DefaultClient.Do(request)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(requestBody, Equals, "hello, chunked")
+	c.Assert(contentLength, Equals, int64(-1))
+}
+
+func (s *LocSuite) TestPassThroughBodyIsNotReplayed(c *C) {
+	calls := 0
+	failing := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	defer failing.Close()
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	p, err := threshold.ParseExpression(`IsNetworkError() && Attempts() < 2`)
+	c.Assert(err, IsNil)
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(failing.URL, server.URL), Options{
+		PassThroughBody:   true,
+		FailoverPredicate: p,
+	})
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, _, err := MakeRequest(proxyServer.URL, Opts{Method: "POST", Body: "hello"})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(calls, Equals, 0)
+}
+
+// newClientCertificate returns self signed certificate for client authentication
+func newClientCertificate(c *C) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vulcan"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
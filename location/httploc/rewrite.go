@@ -1,6 +1,8 @@
 package httploc
 
 import (
+	"bytes"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
@@ -10,17 +12,98 @@ import (
 	"github.com/mailgun/vulcan/request"
 )
 
+// ForwardingHeaders is a set of headers that tell the endpoints about the original request
+type ForwardingHeaders int
+
+const (
+	// Legacy X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Server headers
+	XForwardedHeaders ForwardingHeaders = 1 << iota
+	// Standard Forwarded header, https://tools.ietf.org/html/rfc7239
+	ForwardedHeader
+)
+
 // Rewriter is responsible for removing hop-by-hop headers, fixing encodings and content-length
 type Rewriter struct {
+	// Trusts the forward headers of all clients, otherwise only the ones of the requests
+	// from the trusted proxies are, see Request.IsFromTrustedProxy
 	TrustForwardHeader bool
 	Hostname           string
+	// Forwarding headers to set, XForwardedHeaders if not set
+	ForwardingHeaders ForwardingHeaders
+	// Pseudonym of the proxy added to Via headers, Via is not modified if empty
+	Via string
+}
+
+func newRewriter(o Options) *Rewriter {
+	return &Rewriter{
+		TrustForwardHeader: o.TrustForwardHeader,
+		Hostname:           o.Hostname,
+		ForwardingHeaders:  o.ForwardingHeaders,
+		Via:                o.Via,
+	}
 }
 
 func (rw *Rewriter) ProcessRequest(r request.Request) (*http.Response, error) {
 	req := r.GetHttpRequest()
+	trusted := rw.TrustForwardHeader || r.IsFromTrustedProxy()
+
+	fh := rw.ForwardingHeaders
+	if fh == 0 {
+		fh = XForwardedHeaders
+	}
+	if fh&XForwardedHeaders != 0 {
+		setXForwarded(req, trusted, rw.Hostname)
+	} else if !trusted {
+		// Endpoints may still read the legacy headers, so don't pass the ones forged by the client
+		netutils.RemoveHeaders(xForwardedHeaders, req.Header)
+	}
+	if fh&ForwardedHeader != 0 {
+		setForwarded(req, trusted, rw.Hostname)
+	}
+	if rw.Via != "" {
+		req.Header.Set(headers.Via, appendVia(req.Header, req.ProtoMajor, req.ProtoMinor, rw.Via))
+	}
+
+	// Remove hop-by-hop headers to the backend.  Especially important is "Connection" because we want a persistent
+	// connection, regardless of what the client sent to us.
+	trailers := acceptsTrailers(req.Header)
+	netutils.RemoveHopHeaders(req.Header)
+	// The proxy passes the trailers through, gRPC endpoints reject the requests without TE: trailers
+	if trailers {
+		req.Header.Set(headers.Te, "trailers")
+	}
+
+	// We need to set ContentLength based on known request size. The incoming request may have been
+	// set without content length or using chunked TransferEncoding
+	totalSize, err := r.GetBody().TotalSize()
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = totalSize
+	// Remove TransferEncoding that could have been previously set
+	req.TransferEncoding = []string{}
 
+	return nil, nil
+}
+
+func (tl *Rewriter) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// ModifyResponse adds the proxy to the Via header of the response
+func (rw *Rewriter) ModifyResponse(r request.Request, re *http.Response) error {
+	if rw.Via == "" {
+		return nil
+	}
+	if re.Header == nil {
+		re.Header = make(http.Header)
+	}
+	re.Header.Set(headers.Via, appendVia(re.Header, re.ProtoMajor, re.ProtoMinor, rw.Via))
+	return nil
+}
+
+func setXForwarded(req *http.Request, trusted bool, hostname string) {
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if rw.TrustForwardHeader {
+		if trusted {
 			if prior, ok := req.Header[headers.XForwardedFor]; ok {
 				clientIP = strings.Join(prior, ", ") + ", " + clientIP
 			}
@@ -28,7 +111,7 @@ func (rw *Rewriter) ProcessRequest(r request.Request) (*http.Response, error) {
 		req.Header.Set(headers.XForwardedFor, clientIP)
 	}
 
-	if xfp := req.Header.Get(headers.XForwardedProto); xfp != "" && rw.TrustForwardHeader {
+	if xfp := req.Header.Get(headers.XForwardedProto); xfp != "" && trusted {
 		req.Header.Set(headers.XForwardedProto, xfp)
 	} else if req.TLS != nil {
 		req.Header.Set(headers.XForwardedProto, "https")
@@ -39,24 +122,102 @@ func (rw *Rewriter) ProcessRequest(r request.Request) (*http.Response, error) {
 	if req.Host != "" {
 		req.Header.Set(headers.XForwardedHost, req.Host)
 	}
-	req.Header.Set(headers.XForwardedServer, rw.Hostname)
+	req.Header.Set(headers.XForwardedServer, hostname)
+}
 
-	// Remove hop-by-hop headers to the backend.  Especially important is "Connection" because we want a persistent
-	// connection, regardless of what the client sent to us.
-	netutils.RemoveHeaders(headers.HopHeaders, req.Header)
+// setForwarded adds the element describing this hop to the Forwarded header, e.g.
+// Forwarded: for=192.0.2.60;proto=http;host=example.com;by=proxy1
+func setForwarded(req *http.Request, trusted bool, hostname string) {
+	var params []string
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		params = append(params, "for="+forwardedNode(clientIP))
+	}
+	if req.TLS != nil {
+		params = append(params, "proto=https")
+	} else {
+		params = append(params, "proto=http")
+	}
+	if req.Host != "" {
+		params = append(params, "host="+forwardedValue(req.Host))
+	}
+	if hostname != "" {
+		params = append(params, "by="+forwardedValue(hostname))
+	}
+	value := strings.Join(params, ";")
+	if prior, ok := req.Header[headers.Forwarded]; ok && trusted {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	req.Header.Set(headers.Forwarded, value)
+}
 
-	// We need to set ContentLength based on known request size. The incoming request may have been
-	// set without content length or using chunked TransferEncoding
-	totalSize, err := r.GetBody().TotalSize()
-	if err != nil {
-		return nil, err
+// forwardedNode formats the address for the Forwarded header, IPv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
 	}
-	req.ContentLength = totalSize
-	// Remove TransferEncoding that could have been previously set
-	req.TransferEncoding = []string{}
+	return ip
+}
 
-	return nil, nil
+// forwardedValue returns the value as is if it's a token, quoted string otherwise
+func forwardedValue(v string) string {
+	if isToken(v) {
+		return v
+	}
+	b := &bytes.Buffer{}
+	b.WriteByte('"')
+	for _, c := range v {
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
 }
 
-func (tl *Rewriter) ProcessResponse(r request.Request, a request.Attempt) {
+func isToken(v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendVia returns the Via header with the proxy added to the end of the list, e.g. "1.0 fred, 1.1 vulcan"
+func appendVia(h http.Header, major, minor int, pseudonym string) string {
+	if major == 0 {
+		major, minor = 1, 1
+	}
+	hop := fmt.Sprintf("%d.%d %s", major, minor, pseudonym)
+	if major >= 2 {
+		// HTTP/2 has no minor version
+		hop = fmt.Sprintf("%d %s", major, pseudonym)
+	}
+	if prior, ok := h[headers.Via]; ok {
+		return strings.Join(prior, ", ") + ", " + hop
+	}
+	return hop
+}
+
+// acceptsTrailers tells whether the client has sent TE: trailers
+func acceptsTrailers(h http.Header) bool {
+	for _, v := range h[headers.Te] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var xForwardedHeaders = []string{
+	headers.XForwardedFor,
+	headers.XForwardedProto,
+	headers.XForwardedHost,
+	headers.XForwardedServer,
 }
@@ -0,0 +1,47 @@
+package httploc
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stripPrefix removes the prefix from the request URI, the URIs that are not under the prefix are returned as is
+func stripPrefix(uri, prefix string) string {
+	if prefix == "" || !strings.HasPrefix(uri, prefix) {
+		return uri
+	}
+	rest := uri[len(prefix):]
+	switch {
+	case rest == "":
+		return "/"
+	case rest[0] == '/':
+		return rest
+	case rest[0] == '?':
+		return "/" + rest
+	}
+	// e.g. /api/v10 is not under /api/v1
+	return uri
+}
+
+// restorePrefix adds the stripped prefix back to the Location header of the endpoint,
+// so the redirects point to the URIs the client can reach through the proxy
+func restorePrefix(req *http.Request, re *http.Response, prefix string) {
+	location := re.Header.Get("Location")
+	if prefix == "" || location == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Opaque != "" || !strings.HasPrefix(u.Path, "/") {
+		return
+	}
+	// Absolute redirects to other hosts are left intact
+	if u.Host != "" && u.Host != req.Host {
+		return
+	}
+	u.Path = prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = prefix + u.RawPath
+	}
+	re.Header.Set("Location", u.String())
+}
@@ -0,0 +1,91 @@
+package httploc
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/request"
+)
+
+// timingsRecorder captures the phases of the round trip reported by the transport.
+// Transport may call the hooks from its own goroutines, so the recorder is guarded by mutex.
+type timingsRecorder struct {
+	mutex        *sync.Mutex
+	timeProvider timetools.TimeProvider
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	timings      request.Timings
+}
+
+func newTimingsRecorder(timeProvider timetools.TimeProvider, start time.Time) *timingsRecorder {
+	return &timingsRecorder{
+		mutex:        &sync.Mutex{},
+		timeProvider: timeProvider,
+		start:        start,
+	}
+}
+
+func (r *timingsRecorder) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.mark(&r.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.since(&r.timings.DNSLookup, &r.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			r.mark(&r.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			r.since(&r.timings.Connect, &r.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			r.mark(&r.tlsStart)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.since(&r.timings.TlsHandshake, &r.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.mutex.Lock()
+			r.timings.ConnReused = info.Reused
+			r.mutex.Unlock()
+			r.since(&r.timings.GotConn, &r.start)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			r.since(&r.timings.WroteRequest, &r.start)
+		},
+		GotFirstResponseByte: func() {
+			r.since(&r.timings.FirstByte, &r.start)
+		},
+	}
+}
+
+// getTimings returns the copy of the timings captured so far
+func (r *timingsRecorder) getTimings() *request.Timings {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t := r.timings
+	return &t
+}
+
+func (r *timingsRecorder) mark(t *time.Time) {
+	now := r.timeProvider.UtcNow()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	*t = now
+}
+
+// since sets the duration of the phase that has started at the given time, zero start means that the start was not reported
+func (r *timingsRecorder) since(d *time.Duration, start *time.Time) {
+	now := r.timeProvider.UtcNow()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !start.IsZero() {
+		*d = now.Sub(*start)
+	}
+}
@@ -0,0 +1,58 @@
+package httploc
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Endpoints with unix:// URLs are reached over the unix domain sockets, e.g. the sidecar deployments
+// where the app listens on unix:///var/run/app.sock. The host of the URL, if any, is sent as the Host header:
+// unix://app.local/var/run/app.sock
+const unixScheme = "unix"
+
+// Transport pools the connections by host, so the socket path is encoded in the host that never resolves
+const unixHostSuffix = ".unix.invalid"
+
+func unixSocketHost(path string) string {
+	return hex.EncodeToString([]byte(path)) + unixHostSuffix
+}
+
+// unixSocketPath returns the socket path encoded in the dialed address by unixSocketHost
+func unixSocketPath(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || !strings.HasSuffix(host, unixHostSuffix) {
+		return "", false
+	}
+	path, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+	if err != nil {
+		return "", false
+	}
+	return string(path), true
+}
+
+// unixHostHeader returns the Host header for the endpoint listening on the unix socket: the host of the endpoint URL
+// if set, the host requested by the client otherwise
+func unixHostHeader(u *url.URL, host string) string {
+	if u.Host != "" {
+		return u.Host
+	}
+	if host != "" {
+		return host
+	}
+	return "localhost"
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialUnixSockets connects to the unix sockets of the endpoints, other addresses are dialed as is
+func dialUnixSockets(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if path, ok := unixSocketPath(addr); ok {
+			return dial(ctx, "unix", path)
+		}
+		return dial(ctx, network, addr)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/mailgun/vulcan/netutils"
 	. "github.com/mailgun/vulcan/request"
 	"net/http"
+	"time"
 )
 
 // Location accepts proxy request and round trips it to the backend
@@ -15,6 +16,21 @@ type Location interface {
 	RoundTrip(Request) (*http.Response, error)
 }
 
+// Streamer is an optional interface implemented by locations that want the proxy to flush
+// the response to the client as it arrives from the backend, e.g. for server sent events.
+type Streamer interface {
+	// Returns the flush interval and true if the response should be streamed,
+	// 0 interval means that the response is flushed after every write.
+	GetFlushInterval() (time.Duration, bool)
+}
+
+// DuplexStreamer is an optional interface implemented by locations that stream the response
+// while the client is still sending the request body, e.g. gRPC bidirectional streams.
+type DuplexStreamer interface {
+	// Returns true if the proxy should let the location read the request body after the response has started
+	IsFullDuplex() bool
+}
+
 // This location is used in tests
 type Loc struct {
 	Id   string
@@ -0,0 +1,198 @@
+// Admission queue that limits the concurrency of the location
+package queueloc
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	. "github.com/mailgun/vulcan/location"
+	. "github.com/mailgun/vulcan/request"
+)
+
+// QueueLocation lets at most MaxConcurrent requests to the inner location at a time.
+// Once the concurrency is saturated requests wait in a bounded FIFO queue, requests that
+// overflow the queue or wait longer than MaxQueueTime are rejected with 503 Service Unavailable.
+type QueueLocation struct {
+	location      Location
+	mutex         *sync.Mutex
+	maxConcurrent int
+	inFlight      int
+	queue         *list.List
+	options       Options
+}
+
+type Options struct {
+	// Maximum amount of requests waiting in the queue
+	MaxQueued int
+	// Maximum time request waits in the queue
+	MaxQueueTime time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultMaxQueued    = 1024
+	DefaultMaxQueueTime = 10 * time.Second
+)
+
+// waiter is the queued request, it's ready once the slot has been handed over to it
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func NewQueueLocation(location Location, maxConcurrent int) (*QueueLocation, error) {
+	return NewQueueLocationWithOptions(location, maxConcurrent, Options{})
+}
+
+func NewQueueLocationWithOptions(location Location, maxConcurrent int, o Options) (*QueueLocation, error) {
+	if location == nil {
+		return nil, fmt.Errorf("Provide location")
+	}
+	if maxConcurrent <= 0 {
+		return nil, fmt.Errorf("Max concurrent requests should be > 0")
+	}
+	options, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &QueueLocation{
+		location:      location,
+		mutex:         &sync.Mutex{},
+		maxConcurrent: maxConcurrent,
+		queue:         list.New(),
+		options:       options,
+	}, nil
+}
+
+func (q *QueueLocation) GetId() string {
+	return q.location.GetId()
+}
+
+// GetFlushInterval passes the streaming settings of the inner location to the proxy
+func (q *QueueLocation) GetFlushInterval() (time.Duration, bool) {
+	if s, ok := q.location.(Streamer); ok {
+		return s.GetFlushInterval()
+	}
+	return 0, false
+}
+
+func (q *QueueLocation) GetLocation() Location {
+	return q.location
+}
+
+// GetInFlight returns the amount of requests let to the inner location
+func (q *QueueLocation) GetInFlight() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.inFlight
+}
+
+// GetQueued returns the amount of requests waiting in the queue
+func (q *QueueLocation) GetQueued() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.queue.Len()
+}
+
+func (q *QueueLocation) RoundTrip(req Request) (*http.Response, error) {
+	if err := q.acquire(req); err != nil {
+		return nil, err
+	}
+	response, err := q.location.RoundTrip(req)
+	// Slot is held until the proxy is done reading the response
+	if response != nil && response.Body != nil {
+		response.Body = &releaseBody{ReadCloser: response.Body, release: q.release}
+		return response, err
+	}
+	q.release()
+	return response, err
+}
+
+func (q *QueueLocation) acquire(req Request) error {
+	q.mutex.Lock()
+	if q.inFlight < q.maxConcurrent {
+		q.inFlight++
+		q.mutex.Unlock()
+		return nil
+	}
+	if q.queue.Len() >= q.options.MaxQueued {
+		q.mutex.Unlock()
+		log.Warningf("%s rejected, queue of %s is full", req, q.GetId())
+		return errors.FromStatus(http.StatusServiceUnavailable)
+	}
+	w := &waiter{ready: make(chan struct{})}
+	e := q.queue.PushBack(w)
+	q.mutex.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-q.options.TimeProvider.After(q.options.MaxQueueTime):
+		log.Warningf("%s rejected after waiting in the queue of %s for %s", req, q.GetId(), q.options.MaxQueueTime)
+	case <-req.GetContext().Done():
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	// The slot could have been handed over while we were giving up, pass it on
+	if w.granted {
+		q.releaseLocked()
+	} else {
+		q.queue.Remove(e)
+	}
+	return errors.FromStatus(http.StatusServiceUnavailable)
+}
+
+func (q *QueueLocation) release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.releaseLocked()
+}
+
+// releaseLocked hands the slot over to the first request in the queue, if any
+func (q *QueueLocation) releaseLocked() {
+	if e := q.queue.Front(); e != nil {
+		w := q.queue.Remove(e).(*waiter)
+		w.granted = true
+		close(w.ready)
+		return
+	}
+	q.inFlight--
+}
+
+// releaseBody releases the slot once the response is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MaxQueued < 0 || o.MaxQueueTime < 0 {
+		return o, fmt.Errorf("Queue settings can not be negative")
+	}
+	if o.MaxQueued == 0 {
+		o.MaxQueued = DefaultMaxQueued
+	}
+	if o.MaxQueueTime == 0 {
+		o.MaxQueueTime = DefaultMaxQueueTime
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
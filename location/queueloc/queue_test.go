@@ -0,0 +1,191 @@
+package queueloc
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/errors"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestQueue(t *testing.T) { TestingT(t) }
+
+type QueueSuite struct {
+}
+
+var _ = Suite(&QueueSuite{})
+
+func (s *QueueSuite) TestBadParams(c *C) {
+	_, err := NewQueueLocation(nil, 1)
+	c.Assert(err, NotNil)
+
+	_, err = NewQueueLocation(newBlockingLoc(), 0)
+	c.Assert(err, NotNil)
+
+	_, err = NewQueueLocationWithOptions(newBlockingLoc(), 1, Options{MaxQueued: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *QueueSuite) TestPassThrough(c *C) {
+	loc := newBlockingLoc()
+	close(loc.unblock)
+	q, err := NewQueueLocation(loc, 1)
+	c.Assert(err, IsNil)
+	c.Assert(q.GetId(), Equals, "blocking")
+
+	re, err := q.RoundTrip(makeReq())
+	c.Assert(err, IsNil)
+	c.Assert(q.GetInFlight(), Equals, 1)
+
+	// Slot is released once the response is read
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+	re.Body.Close()
+	c.Assert(q.GetInFlight(), Equals, 0)
+}
+
+// Queued requests are let through in FIFO order
+func (s *QueueSuite) TestQueueOrder(c *C) {
+	loc := newBlockingLoc()
+	q, err := NewQueueLocation(loc, 1)
+	c.Assert(err, IsNil)
+
+	results := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			re, err := q.RoundTrip(makeReq())
+			if err == nil {
+				re.Body.Close()
+			}
+			results <- i
+		}(i)
+		// Wait until the request has taken the slot or the place in the queue
+		for q.GetInFlight()+q.GetQueued() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	c.Assert(q.GetInFlight(), Equals, 1)
+	c.Assert(q.GetQueued(), Equals, 2)
+
+	for i := 0; i < 3; i++ {
+		loc.unblock <- true
+		c.Assert(<-results, Equals, i)
+	}
+	c.Assert(q.GetInFlight(), Equals, 0)
+	c.Assert(q.GetQueued(), Equals, 0)
+}
+
+func (s *QueueSuite) TestQueueOverflow(c *C) {
+	loc := newBlockingLoc()
+	q, err := NewQueueLocationWithOptions(loc, 1, Options{MaxQueued: 1})
+	c.Assert(err, IsNil)
+
+	done := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			re, err := q.RoundTrip(makeReq())
+			if err == nil {
+				re.Body.Close()
+			}
+			done <- true
+		}()
+	}
+	for q.GetInFlight() != 1 || q.GetQueued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = q.RoundTrip(makeReq())
+	c.Assert(err, NotNil)
+	c.Assert(err.(*errors.HttpError).StatusCode, Equals, http.StatusServiceUnavailable)
+
+	close(loc.unblock)
+	<-done
+	<-done
+}
+
+func (s *QueueSuite) TestQueueTimeout(c *C) {
+	loc := newBlockingLoc()
+	q, err := NewQueueLocationWithOptions(loc, 1, Options{MaxQueueTime: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	done := make(chan bool)
+	go func() {
+		re, err := q.RoundTrip(makeReq())
+		if err == nil {
+			re.Body.Close()
+		}
+		done <- true
+	}()
+	for q.GetInFlight() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = q.RoundTrip(makeReq())
+	c.Assert(err, NotNil)
+	c.Assert(err.(*errors.HttpError).StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(q.GetQueued(), Equals, 0)
+
+	close(loc.unblock)
+	<-done
+	c.Assert(q.GetInFlight(), Equals, 0)
+}
+
+func (s *QueueSuite) TestClientGone(c *C) {
+	loc := newBlockingLoc()
+	q, err := NewQueueLocation(loc, 1)
+	c.Assert(err, IsNil)
+
+	done := make(chan bool)
+	go func() {
+		re, err := q.RoundTrip(makeReq())
+		if err == nil {
+			re.Body.Close()
+		}
+		done <- true
+	}()
+	for q.GetInFlight() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := makeReq()
+	req.SetContext(ctx)
+	_, err = q.RoundTrip(req)
+	c.Assert(err, NotNil)
+	c.Assert(q.GetQueued(), Equals, 0)
+
+	close(loc.unblock)
+	<-done
+}
+
+// blockingLoc replies once unblocked
+type blockingLoc struct {
+	unblock chan bool
+}
+
+func newBlockingLoc() *blockingLoc {
+	return &blockingLoc{unblock: make(chan bool)}
+}
+
+func (l *blockingLoc) GetId() string {
+	return "blocking"
+}
+
+func (l *blockingLoc) RoundTrip(r Request) (*http.Response, error) {
+	<-l.unblock
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("hello")),
+	}, nil
+}
+
+func makeReq() Request {
+	return NewBaseRequest(&http.Request{Header: http.Header{}}, 1, nil)
+}
@@ -0,0 +1,68 @@
+package tcploc
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// counters are updated atomically as the data flows, so the stats of the long lived connections are up to date
+type counters struct {
+	connections   int64
+	active        int64
+	failures      int64
+	bytesSent     int64
+	bytesReceived int64
+}
+
+func (c *counters) get() Stats {
+	return Stats{
+		Connections:   atomic.LoadInt64(&c.connections),
+		Active:        atomic.LoadInt64(&c.active),
+		Failures:      atomic.LoadInt64(&c.failures),
+		BytesSent:     atomic.LoadInt64(&c.bytesSent),
+		BytesReceived: atomic.LoadInt64(&c.bytesReceived),
+	}
+}
+
+// meteredConn counts the bytes of the endpoint connection and pushes its deadline on every read and write,
+// so the connection is closed once it has been idle for too long
+type meteredConn struct {
+	net.Conn
+	idle     time.Duration
+	counters []*counters
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	c.extendDeadline()
+	n, err := c.Conn.Read(p)
+	for _, s := range c.counters {
+		atomic.AddInt64(&s.bytesReceived, int64(n))
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	c.extendDeadline()
+	n, err := c.Conn.Write(p)
+	for _, s := range c.counters {
+		atomic.AddInt64(&s.bytesSent, int64(n))
+	}
+	return n, err
+}
+
+// CloseWrite lets the endpoint see EOF once the client is done sending
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *meteredConn) extendDeadline() {
+	if c.idle > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.idle))
+	}
+}
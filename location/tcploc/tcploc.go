@@ -0,0 +1,324 @@
+// TCP location that balances the raw connections, e.g. SMTP or Redis, among the endpoints
+package tcploc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/proxyproto"
+	"github.com/mailgun/vulcan/request"
+)
+
+// TcpLocation forwards the connections to the endpoints chosen by the load balancer and copies the data both ways
+// until either side closes the connection. Endpoints are dialed by the host of their URL, the scheme is ignored:
+//
+//	lb, _ := roundrobin.NewRoundRobin()
+//	lb.AddEndpoint(endpoint.MustParseUrl("tcp://10.0.0.1:6379"))
+//	l, _ := tcploc.NewLocation("redis", lb)
+//	listener, _ := net.Listen("tcp", ":6379")
+//	l.Serve(listener)
+//
+// Load balancers and observers see each connection as the CONNECT request, the attempt ends once the connection
+// is closed, so the balancers that count the requests in flight, e.g. least connections, balance the open connections.
+// Endpoints added and removed through the location, e.g. by discovery.Syncer, get their counters dropped on removal.
+type TcpLocation struct {
+	// Unique identifier of this location
+	id string
+	// Load balancer controls endpoints for this location
+	loadBalancer loadbalance.LoadBalancer
+	// Timeouts and other optional settings
+	options Options
+	dial    proxyproto.DialFunc
+	// Chain of observers that watch the connections
+	observerChain *middleware.ObserverChain
+	lastId        int64
+
+	stats     *counters
+	mutex     *sync.Mutex
+	endpoints map[string]*counters
+}
+
+type Timeouts struct {
+	// Endpoint connect timeout, DefaultDialTimeout by default
+	Dial time.Duration
+	// Connections with no data sent either way for this long are closed, 0 means no limit
+	Idle time.Duration
+}
+
+type Options struct {
+	Timeouts Timeouts
+	// Endpoints to try before the connection is given up, DefaultMaxAttempts by default.
+	// Connections fail over only if the endpoint could not be dialed, as no data has been sent yet.
+	MaxAttempts int
+	// Send the PROXY protocol header of this version, 1 or 2, to the endpoints so they see the address
+	// of the client, 0 means no header
+	ProxyProtocolVersion int
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+// Stats are the connection and byte counters of the location or one of its endpoints
+type Stats struct {
+	// Connections forwarded to the endpoints
+	Connections int64
+	// Connections open at the moment
+	Active int64
+	// Connections that could not be forwarded, for the endpoints these are the failed dials
+	Failures int64
+	// Bytes received from the clients and sent to the endpoints
+	BytesSent int64
+	// Bytes received from the endpoints and sent to the clients
+	BytesReceived int64
+}
+
+const (
+	DefaultDialTimeout = 10 * time.Second
+	DefaultMaxAttempts = 2
+
+	BalancerId = "__loadBalancer"
+)
+
+func NewLocation(id string, loadBalancer loadbalance.LoadBalancer) (*TcpLocation, error) {
+	return NewLocationWithOptions(id, loadBalancer, Options{})
+}
+
+func NewLocationWithOptions(id string, loadBalancer loadbalance.LoadBalancer, o Options) (*TcpLocation, error) {
+	if loadBalancer == nil {
+		return nil, fmt.Errorf("Provide load balancer")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	dial := proxyproto.DialFunc((&net.Dialer{Timeout: o.Timeouts.Dial}).DialContext)
+	if o.ProxyProtocolVersion != 0 {
+		if dial, err = proxyproto.NewDialFunc(dial, o.ProxyProtocolVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	observerChain := middleware.NewObserverChain()
+	observerChain.Add(BalancerId, loadBalancer)
+
+	return &TcpLocation{
+		id:            id,
+		loadBalancer:  loadBalancer,
+		options:       o,
+		dial:          dial,
+		observerChain: observerChain,
+		stats:         &counters{},
+		mutex:         &sync.Mutex{},
+		endpoints:     make(map[string]*counters),
+	}, nil
+}
+
+func (l *TcpLocation) GetId() string {
+	return l.id
+}
+
+func (l *TcpLocation) GetOptions() Options {
+	return l.options
+}
+
+func (l *TcpLocation) GetLoadBalancer() loadbalance.LoadBalancer {
+	return l.loadBalancer
+}
+
+func (l *TcpLocation) GetObserverChain() *middleware.ObserverChain {
+	return l.observerChain
+}
+
+// GetStats returns the counters of all the connections of the location
+func (l *TcpLocation) GetStats() Stats {
+	return l.stats.get()
+}
+
+// GetEndpointStats returns the counters of the connections to the endpoint, false if it has not been dialed yet
+func (l *TcpLocation) GetEndpointStats(endpointId string) (Stats, bool) {
+	l.mutex.Lock()
+	c, ok := l.endpoints[endpointId]
+	l.mutex.Unlock()
+	if !ok {
+		return Stats{}, false
+	}
+	return c.get(), true
+}
+
+// AddEndpoint adds the endpoint to the load balancer, the location can be synced like the balancer itself
+func (l *TcpLocation) AddEndpoint(e endpoint.Endpoint) error {
+	b, err := l.balancer()
+	if err != nil {
+		return err
+	}
+	return b.AddEndpoint(e)
+}
+
+// RemoveEndpoint removes the endpoint from the load balancer and drops its counters,
+// the connections that are still open are not counted anymore
+func (l *TcpLocation) RemoveEndpoint(e endpoint.Endpoint) error {
+	b, err := l.balancer()
+	if err != nil {
+		return err
+	}
+	if err := b.RemoveEndpoint(e); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	delete(l.endpoints, e.GetId())
+	l.mutex.Unlock()
+	return nil
+}
+
+func (l *TcpLocation) balancer() (endpointBalancer, error) {
+	b, ok := l.loadBalancer.(endpointBalancer)
+	if !ok {
+		return nil, fmt.Errorf("Load balancer %T does not support changing the endpoints", l.loadBalancer)
+	}
+	return b, nil
+}
+
+// endpointBalancer is the load balancer the endpoints can be added to and removed from, e.g. roundrobin.RoundRobin
+type endpointBalancer interface {
+	AddEndpoint(endpoint.Endpoint) error
+	RemoveEndpoint(endpoint.Endpoint) error
+}
+
+// Serve accepts the connections on the listener until it's closed
+func (l *TcpLocation) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warningf("Failed to accept connection: %s", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go l.ServeConn(conn)
+	}
+}
+
+// ServeConn forwards the connection to the endpoint and closes it once either side is done
+func (l *TcpLocation) ServeConn(conn net.Conn) {
+	l.ForwardConn(conn, conn.LocalAddr().String())
+}
+
+// ForwardConn is ServeConn for the connection routed by the host, e.g. the server name of TLS passthrough,
+// load balancers and observers see the CONNECT request to the host
+func (l *TcpLocation) ForwardConn(conn net.Conn, host string) {
+	defer conn.Close()
+
+	// Attempts are recorded in the request, so the balancers don't pick the endpoint that has failed again
+	req := l.newRequest(conn, host)
+	for i := 0; i < l.options.MaxAttempts; i++ {
+		e, err := l.loadBalancer.NextEndpoint(req)
+		if err != nil {
+			log.Errorf("Load Balancer failure: %s", err)
+			break
+		}
+		if l.proxyToEndpoint(conn, e, req) {
+			return
+		}
+	}
+	atomic.AddInt64(&l.stats.failures, 1)
+}
+
+// proxyToEndpoint copies the data between the client and the endpoint, returns false if the endpoint could not be dialed
+func (l *TcpLocation) proxyToEndpoint(conn net.Conn, e endpoint.Endpoint, req request.Request) bool {
+	a := &request.BaseAttempt{Endpoint: e}
+
+	l.observerChain.ObserveRequest(req)
+	defer l.observerChain.ObserveResponse(req, a)
+	defer req.AddAttempt(a)
+
+	c := l.endpointCounters(e)
+	start := l.options.TimeProvider.UtcNow()
+	ctx := context.Background()
+	if l.options.ProxyProtocolVersion != 0 {
+		ctx = proxyproto.ContextWithHeader(ctx, headerFromConn(conn))
+	}
+	upstream, err := l.dial(ctx, "tcp", e.GetUrl().Host)
+	if err != nil {
+		log.Errorf("Failed to connect to %s: %s", e, err)
+		atomic.AddInt64(&c.failures, 1)
+		a.Error = err
+		a.Duration = l.options.TimeProvider.UtcNow().Sub(start)
+		return false
+	}
+	defer upstream.Close()
+
+	for _, s := range []*counters{l.stats, c} {
+		atomic.AddInt64(&s.connections, 1)
+		atomic.AddInt64(&s.active, 1)
+		defer atomic.AddInt64(&s.active, -1)
+	}
+	netutils.Pipe(conn, &meteredConn{Conn: upstream, idle: l.options.Timeouts.Idle, counters: []*counters{l.stats, c}})
+	a.Duration = l.options.TimeProvider.UtcNow().Sub(start)
+	return true
+}
+
+func (l *TcpLocation) endpointCounters(e endpoint.Endpoint) *counters {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	c, ok := l.endpoints[e.GetId()]
+	if !ok {
+		c = &counters{}
+		l.endpoints[e.GetId()] = c
+	}
+	return c
+}
+
+// newRequest represents the connection as the CONNECT request for the load balancers and observers
+func (l *TcpLocation) newRequest(conn net.Conn, host string) request.Request {
+	httpReq := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: host},
+		Host:       host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	return request.NewBaseRequest(httpReq, atomic.AddInt64(&l.lastId, 1), nil)
+}
+
+func headerFromConn(conn net.Conn) *proxyproto.Header {
+	h := &proxyproto.Header{}
+	h.Source, _ = conn.RemoteAddr().(*net.TCPAddr)
+	h.Destination, _ = conn.LocalAddr().(*net.TCPAddr)
+	return h
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Timeouts.Dial < 0 || o.Timeouts.Idle < 0 {
+		return o, fmt.Errorf("Timeouts can not be negative")
+	}
+	if o.Timeouts.Dial == 0 {
+		o.Timeouts.Dial = DefaultDialTimeout
+	}
+	if o.MaxAttempts < 0 {
+		return o, fmt.Errorf("Max attempts can not be negative")
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = DefaultMaxAttempts
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
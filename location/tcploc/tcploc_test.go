@@ -0,0 +1,328 @@
+package tcploc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/proxyproto"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestTcpLoc(t *testing.T) { TestingT(t) }
+
+type TcpLocSuite struct{}
+
+var _ = Suite(&TcpLocSuite{})
+
+func (s *TcpLocSuite) TestForwards(c *C) {
+	a, b := newEchoServer(c, "a"), newEchoServer(c, "b")
+	defer a.Close()
+	defer b.Close()
+
+	l, err := NewLocation("loc1", newRoundRobin(c, a, b))
+	c.Assert(err, IsNil)
+	addr := serve(c, l)
+
+	c.Assert(roundTrip(c, addr, "hello"), Equals, "a:hello")
+	c.Assert(roundTrip(c, addr, "hello"), Equals, "b:hello")
+	c.Assert(roundTrip(c, addr, "hello"), Equals, "a:hello")
+}
+
+func (s *TcpLocSuite) TestStats(c *C) {
+	a := newEchoServer(c, "a")
+	defer a.Close()
+
+	l, err := NewLocation("loc1", newRoundRobin(c, a))
+	c.Assert(err, IsNil)
+	addr := serve(c, l)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	conn.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "a:hello\n")
+
+	stats := l.GetStats()
+	c.Assert(stats.Connections, Equals, int64(1))
+	c.Assert(stats.Active, Equals, int64(1))
+	c.Assert(stats.BytesSent, Equals, int64(6))
+	c.Assert(stats.BytesReceived, Equals, int64(8))
+
+	conn.Close()
+	waitFor(c, func() bool { return l.GetStats().Active == 0 })
+
+	stats, ok := l.GetEndpointStats(endpoint.MustParseUrl(a.url).GetId())
+	c.Assert(ok, Equals, true)
+	c.Assert(stats, DeepEquals, Stats{Connections: 1, BytesSent: 6, BytesReceived: 8})
+
+	_, ok = l.GetEndpointStats("tcp://localhost:1")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TcpLocSuite) TestFailover(c *C) {
+	a := newEchoServer(c, "a")
+	defer a.Close()
+	dead := deadUrl(c)
+
+	l, err := NewLocation("loc1", newRoundRobin(c, &echoServer{url: dead}, a))
+	c.Assert(err, IsNil)
+	addr := serve(c, l)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(roundTrip(c, addr, "hello"), Equals, "a:hello")
+	}
+	stats, ok := l.GetEndpointStats(endpoint.MustParseUrl(dead).GetId())
+	c.Assert(ok, Equals, true)
+	c.Assert(stats.Failures, Not(Equals), int64(0))
+	c.Assert(stats.Connections, Equals, int64(0))
+	c.Assert(l.GetStats().Failures, Equals, int64(0))
+}
+
+// Failed endpoint is not tried again for the same connection
+func (s *TcpLocSuite) TestFailoverSkipsFailedEndpoint(c *C) {
+	a := newEchoServer(c, "a")
+	defer a.Close()
+
+	// The dead endpoint comes first, it is only skipped if the failed attempt is remembered
+	lb := &untriedFirst{endpoints: []endpoint.Endpoint{endpoint.MustParseUrl(deadUrl(c)), endpoint.MustParseUrl(a.url)}}
+	l, err := NewLocation("loc1", lb)
+	c.Assert(err, IsNil)
+	addr := serve(c, l)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(roundTrip(c, addr, "hello"), Equals, "a:hello")
+	}
+	c.Assert(l.GetStats().Failures, Equals, int64(0))
+}
+
+func (s *TcpLocSuite) TestRemoveEndpoint(c *C) {
+	a, b := newEchoServer(c, "a"), newEchoServer(c, "b")
+	defer a.Close()
+	defer b.Close()
+
+	l, err := NewLocation("loc1", newRoundRobin(c, a))
+	c.Assert(err, IsNil)
+	addr := serve(c, l)
+	c.Assert(l.AddEndpoint(endpoint.MustParseUrl(b.url)), IsNil)
+
+	c.Assert(roundTrip(c, addr, "hello"), Equals, "a:hello")
+	c.Assert(roundTrip(c, addr, "hello"), Equals, "b:hello")
+	id := endpoint.MustParseUrl(a.url).GetId()
+	_, ok := l.GetEndpointStats(id)
+	c.Assert(ok, Equals, true)
+
+	// Counters of the removed endpoint are dropped
+	c.Assert(l.RemoveEndpoint(endpoint.MustParseUrl(a.url)), IsNil)
+	_, ok = l.GetEndpointStats(id)
+	c.Assert(ok, Equals, false)
+	c.Assert(roundTrip(c, addr, "hello"), Equals, "b:hello")
+	c.Assert(l.GetStats().Connections, Equals, int64(3))
+
+	c.Assert(l.RemoveEndpoint(endpoint.MustParseUrl(a.url)), NotNil)
+}
+
+func (s *TcpLocSuite) TestAllEndpointsDown(c *C) {
+	l, err := NewLocation("loc1", newRoundRobin(c, &echoServer{url: deadUrl(c)}))
+	c.Assert(err, IsNil)
+	addr := serve(c, l)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(l.GetStats().Failures, Equals, int64(1))
+}
+
+func (s *TcpLocSuite) TestIdleTimeout(c *C) {
+	a := newEchoServer(c, "a")
+	defer a.Close()
+
+	l, err := NewLocationWithOptions("loc1", newRoundRobin(c, a), Options{Timeouts: Timeouts{Idle: 50 * time.Millisecond}})
+	c.Assert(err, IsNil)
+	addr := serve(c, l)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Activity keeps the connection open
+	for i := 0; i < 4; i++ {
+		conn.Write([]byte("hello\n"))
+		line, err := r.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, "a:hello\n")
+		time.Sleep(25 * time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = r.ReadByte()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *TcpLocSuite) TestProxyProtocol(c *C) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer backend.Close()
+	headers := make(chan *proxyproto.Header, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h, _ := proxyproto.ReadHeader(bufio.NewReader(conn))
+		headers <- h
+	}()
+
+	l, err := NewLocationWithOptions("loc1", newRoundRobin(c, &echoServer{url: "tcp://" + backend.Addr().String()}), Options{ProxyProtocolVersion: 2})
+	c.Assert(err, IsNil)
+	addr := serve(c, l)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	select {
+	case h := <-headers:
+		c.Assert(h, NotNil)
+		c.Assert(h.Source.String(), Equals, conn.LocalAddr().String())
+		c.Assert(h.Destination.String(), Equals, addr)
+	case <-time.After(time.Second):
+		c.Fatalf("Timeout waiting for the header")
+	}
+}
+
+func (s *TcpLocSuite) TestBadParams(c *C) {
+	lb := newRoundRobin(c)
+	_, err := NewLocation("loc1", nil)
+	c.Assert(err, NotNil)
+	_, err = NewLocationWithOptions("loc1", lb, Options{Timeouts: Timeouts{Idle: -1}})
+	c.Assert(err, NotNil)
+	_, err = NewLocationWithOptions("loc1", lb, Options{MaxAttempts: -1})
+	c.Assert(err, NotNil)
+	_, err = NewLocationWithOptions("loc1", lb, Options{ProxyProtocolVersion: 3})
+	c.Assert(err, NotNil)
+}
+
+// echoServer replies to each line with the line prefixed by its name
+type echoServer struct {
+	listener net.Listener
+	url      string
+}
+
+func newEchoServer(c *C, name string) *echoServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(name + ":" + line))
+				}
+			}()
+		}
+	}()
+	return &echoServer{listener: l, url: "tcp://" + l.Addr().String()}
+}
+
+func (e *echoServer) Close() {
+	e.listener.Close()
+}
+
+// deadUrl returns the URL of the port nothing listens on
+func deadUrl(c *C) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	l.Close()
+	return "tcp://" + l.Addr().String()
+}
+
+func newRoundRobin(c *C, servers ...*echoServer) *roundrobin.RoundRobin {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	for _, s := range servers {
+		c.Assert(rr.AddEndpoint(endpoint.MustParseUrl(s.url)), IsNil)
+	}
+	return rr
+}
+
+// serve starts the location on the local port and returns its address
+func serve(c *C, l *TcpLocation) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go l.Serve(listener)
+	return listener.Addr().String()
+}
+
+// roundTrip sends the line, half-closes the connection and returns everything the endpoint has replied
+func roundTrip(c *C, addr, line string) string {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(line + "\n"))
+	c.Assert(err, IsNil)
+	c.Assert(conn.(*net.TCPConn).CloseWrite(), IsNil)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	out, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+func waitFor(c *C, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("Timeout waiting for the condition")
+}
+
+// untriedFirst picks the first endpoint that has not been attempted by the request
+type untriedFirst struct {
+	endpoints []endpoint.Endpoint
+}
+
+func (u *untriedFirst) NextEndpoint(req request.Request) (endpoint.Endpoint, error) {
+	for _, e := range u.endpoints {
+		tried := false
+		for _, a := range req.GetAttempts() {
+			if a.GetEndpoint().GetId() == e.GetId() {
+				tried = true
+			}
+		}
+		if !tried {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("No endpoints left")
+}
+
+func (u *untriedFirst) ProcessRequest(req request.Request) (*http.Response, error) { return nil, nil }
+func (u *untriedFirst) ProcessResponse(req request.Request, a request.Attempt)     {}
+func (u *untriedFirst) ObserveRequest(req request.Request)                         {}
+func (u *untriedFirst) ObserveResponse(req request.Request, a request.Attempt)     {}
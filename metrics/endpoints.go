@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/request"
+)
+
+// EndpointMetrics is an observer that keeps rolling round trip metrics for every endpoint it has seen,
+// so health checks, balancers and dashboards can query the recent counters and latencies, e.g.
+//
+//	m, _ := metrics.NewEndpointMetrics(metrics.RoundTripOptions{})
+//	location.GetObserverChain().Add("metrics", m)
+//	stats, ok := m.GetStats("http://localhost:5000")
+type EndpointMetrics struct {
+	o         RoundTripOptions
+	mutex     *sync.Mutex
+	endpoints map[string]*RoundTripMetrics
+}
+
+// EndpointStats is a snapshot of the endpoint metrics over the rolling window
+type EndpointStats struct {
+	// Id of the endpoint
+	Endpoint string
+	// Total amount of attempts
+	Total int64
+	// Attempts that failed with network errors, e.g. timeouts or dropped connections
+	NetworkErrors int64
+	// Ratio of network errors to the total attempts
+	NetworkErrorRatio float64
+	// Counts of the response codes
+	StatusCodes map[int]int64
+	// Latencies of the attempts
+	Latency Histogram
+}
+
+func NewEndpointMetrics(o RoundTripOptions) (*EndpointMetrics, error) {
+	o = setDefaults(o)
+	// Make sure options are valid before the first endpoint shows up
+	if _, err := NewRoundTripMetrics(o); err != nil {
+		return nil, err
+	}
+	return &EndpointMetrics{
+		o:         o,
+		mutex:     &sync.Mutex{},
+		endpoints: make(map[string]*RoundTripMetrics),
+	}, nil
+}
+
+func (m *EndpointMetrics) ObserveRequest(r request.Request) {
+}
+
+func (m *EndpointMetrics) ObserveResponse(r request.Request, a request.Attempt) {
+	if a == nil || a.GetEndpoint() == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id := a.GetEndpoint().GetId()
+	rt, ok := m.endpoints[id]
+	if !ok {
+		var err error
+		if rt, err = NewRoundTripMetrics(m.o); err != nil {
+			log.Errorf("Failed to create metrics for %s: %v", id, err)
+			return
+		}
+		m.endpoints[id] = rt
+	}
+	rt.RecordMetrics(a)
+}
+
+// GetEndpoints returns sorted ids of the endpoints that have metrics
+func (m *EndpointMetrics) GetEndpoints() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ids := make([]string, 0, len(m.endpoints))
+	for id := range m.endpoints {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// GetStats returns the snapshot of the endpoint metrics, false if there are no metrics for the endpoint
+func (m *EndpointMetrics) GetStats(endpointId string) (*EndpointStats, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rt, ok := m.endpoints[endpointId]
+	if !ok {
+		return nil, false
+	}
+	h, err := rt.GetLatencyHistogram()
+	if err != nil {
+		return nil, false
+	}
+	return &EndpointStats{
+		Endpoint:          endpointId,
+		Total:             rt.GetTotalCount(),
+		NetworkErrors:     rt.GetNetworkErrorCount(),
+		NetworkErrorRatio: rt.GetNetworkErrorRatio(),
+		StatusCodes:       rt.GetStatusCodesCounts(),
+		Latency:           h,
+	}, true
+}
+
+// Remove drops the metrics of the endpoint, e.g. once it's removed from the load balancer
+func (m *EndpointMetrics) Remove(endpointId string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.endpoints, endpointId)
+}
+
+// Reset drops the metrics of all endpoints
+func (m *EndpointMetrics) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.endpoints = make(map[string]*RoundTripMetrics)
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type EndpointsSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&EndpointsSuite{})
+
+func (s *EndpointsSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *EndpointsSuite) TestStats(c *C) {
+	m, err := NewEndpointMetrics(RoundTripOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	a, b := endpoint.MustParseUrl("http://a:80"), endpoint.MustParseUrl("http://b:80")
+	m.ObserveResponse(nil, withEndpoint(a, O{statusCode: 200, duration: time.Second}))
+	m.ObserveResponse(nil, withEndpoint(a, O{statusCode: 500, duration: 3 * time.Second}))
+	m.ObserveResponse(nil, withEndpoint(b, O{err: fmt.Errorf("refused"), duration: time.Second}))
+	// Attempts without endpoint are ignored
+	m.ObserveResponse(nil, makeAttempt(O{statusCode: 200}))
+
+	c.Assert(m.GetEndpoints(), DeepEquals, []string{"http://a:80", "http://b:80"})
+
+	stats, ok := m.GetStats("http://a:80")
+	c.Assert(ok, Equals, true)
+	c.Assert(stats.Total, Equals, int64(2))
+	c.Assert(stats.NetworkErrors, Equals, int64(0))
+	c.Assert(stats.StatusCodes, DeepEquals, map[int]int64{200: 1, 500: 1})
+	c.Assert(int(stats.Latency.LatencyAtQuantile(100)/time.Second), Equals, 3)
+
+	stats, ok = m.GetStats("http://b:80")
+	c.Assert(ok, Equals, true)
+	c.Assert(stats.NetworkErrors, Equals, int64(1))
+	c.Assert(stats.NetworkErrorRatio, Equals, float64(1))
+
+	_, ok = m.GetStats("http://c:80")
+	c.Assert(ok, Equals, false)
+
+	m.Remove("http://b:80")
+	c.Assert(m.GetEndpoints(), DeepEquals, []string{"http://a:80"})
+	m.Reset()
+	c.Assert(m.GetEndpoints(), DeepEquals, []string{})
+}
+
+// Counters are rolled over with the time window
+func (s *EndpointsSuite) TestRollingWindow(c *C) {
+	m, err := NewEndpointMetrics(RoundTripOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	a := endpoint.MustParseUrl("http://a:80")
+	m.ObserveResponse(nil, withEndpoint(a, O{statusCode: 200}))
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	stats, ok := m.GetStats("http://a:80")
+	c.Assert(ok, Equals, true)
+	c.Assert(stats.Total, Equals, int64(0))
+}
+
+func (s *EndpointsSuite) TestBadParams(c *C) {
+	_, err := NewEndpointMetrics(RoundTripOptions{CounterResolution: time.Millisecond})
+	c.Assert(err, NotNil)
+}
+
+func withEndpoint(e endpoint.Endpoint, o O) *request.BaseAttempt {
+	a := makeAttempt(o)
+	a.Endpoint = e
+	return a
+}
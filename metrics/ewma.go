@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"fmt"
+)
+
+// EWMA is exponentially weighted moving average of the observed values,
+// recent values contribute more to the average than the older ones.
+// It's not thread safe, callers should synchronize access to it.
+type EWMA struct {
+	alpha float64
+	value float64
+	set   bool
+}
+
+// NewEWMA creates the moving average with smoothing factor alpha in range (0, 1],
+// the larger alpha is, the faster the average reacts to the changes.
+func NewEWMA(alpha float64) (*EWMA, error) {
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("Alpha should be in range (0, 1], got %f", alpha)
+	}
+	return &EWMA{alpha: alpha}, nil
+}
+
+func (e *EWMA) Observe(v float64) {
+	if !e.set {
+		e.value = v
+		e.set = true
+		return
+	}
+	e.value = e.alpha*v + (1-e.alpha)*e.value
+}
+
+// Value returns the current average, 0 if nothing has been observed yet
+func (e *EWMA) Value() float64 {
+	return e.value
+}
+
+// IsSet tells whether any values have been observed
+func (e *EWMA) IsSet() bool {
+	return e.set
+}
+
+func (e *EWMA) Reset() {
+	e.value = 0
+	e.set = false
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type EWMASuite struct {
+}
+
+var _ = Suite(&EWMASuite{})
+
+func (s *EWMASuite) TestInvalidParams(c *C) {
+	_, err := NewEWMA(0)
+	c.Assert(err, NotNil)
+
+	_, err = NewEWMA(1.1)
+	c.Assert(err, NotNil)
+}
+
+func (s *EWMASuite) TestObserve(c *C) {
+	e, err := NewEWMA(0.5)
+	c.Assert(err, IsNil)
+	c.Assert(e.IsSet(), Equals, false)
+	c.Assert(e.Value(), Equals, 0.0)
+
+	// First value is taken as is
+	e.Observe(10)
+	c.Assert(e.IsSet(), Equals, true)
+	c.Assert(e.Value(), Equals, 10.0)
+
+	e.Observe(20)
+	c.Assert(e.Value(), Equals, 15.0)
+
+	e.Observe(15)
+	c.Assert(e.Value(), Equals, 15.0)
+
+	e.Reset()
+	c.Assert(e.IsSet(), Equals, false)
+}
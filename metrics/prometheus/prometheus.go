@@ -0,0 +1,214 @@
+// Exports proxy metrics in the Prometheus text exposition format
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Exporter collects request counters and latency histograms per location and endpoint
+// and serves them to the Prometheus scraper, e.g.
+//
+//	e, _ := prometheus.NewExporter()
+//	location.GetObserverChain().Add("prometheus", e.NewObserver(location.GetId()))
+//	http.Handle("/metrics", e)
+type Exporter struct {
+	options Options
+	mutex   *sync.Mutex
+	series  map[seriesKey]*series
+}
+
+type Options struct {
+	// Prefix of the metric names, "vulcan" by default
+	Namespace string
+	// Upper bounds of the latency histogram buckets in seconds, DefaultBuckets by default
+	Buckets []float64
+}
+
+// DefaultBuckets cover latencies from 5 milliseconds to 10 seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type seriesKey struct {
+	location string
+	endpoint string
+}
+
+type series struct {
+	// Requests by the status code class, e.g. 2xx
+	codes map[string]int64
+	// Requests that have failed without response, e.g. connection refused
+	errors int64
+	// Cumulative counts for every bucket, the last one is +Inf
+	buckets []int64
+	sum     float64
+	count   int64
+}
+
+func NewExporter() (*Exporter, error) {
+	return NewExporterWithOptions(Options{})
+}
+
+func NewExporterWithOptions(o Options) (*Exporter, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		options: o,
+		mutex:   &sync.Mutex{},
+		series:  make(map[seriesKey]*series),
+	}, nil
+}
+
+// NewObserver returns the observer that records the attempts with the given location label
+func (e *Exporter) NewObserver(locationId string) middleware.Observer {
+	return &middleware.ObserverWrapper{
+		OnResponse: func(r request.Request, a request.Attempt) {
+			e.record(locationId, a)
+		},
+	}
+}
+
+// ServeHTTP writes the current values of all metrics
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(e.export())
+}
+
+func (e *Exporter) record(locationId string, a request.Attempt) {
+	if a == nil {
+		return
+	}
+	key := seriesKey{location: locationId}
+	if a.GetEndpoint() != nil {
+		key.endpoint = a.GetEndpoint().GetId()
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	s, ok := e.series[key]
+	if !ok {
+		s = &series{
+			codes:   make(map[string]int64),
+			buckets: make([]int64, len(e.options.Buckets)+1),
+		}
+		e.series[key] = s
+	}
+	if re := a.GetResponse(); re != nil {
+		s.codes[codeClass(re.StatusCode)] += 1
+	} else if a.GetError() != nil {
+		s.errors += 1
+	}
+
+	seconds := a.GetDuration().Seconds()
+	for i, upper := range e.options.Buckets {
+		if seconds <= upper {
+			s.buckets[i] += 1
+		}
+	}
+	s.buckets[len(e.options.Buckets)] += 1
+	s.sum += seconds
+	s.count += 1
+}
+
+func (e *Exporter) export() []byte {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	keys := make([]seriesKey, 0, len(e.series))
+	for k := range e.series {
+		keys = append(keys, k)
+	}
+	sort.Sort(byLabels(keys))
+
+	n := e.options.Namespace
+	b := &bytes.Buffer{}
+
+	fmt.Fprintf(b, "# HELP %s_requests_total Requests proxied to the endpoints by status code class.\n", n)
+	fmt.Fprintf(b, "# TYPE %s_requests_total counter\n", n)
+	for _, k := range keys {
+		s := e.series[k]
+		codes := make([]string, 0, len(s.codes))
+		for code := range s.codes {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(b, "%s_requests_total{%s,code=\"%s\"} %d\n", n, k.labels(), code, s.codes[code])
+		}
+	}
+
+	fmt.Fprintf(b, "# HELP %s_network_errors_total Requests to the endpoints that failed without response.\n", n)
+	fmt.Fprintf(b, "# TYPE %s_network_errors_total counter\n", n)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s_network_errors_total{%s} %d\n", n, k.labels(), e.series[k].errors)
+	}
+
+	fmt.Fprintf(b, "# HELP %s_request_duration_seconds Latency of the requests to the endpoints.\n", n)
+	fmt.Fprintf(b, "# TYPE %s_request_duration_seconds histogram\n", n)
+	for _, k := range keys {
+		s := e.series[k]
+		for i, upper := range e.options.Buckets {
+			fmt.Fprintf(b, "%s_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", n, k.labels(), formatFloat(upper), s.buckets[i])
+		}
+		fmt.Fprintf(b, "%s_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", n, k.labels(), s.buckets[len(e.options.Buckets)])
+		fmt.Fprintf(b, "%s_request_duration_seconds_sum{%s} %s\n", n, k.labels(), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_request_duration_seconds_count{%s} %d\n", n, k.labels(), s.count)
+	}
+	return b.Bytes()
+}
+
+func (k seriesKey) labels() string {
+	return fmt.Sprintf(`location="%s",endpoint="%s"`, escape(k.location), escape(k.endpoint))
+}
+
+type byLabels []seriesKey
+
+func (s byLabels) Len() int      { return len(s) }
+func (s byLabels) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLabels) Less(i, j int) bool {
+	if s[i].location != s[j].location {
+		return s[i].location < s[j].location
+	}
+	return s[i].endpoint < s[j].endpoint
+}
+
+func codeClass(statusCode int) string {
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Namespace == "" {
+		o.Namespace = DefaultNamespace
+	}
+	if o.Buckets == nil {
+		o.Buckets = DefaultBuckets
+	}
+	for i := 1; i < len(o.Buckets); i++ {
+		if o.Buckets[i] <= o.Buckets[i-1] {
+			return o, fmt.Errorf("Buckets should be sorted in increasing order")
+		}
+	}
+	return o, nil
+}
+
+const DefaultNamespace = "vulcan"
@@ -0,0 +1,84 @@
+package prometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestPrometheus(t *testing.T) { TestingT(t) }
+
+type PrometheusSuite struct {
+}
+
+var _ = Suite(&PrometheusSuite{})
+
+func (s *PrometheusSuite) TestExport(c *C) {
+	e, err := NewExporterWithOptions(Options{Buckets: []float64{0.1, 1}})
+	c.Assert(err, IsNil)
+
+	o := e.NewObserver("loc1")
+	o.ObserveResponse(nil, attempt("http://a:80", 200, 50*time.Millisecond))
+	o.ObserveResponse(nil, attempt("http://a:80", 503, 500*time.Millisecond))
+	o.ObserveResponse(nil, &request.BaseAttempt{
+		Endpoint: endpoint.MustParseUrl("http://b:80"),
+		Error:    fmt.Errorf("connection refused"),
+		Duration: 2 * time.Second,
+	})
+
+	out := string(e.export())
+	for _, line := range []string{
+		`vulcan_requests_total{location="loc1",endpoint="http://a:80",code="2xx"} 1`,
+		`vulcan_requests_total{location="loc1",endpoint="http://a:80",code="5xx"} 1`,
+		`vulcan_network_errors_total{location="loc1",endpoint="http://a:80"} 0`,
+		`vulcan_network_errors_total{location="loc1",endpoint="http://b:80"} 1`,
+		`vulcan_request_duration_seconds_bucket{location="loc1",endpoint="http://a:80",le="0.1"} 1`,
+		`vulcan_request_duration_seconds_bucket{location="loc1",endpoint="http://a:80",le="1"} 2`,
+		`vulcan_request_duration_seconds_bucket{location="loc1",endpoint="http://a:80",le="+Inf"} 2`,
+		`vulcan_request_duration_seconds_sum{location="loc1",endpoint="http://a:80"} 0.55`,
+		`vulcan_request_duration_seconds_count{location="loc1",endpoint="http://a:80"} 2`,
+		`vulcan_request_duration_seconds_bucket{location="loc1",endpoint="http://b:80",le="1"} 0`,
+		`vulcan_request_duration_seconds_bucket{location="loc1",endpoint="http://b:80",le="+Inf"} 1`,
+	} {
+		c.Assert(strings.Contains(out, line+"\n"), Equals, true, Commentf("missing %s in %s", line, out))
+	}
+}
+
+func (s *PrometheusSuite) TestHandler(c *C) {
+	e, err := NewExporterWithOptions(Options{Namespace: "proxy"})
+	c.Assert(err, IsNil)
+	e.NewObserver(`loc"1`).ObserveResponse(nil, attempt("http://a:80", 200, time.Millisecond))
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	re, err := http.Get(server.URL)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+
+	c.Assert(re.Header.Get("Content-Type"), Equals, "text/plain; version=0.0.4")
+	c.Assert(strings.Contains(string(body), `proxy_requests_total{location="loc\"1",endpoint="http://a:80",code="2xx"} 1`), Equals, true)
+}
+
+func (s *PrometheusSuite) TestBadParams(c *C) {
+	_, err := NewExporterWithOptions(Options{Buckets: []float64{1, 0.1}})
+	c.Assert(err, NotNil)
+}
+
+func attempt(u string, code int, d time.Duration) request.Attempt {
+	return &request.BaseAttempt{
+		Endpoint: endpoint.MustParseUrl(u),
+		Response: &http.Response{StatusCode: code},
+		Duration: d,
+	}
+}
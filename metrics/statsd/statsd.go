@@ -0,0 +1,147 @@
+// Reports proxy metrics to StatsD or DogStatsD over UDP
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Reporter sends a counter and a timing for every attempt to proxy the request to the endpoint, e.g.
+//
+//	r, _ := statsd.NewReporter("127.0.0.1:8125")
+//	location.GetObserverChain().Add("statsd", r.NewObserver(location.GetId()))
+//
+// With plain StatsD the labels are encoded in the metric name:
+//
+//	vulcan.loc1.http_a_80.requests.2xx:1|c
+//	vulcan.loc1.http_a_80.latency:12|ms
+//
+// With DogStatsD they are sent as tags:
+//
+//	vulcan.requests:1|c|#location:loc1,endpoint:http://a:80,status_class:2xx
+//	vulcan.latency:12|ms|#location:loc1,endpoint:http://a:80
+type Reporter struct {
+	options Options
+	// Tags that are added to every metric, already formatted
+	tags  []string
+	mutex *sync.Mutex
+	conn  net.Conn
+}
+
+type Options struct {
+	// Prefix of the metric names, "vulcan" by default
+	Prefix string
+	// Send the labels as DogStatsD tags instead of encoding them in the metric names
+	DogStatsD bool
+	// Additional tags added to every metric, only supported with DogStatsD
+	Tags map[string]string
+}
+
+func NewReporter(addr string) (*Reporter, error) {
+	return NewReporterWithOptions(addr, Options{})
+}
+
+func NewReporterWithOptions(addr string, o Options) (*Reporter, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(o.Tags))
+	for k, v := range o.Tags {
+		tags = append(tags, k+":"+v)
+	}
+	sort.Strings(tags)
+	return &Reporter{
+		options: o,
+		tags:    tags,
+		mutex:   &sync.Mutex{},
+		conn:    conn,
+	}, nil
+}
+
+// NewObserver returns the observer that reports the attempts with the given location label
+func (r *Reporter) NewObserver(locationId string) middleware.Observer {
+	return &middleware.ObserverWrapper{
+		OnResponse: func(req request.Request, a request.Attempt) {
+			r.report(locationId, a)
+		},
+	}
+}
+
+// Close closes the connection to the StatsD server
+func (r *Reporter) Close() error {
+	return r.conn.Close()
+}
+
+func (r *Reporter) report(locationId string, a request.Attempt) {
+	if a == nil {
+		return
+	}
+	endpointId := ""
+	if a.GetEndpoint() != nil {
+		endpointId = a.GetEndpoint().GetId()
+	}
+	latency := int64(a.GetDuration().Seconds() * 1000)
+
+	if re := a.GetResponse(); re != nil {
+		class := fmt.Sprintf("%dxx", re.StatusCode/100)
+		if r.options.DogStatsD {
+			r.send(fmt.Sprintf("%s.requests:1|c", r.options.Prefix), "location:"+locationId, "endpoint:"+endpointId, "status_class:"+class)
+		} else {
+			r.send(fmt.Sprintf("%s.%s.%s.requests.%s:1|c", r.options.Prefix, sanitize(locationId), sanitize(endpointId), class))
+		}
+	} else if a.GetError() != nil {
+		if r.options.DogStatsD {
+			r.send(fmt.Sprintf("%s.errors:1|c", r.options.Prefix), "location:"+locationId, "endpoint:"+endpointId)
+		} else {
+			r.send(fmt.Sprintf("%s.%s.%s.errors:1|c", r.options.Prefix, sanitize(locationId), sanitize(endpointId)))
+		}
+	}
+
+	if r.options.DogStatsD {
+		r.send(fmt.Sprintf("%s.latency:%d|ms", r.options.Prefix, latency), "location:"+locationId, "endpoint:"+endpointId)
+	} else {
+		r.send(fmt.Sprintf("%s.%s.%s.latency:%d|ms", r.options.Prefix, sanitize(locationId), sanitize(endpointId), latency))
+	}
+}
+
+// send writes the metric in a separate datagram, errors are ignored as StatsD delivery is best effort anyway
+func (r *Reporter) send(metric string, tags ...string) {
+	if r.options.DogStatsD {
+		tags = append(tags, r.tags...)
+		metric = metric + "|#" + strings.Join(tags, ",")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.conn.Write([]byte(metric))
+}
+
+// sanitize replaces the characters that have special meaning in StatsD metric names
+func sanitize(v string) string {
+	return strings.Trim(sanitizer.ReplaceAllString(v, "_"), "_")
+}
+
+var sanitizer = regexp.MustCompile(`[^a-zA-Z0-9_\-]+`)
+
+func parseOptions(o Options) (Options, error) {
+	if o.Prefix == "" {
+		o.Prefix = DefaultPrefix
+	}
+	if len(o.Tags) != 0 && !o.DogStatsD {
+		return o, fmt.Errorf("Tags are only supported with DogStatsD")
+	}
+	return o, nil
+}
+
+const DefaultPrefix = "vulcan"
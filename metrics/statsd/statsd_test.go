@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestStatsd(t *testing.T) { TestingT(t) }
+
+type StatsdSuite struct {
+	conn *net.UDPConn
+}
+
+var _ = Suite(&StatsdSuite{})
+
+func (s *StatsdSuite) SetUpTest(c *C) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	c.Assert(err, IsNil)
+	s.conn = conn
+}
+
+func (s *StatsdSuite) TearDownTest(c *C) {
+	s.conn.Close()
+}
+
+func (s *StatsdSuite) TestStatsd(c *C) {
+	r, err := NewReporter(s.conn.LocalAddr().String())
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	o := r.NewObserver("loc1")
+	o.ObserveResponse(nil, &request.BaseAttempt{
+		Endpoint: endpoint.MustParseUrl("http://a:80"),
+		Response: &http.Response{StatusCode: 200},
+		Duration: 12 * time.Millisecond,
+	})
+	c.Assert(s.read(c), Equals, "vulcan.loc1.http_a_80.requests.2xx:1|c")
+	c.Assert(s.read(c), Equals, "vulcan.loc1.http_a_80.latency:12|ms")
+
+	o.ObserveResponse(nil, &request.BaseAttempt{
+		Endpoint: endpoint.MustParseUrl("http://a:80"),
+		Error:    fmt.Errorf("connection refused"),
+	})
+	c.Assert(s.read(c), Equals, "vulcan.loc1.http_a_80.errors:1|c")
+	c.Assert(s.read(c), Equals, "vulcan.loc1.http_a_80.latency:0|ms")
+}
+
+func (s *StatsdSuite) TestDogStatsd(c *C) {
+	r, err := NewReporterWithOptions(s.conn.LocalAddr().String(), Options{
+		Prefix:    "proxy",
+		DogStatsD: true,
+		Tags:      map[string]string{"env": "prod", "dc": "us"},
+	})
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	r.NewObserver("loc1").ObserveResponse(nil, &request.BaseAttempt{
+		Endpoint: endpoint.MustParseUrl("http://a:80"),
+		Response: &http.Response{StatusCode: 503},
+		Duration: 5 * time.Millisecond,
+	})
+	c.Assert(s.read(c), Equals, "proxy.requests:1|c|#location:loc1,endpoint:http://a:80,status_class:5xx,dc:us,env:prod")
+	c.Assert(s.read(c), Equals, "proxy.latency:5|ms|#location:loc1,endpoint:http://a:80,dc:us,env:prod")
+}
+
+func (s *StatsdSuite) TestBadParams(c *C) {
+	_, err := NewReporterWithOptions(s.conn.LocalAddr().String(), Options{Tags: map[string]string{"env": "prod"}})
+	c.Assert(err, NotNil)
+}
+
+func (s *StatsdSuite) read(c *C) string {
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := s.conn.Read(buf)
+	c.Assert(err, IsNil)
+	return string(buf[:n])
+}
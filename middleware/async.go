@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailgun/log"
+	. "github.com/mailgun/vulcan/request"
+)
+
+// AsyncObserver runs the inner observer in a separate goroutine, so a slow or panicking observer
+// does not affect the request path. Events are passed through a bounded queue, events that do not
+// fit are dropped and counted. Note that the request may be changed by the proxy
+// while the observer processes it, so observers should only read the data they need.
+type AsyncObserver struct {
+	observer Observer
+	events   chan observerEvent
+	dropped  int64
+	panics   int64
+	mutex    *sync.Mutex
+	closed   bool
+	done     chan struct{}
+}
+
+type AsyncOptions struct {
+	// Maximum amount of events waiting to be processed by the observer
+	QueueSize int
+}
+
+const DefaultAsyncQueueSize = 1024
+
+type observerEvent struct {
+	request Request
+	attempt Attempt
+	// Tells between ObserveRequest and ObserveResponse events
+	isResponse bool
+}
+
+func NewAsyncObserver(o Observer) (*AsyncObserver, error) {
+	return NewAsyncObserverWithOptions(o, AsyncOptions{})
+}
+
+func NewAsyncObserverWithOptions(o Observer, options AsyncOptions) (*AsyncObserver, error) {
+	if o == nil {
+		return nil, fmt.Errorf("Provide observer")
+	}
+	if options.QueueSize < 0 {
+		return nil, fmt.Errorf("Queue size can not be negative")
+	}
+	if options.QueueSize == 0 {
+		options.QueueSize = DefaultAsyncQueueSize
+	}
+	a := &AsyncObserver{
+		observer: o,
+		events:   make(chan observerEvent, options.QueueSize),
+		mutex:    &sync.Mutex{},
+		done:     make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+func (a *AsyncObserver) ObserveRequest(r Request) {
+	a.push(observerEvent{request: r})
+}
+
+func (a *AsyncObserver) ObserveResponse(r Request, at Attempt) {
+	a.push(observerEvent{request: r, attempt: at, isResponse: true})
+}
+
+// GetDropped returns the amount of events dropped because the queue was full
+func (a *AsyncObserver) GetDropped() int64 {
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// GetPanics returns the amount of events the observer has panicked on
+func (a *AsyncObserver) GetPanics() int64 {
+	return atomic.LoadInt64(&a.panics)
+}
+
+// Close stops accepting the events and waits until the queued events are processed
+func (a *AsyncObserver) Close() {
+	a.mutex.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.events)
+	}
+	a.mutex.Unlock()
+	<-a.done
+}
+
+func (a *AsyncObserver) push(e observerEvent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.closed {
+		atomic.AddInt64(&a.dropped, 1)
+		return
+	}
+	select {
+	case a.events <- e:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+func (a *AsyncObserver) run() {
+	defer close(a.done)
+	for e := range a.events {
+		a.observe(e)
+	}
+}
+
+func (a *AsyncObserver) observe(e observerEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&a.panics, 1)
+			log.Errorf("Observer panicked on %s: %v\n%s", e.request, r, debug.Stack())
+		}
+	}()
+	if e.isResponse {
+		a.observer.ObserveResponse(e.request, e.attempt)
+	} else {
+		a.observer.ObserveRequest(e.request)
+	}
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"time"
+
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type AsyncSuite struct {
+}
+
+var _ = Suite(&AsyncSuite{})
+
+func (s *AsyncSuite) TestObserve(c *C) {
+	r := &Recorder{}
+	a, err := NewAsyncObserver(r)
+	c.Assert(err, IsNil)
+
+	req := makeRequest()
+	a.ObserveRequest(req)
+	a.ObserveResponse(req, &BaseAttempt{})
+	a.Close()
+
+	c.Assert(len(r.ProcessedRequests), Equals, 1)
+	c.Assert(len(r.ProcessedResponses), Equals, 1)
+	c.Assert(a.GetDropped(), Equals, int64(0))
+}
+
+// Slow observer does not block the caller, events over the queue size are dropped
+func (s *AsyncSuite) TestDropsWhenFull(c *C) {
+	unblock := make(chan bool)
+	a, err := NewAsyncObserverWithOptions(&ObserverWrapper{
+		OnRequest: func(r Request) {
+			<-unblock
+		},
+	}, AsyncOptions{QueueSize: 1})
+	c.Assert(err, IsNil)
+
+	req := makeRequest()
+	// Wait until the first event is taken by the observer
+	a.ObserveRequest(req)
+	for len(a.events) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	a.ObserveRequest(req)
+	a.ObserveRequest(req)
+	a.ObserveRequest(req)
+	c.Assert(a.GetDropped(), Equals, int64(2))
+
+	close(unblock)
+	a.Close()
+
+	// Events after close are dropped as well
+	a.ObserveRequest(req)
+	c.Assert(a.GetDropped(), Equals, int64(3))
+}
+
+func (s *AsyncSuite) TestRecoversPanics(c *C) {
+	r := &Recorder{}
+	calls := 0
+	a, err := NewAsyncObserver(&ObserverWrapper{
+		OnRequest: func(req Request) {
+			calls += 1
+			if calls == 1 {
+				panic("oops")
+			}
+			r.ObserveRequest(req)
+		},
+	})
+	c.Assert(err, IsNil)
+
+	a.ObserveRequest(makeRequest())
+	a.ObserveRequest(makeRequest())
+	a.Close()
+
+	c.Assert(a.GetPanics(), Equals, int64(1))
+	c.Assert(len(r.ProcessedRequests), Equals, 1)
+}
+
+func (s *AsyncSuite) TestBadParams(c *C) {
+	_, err := NewAsyncObserver(nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewAsyncObserverWithOptions(&Recorder{}, AsyncOptions{QueueSize: -1})
+	c.Assert(err, NotNil)
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"fmt"
 	. "github.com/mailgun/vulcan/request"
+	"net/http"
 	"sort"
 	"sync"
 )
@@ -23,6 +24,21 @@ func (c *MiddlewareChain) Add(id string, priority int, m Middleware) error {
 	return c.chain.append(id, priority, m)
 }
 
+// InsertBefore adds the middleware right before the middleware with the given id, taking its priority
+func (c *MiddlewareChain) InsertBefore(beforeId, id string, m Middleware) error {
+	return c.chain.insert(beforeId, id, false, m)
+}
+
+// InsertAfter adds the middleware right after the middleware with the given id, taking its priority
+func (c *MiddlewareChain) InsertAfter(afterId, id string, m Middleware) error {
+	return c.chain.insert(afterId, id, true, m)
+}
+
+// List returns ids of the middlewares in the order of execution
+func (c *MiddlewareChain) List() []string {
+	return c.chain.list()
+}
+
 func (c *MiddlewareChain) Upsert(id string, priority int, m Middleware) {
 	c.chain.upsert(id, priority, m)
 }
@@ -49,6 +65,20 @@ func (c *MiddlewareChain) GetIter() *MiddlewareIter {
 	}
 }
 
+// ModifyResponse lets the middlewares that implement ResponseModifier rewrite the response,
+// they are called in the reverse order, the same way the responses are processed.
+func (c *MiddlewareChain) ModifyResponse(r Request, re *http.Response) error {
+	it := c.chain.getReverseIter()
+	for v := it.next(); v != nil; v = it.next() {
+		if m, ok := v.(ResponseModifier); ok {
+			if err := m.ModifyResponse(r, re); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type MiddlewareIter struct {
 	iter *iter
 }
@@ -165,6 +195,41 @@ func (c *chain) append(id string, priority int, cb interface{}) error {
 	return nil
 }
 
+// insert puts the callback next to the target callback. It takes the priority of the target,
+// so the stable sort keeps it in place.
+func (c *chain) insert(targetId, id string, after bool, cb interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if p, _ := c.find(id); p != nil {
+		return fmt.Errorf("Callback with id: %s already exists", id)
+	}
+	target, i := c.find(targetId)
+	if target == nil {
+		return fmt.Errorf("Callback with id: %s not found", targetId)
+	}
+	if after {
+		i += 1
+	}
+	callbacks := make([]*callback, 0, len(c.callbacks)+1)
+	callbacks = append(callbacks, c.callbacks[:i]...)
+	callbacks = append(callbacks, &callback{id, target.priority, cb})
+	callbacks = append(callbacks, c.callbacks[i:]...)
+	c.callbacks = callbacks
+	return nil
+}
+
+func (c *chain) list() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	ids := make([]string, len(c.callbacks))
+	for i, cb := range c.callbacks {
+		ids[i] = cb.id
+	}
+	return ids
+}
+
 func (c *chain) find(id string) (*callback, int) {
 	for i, c := range c.callbacks {
 		if c.id == id {
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"fmt"
 	"github.com/mailgun/vulcan/netutils"
 	. "github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
@@ -380,3 +381,69 @@ func makeRequest() Request {
 		},
 	}
 }
+
+func (s *ChainSuite) TestModifyResponseOrder(c *C) {
+	chain := NewMiddlewareChain()
+
+	var order []string
+	modifier := func(id string) *MiddlewareWrapper {
+		return &MiddlewareWrapper{
+			OnModifyResponse: func(r Request, re *http.Response) error {
+				order = append(order, id)
+				return nil
+			},
+		}
+	}
+	chain.Add("a", 0, modifier("a"))
+	chain.Add("b", 1, modifier("b"))
+	// Middlewares that don't modify responses are skipped
+	chain.Add("c", 2, &Recorder{})
+
+	re := netutils.NewTextResponse(nil, http.StatusOK, "hi")
+	c.Assert(chain.ModifyResponse(nil, re), IsNil)
+	c.Assert(order, DeepEquals, []string{"b", "a"})
+}
+
+func (s *ChainSuite) TestModifyResponseError(c *C) {
+	chain := NewMiddlewareChain()
+	chain.Add("a", 0, &MiddlewareWrapper{
+		OnModifyResponse: func(r Request, re *http.Response) error {
+			return fmt.Errorf("oops")
+		},
+	})
+	c.Assert(chain.ModifyResponse(nil, netutils.NewTextResponse(nil, http.StatusOK, "hi")), NotNil)
+}
+
+func (s *ChainSuite) TestMiddlewareInsertBeforeAfter(c *C) {
+	chain := NewMiddlewareChain()
+
+	c.Assert(chain.Add("ratelimit", 0, &Recorder{}), IsNil)
+	c.Assert(chain.Add("log", 1, &Recorder{}), IsNil)
+
+	c.Assert(chain.InsertBefore("ratelimit", "auth", &Recorder{}), IsNil)
+	c.Assert(chain.InsertAfter("ratelimit", "cache", &Recorder{}), IsNil)
+	c.Assert(chain.InsertAfter("log", "last", &Recorder{}), IsNil)
+	c.Assert(chain.List(), DeepEquals, []string{"auth", "ratelimit", "cache", "log", "last"})
+
+	// Middlewares added later with the same priority go after the inserted ones
+	c.Assert(chain.Add("quota", 0, &Recorder{}), IsNil)
+	c.Assert(chain.List(), DeepEquals, []string{"auth", "ratelimit", "cache", "quota", "log", "last"})
+
+	// Order is kept when other middlewares are updated
+	c.Assert(chain.Update("log", 1, &Recorder{}), IsNil)
+	c.Assert(chain.List(), DeepEquals, []string{"auth", "ratelimit", "cache", "quota", "log", "last"})
+
+	// Iteration follows the same order
+	it := chain.GetIter()
+	c.Assert(it.Next(), Equals, chain.Get("auth"))
+	c.Assert(it.Next(), Equals, chain.Get("ratelimit"))
+}
+
+func (s *ChainSuite) TestMiddlewareInsertFailures(c *C) {
+	chain := NewMiddlewareChain()
+	c.Assert(chain.Add("a", 0, &Recorder{}), IsNil)
+
+	c.Assert(chain.InsertBefore("missing", "b", &Recorder{}), NotNil)
+	c.Assert(chain.InsertAfter("a", "a", &Recorder{}), NotNil)
+	c.Assert(chain.List(), DeepEquals, []string{"a"})
+}
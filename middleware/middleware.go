@@ -20,6 +20,15 @@ type Middleware interface {
 	ProcessResponse(r Request, a Attempt)
 }
 
+// ResponseModifier is an optional interface for middlewares that rewrite the upstream response,
+// e.g. status, headers or body, before the proxy writes it back to the client.
+type ResponseModifier interface {
+	// Called once with the final response of the location, after all failover attempts.
+	// It's ok to change the response in place, use netutils.SetResponseBody to replace the body.
+	// If it returns an error, the response is discarded and the error is replied to the client.
+	ModifyResponse(r Request, re *http.Response) error
+}
+
 // Unlinke middlewares, observers are not able to intercept or change any requests
 // and will be called on every request to endpoint regardless of the middlewares side effects
 type Observer interface {
@@ -32,11 +41,13 @@ type Observer interface {
 
 type ProcessRequestFn func(r Request) (*http.Response, error)
 type ProcessResponseFn func(r Request, a Attempt)
+type ModifyResponseFn func(r Request, re *http.Response) error
 
 // Wraps the functions to create a middleware compatible interface
 type MiddlewareWrapper struct {
-	OnRequest  ProcessRequestFn
-	OnResponse ProcessResponseFn
+	OnRequest        ProcessRequestFn
+	OnResponse       ProcessResponseFn
+	OnModifyResponse ModifyResponseFn
 }
 
 func (cb *MiddlewareWrapper) ProcessRequest(r Request) (*http.Response, error) {
@@ -52,6 +63,13 @@ func (cb *MiddlewareWrapper) ProcessResponse(r Request, a Attempt) {
 	}
 }
 
+func (cb *MiddlewareWrapper) ModifyResponse(r Request, re *http.Response) error {
+	if cb.OnModifyResponse != nil {
+		return cb.OnModifyResponse(r, re)
+	}
+	return nil
+}
+
 type ObserveRequestFn func(r Request)
 type ObserveResponseFn func(r Request, a Attempt)
 
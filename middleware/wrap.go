@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	. "github.com/mailgun/vulcan/request"
+)
+
+// Wrap returns the middleware that runs the inner middleware only for the requests matching the predicate.
+// Both threshold.Predicate and route.Matcher can be used, e.g.
+//
+//	Wrap(route.AND(route.PathPrefix("/api"), route.Method("POST")), limiter)
+func Wrap(predicate func(Request) bool, m Middleware) Middleware {
+	w := &conditional{predicate: predicate, middleware: m}
+	w.key = fmt.Sprintf("middleware.conditional.%p", w)
+	return w
+}
+
+type conditional struct {
+	predicate  func(Request) bool
+	middleware Middleware
+	// Key of the request user data with the decision made for the request
+	key string
+}
+
+// ProcessRequest records the decision, so the response is handled the same way even if the request
+// has been changed by other middlewares since. Every attempt is decided anew
+func (c *conditional) ProcessRequest(r Request) (*http.Response, error) {
+	matched := c.predicate(r)
+	r.SetUserData(c.key, matched)
+	if !matched {
+		return nil, nil
+	}
+	return c.middleware.ProcessRequest(r)
+}
+
+// ProcessResponse is only called for the requests processed by the inner middleware
+func (c *conditional) ProcessResponse(r Request, a Attempt) {
+	if !c.matched(r) {
+		return
+	}
+	c.middleware.ProcessResponse(r, a)
+}
+
+// ModifyResponse is only called for the requests processed by the inner middleware
+func (c *conditional) ModifyResponse(r Request, re *http.Response) error {
+	m, ok := c.middleware.(ResponseModifier)
+	if !ok || !c.matched(r) {
+		return nil
+	}
+	return m.ModifyResponse(r, re)
+}
+
+func (c *conditional) matched(r Request) bool {
+	matched, _ := r.GetUserData(c.key)
+	return matched == true
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type WrapSuite struct {
+}
+
+var _ = Suite(&WrapSuite{})
+
+func isApi(r Request) bool {
+	return strings.HasPrefix(r.GetHttpRequest().URL.Path, "/api")
+}
+
+func (s *WrapSuite) TestRunsOnMatch(c *C) {
+	r := &Recorder{}
+	m := Wrap(isApi, r)
+
+	req := makeUrlReq("http://localhost/api/users")
+	re, err := m.ProcessRequest(req)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	m.ProcessResponse(req, nil)
+
+	c.Assert(len(r.ProcessedRequests), Equals, 1)
+	c.Assert(len(r.ProcessedResponses), Equals, 1)
+}
+
+func (s *WrapSuite) TestSkipsOnMismatch(c *C) {
+	r := &Recorder{}
+	m := Wrap(isApi, r)
+
+	req := makeUrlReq("http://localhost/static/logo.png")
+	re, err := m.ProcessRequest(req)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	m.ProcessResponse(req, nil)
+
+	c.Assert(len(r.ProcessedRequests), Equals, 0)
+	c.Assert(len(r.ProcessedResponses), Equals, 0)
+}
+
+// Response is processed only if the request has been, even if the request has changed since
+func (s *WrapSuite) TestResponseFollowsRequest(c *C) {
+	r := &Recorder{}
+	m := Wrap(isApi, r)
+
+	req := makeUrlReq("http://localhost/api/users")
+	m.ProcessRequest(req)
+	req.GetHttpRequest().URL.Path = "/internal/users"
+	m.ProcessResponse(req, nil)
+	c.Assert(len(r.ProcessedResponses), Equals, 1)
+
+	req = makeUrlReq("http://localhost/static")
+	m.ProcessRequest(req)
+	req.GetHttpRequest().URL.Path = "/api/users"
+	m.ProcessResponse(req, nil)
+	c.Assert(len(r.ProcessedResponses), Equals, 1)
+}
+
+func (s *WrapSuite) TestInterceptedResponse(c *C) {
+	m := Wrap(isApi, &MiddlewareWrapper{
+		OnRequest: func(r Request) (*http.Response, error) {
+			return netutils.NewTextResponse(r.GetHttpRequest(), http.StatusForbidden, "denied"), nil
+		},
+	})
+
+	re, err := m.ProcessRequest(makeUrlReq("http://localhost/api"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+
+	re, err = m.ProcessRequest(makeUrlReq("http://localhost/"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *WrapSuite) TestModifyResponse(c *C) {
+	m := Wrap(isApi, &MiddlewareWrapper{
+		OnModifyResponse: func(r Request, re *http.Response) error {
+			re.Header.Set("X-Api", "yes")
+			return nil
+		},
+	}).(ResponseModifier)
+
+	req := makeUrlReq("http://localhost/api")
+	m.(Middleware).ProcessRequest(req)
+	re := netutils.NewTextResponse(nil, http.StatusOK, "hi")
+	c.Assert(m.ModifyResponse(req, re), IsNil)
+	c.Assert(re.Header.Get("X-Api"), Equals, "yes")
+
+	req = makeUrlReq("http://localhost/")
+	m.(Middleware).ProcessRequest(req)
+	re = netutils.NewTextResponse(nil, http.StatusOK, "hi")
+	c.Assert(m.ModifyResponse(req, re), IsNil)
+	c.Assert(re.Header.Get("X-Api"), Equals, "")
+}
+
+// Response is modified only if the request has been processed, the predicate is not evaluated again
+func (s *WrapSuite) TestModifyResponseFollowsRequest(c *C) {
+	calls := 0
+	m := Wrap(func(r Request) bool {
+		calls++
+		return isApi(r)
+	}, &MiddlewareWrapper{
+		OnModifyResponse: func(r Request, re *http.Response) error {
+			re.Header.Set("X-Api", "yes")
+			return nil
+		},
+	})
+
+	// Attempt is processed, the response is modified after the request has changed
+	req := makeUrlReq("http://localhost/api/users")
+	m.ProcessRequest(req)
+	m.ProcessResponse(req, nil)
+	req.GetHttpRequest().URL.Path = "/internal/users"
+	re := netutils.NewTextResponse(nil, http.StatusOK, "hi")
+	c.Assert(m.(ResponseModifier).ModifyResponse(req, re), IsNil)
+	c.Assert(re.Header.Get("X-Api"), Equals, "yes")
+	c.Assert(calls, Equals, 1)
+
+	// Request has not reached the middleware, e.g. it has been intercepted by the previous one
+	re = netutils.NewTextResponse(nil, http.StatusOK, "hi")
+	c.Assert(m.(ResponseModifier).ModifyResponse(makeUrlReq("http://localhost/api"), re), IsNil)
+	c.Assert(re.Header.Get("X-Api"), Equals, "")
+}
+
+func makeUrlReq(url string) Request {
+	return NewBaseRequest(&http.Request{URL: netutils.MustParseUrl(url), Header: http.Header{}}, 1, nil)
+}
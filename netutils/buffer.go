@@ -97,6 +97,9 @@ type BodyBufferOptions struct {
 	MemBufferBytes int64
 	// Max size bytes, ignored if set to value <= 0, if request exceeds the specified limit, the reader will fail.
 	MaxSizeBytes int64
+	// TempDir is the directory for the part of the body that does not fit into the memory buffer,
+	// os.TempDir() by default. The file is unlinked right away, so it's removed once the body is closed.
+	TempDir string
 }
 
 func NewBodyBuffer(input io.Reader) (MultiReader, error) {
@@ -108,6 +111,10 @@ func NewBodyBuffer(input io.Reader) (MultiReader, error) {
 }
 
 func NewBodyBufferWithOptions(input io.Reader, o BodyBufferOptions) (MultiReader, error) {
+	// Limit applies to the whole body, including the part kept in memory
+	if o.MaxSizeBytes > 0 {
+		input = &MaxReader{R: input, Max: o.MaxSizeBytes}
+	}
 	memReader := &io.LimitedReader{
 		R: input,            // Read from this reader
 		N: o.MemBufferBytes, // Maximum amount of data to read
@@ -124,19 +131,15 @@ func NewBodyBufferWithOptions(input io.Reader, o BodyBufferOptions) (MultiReader
 	// This means that we have exceeded all the memory capacity and we will start buffering the body to disk.
 	totalBytes := int64(len(buffer))
 	if memReader.N <= 0 {
-		file, err = ioutil.TempFile("", "vulcan-bodies-")
+		file, err = ioutil.TempFile(o.TempDir, "vulcan-bodies-")
 		if err != nil {
 			return nil, err
 		}
 		os.Remove(file.Name())
 
-		readSrc := input
-		if o.MaxSizeBytes > 0 {
-			readSrc = &MaxReader{R: input, Max: o.MaxSizeBytes - o.MemBufferBytes}
-		}
-
-		writtenBytes, err := io.Copy(file, readSrc)
+		writtenBytes, err := io.Copy(file, input)
 		if err != nil {
+			file.Close()
 			return nil, err
 		}
 		totalBytes += writtenBytes
@@ -179,5 +182,5 @@ type MaxSizeReachedError struct {
 }
 
 func (e *MaxSizeReachedError) Error() string {
-	return fmt.Sprintf("Maximum size %d was reached", e)
+	return fmt.Sprintf("Maximum size %d was reached", e.MaxSize)
 }
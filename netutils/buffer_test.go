@@ -112,3 +112,24 @@ func (s *BufferSuite) TestLimitExceeds(c *C) {
 	c.Assert(err, FitsTypeOf, &MaxSizeReachedError{})
 	c.Assert(bb, IsNil)
 }
+
+func (s *BufferSuite) TestLimitExceedsInMemory(c *C) {
+	r, _ := createReaderOfSize(100)
+	bb, err := NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 1024, MaxSizeBytes: 99})
+	c.Assert(err, FitsTypeOf, &MaxSizeReachedError{})
+	c.Assert(err.Error(), Equals, "Maximum size 99 was reached")
+	c.Assert(bb, IsNil)
+}
+
+func (s *BufferSuite) TestTempDir(c *C) {
+	dir := c.MkDir()
+	r, hash := createReaderOfSize(4096)
+	bb, err := NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 1024, TempDir: dir})
+	c.Assert(err, IsNil)
+	c.Assert(hashOfReader(bb), Equals, hash)
+	c.Assert(bb.Close(), IsNil)
+
+	r, _ = createReaderOfSize(4096)
+	_, err = NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 1024, TempDir: dir + "/missing"})
+	c.Assert(err, NotNil)
+}
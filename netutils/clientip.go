@@ -0,0 +1,85 @@
+package netutils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRs parses the networks in CIDR notation, single addresses are treated as /32 or /128 networks
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		n, err := ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// ParseCIDR parses the network in CIDR notation or the single address
+func ParseCIDR(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid address: %q", value)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ContainsIP tells whether any of the networks contains the address
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that has sent the request. If the request came from one of
+// the trusted proxies, the address is taken from X-Forwarded-For: the addresses are checked from right
+// to left, as appended by the proxies, and the first address that is not a trusted proxy is the client.
+// Addresses in X-Forwarded-For of the requests from the other clients can be forged and are ignored.
+func ClientIP(req *http.Request, trustedProxies []*net.IPNet) (net.IP, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Failed to parse client address: %q", req.RemoteAddr)
+	}
+	if !ContainsIP(trustedProxies, ip) {
+		return ip, nil
+	}
+	var forwarded []string
+	for _, v := range req.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		next := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if next == nil {
+			// Can't go past the malformed address, the last valid one is the best guess
+			break
+		}
+		ip = next
+		if !ContainsIP(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip, nil
+}
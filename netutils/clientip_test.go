@@ -0,0 +1,55 @@
+package netutils
+
+import (
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *NetUtilsSuite) TestParseCIDRs(c *C) {
+	networks, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1", "::1", "2001:db8::/32"})
+	c.Assert(err, IsNil)
+	c.Assert(len(networks), Equals, 4)
+	c.Assert(networks[1].String(), Equals, "192.168.1.1/32")
+	c.Assert(networks[2].String(), Equals, "::1/128")
+
+	for _, v := range []string{"10.0.0.0/33", "localhost", ""} {
+		_, err := ParseCIDRs([]string{v})
+		c.Assert(err, NotNil, Commentf("%s", v))
+	}
+}
+
+func (s *NetUtilsSuite) TestClientIP(c *C) {
+	trusted, err := ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	tcs := []struct {
+		remoteAddr string
+		forwarded  []string
+		ip         string
+	}{
+		// Not a trusted proxy, the header can be forged
+		{"1.2.3.4:5678", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"10.0.0.1:5678", nil, "10.0.0.1"},
+		{"10.0.0.1:5678", []string{"5.6.7.8"}, "5.6.7.8"},
+		// Client has prepended the forged address, the trusted proxies have appended the real ones
+		{"10.0.0.1:5678", []string{"6.6.6.6, 5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"10.0.0.1:5678", []string{"6.6.6.6", "5.6.7.8"}, "5.6.7.8"},
+		// All hops are trusted
+		{"10.0.0.1:5678", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:5678", []string{"garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"[::1]:5678", nil, "::1"},
+	}
+	for _, tc := range tcs {
+		req := &http.Request{RemoteAddr: tc.remoteAddr, Header: http.Header{}}
+		for _, v := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		ip, err := ClientIP(req, trusted)
+		c.Assert(err, IsNil)
+		c.Assert(ip.String(), Equals, tc.ip, Commentf("%v", tc))
+	}
+
+	_, err = ClientIP(&http.Request{RemoteAddr: "unknown"}, trusted)
+	c.Assert(err, NotNil)
+}
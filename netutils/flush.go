@@ -0,0 +1,102 @@
+package netutils
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FlushWriter wraps http.ResponseWriter and flushes the written data to the client,
+// either after every write or periodically. It is used to stream responses
+// (e.g. server sent events or long polling) back to the client without buffering.
+type FlushWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	mutex   *sync.Mutex
+	stopC   chan struct{}
+	wg      *sync.WaitGroup
+	// Flush interval, 0 means flush after every write
+	interval time.Duration
+}
+
+// NewFlushWriter returns writer that flushes the data on every write if the interval is 0,
+// or every interval otherwise. Writers that don't support flushing are returned as is.
+// Callers should call Stop once they are done writing to release the flushing goroutine.
+func NewFlushWriter(w http.ResponseWriter, interval time.Duration) *FlushWriter {
+	fw := &FlushWriter{
+		w:        w,
+		mutex:    &sync.Mutex{},
+		wg:       &sync.WaitGroup{},
+		interval: interval,
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fw
+	}
+	fw.flusher = flusher
+	if interval > 0 {
+		fw.stopC = make(chan struct{})
+		fw.wg.Add(1)
+		go fw.flushPeriodically(fw.stopC)
+	}
+	return fw
+}
+
+func (fw *FlushWriter) Header() http.Header {
+	return fw.w.Header()
+}
+
+func (fw *FlushWriter) WriteHeader(code int) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.w.WriteHeader(code)
+	// Send headers right away, so client knows that the response has started streaming
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+}
+
+func (fw *FlushWriter) Write(p []byte) (int, error) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if fw.flusher != nil && fw.interval <= 0 {
+		fw.flusher.Flush()
+	}
+	return n, nil
+}
+
+func (fw *FlushWriter) Flush() {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+}
+
+// Stop stops the periodic flushing and flushes the remaining data.
+func (fw *FlushWriter) Stop() {
+	if fw.stopC != nil {
+		close(fw.stopC)
+		fw.stopC = nil
+		fw.wg.Wait()
+	}
+	fw.Flush()
+}
+
+func (fw *FlushWriter) flushPeriodically(stopC chan struct{}) {
+	defer fw.wg.Done()
+	ticker := time.NewTicker(fw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fw.Flush()
+		case <-stopC:
+			return
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package netutils
+
+import (
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type FlushSuite struct{}
+
+var _ = Suite(&FlushSuite{})
+
+func (s *FlushSuite) TestFlushEveryWrite(c *C) {
+	rec := httptest.NewRecorder()
+	fw := NewFlushWriter(rec, 0)
+	defer fw.Stop()
+
+	fw.WriteHeader(200)
+	c.Assert(rec.Flushed, Equals, true)
+
+	rec.Flushed = false
+	fw.Write([]byte("hello"))
+	c.Assert(rec.Flushed, Equals, true)
+	c.Assert(rec.Body.String(), Equals, "hello")
+}
+
+func (s *FlushSuite) TestFlushPeriodically(c *C) {
+	rec := httptest.NewRecorder()
+	fw := NewFlushWriter(rec, time.Millisecond)
+	fw.Write([]byte("hello"))
+	fw.Stop()
+
+	c.Assert(rec.Flushed, Equals, true)
+	c.Assert(rec.Body.String(), Equals, "hello")
+}
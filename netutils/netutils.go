@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+
+	"github.com/mailgun/vulcan/headers"
 )
 
 // Provides update safe copy by avoiding
@@ -48,6 +50,19 @@ func RemoveHeaders(names []string, headers http.Header) {
 	}
 }
 
+// RemoveHopHeaders removes the hop-by-hop headers, both the standard ones and the ones listed in
+// the Connection header. The proxy does not support protocol upgrades, so Upgrade is always removed.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h[headers.Connection] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	RemoveHeaders(headers.HopHeaders, h)
+}
+
 func MustParseUrl(inUrl string) *url.URL {
 	u, err := ParseUrl(inUrl)
 	if err != nil {
@@ -58,19 +73,38 @@ func MustParseUrl(inUrl string) *url.URL {
 
 // Standard parse url is very generous,
 // parseUrl wrapper makes it more strict
-// and demands scheme and host to be set
+// and demands scheme and host to be set.
+// Unix socket URLs need the path instead, e.g. unix:///var/run/app.sock
 func ParseUrl(inUrl string) (*url.URL, error) {
 	parsedUrl, err := url.Parse(inUrl)
 	if err != nil {
 		return nil, err
 	}
 
+	if parsedUrl.Scheme == "unix" {
+		if parsedUrl.Path == "" {
+			return nil, fmt.Errorf("Unix socket path is missing")
+		}
+		return parsedUrl, nil
+	}
 	if parsedUrl.Host == "" || parsedUrl.Scheme == "" {
 		return nil, fmt.Errorf("Empty Url is not allowed")
 	}
 	return parsedUrl, nil
 }
 
+// RequestScheme returns "https" or "http", X-Forwarded-Proto header set by the location takes precedence,
+// so the requests that came through the TLS terminating proxy are seen as https
+func RequestScheme(req *http.Request) string {
+	if proto := req.Header.Get(headers.XForwardedProto); proto != "" {
+		return strings.ToLower(proto)
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
 type BasicAuth struct {
 	Username string
 	Password string
@@ -2,6 +2,7 @@ package netutils
 
 import (
 	. "gopkg.in/check.v1"
+	"crypto/tls"
 	"net/http"
 	"net/url"
 	"testing"
@@ -19,6 +20,7 @@ func (s *NetUtilsSuite) TestParseBadUrl(c *C) {
 		"",
 		" some random text ",
 		"http---{}{\\bad bad url",
+		"unix://app.local",
 	}
 	for _, badUrl := range badUrls {
 		_, err := ParseUrl(badUrl)
@@ -26,6 +28,18 @@ func (s *NetUtilsSuite) TestParseBadUrl(c *C) {
 	}
 }
 
+func (s *NetUtilsSuite) TestParseUnixUrl(c *C) {
+	u, err := ParseUrl("unix:///var/run/app.sock")
+	c.Assert(err, IsNil)
+	c.Assert(u.Host, Equals, "")
+	c.Assert(u.Path, Equals, "/var/run/app.sock")
+
+	u, err = ParseUrl("unix://app.local/var/run/app.sock")
+	c.Assert(err, IsNil)
+	c.Assert(u.Host, Equals, "app.local")
+	c.Assert(u.Path, Equals, "/var/run/app.sock")
+}
+
 //Just to make sure we don't panic, return err and not
 //username and pass and cover the function
 func (s *NetUtilsSuite) TestParseBadHeaders(c *C) {
@@ -130,3 +144,28 @@ func (s *NetUtilsSuite) TestRemoveHeaders(c *C) {
 	c.Assert(source.Get("a"), Equals, "")
 	c.Assert(source.Get("c"), Equals, "d")
 }
+
+func (s *NetUtilsSuite) TestRequestScheme(c *C) {
+	req := &http.Request{Header: http.Header{}}
+	c.Assert(RequestScheme(req), Equals, "http")
+
+	req.TLS = &tls.ConnectionState{}
+	c.Assert(RequestScheme(req), Equals, "https")
+
+	req.TLS = nil
+	req.Header.Set("X-Forwarded-Proto", "HTTPS")
+	c.Assert(RequestScheme(req), Equals, "https")
+}
+
+func (s *NetUtilsSuite) TestRemoveHopHeaders(c *C) {
+	h := make(http.Header)
+	h.Set("Connection", "X-Secret, keep-alive")
+	h.Set("X-Secret", "s")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Proxy-Connection", "keep-alive")
+	h.Set("Trailer", "X-Checksum")
+	h.Set("Upgrade", "websocket")
+	h.Set("Content-Length", "10")
+	RemoveHopHeaders(h)
+	c.Assert(h, DeepEquals, http.Header{"Content-Length": []string{"10"}})
+}
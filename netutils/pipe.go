@@ -0,0 +1,65 @@
+package netutils
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// BufferedConn is the connection some data of which has already been read, e.g. peeked to route it.
+// Reads are served from the Reader that should return the read data first and then read from the connection
+type BufferedConn struct {
+	net.Conn
+	Reader io.Reader
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// CloseWrite closes the write half of the connection if it supports that
+func (c *BufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies the data between the connections both ways until both sides are done and returns the number
+// of bytes copied from a to b and from b to a. Once one side has sent everything, the write half of the other
+// connection is closed, if it supports that, so the peer sees EOF and can still respond. Copy errors abort both ways.
+// Connections are not closed, it's up to the caller.
+func Pipe(a, b net.Conn) (int64, int64) {
+	var aToB, bToA int64
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aToB = copyHalf(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		bToA = copyHalf(a, b)
+	}()
+	wg.Wait()
+	return aToB, bToA
+}
+
+func copyHalf(dst, src net.Conn) int64 {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return n
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
@@ -35,3 +35,17 @@ func NewJsonResponse(request *http.Request, statusCode int, message interface{})
 	}
 	return NewHttpResponse(request, statusCode, bytes, "application/json")
 }
+
+// SetResponseBody replaces the body of the response and updates the content length
+func SetResponseBody(re *http.Response, body []byte) {
+	if re.Body != nil {
+		re.Body.Close()
+	}
+	re.Body = ioutil.NopCloser(bytes.NewReader(body))
+	re.ContentLength = int64(len(body))
+	re.TransferEncoding = nil
+	if re.Header == nil {
+		re.Header = make(http.Header)
+	}
+	re.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+}
@@ -0,0 +1,63 @@
+package netutils
+
+import (
+	"fmt"
+	"io"
+)
+
+// streamingBody passes the body through as it is read without buffering it.
+// It can be rewound only until the first read, so the request can fail over
+// to the next endpoint only if the body has not been sent yet.
+type streamingBody struct {
+	r      io.Reader
+	length int64
+	read   bool
+}
+
+// NewStreamingBody returns the reader of the body that is not buffered, length is the Content-Length
+// of the request or -1 if unknown. Reads fail with MaxSizeReachedError once the body exceeds maxSizeBytes,
+// the limit is ignored if set to value <= 0.
+func NewStreamingBody(input io.Reader, length int64, maxSizeBytes int64) MultiReader {
+	if input == nil {
+		input = eofReader{}
+	}
+	if maxSizeBytes > 0 {
+		input = &MaxReader{R: input, Max: maxSizeBytes}
+	}
+	return &streamingBody{r: input, length: length}
+}
+
+func (s *streamingBody) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.read = true
+	}
+	return n, err
+}
+
+// Seek supports rewinding to the start only and fails once the body has been read
+func (s *streamingBody) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != 0 {
+		return 0, fmt.Errorf("streamingBody: unsupported seek")
+	}
+	if s.read {
+		return 0, fmt.Errorf("streamingBody: body has been read and can not be replayed")
+	}
+	return 0, nil
+}
+
+// TotalSize returns the length of the body, -1 if it's not known in advance, e.g. for chunked requests
+func (s *streamingBody) TotalSize() (int64, error) {
+	return s.length, nil
+}
+
+// Close is a no-op, the body belongs to the http server that closes it once the request is served
+func (s *streamingBody) Close() error {
+	return nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,44 @@
+package netutils
+
+import (
+	"io/ioutil"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type StreamSuite struct{}
+
+var _ = Suite(&StreamSuite{})
+
+func (s *StreamSuite) TestStream(c *C) {
+	b := NewStreamingBody(strings.NewReader("hello"), 5, 0)
+	size, err := b.TotalSize()
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(5))
+
+	// Rewinding is fine until the body is read
+	_, err = b.Seek(0, 0)
+	c.Assert(err, IsNil)
+
+	out, err := ioutil.ReadAll(b)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "hello")
+
+	_, err = b.Seek(0, 0)
+	c.Assert(err, NotNil)
+	c.Assert(b.Close(), IsNil)
+}
+
+func (s *StreamSuite) TestStreamLimit(c *C) {
+	b := NewStreamingBody(strings.NewReader("hello"), -1, 4)
+	_, err := ioutil.ReadAll(b)
+	c.Assert(err, FitsTypeOf, &MaxSizeReachedError{})
+}
+
+func (s *StreamSuite) TestStreamNilBody(c *C) {
+	b := NewStreamingBody(nil, 0, 0)
+	out, err := ioutil.ReadAll(b)
+	c.Assert(err, IsNil)
+	c.Assert(len(out), Equals, 0)
+}
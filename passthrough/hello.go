@@ -0,0 +1,50 @@
+package passthrough
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// PeekClientHello reads the TLS ClientHello from the reader and returns it along with the reader
+// that replays the read data before reading further, so the stream can be forwarded as is
+func PeekClientHello(r io.Reader) (*tls.ClientHelloInfo, io.Reader, error) {
+	peeked := &bytes.Buffer{}
+	hello, err := readClientHello(io.TeeReader(r, peeked))
+	return hello, io.MultiReader(peeked, r), err
+}
+
+// readClientHello lets the TLS server parse the hello and stops the handshake right after
+func readClientHello(r io.Reader) (*tls.ClientHelloInfo, error) {
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{r}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, fmt.Errorf("Failed to read TLS ClientHello: %s", err)
+	}
+	return hello, nil
+}
+
+var errHelloRead = fmt.Errorf("ClientHello is read")
+
+// readOnlyConn feeds the data to the TLS server, nothing is sent back
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
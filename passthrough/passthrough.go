@@ -0,0 +1,188 @@
+// TLS passthrough proxy that routes the connections by the server name without terminating TLS
+package passthrough
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/location/tcploc"
+	"github.com/mailgun/vulcan/netutils"
+)
+
+// Proxy peeks at the server name, see SNI, of the TLS ClientHello and forwards the raw TLS stream to the endpoints
+// of the load balancer routed for the name. The endpoints terminate TLS themselves, e.g. the ones that authenticate
+// the clients with the certificates:
+//
+//	lb, _ := roundrobin.NewRoundRobin()
+//	lb.AddEndpoint(endpoint.MustParseUrl("tcp://10.0.0.1:443"))
+//	p, _ := passthrough.NewProxy()
+//	p.SetRoute("payments.example.com", lb)
+//	l, _ := net.Listen("tcp", ":443")
+//	p.Serve(l)
+//
+// Every route is the tcploc.TcpLocation the connections are forwarded by, the load balancers see each connection
+// as the CONNECT request to the server name, so the balancers that look at the client address, e.g. consistent
+// hashing, work as usual.
+type Proxy struct {
+	options Options
+	mutex   *sync.RWMutex
+	routes  map[string]*tcploc.TcpLocation
+}
+
+type Timeouts struct {
+	// Time to wait for the ClientHello, DefaultClientHelloTimeout by default
+	ClientHello time.Duration
+	// Endpoint connect timeout, DefaultDialTimeout by default
+	Dial time.Duration
+}
+
+type Options struct {
+	Timeouts Timeouts
+	// Endpoints to try before the connection is given up, DefaultMaxAttempts by default
+	MaxAttempts int
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultClientHelloTimeout = 10 * time.Second
+	DefaultDialTimeout        = 10 * time.Second
+	DefaultMaxAttempts        = 2
+)
+
+func NewProxy() (*Proxy, error) {
+	return NewProxyWithOptions(Options{})
+}
+
+func NewProxyWithOptions(o Options) (*Proxy, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{
+		options: o,
+		mutex:   &sync.RWMutex{},
+		routes:  make(map[string]*tcploc.TcpLocation),
+	}, nil
+}
+
+func (p *Proxy) GetOptions() Options {
+	return p.options
+}
+
+// SetRoute routes the connections for the server name to the load balancer. Wildcard names match one label,
+// e.g. *.example.com matches a.example.com, and the empty name matches the connections that have not matched
+// any other route, including the clients that don't send the name
+func (p *Proxy) SetRoute(serverName string, lb loadbalance.LoadBalancer) error {
+	name := strings.ToLower(serverName)
+	l, err := tcploc.NewLocationWithOptions(name, lb, tcploc.Options{
+		Timeouts:     tcploc.Timeouts{Dial: p.options.Timeouts.Dial},
+		MaxAttempts:  p.options.MaxAttempts,
+		TimeProvider: p.options.TimeProvider,
+	})
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.routes[name] = l
+	return nil
+}
+
+// GetRoute returns the location of the server name route, e.g. to get its stats, nil if there is none
+func (p *Proxy) GetRoute(serverName string) *tcploc.TcpLocation {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.routes[strings.ToLower(serverName)]
+}
+
+func (p *Proxy) RemoveRoute(serverName string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	name := strings.ToLower(serverName)
+	if _, ok := p.routes[name]; !ok {
+		return fmt.Errorf("Route %q not found", serverName)
+	}
+	delete(p.routes, name)
+	return nil
+}
+
+// Serve accepts the connections on the listener until it's closed
+func (p *Proxy) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warningf("Failed to accept connection: %s", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn forwards the connection to the endpoint and closes it once either side is done
+func (p *Proxy) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(p.options.Timeouts.ClientHello))
+	hello, reader, err := PeekClientHello(conn)
+	if err != nil {
+		log.Infof("%s from %s, closing", err, conn.RemoteAddr())
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	l := p.route(hello.ServerName)
+	if l == nil {
+		log.Infof("No route for %q from %s, closing", hello.ServerName, conn.RemoteAddr())
+		return
+	}
+	l.ForwardConn(&netutils.BufferedConn{Conn: conn, Reader: reader}, hello.ServerName)
+}
+
+// route returns the location for the server name, nil if there is none
+func (p *Proxy) route(serverName string) *tcploc.TcpLocation {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	name := strings.ToLower(serverName)
+	if lb, ok := p.routes[name]; ok {
+		return lb
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if lb, ok := p.routes["*"+name[i:]]; ok {
+			return lb
+		}
+	}
+	return p.routes[""]
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Timeouts.ClientHello < 0 || o.Timeouts.Dial < 0 {
+		return o, fmt.Errorf("Timeouts can not be negative")
+	}
+	if o.Timeouts.ClientHello == 0 {
+		o.Timeouts.ClientHello = DefaultClientHelloTimeout
+	}
+	if o.Timeouts.Dial == 0 {
+		o.Timeouts.Dial = DefaultDialTimeout
+	}
+	if o.MaxAttempts < 0 {
+		return o, fmt.Errorf("Max attempts can not be negative")
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = DefaultMaxAttempts
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
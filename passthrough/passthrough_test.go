@@ -0,0 +1,213 @@
+package passthrough
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "gopkg.in/check.v1"
+)
+
+func TestPassthrough(t *testing.T) { TestingT(t) }
+
+type PassthroughSuite struct{}
+
+var _ = Suite(&PassthroughSuite{})
+
+func (s *PassthroughSuite) TestRoutesByServerName(c *C) {
+	a, b, d := newBackend("a"), newBackend("b"), newBackend("default")
+	defer a.Close()
+	defer b.Close()
+	defer d.Close()
+
+	p, err := NewProxy()
+	c.Assert(err, IsNil)
+	c.Assert(p.SetRoute("a.example.com", newRoundRobin(c, a.URL)), IsNil)
+	c.Assert(p.SetRoute("*.b.example.com", newRoundRobin(c, b.URL)), IsNil)
+	c.Assert(p.SetRoute("", newRoundRobin(c, d.URL)), IsNil)
+	addr := serve(c, p)
+
+	tcs := []struct {
+		serverName string
+		expected   string
+	}{
+		{"a.example.com", "a"},
+		{"A.Example.Com", "a"},
+		{"x.b.example.com", "b"},
+		// Wildcard matches one label only
+		{"y.x.b.example.com", "default"},
+		{"b.example.com", "default"},
+		{"unknown.com", "default"},
+	}
+	for _, tc := range tcs {
+		c.Assert(get(c, addr, tc.serverName), Equals, tc.expected, Commentf("%s", tc.serverName))
+	}
+
+	// Connections are counted by the location of the route
+	c.Assert(p.GetRoute("A.example.com").GetStats().Connections, Equals, int64(2))
+
+	c.Assert(p.RemoveRoute("a.example.com"), IsNil)
+	c.Assert(p.GetRoute("a.example.com"), IsNil)
+	c.Assert(get(c, addr, "a.example.com"), Equals, "default")
+	c.Assert(p.RemoveRoute("a.example.com"), NotNil)
+}
+
+// Backend terminates TLS, so the client sees its certificate
+func (s *PassthroughSuite) TestDoesNotTerminateTLS(c *C) {
+	a := newBackend("a")
+	defer a.Close()
+
+	p, err := NewProxy()
+	c.Assert(err, IsNil)
+	p.SetRoute("a.example.com", newRoundRobin(c, a.URL))
+	addr := serve(c, p)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(conn.ConnectionState().PeerCertificates[0].Equal(a.Certificate()), Equals, true)
+}
+
+func (s *PassthroughSuite) TestNoRoute(c *C) {
+	a := newBackend("a")
+	defer a.Close()
+
+	p, err := NewProxy()
+	c.Assert(err, IsNil)
+	p.SetRoute("a.example.com", newRoundRobin(c, a.URL))
+	addr := serve(c, p)
+
+	_, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "b.example.com", InsecureSkipVerify: true})
+	c.Assert(err, NotNil)
+}
+
+func (s *PassthroughSuite) TestFailover(c *C) {
+	a := newBackend("a")
+	defer a.Close()
+
+	// Nothing listens on the closed listener's port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	dead := "https://" + l.Addr().String()
+	l.Close()
+
+	p, err := NewProxy()
+	c.Assert(err, IsNil)
+	p.SetRoute("a.example.com", newRoundRobin(c, dead, a.URL))
+	addr := serve(c, p)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(get(c, addr, "a.example.com"), Equals, "a")
+	}
+}
+
+func (s *PassthroughSuite) TestClientHelloTimeout(c *C) {
+	p, err := NewProxyWithOptions(Options{Timeouts: Timeouts{ClientHello: 10 * time.Millisecond}})
+	c.Assert(err, IsNil)
+	addr := serve(c, p)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *PassthroughSuite) TestPeekClientHello(c *C) {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "a.example.com"}).Handshake()
+
+	hello, r, err := PeekClientHello(server)
+	c.Assert(err, IsNil)
+	c.Assert(hello.ServerName, Equals, "a.example.com")
+
+	// The reader replays the hello so the real server can handshake
+	srv := tls.Server(&replayConn{Conn: server, r: r}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			c.Assert(h.ServerName, Equals, "a.example.com")
+			return nil, errHelloRead
+		},
+	})
+	c.Assert(srv.Handshake(), NotNil)
+	client.Close()
+}
+
+func (s *PassthroughSuite) TestPeekNotTLS(c *C) {
+	data := "GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"
+	_, r, err := PeekClientHello(bytes.NewBufferString(data))
+	c.Assert(err, NotNil)
+	out, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, data)
+}
+
+func (s *PassthroughSuite) TestBadParams(c *C) {
+	_, err := NewProxyWithOptions(Options{Timeouts: Timeouts{Dial: -1}})
+	c.Assert(err, NotNil)
+	_, err = NewProxyWithOptions(Options{MaxAttempts: -1})
+	c.Assert(err, NotNil)
+
+	p, err := NewProxy()
+	c.Assert(err, IsNil)
+	c.Assert(p.SetRoute("a.example.com", nil), NotNil)
+}
+
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func newBackend(body string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+func newRoundRobin(c *C, urls ...string) *roundrobin.RoundRobin {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	for _, u := range urls {
+		c.Assert(rr.AddEndpoint(endpoint.MustParseUrl(u)), IsNil)
+	}
+	return rr
+}
+
+// serve starts the proxy on the local port and returns its address
+func serve(c *C, p *Proxy) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go p.Serve(l)
+	c.Logf("Proxy listens on %s", l.Addr())
+	return l.Addr().String()
+}
+
+// get requests the server name through the proxy and returns the response body
+func get(c *C, addr, serverName string) string {
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	re, err := client.Get("https://" + serverName + "/")
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(body)
+}
@@ -2,13 +2,20 @@
 package vulcan
 
 import (
+	"crypto/rand"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/mailgun/log"
 	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/location"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
 	"github.com/mailgun/vulcan/route"
@@ -19,17 +26,66 @@ type Proxy struct {
 	router route.Router
 	// Options like ErrorFormatter
 	options Options
+	// Parsed TrustedCIDRs
+	trustedProxies []*net.IPNet
 	// Counter that is used to provide unique identifiers for requests
 	lastRequestId int64
+	// Mutex protects the draining state below
+	mutex *sync.Mutex
+	// Number of requests currently being processed by the proxy
+	inFlight int64
+	// Set once Close has been called, proxy rejects new requests from now on
+	closed bool
+	// Closed once the proxy is closed and all in-flight requests have completed
+	drainedC chan struct{}
 }
 
 type Options struct {
 	// Takes a status code and formats it into proxy response
 	ErrorFormatter errors.Formatter
+	// Called when router, middleware or balancer panics while serving the request, optional.
+	// Proxy recovers from the panic and replies with 500 Internal Server Error regardless.
+	PanicHandler PanicHandler
+	// Generates globally unique request ids, e.g. UniqueRequestId, optional. The id is sent to the endpoints
+	// and echoed to the client in X-Request-Id header, and is included in the error responses.
+	RequestIdFn RequestIdFn
+	// Addresses or networks of the proxies in front of vulcan, e.g. "10.0.0.0/8". Request.GetClientIP
+	// takes the client address from X-Forwarded-For of their requests, see netutils.ClientIP
+	TrustedCIDRs []string
+}
+
+// PanicHandler is called with the recovered value and the stack trace of the panicked goroutine
+type PanicHandler func(r *http.Request, recovered interface{}, stack []byte)
+
+// RequestIdFn returns the id of the request accepted by the proxy
+type RequestIdFn func(r *http.Request) string
+
+// UniqueRequestId generates random UUID (version 4) for every request
+func UniqueRequestId(r *http.Request) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
 // Accepts requests, round trips it to the endpoint, and writes back the response.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.options.RequestIdFn != nil {
+		// Request headers are copied to every attempt, so the endpoints get the id as well
+		r.Header.Set(headers.XRequestId, p.options.RequestIdFn(r))
+	}
+	if !p.startRequest() {
+		// Ask client to reconnect, so it can reach another instance of the proxy
+		w.Header().Set("Connection", "close")
+		p.replyError(errors.FromStatus(http.StatusServiceUnavailable), w, r)
+		return
+	}
+	defer p.finishRequest()
+	defer p.recoverPanic(w, r)
+
 	err := p.proxyRequest(w, r)
 	if err == nil {
 		return
@@ -43,6 +99,10 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err := p.proxyRequest(w, r); err != nil {
 			p.replyError(err, w, r)
 		}
+	case *errors.AbortError:
+		log.Infof("Aborting %s %s: %s", r.Method, r.URL, e.Reason)
+		// Server closes the connection without writing the response
+		panic(http.ErrAbortHandler)
 	default:
 		p.replyError(err, w, r)
 	}
@@ -59,10 +119,17 @@ func NewProxyWithOptions(router route.Router, o Options) (*Proxy, error) {
 	if err != nil {
 		return nil, err
 	}
+	trusted, err := netutils.ParseCIDRs(o.TrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
 
 	p := &Proxy{
-		options: o,
-		router:  router,
+		options:        o,
+		trustedProxies: trusted,
+		router:         router,
+		mutex:          &sync.Mutex{},
+		drainedC:       make(chan struct{}),
 	}
 	return p, nil
 }
@@ -71,11 +138,69 @@ func (p *Proxy) GetRouter() route.Router {
 	return p.router
 }
 
+// Close stops accepting new requests and waits for in-flight requests to complete.
+// New requests are rejected with 503 Service Unavailable. Returns error if requests
+// are still in flight after drainTimeout, drainTimeout <= 0 means wait until all requests are done.
+func (p *Proxy) Close(drainTimeout time.Duration) error {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		if p.inFlight == 0 {
+			close(p.drainedC)
+		}
+	}
+	p.mutex.Unlock()
+
+	if drainTimeout <= 0 {
+		<-p.drainedC
+		return nil
+	}
+	select {
+	case <-p.drainedC:
+		return nil
+	case <-time.After(drainTimeout):
+		return fmt.Errorf("%d requests are still in flight after %s", p.GetInFlight(), drainTimeout)
+	}
+}
+
+// Drained returns channel that is closed once the proxy is closed and all in-flight requests
+// have completed, e.g. to coordinate the handover to the new process during restarts.
+func (p *Proxy) Drained() <-chan struct{} {
+	return p.drainedC
+}
+
+// GetInFlight returns the number of requests currently being processed by the proxy
+func (p *Proxy) GetInFlight() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.inFlight
+}
+
+func (p *Proxy) startRequest() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return false
+	}
+	p.inFlight += 1
+	return true
+}
+
+func (p *Proxy) finishRequest() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inFlight -= 1
+	if p.closed && p.inFlight == 0 {
+		close(p.drainedC)
+	}
+}
+
 // Round trips the request to the selected location and writes back the response
 func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request) error {
 
 	// Create a unique request with sequential ids that will be passed to all interfaces.
 	req := request.NewBaseRequest(r, atomic.AddInt64(&p.lastRequestId, 1), nil)
+	req.TrustedProxies = p.trustedProxies
 	location, err := p.router.Route(req)
 	if err != nil {
 		return err
@@ -87,21 +212,149 @@ func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request) error {
 		return errors.FromStatus(http.StatusBadGateway)
 	}
 
+	p.enableFullDuplex(w, location)
 	response, err := location.RoundTrip(req)
+	if response != nil && r.Method == "CONNECT" && response.StatusCode == http.StatusOK {
+		conn, ok := response.Body.(io.ReadWriteCloser)
+		if !ok {
+			// The tunnel can't be sent as the plain response body, e.g. if a middleware has wrapped it
+			log.Errorf("%s response body is not a connection: %T", req, response.Body)
+			if response.Body != nil {
+				response.Body.Close()
+			}
+			return errors.FromStatus(http.StatusBadGateway)
+		}
+		return p.tunnel(w, r, conn)
+	}
 	if response != nil {
+		// Hop-by-hop headers of the endpoint connection are not for the client
+		netutils.RemoveHopHeaders(response.Header)
 		netutils.CopyHeaders(w.Header(), response.Header)
+		announceTrailers(w.Header(), response.Trailer)
+		p.setRequestId(w, r)
+		if fw := p.flushWriter(w, location); fw != nil {
+			defer fw.Stop()
+			w = fw
+		}
 		w.WriteHeader(response.StatusCode)
 		io.Copy(w, response.Body)
 		defer response.Body.Close()
+		copyTrailers(w.Header(), response.Trailer)
 		return nil
 	} else {
 		return err
 	}
 }
 
+// tunnel copies the data between the client and the target of the CONNECT request until either side closes the connection
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request, target io.ReadWriteCloser) error {
+	defer target.Close()
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Errorf("Failed to hijack connection for CONNECT %s: %s", r.Host, err)
+		return errors.FromStatus(http.StatusNotImplemented)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return nil
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		// Server could have buffered the data the client has sent right after the request, e.g. TLS hello
+		io.Copy(target, buf.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	// Closing both connections stops the other copy
+	<-done
+	return nil
+}
+
+// announceTrailers lists the trailers known before the body is read in the Trailer header,
+// so the server sends them once the body is written, e.g. grpc-status of the gRPC responses
+func announceTrailers(h http.Header, trailer http.Header) {
+	for name := range trailer {
+		h.Add(headers.Trailer, name)
+	}
+}
+
+// copyTrailers sets the trailers received along with the body, the ones that were not announced
+// are sent with http.TrailerPrefix
+func copyTrailers(h http.Header, trailer http.Header) {
+	announced := make(map[string]bool)
+	for _, v := range h[headers.Trailer] {
+		announced[http.CanonicalHeaderKey(v)] = true
+	}
+	for name, values := range trailer {
+		if !announced[name] {
+			name = http.TrailerPrefix + name
+		}
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+}
+
+// flushWriter returns the writer that flushes the response as it arrives
+// if the location asks for streaming, returns nil otherwise.
+func (p *Proxy) flushWriter(w http.ResponseWriter, l location.Location) *netutils.FlushWriter {
+	s, ok := l.(location.Streamer)
+	if !ok {
+		return nil
+	}
+	interval, enabled := s.GetFlushInterval()
+	if !enabled {
+		return nil
+	}
+	return netutils.NewFlushWriter(w, interval)
+}
+
+// enableFullDuplex lets the location read the request body after the response has started if it asks for it
+func (p *Proxy) enableFullDuplex(w http.ResponseWriter, l location.Location) {
+	d, ok := l.(location.DuplexStreamer)
+	if !ok || !d.IsFullDuplex() {
+		return
+	}
+	// HTTP/2 connections are always full duplex and do not support the call
+	http.NewResponseController(w).EnableFullDuplex()
+}
+
+// recoverPanic converts the panic into 500 Internal Server Error, so the client does not get the connection dropped.
+func (p *Proxy) recoverPanic(w http.ResponseWriter, r *http.Request) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+	stack := debug.Stack()
+	log.Errorf("Panic while serving %s %s: %v\n%s", r.Method, r.URL, recovered, stack)
+	if p.options.PanicHandler != nil {
+		p.options.PanicHandler(r, recovered, stack)
+	}
+	p.replyError(errors.FromStatus(http.StatusInternalServerError), w, r)
+}
+
+// setRequestId echoes the request id to the client, returns the id or empty string if ids are not generated
+func (p *Proxy) setRequestId(w http.ResponseWriter, r *http.Request) string {
+	if p.options.RequestIdFn == nil {
+		return ""
+	}
+	id := r.Header.Get(headers.XRequestId)
+	w.Header().Set(headers.XRequestId, id)
+	return id
+}
+
 // replyError is a helper function that takes error and replies with HTTP compatible error to the client.
 func (p *Proxy) replyError(err error, w http.ResponseWriter, req *http.Request) {
 	proxyError := convertError(err)
+	if id := p.setRequestId(w, req); id != "" {
+		proxyError = errors.WithRequestId(proxyError, id)
+	}
 	statusCode, body, contentType := p.options.ErrorFormatter.Format(proxyError)
 	w.Header().Set("Content-Type", contentType)
 	if proxyError.Headers() != nil {
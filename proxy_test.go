@@ -2,10 +2,13 @@ package vulcan
 
 import (
 	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
 	. "github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/request"
 	. "github.com/mailgun/vulcan/route"
 	. "github.com/mailgun/vulcan/testutils"
 	. "gopkg.in/check.v1"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"time"
@@ -77,3 +80,222 @@ func (s *ProxySuite) TestReadTimeout(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(response.StatusCode, Equals, http.StatusRequestTimeout)
 }
+
+func (s *ProxySuite) TestCloseDrainsRequests(c *C) {
+	release := make(chan bool)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{server.URL}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	resultC := make(chan int, 1)
+	go func() {
+		response, _, err := MakeRequest(proxyServer.URL, Opts{})
+		if err != nil {
+			resultC <- -1
+			return
+		}
+		resultC <- response.StatusCode
+	}()
+	for proxy.GetInFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Request is still in flight, so proxy could not drain in time
+	c.Assert(proxy.Close(10*time.Millisecond), NotNil)
+
+	// New requests are rejected once proxy is closed
+	response, _, err := MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	close(release)
+	c.Assert(<-resultC, Equals, http.StatusOK)
+	<-proxy.Drained()
+	c.Assert(proxy.Close(0), IsNil)
+	c.Assert(proxy.GetInFlight(), Equals, int64(0))
+}
+
+func (s *ProxySuite) TestCloseIdle(c *C) {
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{"http://localhost:63999"}})
+	c.Assert(err, IsNil)
+	c.Assert(proxy.Close(time.Millisecond), IsNil)
+	<-proxy.Drained()
+}
+
+func (s *ProxySuite) TestRecoverPanic(c *C) {
+	var recovered interface{}
+	var stack []byte
+	proxy, err := NewProxyWithOptions(&panicRouter{}, Options{
+		PanicHandler: func(r *http.Request, v interface{}, s []byte) {
+			recovered = v
+			stack = s
+		},
+	})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, bodyBytes, err := MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusInternalServerError)
+	c.Assert(string(bodyBytes), Equals, `{"error":"Internal Server Error"}`)
+	c.Assert(recovered, Equals, "router failure")
+	c.Assert(len(stack) > 0, Equals, true)
+
+	// Panic has not leaked the in flight request
+	c.Assert(proxy.Close(time.Second), IsNil)
+}
+
+type panicRouter struct {
+}
+
+func (*panicRouter) Route(req request.Request) (Location, error) {
+	panic("router failure")
+}
+
+func (s *ProxySuite) TestAbort(c *C) {
+	proxy, err := NewProxy(&abortRouter{})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	_, _, err = MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, NotNil)
+
+	// Aborted request is not leaked either
+	c.Assert(proxy.Close(time.Second), IsNil)
+}
+
+type abortRouter struct {
+}
+
+func (*abortRouter) Route(req request.Request) (Location, error) {
+	return nil, &errors.AbortError{Reason: "connection reset"}
+}
+
+func (s *ProxySuite) TestTrustedCIDRs(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	router := &clientIPRouter{location: &ConstHttpLocation{server.URL}}
+	proxy, err := NewProxyWithOptions(router, Options{TrustedCIDRs: []string{"127.0.0.0/8"}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	_, _, err = MakeRequest(proxyServer.URL, Opts{Headers: http.Header{"X-Forwarded-For": []string{"1.2.3.4, 127.0.0.2"}}})
+	c.Assert(err, IsNil)
+	c.Assert(router.clientIP, Equals, "1.2.3.4")
+
+	_, err = NewProxyWithOptions(router, Options{TrustedCIDRs: []string{"bad"}})
+	c.Assert(err, NotNil)
+}
+
+// clientIPRouter records the client address of the last request
+type clientIPRouter struct {
+	location Location
+	clientIP string
+}
+
+func (r *clientIPRouter) Route(req request.Request) (Location, error) {
+	r.clientIP = req.GetClientIP().String()
+	return r.location, nil
+}
+
+func (s *ProxySuite) TestRequestId(c *C) {
+	var upstreamId string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		upstreamId = r.Header.Get("X-Request-Id")
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	proxy, err := NewProxyWithOptions(&ConstRouter{&ConstHttpLocation{server.URL}}, Options{RequestIdFn: UniqueRequestId})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, _, err := MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(response.Header.Get("X-Request-Id"), Matches, "[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}")
+	c.Assert(upstreamId, Equals, response.Header.Get("X-Request-Id"))
+
+	// Ids are unique
+	other, _, err := MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(other.Header.Get("X-Request-Id"), Not(Equals), response.Header.Get("X-Request-Id"))
+}
+
+func (s *ProxySuite) TestRequestIdInError(c *C) {
+	proxy, err := NewProxyWithOptions(&ConstRouter{&ConstHttpLocation{"http://localhost:63999"}}, Options{
+		RequestIdFn: func(*http.Request) string { return "req-1" },
+	})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, bodyBytes, err := MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(response.Header.Get("X-Request-Id"), Equals, "req-1")
+	c.Assert(string(bodyBytes), Equals, `{"error":"Bad Gateway","request_id":"req-1"}`)
+}
+
+func (s *ProxySuite) TestTrailers(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("Hi, I'm endpoint"))
+		w.Header().Set("Grpc-Status", "0")
+		// Not announced before the body
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	})
+	defer server.Close()
+
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{server.URL}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, body, err := MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "Hi, I'm endpoint")
+	c.Assert(response.Trailer.Get("Grpc-Status"), Equals, "0")
+	c.Assert(response.Trailer.Get("Grpc-Message"), Equals, "ok")
+}
+
+func (s *ProxySuite) TestRemovesResponseHopHeaders(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		// Standard server rewrites the Connection header, so write the response by hand
+		conn, _, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+			"Connection: X-Endpoint-Secret\r\n"+
+			"X-Endpoint-Secret: s\r\n"+
+			"Keep-Alive: timeout=5\r\n"+
+			"Content-Length: 16\r\n\r\n"+
+			"Hi, I'm endpoint")
+	})
+	defer server.Close()
+
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{server.URL}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, _, err := MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(response.Header.Get("X-Endpoint-Secret"), Equals, "")
+	c.Assert(response.Header.Get("Keep-Alive"), Equals, "")
+}
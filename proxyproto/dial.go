@@ -0,0 +1,65 @@
+package proxyproto
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// DialFunc establishes the connection, e.g. net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NewDialFunc returns the dial function that sends the PROXY protocol header of the given version
+// as soon as the connection is established. The header is taken from the context, see ContextWithHeader,
+// the connections dialed without the header are announced as the local ones.
+//
+// Header describes the whole connection, so the connections should not be shared by the requests
+// of the different clients, e.g. disable keep-alives of the http.Transport using this dialer.
+func NewDialFunc(dial DialFunc, version int) (DialFunc, error) {
+	if dial == nil {
+		return nil, fmt.Errorf("Provide dial function")
+	}
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version: %d", version)
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		h, ok := ctx.Value(headerKey).(*Header)
+		if !ok {
+			h = &Header{Local: true}
+		}
+		data, err := h.Format(version)
+		if err == nil {
+			_, err = conn.Write(data)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}, nil
+}
+
+// ContextWithHeader returns the context carrying the header to send with NewDialFunc
+func ContextWithHeader(ctx context.Context, h *Header) context.Context {
+	return context.WithValue(ctx, headerKey, h)
+}
+
+// HeaderFromRequest returns the header describing the connection of the client that has sent the request:
+// the source is the RemoteAddr of the request and the destination is the local address of the server
+func HeaderFromRequest(req *http.Request) *Header {
+	h := &Header{}
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		h.Source, _ = parseAddr(host, port)
+	}
+	if a, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, port, err := net.SplitHostPort(a.String()); err == nil {
+			h.Destination, _ = parseAddr(host, port)
+		}
+	}
+	return h
+}
@@ -0,0 +1,224 @@
+// PROXY protocol support, lets vulcan learn the real client addresses when it sits behind an L4 balancer,
+// and pass them to the endpoints. See http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Header describes the original connection of the client to the balancer
+type Header struct {
+	// Protocol version the header was received with, 1 or 2
+	Version int
+	// Set for the connections opened by the balancer itself, e.g. health checks, their addresses are not proxied
+	Local bool
+	// Addresses of the client and the balancer, nil if unknown
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// Format encodes the header in the given version of the protocol
+func (h *Header) Format(version int) ([]byte, error) {
+	switch version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2(), nil
+	}
+	return nil, fmt.Errorf("Unsupported PROXY protocol version: %d", version)
+}
+
+func (h *Header) String() string {
+	if h.Local || h.Source == nil || h.Destination == nil {
+		return fmt.Sprintf("Header(version=%d, local=%t)", h.Version, h.Local)
+	}
+	return fmt.Sprintf("Header(version=%d, source=%s, destination=%s)", h.Version, h.Source, h.Destination)
+}
+
+func (h *Header) formatV1() []byte {
+	if h.Local || h.Source == nil || h.Destination == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if h.isIPv4() {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, h.Source.IP, h.Destination.IP, h.Source.Port, h.Destination.Port))
+}
+
+func (h *Header) formatV2() []byte {
+	b := &bytes.Buffer{}
+	b.Write(signatureV2)
+	if h.Local {
+		b.Write([]byte{0x20, familyUnspec, 0, 0})
+		return b.Bytes()
+	}
+	b.WriteByte(0x21)
+	var addrs []byte
+	switch {
+	case h.Source == nil || h.Destination == nil:
+		b.WriteByte(familyUnspec)
+	case h.isIPv4():
+		b.WriteByte(familyTCP4)
+		addrs = append(addrs, h.Source.IP.To4()...)
+		addrs = append(addrs, h.Destination.IP.To4()...)
+	default:
+		b.WriteByte(familyTCP6)
+		addrs = append(addrs, h.Source.IP.To16()...)
+		addrs = append(addrs, h.Destination.IP.To16()...)
+	}
+	if addrs != nil {
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports, uint16(h.Source.Port))
+		binary.BigEndian.PutUint16(ports[2:], uint16(h.Destination.Port))
+		addrs = append(addrs, ports...)
+	}
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+	b.Write(length)
+	b.Write(addrs)
+	return b.Bytes()
+}
+
+func (h *Header) isIPv4() bool {
+	return h.Source.IP.To4() != nil && h.Destination.IP.To4() != nil
+}
+
+// ReadHeader reads the header of either version from the beginning of the stream,
+// returns nil header if the stream does not start with the PROXY protocol header
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		prefix, err := r.Peek(len(prefixV1))
+		if err != nil || string(prefix) != prefixV1 {
+			return nil, nil
+		}
+		return readV1(r)
+	case signatureV2[0]:
+		prefix, err := r.Peek(len(signatureV2))
+		if err != nil || !bytes.Equal(prefix, signatureV2) {
+			return nil, nil
+		}
+		return readV2(r)
+	}
+	return nil, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, maxLengthV1)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == maxLengthV1 {
+			return nil, fmt.Errorf("PROXY protocol header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY protocol header should end with CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Malformed PROXY protocol header: %q", line)
+	}
+	var err error
+	if h.Source, err = parseAddr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseAddr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address in PROXY protocol header: %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port in PROXY protocol header: %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, len(signatureV2)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	verCmd, family := fixed[12], fixed[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version: %d", verCmd>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	h := &Header{Version: 2}
+	switch verCmd & 0xF {
+	case 0:
+		h.Local = true
+		return h, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol command: %d", verCmd&0xF)
+	}
+	var size int
+	switch family {
+	case familyTCP4:
+		size = net.IPv4len
+	case familyTCP6:
+		size = net.IPv6len
+	default:
+		// UDP and unix sockets are not proxied over HTTP, the addresses are left unknown
+		return h, nil
+	}
+	// Addresses can be followed by the TLVs, vulcan does not use them
+	if len(payload) < 2*size+4 {
+		return nil, fmt.Errorf("PROXY protocol header is too short for the address family")
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return h, nil
+}
+
+const (
+	prefixV1 = "PROXY "
+	// Including CRLF, as defined by the spec
+	maxLengthV1 = 107
+
+	familyUnspec = 0x00
+	familyTCP4   = 0x11
+	familyTCP6   = 0x21
+)
+
+var signatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
@@ -0,0 +1,171 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/netutils"
+)
+
+// Listener reads the PROXY protocol header of the accepted connections, so RemoteAddr of the connections,
+// and so the RemoteAddr of the http requests, is the address of the client rather than the balancer:
+//
+//	l, _ := net.Listen("tcp", ":8080")
+//	pl, _ := proxyproto.NewListener(l)
+//	server := &http.Server{Handler: proxy, ConnContext: proxyproto.ConnContext}
+//	server.Serve(pl)
+//
+// The header is read on the first use of the connection rather than in Accept,
+// so slow or malicious peers do not block accepting the other connections.
+type Listener struct {
+	net.Listener
+	options Options
+	trusted []*net.IPNet
+}
+
+type Options struct {
+	// Addresses or networks of the balancers, e.g. "10.0.0.0/8". Headers of the other peers are not
+	// read, so they can't forge the client address. All peers are trusted if empty
+	TrustedCIDRs []string
+	// Connections of the trusted peers without the header are closed
+	Required bool
+	// Time to wait for the header, DefaultReadHeaderTimeout by default
+	ReadHeaderTimeout time.Duration
+}
+
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+func NewListener(l net.Listener) (*Listener, error) {
+	return NewListenerWithOptions(l, Options{})
+}
+
+func NewListenerWithOptions(l net.Listener, o Options) (*Listener, error) {
+	if l == nil {
+		return nil, fmt.Errorf("Provide listener")
+	}
+	if o.ReadHeaderTimeout < 0 {
+		return nil, fmt.Errorf("Read header timeout can not be negative")
+	}
+	if o.ReadHeaderTimeout == 0 {
+		o.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	trusted, err := netutils.ParseCIDRs(o.TrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{Listener: l, options: o, trusted: trusted}, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:     c,
+		reader:   bufio.NewReader(c),
+		trusted:  l.isTrusted(c.RemoteAddr()),
+		required: l.options.Required,
+		timeout:  l.options.ReadHeaderTimeout,
+	}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	a, ok := addr.(*net.TCPAddr)
+	return ok && netutils.ContainsIP(l.trusted, a.IP)
+}
+
+// Conn is the connection accepted by the Listener, its addresses are taken from the PROXY protocol header
+type Conn struct {
+	net.Conn
+	reader   *bufio.Reader
+	trusted  bool
+	required bool
+	timeout  time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+// ProxyHeader returns the header sent by the balancer, nil if the connection had no header
+func (c *Conn) ProxyHeader() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, err := c.ProxyHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the client if the header has it, the address of the peer otherwise
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, _ := c.ProxyHeader(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client has connected to if the header has it, the address of the listener otherwise
+func (c *Conn) LocalAddr() net.Addr {
+	if h, _ := c.ProxyHeader(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if !c.trusted {
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.header, c.err = ReadHeader(c.reader)
+	if c.err == nil && c.header == nil && c.required {
+		c.err = fmt.Errorf("Connection from %s has no PROXY protocol header", c.Conn.RemoteAddr())
+	}
+	if c.err != nil {
+		log.Warningf("Failed to read PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+// ConnContext remembers the connection, so the handlers can get the header with GetHeader.
+// Set it as the ConnContext of the http.Server
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if pc, ok := c.(*Conn); ok {
+		return context.WithValue(ctx, connKey, pc)
+	}
+	return ctx
+}
+
+// GetHeader returns the PROXY protocol header of the request connection,
+// nil if there was no header or the server does not use ConnContext
+func GetHeader(req *http.Request) *Header {
+	pc, ok := req.Context().Value(connKey).(*Conn)
+	if !ok {
+		return nil
+	}
+	h, _ := pc.ProxyHeader()
+	return h
+}
+
+type contextKey string
+
+const (
+	connKey   contextKey = "proxyproto.conn"
+	headerKey contextKey = "proxyproto.header"
+)
@@ -0,0 +1,235 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestProxyProto(t *testing.T) { TestingT(t) }
+
+type ProxyProtoSuite struct{}
+
+var _ = Suite(&ProxyProtoSuite{})
+
+func (s *ProxyProtoSuite) TestFormatAndRead(c *C) {
+	tcs := []struct {
+		version int
+		header  *Header
+	}{
+		{1, &Header{Source: tcpAddr("1.2.3.4:5678"), Destination: tcpAddr("10.0.0.1:80")}},
+		{1, &Header{Source: tcpAddr("[2001:db8::1]:5678"), Destination: tcpAddr("[2001:db8::2]:443")}},
+		{1, &Header{}},
+		{2, &Header{Source: tcpAddr("1.2.3.4:5678"), Destination: tcpAddr("10.0.0.1:80")}},
+		{2, &Header{Source: tcpAddr("[2001:db8::1]:5678"), Destination: tcpAddr("[2001:db8::2]:443")}},
+		{2, &Header{Local: true}},
+		{2, &Header{}},
+	}
+	for _, tc := range tcs {
+		data, err := tc.header.Format(tc.version)
+		c.Assert(err, IsNil)
+		r := bufio.NewReader(strings.NewReader(string(data) + "GET / HTTP/1.1\r\n"))
+
+		h, err := ReadHeader(r)
+		c.Assert(err, IsNil)
+		c.Assert(h, NotNil)
+		comment := Commentf("%d %s", tc.version, tc.header)
+		c.Assert(h.Version, Equals, tc.version, comment)
+		c.Assert(h.Local, Equals, tc.header.Local, comment)
+		c.Assert(h.Source.String(), Equals, tc.header.Source.String(), comment)
+		c.Assert(h.Destination.String(), Equals, tc.header.Destination.String(), comment)
+
+		// The rest of the stream is intact
+		line, err := r.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, "GET / HTTP/1.1\r\n")
+	}
+}
+
+func (s *ProxyProtoSuite) TestFormatV1(c *C) {
+	h := &Header{Source: tcpAddr("1.2.3.4:5678"), Destination: tcpAddr("10.0.0.1:80")}
+	data, err := h.Format(1)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\r\n")
+
+	_, err = h.Format(3)
+	c.Assert(err, NotNil)
+}
+
+func (s *ProxyProtoSuite) TestNoHeader(c *C) {
+	for _, data := range []string{"GET / HTTP/1.1\r\n", "POST / HTTP/1.1\r\n", "\r\n\r\n"} {
+		r := bufio.NewReader(strings.NewReader(data))
+		h, err := ReadHeader(r)
+		c.Assert(err, IsNil)
+		c.Assert(h, IsNil)
+
+		out, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		c.Assert(string(out), Equals, data)
+	}
+}
+
+func (s *ProxyProtoSuite) TestMalformed(c *C) {
+	tcs := []string{
+		"PROXY TCP4 1.2.3.4 10.0.0.1 5678\r\n",
+		"PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\n",
+		"PROXY TCP4 1.2.3.x 10.0.0.1 5678 80\r\n",
+		"PROXY TCP4 1.2.3.4 10.0.0.1 5678 100000\r\n",
+		"PROXY UDP4 1.2.3.4 10.0.0.1 5678 80\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+		// Version 3
+		"\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",
+		// IPv4 addresses do not fit
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04",
+		// Truncated
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\x01\x02",
+	}
+	for _, data := range tcs {
+		_, err := ReadHeader(bufio.NewReader(strings.NewReader(data)))
+		c.Assert(err, NotNil, Commentf("%q", data))
+	}
+}
+
+func (s *ProxyProtoSuite) TestListener(c *C) {
+	var remoteAddr string
+	var header *Header
+	server := s.newServer(c, Options{}, func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+		header = GetHeader(r)
+	})
+	defer server.Close()
+
+	status := s.request(c, server, "PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\r\n")
+	c.Assert(status, Equals, "HTTP/1.1 200 OK\r\n")
+	c.Assert(remoteAddr, Equals, "1.2.3.4:5678")
+	c.Assert(header, NotNil)
+	c.Assert(header.Destination.String(), Equals, "10.0.0.1:80")
+
+	// Header is optional by default
+	status = s.request(c, server, "")
+	c.Assert(status, Equals, "HTTP/1.1 200 OK\r\n")
+	c.Assert(strings.HasPrefix(remoteAddr, "127.0.0.1:"), Equals, true)
+	c.Assert(header, IsNil)
+}
+
+func (s *ProxyProtoSuite) TestUntrustedPeer(c *C) {
+	called := false
+	server := s.newServer(c, Options{TrustedCIDRs: []string{"10.0.0.0/8"}}, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	defer server.Close()
+
+	// Header is not read, so the request is malformed
+	status := s.request(c, server, "PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\r\n")
+	c.Assert(status, Equals, "HTTP/1.1 400 Bad Request\r\n")
+	c.Assert(called, Equals, false)
+}
+
+func (s *ProxyProtoSuite) TestRequired(c *C) {
+	server := s.newServer(c, Options{Required: true}, func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	c.Assert(err, IsNil)
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	c.Assert(err, NotNil)
+}
+
+func (s *ProxyProtoSuite) TestDialFunc(c *C) {
+	var header *Header
+	server := s.newServer(c, Options{}, func(w http.ResponseWriter, r *http.Request) {
+		header = GetHeader(r)
+	})
+	defer server.Close()
+
+	dial, err := NewDialFunc((&net.Dialer{}).DialContext, 2)
+	c.Assert(err, IsNil)
+	client := &http.Client{Transport: &http.Transport{DialContext: dial, DisableKeepAlives: true}}
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	c.Assert(err, IsNil)
+	sent := &Header{Source: tcpAddr("1.2.3.4:5678"), Destination: tcpAddr("10.0.0.1:80")}
+	re, err := client.Do(req.WithContext(ContextWithHeader(context.Background(), sent)))
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(header, NotNil)
+	c.Assert(header.Version, Equals, 2)
+	c.Assert(header.Source.String(), Equals, "1.2.3.4:5678")
+
+	// Connections without the header are announced as local
+	re, err = client.Get(server.URL)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(header, NotNil)
+	c.Assert(header.Local, Equals, true)
+
+	_, err = NewDialFunc((&net.Dialer{}).DialContext, 3)
+	c.Assert(err, NotNil)
+}
+
+func (s *ProxyProtoSuite) TestHeaderFromRequest(c *C) {
+	req, err := http.NewRequest("GET", "http://localhost", nil)
+	c.Assert(err, IsNil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, tcpAddr("10.0.0.1:80")))
+
+	h := HeaderFromRequest(req)
+	c.Assert(h.Source.String(), Equals, "1.2.3.4:5678")
+	c.Assert(h.Destination.String(), Equals, "10.0.0.1:80")
+}
+
+func (s *ProxyProtoSuite) TestBadParams(c *C) {
+	_, err := NewListener(nil)
+	c.Assert(err, NotNil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	_, err = NewListenerWithOptions(l, Options{TrustedCIDRs: []string{"bad"}})
+	c.Assert(err, NotNil)
+
+	_, err = NewListenerWithOptions(l, Options{ReadHeaderTimeout: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *ProxyProtoSuite) newServer(c *C, o Options, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	l, err := NewListenerWithOptions(server.Listener, o)
+	c.Assert(err, IsNil)
+	server.Listener = l
+	server.Config.ConnContext = ConnContext
+	server.Start()
+	return server
+}
+
+// request sends the GET request preceded by the header and returns the status line of the response
+func (s *ProxyProtoSuite) request(c *C, server *httptest.Server, header string) string {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(header + "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	c.Assert(err, IsNil)
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	c.Assert(err, IsNil)
+	return status
+}
+
+func tcpAddr(addr string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
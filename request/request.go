@@ -2,7 +2,9 @@
 package request
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -25,6 +27,12 @@ type Request interface {
 	SetUserData(key string, baton interface{})  // Provide storage space for data that survives with the request
 	GetUserData(key string) (interface{}, bool) // Fetch user data set from previously SetUserData call
 	DeleteUserData(key string)                  // Clean up user data set from previously SetUserData call
+	GetContext() context.Context                // Context carrying deadlines and cancelation, defaults to the http request context
+	SetContext(context.Context)                 // Replaces the request context, e.g. to set the deadline for the upstream round trips
+	GetClientIP() net.IP                        // Address of the client, nil if it can't be parsed, see netutils.ClientIP
+	IsFromTrustedProxy() bool                   // Whether the request was sent by one of the trusted proxies, so its forwarding headers can be trusted
+	SetDeadline(time.Time)                      // Sets the deadline of the round trips to the endpoints, e.g. from the X-Timeout header, overrides the location timeout
+	GetDeadline() (time.Time, bool)             // Returns the deadline set by SetDeadline, false if there is none
 }
 
 type Attempt interface {
@@ -32,6 +40,19 @@ type Attempt interface {
 	GetDuration() time.Duration
 	GetResponse() *http.Response
 	GetEndpoint() endpoint.Endpoint
+	GetTimings() *Timings // Breakdown of the round trip to the endpoint, may be nil if the timings were not captured
+}
+
+// Timings break down the round trip to the endpoint, e.g. to tell connect latency from the server processing time.
+// Phases that did not happen, e.g. DNS lookup on a reused connection, are 0.
+type Timings struct {
+	DNSLookup    time.Duration // Time spent resolving the endpoint host
+	Connect      time.Duration // Time spent establishing TCP connection
+	TlsHandshake time.Duration // Time spent in TLS handshake
+	GotConn      time.Duration // Time from the start of the round trip until the connection was obtained, either new or from the idle pool
+	WroteRequest time.Duration // Time from the start of the round trip until the request headers and body were written
+	FirstByte    time.Duration // Time from the start of the round trip until the first byte of the response was received
+	ConnReused   bool          // Whether the connection was reused from the idle pool
 }
 
 type BaseAttempt struct {
@@ -39,6 +60,7 @@ type BaseAttempt struct {
 	Duration time.Duration
 	Response *http.Response
 	Endpoint endpoint.Endpoint
+	Timings  *Timings
 }
 
 func (ba *BaseAttempt) GetResponse() *http.Response {
@@ -57,21 +79,29 @@ func (ba *BaseAttempt) GetEndpoint() endpoint.Endpoint {
 	return ba.Endpoint
 }
 
+func (ba *BaseAttempt) GetTimings() *Timings {
+	return ba.Timings
+}
+
 type BaseRequest struct {
-	HttpRequest   *http.Request
-	Id            int64
-	Body          netutils.MultiReader
-	Attempts      []Attempt
-	userDataMutex *sync.RWMutex
+	HttpRequest *http.Request
+	Id          int64
+	Body        netutils.MultiReader
+	Attempts    []Attempt
+	// Proxies in front of vulcan, GetClientIP trusts X-Forwarded-For of their requests
+	TrustedProxies []*net.IPNet
+	ctx            context.Context
+	deadline       time.Time
+	// Guards user data, zero value is ready to use, so the requests created as literals can store user data too
+	userDataMutex sync.RWMutex
 	userData      map[string]interface{}
 }
 
 func NewBaseRequest(r *http.Request, id int64, body netutils.MultiReader) *BaseRequest {
 	return &BaseRequest{
-		HttpRequest:   r,
-		Id:            id,
-		Body:          body,
-		userDataMutex: &sync.RWMutex{},
+		HttpRequest: r,
+		Id:          id,
+		Body:        body,
 	}
 
 }
@@ -114,6 +144,64 @@ func (br *BaseRequest) GetLastAttempt() Attempt {
 	}
 	return br.Attempts[len(br.Attempts)-1]
 }
+
+// GetContext returns the context set by SetContext, or the original http request context.
+// The context of the request accepted by http.Server is canceled when the client disconnects.
+func (br *BaseRequest) GetContext() context.Context {
+	if br.ctx != nil {
+		return br.ctx
+	}
+	if br.HttpRequest != nil {
+		return br.HttpRequest.Context()
+	}
+	return context.Background()
+}
+
+// SetContext sets the context and attaches it to the http request,
+// so the round trip to the endpoint is canceled along with the context.
+func (br *BaseRequest) SetContext(ctx context.Context) {
+	if ctx == nil {
+		panic("nil context")
+	}
+	br.ctx = ctx
+	if br.HttpRequest != nil {
+		br.HttpRequest = br.HttpRequest.WithContext(ctx)
+	}
+}
+
+// GetClientIP returns the address of the client, taken from X-Forwarded-For if the request came from one of
+// the trusted proxies. X-Forwarded-For is walked from the right, so the addresses forged by the client are skipped.
+func (br *BaseRequest) GetClientIP() net.IP {
+	ip, err := netutils.ClientIP(br.HttpRequest, br.TrustedProxies)
+	if err != nil {
+		return nil
+	}
+	return ip
+}
+
+// IsFromTrustedProxy tells whether the peer of the connection is one of the trusted proxies
+func (br *BaseRequest) IsFromTrustedProxy() bool {
+	if len(br.TrustedProxies) == 0 || br.HttpRequest == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(br.HttpRequest.RemoteAddr)
+	if err != nil {
+		host = br.HttpRequest.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && netutils.ContainsIP(br.TrustedProxies, ip)
+}
+
+// SetDeadline sets the deadline the location enforces for the round trips to the endpoints
+// instead of its own total timeout, so it can be both shorter and longer than the timeout
+func (br *BaseRequest) SetDeadline(t time.Time) {
+	br.deadline = t
+}
+
+func (br *BaseRequest) GetDeadline() (time.Time, bool) {
+	return br.deadline, !br.deadline.IsZero()
+}
+
 func (br *BaseRequest) SetUserData(key string, baton interface{}) {
 	br.userDataMutex.Lock()
 	defer br.userDataMutex.Unlock()
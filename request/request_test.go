@@ -1,9 +1,12 @@
 package request
 
 import (
+	"context"
+	"github.com/mailgun/vulcan/netutils"
 	. "gopkg.in/check.v1"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestRequest(t *testing.T) { TestingT(t) }
@@ -43,3 +46,77 @@ func (s *RequestSuite) TestUserDataNil(c *C) {
 	_, present := br.GetUserData("caller1")
 	c.Assert(present, Equals, false)
 }
+
+// Requests created without constructor can store user data, e.g. in tests
+func (s *RequestSuite) TestUserDataZeroValue(c *C) {
+	br := &BaseRequest{HttpRequest: &http.Request{}}
+	br.SetUserData("identity", "alice")
+	data, present := br.GetUserData("identity")
+	c.Assert(present, Equals, true)
+	c.Assert(data, Equals, "alice")
+}
+
+func (s *RequestSuite) TestContextDefaults(c *C) {
+	br := &BaseRequest{}
+	c.Assert(br.GetContext(), Equals, context.Background())
+
+	r := &http.Request{}
+	br = NewBaseRequest(r, 0, nil)
+	c.Assert(br.GetContext(), Equals, r.Context())
+}
+
+func (s *RequestSuite) TestSetContext(c *C) {
+	br := NewBaseRequest(&http.Request{}, 0, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	br.SetContext(ctx)
+	c.Assert(br.GetContext(), Equals, ctx)
+	c.Assert(br.GetHttpRequest().Context(), Equals, ctx)
+
+	cancel()
+	c.Assert(br.GetHttpRequest().Context().Err(), Equals, context.Canceled)
+}
+
+func (s *RequestSuite) TestGetClientIP(c *C) {
+	trusted, err := netutils.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 2.2.2.2, 10.0.0.2")
+
+	// Forward header is ignored unless the proxy is trusted
+	br := NewBaseRequest(r, 0, nil)
+	c.Assert(br.GetClientIP().String(), Equals, "10.0.0.1")
+
+	br.TrustedProxies = trusted
+	c.Assert(br.GetClientIP().String(), Equals, "2.2.2.2")
+
+	br = NewBaseRequest(&http.Request{RemoteAddr: "bad"}, 0, nil)
+	c.Assert(br.GetClientIP(), IsNil)
+}
+
+func (s *RequestSuite) TestIsFromTrustedProxy(c *C) {
+	trusted, err := netutils.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	br := NewBaseRequest(&http.Request{RemoteAddr: "10.0.0.1:1234"}, 0, nil)
+	c.Assert(br.IsFromTrustedProxy(), Equals, false)
+	br.TrustedProxies = trusted
+	c.Assert(br.IsFromTrustedProxy(), Equals, true)
+
+	br = NewBaseRequest(&http.Request{RemoteAddr: "1.2.3.4:1234"}, 0, nil)
+	br.TrustedProxies = trusted
+	c.Assert(br.IsFromTrustedProxy(), Equals, false)
+}
+
+func (s *RequestSuite) TestDeadline(c *C) {
+	br := &BaseRequest{}
+	_, ok := br.GetDeadline()
+	c.Assert(ok, Equals, false)
+
+	deadline := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	br.SetDeadline(deadline)
+	d, ok := br.GetDeadline()
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, deadline)
+}
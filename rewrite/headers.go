@@ -0,0 +1,113 @@
+// Middlewares that rewrite the requests and the responses according to the declarative rules
+package rewrite
+
+import (
+	"net/http"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+// HeaderRules describe the changes of the headers, applied in order: Remove, Set, Add.
+// Values can reference the request variables, e.g. "${client.ip}", see template for the list.
+type HeaderRules struct {
+	// Headers to remove
+	Remove []string
+	// Headers to set, replacing the existing values
+	Set map[string]string
+	// Values to add to the existing values of the headers
+	Add map[string]string
+}
+
+// HeaderRewriter changes the request headers before the request is proxied to the endpoint
+// and the response headers before the response is sent to the client:
+//
+//	hr, _ := rewrite.NewHeaderRewriter(
+//		rewrite.HeaderRules{Set: map[string]string{"X-Real-Ip": "${client.ip}"}},
+//		rewrite.HeaderRules{Remove: []string{"Server"}, Set: map[string]string{"X-Served-By": "${hostname}"}},
+//	)
+type HeaderRewriter struct {
+	request  *headerRules
+	response *headerRules
+}
+
+func NewHeaderRewriter(request, response HeaderRules) (*HeaderRewriter, error) {
+	vc, err := newVariableContext()
+	if err != nil {
+		return nil, err
+	}
+	req, err := compileHeaderRules(vc, request)
+	if err != nil {
+		return nil, err
+	}
+	re, err := compileHeaderRules(vc, response)
+	if err != nil {
+		return nil, err
+	}
+	return &HeaderRewriter{request: req, response: re}, nil
+}
+
+func (h *HeaderRewriter) ProcessRequest(r request.Request) (*http.Response, error) {
+	h.request.apply(r, r.GetHttpRequest().Header)
+	return nil, nil
+}
+
+func (h *HeaderRewriter) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+func (h *HeaderRewriter) ModifyResponse(r request.Request, re *http.Response) error {
+	if re.Header == nil {
+		re.Header = make(http.Header)
+	}
+	h.response.apply(r, re.Header)
+	return nil
+}
+
+type headerRules struct {
+	remove []string
+	set    []headerValue
+	add    []headerValue
+}
+
+type headerValue struct {
+	name  string
+	value template
+}
+
+func compileHeaderRules(vc *variableContext, rules HeaderRules) (*headerRules, error) {
+	out := &headerRules{}
+	for _, name := range rules.Remove {
+		out.remove = append(out.remove, http.CanonicalHeaderKey(name))
+	}
+	var err error
+	if out.set, err = compileHeaderValues(vc, rules.Set); err != nil {
+		return nil, err
+	}
+	if out.add, err = compileHeaderValues(vc, rules.Add); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func compileHeaderValues(vc *variableContext, values map[string]string) ([]headerValue, error) {
+	var out []headerValue
+	for name, value := range values {
+		t, err := vc.parseTemplate(value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, headerValue{name: http.CanonicalHeaderKey(name), value: t})
+	}
+	return out, nil
+}
+
+func (hr *headerRules) apply(r request.Request, h http.Header) {
+	for _, name := range hr.remove {
+		h.Del(name)
+	}
+	for _, v := range hr.set {
+		h.Set(v.name, v.value.expand(r))
+	}
+	for _, v := range hr.add {
+		h.Add(v.name, v.value.expand(r))
+	}
+}
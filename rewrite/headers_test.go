@@ -0,0 +1,99 @@
+package rewrite
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestRewrite(t *testing.T) { TestingT(t) }
+
+type HeadersSuite struct{}
+
+var _ = Suite(&HeadersSuite{})
+
+func (s *HeadersSuite) TestRequestHeaders(c *C) {
+	h, err := NewHeaderRewriter(HeaderRules{
+		Remove: []string{"x-secret"},
+		Set: map[string]string{
+			"X-Real-Ip":  "${client.ip}",
+			"X-Original": "${request.method} ${request.host}${request.path}",
+		},
+		Add: map[string]string{"X-Tags": "proxied by ${request.header.x-name}"},
+	}, HeaderRules{})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4:1234")
+	hdr := r.GetHttpRequest().Header
+	hdr.Set("X-Secret", "s")
+	hdr.Set("X-Real-Ip", "6.6.6.6")
+	hdr.Set("X-Tags", "original")
+	hdr.Set("X-Name", "vulcan")
+
+	re, err := h.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(hdr.Get("X-Secret"), Equals, "")
+	c.Assert(hdr["X-Real-Ip"], DeepEquals, []string{"1.2.3.4"})
+	c.Assert(hdr.Get("X-Original"), Equals, "GET localhost/a")
+	c.Assert(hdr["X-Tags"], DeepEquals, []string{"original", "proxied by vulcan"})
+}
+
+func (s *HeadersSuite) TestResponseHeaders(c *C) {
+	h, err := NewHeaderRewriter(HeaderRules{}, HeaderRules{
+		Remove: []string{"Server"},
+		Set:    map[string]string{"X-Served-By": "${hostname}", "X-Request-Id": "${request.id}"},
+	})
+	c.Assert(err, IsNil)
+
+	hostname, err := os.Hostname()
+	c.Assert(err, IsNil)
+
+	re := netutils.NewTextResponse(nil, http.StatusOK, "hello")
+	re.Header.Set("Server", "nginx")
+	c.Assert(h.ModifyResponse(makeRequest("1.2.3.4:1234"), re), IsNil)
+	c.Assert(re.Header.Get("Server"), Equals, "")
+	c.Assert(re.Header.Get("X-Served-By"), Equals, hostname)
+	// Falls back to the sequential id if the proxy does not generate the request ids
+	c.Assert(re.Header.Get("X-Request-Id"), Equals, "1")
+}
+
+func (s *HeadersSuite) TestRequestClientIP(c *C) {
+	h, err := NewHeaderRewriter(HeaderRules{Set: map[string]string{"X-Real-Ip": "${client.ip}"}}, HeaderRules{})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("10.0.0.1:1234")
+	r.GetHttpRequest().Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.(*request.BaseRequest).TrustedProxies, err = netutils.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+	_, err = h.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetHttpRequest().Header.Get("X-Real-Ip"), Equals, "1.2.3.4")
+}
+
+func (s *HeadersSuite) TestBadParams(c *C) {
+	bad := []HeaderRules{
+		{Set: map[string]string{"X-A": "${unknown}"}},
+		{Add: map[string]string{"X-A": "${client.ip"}},
+		{Set: map[string]string{"X-A": "${request.header.}"}},
+	}
+	for _, rules := range bad {
+		_, err := NewHeaderRewriter(rules, HeaderRules{})
+		c.Assert(err, NotNil)
+	}
+}
+
+func makeRequest(remoteAddr string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     "GET",
+		Host:       "localhost",
+		RemoteAddr: remoteAddr,
+		URL:        netutils.MustParseUrl("http://localhost/a"),
+		RequestURI: "/a",
+		Header:     http.Header{},
+	}, 1, nil)
+}
@@ -0,0 +1,121 @@
+package rewrite
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Redirector replies with redirects to the canonical URLs without proxying the requests to the endpoints.
+// GET and HEAD requests are redirected with 301 Moved Permanently, other methods with 308 Permanent Redirect,
+// so the clients repeat the method and the body:
+//
+//	rd, _ := rewrite.NewRedirector(rewrite.RedirectOptions{HTTPS: true, Host: "www.example.com"})
+type Redirector struct {
+	options RedirectOptions
+}
+
+type RedirectOptions struct {
+	// Redirect plain HTTP requests to HTTPS. The scheme is taken from X-Forwarded-Proto header
+	// set by the location, so the requests from the TLS terminating proxies are not redirected in a loop.
+	HTTPS bool
+	// Canonical host to redirect other hosts to, e.g. "www.example.com" to redirect the apex domain to www
+	Host string
+	// Adds or removes the trailing slash of the path, TrailingSlashAdd or TrailingSlashRemove.
+	// Paths ending with a file name, e.g. /favicon.ico, do not get the trailing slash.
+	TrailingSlash string
+}
+
+const (
+	TrailingSlashAdd    = "add"
+	TrailingSlashRemove = "remove"
+)
+
+func NewRedirector(o RedirectOptions) (*Redirector, error) {
+	if !o.HTTPS && o.Host == "" && o.TrailingSlash == "" {
+		return nil, fmt.Errorf("Provide at least one redirect rule")
+	}
+	if o.TrailingSlash != "" && o.TrailingSlash != TrailingSlashAdd && o.TrailingSlash != TrailingSlashRemove {
+		return nil, fmt.Errorf("Unsupported trailing slash rule: %q", o.TrailingSlash)
+	}
+	return &Redirector{options: o}, nil
+}
+
+func (rd *Redirector) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	location, ok := rd.redirectLocation(req)
+	if !ok {
+		return nil, nil
+	}
+	code := http.StatusMovedPermanently
+	if req.Method != "GET" && req.Method != "HEAD" {
+		code = http.StatusPermanentRedirect
+	}
+	re := netutils.NewTextResponse(req, code, "")
+	re.Header.Set("Location", location)
+	return re, nil
+}
+
+func (rd *Redirector) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// redirectLocation returns the canonical location of the request, false if the request is already canonical
+func (rd *Redirector) redirectLocation(req *http.Request) (string, bool) {
+	scheme := netutils.RequestScheme(req)
+	host := req.Host
+	urlPath := req.URL.Path
+	if urlPath == "" {
+		urlPath = "/"
+	}
+
+	newScheme, newHost, newPath := scheme, host, urlPath
+	if rd.options.HTTPS && scheme != "https" {
+		newScheme = "https"
+		// The port of the plain HTTP listener is of no use for HTTPS
+		if h, _, err := net.SplitHostPort(newHost); err == nil {
+			newHost = h
+		}
+	}
+	if rd.options.Host != "" && !strings.EqualFold(hostname(host), hostname(rd.options.Host)) {
+		newHost = rd.options.Host
+	}
+	switch rd.options.TrailingSlash {
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(newPath, "/") && !strings.Contains(path.Base(newPath), ".") {
+			newPath += "/"
+		}
+	case TrailingSlashRemove:
+		if newPath != "/" {
+			newPath = strings.TrimRight(newPath, "/")
+			if newPath == "" {
+				newPath = "/"
+			}
+		}
+	}
+	if newScheme == scheme && newHost == host && newPath == urlPath {
+		return "", false
+	}
+
+	u := netutils.CopyUrl(req.URL)
+	u.Opaque = ""
+	u.Path = newPath
+	u.RawPath = ""
+	u.Scheme, u.Host = "", ""
+	// Redirects within the same origin are relative, so they do not depend on the scheme seen by the proxy
+	if newScheme != scheme || newHost != host {
+		u.Scheme, u.Host = newScheme, newHost
+	}
+	return u.String(), true
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
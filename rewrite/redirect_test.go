@@ -0,0 +1,86 @@
+package rewrite
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type RedirectSuite struct{}
+
+var _ = Suite(&RedirectSuite{})
+
+func (s *RedirectSuite) TestRedirects(c *C) {
+	tcs := []struct {
+		options  RedirectOptions
+		method   string
+		url      string
+		proto    string
+		code     int
+		location string
+	}{
+		{RedirectOptions{HTTPS: true}, "GET", "http://example.com:8080/a?b=c", "", 301, "https://example.com/a?b=c"},
+		{RedirectOptions{HTTPS: true}, "POST", "http://example.com/a", "", 308, "https://example.com/a"},
+		{RedirectOptions{HTTPS: true}, "GET", "http://example.com/a", "https", 0, ""},
+		{RedirectOptions{Host: "www.example.com"}, "GET", "http://example.com/a", "", 301, "http://www.example.com/a"},
+		{RedirectOptions{Host: "www.example.com"}, "GET", "http://WWW.example.com/a", "", 0, ""},
+		{RedirectOptions{Host: "example.com"}, "GET", "http://www.example.com/", "", 301, "http://example.com/"},
+		{RedirectOptions{TrailingSlash: TrailingSlashAdd}, "GET", "http://example.com/a?b=c", "", 301, "/a/?b=c"},
+		{RedirectOptions{TrailingSlash: TrailingSlashAdd}, "GET", "http://example.com/a/", "", 0, ""},
+		{RedirectOptions{TrailingSlash: TrailingSlashAdd}, "GET", "http://example.com/favicon.ico", "", 0, ""},
+		{RedirectOptions{TrailingSlash: TrailingSlashRemove}, "GET", "http://example.com/a//", "", 301, "/a"},
+		{RedirectOptions{TrailingSlash: TrailingSlashRemove}, "GET", "http://example.com/", "", 0, ""},
+		{RedirectOptions{HTTPS: true, Host: "www.example.com", TrailingSlash: TrailingSlashAdd}, "GET", "http://example.com/a", "", 301, "https://www.example.com/a/"},
+	}
+	for i, tc := range tcs {
+		rd, err := NewRedirector(tc.options)
+		c.Assert(err, IsNil)
+
+		r := makeRedirectRequest(tc.method, tc.url)
+		if tc.proto != "" {
+			r.GetHttpRequest().Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		re, err := rd.ProcessRequest(r)
+		c.Assert(err, IsNil)
+		if tc.code == 0 {
+			c.Assert(re, IsNil, Commentf("case %d", i))
+			continue
+		}
+		c.Assert(re, NotNil, Commentf("case %d", i))
+		c.Assert(re.StatusCode, Equals, tc.code, Commentf("case %d", i))
+		c.Assert(re.Header.Get("Location"), Equals, tc.location, Commentf("case %d", i))
+	}
+}
+
+func (s *RedirectSuite) TestTLS(c *C) {
+	rd, err := NewRedirector(RedirectOptions{HTTPS: true})
+	c.Assert(err, IsNil)
+
+	r := makeRedirectRequest("GET", "https://example.com/a")
+	r.GetHttpRequest().TLS = &tls.ConnectionState{}
+	re, err := rd.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *RedirectSuite) TestBadParams(c *C) {
+	_, err := NewRedirector(RedirectOptions{})
+	c.Assert(err, NotNil)
+
+	_, err = NewRedirector(RedirectOptions{TrailingSlash: "sometimes"})
+	c.Assert(err, NotNil)
+}
+
+func makeRedirectRequest(method, rawURL string) request.Request {
+	u := netutils.MustParseUrl(rawURL)
+	return request.NewBaseRequest(&http.Request{
+		Method:     method,
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header:     http.Header{},
+	}, 1, nil)
+}
@@ -0,0 +1,130 @@
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/request"
+)
+
+// template is the value with ${variable} references expanded for every request. Supported variables:
+//
+//	client.ip             - address of the client, see Request.GetClientIP
+//	request.id            - X-Request-Id set by the proxy, the sequential request id otherwise
+//	request.host          - host requested by the client
+//	request.method        - request method
+//	request.path          - URL path
+//	request.header.<name> - value of the request header
+//	hostname              - name of the host the proxy is running on
+type template []templatePart
+
+type templatePart struct {
+	literal  string
+	variable func(r request.Request) string
+}
+
+// variableContext holds the settings the variables depend on
+type variableContext struct {
+	hostname string
+}
+
+func newVariableContext() (*variableContext, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &variableContext{hostname: hostname}, nil
+}
+
+func (vc *variableContext) parseTemplate(in string) (template, error) {
+	var t template
+	for {
+		start := strings.Index(in, "${")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(in[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("Unterminated variable in %q", in)
+		}
+		if start > 0 {
+			t = append(t, templatePart{literal: in[:start]})
+		}
+		fn, err := vc.variable(in[start+2 : start+end])
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, templatePart{variable: fn})
+		in = in[start+end+1:]
+	}
+	if in != "" {
+		t = append(t, templatePart{literal: in})
+	}
+	return t, nil
+}
+
+func (vc *variableContext) variable(name string) (func(r request.Request) string, error) {
+	switch name {
+	case "client.ip":
+		return func(r request.Request) string {
+			ip := r.GetClientIP()
+			if ip == nil {
+				return ""
+			}
+			return ip.String()
+		}, nil
+	case "request.id":
+		return func(r request.Request) string {
+			if id := r.GetHttpRequest().Header.Get(headers.XRequestId); id != "" {
+				return id
+			}
+			return strconv.FormatInt(r.GetId(), 10)
+		}, nil
+	case "request.host":
+		return func(r request.Request) string {
+			return r.GetHttpRequest().Host
+		}, nil
+	case "request.method":
+		return func(r request.Request) string {
+			return r.GetHttpRequest().Method
+		}, nil
+	case "request.path":
+		return func(r request.Request) string {
+			return r.GetHttpRequest().URL.Path
+		}, nil
+	case "hostname":
+		return func(r request.Request) string {
+			return vc.hostname
+		}, nil
+	}
+	if strings.HasPrefix(name, "request.header.") {
+		header := http.CanonicalHeaderKey(strings.TrimPrefix(name, "request.header."))
+		if header == "" {
+			return nil, fmt.Errorf("Missing header name in %q", name)
+		}
+		return func(r request.Request) string {
+			return r.GetHttpRequest().Header.Get(header)
+		}, nil
+	}
+	return nil, fmt.Errorf("Unsupported variable: %q", name)
+}
+
+func (t template) expand(r request.Request) string {
+	if len(t) == 1 && t[0].variable == nil {
+		return t[0].literal
+	}
+	b := &bytes.Buffer{}
+	for _, p := range t {
+		if p.variable != nil {
+			b.WriteString(p.variable(r))
+		} else {
+			b.WriteString(p.literal)
+		}
+	}
+	return b.String()
+}
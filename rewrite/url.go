@@ -0,0 +1,131 @@
+package rewrite
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/request"
+)
+
+// URLRule rewrites the requests with the URI matching the pattern
+type URLRule struct {
+	// Regular expression matched against the request URI, i.e. the path with the query string
+	Pattern string
+	// Replacement of the matched part of the URI, can reference the capture groups as $1 or ${name}
+	Replacement string
+	// Host to send to the endpoint, can reference the capture groups as well. Empty value keeps the host
+	Host string
+}
+
+// URLRewriter rewrites the request URI and the host before the request is proxied to the endpoint.
+// Rules are tried in order and the first matching rule wins:
+//
+//	ur, _ := rewrite.NewURLRewriter([]rewrite.URLRule{
+//		{Pattern: `^/api/v1/(.*)$`, Replacement: "/v1/$1"},
+//	})
+//
+// The original URI is kept in the request user data under OriginalURIKey.
+type URLRewriter struct {
+	rules   []*urlRule
+	options URLOptions
+}
+
+type URLOptions struct {
+	// Only log the rewrites without changing the requests, useful to check the rules against the live traffic
+	DryRun bool
+}
+
+type urlRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	host        string
+}
+
+func NewURLRewriter(rules []URLRule) (*URLRewriter, error) {
+	return NewURLRewriterWithOptions(rules, URLOptions{})
+}
+
+func NewURLRewriterWithOptions(rules []URLRule, o URLOptions) (*URLRewriter, error) {
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("Provide at least one rule")
+	}
+	out := make([]*urlRule, len(rules))
+	for i, r := range rules {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Bad pattern %q: %s", r.Pattern, err)
+		}
+		if r.Replacement == "" && r.Host == "" {
+			return nil, fmt.Errorf("Rule %q has neither replacement nor host", r.Pattern)
+		}
+		out[i] = &urlRule{pattern: pattern, replacement: r.Replacement, host: r.Host}
+	}
+	return &URLRewriter{rules: out, options: o}, nil
+}
+
+func (u *URLRewriter) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	for _, rule := range u.rules {
+		match := rule.pattern.FindStringSubmatchIndex(uri)
+		if match == nil {
+			continue
+		}
+		newURI, newHost := uri, req.Host
+		if rule.replacement != "" {
+			newURI = rule.pattern.ReplaceAllString(uri, rule.replacement)
+		}
+		if rule.host != "" {
+			newHost = string(rule.pattern.ExpandString(nil, rule.host, uri, match))
+		}
+		parsed, err := url.ParseRequestURI(newURI)
+		if err != nil {
+			log.Errorf("%s rule %q produced invalid URI %q, leaving request as is: %s", r, rule.pattern, newURI, err)
+			return nil, nil
+		}
+		if u.options.DryRun {
+			log.Infof("%s would be rewritten to %s%s", r, newHost, newURI)
+			return nil, nil
+		}
+		if _, ok := r.GetUserData(OriginalURIKey); !ok {
+			r.SetUserData(OriginalURIKey, uri)
+		}
+		setURI(req, newURI, parsed)
+		req.Host = newHost
+		return nil, nil
+	}
+	return nil, nil
+}
+
+func (u *URLRewriter) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// GetOriginalURI returns the request URI sent by the client if the request has been rewritten
+func GetOriginalURI(r request.Request) (string, bool) {
+	v, ok := r.GetUserData(OriginalURIKey)
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+// setURI updates the request URI, the URL is replaced rather than changed in place,
+// as it's shared with the original request that is copied again for the next attempt
+func setURI(req *http.Request, uri string, parsed *url.URL) {
+	u := *req.URL
+	u.Path = parsed.Path
+	u.RawPath = parsed.RawPath
+	// Proxy sends the opaque URI to the endpoint, it already has the query string
+	u.Opaque = uri
+	u.RawQuery = ""
+	req.URL = &u
+	req.RequestURI = uri
+}
+
+const OriginalURIKey = "rewrite.original_uri"
@@ -0,0 +1,116 @@
+package rewrite
+
+import (
+	"net/http"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type URLSuite struct{}
+
+var _ = Suite(&URLSuite{})
+
+func (s *URLSuite) TestRewrite(c *C) {
+	u, err := NewURLRewriter([]URLRule{
+		{Pattern: `^/api/v1/(?P<rest>.*)$`, Replacement: "/v1/${rest}"},
+		{Pattern: `^/users/(\d+)`, Replacement: "/profile?id=$1"},
+	})
+	c.Assert(err, IsNil)
+
+	r := makeURIRequest("/api/v1/users?limit=10")
+	re, err := u.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	req := r.GetHttpRequest()
+	c.Assert(req.RequestURI, Equals, "/v1/users?limit=10")
+	c.Assert(req.URL.Opaque, Equals, "/v1/users?limit=10")
+	c.Assert(req.URL.Path, Equals, "/v1/users")
+	c.Assert(req.Host, Equals, "localhost")
+
+	original, ok := GetOriginalURI(r)
+	c.Assert(ok, Equals, true)
+	c.Assert(original, Equals, "/api/v1/users?limit=10")
+
+	r = makeURIRequest("/users/42")
+	_, err = u.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetHttpRequest().RequestURI, Equals, "/profile?id=42")
+
+	// Requests that match no rules are not changed
+	r = makeURIRequest("/other")
+	_, err = u.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetHttpRequest().RequestURI, Equals, "/other")
+	_, ok = GetOriginalURI(r)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *URLSuite) TestOriginalURLIsNotChanged(c *C) {
+	u, err := NewURLRewriter([]URLRule{{Pattern: `^/a`, Replacement: "/b"}})
+	c.Assert(err, IsNil)
+
+	r := makeURIRequest("/a")
+	original := r.GetHttpRequest().URL
+	_, err = u.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetHttpRequest().URL.Path, Equals, "/b")
+	c.Assert(original.Path, Equals, "/a")
+}
+
+func (s *URLSuite) TestRewriteHost(c *C) {
+	u, err := NewURLRewriter([]URLRule{{Pattern: `^/tenants/(\w+)/(.*)$`, Replacement: "/$2", Host: "$1.internal"}})
+	c.Assert(err, IsNil)
+
+	r := makeURIRequest("/tenants/acme/orders")
+	_, err = u.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetHttpRequest().Host, Equals, "acme.internal")
+	c.Assert(r.GetHttpRequest().RequestURI, Equals, "/orders")
+}
+
+func (s *URLSuite) TestDryRun(c *C) {
+	u, err := NewURLRewriterWithOptions([]URLRule{{Pattern: `^/a`, Replacement: "/b", Host: "example.com"}}, URLOptions{DryRun: true})
+	c.Assert(err, IsNil)
+
+	r := makeURIRequest("/a")
+	_, err = u.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetHttpRequest().RequestURI, Equals, "/a")
+	c.Assert(r.GetHttpRequest().Host, Equals, "localhost")
+	_, ok := GetOriginalURI(r)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *URLSuite) TestInvalidResult(c *C) {
+	u, err := NewURLRewriter([]URLRule{{Pattern: `^/a`, Replacement: "b"}})
+	c.Assert(err, IsNil)
+
+	r := makeURIRequest("/a")
+	_, err = u.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.GetHttpRequest().RequestURI, Equals, "/a")
+}
+
+func (s *URLSuite) TestBadParams(c *C) {
+	bad := [][]URLRule{
+		nil,
+		{{Pattern: `(`, Replacement: "/"}},
+		{{Pattern: `^/a`}},
+	}
+	for _, rules := range bad {
+		_, err := NewURLRewriter(rules)
+		c.Assert(err, NotNil)
+	}
+}
+
+func makeURIRequest(uri string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     "GET",
+		Host:       "localhost",
+		URL:        netutils.MustParseUrl("http://localhost" + uri),
+		RequestURI: uri,
+		Header:     http.Header{},
+	}, 1, nil)
+}
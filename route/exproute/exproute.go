@@ -3,6 +3,18 @@ Expression based request router, supports functions and combinations of function
 
 <What to match><Matching verb> and || and && operators.
 
+Supported functions are:
+
+* TrieRoute("GET", "/path/<param>") or RegexpRoute("/path/.*") - match the request path, optionally the methods
+* Host("api.example.com") - matches the request host, ignoring port
+* Method("GET", "POST") - matches any of the request methods
+* Header("X-Name") or Header("X-Name", "value") - matches the header presence or its value
+
+Functions can be joined with && operator, e.g.
+
+	TrieRoute(`/users`) && Host(`api.example.com`) && Header(`X-Version`, `2`)
+
+At most one path function is allowed per expression.
 */
 package exproute
 
@@ -10,22 +22,31 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mailgun/vulcan/location"
 	"github.com/mailgun/vulcan/request"
 )
 
+// ExpRouter compiles expressions into matchers, merging path tries together,
+// so lookups take time proportional to the path length rather than the number of routes.
+// Compiled matchers are swapped atomically on every change, so Route never takes a lock.
 type ExpRouter struct {
-	mutex    *sync.RWMutex
-	matchers []matcher
+	// Mutex serializes changes to the routes, readers use the compiled snapshot
+	mutex *sync.RWMutex
+	// Holds the current []matcher snapshot
+	matchers *atomic.Value
 	routes   map[string]location.Location
 }
 
 func NewExpRouter() *ExpRouter {
-	return &ExpRouter{
-		mutex:  &sync.RWMutex{},
-		routes: make(map[string]location.Location),
+	e := &ExpRouter{
+		mutex:    &sync.RWMutex{},
+		matchers: &atomic.Value{},
+		routes:   make(map[string]location.Location),
 	}
+	e.matchers.Store([]matcher{})
+	return e
 }
 
 func (e *ExpRouter) GetLocationByExpression(expr string) location.Location {
@@ -82,10 +103,15 @@ func (e *ExpRouter) compile() error {
 		}
 	}
 
-	e.matchers = matchers
+	e.matchers.Store(matchers)
 	return nil
 }
 
+// Note that compiled matchers are never modified after they've been stored
+func (e *ExpRouter) getMatchers() []matcher {
+	return e.matchers.Load().([]matcher)
+}
+
 func (e *ExpRouter) RemoveLocationByExpression(expr string) error {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
@@ -119,14 +145,12 @@ func (e *ExpRouter) GetLocationById(id string) location.Location {
 }
 
 func (e *ExpRouter) Route(req request.Request) (location.Location, error) {
-	e.mutex.RLock()
-	defer e.mutex.RUnlock()
-
-	if len(e.matchers) == 0 {
+	matchers := e.getMatchers()
+	if len(matchers) == 0 {
 		return nil, nil
 	}
 
-	for _, m := range e.matchers {
+	for _, m := range matchers {
 		if l := m.match(req); l != nil {
 			return l, nil
 		}
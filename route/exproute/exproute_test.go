@@ -1,6 +1,8 @@
 package exproute
 
 import (
+	"fmt"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -73,7 +75,7 @@ func (s *RouteSuite) TestTrieOperations(c *C) {
 	c.Assert(r.AddLocation(`TrieRoute("/r2")`, l2), IsNil)
 
 	// Make sure that compression worked and we have just one matcher
-	c.Assert(len(r.matchers), Equals, 1)
+	c.Assert(len(r.getMatchers()), Equals, 1)
 
 	out1, err := r.Route(makeReq("http://google.com/r1"))
 	c.Assert(err, IsNil)
@@ -192,3 +194,74 @@ func (s *RouteSuite) TestRegexpMatchLongestPath(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(out, Equals, l2)
 }
+
+// Routing proceeds while the routes are being changed
+func (s *RouteSuite) TestRouteWhileUpdating(c *C) {
+	r := NewExpRouter()
+	l1 := makeLoc("loc1")
+	c.Assert(r.AddLocation(`TrieRoute("/r1")`, l1), IsNil)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			r.AddLocation(fmt.Sprintf(`TrieRoute("/r1/%d")`, i), makeLoc(fmt.Sprintf("loc%d", i)))
+		}
+		close(done)
+	}()
+
+	for {
+		l, err := r.Route(makeReq("http://google.com/r1"))
+		c.Assert(err, IsNil)
+		c.Assert(l, Equals, l1)
+		select {
+		case <-done:
+			l, err = r.Route(makeReq("http://google.com/r1/99"))
+			c.Assert(err, IsNil)
+			c.Assert(l.GetId(), Equals, "loc99")
+			return
+		default:
+		}
+	}
+}
+
+func (s *RouteSuite) BenchmarkRouteManyLocations(c *C) {
+	c.StopTimer()
+	r := NewExpRouter()
+	for i := 0; i < 1000; i++ {
+		c.Assert(r.AddLocation(fmt.Sprintf(`TrieRoute("/api/v1/users%d/<id>")`, i), makeLoc(fmt.Sprintf("loc%d", i))), IsNil)
+	}
+	req := makeReq("http://google.com/api/v1/users999/123")
+	c.StartTimer()
+	for i := 0; i < c.N; i++ {
+		r.Route(req)
+	}
+}
+
+func (s *RouteSuite) TestMatchByHost(c *C) {
+	r := NewExpRouter()
+
+	l1 := makeLoc("loc1")
+	c.Assert(r.AddLocation(`TrieRoute("/r1") && Host("a.com")`, l1), IsNil)
+
+	l2 := makeLoc("loc2")
+	c.Assert(r.AddLocation(`TrieRoute("/r1") && Host("b.com")`, l2), IsNil)
+
+	// Tries with the host conditions are still merged into one
+	c.Assert(len(r.getMatchers()), Equals, 1)
+
+	req := makeReq("http://a.com/r1")
+	req.GetHttpRequest().Host = "a.com"
+	out, err := r.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, l1)
+
+	req.GetHttpRequest().Host = "b.com"
+	out, err = r.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, l2)
+
+	req.GetHttpRequest().Host = "c.com"
+	out, err = r.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+}
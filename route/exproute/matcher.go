@@ -5,6 +5,7 @@ import (
 	"github.com/mailgun/vulcan/location"
 	"github.com/mailgun/vulcan/request"
 	"regexp"
+	"strings"
 )
 
 type matcher interface {
@@ -103,3 +104,57 @@ func (m *methodMatcher) match(req request.Request) location.Location {
 	}
 	return nil
 }
+
+// Matches request by its host, ignoring port and case
+type hostMatcher struct {
+	host    string
+	matcher matcher
+}
+
+func (m *hostMatcher) canMerge(matcher) bool {
+	return false
+}
+
+func (m *hostMatcher) merge(matcher) (matcher, error) {
+	return nil, fmt.Errorf("Method not supported")
+}
+
+func (m *hostMatcher) match(req request.Request) location.Location {
+	host := strings.Split(strings.ToLower(req.GetHttpRequest().Host), ":")[0]
+	if host == m.host {
+		return m.matcher.match(req)
+	}
+	return nil
+}
+
+// Matches request by header presence or by the header value
+type headerMatcher struct {
+	name       string
+	value      string
+	matchValue bool
+	matcher    matcher
+}
+
+func (m *headerMatcher) canMerge(matcher) bool {
+	return false
+}
+
+func (m *headerMatcher) merge(matcher) (matcher, error) {
+	return nil, fmt.Errorf("Method not supported")
+}
+
+func (m *headerMatcher) match(req request.Request) location.Location {
+	values, ok := req.GetHttpRequest().Header[m.name]
+	if !ok {
+		return nil
+	}
+	if !m.matchValue {
+		return m.matcher.match(req)
+	}
+	for _, v := range values {
+		if v == m.value {
+			return m.matcher.match(req)
+		}
+	}
+	return nil
+}
@@ -5,13 +5,17 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/mailgun/vulcan/location"
 )
 
 // Parses expression in the go language into matchers, e.g.
 // `TrieRoute("/path")` will be parsed into trie matcher
+// `TrieRoute("/path") && Host("api.example.com")` will be parsed into trie matcher
+// that checks the host once the path matches.
 // Enforces expression to use only registered functions and string literals
 func parseExpression(in string, l location.Location) (matcher, error) {
 	expr, err := parser.ParseExpr(in)
@@ -19,46 +23,86 @@ func parseExpression(in string, l location.Location) (matcher, error) {
 		return nil, err
 	}
 
+	calls, err := parseCalls(expr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var pathCall *funcCall
+	conditions := []*funcCall{}
+	for _, call := range calls {
+		if call.name == TrieRouteFn || call.name == RegexpRouteFn {
+			if pathCall != nil {
+				return nil, fmt.Errorf("Only one of %s or %s is allowed in expression", TrieRouteFn, RegexpRouteFn)
+			}
+			pathCall = call
+		} else {
+			conditions = append(conditions, call)
+		}
+	}
+
 	var matcher matcher
 	matcher = &constMatcher{location: l}
-	var call *funcCall
+	// Wrap in reverse order, so conditions are checked in the order they appear in the expression
+	for i := len(conditions) - 1; i >= 0; i-- {
+		matcher, err = createConditionMatcher(matcher, conditions[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pathCall == nil {
+		return matcher, nil
+	}
+	return createMatcher(matcher, pathCall)
+}
 
-	ast.Inspect(expr, func(n ast.Node) bool {
-		// If error condition has been triggered, stop inspecting.
+// Flattens the chain of function calls joined by && operator
+func parseCalls(expr ast.Expr, calls []*funcCall) ([]*funcCall, error) {
+	switch x := expr.(type) {
+	case *ast.ParenExpr:
+		return parseCalls(x.X, calls)
+	case *ast.BinaryExpr:
+		if x.Op != token.LAND {
+			return nil, fmt.Errorf("Unsupported operator: %s", x.Op)
+		}
+		calls, err := parseCalls(x.X, calls)
 		if err != nil {
-			return false
+			return nil, err
 		}
-		switch x := n.(type) {
+		return parseCalls(x.Y, calls)
+	case *ast.CallExpr:
+		call, err := parseCall(x)
+		if err != nil {
+			return nil, err
+		}
+		return append(calls, call), nil
+	case *ast.BasicLit:
+		return nil, fmt.Errorf("Literals are supported only as function arguments")
+	case *ast.Ident:
+		return nil, fmt.Errorf("Unsupported identifier")
+	}
+	return nil, fmt.Errorf("Unsupported %T", expr)
+}
+
+func parseCall(x *ast.CallExpr) (*funcCall, error) {
+	ident, ok := x.Fun.(*ast.Ident)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported function %T", x.Fun)
+	}
+	call := &funcCall{name: ident.Name}
+	for _, arg := range x.Args {
+		switch a := arg.(type) {
 		case *ast.BasicLit:
-			if call == nil {
-				err = fmt.Errorf("Literals are supported only as function arguments")
-				return false
+			if err := addFunctionArgument(call, a); err != nil {
+				return nil, err
 			}
-			err = addFunctionArgument(call, x)
 		case *ast.CallExpr:
-			if call != nil {
-				err = fmt.Errorf("Nested function calls are not allowed")
-				return false
-			}
-			call = &funcCall{}
-		case *ast.Ident:
-			if call == nil {
-				err = fmt.Errorf("Unsupported identifier")
-				return false
-			}
-			call.name = x.Name
+			return nil, fmt.Errorf("Nested function calls are not allowed")
 		default:
-			if x != nil {
-				err = fmt.Errorf("Unsupported %T", n)
-				return false
-			}
+			return nil, fmt.Errorf("Unsupported argument %T", arg)
 		}
-		return true
-	})
-	if err != nil {
-		return nil, err
 	}
-	return createMatcher(matcher, call)
+	return call, nil
 }
 
 func addFunctionArgument(call *funcCall, a *ast.BasicLit) error {
@@ -83,6 +127,18 @@ func createMatcher(currentMatcher matcher, call *funcCall) (matcher, error) {
 	return nil, fmt.Errorf("Unsupported method: %s", call.name)
 }
 
+func createConditionMatcher(currentMatcher matcher, call *funcCall) (matcher, error) {
+	switch call.name {
+	case HostFn:
+		return makeHostMatcher(currentMatcher, call.args)
+	case MethodFn:
+		return makeMethodMatcher(currentMatcher, call.args)
+	case HeaderFn:
+		return makeHeaderMatcher(currentMatcher, call.args)
+	}
+	return nil, fmt.Errorf("Unsupported method: %s", call.name)
+}
+
 type funcCall struct {
 	name string
 	args []interface{}
@@ -130,6 +186,48 @@ func makeRegexpRouteMatcher(matcher matcher, params []interface{}) (matcher, err
 	return t, nil
 }
 
+func makeHostMatcher(matcher matcher, params []interface{}) (matcher, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("%s accepts exactly one argument - hostname to match", HostFn)
+	}
+	args, err := toStrings(params)
+	if err != nil {
+		return nil, err
+	}
+	if args[0] == "" {
+		return nil, fmt.Errorf("%s - hostname can not be empty", HostFn)
+	}
+	return &hostMatcher{host: strings.ToLower(args[0]), matcher: matcher}, nil
+}
+
+func makeMethodMatcher(matcher matcher, params []interface{}) (matcher, error) {
+	if len(params) == 0 {
+		return nil, fmt.Errorf("%s accepts at least one argument - method to match", MethodFn)
+	}
+	args, err := toStrings(params)
+	if err != nil {
+		return nil, err
+	}
+	return &methodMatcher{methods: args, matcher: matcher}, nil
+}
+
+// Header("X-Name") matches if the header is present, Header("X-Name", "value") matches the header value
+func makeHeaderMatcher(matcher matcher, params []interface{}) (matcher, error) {
+	if len(params) != 1 && len(params) != 2 {
+		return nil, fmt.Errorf("%s accepts header name and optional header value", HeaderFn)
+	}
+	args, err := toStrings(params)
+	if err != nil {
+		return nil, err
+	}
+	m := &headerMatcher{name: http.CanonicalHeaderKey(args[0]), matcher: matcher}
+	if len(args) == 2 {
+		m.value = args[1]
+		m.matchValue = true
+	}
+	return m, nil
+}
+
 func toStrings(in []interface{}) ([]string, error) {
 	out := make([]string, len(in))
 	for i, v := range in {
@@ -145,4 +243,7 @@ func toStrings(in []interface{}) ([]string, error) {
 const (
 	TrieRouteFn   = "TrieRoute"
 	RegexpRouteFn = "RegexpRoute"
+	HostFn        = "Host"
+	MethodFn      = "Method"
+	HeaderFn      = "Header"
 )
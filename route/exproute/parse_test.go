@@ -1,6 +1,8 @@
 package exproute
 
 import (
+	"net/http"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -45,6 +47,21 @@ func (s *TrieSuite) TestParseSuccess(c *C) {
 			`http://google.com/helloworld`,
 			"POST",
 		},
+		{
+			"TrieRoute(`/helloworld`) && Host(`google.com`)",
+			`http://google.com/helloworld`,
+			"GET",
+		},
+		{
+			`(RegexpRoute("/hello.*") && Method("PUT", "POST")) && Host("google.com")`,
+			`http://google.com/helloworld`,
+			"POST",
+		},
+		{
+			`Host("Google.com")`,
+			`http://google.com:8080/helloworld`,
+			"GET",
+		},
 	}
 	for _, tc := range testCases {
 		l := makeLoc(tc.Url)
@@ -54,6 +71,7 @@ func (s *TrieSuite) TestParseSuccess(c *C) {
 
 		req := makeReq(tc.Url)
 		req.GetHttpRequest().Method = tc.Method
+		req.GetHttpRequest().Host = req.GetHttpRequest().URL.Host
 		outLoc := m.match(req)
 		c.Assert(outLoc, Equals, l)
 	}
@@ -74,6 +92,14 @@ func (s *TrieSuite) TestParseFailures(c *C) {
 		`TrieRoute(RegexpRoute("hello"))`, // nested calls
 		`TrieRoute("")`,                   // bad trie expression
 		`RegexpRoute("[[[[")`,             // bad regular expression
+		`TrieRoute("/a") && RegexpRoute("/b")`,     // two path matchers
+		`TrieRoute("/a") && !Host("google.com")`,   // unsupported unary operator
+		`TrieRoute("/a") && Host()`,                // host without arguments
+		`TrieRoute("/a") && Host("a", "b")`,        // too many arguments
+		`TrieRoute("/a") && Method()`,              // method without arguments
+		`TrieRoute("/a") && Header()`,              // header without arguments
+		`TrieRoute("/a") && Header("a", "b", "c")`, // too many arguments
+		`TrieRoute("/a") && Unknown("a")`,          // unknown condition
 	}
 
 	for _, expr := range testCases {
@@ -82,3 +108,23 @@ func (s *TrieSuite) TestParseFailures(c *C) {
 		c.Assert(m, IsNil)
 	}
 }
+
+func (s *TrieSuite) TestParseHeader(c *C) {
+	l := makeLoc("loc1")
+	m, err := parseExpression(`TrieRoute("/a") && Header("x-version", "2")`, l)
+	c.Assert(err, IsNil)
+
+	req := makeReq("http://google.com/a")
+	req.GetHttpRequest().Header = http.Header{}
+	c.Assert(m.match(req), IsNil)
+
+	req.GetHttpRequest().Header.Set("X-Version", "1")
+	c.Assert(m.match(req), IsNil)
+
+	req.GetHttpRequest().Header.Set("X-Version", "2")
+	c.Assert(m.match(req), Equals, l)
+
+	m, err = parseExpression(`TrieRoute("/a") && Header("X-Version")`, l)
+	c.Assert(err, IsNil)
+	c.Assert(m.match(req), Equals, l)
+}
@@ -6,62 +6,52 @@ import (
 	. "github.com/mailgun/vulcan/location"
 	. "github.com/mailgun/vulcan/request"
 	. "github.com/mailgun/vulcan/route"
+	"sort"
 	"strings"
 	"sync"
 )
 
 // This router composer helps to match request by host header and uses inner
-// routes to do further matching
+// routes to do further matching. Hostnames can contain wildcards, e.g. *.example.com,
+// where each '*' matches exactly one domain label.
 type HostRouter struct {
 	routers map[string]Router
-	mutex   *sync.Mutex
+	// Wildcard hostnames sorted from the most specific to the least specific
+	wildcards []string
+	mutex     *sync.RWMutex
 }
 
 func NewHostRouter() *HostRouter {
 	return &HostRouter{
-		mutex:   &sync.Mutex{},
+		mutex:   &sync.RWMutex{},
 		routers: make(map[string]Router),
 	}
 }
 
 func (h *HostRouter) Route(req Request) (Location, error) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	router := h.findRouter(strings.Split(strings.ToLower(req.GetHttpRequest().Host), ":")[0])
+	if router == nil {
+		return nil, nil
+	}
+	return router.Route(req)
+}
 
-	hostname := strings.Split(strings.ToLower(req.GetHttpRequest().Host), ":")[0]
-	matcher, exists := h.routers[hostname]
+func (h *HostRouter) findRouter(hostname string) Router {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if router, exists := h.routers[hostname]; exists {
+		return router
+	}
 
 	// search for wildcard domains
-	if !exists {
-		hostname := strings.Split(hostname, ".")
-		for key, value := range h.routers {
-			keys := strings.Split(key, ".")
-
-			if len(hostname) != len(keys) {
-				continue
-			}
-
-			matches := true
-			for i := len(hostname) - 1; i >= 0; i-- {
-				if keys[i] == "*" {
-					continue
-				}
-
-				if hostname[i] != keys[i] {
-					matches = false
-					break
-				}
-			}
-
-			if matches {
-				return value.Route(req)
-			}
+	labels := strings.Split(hostname, ".")
+	for _, key := range h.wildcards {
+		if matchesWildcard(labels, strings.Split(key, ".")) {
+			return h.routers[key]
 		}
-
-		return nil, nil
 	}
-
-	return matcher.Route(req)
+	return nil
 }
 
 func (h *HostRouter) SetRouter(hostname string, router Router) error {
@@ -72,15 +62,17 @@ func (h *HostRouter) SetRouter(hostname string, router Router) error {
 		return fmt.Errorf("Router can not be nil")
 	}
 
+	hostname = normalizeHostname(hostname)
 	h.routers[hostname] = router
+	h.updateWildcards()
 	return nil
 }
 
 func (h *HostRouter) GetRouter(hostname string) Router {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
 
-	router := h.routers[hostname]
+	router := h.routers[normalizeHostname(hostname)]
 	return router
 }
 
@@ -88,5 +80,81 @@ func (h *HostRouter) RemoveRouter(hostname string) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	delete(h.routers, normalizeHostname(hostname))
+	h.updateWildcards()
+}
+
+// AddLocation routes all requests for the hostname to the location,
+// returns error if there's a router set for this hostname already.
+func (h *HostRouter) AddLocation(hostname string, location Location) error {
+	if location == nil {
+		return fmt.Errorf("Location can not be nil")
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hostname = normalizeHostname(hostname)
+	if _, exists := h.routers[hostname]; exists {
+		return fmt.Errorf("Hostname '%s' already exists", hostname)
+	}
+	h.routers[hostname] = &ConstRouter{Location: location}
+	h.updateWildcards()
+	return nil
+}
+
+// RemoveLocation removes the location set for the hostname by AddLocation
+func (h *HostRouter) RemoveLocation(hostname string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hostname = normalizeHostname(hostname)
+	if _, exists := h.routers[hostname]; !exists {
+		return fmt.Errorf("Hostname '%s' not found", hostname)
+	}
 	delete(h.routers, hostname)
+	h.updateWildcards()
+	return nil
+}
+
+func (h *HostRouter) updateWildcards() {
+	wildcards := []string{}
+	for key := range h.routers {
+		if strings.Contains(key, "*") {
+			wildcards = append(wildcards, key)
+		}
+	}
+	sort.Sort(bySpecificity(wildcards))
+	h.wildcards = wildcards
+}
+
+func matchesWildcard(hostname, keys []string) bool {
+	if len(hostname) != len(keys) {
+		return false
+	}
+	for i := len(hostname) - 1; i >= 0; i-- {
+		if keys[i] == "*" {
+			continue
+		}
+		if hostname[i] != keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeHostname(hostname string) string {
+	return strings.ToLower(hostname)
+}
+
+// Wildcards with less '*' are more specific, e.g. *.api.example.com is matched before *.*.example.com
+type bySpecificity []string
+
+func (a bySpecificity) Len() int      { return len(a) }
+func (a bySpecificity) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySpecificity) Less(i, j int) bool {
+	ci, cj := strings.Count(a[i], "*"), strings.Count(a[j], "*")
+	if ci != cj {
+		return ci < cj
+	}
+	return a[i] < a[j]
 }
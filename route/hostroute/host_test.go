@@ -85,6 +85,54 @@ func (s *HostSuite) TestRemove(c *C) {
 	c.Assert(out, Equals, nil)
 }
 
+func (s *HostSuite) TestAddRemoveLocation(c *C) {
+	m := NewHostRouter()
+	a := &Loc{Name: "a"}
+	c.Assert(m.AddLocation("google.com", a), IsNil)
+	c.Assert(m.AddLocation("google.com", a), NotNil)
+	c.Assert(m.AddLocation("yahoo.com", nil), NotNil)
+
+	out, err := m.Route(request("google.com", "http://google.com/"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, a)
+
+	c.Assert(m.RemoveLocation("google.com"), IsNil)
+	c.Assert(m.RemoveLocation("google.com"), NotNil)
+
+	out, err = m.Route(request("google.com", "http://google.com/"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, nil)
+}
+
+func (s *HostSuite) TestCaseInsensitive(c *C) {
+	m := NewHostRouter()
+	a := &Loc{Name: "a"}
+	c.Assert(m.AddLocation("Google.com", a), IsNil)
+
+	out, err := m.Route(request("GOOGLE.com:8080", "http://google.com/"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, a)
+}
+
+// The most specific wildcard wins regardless of the order they were added in
+func (s *HostSuite) TestWildcardSpecificity(c *C) {
+	m := NewHostRouter()
+	a := &Loc{Name: "a"}
+	b := &Loc{Name: "b"}
+	c.Assert(m.AddLocation("*.*.example.com", a), IsNil)
+	c.Assert(m.AddLocation("*.api.example.com", b), IsNil)
+
+	for i := 0; i < 10; i++ {
+		out, err := m.Route(request("v1.api.example.com", "http://v1.api.example.com/"))
+		c.Assert(err, IsNil)
+		c.Assert(out, Equals, b)
+	}
+
+	out, err := m.Route(request("v1.web.example.com", "http://v1.web.example.com/"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, a)
+}
+
 func request(hostname, url string) Request {
 	u := MustParseUrl(url)
 	hr := &http.Request{URL: u, Header: make(http.Header), Host: hostname}
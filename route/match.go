@@ -0,0 +1,187 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	. "github.com/mailgun/vulcan/location"
+	. "github.com/mailgun/vulcan/request"
+)
+
+// Matcher is a predicate that tells whether the request matches some condition.
+// Matchers can be combined with AND, OR and NOT to build routing rules.
+type Matcher func(req Request) bool
+
+// Method matches requests with any of the given methods
+func Method(methods ...string) Matcher {
+	return func(req Request) bool {
+		for _, m := range methods {
+			if req.GetHttpRequest().Method == m {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PathPrefix matches requests with the URL path starting with any of the given prefixes
+func PathPrefix(prefixes ...string) Matcher {
+	return func(req Request) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(req.GetHttpRequest().URL.Path, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasHeader matches requests that have the header set
+func HasHeader(name string) Matcher {
+	return func(req Request) bool {
+		_, ok := req.GetHttpRequest().Header[http.CanonicalHeaderKey(name)]
+		return ok
+	}
+}
+
+// Header matches requests that have the header set to the value
+func Header(name, value string) Matcher {
+	return func(req Request) bool {
+		for _, v := range req.GetHttpRequest().Header[http.CanonicalHeaderKey(name)] {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasQuery matches requests that have the query parameter set
+func HasQuery(name string) Matcher {
+	return func(req Request) bool {
+		_, ok := req.GetHttpRequest().URL.Query()[name]
+		return ok
+	}
+}
+
+// Query matches requests that have the query parameter set to the value
+func Query(name, value string) Matcher {
+	return func(req Request) bool {
+		for _, v := range req.GetHttpRequest().URL.Query()[name] {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AND matches if all the matchers match
+func AND(ms ...Matcher) Matcher {
+	return func(req Request) bool {
+		for _, m := range ms {
+			if !m(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// OR matches if any of the matchers matches
+func OR(ms ...Matcher) Matcher {
+	return func(req Request) bool {
+		for _, m := range ms {
+			if m(req) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NOT creates negation of the passed matcher
+func NOT(m Matcher) Matcher {
+	return func(req Request) bool {
+		return !m(req)
+	}
+}
+
+// MatchRouter routes the request to the location of the first matching route,
+// routes are checked in the order they have been added.
+type MatchRouter struct {
+	mutex  *sync.RWMutex
+	routes []matchRoute
+}
+
+type matchRoute struct {
+	id       string
+	matcher  Matcher
+	location Location
+}
+
+func NewMatchRouter() *MatchRouter {
+	return &MatchRouter{
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (m *MatchRouter) Route(req Request) (Location, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, r := range m.routes {
+		if r.matcher(req) {
+			return r.location, nil
+		}
+	}
+	return nil, nil
+}
+
+// AddRoute adds the route with unique id to the end of the routes list
+func (m *MatchRouter) AddRoute(id string, matcher Matcher, location Location) error {
+	if matcher == nil || location == nil {
+		return fmt.Errorf("Provide matcher and location")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, i := m.find(id); i != -1 {
+		return fmt.Errorf("Route with id: %s already exists", id)
+	}
+	m.routes = append(m.routes, matchRoute{id: id, matcher: matcher, location: location})
+	return nil
+}
+
+func (m *MatchRouter) RemoveRoute(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, i := m.find(id)
+	if i == -1 {
+		return fmt.Errorf("Route with id: %s not found", id)
+	}
+	m.routes = append(m.routes[:i], m.routes[i+1:]...)
+	return nil
+}
+
+func (m *MatchRouter) GetLocation(id string) Location {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if r, i := m.find(id); i != -1 {
+		return r.location
+	}
+	return nil
+}
+
+func (m *MatchRouter) find(id string) (*matchRoute, int) {
+	for i := range m.routes {
+		if m.routes[i].id == id {
+			return &m.routes[i], i
+		}
+	}
+	return nil, -1
+}
@@ -0,0 +1,92 @@
+package route
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestRoute(t *testing.T) { TestingT(t) }
+
+type MatchSuite struct {
+}
+
+var _ = Suite(&MatchSuite{})
+
+func (s *MatchSuite) TestMatchers(c *C) {
+	req := request("POST", "http://google.com/path?a=1&b=2")
+	req.GetHttpRequest().Header.Set("X-Version", "2")
+
+	testCases := []struct {
+		m        Matcher
+		expected bool
+	}{
+		{Method("POST"), true},
+		{Method("GET", "POST"), true},
+		{Method("GET"), false},
+		{PathPrefix("/pa"), true},
+		{PathPrefix("/other", "/path"), true},
+		{PathPrefix("/other"), false},
+		{HasHeader("x-version"), true},
+		{HasHeader("X-Other"), false},
+		{Header("X-Version", "2"), true},
+		{Header("X-Version", "1"), false},
+		{HasQuery("a"), true},
+		{HasQuery("c"), false},
+		{Query("b", "2"), true},
+		{Query("b", "1"), false},
+		{AND(Method("POST"), Query("a", "1")), true},
+		{AND(Method("POST"), Query("a", "2")), false},
+		{OR(Method("GET"), Query("a", "1")), true},
+		{OR(Method("GET"), Query("a", "2")), false},
+		{NOT(Method("GET")), true},
+		{NOT(Method("POST")), false},
+	}
+	for i, tc := range testCases {
+		c.Assert(tc.m(req), Equals, tc.expected, Commentf("test case %d", i))
+	}
+}
+
+func (s *MatchSuite) TestMatchRouter(c *C) {
+	r := NewMatchRouter()
+	a := &Loc{Name: "a"}
+	b := &Loc{Name: "b"}
+
+	c.Assert(r.AddRoute("a", AND(Method("POST"), HasHeader("X-Version")), a), IsNil)
+	c.Assert(r.AddRoute("b", Method("POST"), b), IsNil)
+	c.Assert(r.AddRoute("b", Method("GET"), b), NotNil)
+	c.Assert(r.AddRoute("c", nil, b), NotNil)
+
+	req := request("POST", "http://google.com/path")
+	out, err := r.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, b)
+
+	req.GetHttpRequest().Header.Set("X-Version", "2")
+	out, err = r.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, a)
+
+	out, err = r.Route(request("GET", "http://google.com/path"))
+	c.Assert(err, IsNil)
+	c.Assert(out, IsNil)
+
+	c.Assert(r.GetLocation("a"), Equals, a)
+	c.Assert(r.RemoveRoute("a"), IsNil)
+	c.Assert(r.RemoveRoute("a"), NotNil)
+	c.Assert(r.GetLocation("a"), IsNil)
+
+	out, err = r.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, b)
+}
+
+func request(method, url string) Request {
+	return &BaseRequest{
+		HttpRequest: &http.Request{Method: method, URL: netutils.MustParseUrl(url), Header: make(http.Header)},
+	}
+}
@@ -0,0 +1,197 @@
+// Mirror a sample of the production traffic to the secondary location
+package mirrorroute
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/mailgun/log"
+	. "github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "github.com/mailgun/vulcan/route"
+)
+
+// MirrorRouter routes requests with the inner router and asynchronously sends the copies
+// of the sampled requests to the mirror location. Responses of the mirror location are discarded,
+// so it can be used to test new backends with the production traffic without affecting clients.
+type MirrorRouter struct {
+	router  Router
+	mirror  Location
+	mutex   *sync.Mutex
+	percent int
+	// Number of the mirrored requests currently in flight
+	inFlight int
+	options  Options
+}
+
+type Options struct {
+	// Requests with bodies larger than this are not mirrored, as the body has to be kept in memory
+	MaxBodyBytes int64
+	// Maximum number of the mirrored requests in flight, requests over the limit are not mirrored
+	MaxInFlight int
+}
+
+const (
+	DefaultMaxBodyBytes = netutils.DefaultMemBufferBytes
+	DefaultMaxInFlight  = 100
+)
+
+func NewMirrorRouter(router Router, mirror Location, percent int) (*MirrorRouter, error) {
+	return NewMirrorRouterWithOptions(router, mirror, percent, Options{})
+}
+
+func NewMirrorRouterWithOptions(router Router, mirror Location, percent int, o Options) (*MirrorRouter, error) {
+	if router == nil || mirror == nil {
+		return nil, fmt.Errorf("Provide router and mirror location")
+	}
+	if err := validatePercent(percent); err != nil {
+		return nil, err
+	}
+	return &MirrorRouter{
+		router:  router,
+		mirror:  mirror,
+		mutex:   &sync.Mutex{},
+		percent: percent,
+		options: parseOptions(o),
+	}, nil
+}
+
+func (m *MirrorRouter) Route(req Request) (Location, error) {
+	location, err := m.router.Route(req)
+	if err != nil || location == nil {
+		return location, err
+	}
+	if m.sample(req) {
+		m.mirrorRequest(req)
+	}
+	return location, nil
+}
+
+// SetPercent changes the percentage of requests copied to the mirror location
+func (m *MirrorRouter) SetPercent(percent int) error {
+	if err := validatePercent(percent); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.percent = percent
+	return nil
+}
+
+func (m *MirrorRouter) GetPercent() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.percent
+}
+
+func (m *MirrorRouter) GetRouter() Router {
+	return m.router
+}
+
+func (m *MirrorRouter) GetMirror() Location {
+	return m.mirror
+}
+
+// Request ids are sequential, so taking them by modulo selects exactly the configured percentage
+func (m *MirrorRouter) sample(req Request) bool {
+	id := req.GetId()
+	if id < 0 {
+		id = -id
+	}
+	return id%100 < int64(m.GetPercent())
+}
+
+func (m *MirrorRouter) mirrorRequest(req Request) {
+	if !m.acquire() {
+		log.Infof("%s is not mirrored, too many mirrored requests in flight", req)
+		return
+	}
+	out, err := m.copyRequest(req.GetHttpRequest())
+	if err != nil {
+		m.release()
+		log.Infof("%s is not mirrored: %s", req, err)
+		return
+	}
+	go func() {
+		defer m.release()
+		response, err := m.mirror.RoundTrip(NewBaseRequest(out, req.GetId(), nil))
+		if err != nil {
+			log.Infof("Mirror %s failed: %s", m.mirror.GetId(), err)
+			return
+		}
+		if response != nil {
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+	}()
+}
+
+// copyRequest reads the request body into memory and returns the copy of the request that
+// is detached from the client connection, so the mirror round trip outlives the original request.
+func (m *MirrorRouter) copyRequest(r *http.Request) (*http.Request, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, m.options.MaxBodyBytes+1))
+		// Put back what we've read, so the original request is proxied intact
+		r.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > m.options.MaxBodyBytes {
+			return nil, fmt.Errorf("body exceeds %d bytes", m.options.MaxBodyBytes)
+		}
+	}
+
+	out := r.WithContext(context.Background())
+	u := *r.URL
+	out.URL = &u
+	out.Header = make(http.Header)
+	netutils.CopyHeaders(out.Header, r.Header)
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return out, nil
+}
+
+func (m *MirrorRouter) acquire() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.inFlight >= m.options.MaxInFlight {
+		return false
+	}
+	m.inFlight += 1
+	return true
+}
+
+func (m *MirrorRouter) release() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.inFlight -= 1
+}
+
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+func parseOptions(o Options) Options {
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = DefaultMaxInFlight
+	}
+	return o
+}
+
+func validatePercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("Percent should be in range [0, 100], got %d", percent)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package mirrorroute
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "github.com/mailgun/vulcan/route"
+	. "gopkg.in/check.v1"
+)
+
+func TestMirrorRoute(t *testing.T) { TestingT(t) }
+
+type MirrorSuite struct {
+	primary *Loc
+	router  *ConstRouter
+}
+
+var _ = Suite(&MirrorSuite{})
+
+func (s *MirrorSuite) SetUpTest(c *C) {
+	s.primary = &Loc{Name: "primary"}
+	s.router = &ConstRouter{Location: s.primary}
+}
+
+func (s *MirrorSuite) TestBadParams(c *C) {
+	_, err := NewMirrorRouter(nil, newRecorder(), 10)
+	c.Assert(err, NotNil)
+
+	_, err = NewMirrorRouter(s.router, newRecorder(), 101)
+	c.Assert(err, NotNil)
+
+	m, err := NewMirrorRouter(s.router, newRecorder(), 10)
+	c.Assert(err, IsNil)
+	c.Assert(m.SetPercent(-1), NotNil)
+	c.Assert(m.GetPercent(), Equals, 10)
+}
+
+func (s *MirrorSuite) TestMirrorRequest(c *C) {
+	mirror := newRecorder()
+	m, err := NewMirrorRouter(s.router, mirror, 100)
+	c.Assert(err, IsNil)
+
+	req := request(1, "hello")
+	out, err := m.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, s.primary)
+
+	// Original request body is intact
+	body, err := ioutil.ReadAll(req.GetHttpRequest().Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+
+	select {
+	case body := <-mirror.bodies:
+		c.Assert(body, Equals, "hello")
+	case <-time.After(time.Second):
+		c.Fatalf("request was not mirrored")
+	}
+}
+
+func (s *MirrorSuite) TestSampling(c *C) {
+	mirror := newRecorder()
+	m, err := NewMirrorRouter(s.router, mirror, 10)
+	c.Assert(err, IsNil)
+
+	for i := int64(0); i < 100; i++ {
+		_, err := m.Route(request(i, ""))
+		c.Assert(err, IsNil)
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case <-mirror.bodies:
+		case <-time.After(time.Second):
+			c.Fatalf("request was not mirrored")
+		}
+	}
+	select {
+	case <-mirror.bodies:
+		c.Fatalf("too many requests mirrored")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func (s *MirrorSuite) TestLargeBodyNotMirrored(c *C) {
+	mirror := newRecorder()
+	m, err := NewMirrorRouterWithOptions(s.router, mirror, 100, Options{MaxBodyBytes: 4})
+	c.Assert(err, IsNil)
+
+	req := request(1, "hello")
+	out, err := m.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, s.primary)
+
+	body, err := ioutil.ReadAll(req.GetHttpRequest().Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+
+	select {
+	case <-mirror.bodies:
+		c.Fatalf("request should not be mirrored")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// Records bodies of the requests it receives
+type recorder struct {
+	bodies chan string
+}
+
+func newRecorder() *recorder {
+	return &recorder{bodies: make(chan string, 100)}
+}
+
+func (r *recorder) GetId() string {
+	return "mirror"
+}
+
+func (r *recorder) RoundTrip(req Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.GetHttpRequest().Body)
+	if err != nil {
+		return nil, err
+	}
+	r.bodies <- string(body)
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+}
+
+func request(id int64, body string) Request {
+	hr := &http.Request{
+		Method: "POST",
+		URL:    netutils.MustParseUrl("http://google.com"),
+		Header: make(http.Header),
+		Body:   ioutil.NopCloser(strings.NewReader(body)),
+	}
+	return NewBaseRequest(hr, id, nil)
+}
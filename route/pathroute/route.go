@@ -8,12 +8,15 @@ import (
 	. "github.com/mailgun/vulcan/request"
 	"regexp"
 	"sort"
+	"strings"
 	"sync"
 )
 
-// Matches the location by path regular expression.
+// Matches the location by path prefix or path regular expression.
+// Out of two prefixes will select the longer one, prefixes are checked before regular expressions.
 // Out of two paths will select the one with the longer regular expression
 type PathRouter struct {
+	prefixes   []locPair
 	locations  []locPair
 	expression *regexp.Regexp
 	mutex      *sync.Mutex
@@ -40,15 +43,22 @@ func (m *PathRouter) Route(req Request) (Location, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if m.expression == nil {
-		return nil, nil
-	}
-
 	path := req.GetHttpRequest().URL.Path
 	if len(path) == 0 {
 		path = "/"
 	}
 
+	// Prefixes are sorted by length, so the first match is the longest one
+	for _, p := range m.prefixes {
+		if matchesPrefix(p.pattern, path) {
+			return p.location, nil
+		}
+	}
+
+	if m.expression == nil {
+		return nil, nil
+	}
+
 	matches := m.expression.FindStringSubmatchIndex(path)
 	if len(matches) < 2 {
 		return nil, nil
@@ -94,6 +104,42 @@ func (m *PathRouter) AddLocation(pattern string, location Location) error {
 	return nil
 }
 
+// AddPrefix routes requests with the path starting with prefix to the location.
+// Prefix matches whole path segments, e.g. /api matches /api and /api/users, but not /apiv2,
+// prefix with trailing slash /api/ matches everything under /api/.
+func (m *PathRouter) AddPrefix(prefix string, location Location) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("Prefix '%s' should start with /", prefix)
+	}
+	if location == nil {
+		return fmt.Errorf("Location can not be nil")
+	}
+	for _, p := range m.prefixes {
+		if p.pattern == prefix {
+			return fmt.Errorf("Prefix: %s already exists", prefix)
+		}
+	}
+	prefixes := append(m.prefixes, locPair{prefix, location})
+	sort.Sort(ByPattern(prefixes))
+	m.prefixes = prefixes
+	return nil
+}
+
+func (m *PathRouter) GetLocationByPrefix(prefix string) Location {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, p := range m.prefixes {
+		if p.pattern == prefix {
+			return p.location
+		}
+	}
+	return nil
+}
+
 func (m *PathRouter) GetLocationByPattern(pattern string) Location {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -110,6 +156,11 @@ func (m *PathRouter) GetLocationById(id string) Location {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	for _, p := range m.prefixes {
+		if p.location.GetId() == id {
+			return p.location
+		}
+	}
 	for _, p := range m.locations {
 		if p.location.GetId() == id {
 			return p.location
@@ -126,6 +177,13 @@ func (m *PathRouter) RemoveLocation(location Location) error {
 		return fmt.Errorf("Pass location to remove")
 	}
 
+	for i, p := range m.prefixes {
+		if p.location == location {
+			m.prefixes = append(m.prefixes[:i], m.prefixes[i+1:]...)
+			break
+		}
+	}
+
 	for i, p := range m.locations {
 		if p.location == location {
 			// Note this is safe due to the way go does range iterations by snapshotting the ranged list
@@ -146,6 +204,13 @@ func (m *PathRouter) RemoveLocation(location Location) error {
 	return err
 }
 
+func matchesPrefix(prefix, path string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
 func buildMapping(locations []locPair) (*regexp.Regexp, error) {
 	if len(locations) == 0 {
 		return nil, nil
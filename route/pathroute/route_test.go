@@ -177,6 +177,75 @@ func (s *MatchSuite) TestAddBad(c *C) {
 	c.Assert(out, Equals, locA)
 }
 
+func (s *MatchSuite) TestPrefixChooseLongest(c *C) {
+	m := NewPathRouter()
+	locA := &Loc{Name: "a"}
+	locB := &Loc{Name: "b"}
+
+	c.Assert(m.AddPrefix("/api", locA), IsNil)
+	c.Assert(m.AddPrefix("/api/v2", locB), IsNil)
+
+	out, err := m.Route(request("http://google.com/api/users"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, locA)
+
+	out, err = m.Route(request("http://google.com/api/v2/users"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, locB)
+
+	out, err = m.Route(request("http://google.com/api"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, locA)
+
+	// Prefix matches whole path segments only
+	out, err = m.Route(request("http://google.com/apiv2"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, nil)
+}
+
+func (s *MatchSuite) TestPrefixTrailingSlash(c *C) {
+	m := NewPathRouter()
+	locA := &Loc{Name: "a"}
+	c.Assert(m.AddPrefix("/", locA), IsNil)
+
+	out, err := m.Route(request("http://google.com/anything/here"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, locA)
+}
+
+func (s *MatchSuite) TestPrefixBeforePattern(c *C) {
+	m := NewPathRouter()
+	locA := &Loc{Name: "a"}
+	locB := &Loc{Name: "b"}
+
+	c.Assert(m.AddLocation("/api/.*", locA), IsNil)
+	c.Assert(m.AddPrefix("/api/v1", locB), IsNil)
+
+	out, err := m.Route(request("http://google.com/api/v1/users"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, locB)
+
+	out, err = m.Route(request("http://google.com/api/v2/users"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, locA)
+
+	c.Assert(m.RemoveLocation(m.GetLocationByPrefix("/api/v1")), IsNil)
+
+	out, err = m.Route(request("http://google.com/api/v1/users"))
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, locA)
+}
+
+func (s *MatchSuite) TestAddPrefixBad(c *C) {
+	m := NewPathRouter()
+	locA := &Loc{Name: "a"}
+
+	c.Assert(m.AddPrefix("api", locA), NotNil)
+	c.Assert(m.AddPrefix("/api", nil), NotNil)
+	c.Assert(m.AddPrefix("/api", locA), IsNil)
+	c.Assert(m.AddPrefix("/api", locA), NotNil)
+}
+
 func (s *MatchSuite) BenchmarkMatching(c *C) {
 	rndString := testutils.NewRndString()
 
@@ -0,0 +1,104 @@
+// Split the traffic between the primary and canary locations
+package splitroute
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	. "github.com/mailgun/vulcan/location"
+	. "github.com/mailgun/vulcan/request"
+)
+
+// SplitRouter routes the configured percentage of requests to the canary location
+// and the rest of the requests to the primary location. The decision is deterministic:
+// it's based on the value of the cookie if it's configured and present in the request,
+// so the client keeps hitting the same location, or on the request id otherwise.
+type SplitRouter struct {
+	mutex   *sync.RWMutex
+	primary Location
+	canary  Location
+	percent int
+	options Options
+}
+
+type Options struct {
+	// Cookie with the value that selects the location, e.g. session id cookie
+	Cookie string
+}
+
+func NewSplitRouter(primary, canary Location, percent int) (*SplitRouter, error) {
+	return NewSplitRouterWithOptions(primary, canary, percent, Options{})
+}
+
+func NewSplitRouterWithOptions(primary, canary Location, percent int, o Options) (*SplitRouter, error) {
+	if primary == nil || canary == nil {
+		return nil, fmt.Errorf("Provide primary and canary locations")
+	}
+	if err := validatePercent(percent); err != nil {
+		return nil, err
+	}
+	return &SplitRouter{
+		mutex:   &sync.RWMutex{},
+		primary: primary,
+		canary:  canary,
+		percent: percent,
+		options: o,
+	}, nil
+}
+
+func (s *SplitRouter) Route(req Request) (Location, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.bucket(req) < s.percent {
+		return s.canary, nil
+	}
+	return s.primary, nil
+}
+
+// SetPercent changes the percentage of requests routed to the canary location
+func (s *SplitRouter) SetPercent(percent int) error {
+	if err := validatePercent(percent); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.percent = percent
+	return nil
+}
+
+func (s *SplitRouter) GetPercent() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.percent
+}
+
+func (s *SplitRouter) GetPrimary() Location {
+	return s.primary
+}
+
+func (s *SplitRouter) GetCanary() Location {
+	return s.canary
+}
+
+// Maps the request to the bucket in range [0, 100)
+func (s *SplitRouter) bucket(req Request) int {
+	key := strconv.FormatInt(req.GetId(), 10)
+	if s.options.Cookie != "" {
+		if c, err := req.GetHttpRequest().Cookie(s.options.Cookie); err == nil {
+			key = c.Value
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % 100)
+}
+
+func validatePercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("Percent should be in range [0, 100], got %d", percent)
+	}
+	return nil
+}
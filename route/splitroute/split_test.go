@@ -0,0 +1,96 @@
+package splitroute
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestSplitRoute(t *testing.T) { TestingT(t) }
+
+type SplitSuite struct {
+	primary *Loc
+	canary  *Loc
+}
+
+var _ = Suite(&SplitSuite{})
+
+func (s *SplitSuite) SetUpTest(c *C) {
+	s.primary = &Loc{Name: "primary"}
+	s.canary = &Loc{Name: "canary"}
+}
+
+func (s *SplitSuite) TestBadParams(c *C) {
+	_, err := NewSplitRouter(nil, s.canary, 10)
+	c.Assert(err, NotNil)
+
+	_, err = NewSplitRouter(s.primary, s.canary, 101)
+	c.Assert(err, NotNil)
+
+	r, err := NewSplitRouter(s.primary, s.canary, 10)
+	c.Assert(err, IsNil)
+	c.Assert(r.SetPercent(-1), NotNil)
+	c.Assert(r.GetPercent(), Equals, 10)
+}
+
+func (s *SplitSuite) TestSplitByRequestId(c *C) {
+	r, err := NewSplitRouter(s.primary, s.canary, 20)
+	c.Assert(err, IsNil)
+
+	canary := s.countCanary(c, r)
+	c.Assert(canary > 100 && canary < 300, Equals, true, Commentf("canary: %d", canary))
+
+	// Same request is always routed to the same location
+	req := request(7, "")
+	first, _ := r.Route(req)
+	for i := 0; i < 10; i++ {
+		out, _ := r.Route(req)
+		c.Assert(out, Equals, first)
+	}
+}
+
+func (s *SplitSuite) TestAdjustPercent(c *C) {
+	r, err := NewSplitRouter(s.primary, s.canary, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.countCanary(c, r), Equals, 0)
+
+	c.Assert(r.SetPercent(100), IsNil)
+	c.Assert(s.countCanary(c, r), Equals, 1000)
+}
+
+func (s *SplitSuite) TestSplitByCookie(c *C) {
+	r, err := NewSplitRouterWithOptions(s.primary, s.canary, 50, Options{Cookie: "session"})
+	c.Assert(err, IsNil)
+
+	// Requests with the same session end up in the same location regardless of the request id
+	first, _ := r.Route(request(1, "abc"))
+	for i := int64(2); i < 100; i++ {
+		out, err := r.Route(request(i, "abc"))
+		c.Assert(err, IsNil)
+		c.Assert(out, Equals, first)
+	}
+}
+
+func (s *SplitSuite) countCanary(c *C, r *SplitRouter) int {
+	canary := 0
+	for i := int64(0); i < 1000; i++ {
+		out, err := r.Route(request(i, ""))
+		c.Assert(err, IsNil)
+		if out == s.canary {
+			canary += 1
+		}
+	}
+	return canary
+}
+
+func request(id int64, session string) Request {
+	hr := &http.Request{URL: netutils.MustParseUrl("http://google.com"), Header: make(http.Header)}
+	if session != "" {
+		hr.AddCookie(&http.Cookie{Name: "session", Value: session})
+	}
+	return &BaseRequest{HttpRequest: hr, Id: id}
+}
@@ -0,0 +1,132 @@
+// Middleware that adds the security headers to the responses
+package secure
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Secure adds HSTS, X-Frame-Options, X-Content-Type-Options, Referrer-Policy and Content-Security-Policy
+// headers to the responses. Headers set by the endpoints are kept unless Override is set, so the endpoints
+// can relax the policies for the particular pages:
+//
+//	s, _ := secure.NewSecureWithOptions(secure.Options{
+//		HSTS:                  secure.HSTS{MaxAge: 365 * 24 * time.Hour, IncludeSubdomains: true},
+//		FrameOptions:          "DENY",
+//		ContentTypeNosniff:    true,
+//		ContentSecurityPolicy: "default-src 'self'",
+//	})
+//	location.GetMiddlewareChain().Add("secure", 0, s)
+type Secure struct {
+	options Options
+	headers http.Header
+	hsts    string
+}
+
+type Options struct {
+	// Strict-Transport-Security settings, the header is sent with the responses to HTTPS requests only
+	HSTS HSTS
+	// X-Frame-Options value, e.g. "DENY" or "SAMEORIGIN", empty value omits the header
+	FrameOptions string
+	// Sends X-Content-Type-Options: nosniff
+	ContentTypeNosniff bool
+	// Referrer-Policy value, e.g. "strict-origin-when-cross-origin", empty value omits the header
+	ReferrerPolicy string
+	// Content-Security-Policy value, empty value omits the header
+	ContentSecurityPolicy string
+	// Sends the policy in Content-Security-Policy-Report-Only header, so the violations are reported but not enforced
+	ContentSecurityPolicyReportOnly bool
+	// Replace the headers set by the endpoints
+	Override bool
+}
+
+type HSTS struct {
+	// How long the browsers should use HTTPS only, 0 omits the header
+	MaxAge            time.Duration
+	IncludeSubdomains bool
+	Preload           bool
+}
+
+// DefaultOptions are the safe settings that do not break the typical sites
+var DefaultOptions = Options{
+	FrameOptions:       "SAMEORIGIN",
+	ContentTypeNosniff: true,
+	ReferrerPolicy:     "strict-origin-when-cross-origin",
+}
+
+func NewSecure() (*Secure, error) {
+	return NewSecureWithOptions(DefaultOptions)
+}
+
+func NewSecureWithOptions(o Options) (*Secure, error) {
+	if o.HSTS.MaxAge < 0 {
+		return nil, fmt.Errorf("HSTS max age can not be negative")
+	}
+	if o.HSTS.Preload && (o.HSTS.MaxAge < preloadMinMaxAge || !o.HSTS.IncludeSubdomains) {
+		return nil, fmt.Errorf("HSTS preload requires max age of at least one year and includeSubDomains")
+	}
+	s := &Secure{headers: make(http.Header)}
+	if o.HSTS.MaxAge > 0 {
+		s.hsts = "max-age=" + strconv.FormatInt(int64(o.HSTS.MaxAge/time.Second), 10)
+		if o.HSTS.IncludeSubdomains {
+			s.hsts += "; includeSubDomains"
+		}
+		if o.HSTS.Preload {
+			s.hsts += "; preload"
+		}
+	}
+	if o.FrameOptions != "" {
+		s.headers.Set("X-Frame-Options", o.FrameOptions)
+	}
+	if o.ContentTypeNosniff {
+		s.headers.Set("X-Content-Type-Options", "nosniff")
+	}
+	if o.ReferrerPolicy != "" {
+		s.headers.Set("Referrer-Policy", o.ReferrerPolicy)
+	}
+	if o.ContentSecurityPolicy != "" {
+		if o.ContentSecurityPolicyReportOnly {
+			s.headers.Set("Content-Security-Policy-Report-Only", o.ContentSecurityPolicy)
+		} else {
+			s.headers.Set("Content-Security-Policy", o.ContentSecurityPolicy)
+		}
+	}
+	s.options = o
+	return s, nil
+}
+
+func (s *Secure) ProcessRequest(r request.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (s *Secure) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// ModifyResponse adds the security headers to the response
+func (s *Secure) ModifyResponse(r request.Request, re *http.Response) error {
+	if re.Header == nil {
+		re.Header = make(http.Header)
+	}
+	for name, values := range s.headers {
+		s.setHeader(re.Header, name, values[0])
+	}
+	if s.hsts != "" && netutils.RequestScheme(r.GetHttpRequest()) == "https" {
+		s.setHeader(re.Header, "Strict-Transport-Security", s.hsts)
+	}
+	return nil
+}
+
+func (s *Secure) setHeader(h http.Header, name, value string) {
+	if !s.options.Override && h.Get(name) != "" {
+		return
+	}
+	h.Set(name, value)
+}
+
+// Minimum max age accepted by the browsers' HSTS preload lists
+const preloadMinMaxAge = 365 * 24 * time.Hour
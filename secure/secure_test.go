@@ -0,0 +1,105 @@
+package secure
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestSecure(t *testing.T) { TestingT(t) }
+
+type SecureSuite struct{}
+
+var _ = Suite(&SecureSuite{})
+
+func (s *SecureSuite) TestDefaults(c *C) {
+	sec, err := NewSecure()
+	c.Assert(err, IsNil)
+
+	re := makeResponse()
+	c.Assert(sec.ModifyResponse(makeRequest("http"), re), IsNil)
+	c.Assert(re.Header.Get("X-Frame-Options"), Equals, "SAMEORIGIN")
+	c.Assert(re.Header.Get("X-Content-Type-Options"), Equals, "nosniff")
+	c.Assert(re.Header.Get("Referrer-Policy"), Equals, "strict-origin-when-cross-origin")
+	c.Assert(re.Header.Get("Strict-Transport-Security"), Equals, "")
+	c.Assert(re.Header.Get("Content-Security-Policy"), Equals, "")
+}
+
+func (s *SecureSuite) TestHSTS(c *C) {
+	sec, err := NewSecureWithOptions(Options{
+		HSTS: HSTS{MaxAge: 365 * 24 * time.Hour, IncludeSubdomains: true, Preload: true},
+	})
+	c.Assert(err, IsNil)
+
+	re := makeResponse()
+	c.Assert(sec.ModifyResponse(makeRequest("https"), re), IsNil)
+	c.Assert(re.Header.Get("Strict-Transport-Security"), Equals, "max-age=31536000; includeSubDomains; preload")
+	c.Assert(re.Header.Get("X-Frame-Options"), Equals, "")
+
+	// Browsers ignore HSTS sent over plain HTTP
+	re = makeResponse()
+	c.Assert(sec.ModifyResponse(makeRequest("http"), re), IsNil)
+	c.Assert(re.Header.Get("Strict-Transport-Security"), Equals, "")
+}
+
+func (s *SecureSuite) TestContentSecurityPolicy(c *C) {
+	sec, err := NewSecureWithOptions(Options{ContentSecurityPolicy: "default-src 'self'"})
+	c.Assert(err, IsNil)
+	re := makeResponse()
+	c.Assert(sec.ModifyResponse(makeRequest("http"), re), IsNil)
+	c.Assert(re.Header.Get("Content-Security-Policy"), Equals, "default-src 'self'")
+
+	sec, err = NewSecureWithOptions(Options{ContentSecurityPolicy: "default-src 'self'", ContentSecurityPolicyReportOnly: true})
+	c.Assert(err, IsNil)
+	re = makeResponse()
+	c.Assert(sec.ModifyResponse(makeRequest("http"), re), IsNil)
+	c.Assert(re.Header.Get("Content-Security-Policy"), Equals, "")
+	c.Assert(re.Header.Get("Content-Security-Policy-Report-Only"), Equals, "default-src 'self'")
+}
+
+func (s *SecureSuite) TestEndpointHeadersAreKept(c *C) {
+	sec, err := NewSecure()
+	c.Assert(err, IsNil)
+	re := makeResponse()
+	re.Header.Set("X-Frame-Options", "ALLOW-FROM https://example.com")
+	c.Assert(sec.ModifyResponse(makeRequest("http"), re), IsNil)
+	c.Assert(re.Header.Get("X-Frame-Options"), Equals, "ALLOW-FROM https://example.com")
+
+	o := DefaultOptions
+	o.Override = true
+	sec, err = NewSecureWithOptions(o)
+	c.Assert(err, IsNil)
+	re = makeResponse()
+	re.Header.Set("X-Frame-Options", "ALLOW-FROM https://example.com")
+	c.Assert(sec.ModifyResponse(makeRequest("http"), re), IsNil)
+	c.Assert(re.Header.Get("X-Frame-Options"), Equals, "SAMEORIGIN")
+}
+
+func (s *SecureSuite) TestBadParams(c *C) {
+	_, err := NewSecureWithOptions(Options{HSTS: HSTS{MaxAge: -1}})
+	c.Assert(err, NotNil)
+
+	// Preload lists require long max age and subdomains
+	_, err = NewSecureWithOptions(Options{HSTS: HSTS{MaxAge: time.Hour, IncludeSubdomains: true, Preload: true}})
+	c.Assert(err, NotNil)
+	_, err = NewSecureWithOptions(Options{HSTS: HSTS{MaxAge: 365 * 24 * time.Hour, Preload: true}})
+	c.Assert(err, NotNil)
+}
+
+func makeRequest(scheme string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     "GET",
+		Host:       "localhost",
+		URL:        netutils.MustParseUrl("http://localhost/a"),
+		RequestURI: "/a",
+		Header:     http.Header{"X-Forwarded-Proto": []string{scheme}},
+	}, 1, nil)
+}
+
+func makeResponse() *http.Response {
+	return netutils.NewTextResponse(nil, http.StatusOK, "hello")
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+)
+
+// ACME gets the certificates for the hostnames from the ACME CA, e.g. Let's Encrypt, and renews them before
+// they expire. The CA validates the hostnames with HTTP-01 challenges, so the plain HTTP port of the hostnames
+// should be served by Server.HTTPHandler:
+//
+//	s, _ := server.NewServerWithOptions(proxy, server.Options{
+//		ACME: &server.ACME{Hostnames: []string{"example.com"}, Email: "ops@example.com", CacheDir: "/var/lib/vulcan/acme"},
+//	})
+//	go http.ListenAndServe(":80", s.HTTPHandler(proxy))
+//	s.ListenAndServe(":443")
+type ACME struct {
+	// Directory URL of the CA, LetsEncryptURL by default
+	DirectoryURL string
+	// Contact email of the account, optional
+	Email string
+	// Hostnames to get the certificates for, one certificate per hostname
+	Hostnames []string
+	// Directory to keep the account key and the certificates in, so they survive restarts and the CA
+	// rate limits are not hit. Kept in memory only if empty
+	CacheDir string
+	// Certificates that expire sooner than this are renewed, DefaultRenewBefore by default
+	RenewBefore time.Duration
+	// How often to check the certificates, DefaultCheckPeriod by default
+	CheckPeriod time.Duration
+	// Client to talk to the CA, http.DefaultClient by default
+	Client *http.Client
+}
+
+const (
+	LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+	DefaultRenewBefore = 30 * 24 * time.Hour
+	DefaultCheckPeriod = 12 * time.Hour
+
+	// Path the CA fetches the HTTP-01 challenge responses from
+	acmeChallengePath = "/.well-known/acme-challenge/"
+)
+
+// acmeManager keeps the certificates of the hostnames up to date
+type acmeManager struct {
+	options ACME
+	tm      timetools.TimeProvider
+	client  *acmeClient
+	// Called once the certificates have changed
+	onUpdate func()
+
+	mutex sync.RWMutex
+	certs map[string]*tls.Certificate
+	// Key authorizations of the pending challenges by token
+	tokens map[string]string
+
+	// Serializes the renewals in the background and the ones asked for by RenewCertificates
+	renewMutex sync.Mutex
+	startOnce  sync.Once
+	stopOnce   sync.Once
+	stop       chan struct{}
+}
+
+func newACMEManager(o ACME, tm timetools.TimeProvider, onUpdate func()) (*acmeManager, error) {
+	key, err := loadAccountKey(o.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	m := &acmeManager{
+		options:  o,
+		tm:       tm,
+		client:   newACMEClient(o.DirectoryURL, o.Email, o.Client, key),
+		onUpdate: onUpdate,
+		certs:    make(map[string]*tls.Certificate),
+		tokens:   make(map[string]string),
+		stop:     make(chan struct{}),
+	}
+	if o.CacheDir != "" {
+		for _, host := range o.Hostnames {
+			base := filepath.Join(o.CacheDir, host)
+			if c, err := tls.LoadX509KeyPair(base+".crt", base+".key"); err == nil {
+				m.certs[host] = &c
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *acmeManager) certificates() []tls.Certificate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	certs := make([]tls.Certificate, 0, len(m.certs))
+	for _, host := range m.options.Hostnames {
+		if c, ok := m.certs[host]; ok {
+			certs = append(certs, *c)
+		}
+	}
+	return certs
+}
+
+// start checks the certificates in the background until the manager is stopped
+func (m *acmeManager) start() {
+	m.startOnce.Do(func() { go m.run() })
+}
+
+func (m *acmeManager) close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *acmeManager) run() {
+	for {
+		period := m.options.CheckPeriod
+		if err := m.renew(); err != nil {
+			log.Errorf("Failed to renew ACME certificates: %s", err)
+			// Don't wait for long, the hostnames are left without the certificates
+			if period > time.Minute {
+				period = time.Minute
+			}
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(period):
+		}
+	}
+}
+
+// renew gets the certificates for the hostnames that have none or have the ones about to expire
+func (m *acmeManager) renew() error {
+	m.renewMutex.Lock()
+	defer m.renewMutex.Unlock()
+
+	var failed []string
+	updated := false
+	for _, host := range m.options.Hostnames {
+		if !m.needsRenewal(host) {
+			continue
+		}
+		log.Infof("Requesting ACME certificate for %s", host)
+		c, err := m.client.obtain(host, m.solve)
+		if err != nil {
+			log.Errorf("Failed to get ACME certificate for %s: %s", host, err)
+			failed = append(failed, host)
+			continue
+		}
+		if err := m.save(host, c); err != nil {
+			log.Errorf("Failed to cache ACME certificate for %s: %s", host, err)
+		}
+		m.mutex.Lock()
+		m.certs[host] = c
+		m.mutex.Unlock()
+		updated = true
+	}
+	if updated && m.onUpdate != nil {
+		m.onUpdate()
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("Failed to get certificates for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (m *acmeManager) needsRenewal(host string) bool {
+	m.mutex.RLock()
+	c, ok := m.certs[host]
+	m.mutex.RUnlock()
+	if !ok {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return m.tm.UtcNow().Add(m.options.RenewBefore).After(leaf.NotAfter)
+}
+
+// solve publishes the key authorization for the CA, the returned function removes it
+func (m *acmeManager) solve(token, keyAuth string) func() {
+	m.mutex.Lock()
+	m.tokens[token] = keyAuth
+	m.mutex.Unlock()
+	return func() {
+		m.mutex.Lock()
+		delete(m.tokens, token)
+		m.mutex.Unlock()
+	}
+}
+
+// keyAuth returns the response to the HTTP-01 challenge request, false if the request is not a challenge
+func (m *acmeManager) keyAuth(req *http.Request) (string, bool) {
+	if !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		return "", false
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	keyAuth, ok := m.tokens[strings.TrimPrefix(req.URL.Path, acmeChallengePath)]
+	return keyAuth, ok
+}
+
+func (m *acmeManager) save(host string, c *tls.Certificate) error {
+	if m.options.CacheDir == "" {
+		return nil
+	}
+	var chain []byte
+	for _, der := range c.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	key, ok := c.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("Unsupported key type %T", c.PrivateKey)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	base := filepath.Join(m.options.CacheDir, host)
+	if err := ioutil.WriteFile(base+".key", keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(base+".crt", chain, 0600)
+}
+
+// loadAccountKey reads the account key from the cache directory, or generates the new one
+func loadAccountKey(dir string) (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(dir, "account.key")
+	if dir != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return nil, fmt.Errorf("Failed to decode %s", path)
+			}
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		data, err := encodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseACME(o *ACME) error {
+	if len(o.Hostnames) == 0 {
+		return fmt.Errorf("Provide ACME hostnames")
+	}
+	if o.DirectoryURL == "" {
+		o.DirectoryURL = LetsEncryptURL
+	}
+	if o.RenewBefore < 0 || o.CheckPeriod < 0 {
+		return fmt.Errorf("ACME periods can not be negative")
+	}
+	if o.RenewBefore == 0 {
+		o.RenewBefore = DefaultRenewBefore
+	}
+	if o.CheckPeriod == 0 {
+		o.CheckPeriod = DefaultCheckPeriod
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	return nil
+}
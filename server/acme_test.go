@@ -0,0 +1,431 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"golang.org/x/crypto/acme"
+	. "gopkg.in/check.v1"
+)
+
+type ACMESuite struct {
+	ca *fakeCA
+	// Plain HTTP port the CA validates the challenges on
+	http *httptest.Server
+	// Handler of the plain HTTP port, set by the test
+	handler http.Handler
+}
+
+var _ = Suite(&ACMESuite{})
+
+func (s *ACMESuite) SetUpTest(c *C) {
+	s.handler = http.NotFoundHandler()
+	s.http = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handler.ServeHTTP(w, r)
+	}))
+	s.ca = newFakeCA(c, s.http.Listener.Addr().String())
+}
+
+func (s *ACMESuite) TearDownTest(c *C) {
+	s.ca.server.Close()
+	s.http.Close()
+}
+
+func (s *ACMESuite) newServer(c *C, o Options) *Server {
+	srv, err := NewServerWithOptions(hello, o)
+	c.Assert(err, IsNil)
+	s.handler = srv.HTTPHandler(hello)
+	return srv
+}
+
+func (s *ACMESuite) acme(dir string) *ACME {
+	return &ACME{
+		DirectoryURL: s.ca.server.URL + "/directory",
+		Email:        "ops@example.com",
+		Hostnames:    []string{"a.example.com", "b.example.com"},
+		CacheDir:     dir,
+	}
+}
+
+func (s *ACMESuite) TestObtain(c *C) {
+	srv := s.newServer(c, Options{ACME: s.acme(c.MkDir())})
+	defer srv.Close()
+
+	c.Assert(srv.RenewCertificates(), IsNil)
+	c.Assert(s.ca.issued, DeepEquals, []string{"a.example.com", "b.example.com"})
+	c.Assert(s.ca.contact, Equals, "mailto:ops@example.com")
+
+	addr := serve(c, srv)
+	c.Assert(s.peerName(c, addr, "a.example.com"), Equals, "a.example.com")
+	c.Assert(s.peerName(c, addr, "b.example.com"), Equals, "b.example.com")
+
+	// Certificates are valid, nothing to renew
+	c.Assert(srv.RenewCertificates(), IsNil)
+	c.Assert(len(s.ca.issued), Equals, 2)
+
+	// Other requests are passed to the handler
+	re, err := http.Get(s.http.URL + "/hello")
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+}
+
+// Certificates and the account key are loaded from the cache
+func (s *ACMESuite) TestCache(c *C) {
+	dir := c.MkDir()
+	srv := s.newServer(c, Options{ACME: s.acme(dir)})
+	c.Assert(srv.RenewCertificates(), IsNil)
+	srv.Close()
+	c.Assert(len(s.ca.issued), Equals, 2)
+
+	srv = s.newServer(c, Options{ACME: s.acme(dir)})
+	defer srv.Close()
+	addr := serve(c, srv)
+	c.Assert(s.peerName(c, addr, "b.example.com"), Equals, "b.example.com")
+	c.Assert(srv.RenewCertificates(), IsNil)
+	c.Assert(len(s.ca.issued), Equals, 2)
+	c.Assert(s.ca.accounts, Equals, 1)
+
+	_, err := os.Stat(filepath.Join(dir, "account.key"))
+	c.Assert(err, IsNil)
+}
+
+func (s *ACMESuite) TestRenew(c *C) {
+	tm := &timetools.FreezedTime{CurrentTime: time.Now()}
+	srv := s.newServer(c, Options{ACME: s.acme(""), TimeProvider: tm})
+	defer srv.Close()
+	c.Assert(srv.RenewCertificates(), IsNil)
+	c.Assert(len(s.ca.issued), Equals, 2)
+
+	// Certificates are issued for 90 days, so they are renewed once 30 days are left
+	tm.CurrentTime = tm.CurrentTime.Add(59 * 24 * time.Hour)
+	c.Assert(srv.RenewCertificates(), IsNil)
+	c.Assert(len(s.ca.issued), Equals, 2)
+
+	tm.CurrentTime = tm.CurrentTime.Add(2 * 24 * time.Hour)
+	c.Assert(srv.RenewCertificates(), IsNil)
+	c.Assert(len(s.ca.issued), Equals, 4)
+}
+
+func (s *ACMESuite) TestChallengeFailed(c *C) {
+	srv := s.newServer(c, Options{ACME: s.acme("")})
+	defer srv.Close()
+	// Challenges are not answered
+	s.handler = hello
+
+	c.Assert(srv.RenewCertificates(), NotNil)
+	c.Assert(len(s.ca.issued), Equals, 0)
+
+	// There are no certificates to serve
+	addr := serve(c, srv)
+	_, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true})
+	c.Assert(err, NotNil)
+}
+
+// ACME certificates are served along with the static ones
+func (s *ACMESuite) TestStaticCertificates(c *C) {
+	srv := s.newServer(c, Options{
+		ACME:         s.acme(""),
+		Certificates: []tls.Certificate{newCertificate(c, "static.example.com")},
+	})
+	defer srv.Close()
+	c.Assert(srv.RenewCertificates(), IsNil)
+
+	addr := serve(c, srv)
+	c.Assert(s.peerName(c, addr, "static.example.com"), Equals, "static.example.com")
+	c.Assert(s.peerName(c, addr, "a.example.com"), Equals, "a.example.com")
+}
+
+func (s *ACMESuite) TestBadParams(c *C) {
+	_, err := NewServerWithOptions(hello, Options{ACME: &ACME{}})
+	c.Assert(err, NotNil)
+
+	_, err = NewServerWithOptions(hello, Options{ACME: &ACME{Hostnames: []string{"a.example.com"}, RenewBefore: -1}})
+	c.Assert(err, NotNil)
+
+	srv, err := NewServer(hello, []tls.Certificate{newCertificate(c, "a.example.com")})
+	c.Assert(err, IsNil)
+	c.Assert(srv.RenewCertificates(), NotNil)
+}
+
+func (s *ACMESuite) peerName(c *C, addr, serverName string) string {
+	return peerName(c, addr, &tls.Config{ServerName: serverName})
+}
+
+// fakeCA implements the ACME endpoints the client uses, the challenges are validated synchronously
+// against the plain HTTP address
+type fakeCA struct {
+	c         *C
+	server    *httptest.Server
+	key       *ecdsa.PrivateKey
+	cert      *x509.Certificate
+	challenge string
+
+	mutex    sync.Mutex
+	nonce    int
+	nonces   map[string]bool
+	accounts int
+	keys     map[string]*ecdsa.PublicKey
+	contact  string
+	orders   []*fakeOrder
+	issued   []string
+}
+
+type fakeOrder struct {
+	hostname string
+	token    string
+	authz    string
+	status   string
+	cert     []byte
+}
+
+func newFakeCA(c *C, challengeAddr string) *fakeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	ca := &fakeCA{
+		c:         c,
+		key:       key,
+		cert:      cert,
+		challenge: challengeAddr,
+		nonces:    make(map[string]bool),
+		keys:      make(map[string]*ecdsa.PublicKey),
+	}
+	ca.server = httptest.NewServer(http.HandlerFunc(ca.serveHTTP))
+	return ca
+}
+
+func (ca *fakeCA) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.nonce++
+	nonce := fmt.Sprintf("nonce-%d", ca.nonce)
+	ca.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	switch {
+	case r.URL.Path == "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.server.URL + "/nonce",
+			"newAccount": ca.server.URL + "/account",
+			"newOrder":   ca.server.URL + "/order",
+		})
+		return
+	case r.URL.Path == "/nonce":
+		return
+	}
+
+	payload, key, err := ca.verify(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:malformed", "detail": err.Error()})
+		return
+	}
+	var parts []string
+	if strings.Count(r.URL.Path, "/") == 2 {
+		parts = strings.Split(r.URL.Path[1:], "/")
+	}
+	switch {
+	case r.URL.Path == "/account":
+		var account struct{ Contact []string }
+		json.Unmarshal(payload, &account)
+		if len(account.Contact) != 0 {
+			ca.contact = account.Contact[0]
+		}
+		kid := ca.server.URL + "/accounts/" + thumbprint(key)
+		if _, ok := ca.keys[kid]; !ok {
+			ca.accounts++
+			ca.keys[kid] = key
+		}
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	case r.URL.Path == "/order":
+		var order struct{ Identifiers []struct{ Value string } }
+		json.Unmarshal(payload, &order)
+		o := &fakeOrder{hostname: order.Identifiers[0].Value, token: fmt.Sprintf("token-%d", ca.nonce), authz: "pending", status: "pending"}
+		ca.orders = append(ca.orders, o)
+		id := len(ca.orders) - 1
+		w.Header().Set("Location", fmt.Sprintf("%s/orders/%d", ca.server.URL, id))
+		w.WriteHeader(http.StatusCreated)
+		ca.writeOrder(w, id)
+	case parts != nil:
+		var id int
+		fmt.Sscanf(parts[1], "%d", &id)
+		if id >= len(ca.orders) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		o := ca.orders[id]
+		switch parts[0] {
+		case "orders":
+			ca.writeOrder(w, id)
+		case "authz":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": o.authz,
+				"challenges": []map[string]string{
+					{"type": "dns-01", "url": ca.server.URL + "/dns/0", "token": "other"},
+					{"type": "http-01", "url": fmt.Sprintf("%s/challenges/%d", ca.server.URL, id), "token": o.token},
+				},
+			})
+		case "challenges":
+			o.authz = "invalid"
+			if ca.fetchChallenge(o) == o.token+"."+thumbprint(key) {
+				o.authz = "valid"
+			}
+			w.Write([]byte("{}"))
+		case "finalize":
+			if o.authz != "valid" {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:unauthorized"})
+				return
+			}
+			var finalize struct{ CSR string }
+			json.Unmarshal(payload, &finalize)
+			o.cert = ca.issue(finalize.CSR)
+			o.status = "valid"
+			ca.issued = append(ca.issued, o.hostname)
+			ca.writeOrder(w, id)
+		case "certs":
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			w.Write(o.cert)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (ca *fakeCA) writeOrder(w http.ResponseWriter, id int) {
+	o := ca.orders[id]
+	status := o.status
+	if status == "pending" && o.authz == "valid" {
+		status = "ready"
+	}
+	order := map[string]interface{}{
+		"status":         status,
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", ca.server.URL, id)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", ca.server.URL, id),
+	}
+	if o.cert != nil {
+		order["certificate"] = fmt.Sprintf("%s/certs/%d", ca.server.URL, id)
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+// verify checks the nonce and the signature of the JWS and returns its payload and the account key
+func (ca *fakeCA) verify(r *http.Request) ([]byte, *ecdsa.PublicKey, error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, nil, err
+	}
+	header, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, err
+	}
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		Jwk                  map[string]string
+	}
+	if err := json.Unmarshal(header, &protected); err != nil {
+		return nil, nil, err
+	}
+	if !ca.nonces[protected.Nonce] {
+		return nil, nil, fmt.Errorf("Bad nonce")
+	}
+	delete(ca.nonces, protected.Nonce)
+	if protected.URL != ca.server.URL+r.URL.Path {
+		return nil, nil, fmt.Errorf("URL mismatch")
+	}
+	key := ca.keys[protected.Kid]
+	if protected.Jwk != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.Jwk["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(protected.Jwk["y"])
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("Unknown account")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(signature) != 64 {
+		return nil, nil, fmt.Errorf("Bad signature")
+	}
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if !ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, nil, fmt.Errorf("Signature verification failed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, key, err
+}
+
+func thumbprint(key *ecdsa.PublicKey) string {
+	t, _ := acme.JWKThumbprint(key)
+	return t
+}
+
+func (ca *fakeCA) fetchChallenge(o *fakeOrder) string {
+	req, err := http.NewRequest("GET", "http://"+ca.challenge+"/.well-known/acme-challenge/"+o.token, nil)
+	ca.c.Assert(err, IsNil)
+	req.Host = o.hostname
+	re, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer re.Body.Close()
+	body, _ := ioutil.ReadAll(re.Body)
+	return string(body)
+}
+
+func (ca *fakeCA) issue(encoded string) []byte {
+	der, err := base64.RawURLEncoding.DecodeString(encoded)
+	ca.c.Assert(err, IsNil)
+	csr, err := x509.ParseCertificateRequest(der)
+	ca.c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(len(ca.issued) + 2)),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	ca.c.Assert(err, IsNil)
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeClient gets the certificates with HTTP-01 challenges, the protocol is spoken by acme.Client
+type acmeClient struct {
+	client *acme.Client
+	email  string
+	// How long to wait for the CA to validate the challenges and issue the certificate
+	timeout time.Duration
+	// The account is registered once, the calls are serialized by acmeManager
+	registered bool
+}
+
+func newACMEClient(directoryURL, email string, client *http.Client, key *ecdsa.PrivateKey) *acmeClient {
+	return &acmeClient{
+		client: &acme.Client{
+			Key:          key,
+			HTTPClient:   client,
+			DirectoryURL: directoryURL,
+			UserAgent:    "vulcan",
+		},
+		email:   email,
+		timeout: 5 * time.Minute,
+	}
+}
+
+// obtain orders the certificate for the hostname. solve is called to publish the key authorization
+// of the HTTP-01 challenge token, the returned function removes it
+func (a *acmeClient) obtain(hostname string, solve func(token, keyAuth string) func()) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	if err := a.register(ctx); err != nil {
+		return nil, err
+	}
+	order, err := a.client.AuthorizeOrder(ctx, acme.DomainIDs(hostname))
+	if err != nil {
+		return nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorize(ctx, authzURL, solve); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = a.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{hostname}}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("CA has returned no certificates for %s", hostname)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+		return nil, fmt.Errorf("Certificate for %s does not match the key", hostname)
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// authorize completes the HTTP-01 challenge of the authorization and waits for the CA to validate it
+func (a *acmeClient) authorize(ctx context.Context, authzURL string, solve func(token, keyAuth string) func()) error {
+	authz, err := a.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("CA has not offered http-01 challenge for %s", authzURL)
+	}
+	keyAuth, err := a.client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	cleanup := solve(challenge.Token, keyAuth)
+	defer cleanup()
+
+	if _, err := a.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = a.client.WaitAuthorization(ctx, authzURL)
+	return err
+}
+
+// register creates the account, or finds the existing one for the key
+func (a *acmeClient) register(ctx context.Context) error {
+	if a.registered {
+		return nil
+	}
+	account := &acme.Account{}
+	if a.email != "" {
+		account.Contact = []string{"mailto:" + a.email}
+	}
+	if _, err := a.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	a.registered = true
+	return nil
+}
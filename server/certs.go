@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// KeyPair is the PEM encoded certificate chain and the private key, re-read from the disk on Reload
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certIndex picks the certificate by the server name the client has asked for, see SNI.
+// Names are taken from the certificates themselves, wildcard certificates match one label, e.g. *.example.com
+// matches a.example.com. Clients that don't send the name or ask for the unknown one get the first certificate.
+type certIndex struct {
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func newCertIndex(certs []tls.Certificate) (*certIndex, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("Provide at least one certificate")
+	}
+	// Leafs are set below, so don't change the certificates of the caller
+	certs = append([]tls.Certificate(nil), certs...)
+	index := &certIndex{byName: make(map[string]*tls.Certificate), fallback: &certs[0]}
+	for i := range certs {
+		c := &certs[i]
+		if len(c.Certificate) == 0 {
+			return nil, fmt.Errorf("Certificate %d is empty", i)
+		}
+		if c.Leaf == nil {
+			leaf, err := x509.ParseCertificate(c.Certificate[0])
+			if err != nil {
+				return nil, err
+			}
+			c.Leaf = leaf
+		}
+		names := c.Leaf.DNSNames
+		if len(names) == 0 && c.Leaf.Subject.CommonName != "" {
+			names = []string{c.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// The first certificate with the name wins
+			if _, ok := index.byName[name]; !ok {
+				index.byName[name] = c
+			}
+		}
+	}
+	return index, nil
+}
+
+// get returns the certificate for the name, nil if the index is empty
+func (ci *certIndex) get(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if c, ok := ci.byName[name]; ok {
+		return c
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if c, ok := ci.byName["*"+name[i:]]; ok {
+			return c
+		}
+	}
+	return ci.fallback
+}
+
+func loadKeyPairs(pairs []KeyPair) ([]tls.Certificate, error) {
+	certs := make([]tls.Certificate, 0, len(pairs))
+	for _, p := range pairs {
+		c, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load %s: %s", p.CertFile, err)
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/mailgun/log"
+)
+
+// InheritedListenersEnv passes the addresses of the listeners to the restarted process, the listeners
+// themselves are passed as the open files starting from the descriptor 3, in the same order
+const InheritedListenersEnv = "VULCAN_LISTENERS"
+
+// First descriptor of the passed listeners, the ones after stdin, stdout and stderr
+const listenFdsStart = 3
+
+// Listeners passed by the parent process or by systemd, taken one by one by Listen
+var inherited struct {
+	once      sync.Once
+	listeners []net.Listener
+	mutex     sync.Mutex
+}
+
+// Listen returns the listener inherited from the process that has restarted this one, see Restart,
+// or passed by systemd socket activation, or opens the new one if none was inherited for the address.
+// Use it instead of net.Listen to take over the sockets, ListenAndServe does so.
+func Listen(network, addr string) (net.Listener, error) {
+	inherited.once.Do(func() {
+		if inherited.listeners = systemdListeners(); inherited.listeners != nil {
+			return
+		}
+		if env := os.Getenv(InheritedListenersEnv); env != "" {
+			// The processes started by this one should not take the descriptors for the listeners
+			os.Unsetenv(InheritedListenersEnv)
+			inherited.listeners = inheritListeners(strings.Split(env, ","))
+		}
+	})
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+	for i, l := range inherited.listeners {
+		if matchAddr(network, addr, l.Addr()) {
+			inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+			log.Infof("Using inherited listener on %s", l.Addr())
+			return l, nil
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// Restart starts the new process of the same binary with the same arguments and passes the listeners to it.
+// Both processes accept the connections on the listeners once it's started, so the old one should stop
+// accepting and drain the requests in flight with Shutdown:
+//
+//	// On SIGUSR2, once the new binary is in place
+//	if _, err := server.Restart(listener); err == nil {
+//		s.Shutdown(ctx)
+//	}
+//
+// New process takes the listeners over with Listen. Connections that arrive while it's starting are queued
+// by the kernel, so none of them are refused.
+func Restart(listeners ...net.Listener) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return startProcess(path, os.Args[1:], listeners)
+}
+
+func startProcess(path string, args []string, listeners []net.Listener) (*os.Process, error) {
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	addrs := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		f, err := listenerFile(l)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	env := withoutEnv(os.Environ(), InheritedListenersEnv, listenPidEnv, listenFdsEnv, listenFdNamesEnv)
+	cmd.Env = append(env, InheritedListenersEnv+"="+strings.Join(addrs, ","))
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.Infof("Started process %d with listeners %s", cmd.Process.Pid, strings.Join(addrs, ", "))
+	return cmd.Process, nil
+}
+
+// listenerFile returns the copy of the listener descriptor
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// Socket file should stay in place for the new process once this one closes the listener
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, fmt.Errorf("Listener on %s of type %T can not be passed to the process", l.Addr(), l)
+}
+
+// inheritListeners takes over the listeners passed as the files starting from listenFdsStart,
+// names are used in the logs only
+func inheritListeners(names []string) []net.Listener {
+	var listeners []net.Listener
+	for i, name := range names {
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Errorf("Failed to inherit listener %s: %s", name, err)
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// matchAddr tells whether the listener address is the one asked for, e.g. [::]:443 matches :443
+func matchAddr(network, addr string, la net.Addr) bool {
+	switch la := la.(type) {
+	case *net.TCPAddr:
+		if !strings.HasPrefix(network, "tcp") {
+			return false
+		}
+		a, err := net.ResolveTCPAddr(network, addr)
+		if err != nil || a.Port != la.Port {
+			return false
+		}
+		if a.IP == nil || a.IP.IsUnspecified() {
+			return la.IP == nil || la.IP.IsUnspecified()
+		}
+		return a.IP.Equal(la.IP)
+	case *net.UnixAddr:
+		return network == la.Net && addr == la.Name
+	}
+	return false
+}
+
+func withoutEnv(env []string, names ...string) []string {
+	out := make([]string, 0, len(env))
+	for _, v := range env {
+		if i := strings.IndexByte(v, '='); i < 0 || !hasString(names, v[:i]) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func hasString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type RestartSuite struct{}
+
+var _ = Suite(&RestartSuite{})
+
+const restartHelperEnv = "VULCAN_TEST_RESTART_ADDR"
+
+// TestRestartHelper is the restarted or socket activated process, it answers one connection on the inherited listener
+func TestRestartHelper(t *testing.T) {
+	addr := os.Getenv(restartHelperEnv)
+	if addr == "" {
+		return
+	}
+	l, err := Listen("tcp", addr)
+	// Listeners are not passed on to the children of the process
+	if err != nil || os.Getenv(InheritedListenersEnv) != "" {
+		os.Exit(1)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	conn.Write([]byte("restarted"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func (s *RestartSuite) TestRestart(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := l.Addr().String()
+
+	os.Setenv(restartHelperEnv, addr)
+	defer os.Unsetenv(restartHelperEnv)
+	p, err := startProcess(os.Args[0], []string{"-test.run=TestRestartHelper"}, []net.Listener{l})
+	c.Assert(err, IsNil)
+
+	// Socket is shared, the new process accepts the connection while the old one is not accepting.
+	// Helper fails to listen on the address in use if it has not inherited the socket
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	out, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "restarted")
+
+	state, err := p.Wait()
+	c.Assert(err, IsNil)
+	c.Assert(state.Success(), Equals, true)
+}
+
+func (s *RestartSuite) TestUnixSocketIsKept(c *C) {
+	path := filepath.Join(c.MkDir(), "vulcan.sock")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+
+	f, err := listenerFile(l)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	l.Close()
+
+	_, err = os.Stat(path)
+	c.Assert(err, IsNil)
+}
+
+func (s *RestartSuite) TestUnsupportedListener(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	_, err = startProcess(os.Args[0], nil, []net.Listener{wrappedListener{l}})
+	c.Assert(err, NotNil)
+}
+
+func (s *RestartSuite) TestListenWithoutInherited(c *C) {
+	l, err := Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	l.Close()
+}
+
+func (s *RestartSuite) TestMatchAddr(c *C) {
+	tcs := []struct {
+		network  string
+		addr     string
+		listener net.Addr
+		expected bool
+	}{
+		{"tcp", ":443", &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}, true},
+		{"tcp", "0.0.0.0:443", &net.TCPAddr{IP: net.IPv4zero, Port: 443}, true},
+		{"tcp", "127.0.0.1:443", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}, true},
+		{"tcp4", "127.0.0.1:443", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}, true},
+		{"tcp", ":443", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}, false},
+		{"tcp", "127.0.0.1:443", &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}, false},
+		{"tcp", ":80", &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}, false},
+		{"unix", ":443", &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}, false},
+		{"unix", "/run/vulcan.sock", &net.UnixAddr{Net: "unix", Name: "/run/vulcan.sock"}, true},
+		{"unix", "/run/other.sock", &net.UnixAddr{Net: "unix", Name: "/run/vulcan.sock"}, false},
+		{"tcp", "/run/vulcan.sock", &net.UnixAddr{Net: "unix", Name: "/run/vulcan.sock"}, false},
+	}
+	for _, tc := range tcs {
+		c.Assert(matchAddr(tc.network, tc.addr, tc.listener), Equals, tc.expected, Commentf("%s %s %s", tc.network, tc.addr, tc.listener))
+	}
+}
+
+type wrappedListener struct {
+	net.Listener
+}
@@ -0,0 +1,305 @@
+// HTTPS server that terminates TLS in front of the proxy
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+)
+
+// Server terminates TLS and passes the requests to the handler, usually the vulcan.Proxy:
+//
+//	proxy, _ := vulcan.NewProxy(router)
+//	s, _ := server.NewServerWithOptions(proxy, server.Options{
+//		KeyPairs: []server.KeyPair{{CertFile: "a.crt", KeyFile: "a.key"}, {CertFile: "b.crt", KeyFile: "b.key"}},
+//	})
+//	go s.ListenAndServe(":443")
+//	// On SIGHUP, once the renewed certificates are in place
+//	s.Reload()
+//
+// Certificate is picked for each TLS handshake, so the new certificates are served to the new connections
+// right away, while the established connections are not interrupted.
+type Server struct {
+	options    Options
+	httpServer *http.Server
+	mutex      *sync.RWMutex
+	// Certificates set by SetCertificates, in addition to the key pairs
+	certs []tls.Certificate
+	index *certIndex
+	// Provisions the certificates if ACME is set, nil otherwise
+	acme *acmeManager
+}
+
+type TLS struct {
+	// Minimum TLS version, DefaultMinVersion by default
+	MinVersion uint16
+	// Cipher suites for TLS 1.2 and below, TLS 1.3 suites are not configurable. Go defaults are used if empty
+	CipherSuites []uint16
+}
+
+type Timeouts struct {
+	// Time to read the request headers, DefaultReadHeaderTimeout by default
+	ReadHeader time.Duration
+	// Time to read the whole request, including the body, 0 means no limit
+	Read time.Duration
+	// Time to write the response, 0 means no limit, e.g. for the streaming responses
+	Write time.Duration
+	// Time to keep the idle keep-alive connections open, DefaultIdleTimeout by default
+	Idle time.Duration
+}
+
+type Options struct {
+	TLS      TLS
+	Timeouts Timeouts
+	// Certificate files, re-read on Reload
+	KeyPairs []KeyPair
+	// Certificates in addition to KeyPairs, e.g. the ones kept in the secret store
+	Certificates []tls.Certificate
+	// Get the certificates from the ACME CA, e.g. Let's Encrypt. KeyPairs and Certificates are optional then
+	ACME *ACME
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultMinVersion        = tls.VersionTLS12
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 90 * time.Second
+)
+
+func NewServer(handler http.Handler, certs []tls.Certificate) (*Server, error) {
+	return NewServerWithOptions(handler, Options{Certificates: certs})
+}
+
+func NewServerWithOptions(handler http.Handler, o Options) (*Server, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("Provide handler")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		options: o,
+		mutex:   &sync.RWMutex{},
+		certs:   o.Certificates,
+	}
+	if o.ACME != nil {
+		acme, err := newACMEManager(*o.ACME, o.TimeProvider, s.onACMEUpdate)
+		if err != nil {
+			return nil, err
+		}
+		s.acme = acme
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	s.httpServer = &http.Server{
+		Handler:           handler,
+		TLSConfig:         s.newTLSConfig(),
+		ReadHeaderTimeout: o.Timeouts.ReadHeader,
+		ReadTimeout:       o.Timeouts.Read,
+		WriteTimeout:      o.Timeouts.Write,
+		IdleTimeout:       o.Timeouts.Idle,
+	}
+	if !supportsHTTP2(o.TLS.CipherSuites) {
+		log.Warningf("Cipher suites do not include the ones required by HTTP/2, serving HTTP/1.1 only")
+		s.httpServer.Protocols = &http.Protocols{}
+		s.httpServer.Protocols.SetHTTP1(true)
+	}
+	return s, nil
+}
+
+func (s *Server) GetOptions() Options {
+	return s.options
+}
+
+// ListenAndServe listens on the TCP address and serves HTTPS until the server is shut down.
+// Listener inherited from the restarted process or passed by systemd is used if there is one for the address, see Listen
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts the TLS connections on the listener, HTTP/2 is negotiated with the clients that support it.
+// ACME certificates are requested in the background once the server starts
+func (s *Server) Serve(l net.Listener) error {
+	log.Infof("Serving HTTPS on %s", l.Addr())
+	if s.acme != nil {
+		s.acme.start()
+	}
+	return s.httpServer.ServeTLS(l, "", "")
+}
+
+// Shutdown stops accepting the connections and waits for the requests in flight to complete
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.acme != nil {
+		s.acme.close()
+	}
+	return s.httpServer.Shutdown(ctx)
+}
+
+// Close closes the listeners and the connections immediately
+func (s *Server) Close() error {
+	if s.acme != nil {
+		s.acme.close()
+	}
+	return s.httpServer.Close()
+}
+
+// HTTPHandler answers the ACME HTTP-01 challenges and passes the other requests to the handler,
+// e.g. to the proxy or to the redirect to HTTPS. Serve the plain HTTP port of the ACME hostnames with it
+func (s *Server) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.acme != nil {
+			if keyAuth, ok := s.acme.keyAuth(r); ok {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(keyAuth))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RenewCertificates gets the ACME certificates that are missing or about to expire right away,
+// without waiting for the next check
+func (s *Server) RenewCertificates() error {
+	if s.acme == nil {
+		return fmt.Errorf("ACME is not configured")
+	}
+	return s.acme.renew()
+}
+
+func (s *Server) onACMEUpdate() {
+	if err := s.Reload(); err != nil {
+		log.Errorf("Failed to update ACME certificates: %s", err)
+	}
+}
+
+// Reload re-reads the key pairs from the disk. In case of error the server keeps the certificates it had
+func (s *Server) Reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.updateIndex(s.certs)
+}
+
+// SetCertificates replaces the certificates set in the options, the key pairs are re-read as well
+func (s *Server) SetCertificates(certs []tls.Certificate) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.updateIndex(certs); err != nil {
+		return err
+	}
+	s.certs = certs
+	return nil
+}
+
+func (s *Server) updateIndex(certs []tls.Certificate) error {
+	loaded, err := loadKeyPairs(s.options.KeyPairs)
+	if err != nil {
+		return err
+	}
+	all := append(loaded, certs...)
+	if s.acme != nil {
+		all = append(all, s.acme.certificates()...)
+		// Server starts with no certificates until the CA issues them
+		if len(all) == 0 {
+			s.index = &certIndex{}
+			return nil
+		}
+	}
+	index, err := newCertIndex(all)
+	if err != nil {
+		return err
+	}
+	s.index = index
+	return nil
+}
+
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c := s.index.get(hello.ServerName)
+	if c == nil {
+		return nil, fmt.Errorf("No certificate for %q", hello.ServerName)
+	}
+	return c, nil
+}
+
+func (s *Server) newTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.getCertificate,
+		MinVersion:     s.options.TLS.MinVersion,
+		CipherSuites:   s.options.TLS.CipherSuites,
+	}
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.TLS.MinVersion == 0 {
+		o.TLS.MinVersion = DefaultMinVersion
+	}
+	if o.TLS.MinVersion < tls.VersionTLS10 || o.TLS.MinVersion > tls.VersionTLS13 {
+		return o, fmt.Errorf("Unsupported TLS version: %x", o.TLS.MinVersion)
+	}
+	for _, id := range o.TLS.CipherSuites {
+		if !isCipherSuite(id) {
+			return o, fmt.Errorf("Unsupported cipher suite: %x", id)
+		}
+	}
+	if o.Timeouts.ReadHeader < 0 || o.Timeouts.Read < 0 || o.Timeouts.Write < 0 || o.Timeouts.Idle < 0 {
+		return o, fmt.Errorf("Timeouts can not be negative")
+	}
+	if o.Timeouts.ReadHeader == 0 {
+		o.Timeouts.ReadHeader = DefaultReadHeaderTimeout
+	}
+	if o.Timeouts.Idle == 0 {
+		o.Timeouts.Idle = DefaultIdleTimeout
+	}
+	if o.ACME != nil {
+		// Don't change the options of the caller
+		acme := *o.ACME
+		if err := parseACME(&acme); err != nil {
+			return o, err
+		}
+		o.ACME = &acme
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
+
+func isCipherSuite(id uint16) bool {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, cs := range suites {
+			if cs.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// supportsHTTP2 tells whether the cipher suites include the one HTTP/2 requires, see RFC 7540, section 9.2.2
+func supportsHTTP2(suites []uint16) bool {
+	if len(suites) == 0 {
+		return true
+	}
+	for _, id := range suites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestServer(t *testing.T) { TestingT(t) }
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+var hello = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("hello"))
+})
+
+func (s *ServerSuite) TestSNI(c *C) {
+	a, b := newCertificate(c, "a.example.com"), newCertificate(c, "*.b.example.com", "b.example.com")
+	srv, addr := s.serve(c, Options{Certificates: []tls.Certificate{a, b}})
+	defer srv.Close()
+
+	tcs := []struct {
+		serverName string
+		expected   string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"A.Example.Com", "a.example.com"},
+		{"b.example.com", "*.b.example.com"},
+		{"x.b.example.com", "*.b.example.com"},
+		// Wildcard matches one label only
+		{"y.x.b.example.com", "a.example.com"},
+		{"unknown.com", "a.example.com"},
+		{"", "a.example.com"},
+	}
+	for _, tc := range tcs {
+		c.Assert(s.peerName(c, addr, &tls.Config{ServerName: tc.serverName}), Equals, tc.expected, Commentf("%s", tc.serverName))
+	}
+}
+
+func (s *ServerSuite) TestServesRequests(c *C) {
+	srv, addr := s.serve(c, Options{Certificates: []tls.Certificate{newCertificate(c, "a.example.com")}})
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	re, err := client.Get("https://" + addr)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(re.ProtoMajor, Equals, 2)
+}
+
+// New connections get the new certificate, while the established ones keep working
+func (s *ServerSuite) TestReload(c *C) {
+	dir := c.MkDir()
+	pair := KeyPair{CertFile: filepath.Join(dir, "a.crt"), KeyFile: filepath.Join(dir, "a.key")}
+	writeKeyPair(c, pair, "a.example.com")
+
+	srv, addr := s.serve(c, Options{KeyPairs: []KeyPair{pair}})
+	defer srv.Close()
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := &http.Client{Transport: transport}
+	re, err := client.Get("https://" + addr)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.TLS.PeerCertificates[0].DNSNames, DeepEquals, []string{"a.example.com"})
+
+	writeKeyPair(c, pair, "renewed.example.com")
+	c.Assert(srv.Reload(), IsNil)
+	c.Assert(s.peerName(c, addr, &tls.Config{ServerName: "renewed.example.com"}), Equals, "renewed.example.com")
+
+	// Keep-alive connection is reused
+	re, err = client.Get("https://" + addr)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.TLS.PeerCertificates[0].DNSNames, DeepEquals, []string{"a.example.com"})
+
+	// Broken files are not loaded
+	c.Assert(ioutil.WriteFile(pair.CertFile, []byte("garbage"), 0600), IsNil)
+	c.Assert(srv.Reload(), NotNil)
+	c.Assert(s.peerName(c, addr, &tls.Config{ServerName: "renewed.example.com"}), Equals, "renewed.example.com")
+}
+
+func (s *ServerSuite) TestSetCertificates(c *C) {
+	srv, addr := s.serve(c, Options{Certificates: []tls.Certificate{newCertificate(c, "a.example.com")}})
+	defer srv.Close()
+
+	c.Assert(srv.SetCertificates([]tls.Certificate{newCertificate(c, "b.example.com")}), IsNil)
+	c.Assert(s.peerName(c, addr, &tls.Config{ServerName: "a.example.com"}), Equals, "b.example.com")
+
+	c.Assert(srv.SetCertificates(nil), NotNil)
+	c.Assert(s.peerName(c, addr, &tls.Config{ServerName: "a.example.com"}), Equals, "b.example.com")
+}
+
+func (s *ServerSuite) TestMinVersion(c *C) {
+	srv, addr := s.serve(c, Options{
+		Certificates: []tls.Certificate{newCertificate(c, "a.example.com")},
+		TLS:          TLS{MinVersion: tls.VersionTLS13},
+	})
+	defer srv.Close()
+
+	_, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	c.Assert(err, NotNil)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(conn.ConnectionState().Version, Equals, uint16(tls.VersionTLS13))
+}
+
+func (s *ServerSuite) TestCipherSuites(c *C) {
+	srv, addr := s.serve(c, Options{
+		Certificates: []tls.Certificate{newCertificate(c, "a.example.com")},
+		TLS:          TLS{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+	})
+	defer srv.Close()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(conn.ConnectionState().CipherSuite, Equals, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384)
+
+	// HTTP/2 requires AES-128-GCM, so the server falls back to HTTP/1.1
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2: true,
+	}}
+	re, err := client.Get("https://" + addr)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.ProtoMajor, Equals, 1)
+}
+
+func (s *ServerSuite) TestBadParams(c *C) {
+	certs := []tls.Certificate{newCertificate(c, "a.example.com")}
+
+	_, err := NewServer(nil, certs)
+	c.Assert(err, NotNil)
+
+	_, err = NewServer(hello, nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewServerWithOptions(hello, Options{KeyPairs: []KeyPair{{CertFile: "/no/such.crt", KeyFile: "/no/such.key"}}})
+	c.Assert(err, NotNil)
+
+	_, err = NewServerWithOptions(hello, Options{Certificates: certs, TLS: TLS{MinVersion: 1}})
+	c.Assert(err, NotNil)
+
+	_, err = NewServerWithOptions(hello, Options{Certificates: certs, TLS: TLS{CipherSuites: []uint16{0xffff}}})
+	c.Assert(err, NotNil)
+
+	_, err = NewServerWithOptions(hello, Options{Certificates: certs, Timeouts: Timeouts{Read: -1}})
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) serve(c *C, o Options) (*Server, string) {
+	srv, err := NewServerWithOptions(hello, o)
+	c.Assert(err, IsNil)
+	return srv, serve(c, srv)
+}
+
+func (s *ServerSuite) peerName(c *C, addr string, config *tls.Config) string {
+	return peerName(c, addr, config)
+}
+
+// serve starts the server on the local port and returns its address
+func serve(c *C, srv *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go srv.Serve(l)
+	return l.Addr().String()
+}
+
+// peerName returns the first name of the certificate the server has presented
+func peerName(c *C, addr string, config *tls.Config) string {
+	config.InsecureSkipVerify = true
+	conn, err := tls.Dial("tcp", addr, config)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].DNSNames[0]
+}
+
+func newCertificate(c *C, names ...string) tls.Certificate {
+	certPEM, keyPEM := newKeyPairPEM(c, names...)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	c.Assert(err, IsNil)
+	return cert
+}
+
+func writeKeyPair(c *C, pair KeyPair, names ...string) {
+	certPEM, keyPEM := newKeyPairPEM(c, names...)
+	c.Assert(ioutil.WriteFile(pair.CertFile, certPEM, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(pair.KeyFile, keyPEM, 0600), IsNil)
+}
+
+// newKeyPairPEM returns the self signed certificate for the names and its key
+func newKeyPairPEM(c *C, names ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
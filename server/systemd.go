@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment of systemd socket activation, see sd_listen_fds(3)
+const (
+	listenPidEnv     = "LISTEN_PID"
+	listenFdsEnv     = "LISTEN_FDS"
+	listenFdNamesEnv = "LISTEN_FDNAMES"
+)
+
+// systemdListeners takes over the sockets passed by systemd, so the server can listen on the privileged ports
+// without the privileges. Sockets are matched to the addresses by Listen, e.g. ListenStream=443 of the socket
+// unit is taken by ListenAndServe(":443"). The environment is cleared, so the child processes don't take
+// the sockets meant for this one.
+func systemdListeners() []net.Listener {
+	pid, err := strconv.Atoi(os.Getenv(listenPidEnv))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv(listenFdsEnv))
+	if err != nil || count <= 0 {
+		return nil
+	}
+	names := make([]string, count)
+	fdNames := strings.Split(os.Getenv(listenFdNamesEnv), ":")
+	for i := range names {
+		names[i] = "fd " + strconv.Itoa(listenFdsStart+i)
+		if i < len(fdNames) && fdNames[i] != "" {
+			names[i] = fdNames[i]
+		}
+	}
+	os.Unsetenv(listenPidEnv)
+	os.Unsetenv(listenFdsEnv)
+	os.Unsetenv(listenFdNamesEnv)
+	return inheritListeners(names)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SystemdSuite struct{}
+
+var _ = Suite(&SystemdSuite{})
+
+func (s *SystemdSuite) TestSocketActivation(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := l.Addr().String()
+	f, err := l.(*net.TCPListener).File()
+	c.Assert(err, IsNil)
+
+	// Like systemd, the shell sets LISTEN_PID to the pid of the process it executes
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`, os.Args[0], "-test.run=TestRestartHelper")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(withoutEnv(os.Environ(), listenPidEnv),
+		listenFdsEnv+"=1", listenFdNamesEnv+"=https", restartHelperEnv+"="+addr)
+	c.Assert(cmd.Start(), IsNil)
+	f.Close()
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	out, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "restarted")
+	c.Assert(cmd.Wait(), IsNil)
+}
+
+func (s *SystemdSuite) TestOtherProcessSockets(c *C) {
+	os.Setenv(listenPidEnv, strconv.Itoa(os.Getpid()+1))
+	os.Setenv(listenFdsEnv, "1")
+	defer os.Unsetenv(listenPidEnv)
+	defer os.Unsetenv(listenFdsEnv)
+
+	c.Assert(systemdListeners(), IsNil)
+	// Environment is left for the process the sockets are meant for
+	c.Assert(os.Getenv(listenFdsEnv), Equals, "1")
+}
+
+func (s *SystemdSuite) TestRestartDropsSystemdEnv(c *C) {
+	env := []string{"PATH=/bin", "LISTEN_PID=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=a:b", "VULCAN_LISTENERS=:443", "LISTEN_FDS_X=1"}
+	c.Assert(withoutEnv(env, InheritedListenersEnv, listenPidEnv, listenFdsEnv, listenFdNamesEnv), DeepEquals,
+		[]string{"PATH=/bin", "LISTEN_FDS_X=1"})
+}
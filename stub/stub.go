@@ -0,0 +1,182 @@
+// Middleware that replies with the canned responses, e.g. to stub out the endpoints that are not built yet
+package stub
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Response is returned to the requests with the matching method and path
+type Response struct {
+	// Request method, empty value matches all methods
+	Method string
+	// Regular expression matched against the URL path. Named groups are passed to the body template as .Params
+	Path string
+	// Response status code, 200 by default
+	StatusCode int
+	// Response headers, Content-Type is text/plain unless set here
+	Header http.Header
+	// Body template, see text/template. The template gets TemplateData, e.g. {"id": "{{.Params.id}}"}
+	Body string
+	// Simulated response time of the endpoint
+	Latency time.Duration
+	// Random delay in range [0, Jitter) added to the latency
+	Jitter time.Duration
+}
+
+// TemplateData is passed to the body templates
+type TemplateData struct {
+	Request *http.Request
+	// Named groups of the path expression
+	Params map[string]string
+	Query  url.Values
+	Header http.Header
+}
+
+// Stub replies with the first response matching the request, the requests that match no responses
+// are passed to the endpoints as usual:
+//
+//	s, _ := stub.NewStub([]stub.Response{{
+//		Method:  "GET",
+//		Path:    `^/users/(?P<id>\d+)$`,
+//		Header:  http.Header{"Content-Type": []string{"application/json"}},
+//		Body:    `{"id": {{.Params.id}}}`,
+//		Latency: 50 * time.Millisecond,
+//	}})
+type Stub struct {
+	responses []*response
+	options   Options
+}
+
+type Options struct {
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+type response struct {
+	Response
+	path *regexp.Regexp
+	body *template.Template
+}
+
+func NewStub(responses []Response) (*Stub, error) {
+	return NewStubWithOptions(responses, Options{})
+}
+
+func NewStubWithOptions(responses []Response, o Options) (*Stub, error) {
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("Provide at least one response")
+	}
+	out := make([]*response, len(responses))
+	for i, r := range responses {
+		compiled, err := compileResponse(r)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = compiled
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &Stub{responses: out, options: o}, nil
+}
+
+func (s *Stub) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	for _, re := range s.responses {
+		if re.Method != "" && re.Method != req.Method {
+			continue
+		}
+		match := re.path.FindStringSubmatch(req.URL.Path)
+		if match == nil {
+			continue
+		}
+		if err := s.wait(r, re); err != nil {
+			return nil, err
+		}
+		return re.render(r, match), nil
+	}
+	return nil, nil
+}
+
+func (s *Stub) ProcessResponse(r request.Request, a request.Attempt) {
+}
+
+// wait simulates the latency of the endpoint, returns early if the client has gone away
+func (s *Stub) wait(r request.Request, re *response) error {
+	delay := re.Latency
+	if re.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(re.Jitter)))
+	}
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-s.options.TimeProvider.After(delay):
+		return nil
+	case <-r.GetContext().Done():
+		return r.GetContext().Err()
+	}
+}
+
+func (re *response) render(r request.Request, match []string) *http.Response {
+	req := r.GetHttpRequest()
+	data := &TemplateData{
+		Request: req,
+		Params:  make(map[string]string),
+		Query:   req.URL.Query(),
+		Header:  req.Header,
+	}
+	for i, name := range re.path.SubexpNames() {
+		if name != "" {
+			data.Params[name] = match[i]
+		}
+	}
+	body := &bytes.Buffer{}
+	if err := re.body.Execute(body, data); err != nil {
+		log.Errorf("%s failed to render stub response: %s", r, err)
+		return netutils.NewTextResponse(req, http.StatusInternalServerError, "Failed to render stub response")
+	}
+	out := netutils.NewHttpResponse(req, re.StatusCode, body.Bytes(), "text/plain")
+	for name, values := range re.Header {
+		out.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+	return out
+}
+
+func compileResponse(r Response) (*response, error) {
+	if r.Path == "" {
+		return nil, fmt.Errorf("Provide path expression")
+	}
+	path, err := regexp.Compile(r.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Bad path expression %q: %s", r.Path, err)
+	}
+	body, err := template.New(r.Path).Option("missingkey=zero").Parse(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Bad body template for %q: %s", r.Path, err)
+	}
+	if r.StatusCode == 0 {
+		r.StatusCode = http.StatusOK
+	}
+	if r.StatusCode < 100 || r.StatusCode > 599 {
+		return nil, fmt.Errorf("Unsupported status code: %d", r.StatusCode)
+	}
+	if r.Latency < 0 || r.Jitter < 0 {
+		return nil, fmt.Errorf("Latency and jitter can not be negative")
+	}
+	r.Method = strings.ToUpper(r.Method)
+	return &response{Response: r, path: path, body: body}, nil
+}
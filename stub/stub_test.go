@@ -0,0 +1,139 @@
+package stub
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestStub(t *testing.T) { TestingT(t) }
+
+type StubSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&StubSuite{})
+
+func (s *StubSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *StubSuite) TestTemplate(c *C) {
+	st, err := NewStubWithOptions([]Response{{
+		Method:     "get",
+		Path:       `^/users/(?P<id>\d+)$`,
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       `{"id": {{.Params.id}}, "q": "{{.Query.Get "q"}}", "agent": "{{.Header.Get "User-Agent"}}"}`,
+	}}, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("GET", "/users/42?q=hi")
+	r.GetHttpRequest().Header.Set("User-Agent", "curl")
+	re, err := st.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusCreated)
+	c.Assert(re.Header.Get("Content-Type"), Equals, "application/json")
+	c.Assert(readBody(c, re), Equals, `{"id": 42, "q": "hi", "agent": "curl"}`)
+
+	// Other methods and paths are passed through
+	re, err = st.ProcessRequest(makeRequest("POST", "/users/42"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	re, err = st.ProcessRequest(makeRequest("GET", "/users/bob"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+}
+
+func (s *StubSuite) TestFirstMatchWins(c *C) {
+	st, err := NewStub([]Response{
+		{Path: `^/a$`, Body: "a"},
+		{Path: `^/`, Body: "any"},
+	})
+	c.Assert(err, IsNil)
+
+	re, err := st.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(readBody(c, re), Equals, "a")
+	c.Assert(re.Header.Get("Content-Type"), Equals, "text/plain")
+
+	re, err = st.ProcessRequest(makeRequest("DELETE", "/b"))
+	c.Assert(err, IsNil)
+	c.Assert(readBody(c, re), Equals, "any")
+}
+
+func (s *StubSuite) TestLatency(c *C) {
+	st, err := NewStubWithOptions([]Response{{Path: `^/`, Latency: time.Second}}, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	start := s.tm.UtcNow()
+	re, err := st.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, time.Second)
+}
+
+func (s *StubSuite) TestClientGone(c *C) {
+	st, err := NewStub([]Response{{Path: `^/`, Latency: time.Hour}})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("GET", "/a")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.SetContext(ctx)
+	re, err := st.ProcessRequest(r)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(re, IsNil)
+}
+
+func (s *StubSuite) TestRenderError(c *C) {
+	st, err := NewStub([]Response{{Path: `^/`, Body: `{{.Request.Nope}}`}})
+	c.Assert(err, IsNil)
+
+	re, err := st.ProcessRequest(makeRequest("GET", "/a"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusInternalServerError)
+}
+
+func (s *StubSuite) TestBadParams(c *C) {
+	bad := [][]Response{
+		nil,
+		{{Path: ""}},
+		{{Path: `(`}},
+		{{Path: `^/`, Body: "{{"}},
+		{{Path: `^/`, StatusCode: 1000}},
+		{{Path: `^/`, Latency: -1}},
+	}
+	for _, responses := range bad {
+		_, err := NewStub(responses)
+		c.Assert(err, NotNil)
+	}
+}
+
+func makeRequest(method, uri string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     method,
+		Host:       "localhost",
+		URL:        netutils.MustParseUrl("http://localhost" + uri),
+		RequestURI: uri,
+		Header:     http.Header{},
+	}, 1, nil)
+}
+
+func readBody(c *C, re *http.Response) string {
+	defer re.Body.Close()
+	out, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(out)
+}
@@ -0,0 +1,228 @@
+// Middleware that slows down the responses to the abusive clients
+package tarpit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/threshold"
+)
+
+// Tarpit delays the responses to the flagged clients and drip-feeds the body a few bytes at a time,
+// raising the cost of the abuse without blocking the clients outright. Clients are flagged by the predicate,
+// e.g. scanner user agents, or by the number of the failed authentication attempts:
+//
+//	scanner := func(r request.Request) bool {
+//		return strings.Contains(r.GetHttpRequest().UserAgent(), "sqlmap")
+//	}
+//	t, _ := tarpit.NewTarpitWithOptions(scanner, tarpit.Options{MaxAuthFailures: 5})
+//	location.GetMiddlewareChain().Add("tarpit", -10, t)
+//
+// Add the tarpit before the authentication middlewares, so it sees the requests they reject.
+// Enable streaming on the location, so the drip-fed bytes are flushed to the client as they are sent.
+type Tarpit struct {
+	predicate threshold.Predicate
+	options   Options
+	mutex     *sync.Mutex
+	// Failed authentication attempts by client address, nil if not tracked
+	failures *ttlmap.TtlMap
+}
+
+type Options struct {
+	// Clients that got this many 401 or 403 responses within AuthFailurePeriod are tarpitted, 0 disables tracking
+	MaxAuthFailures int
+	// How long the failures are remembered since the last one, DefaultAuthFailurePeriod by default
+	AuthFailurePeriod time.Duration
+	// Maximum number of tracked clients, DefaultCapacity by default
+	Capacity int
+	// Delay before the request of the tarpitted client is processed, DefaultDelay by default
+	Delay time.Duration
+	// Bytes of the body sent every Interval, DefaultChunkSize by default
+	ChunkSize int
+	// DefaultInterval by default
+	Interval time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultAuthFailurePeriod = 10 * time.Minute
+	DefaultCapacity          = 65536
+	DefaultDelay             = 5 * time.Second
+	DefaultChunkSize         = 16
+	DefaultInterval          = time.Second
+)
+
+func NewTarpit(p threshold.Predicate) (*Tarpit, error) {
+	return NewTarpitWithOptions(p, Options{})
+}
+
+func NewTarpitWithOptions(p threshold.Predicate, o Options) (*Tarpit, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil && o.MaxAuthFailures == 0 {
+		return nil, fmt.Errorf("Provide predicate or max auth failures")
+	}
+	t := &Tarpit{predicate: p, options: o, mutex: &sync.Mutex{}}
+	if o.MaxAuthFailures > 0 {
+		if t.failures, err = ttlmap.NewMapWithProvider(o.Capacity, o.TimeProvider); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Tarpit) ProcessRequest(r request.Request) (*http.Response, error) {
+	// Failover attempts are flagged by the first one
+	if _, ok := r.GetUserData(clientKey); ok {
+		return nil, nil
+	}
+	client := ""
+	if ip := r.GetClientIP(); ip != nil {
+		client = ip.String()
+	}
+	r.SetUserData(clientKey, client)
+	if (t.predicate == nil || !t.predicate(r)) && !t.isOffender(client) {
+		return nil, nil
+	}
+	log.Infof("%s from %s is tarpitted", r, client)
+	r.SetUserData(tarpitKey, true)
+	// The endpoint is not involved yet, so only the client is kept waiting
+	return nil, t.wait(r.GetContext(), t.options.Delay)
+}
+
+// ProcessResponse counts the failed authentication attempts, both rejected by the middlewares and by the endpoints
+func (t *Tarpit) ProcessResponse(r request.Request, a request.Attempt) {
+	v, ok := r.GetUserData(clientKey)
+	if !ok || a == nil {
+		return
+	}
+	status := 0
+	if a.GetResponse() != nil {
+		status = a.GetResponse().StatusCode
+	} else if e, ok := a.GetError().(errors.ProxyError); ok {
+		status = e.GetStatusCode()
+	}
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		t.recordFailure(v.(string))
+	}
+}
+
+// ModifyResponse drip-feeds the response body to the tarpitted clients
+func (t *Tarpit) ModifyResponse(r request.Request, re *http.Response) error {
+	if _, ok := r.GetUserData(tarpitKey); !ok || re.Body == nil {
+		return nil
+	}
+	re.Body = &dripBody{ReadCloser: re.Body, tarpit: t, ctx: r.GetContext()}
+	return nil
+}
+
+// GetAuthFailures returns the number of the failed authentication attempts of the client
+func (t *Tarpit) GetAuthFailures(client string) int {
+	if t.failures == nil || client == "" {
+		return 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	v, ok := t.failures.Get(client)
+	if !ok {
+		return 0
+	}
+	return v.(int)
+}
+
+func (t *Tarpit) isOffender(client string) bool {
+	return t.options.MaxAuthFailures > 0 && t.GetAuthFailures(client) >= t.options.MaxAuthFailures
+}
+
+func (t *Tarpit) recordFailure(client string) {
+	if t.failures == nil || client == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	count := 0
+	if v, ok := t.failures.Get(client); ok {
+		count = v.(int)
+	}
+	if err := t.failures.Set(client, count+1, int(t.options.AuthFailurePeriod/time.Second)); err != nil {
+		log.Errorf("Failed to record auth failure of %s: %s", client, err)
+	}
+}
+
+func (t *Tarpit) wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-t.options.TimeProvider.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dripBody returns at most ChunkSize bytes per read and waits Interval before every read but the first one
+type dripBody struct {
+	io.ReadCloser
+	tarpit  *Tarpit
+	ctx     context.Context
+	started bool
+}
+
+func (b *dripBody) Read(p []byte) (int, error) {
+	if b.started {
+		if err := b.tarpit.wait(b.ctx, b.tarpit.options.Interval); err != nil {
+			return 0, err
+		}
+	}
+	b.started = true
+	if len(p) > b.tarpit.options.ChunkSize {
+		p = p[:b.tarpit.options.ChunkSize]
+	}
+	return b.ReadCloser.Read(p)
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MaxAuthFailures < 0 || o.AuthFailurePeriod < 0 || o.Capacity < 0 {
+		return o, fmt.Errorf("Auth failure settings can not be negative")
+	}
+	if o.Delay < 0 || o.ChunkSize < 0 || o.Interval < 0 {
+		return o, fmt.Errorf("Delay, chunk size and interval can not be negative")
+	}
+	if o.AuthFailurePeriod == 0 {
+		o.AuthFailurePeriod = DefaultAuthFailurePeriod
+	}
+	if o.AuthFailurePeriod < time.Second {
+		return o, fmt.Errorf("Auth failure period should be at least one second")
+	}
+	if o.Capacity == 0 {
+		o.Capacity = DefaultCapacity
+	}
+	if o.Delay == 0 {
+		o.Delay = DefaultDelay
+	}
+	if o.ChunkSize == 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.Interval == 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
+
+const (
+	clientKey = "__tarpit.client"
+	tarpitKey = "__tarpit.tarpit"
+)
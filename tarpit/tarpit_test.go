@@ -0,0 +1,181 @@
+package tarpit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestTarpit(t *testing.T) { TestingT(t) }
+
+type TarpitSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&TarpitSuite{})
+
+func (s *TarpitSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func isScanner(r request.Request) bool {
+	return strings.Contains(r.GetHttpRequest().UserAgent(), "sqlmap")
+}
+
+func (s *TarpitSuite) TestPredicate(c *C) {
+	t, err := NewTarpitWithOptions(isScanner, Options{
+		Delay:        3 * time.Second,
+		ChunkSize:    2,
+		Interval:     time.Second,
+		TimeProvider: s.tm,
+	})
+	c.Assert(err, IsNil)
+
+	// Regular clients are not affected
+	start := s.tm.UtcNow()
+	r := makeRequest("1.2.3.4:5678")
+	re := s.roundTrip(c, t, r, http.StatusOK, "hello")
+	c.Assert(readBody(c, re), Equals, "hello")
+	c.Assert(s.tm.UtcNow(), Equals, start)
+
+	r = makeRequest("1.2.3.4:5678")
+	r.GetHttpRequest().Header.Set("User-Agent", "sqlmap/1.0")
+	re = s.roundTrip(c, t, r, http.StatusOK, "hello")
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, 3*time.Second)
+
+	// Body is sent 2 bytes per second
+	buf := make([]byte, 10)
+	n, err := re.Body.Read(buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf[:n]), Equals, "he")
+	c.Assert(readBody(c, re), Equals, "llo")
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, 6*time.Second)
+}
+
+func (s *TarpitSuite) TestAuthFailures(c *C) {
+	t, err := NewTarpitWithOptions(nil, Options{
+		MaxAuthFailures:   2,
+		AuthFailurePeriod: time.Minute,
+		TimeProvider:      s.tm,
+	})
+	c.Assert(err, IsNil)
+
+	// Failures rejected by the endpoint and by the auth middleware are counted
+	s.roundTrip(c, t, makeRequest("1.2.3.4:5678"), http.StatusForbidden, "")
+	r := makeRequest("1.2.3.4:5678")
+	re, err := t.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	t.ProcessResponse(r, &request.BaseAttempt{Error: &errors.AuthError{Reason: "bad token"}})
+	c.Assert(t.GetAuthFailures("1.2.3.4"), Equals, 2)
+
+	start := s.tm.UtcNow()
+	s.roundTrip(c, t, makeRequest("1.2.3.4:5678"), http.StatusOK, "")
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, DefaultDelay)
+
+	// Other clients are not affected
+	start = s.tm.UtcNow()
+	s.roundTrip(c, t, makeRequest("5.6.7.8:5678"), http.StatusOK, "")
+	c.Assert(s.tm.UtcNow(), Equals, start)
+
+	// Failures are forgotten after the period
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(2 * time.Minute)
+	c.Assert(t.GetAuthFailures("1.2.3.4"), Equals, 0)
+}
+
+// Clients behind the trusted proxies are told apart by the address of the request
+func (s *TarpitSuite) TestRequestClientIP(c *C) {
+	t, err := NewTarpitWithOptions(nil, Options{MaxAuthFailures: 1, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	trusted, err := netutils.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("10.0.0.1:5678")
+	r.GetHttpRequest().Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.(*request.BaseRequest).TrustedProxies = trusted
+	s.roundTrip(c, t, r, http.StatusForbidden, "")
+	c.Assert(t.GetAuthFailures("1.2.3.4"), Equals, 1)
+	c.Assert(t.GetAuthFailures("10.0.0.1"), Equals, 0)
+}
+
+func (s *TarpitSuite) TestFailoverIsNotDelayedAgain(c *C) {
+	t, err := NewTarpitWithOptions(isScanner, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4:5678")
+	r.GetHttpRequest().Header.Set("User-Agent", "sqlmap/1.0")
+	start := s.tm.UtcNow()
+	_, err = t.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	_, err = t.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(s.tm.UtcNow().Sub(start), Equals, DefaultDelay)
+}
+
+func (s *TarpitSuite) TestClientGone(c *C) {
+	t, err := NewTarpitWithOptions(isScanner, Options{Delay: time.Hour})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4:5678")
+	r.GetHttpRequest().Header.Set("User-Agent", "sqlmap/1.0")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.SetContext(ctx)
+	_, err = t.ProcessRequest(r)
+	c.Assert(err, Equals, context.Canceled)
+}
+
+func (s *TarpitSuite) TestBadParams(c *C) {
+	_, err := NewTarpit(nil)
+	c.Assert(err, NotNil)
+
+	bad := []Options{
+		{MaxAuthFailures: -1},
+		{MaxAuthFailures: 1, AuthFailurePeriod: time.Millisecond},
+		{MaxAuthFailures: 1, Delay: -1},
+	}
+	for _, o := range bad {
+		_, err := NewTarpitWithOptions(nil, o)
+		c.Assert(err, NotNil)
+	}
+}
+
+// roundTrip emulates the request proxied to the endpoint that replies with the given status
+func (s *TarpitSuite) roundTrip(c *C, t *Tarpit, r request.Request, status int, body string) *http.Response {
+	re, err := t.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	re = netutils.NewTextResponse(r.GetHttpRequest(), status, body)
+	t.ProcessResponse(r, &request.BaseAttempt{Response: re})
+	c.Assert(t.ModifyResponse(r, re), IsNil)
+	return re
+}
+
+func makeRequest(remoteAddr string) request.Request {
+	return request.NewBaseRequest(&http.Request{
+		Method:     "GET",
+		Host:       "localhost",
+		RemoteAddr: remoteAddr,
+		URL:        netutils.MustParseUrl("http://localhost/a"),
+		RequestURI: "/a",
+		Header:     http.Header{},
+	}, 1, nil)
+}
+
+func readBody(c *C, re *http.Response) string {
+	defer re.Body.Close()
+	out, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(out)
+}
@@ -23,6 +23,7 @@ func ParseExpression(in string) (Predicate, error) {
 		Functions: map[string]interface{}{
 			"RequestMethod":  RequestMethod,
 			"IsNetworkError": IsNetworkError,
+			"IsIdempotent":   IsIdempotent,
 			"Attempts":       Attempts,
 			"ResponseCode":   ResponseCode,
 		},
@@ -332,3 +332,35 @@ func (s *ThresholdSuite) TestInvalidCases(c *C) {
 		c.Assert(p, IsNil)
 	}
 }
+
+func (s *ThresholdSuite) TestIsIdempotent(c *C) {
+	p, err := ParseExpression(`IsIdempotent() && IsNetworkError()`)
+	c.Assert(err, IsNil)
+
+	failed := []Attempt{&BaseAttempt{Error: fmt.Errorf("Something failed")}}
+	c.Assert(p(&BaseRequest{HttpRequest: &http.Request{Method: "PUT"}, Attempts: failed}), Equals, true)
+	c.Assert(p(&BaseRequest{HttpRequest: &http.Request{Method: "POST"}, Attempts: failed}), Equals, false)
+}
+
+func (s *ThresholdSuite) TestFailoverPolicy(c *C) {
+	_, err := FailoverPolicy{}.Predicate()
+	c.Assert(err, NotNil)
+
+	p, err := DefaultFailoverPolicy.Predicate()
+	c.Assert(err, IsNil)
+
+	attempt := func(code int) Attempt {
+		return &BaseAttempt{Response: &http.Response{StatusCode: code}}
+	}
+	get := &http.Request{Method: "GET"}
+
+	c.Assert(p(&BaseRequest{HttpRequest: get, Attempts: []Attempt{attempt(503)}}), Equals, true)
+	c.Assert(p(&BaseRequest{HttpRequest: get, Attempts: []Attempt{attempt(500)}}), Equals, false)
+	c.Assert(p(&BaseRequest{HttpRequest: get, Attempts: []Attempt{&BaseAttempt{Error: fmt.Errorf("oops")}}}), Equals, true)
+
+	// Non idempotent request is not retried
+	c.Assert(p(&BaseRequest{HttpRequest: &http.Request{Method: "POST"}, Attempts: []Attempt{attempt(503)}}), Equals, false)
+
+	// Attempts are exhausted
+	c.Assert(p(&BaseRequest{HttpRequest: get, Attempts: []Attempt{attempt(503), attempt(503), attempt(503)}}), Equals, false)
+}
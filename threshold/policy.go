@@ -0,0 +1,54 @@
+package threshold
+
+import (
+	"fmt"
+)
+
+// FailoverPolicy is a structured alternative to the failover expression,
+// it defines the attempts that are retried on the next endpoint.
+type FailoverPolicy struct {
+	// Maximum number of attempts including the first one
+	MaxAttempts int
+	// Retry on network errors, including timeouts
+	NetworkErrors bool
+	// Retry on these response codes, e.g. 502, 503 and 504
+	ResponseCodes []int
+	// Retry idempotent requests only, e.g. GET, PUT or DELETE, but not POST
+	IdempotentOnly bool
+}
+
+// Retry GET requests on network errors and gateway errors up to 3 attempts
+var DefaultFailoverPolicy = FailoverPolicy{
+	MaxAttempts:    3,
+	NetworkErrors:  true,
+	ResponseCodes:  []int{502, 503, 504},
+	IdempotentOnly: true,
+}
+
+// Predicate converts the policy into the failover predicate
+func (p FailoverPolicy) Predicate() (Predicate, error) {
+	if p.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("MaxAttempts should be > 0")
+	}
+	conditions := []Predicate{}
+	if p.NetworkErrors {
+		conditions = append(conditions, IsNetworkError())
+	}
+	for _, code := range p.ResponseCodes {
+		eq, err := EQ(ResponseCode(), code)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, eq)
+	}
+
+	attempts, err := LT(Attempts(), p.MaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	predicates := []Predicate{attempts, OR(conditions...)}
+	if p.IdempotentOnly {
+		predicates = append(predicates, IsIdempotent())
+	}
+	return AND(predicates...), nil
+}
@@ -5,6 +5,7 @@ Examples:
 
 * RequestMethod() == "GET" triggers action when request method equals "GET"
 * IsNetworkError() - triggers action on network errors
+* IsIdempotent() - triggers action for idempotent request methods, e.g. GET, PUT or DELETE
 * RequestMethod() == "GET" && Attempts <= 2 && (IsNetworkError() || ResponseCode() == 408)
   This predicate triggers for GET requests with maximum 2 attempts
   on network errors or when upstream returns special http response code 408
@@ -66,6 +67,18 @@ func IsNetworkError() Predicate {
 	}
 }
 
+// IsIdempotent returns a predicate that returns true if the request method is idempotent,
+// so the request can be safely sent to the next endpoint, e.g. GET or PUT but not POST.
+func IsIdempotent() Predicate {
+	return func(r request.Request) bool {
+		switch r.GetHttpRequest().Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+			return true
+		}
+		return false
+	}
+}
+
 // AND returns predicate by joining the passed predicates with logical 'and'
 func AND(fns ...Predicate) Predicate {
 	return func(req request.Request) bool {
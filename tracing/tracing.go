@@ -0,0 +1,177 @@
+// Distributed tracing middleware that propagates Zipkin B3 headers to the endpoints
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Span describes a single attempt to proxy the request to the endpoint
+type Span struct {
+	// Shared by all spans of the request, taken from the client or generated by the proxy
+	TraceId string
+	// Unique for every attempt
+	SpanId string
+	// Span id sent by the client, empty if the proxy has started the trace
+	ParentId string
+	// Name of the span, the request method
+	Name string
+	// Id of the endpoint the attempt was proxied to
+	Endpoint string
+	Start    time.Time
+	Duration time.Duration
+	// Response status code, 0 if the attempt has failed without response
+	StatusCode int
+	// Error of the failed attempt
+	Error error
+}
+
+// Reporter ships the finished spans, e.g. to the Zipkin collector.
+// Report is called on the request path, so implementations should not block.
+type Reporter interface {
+	Report(Span)
+}
+
+// ReporterFunc adapts the function to the Reporter interface
+type ReporterFunc func(Span)
+
+func (f ReporterFunc) Report(s Span) {
+	f(s)
+}
+
+// Tracer is a middleware that joins the trace sent by the client in B3 headers or starts a new one,
+// sends a new span id to the endpoint with every attempt and reports the spans once the attempts complete.
+type Tracer struct {
+	reporter Reporter
+	options  Options
+}
+
+type Options struct {
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+func NewTracer(r Reporter) (*Tracer, error) {
+	return NewTracerWithOptions(r, Options{})
+}
+
+func NewTracerWithOptions(r Reporter, o Options) (*Tracer, error) {
+	if r == nil {
+		return nil, fmt.Errorf("Provide reporter")
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &Tracer{reporter: r, options: o}, nil
+}
+
+func (t *Tracer) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	tr := t.getTrace(r)
+	s := &Span{
+		TraceId:  tr.traceId,
+		SpanId:   newId(),
+		ParentId: tr.parentId,
+		Name:     req.Method,
+		Start:    t.options.TimeProvider.UtcNow(),
+	}
+	r.SetUserData(spanKey, s)
+
+	req.Header.Set(headers.XB3TraceId, s.TraceId)
+	req.Header.Set(headers.XB3SpanId, s.SpanId)
+	if s.ParentId != "" {
+		req.Header.Set(headers.XB3ParentSpanId, s.ParentId)
+	} else {
+		req.Header.Del(headers.XB3ParentSpanId)
+	}
+	if tr.sampled {
+		req.Header.Set(headers.XB3Sampled, "1")
+	} else {
+		req.Header.Set(headers.XB3Sampled, "0")
+	}
+	return nil, nil
+}
+
+func (t *Tracer) ProcessResponse(r request.Request, a request.Attempt) {
+	v, ok := r.GetUserData(spanKey)
+	if !ok {
+		return
+	}
+	r.DeleteUserData(spanKey)
+	tr, _ := r.GetUserData(traceKey)
+	if !tr.(*trace).sampled {
+		return
+	}
+
+	s := v.(*Span)
+	s.Duration = t.options.TimeProvider.UtcNow().Sub(s.Start)
+	if a != nil {
+		if a.GetEndpoint() != nil {
+			s.Endpoint = a.GetEndpoint().GetId()
+		}
+		if a.GetResponse() != nil {
+			s.StatusCode = a.GetResponse().StatusCode
+		}
+		s.Error = a.GetError()
+	}
+	t.reporter.Report(*s)
+}
+
+// trace is shared by all attempts of the request
+type trace struct {
+	traceId  string
+	parentId string
+	sampled  bool
+}
+
+// getTrace reads the B3 headers of the client once, so all attempts of the request get the same trace
+func (t *Tracer) getTrace(r request.Request) *trace {
+	if v, ok := r.GetUserData(traceKey); ok {
+		return v.(*trace)
+	}
+	h := r.GetHttpRequest().Header
+	tr := &trace{
+		traceId:  h.Get(headers.XB3TraceId),
+		parentId: h.Get(headers.XB3SpanId),
+		sampled:  h.Get(headers.XB3Sampled) != "0",
+	}
+	if tr.traceId == "" {
+		tr.traceId = newId()
+		tr.parentId = ""
+	} else if !validId.MatchString(tr.traceId) {
+		log.Warningf("%s has invalid trace id %q, starting a new trace", r, tr.traceId)
+		tr.traceId = newId()
+		tr.parentId = ""
+	}
+	if tr.parentId != "" && !validId.MatchString(tr.parentId) {
+		tr.parentId = ""
+	}
+	r.SetUserData(traceKey, tr)
+	return tr
+}
+
+// newId returns random 64 bit id encoded as 16 hex characters
+func newId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// B3 ids are 64 or 128 bit lower hex strings
+var validId = regexp.MustCompile(`^([0-9a-f]{16}|[0-9a-f]{32})$`)
+
+const (
+	traceKey = "__tracing.trace"
+	spanKey  = "__tracing.span"
+)
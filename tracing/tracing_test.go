@@ -0,0 +1,134 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestTracing(t *testing.T) { TestingT(t) }
+
+type TracingSuite struct {
+	tm    *timetools.FreezedTime
+	spans []Span
+}
+
+var _ = Suite(&TracingSuite{})
+
+func (s *TracingSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	s.spans = nil
+}
+
+func (s *TracingSuite) newTracer(c *C) *Tracer {
+	t, err := NewTracerWithOptions(ReporterFunc(func(sp Span) {
+		s.spans = append(s.spans, sp)
+	}), Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	return t
+}
+
+// Proxy starts a new trace and every attempt gets its own span
+func (s *TracingSuite) TestNewTrace(c *C) {
+	t := s.newTracer(c)
+	r := makeRequest(http.Header{})
+
+	out1 := s.attempt(c, t, r, &request.BaseAttempt{Error: fmt.Errorf("connection refused")})
+	out2 := s.attempt(c, t, r, &request.BaseAttempt{
+		Endpoint: endpoint.MustParseUrl("http://localhost:5000"),
+		Response: &http.Response{StatusCode: 200},
+	})
+
+	c.Assert(validId.MatchString(out1.Get("X-B3-TraceId")), Equals, true)
+	c.Assert(out1.Get("X-B3-TraceId"), Equals, out2.Get("X-B3-TraceId"))
+	c.Assert(out1.Get("X-B3-SpanId"), Not(Equals), out2.Get("X-B3-SpanId"))
+	c.Assert(out1.Get("X-B3-ParentSpanId"), Equals, "")
+	c.Assert(out1.Get("X-B3-Sampled"), Equals, "1")
+
+	c.Assert(len(s.spans), Equals, 2)
+	c.Assert(s.spans[0].SpanId, Equals, out1.Get("X-B3-SpanId"))
+	c.Assert(s.spans[0].Error, NotNil)
+	c.Assert(s.spans[0].Duration, Equals, 10*time.Millisecond)
+	c.Assert(s.spans[1].SpanId, Equals, out2.Get("X-B3-SpanId"))
+	c.Assert(s.spans[1].Name, Equals, "GET")
+	c.Assert(s.spans[1].StatusCode, Equals, 200)
+	c.Assert(s.spans[1].Endpoint, Equals, "http://localhost:5000")
+}
+
+// Proxy joins the trace started by the client
+func (s *TracingSuite) TestJoinTrace(c *C) {
+	t := s.newTracer(c)
+	h := http.Header{}
+	h.Set("X-B3-TraceId", "463ac35c9f6413ad")
+	h.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	r := makeRequest(h)
+
+	out := s.attempt(c, t, r, &request.BaseAttempt{Response: &http.Response{StatusCode: 200}})
+	c.Assert(out.Get("X-B3-TraceId"), Equals, "463ac35c9f6413ad")
+	c.Assert(out.Get("X-B3-ParentSpanId"), Equals, "a2fb4a1d1a96d312")
+	c.Assert(out.Get("X-B3-SpanId"), Not(Equals), "a2fb4a1d1a96d312")
+
+	c.Assert(len(s.spans), Equals, 1)
+	c.Assert(s.spans[0].TraceId, Equals, "463ac35c9f6413ad")
+	c.Assert(s.spans[0].ParentId, Equals, "a2fb4a1d1a96d312")
+}
+
+// Spans of the traces the client has decided not to sample are not reported
+func (s *TracingSuite) TestNotSampled(c *C) {
+	t := s.newTracer(c)
+	h := http.Header{}
+	h.Set("X-B3-TraceId", "463ac35c9f6413ad")
+	h.Set("X-B3-Sampled", "0")
+
+	out := s.attempt(c, t, makeRequest(h), &request.BaseAttempt{Response: &http.Response{StatusCode: 200}})
+	c.Assert(out.Get("X-B3-Sampled"), Equals, "0")
+	c.Assert(len(s.spans), Equals, 0)
+}
+
+func (s *TracingSuite) TestInvalidTraceId(c *C) {
+	t := s.newTracer(c)
+	h := http.Header{}
+	h.Set("X-B3-TraceId", "bad")
+	h.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+
+	out := s.attempt(c, t, makeRequest(h), &request.BaseAttempt{Response: &http.Response{StatusCode: 200}})
+	c.Assert(validId.MatchString(out.Get("X-B3-TraceId")), Equals, true)
+	c.Assert(out.Get("X-B3-ParentSpanId"), Equals, "")
+}
+
+func (s *TracingSuite) TestBadParams(c *C) {
+	_, err := NewTracer(nil)
+	c.Assert(err, NotNil)
+}
+
+// attempt emulates the attempt that takes 10 milliseconds and returns the headers sent to the endpoint
+func (s *TracingSuite) attempt(c *C, t *Tracer, r request.Request, a request.Attempt) http.Header {
+	// Every attempt starts with the fresh copy of the client request
+	original := r.GetHttpRequest()
+	out := *original
+	out.Header = http.Header{}
+	for k, v := range original.Header {
+		out.Header[k] = v
+	}
+	r.SetHttpRequest(&out)
+	defer r.SetHttpRequest(original)
+
+	re, err := t.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(10 * time.Millisecond)
+	t.ProcessResponse(r, a)
+	return out.Header
+}
+
+func makeRequest(h http.Header) request.Request {
+	return request.NewBaseRequest(&http.Request{Method: "GET", Header: h}, 1, nil)
+}